@@ -0,0 +1,176 @@
+package gpt_bpe
+
+import (
+	"encoding/json"
+	"io"
+	"sort"
+	"unicode/utf8"
+)
+
+// TokenAlignment
+// The tokens of a target vocabulary that a token of a draft vocabulary maps
+// to, which decode to the same bytes. Exact is true when that is a single
+// token, and otherwise the draft token is split into Target.
+type TokenAlignment struct {
+	Draft  Token  `json:"draft"`
+	Target Tokens `json:"target"`
+	Exact  bool   `json:"exact"`
+}
+
+// VocabAlignment
+// The mapping from each token of a draft model's vocabulary to the tokens of
+// a target model's vocabulary, for speculative decoding across tokenizers,
+// where the draft model's tokens must be translated for the target model to
+// verify. Tokens are ordered by draft token, and Unmapped lists the draft
+// tokens that the target vocabulary cannot spell, such as special tokens
+// that it does not have.
+type VocabAlignment struct {
+	DraftFingerprint  string           `json:"draft_fingerprint"`
+	TargetFingerprint string           `json:"target_fingerprint"`
+	Exact             int              `json:"exact"`
+	Split             int              `json:"split"`
+	Unmapped          Tokens           `json:"unmapped"`
+	Tokens            []TokenAlignment `json:"tokens"`
+}
+
+// AlignVocabularies
+// Maps each token of the draft encoder's vocabulary to the tokens of the
+// target encoder's vocabulary that decode to the same bytes. A draft token is
+// split into the tokens that the target encodes its text to, or, when its
+// bytes are not whole characters, into the longest target tokens that each
+// of its bytes start. Special tokens map to the target's special token of the
+// same text. Aligning the vocabularies the other way around maps the tokens
+// that the target accepts back to the draft's.
+func AlignVocabularies(draft *GPTEncoder,
+	target *GPTEncoder) *VocabAlignment {
+	alignment := &VocabAlignment{
+		DraftFingerprint:  draft.Fingerprint(),
+		TargetFingerprint: target.Fingerprint(),
+		Unmapped:          make(Tokens, 0),
+		Tokens:            make([]TokenAlignment, 0, len(draft.decoder)),
+	}
+	draftSpecials := specialsByToken(draft)
+	targetSpecials := specialsByToken(target)
+	// The target's ordinary tokens, by their bytes.
+	targetByBytes := make(map[string]Token, len(target.decoder))
+	longest := 0
+	for token := range target.decoder {
+		if _, isSpecial := targetSpecials[token]; isSpecial {
+			continue
+		}
+		tokenBytes := string(target.TokenBytes(token))
+		// Of the ids of a duplicated string, the one that is encoded.
+		if chosen, ok := target.encoder[string(
+			target.decoder[token])]; ok {
+			token = chosen
+		}
+		targetByBytes[tokenBytes] = token
+		if len(tokenBytes) > longest {
+			longest = len(tokenBytes)
+		}
+	}
+
+	draftTokens := make(Tokens, 0, len(draft.decoder))
+	for token := range draft.decoder {
+		draftTokens = append(draftTokens, token)
+	}
+	sort.Slice(draftTokens, func(i, j int) bool {
+		return draftTokens[i] < draftTokens[j]
+	})
+	for _, token := range draftTokens {
+		var targetTokens Tokens
+		if special, isSpecial := draftSpecials[token]; isSpecial {
+			targetTokens = target.specials[special]
+		} else {
+			tokenBytes := string(draft.TokenBytes(token))
+			if exact, ok := targetByBytes[tokenBytes]; ok {
+				targetTokens = Tokens{exact}
+			} else {
+				targetTokens = target.spell(tokenBytes, targetByBytes,
+					targetSpecials, longest)
+			}
+		}
+		if len(targetTokens) == 0 {
+			alignment.Unmapped = append(alignment.Unmapped, token)
+			continue
+		}
+		exact := len(targetTokens) == 1
+		if exact {
+			alignment.Exact++
+		} else {
+			alignment.Split++
+		}
+		alignment.Tokens = append(alignment.Tokens, TokenAlignment{token,
+			append(Tokens{}, targetTokens...), exact})
+	}
+	return alignment
+}
+
+// specialsByToken returns the text of each of the encoder's special tokens,
+// by its token.
+func specialsByToken(encoder *GPTEncoder) map[Token]string {
+	specials := make(map[Token]string, len(encoder.specials))
+	for text, tokens := range encoder.specials {
+		if len(tokens) == 1 {
+			specials[tokens[0]] = text
+		}
+	}
+	return specials
+}
+
+// spell returns the tokens that text, the bytes of a token of another
+// vocabulary, encodes to, or nil if the vocabulary cannot spell it.
+func (encoder *GPTEncoder) spell(text string, byBytes map[string]Token,
+	specials map[Token]string, longest int) Tokens {
+	if text == "" {
+		return nil
+	}
+	if utf8.ValidString(text) {
+		encoded := *encoder.EncodeWithPolicy(&text, AddNever, AddNever)
+		spelled := encoder.Decode(&encoded) == text
+		for _, token := range encoded {
+			if _, isSpecial := specials[token]; isSpecial {
+				spelled = false
+			}
+		}
+		if spelled {
+			return encoded
+		}
+	}
+	// Partial characters, and text that the encoder normalizes, are spelled
+	// with the longest tokens that each position starts with.
+	tokens := make(Tokens, 0, len(text))
+	for begin := 0; begin < len(text); {
+		end := begin + longest
+		if end > len(text) {
+			end = len(text)
+		}
+		for ; end > begin; end-- {
+			if token, ok := byBytes[text[begin:end]]; ok {
+				tokens = append(tokens, token)
+				break
+			}
+		}
+		if end == begin {
+			return nil
+		}
+		begin = end
+	}
+	return tokens
+}
+
+// DraftToTarget
+// Returns the target tokens of each draft token that the alignment maps.
+func (alignment *VocabAlignment) DraftToTarget() map[Token]Tokens {
+	mapping := make(map[Token]Tokens, len(alignment.Tokens))
+	for _, tokenAlignment := range alignment.Tokens {
+		mapping[tokenAlignment.Draft] = tokenAlignment.Target
+	}
+	return mapping
+}
+
+// WriteJSON
+// Writes the alignment to writer as JSON, for inference stacks to load.
+func (alignment *VocabAlignment) WriteJSON(writer io.Writer) error {
+	return json.NewEncoder(writer).Encode(alignment)
+}
@@ -0,0 +1,82 @@
+package gpt_bpe
+
+import (
+	"bufio"
+	"io"
+	"math"
+	"strings"
+)
+
+// analysisBatchSize is the number of bytes of a corpus that AnalyzeCompression
+// encodes at a time, extended to the end of the line it falls in.
+const analysisBatchSize = 64 * 1024
+
+// CompressionStats
+// How well an encoder compresses a corpus. BitsPerByte treats the tokens as
+// a static code fit to the corpus, with each token costing the bits of its
+// frequency, which is the least that any static code over the tokens can
+// achieve, so lower is better when comparing vocabularies. RankBitsPerByte
+// instead costs each token the bits of the Elias gamma code of its rank,
+// which is its id in BPE vocabularies, and so needs no code table.
+type CompressionStats struct {
+	Bytes           int
+	Tokens          int
+	Distinct        int
+	BytesPerToken   float64
+	EntropyBits     float64
+	BitsPerByte     float64
+	RankBitsPerByte float64
+}
+
+// gammaBits returns the length of the Elias gamma code of the token's rank.
+func gammaBits(token Token) float64 {
+	return float64(2*int(math.Floor(math.Log2(float64(token)+1))) + 1)
+}
+
+// AnalyzeCompression
+// Encodes the corpus read from reader with the encoder, and returns how many
+// bits per byte its tokens take. The corpus is encoded in batches of whole
+// lines, so tokens never span batches.
+func AnalyzeCompression(encoder Encoder,
+	reader io.Reader) (*CompressionStats, error) {
+	counts := make(map[Token]int)
+	stats := &CompressionStats{}
+	rankBits := 0.0
+	bufReader := bufio.NewReader(reader)
+	var batch strings.Builder
+	flush := func() {
+		text := batch.String()
+		batch.Reset()
+		stats.Bytes += len(text)
+		for _, token := range *encoder.Encode(&text) {
+			counts[token]++
+			stats.Tokens++
+			rankBits += gammaBits(token)
+		}
+	}
+	for {
+		line, err := bufReader.ReadString('\n')
+		batch.WriteString(line)
+		if batch.Len() >= analysisBatchSize || err == io.EOF {
+			flush()
+		}
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+	}
+
+	stats.Distinct = len(counts)
+	if stats.Tokens == 0 || stats.Bytes == 0 {
+		return stats, nil
+	}
+	for _, count := range counts {
+		p := float64(count) / float64(stats.Tokens)
+		stats.EntropyBits -= p * math.Log2(p)
+	}
+	stats.BytesPerToken = float64(stats.Bytes) / float64(stats.Tokens)
+	stats.BitsPerByte = stats.EntropyBits / stats.BytesPerToken
+	stats.RankBitsPerByte = rankBits / float64(stats.Bytes)
+	return stats, nil
+}
@@ -0,0 +1,38 @@
+package gpt_bpe
+
+import (
+	"runtime"
+	"sync"
+)
+
+// EncodeBatch
+// Encodes each of texts, as Encode does, on at most workers goroutines at a
+// time, and returns their tokens in the order of texts. A workers of zero or
+// less uses a goroutine per CPU. The encoder's word cache is shared by the
+// workers.
+func (encoder *GPTEncoder) EncodeBatch(texts []string, workers int) []Tokens {
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	if workers > len(texts) {
+		workers = len(texts)
+	}
+	encoded := make([]Tokens, len(texts))
+	indexes := make(chan int, workers)
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for worker := 0; worker < workers; worker++ {
+		go func() {
+			defer wg.Done()
+			for idx := range indexes {
+				encoded[idx] = *encoder.Encode(&texts[idx])
+			}
+		}()
+	}
+	for idx := range texts {
+		indexes <- idx
+	}
+	close(indexes)
+	wg.Wait()
+	return encoded
+}
@@ -0,0 +1,130 @@
+package gpt_bpe
+
+import (
+	"sync"
+	"time"
+)
+
+// EncoderResolver
+// Resolves a vocabulary id to a fully constructed encoder, as NewEncoder
+// does.
+type EncoderResolver func(vocabId string) (*GPTEncoder, error)
+
+// cachedResolution is the resolution of a vocabulary id by a
+// CachingResolver, which is done once its encoder is built.
+type cachedResolution struct {
+	done        chan struct{}
+	encoder     *GPTEncoder
+	fingerprint string
+	err         error
+	built       time.Time
+}
+
+// CachingResolver
+// Wraps an EncoderResolver, and keeps the encoders that it builds in memory
+// for TTL after they are built, so that a long-lived process, such as a
+// serverless function whose instance is reused, pays for constructing an
+// encoder once rather than on every request. Encoders are kept by their
+// fingerprint, so ids that resolve to identical tokenizers share a single
+// encoder. Concurrent resolutions of an id wait on the one build, and failed
+// builds are not kept. As with SharedEncoder, the encoders are shared and
+// must be treated as read-only.
+type CachingResolver struct {
+	TTL         time.Duration
+	resolve     EncoderResolver
+	mtx         sync.Mutex
+	resolutions map[string]*cachedResolution
+	encoders    map[string]*GPTEncoder
+}
+
+// NewCachingResolver
+// Creates a CachingResolver of resolve, which keeps encoders for ttl after
+// they are built, or for as long as the process runs if ttl is zero.
+func NewCachingResolver(resolve EncoderResolver,
+	ttl time.Duration) *CachingResolver {
+	return &CachingResolver{
+		TTL:         ttl,
+		resolve:     resolve,
+		resolutions: make(map[string]*cachedResolution),
+		encoders:    make(map[string]*GPTEncoder),
+	}
+}
+
+// Resolve
+// Returns the encoder of the vocabulary id, building it with the wrapped
+// resolver unless one was built within the TTL.
+func (resolver *CachingResolver) Resolve(vocabId string) (*GPTEncoder,
+	error) {
+	resolver.mtx.Lock()
+	resolution, ok := resolver.resolutions[vocabId]
+	if ok && resolution.fingerprint != "" && resolver.TTL > 0 &&
+		time.Since(resolution.built) >= resolver.TTL {
+		ok = false
+	}
+	if !ok {
+		resolution = &cachedResolution{done: make(chan struct{})}
+		resolver.resolutions[vocabId] = resolution
+		resolver.mtx.Unlock()
+		resolver.build(vocabId, resolution)
+	} else {
+		resolver.mtx.Unlock()
+	}
+	<-resolution.done
+	return resolution.encoder, resolution.err
+}
+
+// build builds the encoder of the vocabulary id for resolution, keeping it
+// by its fingerprint, unless an identical encoder is already kept.
+func (resolver *CachingResolver) build(vocabId string,
+	resolution *cachedResolution) {
+	defer close(resolution.done)
+	encoder, err := resolver.resolve(vocabId)
+	resolver.mtx.Lock()
+	defer resolver.mtx.Unlock()
+	if err != nil {
+		resolution.err = err
+		if resolver.resolutions[vocabId] == resolution {
+			delete(resolver.resolutions, vocabId)
+		}
+		return
+	}
+	fingerprint := encoder.Fingerprint()
+	if kept, ok := resolver.encoders[fingerprint]; ok {
+		encoder = kept
+	} else {
+		resolver.encoders[fingerprint] = encoder
+	}
+	resolution.encoder = encoder
+	resolution.fingerprint = fingerprint
+	resolution.built = time.Now()
+	resolver.prune()
+}
+
+// prune drops the encoders that no resolution refers to any longer, as
+// when an id resolves to a changed tokenizer once its TTL has passed.
+func (resolver *CachingResolver) prune() {
+	referenced := make(map[string]bool, len(resolver.resolutions))
+	for _, resolution := range resolver.resolutions {
+		referenced[resolution.fingerprint] = true
+	}
+	for fingerprint := range resolver.encoders {
+		if !referenced[fingerprint] {
+			delete(resolver.encoders, fingerprint)
+		}
+	}
+}
+
+// Purge
+// Drops every encoder that is kept, so that the next resolution of each id
+// builds it anew.
+func (resolver *CachingResolver) Purge() {
+	resolver.mtx.Lock()
+	defer resolver.mtx.Unlock()
+	for vocabId, resolution := range resolver.resolutions {
+		// Builds in flight keep their resolutions, and finish as usual.
+		if resolution.fingerprint != "" {
+			delete(resolver.resolutions, vocabId)
+		}
+	}
+	resolver.prune()
+}
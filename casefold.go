@@ -0,0 +1,209 @@
+package gpt_bpe
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// CaseFolding
+// How text is case folded before it is split into words, for tokenizing
+// text case insensitively, such as for retrieval.
+type CaseFolding uint8
+
+const (
+	// CaseFoldNone leaves the case of text as it is, and is the default.
+	CaseFoldNone CaseFolding = iota
+	// CaseFoldFull folds text by the full Unicode case folding, which maps
+	// some characters to more than one, such as ß to ss, so that text
+	// differing only by case folds the same.
+	CaseFoldFull
+	// CaseFoldTurkic folds text as CaseFoldFull does, except that I folds to
+	// dotless ı and İ to i, as in Turkish and Azerbaijani.
+	CaseFoldTurkic
+)
+
+// fullCaseFolds are the characters that fold to more than one character by
+// the full case folding of the Unicode CaseFolding.txt, with status F.
+var fullCaseFolds = map[rune]string{
+	0x00DF: "\u0073\u0073",
+	0x0130: "\u0069\u0307",
+	0x0149: "\u02BC\u006E",
+	0x01F0: "\u006A\u030C",
+	0x0390: "\u03B9\u0308\u0301",
+	0x03B0: "\u03C5\u0308\u0301",
+	0x0587: "\u0565\u0582",
+	0x1E96: "\u0068\u0331",
+	0x1E97: "\u0074\u0308",
+	0x1E98: "\u0077\u030A",
+	0x1E99: "\u0079\u030A",
+	0x1E9A: "\u0061\u02BE",
+	0x1E9E: "\u0073\u0073",
+	0x1F50: "\u03C5\u0313",
+	0x1F52: "\u03C5\u0313\u0300",
+	0x1F54: "\u03C5\u0313\u0301",
+	0x1F56: "\u03C5\u0313\u0342",
+	0x1F80: "\u1F00\u03B9",
+	0x1F81: "\u1F01\u03B9",
+	0x1F82: "\u1F02\u03B9",
+	0x1F83: "\u1F03\u03B9",
+	0x1F84: "\u1F04\u03B9",
+	0x1F85: "\u1F05\u03B9",
+	0x1F86: "\u1F06\u03B9",
+	0x1F87: "\u1F07\u03B9",
+	0x1F88: "\u1F00\u03B9",
+	0x1F89: "\u1F01\u03B9",
+	0x1F8A: "\u1F02\u03B9",
+	0x1F8B: "\u1F03\u03B9",
+	0x1F8C: "\u1F04\u03B9",
+	0x1F8D: "\u1F05\u03B9",
+	0x1F8E: "\u1F06\u03B9",
+	0x1F8F: "\u1F07\u03B9",
+	0x1F90: "\u1F20\u03B9",
+	0x1F91: "\u1F21\u03B9",
+	0x1F92: "\u1F22\u03B9",
+	0x1F93: "\u1F23\u03B9",
+	0x1F94: "\u1F24\u03B9",
+	0x1F95: "\u1F25\u03B9",
+	0x1F96: "\u1F26\u03B9",
+	0x1F97: "\u1F27\u03B9",
+	0x1F98: "\u1F20\u03B9",
+	0x1F99: "\u1F21\u03B9",
+	0x1F9A: "\u1F22\u03B9",
+	0x1F9B: "\u1F23\u03B9",
+	0x1F9C: "\u1F24\u03B9",
+	0x1F9D: "\u1F25\u03B9",
+	0x1F9E: "\u1F26\u03B9",
+	0x1F9F: "\u1F27\u03B9",
+	0x1FA0: "\u1F60\u03B9",
+	0x1FA1: "\u1F61\u03B9",
+	0x1FA2: "\u1F62\u03B9",
+	0x1FA3: "\u1F63\u03B9",
+	0x1FA4: "\u1F64\u03B9",
+	0x1FA5: "\u1F65\u03B9",
+	0x1FA6: "\u1F66\u03B9",
+	0x1FA7: "\u1F67\u03B9",
+	0x1FA8: "\u1F60\u03B9",
+	0x1FA9: "\u1F61\u03B9",
+	0x1FAA: "\u1F62\u03B9",
+	0x1FAB: "\u1F63\u03B9",
+	0x1FAC: "\u1F64\u03B9",
+	0x1FAD: "\u1F65\u03B9",
+	0x1FAE: "\u1F66\u03B9",
+	0x1FAF: "\u1F67\u03B9",
+	0x1FB2: "\u1F70\u03B9",
+	0x1FB3: "\u03B1\u03B9",
+	0x1FB4: "\u03AC\u03B9",
+	0x1FB6: "\u03B1\u0342",
+	0x1FB7: "\u03B1\u0342\u03B9",
+	0x1FBC: "\u03B1\u03B9",
+	0x1FC2: "\u1F74\u03B9",
+	0x1FC3: "\u03B7\u03B9",
+	0x1FC4: "\u03AE\u03B9",
+	0x1FC6: "\u03B7\u0342",
+	0x1FC7: "\u03B7\u0342\u03B9",
+	0x1FCC: "\u03B7\u03B9",
+	0x1FD2: "\u03B9\u0308\u0300",
+	0x1FD3: "\u03B9\u0308\u0301",
+	0x1FD6: "\u03B9\u0342",
+	0x1FD7: "\u03B9\u0308\u0342",
+	0x1FE2: "\u03C5\u0308\u0300",
+	0x1FE3: "\u03C5\u0308\u0301",
+	0x1FE4: "\u03C1\u0313",
+	0x1FE6: "\u03C5\u0342",
+	0x1FE7: "\u03C5\u0308\u0342",
+	0x1FF2: "\u1F7C\u03B9",
+	0x1FF3: "\u03C9\u03B9",
+	0x1FF4: "\u03CE\u03B9",
+	0x1FF6: "\u03C9\u0342",
+	0x1FF7: "\u03C9\u0342\u03B9",
+	0x1FFC: "\u03C9\u03B9",
+	0xFB00: "\u0066\u0066",
+	0xFB01: "\u0066\u0069",
+	0xFB02: "\u0066\u006C",
+	0xFB03: "\u0066\u0066\u0069",
+	0xFB04: "\u0066\u0066\u006C",
+	0xFB05: "\u0073\u0074",
+	0xFB06: "\u0073\u0074",
+	0xFB13: "\u0574\u0576",
+	0xFB14: "\u0574\u0565",
+	0xFB15: "\u0574\u056B",
+	0xFB16: "\u057E\u0576",
+	0xFB17: "\u0574\u056D",
+}
+
+// foldRune writes the case folding of r to builder.
+func foldRune(builder *strings.Builder, r rune, folding CaseFolding) {
+	if folding == CaseFoldTurkic {
+		switch r {
+		case 'I':
+			builder.WriteRune('ı')
+			return
+		case 'İ':
+			builder.WriteRune('i')
+			return
+		}
+	}
+	if full, ok := fullCaseFolds[r]; ok {
+		builder.WriteString(full)
+		return
+	}
+	// Dotless ı folds to itself, though it is the lower case of I.
+	if r == 'ı' {
+		builder.WriteRune(r)
+		return
+	}
+	// The simple folding of a character is the lower case of its upper
+	// case, which folds the characters with more than one lower case, such
+	// as final ς, to the same one, except for Cherokee, which folds to its
+	// upper case.
+	upper := unicode.ToUpper(r)
+	if upper >= 0x13A0 && upper <= 0x13F5 {
+		builder.WriteRune(upper)
+	} else {
+		builder.WriteRune(unicode.ToLower(upper))
+	}
+}
+
+// CaseFold
+// Returns text case folded by folding, for comparing or tokenizing text
+// case insensitively the same way as an encoder that folds case.
+func CaseFold(text string, folding CaseFolding) string {
+	if folding == CaseFoldNone {
+		return text
+	}
+	var builder strings.Builder
+	builder.Grow(len(text))
+	for _, r := range text {
+		foldRune(&builder, r, folding)
+	}
+	return builder.String()
+}
+
+// CaseFolding
+// Returns how the encoder case folds text before it is split into words.
+func (encoder *GPTEncoder) CaseFolding() CaseFolding {
+	return encoder.caseFolding
+}
+
+// SetCaseFolding
+// Sets how the encoder case folds text before it is split into words, which
+// changes the encoder's fingerprint. Folding is applied after the encoder's
+// normalizer, and before its lower casing, if any.
+func (encoder *GPTEncoder) SetCaseFolding(folding CaseFolding) error {
+	if folding > CaseFoldTurkic {
+		return errors.New(fmt.Sprintf("invalid case folding %d", folding))
+	}
+	encoder.caseFolding = folding
+	encoder.cache.Purge()
+	return nil
+}
+
+// WithCaseFolding
+// Sets how text is case folded before it is encoded, as SetCaseFolding does.
+func WithCaseFolding(folding CaseFolding) Option {
+	return func(encoder *GPTEncoder) error {
+		return encoder.SetCaseFolding(folding)
+	}
+}
@@ -0,0 +1,119 @@
+package gpt_bpe
+
+import (
+	"errors"
+	"fmt"
+)
+
+// BPELevel
+// What the merges of a BPE vocabulary start from, the bytes of each word or
+// its characters.
+type BPELevel uint8
+
+const (
+	// BPEByteLevel merges the bytes of each word, which the vocabulary
+	// writes as printable characters, as GPT-2 style vocabularies do, and is
+	// the default. Every text can be encoded.
+	BPEByteLevel BPELevel = iota
+	// BPECharLevel merges the characters of each word as they are, as some
+	// older and multilingual vocabularies do. Characters that are not in the
+	// vocabulary are encoded as the unknown token, or dropped if the encoder
+	// has none.
+	BPECharLevel
+)
+
+// unknownToken is the token of the characters that are not in a character
+// level vocabulary, and whether runs of them are fused into one token.
+type unknownToken struct {
+	token Token
+	fuse  bool
+}
+
+// BPELevel
+// Returns what the merges of the encoder's vocabulary start from.
+func (encoder *GPTEncoder) BPELevel() BPELevel {
+	return encoder.bpeLevel
+}
+
+// SetBPELevel
+// Sets what the merges of the encoder's vocabulary start from, which changes
+// the encoder's fingerprint. The vocabulary of a character level encoder is
+// written as its text, rather than in the byte mapping of GPT-2, and each of
+// its tokens is whole characters, so none are trimmed as incomplete.
+func (encoder *GPTEncoder) SetBPELevel(level BPELevel) error {
+	if level > BPECharLevel {
+		return errors.New(fmt.Sprintf("invalid BPE level %d", level))
+	}
+	encoder.bpeLevel = level
+	if level == BPECharLevel {
+		encoder.unitrim = make([]int, len(encoder.unitrim))
+	} else {
+		mappings := make(map[string]int, len(encoder.encoder))
+		for text, token := range encoder.encoder {
+			mappings[text] = int(token)
+		}
+		encoder.unitrim = makeUnitrimArr(mappings)
+	}
+	encoder.cache.Purge()
+	return nil
+}
+
+// UnkToken
+// Returns the token that characters which are not in a character level
+// vocabulary are encoded as, and whether the encoder has one.
+func (encoder *GPTEncoder) UnkToken() (Token, bool) {
+	if encoder.unk == nil {
+		return 0, false
+	}
+	return encoder.unk.token, true
+}
+
+// SetUnkToken
+// Sets the token of the vocabulary that characters which are not in a
+// character level vocabulary are encoded as, by its text, fusing runs of
+// them into a single token if fuse is set. An empty text removes it, so
+// that those characters are dropped.
+func (encoder *GPTEncoder) SetUnkToken(text string, fuse bool) error {
+	if text == "" {
+		encoder.unk = nil
+	} else if token, ok := encoder.encoder[text]; !ok {
+		return fmt.Errorf("%w: unknown token %q is not in the vocabulary",
+			ErrVocabInvalid, text)
+	} else {
+		encoder.unk = &unknownToken{token, fuse}
+	}
+	encoder.cache.Purge()
+	return nil
+}
+
+// WithBPELevel
+// Sets what the merges of the vocabulary start from, as SetBPELevel does.
+func WithBPELevel(level BPELevel) Option {
+	return func(encoder *GPTEncoder) error {
+		return encoder.SetBPELevel(level)
+	}
+}
+
+// WithUnkToken
+// Sets the unknown token of a character level vocabulary, as SetUnkToken
+// does.
+func WithUnkToken(text string, fuse bool) Option {
+	return func(encoder *GPTEncoder) error {
+		return encoder.SetUnkToken(text, fuse)
+	}
+}
+
+// appendPiece appends the token of a merged piece of a word to tokens, and
+// returns whether the piece is not in the vocabulary, given whether the
+// piece before it was not. Byte level pieces are always in the vocabulary.
+func (encoder *GPTEncoder) appendPiece(tokens Tokens, piece string,
+	afterUnknown bool) (Tokens, bool) {
+	token, ok := encoder.encoder[piece]
+	if ok || encoder.bpeLevel == BPEByteLevel {
+		return append(tokens, token), false
+	}
+	if encoder.unk != nil && !(afterUnknown && encoder.unk.fuse) {
+		tokens = append(tokens, encoder.unk.token)
+	}
+	return tokens, true
+}
@@ -0,0 +1,418 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/wbrown/gpt_bpe"
+	"github.com/wbrown/gpt_bpe/dataset"
+	"github.com/wbrown/gpt_bpe/zstd"
+)
+
+const (
+	// RedactRemove removes the tokens of redacted documents from their
+	// shard, moving the documents after them back and padding the last
+	// context.
+	RedactRemove = "remove"
+	// RedactPad overwrites the tokens of redacted documents with the pad
+	// token, so that every other document keeps its offset.
+	RedactPad = "pad"
+)
+
+// HashPrefix is the prefix of a DocumentRef that selects documents by the
+// hash of their tokens, as DocumentHash gives it.
+const HashPrefix = "sha256:"
+
+// DocumentRef
+// Selects documents to redact, either by the id of a document in the index
+// of a shard, or in every shard if Shard is empty, or by the hash of their
+// tokens.
+type DocumentRef struct {
+	Shard string
+	Id    int
+	Hash  string
+}
+
+// ParseDocumentRefs
+// Reads the documents to redact from reader, one on each line, as either
+// `shard:id`, an `id` in every shard, or `sha256:` followed by the hex
+// DocumentHash of the document. Blank lines and lines beginning with # are
+// skipped.
+func ParseDocumentRefs(reader io.Reader) ([]DocumentRef, error) {
+	refs := make([]DocumentRef, 0)
+	scanner := bufio.NewScanner(reader)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if strings.HasPrefix(line, HashPrefix) {
+			hash := strings.ToLower(strings.TrimPrefix(line, HashPrefix))
+			if digest, err := hex.DecodeString(hash); err != nil ||
+				len(digest) != sha256.Size {
+				return nil, errors.New(fmt.Sprintf("line %d: invalid "+
+					"hash %s", lineNum, line))
+			}
+			refs = append(refs, DocumentRef{Id: -1, Hash: hash})
+			continue
+		}
+		ref := DocumentRef{}
+		idStr := line
+		if colon := strings.LastIndexByte(line, ':'); colon >= 0 {
+			ref.Shard, idStr = line[:colon], line[colon+1:]
+		}
+		id, err := strconv.Atoi(idStr)
+		if err != nil || id < 0 {
+			return nil, errors.New(fmt.Sprintf("line %d: invalid document "+
+				"%s, expected shard:id, id or %s<hash>", lineNum, line,
+				HashPrefix))
+		}
+		ref.Id = id
+		refs = append(refs, ref)
+	}
+	return refs, scanner.Err()
+}
+
+// DocumentHash
+// Returns the hex SHA-256 digest of a document's tokens, as little-endian
+// uint16 tokens, which selects it in a DocumentRef. Fails as ToBin does for
+// tokens that do not fit in a uint16.
+func DocumentHash(tokens gpt_bpe.Tokens) (string, error) {
+	bin, err := tokens.ToBin()
+	if err != nil {
+		return "", err
+	}
+	digest := sha256.Sum256(*bin)
+	return hex.EncodeToString(digest[:]), nil
+}
+
+// Redactor
+// Rewrites the shards of a tokenization run with documents removed, or
+// overwritten with padding, through the document index sidecars that were
+// written with -doc_index, so that data removal requests can be honored
+// without retokenizing. Shards and their indexes are replaced atomically,
+// and shards that were Zstandard compressed are compressed again.
+type Redactor struct {
+	ContextSize int
+	PadToken    gpt_bpe.Token
+	Mode        string
+}
+
+// NewRedactor
+// Creates a new Redactor struct with the default configuration.
+func NewRedactor() Redactor {
+	return Redactor{
+		ContextSize: 2048,
+		PadToken:    0,
+		Mode:        RedactRemove,
+	}
+}
+
+// selected returns whether the document of span, with the given tokens, is
+// selected by any of refs.
+func selected(refs []DocumentRef, span dataset.DocumentSpan,
+	tokens gpt_bpe.Tokens) (bool, error) {
+	hash := ""
+	for _, ref := range refs {
+		if ref.Hash != "" {
+			if hash == "" {
+				var err error
+				if hash, err = DocumentHash(tokens); err != nil {
+					return false, err
+				}
+			}
+			if hash == ref.Hash {
+				return true, nil
+			}
+		} else if ref.Id == span.Id && (ref.Shard == "" ||
+			ref.Shard == span.Shard) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// RedactShard
+// Redacts the documents of the shard at path that are selected by refs.
+// Returns the ids of the redacted documents, and the change in the number of
+// tokens of the shard. A shard without redacted documents is left as it is.
+func (r Redactor) RedactShard(path string, refs []DocumentRef) ([]int,
+	int64, error) {
+	if r.Mode != RedactRemove && r.Mode != RedactPad {
+		return nil, 0, errors.New(fmt.Sprintf("invalid redaction mode %s",
+			r.Mode))
+	}
+	shard, err := dataset.OpenShardWithOptions(path,
+		dataset.ShardOptions{ContextSize: r.ContextSize})
+	if err != nil {
+		return nil, 0, err
+	}
+	defer shard.Close()
+	if shard.Documents == nil {
+		return nil, 0, errors.New(fmt.Sprintf("%s has no document index, "+
+			"it must be tokenized with -doc_index to be redacted", path))
+	}
+	tokens, err := shard.Tokens(0, shard.NumTokens())
+	if err != nil {
+		return nil, 0, err
+	}
+
+	redacted := make([]int, 0)
+	spans := make([]dataset.DocumentSpan, 0, len(shard.Documents))
+	output := make(gpt_bpe.Tokens, 0, len(tokens))
+	copied, removed := int64(0), int64(0)
+	for _, span := range shard.Documents {
+		end := span.Offset + span.Length
+		if span.Offset < copied || end > int64(len(tokens)) {
+			return nil, 0, errors.New(fmt.Sprintf("%s: document %d at "+
+				"[%d, %d) does not match its shard", path, span.Id,
+				span.Offset, end))
+		}
+		isSelected, err := selected(refs, span, tokens[span.Offset:end])
+		if err != nil {
+			return nil, 0, err
+		}
+		if !isSelected {
+			span.Offset -= removed
+			spans = append(spans, span)
+			continue
+		}
+		redacted = append(redacted, span.Id)
+		output = append(output, tokens[copied:span.Offset]...)
+		if r.Mode == RedactPad {
+			for idx := int64(0); idx < span.Length; idx++ {
+				output = append(output, r.PadToken)
+			}
+		} else {
+			removed += span.Length
+		}
+		copied = end
+	}
+	if len(redacted) == 0 {
+		return redacted, 0, nil
+	}
+	output = append(output, tokens[copied:]...)
+	for len(output)%r.ContextSize != 0 {
+		output = append(output, r.PadToken)
+	}
+
+	magic := make([]byte, 4)
+	compressed := false
+	if file, openErr := os.Open(path); openErr != nil {
+		return nil, 0, openErr
+	} else {
+		_, readErr := io.ReadFull(file, magic)
+		file.Close()
+		compressed = readErr == nil && zstd.IsFrame(magic)
+	}
+	bin, err := output.ToBin()
+	if err != nil {
+		return nil, 0, err
+	}
+	data := *bin
+	if compressed {
+		data = zstd.Compress(nil, data)
+	}
+	if err := replaceFile(path, data); err != nil {
+		return nil, 0, err
+	}
+	var index strings.Builder
+	encoder := json.NewEncoder(&index)
+	for _, span := range spans {
+		if err := encoder.Encode(span); err != nil {
+			return nil, 0, err
+		}
+	}
+	if err := replaceFile(path+dataset.DocumentIndexSuffix,
+		[]byte(index.String())); err != nil {
+		return nil, 0, err
+	}
+	return redacted, int64(len(output)) - int64(len(tokens)), nil
+}
+
+// replaceFile atomically replaces the file at path with data, by writing it
+// next to path and renaming it over path.
+func replaceFile(path string, data []byte) error {
+	tempPath := path + ".redact"
+	if err := os.WriteFile(tempPath, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tempPath, path)
+}
+
+// RedactManifest
+// Redacts the documents selected by refs from every shard of the run
+// manifest at manifestPath, and updates the token counts of the manifest,
+// recording the redaction in it. Returns the ids of the redacted documents
+// in each shard.
+func (r Redactor) RedactManifest(manifestPath string,
+	refs []DocumentRef) (map[string][]int, error) {
+	data, err := os.ReadFile(manifestPath)
+	if err != nil {
+		return nil, err
+	}
+	// The manifest is updated in place, keeping the fields that are not
+	// read here.
+	var manifest map[string]interface{}
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, errors.New(fmt.Sprintf("%s: %v", manifestPath, err))
+	}
+	shards, _ := manifest["shards"].([]interface{})
+	if len(shards) == 0 {
+		if output, ok := manifest["output"].(string); ok {
+			// Manifests from before shards were recorded hold a single
+			// output.
+			shards = []interface{}{map[string]interface{}{"path": output}}
+		}
+	}
+	redacted := make(map[string][]int)
+	documents := 0
+	for _, shard := range shards {
+		shardInfo, _ := shard.(map[string]interface{})
+		path, _ := shardInfo["path"].(string)
+		if path == "" {
+			return nil, errors.New(fmt.Sprintf("%s: shard without a path",
+				manifestPath))
+		}
+		ids, delta, err := r.RedactShard(path, refs)
+		if err != nil {
+			return nil, err
+		}
+		if len(ids) == 0 {
+			continue
+		}
+		redacted[path] = ids
+		documents += len(ids)
+		if tokens, ok := shardInfo["tokens"].(float64); ok {
+			shardInfo["tokens"] = tokens + float64(delta)
+		}
+		if total, ok := manifest["total_tokens"].(float64); ok {
+			manifest["total_tokens"] = total + float64(delta)
+		}
+	}
+	if documents == 0 {
+		return redacted, nil
+	}
+	redactions, _ := manifest["redactions"].([]interface{})
+	manifest["redactions"] = append(redactions, map[string]interface{}{
+		"mode":        r.Mode,
+		"documents":   documents,
+		"redacted_at": time.Now().UTC(),
+	})
+	manifestJson, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return redacted, replaceFile(manifestPath, manifestJson)
+}
+
+// manifestPadToken returns the pad token of the run manifest at
+// manifestPath, from its tokenizer and its -pad flag.
+func manifestPadToken(manifestPath string) (gpt_bpe.Token, error) {
+	data, err := os.ReadFile(manifestPath)
+	if err != nil {
+		return 0, err
+	}
+	var manifest struct {
+		Flags     map[string]string `json:"flags"`
+		Tokenizer struct {
+			Id string `json:"id"`
+		} `json:"tokenizer"`
+	}
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return 0, err
+	}
+	encoder, err := gpt_bpe.NewEncoder(manifest.Tokenizer.Id)
+	if err != nil {
+		return 0, err
+	}
+	pad := strings.ReplaceAll(manifest.Flags["pad"], "\\n", "\n")
+	if pad == "" {
+		return encoder.PadToken, nil
+	} else if token := encoder.Get(pad); token != nil {
+		return *token, nil
+	}
+	return 0, errors.New(fmt.Sprintf("'%s' is not a token of %s, use -pad_id",
+		pad, manifest.Tokenizer.Id))
+}
+
+func main() {
+	manifestPath := flag.String("manifest", "",
+		"run manifest of the tokenized shards to redact documents from")
+	documentsPath := flag.String("documents", "",
+		"file of the documents to redact, one on each line as shard:id, "+
+			"an id in every shard, or sha256:<hash> of the document's tokens")
+	mode := flag.String("mode", RedactRemove,
+		"how documents are redacted [remove, pad]")
+	padId := flag.Int("pad_id", -1,
+		"pad token id, defaults to the pad token of the manifest's run")
+	flag.Parse()
+	if *manifestPath == "" || *documentsPath == "" {
+		flag.Usage()
+		log.Fatal("Must provide -manifest and -documents")
+	}
+
+	documentsFile, err := os.Open(*documentsPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	refs, err := ParseDocumentRefs(documentsFile)
+	documentsFile.Close()
+	if err != nil {
+		log.Fatalf("%s: %v", *documentsPath, err)
+	}
+	contextSize, err := readContextSize(*manifestPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	redactor := NewRedactor()
+	redactor.ContextSize = contextSize
+	redactor.Mode = *mode
+	if *padId >= 0 {
+		redactor.PadToken = gpt_bpe.Token(*padId)
+	} else if redactor.PadToken, err = manifestPadToken(
+		*manifestPath); err != nil {
+		log.Fatal(err)
+	}
+
+	redacted, err := redactor.RedactManifest(*manifestPath, refs)
+	if err != nil {
+		log.Fatal(err)
+	}
+	documents := 0
+	for path, ids := range redacted {
+		log.Printf("Redacted %d documents from %s", len(ids), path)
+		documents += len(ids)
+	}
+	log.Printf("Redacted %d documents of %d requested", documents, len(refs))
+}
+
+// readContextSize returns the context size of the run manifest at path.
+func readContextSize(path string) (int, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	var manifest struct {
+		ContextSize int `json:"context_size"`
+	}
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return 0, errors.New(fmt.Sprintf("%s: %v", path, err))
+	} else if manifest.ContextSize <= 0 {
+		return 0, errors.New(fmt.Sprintf("%s: no context size recorded",
+			path))
+	}
+	return manifest.ContextSize, nil
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/wbrown/gpt_bpe"
+	"github.com/wbrown/gpt_bpe/zstd"
+)
+
+// writeShard writes a shard of contexts of four tokens holding three
+// documents that end with token 0 and are padded with token 9, along with
+// its document index and a run manifest, and returns the manifest's path.
+func writeShard(t *testing.T, dir string, compress bool) (string, string) {
+	shardPath := filepath.Join(dir, "tokenized.chunk")
+	tokens := gpt_bpe.Tokens{1, 2, 0, 3, 4, 5, 0, 9, 6, 7, 0, 9}
+	bin, err := tokens.ToBin()
+	assert.Nil(t, err)
+	data := *bin
+	if compress {
+		data = zstd.Compress(nil, data)
+	}
+	assert.Nil(t, os.WriteFile(shardPath, data, 0644))
+	spans := []string{
+		`{"id":0,"shard":"` + shardPath + `","offset":0,"length":3}`,
+		`{"id":1,"shard":"` + shardPath + `","offset":3,"length":4}`,
+		`{"id":2,"shard":"` + shardPath + `","offset":8,"length":3}`,
+	}
+	assert.Nil(t, os.WriteFile(shardPath+".index.jsonl",
+		[]byte(strings.Join(spans, "\n")+"\n"), 0644))
+	manifestPath := shardPath + ".manifest.json"
+	assert.Nil(t, os.WriteFile(manifestPath, []byte(`{"context_size": 4, `+
+		`"total_tokens": 12, "output": "`+shardPath+`", "shards": [`+
+		`{"path": "`+shardPath+`", "tokens": 12}]}`), 0644))
+	return manifestPath, shardPath
+}
+
+func TestParseDocumentRefs(t *testing.T) {
+	hash, err := DocumentHash(gpt_bpe.Tokens{1, 2, 0})
+	assert.Nil(t, err)
+	refs, err := ParseDocumentRefs(strings.NewReader(
+		"# removal request\n3\n\nout/a.chunk:12\nsha256:" + hash + "\n"))
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.Equal(t, []DocumentRef{{Id: 3}, {Shard: "out/a.chunk", Id: 12},
+		{Id: -1, Hash: hash}}, refs)
+	for _, invalid := range []string{"a.chunk:x", "-1", "sha256:abc"} {
+		_, err = ParseDocumentRefs(strings.NewReader(invalid))
+		assert.NotNil(t, err, invalid)
+	}
+}
+
+func TestRedactor_RedactManifest(t *testing.T) {
+	redactor := NewRedactor()
+	redactor.ContextSize = 4
+	redactor.PadToken = 9
+
+	// Removing a document moves the documents after it back.
+	manifestPath, shardPath := writeShard(t, t.TempDir(), false)
+	redacted, err := redactor.RedactManifest(manifestPath,
+		[]DocumentRef{{Shard: shardPath, Id: 1}})
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.Equal(t, map[string][]int{shardPath: {1}}, redacted)
+	tokens, err := gpt_bpe.ReadTokensFile(shardPath)
+	assert.Nil(t, err)
+	assert.Equal(t, gpt_bpe.Tokens{1, 2, 0, 9, 6, 7, 0, 9}, *tokens)
+	index, err := os.ReadFile(shardPath + ".index.jsonl")
+	assert.Nil(t, err)
+	assert.Equal(t, 2, strings.Count(string(index), "\n"))
+	assert.Contains(t, string(index), `"id":2,"shard":"`+shardPath+
+		`","offset":4,"length":3`)
+	var manifest map[string]interface{}
+	data, err := os.ReadFile(manifestPath)
+	assert.Nil(t, err)
+	assert.Nil(t, json.Unmarshal(data, &manifest))
+	assert.Equal(t, 8.0, manifest["total_tokens"])
+	assert.Equal(t, 1, len(manifest["redactions"].([]interface{})))
+
+	// Padding a compressed shard keeps every offset, and documents are
+	// selected by the hash of their tokens.
+	redactor.Mode = RedactPad
+	manifestPath, shardPath = writeShard(t, t.TempDir(), true)
+	hash, err := DocumentHash(gpt_bpe.Tokens{6, 7, 0})
+	assert.Nil(t, err)
+	redacted, err = redactor.RedactManifest(manifestPath, []DocumentRef{
+		{Id: -1, Hash: hash}})
+	assert.Nil(t, err)
+	assert.Equal(t, map[string][]int{shardPath: {2}}, redacted)
+	data, err = os.ReadFile(shardPath)
+	assert.Nil(t, err)
+	assert.True(t, zstd.IsFrame(data))
+	tokens, err = gpt_bpe.ReadTokensFile(shardPath)
+	assert.Nil(t, err)
+	assert.Equal(t, gpt_bpe.Tokens{1, 2, 0, 3, 4, 5, 0, 9, 9, 9, 9, 9},
+		*tokens)
+
+	// Shards without redacted documents are left as they are.
+	redacted, err = redactor.RedactManifest(manifestPath,
+		[]DocumentRef{{Id: 7}})
+	assert.Nil(t, err)
+	assert.Empty(t, redacted)
+	_, err = os.Stat(shardPath + ".redact")
+	assert.True(t, os.IsNotExist(err))
+}
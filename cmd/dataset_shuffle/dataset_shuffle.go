@@ -0,0 +1,380 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/wbrown/gpt_bpe"
+	"github.com/wbrown/gpt_bpe/zstd"
+)
+
+const DefaultCompressionChunkSize = 4 * 1024 * 1024
+
+// Shuffler
+// Globally shuffles the fixed size contexts of tokenized datasets, using
+// bounded memory. In the first pass, every context is streamed from the
+// inputs into a uniformly random bucket file. In the second pass, each
+// bucket is loaded, shuffled in memory and appended to the output shards.
+// Buckets that turn out to be larger than the memory limit are shuffled by
+// recursively applying the same two passes.
+type Shuffler struct {
+	ContextSize  int
+	Seed         int64
+	MemoryLimit  int64
+	TempDir      string
+	OutputShards int
+	Compress     bool
+}
+
+// NewShuffler
+// Creates a new Shuffler struct with the default configuration.
+func NewShuffler() Shuffler {
+	return Shuffler{
+		ContextSize:  2048,
+		Seed:         0,
+		MemoryLimit:  1024 * 1024 * 1024,
+		TempDir:      "",
+		OutputShards: 1,
+		Compress:     false,
+	}
+}
+
+// contextBytes returns the size of a single context in bytes.
+func (s Shuffler) contextBytes() int {
+	return s.ContextSize * gpt_bpe.TokenSize
+}
+
+// ShardPaths
+// Returns the paths of the output shards for the given output path. A
+// single shard is written to the output path itself.
+func (s Shuffler) ShardPaths(output string) []string {
+	if s.OutputShards <= 1 {
+		return []string{output}
+	}
+	paths := make([]string, s.OutputShards)
+	for shardIdx := range paths {
+		paths[shardIdx] = fmt.Sprintf("%s.%04d", output, shardIdx)
+	}
+	return paths
+}
+
+// shardWriter writes contexts to a series of output shards, moving to the
+// next shard once the current one holds its share of contexts.
+type shardWriter struct {
+	paths            []string
+	compress         bool
+	contextsPerShard int64
+	written          int64
+	file             *os.File
+	buffered         *bufio.Writer
+	zstdWriter       *zstd.Writer
+	out              io.Writer
+}
+
+func (sw *shardWriter) write(context []byte) error {
+	if sw.out == nil || sw.written%sw.contextsPerShard == 0 &&
+		sw.written > 0 {
+		if err := sw.next(); err != nil {
+			return err
+		}
+	}
+	sw.written++
+	_, err := sw.out.Write(context)
+	return err
+}
+
+// next closes the current shard, and opens the next one.
+func (sw *shardWriter) next() error {
+	if err := sw.close(); err != nil {
+		return err
+	}
+	if len(sw.paths) == 0 {
+		return errors.New("more contexts than expected for the shards")
+	}
+	file, err := os.Create(sw.paths[0])
+	if err != nil {
+		return err
+	}
+	sw.paths = sw.paths[1:]
+	sw.file = file
+	sw.buffered = bufio.NewWriterSize(file, 1024*1024)
+	sw.out = sw.buffered
+	if sw.compress {
+		sw.zstdWriter = zstd.NewWriter(sw.buffered,
+			DefaultCompressionChunkSize)
+		sw.out = sw.zstdWriter
+	}
+	return nil
+}
+
+func (sw *shardWriter) close() error {
+	if sw.file == nil {
+		return nil
+	}
+	if sw.zstdWriter != nil {
+		if err := sw.zstdWriter.Close(); err != nil {
+			return err
+		}
+		sw.zstdWriter = nil
+	}
+	if err := sw.buffered.Flush(); err != nil {
+		return err
+	}
+	err := sw.file.Close()
+	sw.file = nil
+	return err
+}
+
+// partition streams every context from readers into numBuckets uniformly
+// random bucket files in dir, returning the bucket paths and the number of
+// contexts read.
+func (s Shuffler) partition(readers func(func(io.Reader) error) error,
+	dir string, numBuckets int, rng *rand.Rand) ([]string, int64, error) {
+	paths := make([]string, numBuckets)
+	files := make([]*os.File, numBuckets)
+	writers := make([]*bufio.Writer, numBuckets)
+	defer func() {
+		for _, file := range files {
+			if file != nil {
+				file.Close()
+			}
+		}
+	}()
+	for bucketIdx := range paths {
+		file, err := os.CreateTemp(dir, "bucket-*.chunk")
+		if err != nil {
+			return nil, 0, err
+		}
+		paths[bucketIdx] = file.Name()
+		files[bucketIdx] = file
+		writers[bucketIdx] = bufio.NewWriterSize(file, 64*1024)
+	}
+	context := make([]byte, s.contextBytes())
+	numContexts := int64(0)
+	err := readers(func(reader io.Reader) error {
+		for {
+			if _, err := io.ReadFull(reader, context); err == io.EOF {
+				return nil
+			} else if err == io.ErrUnexpectedEOF {
+				return errors.New(fmt.Sprintf(
+					"input is not a multiple of %d tokens", s.ContextSize))
+			} else if err != nil {
+				return err
+			}
+			bucket := writers[rng.Intn(numBuckets)]
+			if _, err := bucket.Write(context); err != nil {
+				return err
+			}
+			numContexts++
+		}
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	for bucketIdx, writer := range writers {
+		if err := writer.Flush(); err != nil {
+			return nil, 0, err
+		}
+		if err := files[bucketIdx].Close(); err != nil {
+			return nil, 0, err
+		}
+		files[bucketIdx] = nil
+	}
+	return paths, numContexts, nil
+}
+
+// bucketsFor returns the number of buckets needed for each to fit in memory.
+func (s Shuffler) bucketsFor(size int64) int {
+	return int(size/s.MemoryLimit) + 1
+}
+
+// shuffleBucket shuffles the contexts of a bucket file into out, and removes
+// the bucket.
+func (s Shuffler) shuffleBucket(path string, dir string, rng *rand.Rand,
+	out *shardWriter) error {
+	defer os.Remove(path)
+	stat, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if stat.Size() > s.MemoryLimit {
+		// The bucket is too large to hold in memory, so we shuffle it in
+		// two passes of its own.
+		bucketPaths, _, err := s.partition(
+			func(consume func(io.Reader) error) error {
+				file, err := os.Open(path)
+				if err != nil {
+					return err
+				}
+				defer file.Close()
+				return consume(bufio.NewReaderSize(file, 1024*1024))
+			}, dir, s.bucketsFor(stat.Size())+1, rng)
+		if err != nil {
+			return err
+		}
+		for _, bucketPath := range bucketPaths {
+			if err := s.shuffleBucket(bucketPath, dir, rng,
+				out); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	contexts, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	contextBytes := s.contextBytes()
+	swap := make([]byte, contextBytes)
+	rng.Shuffle(len(contexts)/contextBytes, func(i, j int) {
+		a := contexts[i*contextBytes : (i+1)*contextBytes]
+		b := contexts[j*contextBytes : (j+1)*contextBytes]
+		copy(swap, a)
+		copy(a, b)
+		copy(b, swap)
+	})
+	for start := 0; start < len(contexts); start += contextBytes {
+		if err := out.write(
+			contexts[start : start+contextBytes]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Shuffle
+// Shuffles every context in the input files, which may be Zstandard
+// compressed, into the output shards. The result is a uniformly random
+// permutation of the contexts that is fully determined by the seed and the
+// order of the inputs. Returns the number of contexts shuffled.
+func (s Shuffler) Shuffle(inputs []string, output string) (int64, error) {
+	if s.ContextSize <= 0 {
+		return 0, errors.New("context size must be positive")
+	}
+	if s.MemoryLimit < int64(s.contextBytes()) {
+		return 0, errors.New("memory limit must hold at least one context")
+	}
+	totalSize := int64(0)
+	for _, input := range inputs {
+		stat, err := os.Stat(input)
+		if err != nil {
+			return 0, err
+		}
+		totalSize += stat.Size()
+	}
+	dir, err := os.MkdirTemp(s.TempDir, "dataset_shuffle")
+	if err != nil {
+		return 0, err
+	}
+	defer os.RemoveAll(dir)
+	rng := rand.New(rand.NewSource(s.Seed))
+
+	// Pass one: scatter the contexts into random buckets.
+	bucketPaths, numContexts, err := s.partition(
+		func(consume func(io.Reader) error) error {
+			for _, input := range inputs {
+				log.Printf("Reading %s", input)
+				file, err := os.Open(input)
+				if err != nil {
+					return err
+				}
+				consumeErr := consume(gpt_bpe.NewTokensReader(file))
+				file.Close()
+				if consumeErr != nil {
+					return errors.New(fmt.Sprintf("%s: %v", input,
+						consumeErr))
+				}
+			}
+			return nil
+		}, dir, s.bucketsFor(totalSize), rng)
+	if err != nil {
+		return 0, err
+	}
+
+	// Pass two: shuffle each bucket in memory, and concatenate them.
+	shards := s.ShardPaths(output)
+	contextsPerShard := (numContexts + int64(len(shards)) - 1) /
+		int64(len(shards))
+	if contextsPerShard == 0 {
+		contextsPerShard = 1
+	}
+	out := &shardWriter{
+		paths:            shards,
+		compress:         s.Compress,
+		contextsPerShard: contextsPerShard,
+	}
+	for bucketIdx, bucketPath := range bucketPaths {
+		log.Printf("Shuffling bucket %d of %d", bucketIdx+1,
+			len(bucketPaths))
+		if err := s.shuffleBucket(bucketPath, dir, rng, out); err != nil {
+			out.close()
+			return 0, err
+		}
+	}
+	return numContexts, out.close()
+}
+
+func main() {
+	inputGlob := flag.String("input", "",
+		"comma separated tokenized input files or glob patterns")
+	outputFile := flag.String("output", "shuffled.chunk",
+		"shuffled output file, suffixed with the shard index if "+
+			"-shards is more than one")
+	contextSize := flag.Int("context", 2048, "context size in tokens")
+	seed := flag.Int64("seed", 0, "random seed for the shuffle")
+	memoryLimit := flag.Int64("memory", 1024,
+		"memory to use for shuffling buckets, in MiB")
+	tempDir := flag.String("temp", "",
+		"directory for temporary bucket files, defaults to the output's")
+	outputShards := flag.Int("shards", 1, "number of output shards")
+	compress := flag.String("compress", "",
+		"compress the shuffled output [zst]")
+	flag.Parse()
+	if *inputGlob == "" {
+		flag.Usage()
+		log.Fatal("Must provide -input")
+	}
+	if *compress != "" && *compress != "zst" {
+		log.Fatalf("Invalid compression: %s", *compress)
+	}
+
+	inputs := make([]string, 0)
+	for _, pattern := range strings.Split(*inputGlob, ",") {
+		matches, globErr := filepath.Glob(strings.TrimSpace(pattern))
+		if globErr != nil {
+			log.Fatal(globErr)
+		}
+		inputs = append(inputs, matches...)
+	}
+	if len(inputs) == 0 {
+		log.Fatalf("No inputs match %s", *inputGlob)
+	}
+
+	shuffler := NewShuffler()
+	shuffler.ContextSize = *contextSize
+	shuffler.Seed = *seed
+	shuffler.MemoryLimit = *memoryLimit * 1024 * 1024
+	shuffler.TempDir = *tempDir
+	if shuffler.TempDir == "" {
+		shuffler.TempDir = filepath.Dir(*outputFile)
+	}
+	shuffler.OutputShards = *outputShards
+	shuffler.Compress = *compress == "zst"
+
+	begin := time.Now()
+	numContexts, err := shuffler.Shuffle(inputs, *outputFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("Shuffled %d contexts from %d inputs in %0.2fs", numContexts,
+		len(inputs), time.Now().Sub(begin).Seconds())
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/wbrown/gpt_bpe"
+	"github.com/wbrown/gpt_bpe/zstd"
+)
+
+// writeContexts writes contexts [first, first+count) to path, each filled
+// with its own index, optionally compressed.
+func writeContexts(t *testing.T, path string, contextSize int, first int,
+	count int, compress bool) {
+	data := make([]byte, 0, count*contextSize*gpt_bpe.TokenSize)
+	for contextIdx := first; contextIdx < first+count; contextIdx++ {
+		for tokenIdx := 0; tokenIdx < contextSize; tokenIdx++ {
+			data = append(data, byte(contextIdx), byte(contextIdx>>8))
+		}
+	}
+	if compress {
+		data = zstd.Compress(nil, data)
+	}
+	assert.Nil(t, os.WriteFile(path, data, 0644))
+}
+
+// readContexts returns the index of each context in the shards.
+func readContexts(t *testing.T, paths []string, contextSize int) []int {
+	indexes := make([]int, 0)
+	for _, path := range paths {
+		tokens, err := gpt_bpe.ReadTokensFile(path)
+		assert.Nil(t, err)
+		for start := 0; start < len(*tokens); start += contextSize {
+			context := (*tokens)[start : start+contextSize]
+			for _, token := range context {
+				assert.Equal(t, context[0], token)
+			}
+			indexes = append(indexes, int(context[0]))
+		}
+	}
+	return indexes
+}
+
+func TestShuffler_Shuffle(t *testing.T) {
+	dir := t.TempDir()
+	contextSize := 64
+	inputs := []string{
+		filepath.Join(dir, "a.chunk"),
+		filepath.Join(dir, "b.chunk"),
+		filepath.Join(dir, "c.chunk.zst"),
+	}
+	writeContexts(t, inputs[0], contextSize, 0, 300, false)
+	writeContexts(t, inputs[1], contextSize, 300, 250, false)
+	writeContexts(t, inputs[2], contextSize, 550, 450, true)
+
+	shuffler := NewShuffler()
+	shuffler.ContextSize = contextSize
+	shuffler.Seed = 42
+	shuffler.TempDir = dir
+	// Small enough to need many buckets, and to recurse into those that
+	// were undercounted because of the compressed input.
+	shuffler.MemoryLimit = int64(contextSize * gpt_bpe.TokenSize * 40)
+	shuffler.OutputShards = 3
+	shuffler.Compress = true
+
+	output := filepath.Join(dir, "shuffled.chunk")
+	numContexts, err := shuffler.Shuffle(inputs, output)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1000), numContexts)
+
+	shards := shuffler.ShardPaths(output)
+	assert.Len(t, shards, 3)
+	indexes := readContexts(t, shards, contextSize)
+	assert.Len(t, indexes, 1000)
+	seen := make(map[int]bool)
+	inOrder := 0
+	for position, index := range indexes {
+		seen[index] = true
+		if position == index {
+			inOrder++
+		}
+	}
+	assert.Len(t, seen, 1000)
+	assert.Less(t, inOrder, 20)
+
+	// The same seed must reproduce the same shuffle.
+	expected, _ := os.ReadFile(shards[0])
+	_, err = shuffler.Shuffle(inputs, output)
+	assert.Nil(t, err)
+	actual, _ := os.ReadFile(shards[0])
+	assert.True(t, bytes.Equal(expected, actual))
+
+	// Only the outputs and inputs remain; the buckets are removed.
+	entries, _ := os.ReadDir(dir)
+	assert.Len(t, entries, 6)
+}
+
+func TestShuffler_Shuffle_PartialContext(t *testing.T) {
+	dir := t.TempDir()
+	input := filepath.Join(dir, "partial.chunk")
+	data := make([]byte, 100*gpt_bpe.TokenSize)
+	binary.LittleEndian.PutUint16(data, 1)
+	assert.Nil(t, os.WriteFile(input, data, 0644))
+
+	shuffler := NewShuffler()
+	shuffler.ContextSize = 64
+	shuffler.TempDir = dir
+	_, err := shuffler.Shuffle([]string{input},
+		filepath.Join(dir, "shuffled.chunk"))
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"time"
+)
+
+// ResumeCheckpoint
+// Prepares the manifest of a checkpointed run to be resumed with the current
+// inputs, and returns those that remain to be tokenized. Every shard that
+// the manifest records must be intact, at the size it was synced at, and
+// the inputs that were tokenized into them unchanged, so that each input is
+// tokenized exactly once. The shard that was being written when the run was
+// interrupted is removed, along with its document index, and the total
+// tokens are counted again from the shards that are kept.
+func (manifest *RunManifest) ResumeCheckpoint(
+	inputs []ManifestInput) ([]ManifestInput, error) {
+	if manifest.CheckpointInputs <= 0 {
+		return nil, errors.New(fmt.Sprintf("%s was not written by a "+
+			"checkpointed run", manifest.Output))
+	}
+	completed := make(map[string]string)
+	manifest.TotalTokens = 0
+	for _, shard := range manifest.Shards {
+		stat, err := os.Stat(shard.Path)
+		if err != nil {
+			return nil, err
+		} else if stat.Size() != shard.Bytes {
+			return nil, errors.New(fmt.Sprintf("shard %s is %d bytes, but "+
+				"was checkpointed at %d bytes", shard.Path, stat.Size(),
+				shard.Bytes))
+		}
+		for _, input := range shard.Inputs {
+			completed[input] = shard.Path
+		}
+		manifest.TotalTokens += shard.Tokens
+	}
+	recorded := make(map[string]string, len(manifest.Inputs))
+	for _, input := range manifest.Inputs {
+		recorded[input.Path] = input.SHA256
+	}
+	pending := make([]ManifestInput, 0)
+	for _, input := range inputs {
+		if shardPath, ok := completed[input.Path]; !ok {
+			pending = append(pending, input)
+		} else if recorded[input.Path] != input.SHA256 {
+			return nil, errors.New(fmt.Sprintf("%s changed since it was "+
+				"tokenized into %s", input.Path, shardPath))
+		}
+	}
+	partialPath := ShardPath(manifest.Output, len(manifest.Shards))
+	for _, path := range []string{partialPath,
+		partialPath + DocumentIndexSuffix} {
+		if err := os.Remove(path); err != nil &&
+			!errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+	}
+	manifest.Inputs = inputs
+	return pending, nil
+}
+
+// syncFile flushes the file at path to disk.
+func syncFile(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	if err = file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// syncShard flushes the files of the shard at shardPath to disk.
+func syncShard(shardPath string) error {
+	for _, suffix := range shardFileSuffixes {
+		err := syncFile(shardPath + suffix)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+// TokenizeCheckpointed
+// Tokenizes the inputs of matches that are pending into shards of the
+// manifest's CheckpointInputs inputs each, numbered on from the shards that
+// it records. Once each shard is synced to disk, it is recorded in the
+// manifest at manifestPath, as a checkpoint that an interrupted run is
+// resumed from.
+func TokenizeCheckpointed(textsReader TextsReader,
+	textsTokenizer TextsTokenizer, contextsWriter ContextsWriter,
+	matches []PathInfo, pending []ManifestInput, manifest *RunManifest,
+	manifestPath string, documentIndex bool) error {
+	matchesByPath := make(map[string]PathInfo, len(matches))
+	for _, match := range matches {
+		matchesByPath[match.Path] = match
+	}
+	for start := 0; start < len(pending); {
+		end := start + manifest.CheckpointInputs
+		if end > len(pending) {
+			end = len(pending)
+		}
+		shardInputs := pending[start:end]
+		shardMatches := make([]PathInfo, len(shardInputs))
+		for idx, input := range shardInputs {
+			shardMatches[idx] = matchesByPath[input.Path]
+		}
+		shardPath := ShardPath(manifest.Output, len(manifest.Shards))
+		begin := time.Now()
+		total, err := TokenizeShard(textsReader, textsTokenizer,
+			contextsWriter, shardMatches, shardPath, documentIndex)
+		if err != nil {
+			return err
+		}
+		if err = syncFile(shardPath); err != nil {
+			return err
+		}
+		if documentIndex {
+			if err = syncFile(shardPath + DocumentIndexSuffix); err != nil {
+				return err
+			}
+		}
+		stat, err := os.Stat(shardPath)
+		if err != nil {
+			return err
+		}
+		manifest.AddShard(shardPath, total, shardInputs, begin)
+		manifest.Shards[len(manifest.Shards)-1].Bytes = stat.Size()
+		if err = manifest.Write(manifestPath); err != nil {
+			return err
+		}
+		start = end
+		log.Printf("Checkpointed %d tokens of %d inputs in %s, %d of %d "+
+			"inputs remain", total, len(shardInputs), shardPath,
+			len(pending)-end, len(manifest.Inputs))
+	}
+	return nil
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/wbrown/gpt_bpe"
+	"github.com/wbrown/gpt_bpe/zstd"
+)
+
+// DefaultCompressionWorkers is the number of frames of compressed output
+// that are compressed at once by default.
+const DefaultCompressionWorkers = 1
+
+// CompressedInputExtensions are the extensions of compressed input files,
+// which are found along with the uncompressed inputs of each format, such as
+// .jsonl.zst, and are decompressed as they are read.
+var CompressedInputExtensions = []string{".gz", ".bz2", ".zst"}
+
+// decompressReader
+// Returns a reader that decompresses reader by the extension of path, or
+// reader itself if path is not of a compressed input. Common Crawl files are
+// concatenated gzip members, one per record, which gzip.Reader reads
+// through in multistream mode.
+func decompressReader(path string, reader io.Reader) (io.Reader, error) {
+	switch {
+	case strings.HasSuffix(path, ".bz2"):
+		return bzip2.NewReader(reader), nil
+	case strings.HasSuffix(path, ".gz"):
+		return gzip.NewReader(reader)
+	case strings.HasSuffix(path, ".zst"):
+		return zstd.NewReader(reader), nil
+	}
+	return reader, nil
+}
+
+// frameCompressor appends src to dst, compressed as a frame that is
+// decompressed independently of any other.
+type frameCompressor func(dst []byte, src []byte) []byte
+
+// newFrameCompressor
+// Returns a function that creates a frameCompressor of compression at level,
+// for each worker that compresses frames. A level of zero is the default
+// level of the compression.
+func newFrameCompressor(compression string,
+	level int) (func() frameCompressor, error) {
+	switch compression {
+	case CompressionZstd:
+		if level == 0 {
+			level = zstd.DefaultLevel
+		}
+		if _, err := zstd.NewEncoderLevel(level); err != nil {
+			return nil, errors.New(fmt.Sprintf("invalid zst compression "+
+				"level %d, expected %d to %d", level, zstd.MinLevel,
+				zstd.MaxLevel))
+		}
+		return func() frameCompressor {
+			encoder, _ := zstd.NewEncoderLevel(level)
+			return encoder.EncodeAll
+		}, nil
+	case CompressionGzip:
+		if level == 0 {
+			level = gzip.DefaultCompression
+		}
+		if _, err := gzip.NewWriterLevel(io.Discard, level); err != nil {
+			return nil, errors.New(fmt.Sprintf("invalid gz compression "+
+				"level %d, expected %d to %d", level, gzip.BestSpeed,
+				gzip.BestCompression))
+		}
+		return func() frameCompressor {
+			var buffer bytes.Buffer
+			gzipWriter, _ := gzip.NewWriterLevel(&buffer, level)
+			// Each frame is a gzip member, which gzip readers read through
+			// as a single stream.
+			return func(dst []byte, src []byte) []byte {
+				buffer.Reset()
+				gzipWriter.Reset(&buffer)
+				gzipWriter.Write(src)
+				gzipWriter.Close()
+				return append(dst, buffer.Bytes()...)
+			}
+		}, nil
+	}
+	return nil, errors.New(fmt.Sprintf("invalid compression: %s",
+		compression))
+}
+
+// framesWriter
+// Compresses the data written to it into independent frames, each of which
+// is written once at least frameSize bytes are pending at the end of a
+// Write, so that a frameSize of one compresses each Write as a frame. The
+// frames are compressed by parallel workers, and written in order, so that
+// the output does not depend on the number of workers.
+type framesWriter struct {
+	frameSize int
+	buf       []byte
+	jobs      chan frameJob
+	// pending are the results of the frames that are being compressed, in
+	// the order that they are written.
+	pending chan chan []byte
+	done    chan error
+}
+
+// frameJob is a frame to compress, and where its result is sent.
+type frameJob struct {
+	src    []byte
+	result chan []byte
+}
+
+// newFramesWriter
+// Creates a framesWriter that writes frames of at least frameSize bytes to
+// writer, compressed by workers frameCompressors of newCompressor.
+func newFramesWriter(writer io.Writer, frameSize int, workers int,
+	newCompressor func() frameCompressor) *framesWriter {
+	if workers < 1 {
+		workers = 1
+	}
+	fw := &framesWriter{
+		frameSize: frameSize,
+		jobs:      make(chan frameJob, workers),
+		pending:   make(chan chan []byte, workers*2),
+		done:      make(chan error, 1),
+	}
+	for worker := 0; worker < workers; worker++ {
+		go func(compress frameCompressor) {
+			for job := range fw.jobs {
+				job.result <- compress(nil, job.src)
+			}
+		}(newCompressor())
+	}
+	go func() {
+		var err error
+		for result := range fw.pending {
+			frame := <-result
+			if err == nil {
+				_, err = writer.Write(frame)
+			}
+		}
+		fw.done <- err
+	}()
+	return fw
+}
+
+// Write
+// Buffers p, and compresses a frame once frameSize bytes are pending. Errors
+// writing the frames are returned by Close.
+func (fw *framesWriter) Write(p []byte) (int, error) {
+	fw.buf = append(fw.buf, p...)
+	if len(fw.buf) >= fw.frameSize {
+		fw.flush()
+	}
+	return len(p), nil
+}
+
+// flush queues any pending data to be compressed as a frame.
+func (fw *framesWriter) flush() {
+	if len(fw.buf) == 0 {
+		return
+	}
+	result := make(chan []byte, 1)
+	fw.pending <- result
+	fw.jobs <- frameJob{fw.buf, result}
+	fw.buf = nil
+}
+
+// writeDocumentFrames
+// Writes bin, the binary form of context, to fw, ending a frame after each
+// document that ends in the context with an EndOfText token, so that every
+// frame holds the tokens of a single document, along with the padding of a
+// context after its last document.
+func (cw ContextsWriter) writeDocumentFrames(fw *framesWriter,
+	context gpt_bpe.Tokens, bin []byte) {
+	tokenSize := len(bin) / len(context)
+	paddingStart := cw.paddingStart(context)
+	start := 0
+	for idx := 0; idx < paddingStart; idx++ {
+		if context[idx] != cw.EndOfText {
+			continue
+		}
+		end := idx + 1
+		if end == paddingStart {
+			end = len(context)
+		}
+		fw.Write(bin[start*tokenSize : end*tokenSize])
+		fw.flush()
+		start = end
+	}
+	if start < len(context) {
+		fw.Write(bin[start*tokenSize:])
+	}
+}
+
+// Close
+// Compresses any pending data, waits for every frame to be written, and
+// returns the first error writing them. It does not close the underlying
+// writer.
+func (fw *framesWriter) Close() error {
+	fw.flush()
+	close(fw.jobs)
+	close(fw.pending)
+	return <-fw.done
+}
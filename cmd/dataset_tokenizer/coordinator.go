@@ -0,0 +1,449 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/rpc"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/wbrown/gpt_bpe"
+)
+
+const (
+	DefaultTaskTimeout = 6 * time.Hour
+	DefaultMaxAttempts = 3
+	// workerPollInterval is how long workers wait before asking again when
+	// every remaining task is assigned to another worker.
+	workerPollInterval = 5 * time.Second
+)
+
+// TokenizeTask
+// A set of input files that a worker tokenizes into a single shard. Inputs
+// and shards are addressed by path, so every worker must see the same paths,
+// such as on a shared filesystem. Each attempt at a task writes its shard to
+// its own Output, which the coordinator moves to Shard once it accepts the
+// attempt's result.
+type TokenizeTask struct {
+	Id          int
+	Attempt     int
+	Inputs      []PathInfo
+	Shard       string
+	Output      string
+	Fingerprint string
+	ContextSize int
+	// Wait is set when every remaining task is assigned to another worker,
+	// and the worker should ask again later. Done is set when every task is
+	// complete, and the worker should exit.
+	Wait bool
+	Done bool
+}
+
+// TaskRequest
+// Identifies the worker asking the coordinator for a task.
+type TaskRequest struct {
+	Worker string
+}
+
+// TaskResult
+// Reports the outcome of an attempt at a TokenizeTask back to the
+// coordinator. A failed task carries its error, and is retried by another
+// request.
+type TaskResult struct {
+	Worker    string
+	Id        int
+	Attempt   int
+	Tokens    int
+	Inputs    []ManifestInput
+	Languages map[string]int
+	StartedAt time.Time
+	Error     string
+}
+
+// CoordinatorHealth
+// Reports the build, tokenizer and progress of a coordinator, so that
+// workers and monitoring can tell whether a fleet runs matching binaries.
+type CoordinatorHealth struct {
+	Build     ManifestBuild
+	Tokenizer ManifestTokenizer
+	Tasks     int
+	Remaining int
+	Error     string
+}
+
+// shardFileSuffixes are the suffixes of the files of a shard, its contexts
+// and their sidecars, that a task's attempt may write.
+var shardFileSuffixes = []string{"", DocumentIndexSuffix, SegmentIdsSuffix,
+	LossMaskSuffix}
+
+// AttemptPath
+// Returns the path that the given attempt at the task of shard writes the
+// shard to.
+func AttemptPath(shard string, attempt int) string {
+	return fmt.Sprintf("%s.attempt%d", shard, attempt)
+}
+
+// removeAttempt removes the files that the given attempt at the task of
+// shard wrote.
+func removeAttempt(shard string, attempt int) {
+	output := AttemptPath(shard, attempt)
+	for _, suffix := range shardFileSuffixes {
+		if err := os.Remove(output + suffix); err != nil &&
+			!errors.Is(err, os.ErrNotExist) {
+			log.Printf("Could not remove %s: %v", output+suffix, err)
+		}
+	}
+}
+
+// acceptAttempt moves the files that the given attempt at the task of shard
+// wrote into place.
+func acceptAttempt(shard string, attempt int) error {
+	output := AttemptPath(shard, attempt)
+	for _, suffix := range shardFileSuffixes {
+		err := os.Rename(output+suffix, shard+suffix)
+		if errors.Is(err, os.ErrNotExist) && suffix != "" {
+			continue
+		} else if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// coordinatorTask tracks the assignment of a task to workers. A task is
+// leased to worker for its attempts'th attempt, until it is assigned again.
+type coordinatorTask struct {
+	task     TokenizeTask
+	worker   string
+	deadline time.Time
+	attempts int
+	result   *TaskResult
+}
+
+// Coordinator
+// Partitions the inputs of a run into tasks, and hands them out to workers
+// over RPC. Tasks that fail, or whose worker does not report back within
+// TaskTimeout, are handed out again. Once every task is complete, the
+// results are aggregated into the run manifest.
+type Coordinator struct {
+	TaskTimeout  time.Duration
+	MaxAttempts  int
+	manifest     *RunManifest
+	manifestPath string
+	tasks        []*coordinatorTask
+	remaining    int
+	err          error
+	finished     chan struct{}
+	mutex        sync.Mutex
+}
+
+// NewCoordinator
+// Creates a Coordinator that partitions the inputs into tasks of at least
+// taskSize bytes each, writing their shards next to the manifest's output.
+func NewCoordinator(manifest *RunManifest, manifestPath string,
+	inputs []PathInfo, taskSize int64) *Coordinator {
+	coordinator := &Coordinator{
+		TaskTimeout:  DefaultTaskTimeout,
+		MaxAttempts:  DefaultMaxAttempts,
+		manifest:     manifest,
+		manifestPath: manifestPath,
+		tasks:        make([]*coordinatorTask, 0),
+		finished:     make(chan struct{}),
+	}
+	var taskInputs []PathInfo
+	var size int64
+	addTask := func() {
+		taskId := len(coordinator.tasks)
+		coordinator.tasks = append(coordinator.tasks, &coordinatorTask{
+			task: TokenizeTask{
+				Id:          taskId,
+				Inputs:      taskInputs,
+				Shard:       ShardPath(manifest.Output, taskId),
+				Fingerprint: manifest.Tokenizer.Fingerprint,
+				ContextSize: manifest.ContextSize,
+			},
+		})
+		taskInputs = nil
+		size = 0
+	}
+	for _, input := range inputs {
+		taskInputs = append(taskInputs, input)
+		if size += input.Size; size >= taskSize {
+			addTask()
+		}
+	}
+	if len(taskInputs) > 0 {
+		addTask()
+	}
+	coordinator.remaining = len(coordinator.tasks)
+	if coordinator.remaining == 0 {
+		close(coordinator.finished)
+	}
+	return coordinator
+}
+
+// NextTask
+// Assigns the next unassigned or expired task to the requesting worker.
+func (coordinator *Coordinator) NextTask(request *TaskRequest,
+	task *TokenizeTask) error {
+	coordinator.mutex.Lock()
+	defer coordinator.mutex.Unlock()
+	if coordinator.remaining == 0 || coordinator.err != nil {
+		*task = TokenizeTask{Done: true}
+		return nil
+	}
+	now := time.Now()
+	for _, assigned := range coordinator.tasks {
+		if assigned.result != nil ||
+			(assigned.worker != "" && now.Before(assigned.deadline)) {
+			continue
+		}
+		if assigned.worker != "" {
+			log.Printf("Task %d timed out on worker %s", assigned.task.Id,
+				assigned.worker)
+		}
+		assigned.worker = request.Worker
+		assigned.deadline = now.Add(coordinator.TaskTimeout)
+		assigned.attempts++
+		log.Printf("Assigned task %d of %d to worker %s", assigned.task.Id+1,
+			len(coordinator.tasks), request.Worker)
+		*task = assigned.task
+		task.Attempt = assigned.attempts
+		task.Output = AttemptPath(task.Shard, task.Attempt)
+		return nil
+	}
+	*task = TokenizeTask{Wait: true}
+	return nil
+}
+
+// CompleteTask
+// Records the result of an attempt at a task, and moves the shard of a
+// successful attempt into place. Results of workers that no longer hold the
+// task's lease, as it timed out and was assigned again, are ignored, and
+// their shards removed. Failed tasks are handed out again, until they have
+// failed MaxAttempts times, which fails the run.
+func (coordinator *Coordinator) CompleteTask(result *TaskResult,
+	ok *bool) error {
+	coordinator.mutex.Lock()
+	defer coordinator.mutex.Unlock()
+	if result.Id < 0 || result.Id >= len(coordinator.tasks) {
+		return errors.New(fmt.Sprintf("unknown task %d", result.Id))
+	}
+	assigned := coordinator.tasks[result.Id]
+	*ok = true
+	if assigned.result != nil || assigned.worker != result.Worker ||
+		assigned.attempts != result.Attempt {
+		// A worker that timed out may still finish after the task was
+		// assigned to, or completed by, another worker.
+		log.Printf("Ignoring attempt %d at task %d of worker %s, which "+
+			"no longer holds it", result.Attempt, result.Id, result.Worker)
+		removeAttempt(assigned.task.Shard, result.Attempt)
+		return nil
+	}
+	if result.Error == "" {
+		if err := acceptAttempt(assigned.task.Shard,
+			result.Attempt); err != nil {
+			result.Error = err.Error()
+		}
+	}
+	if result.Error != "" {
+		log.Printf("Task %d failed on worker %s: %s", result.Id,
+			result.Worker, result.Error)
+		removeAttempt(assigned.task.Shard, result.Attempt)
+		assigned.worker = ""
+		if assigned.attempts >= coordinator.MaxAttempts &&
+			coordinator.err == nil {
+			coordinator.err = errors.New(fmt.Sprintf(
+				"task %d failed %d times, last with: %s", result.Id,
+				assigned.attempts, result.Error))
+			close(coordinator.finished)
+		}
+		return nil
+	}
+	log.Printf("Task %d completed by worker %s with %d tokens", result.Id,
+		result.Worker, result.Tokens)
+	assigned.result = result
+	if coordinator.remaining--; coordinator.remaining == 0 &&
+		coordinator.err == nil {
+		close(coordinator.finished)
+	}
+	return nil
+}
+
+// TokenizeAttempt
+// Reads the documents of the inputs of task, and tokenizes them into the
+// shard of its attempt at task.Output, along with the shard's document index
+// if requested, which locates documents in task.Shard. Returns the number of
+// tokens written.
+func TokenizeAttempt(textsReader TextsReader, textsTokenizer TextsTokenizer,
+	contextsWriter ContextsWriter, task TokenizeTask,
+	documentIndex bool) (int, error) {
+	nextText, err := textsReader.ReadPaths(task.Inputs)
+	if err != nil {
+		return 0, err
+	}
+	return writeShardTo(nextText, textsTokenizer, contextsWriter,
+		task.Output, task.Shard, documentIndex)
+}
+
+// Health
+// Reports the coordinator's build, tokenizer and progress.
+func (coordinator *Coordinator) Health(request *TaskRequest,
+	health *CoordinatorHealth) error {
+	coordinator.mutex.Lock()
+	defer coordinator.mutex.Unlock()
+	*health = CoordinatorHealth{
+		Build:     coordinator.manifest.Build,
+		Tokenizer: coordinator.manifest.Tokenizer,
+		Tasks:     len(coordinator.tasks),
+		Remaining: coordinator.remaining,
+	}
+	if coordinator.err != nil {
+		health.Error = coordinator.err.Error()
+	}
+	return nil
+}
+
+// aggregate records every task's result in the manifest, in task order.
+func (coordinator *Coordinator) aggregate() {
+	manifest := coordinator.manifest
+	manifest.Inputs = make([]ManifestInput, 0)
+	for _, completed := range coordinator.tasks {
+		result := completed.result
+		manifest.Inputs = append(manifest.Inputs, result.Inputs...)
+		manifest.AddShard(completed.task.Shard, result.Tokens, result.Inputs,
+			result.StartedAt)
+		if result.Languages != nil {
+			manifest.AddLanguages(result.Languages)
+		}
+	}
+	manifest.Finish(manifest.TotalTokens)
+}
+
+// Serve
+// Hands out tasks to workers connecting to listener until every task is
+// complete, and then writes the aggregated manifest. Workers that ask for a
+// task during the grace period afterwards are told that the run is done.
+func (coordinator *Coordinator) Serve(listener net.Listener,
+	grace time.Duration) error {
+	server := rpc.NewServer()
+	if err := server.Register(coordinator); err != nil {
+		return err
+	}
+	go server.Accept(listener)
+	<-coordinator.finished
+	defer func() {
+		time.Sleep(grace)
+		listener.Close()
+	}()
+
+	coordinator.mutex.Lock()
+	defer coordinator.mutex.Unlock()
+	if coordinator.err != nil {
+		return coordinator.err
+	}
+	// Attempts that timed out and were never reported leave their shards.
+	for _, completed := range coordinator.tasks {
+		for attempt := 1; attempt <= completed.attempts; attempt++ {
+			if attempt != completed.result.Attempt {
+				removeAttempt(completed.task.Shard, attempt)
+			}
+		}
+	}
+	coordinator.aggregate()
+	return coordinator.manifest.Write(coordinator.manifestPath)
+}
+
+// dialCoordinator connects to the coordinator at address, such as
+// `tcp://host:7070`.
+func dialCoordinator(address string) (*rpc.Client, error) {
+	coordinatorUrl, err := url.Parse(address)
+	if err != nil {
+		return nil, err
+	} else if coordinatorUrl.Scheme != "tcp" {
+		return nil, errors.New(fmt.Sprintf(
+			"coordinator address must be tcp://host:port, not %s", address))
+	}
+	return rpc.Dial("tcp", coordinatorUrl.Host)
+}
+
+// workerRequest identifies this process to the coordinator.
+func workerRequest() TaskRequest {
+	hostname, _ := os.Hostname()
+	return TaskRequest{Worker: fmt.Sprintf("%s:%d", hostname, os.Getpid())}
+}
+
+// QueryHealth
+// Asks the coordinator at address, such as `tcp://host:7070`, for its
+// health.
+func QueryHealth(address string) (*CoordinatorHealth, error) {
+	client, err := dialCoordinator(address)
+	if err != nil {
+		return nil, err
+	}
+	defer client.Close()
+	request := workerRequest()
+	var health CoordinatorHealth
+	if err := client.Call("Coordinator.Health", &request,
+		&health); err != nil {
+		return nil, err
+	}
+	return &health, nil
+}
+
+// RunWorker
+// Connects to the coordinator at address, such as `tcp://host:7070`, and
+// calls work for each task it is assigned until the run is done. Workers
+// built with another release of gpt_bpe than the coordinator refuse to
+// work, as they may tokenize differently.
+func RunWorker(address string,
+	work func(task TokenizeTask) TaskResult) error {
+	client, err := dialCoordinator(address)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	request := workerRequest()
+	var health CoordinatorHealth
+	if err := client.Call("Coordinator.Health", &request,
+		&health); err != nil {
+		return err
+	}
+	if health.Build.GptBpeVersion != gpt_bpe.Version() {
+		return errors.New(fmt.Sprintf("gpt_bpe %s does not match the "+
+			"coordinator's %s", gpt_bpe.Version(),
+			health.Build.GptBpeVersion))
+	}
+	build := GetManifestBuild()
+	if build.VcsRevision != health.Build.VcsRevision ||
+		build.VcsModified != health.Build.VcsModified {
+		log.Printf("Worker build %s does not match the coordinator's %s",
+			build.VcsRevision, health.Build.VcsRevision)
+	}
+	for {
+		var task TokenizeTask
+		if err := client.Call("Coordinator.NextTask", &request,
+			&task); err != nil {
+			return err
+		}
+		if task.Done {
+			return nil
+		} else if task.Wait {
+			time.Sleep(workerPollInterval)
+			continue
+		}
+		result := work(task)
+		result.Worker = request.Worker
+		result.Id = task.Id
+		result.Attempt = task.Attempt
+		var ok bool
+		if err := client.Call("Coordinator.CompleteTask", &result,
+			&ok); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// CurriculumScores is the name of the curriculum that scores documents by
+// the external score of their input, read from a -curriculum_scores file.
+const CurriculumScores = "scores"
+
+// DocumentScorer
+// Scores a document read from the input at source for a curriculum, where
+// lower scores are easier and are written first.
+type DocumentScorer func(source string, document string) float64
+
+// Curriculum
+// Orders the documents of a run from easy to hard by their score, so that
+// the contexts of its output, and of each of its shards in turn, are laid out
+// for curriculum learning. Documents of equal score keep the order that they
+// were read in. As every document must be scored before the first can be
+// written, the documents of a shard are held in memory while it is ordered.
+type Curriculum struct {
+	Name   string
+	Scorer DocumentScorer
+}
+
+// NewCurriculum
+// Creates a Curriculum that orders documents by the given scorer.
+func NewCurriculum(name string, scorer DocumentScorer) *Curriculum {
+	return &Curriculum{Name: name, Scorer: scorer}
+}
+
+// ParseCurriculum
+// Creates a Curriculum from its name: `length` scores documents by their
+// number of characters, the name of a built-in quality filter scores them as
+// the filter does, and `scores` scores them by the score of their input in
+// the file at scoresPath, as LoadSourceScores reads it.
+func ParseCurriculum(name string, scoresPath string) (*Curriculum, error) {
+	name = strings.TrimSpace(name)
+	if (name == CurriculumScores) != (scoresPath != "") {
+		return nil, errors.New(fmt.Sprintf("curriculum %s: a scores file "+
+			"is given with, and only with, the %s curriculum", name,
+			CurriculumScores))
+	}
+	if name == "length" {
+		return NewCurriculum(name, func(_ string, document string) float64 {
+			return float64(utf8.RuneCountInString(document))
+		}), nil
+	} else if name == CurriculumScores {
+		scores, err := LoadSourceScores(scoresPath)
+		if err != nil {
+			return nil, err
+		}
+		return NewCurriculum(name, func(source string, _ string) float64 {
+			if score, ok := scores[source]; ok {
+				return score
+			}
+			// Inputs without a score are the hardest.
+			return math.Inf(1)
+		}), nil
+	} else if filter, ok := GopherFilters()[name]; ok {
+		return NewCurriculum(name, func(_ string, document string) float64 {
+			return filter.Score(document)
+		}), nil
+	}
+	return nil, errors.New(fmt.Sprintf("unknown curriculum: %s, expected "+
+		"length, %s or a quality filter name", name, CurriculumScores))
+}
+
+// LoadSourceScores
+// Reads the external score of each input from the file at path, of an input
+// path and its score separated by a tab on each line.
+func LoadSourceScores(path string) (map[string]float64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	scores := make(map[string]float64)
+	scanner := bufio.NewScanner(file)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		tab := strings.LastIndexByte(line, '\t')
+		if tab < 0 {
+			return nil, errors.New(fmt.Sprintf("%s:%d: expected a path and "+
+				"a score separated by a tab", path, lineNum))
+		}
+		score, err := strconv.ParseFloat(strings.TrimSpace(line[tab+1:]), 64)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("%s:%d: %v", path, lineNum,
+				err))
+		}
+		scores[line[:tab]] = score
+	}
+	return scores, scanner.Err()
+}
+
+// Order
+// Reads every document from next, which returns the input that each
+// document was read from along with it, or a nil reader after the last, and
+// returns a TextsIterator over them from the lowest score to the highest.
+func (curriculum *Curriculum) Order(
+	next func() (string, io.RuneReader)) TextsIterator {
+	type scoredDocument struct {
+		score    float64
+		document string
+		metadata map[string]interface{}
+	}
+	documents := make([]scoredDocument, 0)
+	for source, reader := next(); reader != nil; source, reader = next() {
+		document := readDocument(reader)
+		documents = append(documents, scoredDocument{
+			score:    curriculum.Scorer(source, document),
+			document: document,
+			metadata: readerMetadata(reader),
+		})
+	}
+	sort.SliceStable(documents, func(i, j int) bool {
+		return documents[i].score < documents[j].score
+	})
+	return func() io.RuneReader {
+		if len(documents) == 0 {
+			return nil
+		}
+		document := documents[0]
+		documents = documents[1:]
+		return withMetadata(strings.NewReader(document.document),
+			document.metadata)
+	}
+}
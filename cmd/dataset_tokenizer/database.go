@@ -0,0 +1,137 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/wbrown/gpt_bpe"
+	_ "modernc.org/sqlite"
+)
+
+// databaseDrivers are the database/sql drivers of each engine. DuckDB's
+// driver is a cgo binding, and is only registered in cgo builds.
+var databaseDrivers = map[string]string{
+	OutputFormatSQLite: "sqlite",
+}
+
+// databaseSchema creates the documents table. Tokens are stored as a blob of
+// little-endian uint16 tokens, as in the contexts output.
+var databaseSchema = []string{`CREATE TABLE documents (
+	id INTEGER PRIMARY KEY,
+	source TEXT NOT NULL,
+	text TEXT NOT NULL,
+	token_count INTEGER NOT NULL,
+	tokens BLOB NOT NULL
+)`, `CREATE TABLE metadata (
+	key TEXT PRIMARY KEY,
+	value TEXT NOT NULL
+)`}
+
+// databaseIndexes are created once every document is inserted, which is
+// faster than maintaining them during the inserts.
+const databaseIndexes = `CREATE INDEX documents_source ON documents (source)`
+
+// DocumentsDatabase
+// Writes documents, along with their tokens, into a SQLite or DuckDB
+// database file for interactive analysis, through the engine's database/sql
+// driver. DuckDB's driver requires a build with cgo.
+type DocumentsDatabase struct {
+	Engine    string
+	Documents int
+	Tokens    int
+}
+
+// NewDocumentsDatabase
+// Creates a DocumentsDatabase for the given engine.
+func NewDocumentsDatabase(engine string) (*DocumentsDatabase, error) {
+	switch engine {
+	case OutputFormatSQLite, OutputFormatDuckDB:
+		if _, ok := databaseDrivers[engine]; !ok {
+			return nil, errors.New(fmt.Sprintf(
+				"database engine %s requires a build with cgo", engine))
+		}
+		return &DocumentsDatabase{Engine: engine}, nil
+	default:
+		return nil, errors.New(fmt.Sprintf(
+			"invalid database engine %s", engine))
+	}
+}
+
+// Write
+// Reads the documents of the given inputs with textsReader, tokenizes them
+// with encoder, and writes them to a new database at dbPath, replacing any
+// existing file. The metadata table records each of the given key and
+// values. The rows are inserted with prepared statements in a single
+// transaction, so a failed write leaves no partial documents.
+func (db *DocumentsDatabase) Write(textsReader TextsReader,
+	encoder *gpt_bpe.GPTEncoder, matches []PathInfo, dbPath string,
+	metadata map[string]string) error {
+	if err := os.Remove(dbPath); err != nil && !errors.Is(err,
+		os.ErrNotExist) {
+		return err
+	}
+	db.Documents, db.Tokens = 0, 0
+	conn, err := sql.Open(databaseDrivers[db.Engine], dbPath)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	for _, statement := range databaseSchema {
+		if _, err := conn.Exec(statement); err != nil {
+			return err
+		}
+	}
+	tx, err := conn.Begin()
+	if err != nil {
+		return err
+	}
+	if err := db.insert(tx, textsReader, encoder, matches,
+		metadata); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	_, err = conn.Exec(databaseIndexes)
+	return err
+}
+
+// insert inserts the metadata and the documents of the inputs in tx.
+func (db *DocumentsDatabase) insert(tx *sql.Tx, textsReader TextsReader,
+	encoder *gpt_bpe.GPTEncoder, matches []PathInfo,
+	metadata map[string]string) error {
+	insertMetadata, err := tx.Prepare(
+		"INSERT INTO metadata VALUES (?, ?)")
+	if err != nil {
+		return err
+	}
+	defer insertMetadata.Close()
+	for key, value := range metadata {
+		if _, err := insertMetadata.Exec(key, value); err != nil {
+			return err
+		}
+	}
+	insertDocument, err := tx.Prepare(
+		"INSERT INTO documents VALUES (?, ?, ?, ?, ?)")
+	if err != nil {
+		return err
+	}
+	defer insertDocument.Close()
+	return encodeDocuments(textsReader, encoder, matches,
+		func(source string, document string, tokens gpt_bpe.Tokens) error {
+			bin, err := tokens.ToBin()
+			if err != nil {
+				return err
+			}
+			if _, err := insertDocument.Exec(db.Documents, source, document,
+				len(tokens), *bin); err != nil {
+				return err
+			}
+			db.Documents++
+			db.Tokens += len(tokens)
+			return nil
+		})
+}
@@ -0,0 +1,11 @@
+//go:build cgo
+
+package main
+
+import (
+	_ "github.com/marcboeker/go-duckdb"
+)
+
+func init() {
+	databaseDrivers[OutputFormatDuckDB] = "duckdb"
+}
@@ -2,19 +2,24 @@ package main
 
 import (
 	"bufio"
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"log"
+	"math"
 	"math/rand"
+	"net"
 	"os"
+	"os/signal"
 	"sort"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/wbrown/gpt_bpe"
+	"github.com/wbrown/gpt_bpe/dataset"
 	"github.com/yargevad/filepathx"
 )
 
@@ -29,22 +34,74 @@ type PathInfo struct {
 	Dir     bool
 }
 
-// GlobTexts
-// Given a directory path, recursively finds all `.txt` files, returning a
-// slice of PathInfo.
-func GlobTexts(dirPath string) (pathInfos []PathInfo, err error) {
-	textPaths, err := filepathx.Glob(dirPath + "/**/*.txt")
-	if err != nil {
-		return nil, err
+const (
+	InputFormatText    = "text"
+	InputFormatWikiXML = "wikixml"
+	InputFormatWARC    = "warc"
+	InputFormatWET     = "wet"
+	InputFormatNATS    = "nats"
+	InputFormatJSONL   = "jsonl"
+)
+
+// InputFormatExtensions
+// Maps each input format to the file extensions that are read for it, each
+// of which is also read compressed, with one of CompressedInputExtensions.
+var InputFormatExtensions = map[string][]string{
+	InputFormatText:    {".txt"},
+	InputFormatWikiXML: {".xml"},
+	InputFormatWARC:    {".warc"},
+	InputFormatWET:     {".wet"},
+	InputFormatJSONL:   {".jsonl"},
+	// Streams are read from a URL rather than from files.
+	InputFormatNATS: {},
+}
+
+// InputGlobs
+// Returns the glob patterns used to recursively find input files of the given
+// format in dirPath. If dirPath is a single file, the pattern is the path
+// itself.
+func InputGlobs(dirPath string, format string) []string {
+	if stat, err := os.Stat(dirPath); err == nil && !stat.IsDir() {
+		return []string{dirPath}
+	}
+	globs := make([]string, 0)
+	for _, extension := range InputFormatExtensions[format] {
+		globs = append(globs, dirPath+"/**/*"+extension)
+		for _, compressed := range CompressedInputExtensions {
+			globs = append(globs, dirPath+"/**/*"+extension+compressed)
+		}
 	}
-	numMatches := len(textPaths)
+	return globs
+}
+
+// GlobInputs
+// Given a directory path, recursively finds all input files of the given
+// format, returning a slice of PathInfo. If the path is a single file, it is
+// returned as is, regardless of its extension.
+func GlobInputs(dirPath string, format string) (pathInfos []PathInfo,
+	err error) {
+	extensions, ok := InputFormatExtensions[format]
+	if !ok {
+		return nil, errors.New(fmt.Sprintf(
+			"unknown input format: %s", format))
+	}
+	inputPaths := make([]string, 0)
+	for _, glob := range InputGlobs(dirPath, format) {
+		globPaths, globErr := filepathx.Glob(glob)
+		if globErr != nil {
+			return nil, globErr
+		}
+		inputPaths = append(inputPaths, globPaths...)
+	}
+	numMatches := len(inputPaths)
 	if numMatches == 0 {
 		return nil, errors.New(fmt.Sprintf(
-			"%s does not contain any .txt files", dirPath))
+			"%s does not contain any %s files", dirPath,
+			strings.Join(extensions, " or ")))
 	}
 	pathInfos = make([]PathInfo, numMatches)
-	for matchIdx := range textPaths {
-		currPath := textPaths[matchIdx]
+	for matchIdx := range inputPaths {
+		currPath := inputPaths[matchIdx]
 		if stat, statErr := os.Stat(currPath); statErr != nil {
 			return nil, statErr
 		} else {
@@ -59,6 +116,13 @@ func GlobTexts(dirPath string) (pathInfos []PathInfo, err error) {
 	return pathInfos, nil
 }
 
+// GlobTexts
+// Given a directory path, recursively finds all `.txt` files, returning a
+// slice of PathInfo.
+func GlobTexts(dirPath string) (pathInfos []PathInfo, err error) {
+	return GlobInputs(dirPath, InputFormatText)
+}
+
 func SortPathInfoBySize(pathInfos []PathInfo, ascending bool) {
 	if ascending {
 		sort.Slice(pathInfos, func(i, j int) bool {
@@ -130,7 +194,15 @@ func FindNewestPath(paths []PathInfo) (path *string, newest *time.Time,
 // for the newest `.txt` file.
 func FindNewestText(dirPath string) (path *string, newest *time.Time,
 	err error) {
-	matches, err := GlobTexts(dirPath)
+	return FindNewestInput(dirPath, InputFormatText)
+}
+
+// FindNewestInput
+// Given a directory, recursively scans and returns the path and modified time
+// for the newest input file of the given format.
+func FindNewestInput(dirPath string, format string) (path *string,
+	newest *time.Time, err error) {
+	matches, err := GlobInputs(dirPath, format)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -157,16 +229,78 @@ func FindNewestDir(dirPath string) (path *string, newest *time.Time,
 	return FindNewestPath(directories)
 }
 
+// TextsReader
+// A struct that encapsulates the configuration for reading input texts.
+type TextsReader struct {
+	Format             string
+	Sanitize           bool
+	SortSpec           string
+	Splitter           *DocumentSplitter
+	WikiStripTemplates bool
+	WarcLanguages      []string
+	WarcStatusCodes    []int
+	Languages          *LanguageFilter
+	Filters            *DocumentFilters
+	Dedup              *Deduplicator
+	Curriculum         *Curriculum
+	// Shuffle, if set, shuffles the documents that are read, after they are
+	// filtered.
+	Shuffle *DocumentShuffler
+	// JSONL reads the documents of jsonl inputs, from their "text" field if
+	// it is nil.
+	JSONL *JSONLInput
+}
+
+// NewTextsReader
+// Creates a new TextsReader struct with the default configuration.
+func NewTextsReader() TextsReader {
+	return TextsReader{
+		Format:             InputFormatText,
+		Sanitize:           false,
+		SortSpec:           "",
+		Splitter:           nil,
+		WikiStripTemplates: false,
+		WarcLanguages:      nil,
+		WarcStatusCodes:    []int{200},
+		Languages:          nil,
+		Filters:            nil,
+		Dedup:              nil,
+		Curriculum:         nil,
+		Shuffle:            nil,
+		JSONL:              nil,
+	}
+}
+
 // ReadTexts
 // Consumes a directory path and recursively scans for `.txt` files, producing
 // a TextsIterator function that yields the text file as an io.Reader type.
 func ReadTexts(dirPath string, sanitize bool, sortSpec string) (TextsIterator,
 	error) {
-	matches, err := GlobTexts(dirPath)
+	textsReader := NewTextsReader()
+	textsReader.Sanitize = sanitize
+	textsReader.SortSpec = sortSpec
+	return textsReader.ReadTexts(dirPath)
+}
+
+// ReadTexts
+// Consumes a directory path and recursively scans for input files, producing
+// a TextsIterator function that yields each document as an io.Reader type.
+// Without a Splitter, each text file is a single document.
+func (tr TextsReader) ReadTexts(dirPath string) (TextsIterator, error) {
+	matches, err := GlobInputs(dirPath, tr.Format)
 	if err != nil {
 		return nil, err
 	}
+	return tr.ReadPaths(matches)
+}
 
+// ReadPaths
+// Produces a TextsIterator function over the documents in the given input
+// files, ordered according to the reader's sort spec, or by the reader's
+// curriculum if it has one, and shuffled if the reader shuffles documents.
+func (tr TextsReader) ReadPaths(matches []PathInfo) (TextsIterator, error) {
+	sortSpec := tr.SortSpec
+	matches = append([]PathInfo(nil), matches...)
 	if sortSpec != "" && sortSpec != "shuffle" {
 		if sortSpec == "size_ascending" {
 			SortPathInfoBySize(matches, true)
@@ -188,6 +322,7 @@ func ReadTexts(dirPath string, sanitize bool, sortSpec string) (TextsIterator,
 
 	type namedRuneReader struct {
 		path   string
+		source string
 		reader io.RuneReader
 	}
 
@@ -196,33 +331,168 @@ func ReadTexts(dirPath string, sanitize bool, sortSpec string) (TextsIterator,
 	runeReaders := make(chan namedRuneReader, 4)
 	go func() {
 		for matchIdx := 0; matchIdx < numMatches; matchIdx++ {
-			path := matches[matchIdx]
-			if fileReader, openErr := os.Open(path.Path); openErr != nil {
-				log.Fatal(openErr)
-			} else {
-				if sanitize {
-					runeReaders <- namedRuneReader{
-						path.Path,
-						CreateTextSanitizer(fileReader)}
-				} else {
-					runeReaders <- namedRuneReader{
-						path.Path,
-						bufio.NewReaderSize(fileReader,
-							8*1024*1024)}
+			path := matches[matchIdx].Path
+			// Only log the path for the first document of each file.
+			name := path
+			emit := func(reader io.RuneReader) {
+				if reader = tr.filterDocument(reader); reader == nil {
+					return
 				}
+				runeReaders <- namedRuneReader{name, path, reader}
+				name = ""
+			}
+			if readErr := tr.readFile(path, emit); readErr != nil {
+				log.Fatal(readErr)
 			}
 		}
 		close(runeReaders)
 	}()
 
-	return func() io.RuneReader {
+	if tr.Curriculum != nil {
+		return tr.Curriculum.Order(func() (string, io.RuneReader) {
+			if reader, ok := <-runeReaders; !ok {
+				return "", nil
+			} else {
+				if reader.path != "" {
+					log.Print("Reading ", reader.path)
+				}
+				return reader.source, reader.reader
+			}
+		}), nil
+	}
+	nextText := func() io.RuneReader {
 		if reader, ok := <-runeReaders; !ok {
 			return nil
 		} else {
-			log.Print("Reading ", reader.path)
+			if reader.path != "" {
+				log.Print("Reading ", reader.path)
+			}
 			return reader.reader
 		}
-	}, nil
+	}
+	if tr.Shuffle != nil {
+		return tr.Shuffle.Shuffle(nextText)
+	}
+	return nextText, nil
+}
+
+// readFile
+// Opens the file at path and calls emit with an io.RuneReader for each
+// document in the file, according to the input format and the splitter.
+func (tr TextsReader) readFile(path string, emit func(io.RuneReader)) error {
+	fileReader, openErr := os.Open(path)
+	if openErr != nil {
+		return openErr
+	}
+	reader, decompressErr := decompressReader(path, fileReader)
+	if decompressErr != nil {
+		fileReader.Close()
+		return errors.New(fmt.Sprintf("error reading %s: %v",
+			path, decompressErr))
+	}
+	switch {
+	case tr.Format == InputFormatWARC || tr.Format == InputFormatWET:
+		defer fileReader.Close()
+		warcReader := NewWarcReader(reader)
+		if tr.WarcLanguages != nil {
+			warcReader.Languages = make(map[string]bool)
+			for _, language := range tr.WarcLanguages {
+				warcReader.Languages[language] = true
+			}
+		}
+		if tr.WarcStatusCodes != nil {
+			warcReader.StatusCodes = make(map[int]bool)
+			for _, statusCode := range tr.WarcStatusCodes {
+				warcReader.StatusCodes[statusCode] = true
+			}
+		}
+		for {
+			document, warcErr := warcReader.Next()
+			if warcErr == io.EOF {
+				return nil
+			} else if warcErr != nil {
+				return errors.New(fmt.Sprintf("error reading %s: %v",
+					path, warcErr))
+			}
+			emit(tr.documentReader(*document))
+		}
+	case tr.Format == InputFormatJSONL:
+		defer fileReader.Close()
+		jsonlInput := tr.JSONL
+		if jsonlInput == nil {
+			jsonlInput = &JSONLInput{Field: DefaultJSONLField}
+		}
+		if jsonlErr := jsonlInput.Read(reader, func(document string,
+			metadata map[string]interface{}) {
+			emit(withMetadata(tr.documentReader(document), metadata))
+		}); jsonlErr != nil {
+			return errors.New(fmt.Sprintf("error reading %s: %v",
+				path, jsonlErr))
+		}
+		return nil
+	case tr.Format == InputFormatWikiXML:
+		defer fileReader.Close()
+		wikiReader := NewWikiReader(reader)
+		wikiReader.StripTemplates = tr.WikiStripTemplates
+		for {
+			page, pageErr := wikiReader.Next()
+			if pageErr == io.EOF {
+				return nil
+			} else if pageErr != nil {
+				return errors.New(fmt.Sprintf("error reading %s: %v",
+					path, pageErr))
+			}
+			emit(tr.documentReader(page.Document()))
+		}
+	case tr.Splitter != nil:
+		defer fileReader.Close()
+		nextDocument := tr.Splitter.Split(reader)
+		for {
+			document, splitErr := nextDocument()
+			if splitErr != nil {
+				return errors.New(fmt.Sprintf("error splitting %s: %v",
+					path, splitErr))
+			} else if document == nil {
+				return nil
+			}
+			emit(tr.documentReader(*document))
+		}
+	case tr.Sanitize:
+		emit(CreateTextSanitizer(reader))
+	default:
+		emit(bufio.NewReaderSize(reader, 8*1024*1024))
+	}
+	return nil
+}
+
+// filterDocument
+// Returns a reader over the document in reader, or nil if the document is
+// dropped for its language, by the quality filters, or as a duplicate. The
+// document keeps its metadata.
+func (tr TextsReader) filterDocument(reader io.RuneReader) io.RuneReader {
+	metadata := readerMetadata(reader)
+	if tr.Languages != nil {
+		if reader, _ = tr.Languages.Filter(reader); reader == nil {
+			return nil
+		}
+	}
+	if tr.Filters != nil {
+		reader = tr.Filters.FilterReader(reader)
+	}
+	if tr.Dedup != nil && reader != nil {
+		reader = tr.Dedup.FilterReader(reader)
+	}
+	return withMetadata(reader, metadata)
+}
+
+// documentReader
+// Returns an io.RuneReader over an in-memory document, sanitizing it if
+// requested.
+func (tr TextsReader) documentReader(document string) io.RuneReader {
+	if tr.Sanitize {
+		return CreateTextSanitizer(strings.NewReader(document))
+	}
+	return strings.NewReader(document)
 }
 
 // TextsTokenizer
@@ -236,6 +506,15 @@ type TextsTokenizer struct {
 	PadToken        string
 	EndOfText       string
 	Unitrim         bool
+	DocumentIndex   *DocumentIndex
+	// Packing is the mode of packing documents into contexts, and
+	// PackingBins the number of contexts open to documents when they are
+	// bin-packed.
+	Packing     string
+	PackingBins int
+	// LossMasks, if set, receives the loss mask of each context, for which
+	// the prompt and completion of each document are tokenized separately.
+	LossMasks *LossMasks
 }
 
 // NewTextsTokenizer
@@ -250,6 +529,10 @@ func NewTextsTokenizer() TextsTokenizer {
 		"<|endoftext|>",
 		"<|padding|>",
 		true,
+		nil,
+		PackingNone,
+		DefaultPackingBins,
+		nil,
 	}
 }
 
@@ -341,42 +624,55 @@ func (tt *TextsTokenizer) PartitionBoundary(
 	return idx
 }
 
+// SpecialTokens
+// Returns the padding and end of text tokens, which default to those of the
+// tokenizer.
+func (tt TextsTokenizer) SpecialTokens() (padToken gpt_bpe.Token,
+	endOfText gpt_bpe.Token, err error) {
+	tokenizer, err := tt.InitTokenizer()
+	if err != nil {
+		return 0, 0, err
+	}
+	if tt.PadToken == "" {
+		padToken = tokenizer.PadToken
+	} else if padToken, err = getAndCheckToken(tokenizer, tt.PadToken,
+		"PadToken"); err != nil {
+		return 0, 0, err
+	}
+	if tt.EndOfText == "" {
+		endOfText = tokenizer.EosToken
+	} else if endOfText, err = getAndCheckToken(tokenizer, tt.EndOfText,
+		"EndOfText"); err != nil {
+		return 0, 0, err
+	}
+	return padToken, endOfText, nil
+}
+
 // TokenizeTexts
 // Consumes a TextsIterator and produces a ContextsIterator iterator function
 // that returns tokenized contexts that are fixed and padded out to
-// `contextSize`.
+// `contextSize`, bin-packing the documents with PackTexts if a Packing mode
+// is set.
 func (tt TextsTokenizer) TokenizeTexts(
 	nextText TextsIterator) (ContextsIterator, error) {
+	if tt.Packing != PackingNone {
+		return tt.PackTexts(nextText)
+	}
 	tokenizerPtr, tokErr := tt.InitTokenizer()
 	if tokErr != nil {
 		return nil, tokErr
 	}
 	tokenizer := *tokenizerPtr
-	var padToken, endOfText gpt_bpe.Token
-	if tt.PadToken == "" {
-		padToken = tokenizer.PadToken
-	} else {
-		var padErr error
-		padToken, padErr = getAndCheckToken(&tokenizer, tt.PadToken,
-			"PadToken")
-		if padErr != nil {
-			return nil, padErr
-		}
-	}
-	if tt.EndOfText == "" {
-		endOfText = tokenizer.EosToken
-	} else {
-		var eotErr error
-		endOfText, eotErr = getAndCheckToken(&tokenizer, tt.EndOfText,
-			"EndOfText")
-		if eotErr != nil {
-			return nil, eotErr
-		}
+	padToken, endOfText, specialErr := tt.SpecialTokens()
+	if specialErr != nil {
+		return nil, specialErr
 	}
 
 	var boundary gpt_bpe.Token
 	if tt.Boundary == "" {
-		boundary = 65535
+		// No token has the largest id, so without a boundary token
+		// contexts are split at the unicode aligned token index.
+		boundary = ^gpt_bpe.Token(0)
 	} else {
 		var boundaryErr error
 		boundary, boundaryErr = getAndCheckToken(&tokenizer, tt.Boundary,
@@ -392,22 +688,62 @@ func (tt TextsTokenizer) TokenizeTexts(
 	var done bool
 	var numTokens, idx, begin int
 	boundaryIdxes := make([]int, 0)
+	// The number of tokens dropped from the front of `tokens`, and contexts
+	// returned, so that the document index can locate source tokens.
+	var dropped int64
+	var contextIdx int
+	documentIndex := tt.DocumentIndex
+	// The loss mask of each of `tokens`, when loss masks are written.
+	lossMasks := tt.LossMasks
+	var masks []int64
+	contextMask := func(chunk gpt_bpe.Tokens) []int64 {
+		mask := make([]int64, contextSize)
+		end := begin + len(chunk)
+		if end > len(masks) {
+			end = len(masks)
+		}
+		copy(mask, masks[begin:end])
+		return mask
+	}
 
 	// Consume texts from `nextText()` and tokenize as a `goroutine`.
-	tokenizedTexts := make(chan gpt_bpe.Tokens, 4)
+	type tokenizedText struct {
+		tokens      gpt_bpe.Tokens
+		documentEnd bool
+		metadata    map[string]interface{}
+		completion  bool
+	}
+	tokenizedTexts := make(chan tokenizedText, 4)
 	nextTokenized := func() {
 		for {
 			runeReader := nextText()
 			if runeReader != nil {
-				encodeChunk := tokenizer.StreamingEncode(runeReader)
-				for {
-					tokenized := encodeChunk(contextSize * 8)
-					if tokenized == nil {
-						tokenizedTexts <- gpt_bpe.Tokens{endOfText}
-						break
+				metadata := readerMetadata(runeReader)
+				// The prompt and completion of a document are tokenized
+				// separately, so that their tokens can be told apart.
+				pieces := []io.RuneReader{runeReader}
+				completions := []bool{true}
+				if lossMasks != nil {
+					if prompt, completion, ok := splitPrompt(
+						runeReader); ok {
+						pieces = []io.RuneReader{strings.NewReader(prompt),
+							strings.NewReader(completion)}
+						completions = []bool{false, true}
+					}
+				}
+				for pieceIdx, piece := range pieces {
+					encodeChunk := tokenizer.StreamingEncode(piece)
+					for {
+						tokenized := encodeChunk(contextSize * 8)
+						if tokenized == nil {
+							break
+						}
+						tokenizedTexts <- tokenizedText{*tokenized, false,
+							nil, completions[pieceIdx]}
 					}
-					tokenizedTexts <- *tokenized
 				}
+				tokenizedTexts <- tokenizedText{gpt_bpe.Tokens{endOfText},
+					true, withoutPromptBytes(metadata), true}
 			} else {
 				close(tokenizedTexts)
 				break
@@ -419,8 +755,21 @@ func (tt TextsTokenizer) TokenizeTexts(
 	// Consumes tokenized texts and resets closured states for token blocks.
 	moreTokens := func() {
 		moreTokens, more := <-tokenizedTexts
-		tokens = append(tokens, moreTokens...)
+		tokens = append(tokens, moreTokens.tokens...)
 		numTokens = len(tokens)
+		if lossMasks != nil {
+			value := int64(0)
+			if moreTokens.completion {
+				value = 1
+			}
+			for range moreTokens.tokens {
+				masks = append(masks, value)
+			}
+		}
+		if moreTokens.documentEnd && documentIndex != nil {
+			documentIndex.endDocument(dropped+int64(numTokens),
+				moreTokens.metadata)
+		}
 		if more {
 			done = false
 		} else {
@@ -445,6 +794,16 @@ func (tt TextsTokenizer) TokenizeTexts(
 				// We're completely done and have no more token chunks to
 				// return, so we flush out and pad the last chunk.
 				chunk := tokens[begin:]
+				if documentIndex != nil {
+					documentIndex.addContext(contextIdx, contextSize,
+						dropped+int64(begin), dropped+int64(numTokens),
+						len(chunk))
+				}
+				contextIdx++
+				if lossMasks != nil {
+					lossMasks.push(contextMask(chunk))
+					masks = masks[:0]
+				}
 				padSize := contextSize - len(chunk)
 				if padSize > 0 {
 					for padIdx := 0; padIdx < padSize; padIdx += 1 {
@@ -480,6 +839,15 @@ func (tt TextsTokenizer) TokenizeTexts(
 					} else {
 						idx = begin + len(chunk)
 					}
+					if documentIndex != nil {
+						documentIndex.addContext(contextIdx, contextSize,
+							dropped+int64(begin), dropped+int64(idx),
+							len(chunk))
+					}
+					contextIdx++
+					if lossMasks != nil {
+						lossMasks.push(contextMask(chunk))
+					}
 
 					// If we have less than `contextSize`, we need to pad out
 					// the tokens in this context.
@@ -499,7 +867,7 @@ func (tt TextsTokenizer) TokenizeTexts(
 					// We were given a hard index to use as the chunk boundary,
 					// and it may not be a complete unicode character, so we
 					// need to align it to a valid unicode character.
-					if boundary == 65535 && doUnitrim {
+					if boundary == ^gpt_bpe.Token(0) && doUnitrim {
 						// Ensure that our next chunk is aligned to valid
 						// unicode.
 						_, offset := tokenizer.AlignAndSizeTokens(&chunk,
@@ -516,6 +884,10 @@ func (tt TextsTokenizer) TokenizeTexts(
 					// state for the next invocation of this function.
 					if idx > contextSize*6 {
 						tokens = tokens[idx:]
+						if lossMasks != nil {
+							masks = masks[idx:]
+						}
+						dropped += int64(idx)
 						begin = 0
 						idx = 0
 					} else {
@@ -534,18 +906,204 @@ func (tt TextsTokenizer) TokenizeTexts(
 	return nextContext, nil
 }
 
+const (
+	CompressionNone = ""
+	CompressionZstd = "zst"
+
+	CompressionFramesChunk    = "chunk"
+	CompressionFramesContext  = "context"
+	CompressionFramesDocument = "document"
+
+	DefaultCompressionChunkSize = 4 * 1024 * 1024
+
+	OutputFormatContexts    = "contexts"
+	OutputFormatHuggingFace = "huggingface"
+	OutputFormatSQLite      = "sqlite"
+	OutputFormatDuckDB      = "duckdb"
+	OutputFormatJSONL       = "jsonl"
+	OutputFormatParquet     = "parquet"
+	OutputFormatMegatron    = "megatron"
+	OutputFormatTFRecord    = "tfrecord"
+)
+
+// ContextsWriter
+// A struct that encapsulates the configuration for writing contexts.
+type ContextsWriter struct {
+	Encoder     *gpt_bpe.GPTEncoder
+	Sampling    int
+	Shuffle     bool
+	Compression string
+	// CompressionFrames lays out the compressed frames, each of which holds
+	// a CompressionChunkSize chunk of contexts, a single context, or a
+	// single document, which is ended by the EndOfText token, which must be
+	// set.
+	CompressionFrames    string
+	CompressionChunkSize int
+	// CompressionLevel is the level of Compression, or zero for its default
+	// level, and CompressionWorkers the number of frames compressed at once.
+	CompressionLevel   int
+	CompressionWorkers int
+	// Format selects between binary contexts, and a Hugging Face dataset
+	// with the optional AttentionMask and Labels columns, for which the
+	// PadToken and EndOfText tokens must be set.
+	Format        string
+	AttentionMask bool
+	Labels        bool
+	PadToken      gpt_bpe.Token
+	EndOfText     gpt_bpe.Token
+	// TFRecordFeatures are the features of each context's tf.Example in
+	// TFRecord output, which are its input_ids if there are none.
+	TFRecordFeatures []TFRecordFeature
+	// Report, if set, tallies the packing of every context that is written.
+	Report *PackingReport
+	// SegmentIds writes the segment ids of the contexts, as the segment_ids
+	// column of Hugging Face datasets, or alongside binary contexts as a
+	// stream of the same layout at the path of SegmentIdsSuffix, so that
+	// attention across the documents of a context can be masked. The
+	// PadToken and EndOfText tokens must be set.
+	SegmentIds bool
+	// LossMasks, if set, passes the loss mask of each context from the
+	// TextsTokenizer, which is written as the loss_mask column of Hugging
+	// Face datasets, or alongside binary contexts as a stream of the same
+	// layout at the path of LossMaskSuffix.
+	LossMasks *LossMasks
+}
+
+// SegmentIdsSuffix is the suffix of the path of the segment ids of binary
+// contexts, which are uncompressed, and are written as tokens are.
+const SegmentIdsSuffix = ".segments"
+
+// NewContextsWriter
+// Creates a new ContextsWriter struct with the default configuration.
+func NewContextsWriter() ContextsWriter {
+	return ContextsWriter{
+		Encoder:              nil,
+		Sampling:             100,
+		Shuffle:              false,
+		Compression:          CompressionNone,
+		CompressionFrames:    CompressionFramesChunk,
+		CompressionChunkSize: DefaultCompressionChunkSize,
+		CompressionWorkers:   DefaultCompressionWorkers,
+		Format:               OutputFormatContexts,
+		AttentionMask:        false,
+		Labels:               false,
+	}
+}
+
 // WriteContexts
 // Consumes a ContextsIterator function and serializes the contexts to an
 // aligned binary file.
 func WriteContexts(outPath string, nextContext ContextsIterator,
 	encoder *gpt_bpe.GPTEncoder, sampling int, shuffle bool) (int, error) {
+	contextsWriter := NewContextsWriter()
+	contextsWriter.Encoder = encoder
+	contextsWriter.Sampling = sampling
+	contextsWriter.Shuffle = shuffle
+	return contextsWriter.WriteContexts(outPath, nextContext)
+}
+
+// WriteContexts
+// Consumes a ContextsIterator function and serializes the contexts to an
+// aligned binary file. With Zstandard or gzip compression, every frame, or
+// gzip member, holds either whole contexts, exactly one or as many as fit in
+// CompressionChunkSize, or the tokens of exactly one document.
+func (cw ContextsWriter) WriteContexts(outPath string,
+	nextContext ContextsIterator) (int, error) {
+	if report := cw.Report; report != nil {
+		nextPacked := nextContext
+		nextContext = func() *gpt_bpe.Tokens {
+			context := nextPacked()
+			if context != nil {
+				report.Add(*context)
+			}
+			return context
+		}
+	}
+	if cw.Format == OutputFormatHuggingFace {
+		return cw.writeHuggingFace(outPath, nextContext)
+	} else if cw.Format == OutputFormatTFRecord {
+		return cw.writeTFRecord(outPath, nextContext)
+	} else if cw.Format != OutputFormatContexts {
+		return 0, errors.New(fmt.Sprintf("invalid output format: %s",
+			cw.Format))
+	}
+	encoder := cw.Encoder
+	sampling := cw.Sampling
+	shuffle := cw.Shuffle
 	totalTokens := 0
+	frameSize := 0
+	var newCompressor func() frameCompressor
+	switch cw.Compression {
+	case CompressionNone:
+	case CompressionZstd, CompressionGzip:
+		if shuffle {
+			return 0, errors.New(
+				"shuffling is not supported with compressed output")
+		}
+		// A frame size of one writes a frame for every context, while the
+		// frames of documents are only ended by their end of text tokens.
+		switch cw.CompressionFrames {
+		case CompressionFramesChunk:
+			frameSize = cw.CompressionChunkSize
+		case CompressionFramesContext:
+			frameSize = 1
+		case CompressionFramesDocument:
+			frameSize = math.MaxInt
+		default:
+			return 0, errors.New(fmt.Sprintf(
+				"invalid compression frames: %s", cw.CompressionFrames))
+		}
+		var err error
+		if newCompressor, err = newFrameCompressor(cw.Compression,
+			cw.CompressionLevel); err != nil {
+			return 0, err
+		}
+	default:
+		return 0, errors.New(fmt.Sprintf("invalid compression: %s",
+			cw.Compression))
+	}
 	outFile, err := os.OpenFile(outPath, os.O_TRUNC|os.O_RDWR|os.O_CREATE,
 		0755)
 	if err != nil {
 		return 0, err
 	}
+	defer outFile.Close()
+	var segmentsWriter *bufio.Writer
+	if cw.SegmentIds {
+		if shuffle {
+			return 0, errors.New(
+				"shuffling is not supported with segment ids")
+		}
+		segmentsFile, err := os.Create(outPath + SegmentIdsSuffix)
+		if err != nil {
+			return 0, err
+		}
+		defer segmentsFile.Close()
+		segmentsWriter = bufio.NewWriter(segmentsFile)
+	}
+	var masksWriter *bufio.Writer
+	if cw.LossMasks != nil {
+		if shuffle {
+			return 0, errors.New(
+				"shuffling is not supported with loss masks")
+		}
+		masksFile, err := os.Create(outPath + LossMaskSuffix)
+		if err != nil {
+			return 0, err
+		}
+		defer masksFile.Close()
+		masksWriter = bufio.NewWriter(masksFile)
+	}
+	var out io.Writer = outFile
+	var compressedWriter *framesWriter
+	if frameSize > 0 {
+		compressedWriter = newFramesWriter(outFile, frameSize,
+			cw.CompressionWorkers, newCompressor)
+		out = compressedWriter
+	}
 	contexts := make(chan gpt_bpe.Tokens, 2)
+	// The loss mask of each context is sent before the context.
+	lossMasks := make(chan []int64, 2)
 
 	go func() {
 		samplingIdx := 0
@@ -555,8 +1113,16 @@ func WriteContexts(outPath string, nextContext ContextsIterator,
 				close(contexts)
 				break
 			} else {
+				// The mask of every context is taken, sampled or not.
+				var lossMask []int64
+				if cw.LossMasks != nil {
+					lossMask = cw.LossMasks.next()
+				}
 				// Ignore every `sampling` percent context (rounded to int)
 				if sampling == 100 || (samplingIdx%20) < int(sampling/5) {
+					if cw.LossMasks != nil {
+						lossMasks <- lossMask
+					}
 					contexts <- *context
 					if encoder != nil {
 						println(len(*context))
@@ -581,7 +1147,10 @@ func WriteContexts(outPath string, nextContext ContextsIterator,
 		if !more {
 			break
 		}
-		binContext := context.ToBin()
+		binContext, err := context.ToBin()
+		if err != nil {
+			return totalTokens, err
+		}
 		// We keep track of the final file position
 		if endpos == 0 {
 			// On the first context, we discern the context size and make the
@@ -624,9 +1193,41 @@ func WriteContexts(outPath string, nextContext ContextsIterator,
 			if _, err := outFile.Write(buf); err != nil {
 				return totalTokens, err
 			}
+		} else if cw.CompressionFrames == CompressionFramesDocument &&
+			compressedWriter != nil {
+			cw.writeDocumentFrames(compressedWriter, context,
+				*binContext)
 		} else if !shuffle {
 			// Else, we just write the context to the end of the file as usual
-			if _, err := outFile.Write(*binContext); err != nil {
+			if _, err := out.Write(*binContext); err != nil {
+				return totalTokens, err
+			}
+		}
+		if segmentsWriter != nil {
+			values := cw.contextColumn(context, ColumnSegmentIds)
+			segments := make(gpt_bpe.Tokens, len(values))
+			for idx, value := range values {
+				segments[idx] = gpt_bpe.Token(value)
+			}
+			bin, err := segments.ToBin()
+			if err != nil {
+				return totalTokens, err
+			}
+			if _, err := segmentsWriter.Write(*bin); err != nil {
+				return totalTokens, err
+			}
+		}
+		if masksWriter != nil {
+			values := <-lossMasks
+			mask := make(gpt_bpe.Tokens, len(values))
+			for idx, value := range values {
+				mask[idx] = gpt_bpe.Token(value)
+			}
+			bin, err := mask.ToBin()
+			if err != nil {
+				return totalTokens, err
+			}
+			if _, err := masksWriter.Write(*bin); err != nil {
 				return totalTokens, err
 			}
 		}
@@ -635,9 +1236,75 @@ func WriteContexts(outPath string, nextContext ContextsIterator,
 		endpos += len(*binContext)
 	}
 
+	if compressedWriter != nil {
+		if err := compressedWriter.Close(); err != nil {
+			return totalTokens, err
+		}
+	}
+	for _, writer := range []*bufio.Writer{segmentsWriter, masksWriter} {
+		if writer == nil {
+			continue
+		}
+		if err := writer.Flush(); err != nil {
+			return totalTokens, err
+		}
+	}
 	return totalTokens, nil
 }
 
+// TokenizeShard
+// Reads the documents of the given inputs, and tokenizes them into the
+// contexts of a single shard at shardPath, along with the shard's document
+// index if requested. Returns the number of tokens written.
+func TokenizeShard(textsReader TextsReader, textsTokenizer TextsTokenizer,
+	contextsWriter ContextsWriter, matches []PathInfo, shardPath string,
+	documentIndex bool) (int, error) {
+	nextText, err := textsReader.ReadPaths(matches)
+	if err != nil {
+		return 0, err
+	}
+	return WriteShard(nextText, textsTokenizer, contextsWriter, shardPath,
+		documentIndex)
+}
+
+// WriteShard
+// Tokenizes the documents of nextText into the contexts of a single shard at
+// shardPath, along with the shard's document index if requested. Returns the
+// number of tokens written.
+func WriteShard(nextText TextsIterator, textsTokenizer TextsTokenizer,
+	contextsWriter ContextsWriter, shardPath string,
+	documentIndex bool) (int, error) {
+	return writeShardTo(nextText, textsTokenizer, contextsWriter, shardPath,
+		shardPath, documentIndex)
+}
+
+// writeShardTo writes the shard of shardPath, along with its document index,
+// to outPath, from where it is moved to shardPath.
+func writeShardTo(nextText TextsIterator, textsTokenizer TextsTokenizer,
+	contextsWriter ContextsWriter, outPath string, shardPath string,
+	documentIndex bool) (int, error) {
+	if documentIndex {
+		textsTokenizer.DocumentIndex = NewDocumentIndex(shardPath)
+	}
+	contexts, err := textsTokenizer.TokenizeTexts(nextText)
+	if err != nil {
+		return 0, err
+	}
+	total, err := contextsWriter.WriteContexts(outPath, contexts)
+	if err != nil {
+		return total, err
+	}
+	if index := textsTokenizer.DocumentIndex; index != nil {
+		indexPath := outPath + DocumentIndexSuffix
+		if err := index.Write(indexPath); err != nil {
+			return total, err
+		}
+		log.Printf("Wrote index of %d documents to %s", len(index.Spans),
+			indexPath)
+	}
+	return total, nil
+}
+
 func init() {
 	tokenizers = make(map[string]*gpt_bpe.GPTEncoder, 0)
 	tokenizers["gpt2"] = &gpt_bpe.GPT2Encoder
@@ -666,11 +1333,18 @@ func main() {
 		"token index in context to approximately overlap contexts on, "+
 			"-1 for last boundary token in context")
 	outputFile := flag.String("output", "tokenized.chunk",
-		"tokenized output file")
+		"tokenized output file, a template of {shard}, {shard:05d}, "+
+			"{tokenizer} and {date}")
 	inputDir := flag.String("input", "",
-		"input directory")
+		"input directory or file")
 	unitrimBool := flag.Bool("no_unitrim", false,
 		"do not trim contexts to valid unicode")
+	regexpPreTokenizer := flag.Bool("regexp_pretokenizer", false,
+		"split words with the regular expression approximating the "+
+			"tokenizer's pre-tokenization, instead of the exact scanner")
+	maxWordLength := flag.Int("max_word_length", gpt_bpe.MAXWORD_SZ,
+		"longest word in bytes that is merged whole, where longer words "+
+			"are split, or 0 to merge every word whole")
 	forceRetokenization := flag.Bool("retokenize", false,
 		"force retokenization even if tokenizer output is newer")
 	sanitizeBool := flag.Bool("sanitize", false,
@@ -678,13 +1352,352 @@ func main() {
 	reorderPaths := flag.String("reorder", "",
 		"reorder input files to specification [size_ascending, "+
 			"size_descending, name_ascending, name_descending, random, shuffle, none]")
+	curriculum := flag.String("curriculum", "",
+		"order the documents of each shard from easy to hard by this "+
+			"score [length, scores, or a -quality_filters name such as "+
+			"word_count]")
+	curriculumScores := flag.String("curriculum_scores", "",
+		"file of an input path and its score separated by a tab on each "+
+			"line, for -curriculum scores")
+	shuffleDocuments := flag.Bool("shuffle", false,
+		"shuffle the documents of each shard by -seed, spilling them to "+
+			"spool files when they do not fit in -shuffle_memory")
+	shuffleSeed := flag.Int("seed", 0,
+		"seed for the shuffling of documents with -shuffle")
+	shuffleMemory := flag.Int("shuffle_memory", DefaultShuffleMemory,
+		"megabytes of documents to shuffle in memory with -shuffle")
+	shuffleDir := flag.String("shuffle_dir", "",
+		"directory of the spool files of -shuffle, or the system's "+
+			"temporary directory if empty")
 	sampling_str := flag.String("sampling", "100", "a integer value from 0-100 "+
 		"which tells the tokenizer how many chunks to discard in %, 60 keeps 60%% chunks")
+	epochs := flag.Int("epochs", 0,
+		"plan this many epochs over the inputs, each reshuffled and written "+
+			"to its own shard, instead of a single pass")
+	tokenBudget := flag.Int("token_budget", 0,
+		"total tokens to plan across -epochs, traversing inputs more than "+
+			"once per epoch if needed; 0 traverses every input once per "+
+			"epoch")
+	bytesPerToken := flag.Int("bytes_per_token", DefaultBytesPerToken,
+		"input bytes estimated for each token when planning -token_budget")
+	epochSeed := flag.Int("epoch_seed", 0,
+		"seed for the shuffling of the inputs of each epoch")
+	splitRegex := flag.String("split_regex", "",
+		"regular expression delimiting documents within an input file, "+
+			"use (?m) for line anchors")
+	splitLength := flag.Int("split_length", 0,
+		"split input files into documents of this many bytes")
+	inputFormat := flag.String("input_format", InputFormatText,
+		"input file format [text, wikixml, warc, wet, nats, jsonl], nats "+
+			"consumes the JetStream subject of a -input such as "+
+			"`nats://host:4222/subject?queue=consumer`, and jsonl reads a document from "+
+			"each line of .jsonl files")
+	jsonlField := flag.String("jsonl_field", DefaultJSONLField,
+		"field of each line of jsonl inputs that holds its text")
+	jsonlTemplate := flag.String("jsonl_template", "",
+		"template of the fields of each line of jsonl inputs to read its "+
+			"text from instead of -jsonl_field, such as "+
+			"`{{.title}}\\n\\n{{.text}}`")
+	jsonlMetadata := flag.String("jsonl_metadata", "",
+		"comma separated fields of each line of jsonl inputs to carry "+
+			"into the -doc_index sidecar index as its metadata")
+	jsonlPromptField := flag.String("jsonl_prompt_field",
+		DefaultJSONLPromptField,
+		"field of each line of jsonl inputs that holds its prompt, with "+
+			"-loss_mask")
+	jsonlCompletionField := flag.String("jsonl_completion_field",
+		DefaultJSONLCompletionField, "field of each line of jsonl inputs "+
+			"that holds its completion, with -loss_mask")
+	wikiStripTemplates := flag.Bool("wiki_strip_templates", false,
+		"strip {{templates}} from MediaWiki page text")
+	warcLanguages := flag.String("warc_languages", "",
+		"comma separated primary languages to keep from WARC/WET records, "+
+			"such as `eng,deu`; empty keeps all")
+	warcStatusCodes := flag.String("warc_status", "200",
+		"comma separated HTTP status codes to keep from WARC responses; "+
+			"empty keeps all")
+	compression := flag.String("compress", CompressionNone,
+		"compress the tokenized output [zst, gz]")
+	compressionFrames := flag.String("compress_frames",
+		CompressionFramesChunk, "compressed frame layout, one frame per "+
+			"[chunk, context, document]")
+	compressionChunkSize := flag.Int("compress_chunk_size",
+		DefaultCompressionChunkSize,
+		"bytes of contexts per compressed frame with -compress_frames chunk")
+	compressionLevel := flag.Int("compress_level", 0,
+		"compression level, 1 to 22 for zst or 1 to 9 for gz, or 0 for "+
+			"the default of -compress")
+	compressionWorkers := flag.Int("compress_workers",
+		DefaultCompressionWorkers,
+		"number of frames of contexts compressed in parallel")
+	appendMode := flag.Bool("append", false,
+		"tokenize only inputs that are new or changed since the run "+
+			"manifest of -output, appending them as a new shard")
+	checkpointInputs := flag.Int("checkpoint_inputs", 0,
+		"tokenize the inputs into shards of this many inputs, recording "+
+			"each in the run manifest once it is on disk, so that an "+
+			"interrupted run can be continued with -resume")
+	resume := flag.Bool("resume", false,
+		"continue the checkpointed run of -output after its last "+
+			"recorded shard, removing any partially written shard, or "+
+			"start it if it has no run manifest")
+	languageAllow := flag.String("lang_allow", "",
+		"comma separated ISO 639-3 languages to keep, such as `eng,deu`, "+
+			"identified from each document's text; empty keeps all")
+	languageDeny := flag.String("lang_deny", "",
+		"comma separated ISO 639-3 languages to drop, `und` drops "+
+			"documents whose language is undetermined")
+	qualityFilters := flag.String("quality_filters", "",
+		"comma separated document quality filters to apply before "+
+			"tokenization [gopher, word_count, mean_word_length, "+
+			"symbol_ratio, alphabetic_ratio, repetition]")
+	packing := flag.String("packing", PackingNone,
+		"bin-pack whole documents into contexts [first_fit, best_fit], "+
+			"each followed by -eot and padded out, instead of cutting the "+
+			"stream of documents into contexts")
+	packingBins := flag.Int("packing_bins", DefaultPackingBins,
+		"number of contexts open to documents at once with -packing")
+	segmentIds := flag.Bool("segment_ids", false,
+		"write the segment id of each token, numbering the documents of "+
+			"its context from 1 with padding as 0, as the segment_ids "+
+			"column of huggingface output, or to a .segments file of the "+
+			"layout of contexts output")
+	lossMask := flag.Bool("loss_mask", false,
+		"read jsonl inputs as a prompt followed by a completion, and "+
+			"write the loss mask of each token, 0 for prompt tokens and "+
+			"padding and 1 for completion tokens, as the loss_mask column "+
+			"of huggingface output, or to a .lossmask file of the layout "+
+			"of contexts output")
+	dedup := flag.String("dedup", DedupNone,
+		"drop documents that duplicate one kept before in the run, after "+
+			"the other filters [exact, minhash, simhash], exactly by their "+
+			"SHA-256 hash, or nearly by MinHash or SimHash as well")
+	dedupThreshold := flag.Float64("dedup_threshold", DefaultDedupThreshold,
+		"similarity at which documents are near duplicates with -dedup "+
+			"minhash, the estimated Jaccard similarity of their word "+
+			"shingles, or simhash, the fraction of fingerprint bits that agree")
+	dedupReport := flag.String("dedup_report", "",
+		"write a JSON report of the documents and tokens dropped by -dedup "+
+			"to this path")
+	packingReport := flag.String("packing_report", "",
+		"write a JSON report of the packing efficiency of the contexts to "+
+			"this path, and log its summary")
+	routeShards := flag.Int("route_shards", 0,
+		"route each document to one of this many shards of each split by "+
+			"a stable hash of its text, so that its shard can be located")
+	routeSplits := flag.String("route_splits", "",
+		"comma separated splits and weights to route documents to with "+
+			"-route_shards, such as `train:98,validation:2`")
+	documentIndex := flag.Bool("doc_index", false,
+		"write a sidecar index of each document's token offset and "+
+			"length next to the output")
+	outputFormat := flag.String("output_format", OutputFormatContexts,
+		"output format [contexts, huggingface, sqlite, duckdb, jsonl, "+
+			"parquet, megatron, tfrecord], huggingface writes the contexts "+
+			"as a Parquet dataset, tfrecord writes them as a tf.Example "+
+			"each, the databases hold each document's source, "+
+			"text and tokens, jsonl writes each document's tokens as a line "+
+			"of JSON, parquet writes each document's id, tokens and length "+
+			"as a row, and megatron writes a Megatron-LM indexed dataset of "+
+			"the output's .bin and .idx files")
+	jsonlFields := flag.String("jsonl_fields", "",
+		"comma separated document metadata fields to write with each "+
+			"document's tokens in jsonl output [id, source, token_count, "+
+			"text], without which each line is an array of token ids")
+	megatronDtype := flag.String("megatron_dtype", "uint16",
+		"dtype of the tokens of megatron output [uint16, int32]")
+	tfrecordFeatures := flag.String("tfrecord_features", ColumnInputIds,
+		"comma separated columns to write as the int64 features of each "+
+			"context in tfrecord output, each optionally renamed, such as "+
+			"`input_ids=inputs,attention_mask,labels`")
+	hfAttentionMask := flag.Bool("hf_attention_mask", false,
+		"add an attention_mask column to Hugging Face dataset output")
+	hfLabels := flag.Bool("hf_labels", false,
+		"add a labels column to Hugging Face dataset output, with "+
+			"padding labelled -100")
+	configPath := flag.String("config", "",
+		"YAML pipeline file describing the run, flags given on the "+
+			"command line take precedence over it")
+	coordinatorAddress := flag.String("coordinator", "",
+		"listen on this address, such as `:7070`, and hand out the inputs "+
+			"to -worker processes instead of tokenizing them")
+	workerAddress := flag.String("worker", "",
+		"tokenize the inputs handed out by the coordinator at this "+
+			"address, such as `tcp://host:7070`")
+	coordinatorHealth := flag.String("coordinator_health", "",
+		"print the build, tokenizer and progress of the coordinator at "+
+			"this address, such as `tcp://host:7070`, and exit")
+	taskSize := flag.Int64("task_size", 1024,
+		"MiB of inputs in each task handed out by the coordinator")
+	taskTimeout := flag.Duration("task_timeout", DefaultTaskTimeout,
+		"time a worker has to complete a task before it is reassigned")
+	streamShardSize := flag.Int64("stream_shard_size", 1024,
+		"MiB of streamed documents in each shard written from a NATS input")
+	streamShardInterval := flag.Duration("stream_shard_interval", time.Hour,
+		"longest time a shard written from a NATS input stays open")
+	printConfig := flag.Bool("print_effective_config", false,
+		"print the pipeline file for the effective configuration and exit")
 	flag.Parse()
-	if *inputDir == "" {
+	if *configPath != "" || *printConfig {
+		config, configErr := PipelineConfigFromFlags(flag.CommandLine)
+		if configErr != nil {
+			log.Fatal(configErr)
+		}
+		if *configPath != "" {
+			explicit := make(map[string]bool)
+			flag.Visit(func(f *flag.Flag) {
+				explicit[f.Name] = true
+			})
+			if config, configErr = LoadPipelineConfig(*configPath,
+				config); configErr != nil {
+				log.Fatal(configErr)
+			} else if configErr = config.Apply(flag.CommandLine,
+				explicit); configErr != nil {
+				log.Fatal(configErr)
+			} else if config, configErr = PipelineConfigFromFlags(
+				flag.CommandLine); configErr != nil {
+				log.Fatal(configErr)
+			} else if configErr = config.Validate(); configErr != nil {
+				log.Fatalf("%s: %v", *configPath, configErr)
+			}
+		}
+		if *printConfig {
+			if configErr = config.Write(os.Stdout); configErr != nil {
+				log.Fatal(configErr)
+			}
+			os.Exit(0)
+		}
+	}
+	if *coordinatorHealth != "" {
+		health, healthErr := QueryHealth(*coordinatorHealth)
+		if healthErr != nil {
+			log.Fatal(healthErr)
+		}
+		healthJson, _ := json.MarshalIndent(health, "", "  ")
+		fmt.Println(string(healthJson))
+		os.Exit(0)
+	}
+	if *inputDir == "" && *workerAddress == "" {
 		flag.Usage()
 		log.Fatal("Must provide -input for directory source")
 	}
+	if *coordinatorAddress != "" && (*workerAddress != "" || *appendMode) {
+		log.Fatal("-coordinator cannot be used with -worker or -append")
+	}
+	if *inputFormat == InputFormatNATS && (*coordinatorAddress != "" ||
+		*workerAddress != "" || *appendMode) {
+		log.Fatal("-input_format nats cannot be used with -coordinator, " +
+			"-worker or -append")
+	}
+	isDatabase := *outputFormat == OutputFormatSQLite ||
+		*outputFormat == OutputFormatDuckDB
+	isDocuments := isDatabase || *outputFormat == OutputFormatJSONL ||
+		*outputFormat == OutputFormatParquet ||
+		*outputFormat == OutputFormatMegatron
+	if isDocuments && (*coordinatorAddress != "" ||
+		*workerAddress != "" || *appendMode || *documentIndex ||
+		*inputFormat == InputFormatNATS) {
+		log.Fatal("-output_format " + *outputFormat + " cannot be used " +
+			"with -coordinator, -worker, -append, -doc_index or NATS inputs")
+	}
+	jsonlFieldList, jsonlErr := ParseJSONLFields(*jsonlFields)
+	if jsonlErr != nil {
+		log.Fatal(jsonlErr)
+	} else if len(jsonlFieldList) > 0 && *outputFormat != OutputFormatJSONL {
+		log.Fatal("-jsonl_fields can only be used with -output_format jsonl")
+	}
+	megatronDtypeId, megatronErr := ParseMegatronDtype(*megatronDtype)
+	if megatronErr != nil {
+		log.Fatal(megatronErr)
+	}
+	tfrecordFeatureList, tfrecordErr := ParseTFRecordFeatures(
+		*tfrecordFeatures)
+	if tfrecordErr != nil {
+		log.Fatal(tfrecordErr)
+	}
+	if *compression != CompressionNone {
+		if _, compressErr := newFrameCompressor(*compression,
+			*compressionLevel); compressErr != nil {
+			log.Fatal(compressErr)
+		}
+	}
+	if *compressionWorkers < 1 {
+		log.Fatal("-compress_workers must be positive")
+	}
+	if *dedup != DedupNone && *epochs > 0 {
+		log.Fatal("-dedup would drop every document of the epochs after " +
+			"the first, and cannot be used with -epochs")
+	} else if *dedup == DedupNone && *dedupReport != "" {
+		log.Fatal("-dedup_report can only be used with -dedup")
+	}
+	if *shuffleDocuments && (*curriculum != "" || *curriculumScores != "" ||
+		*inputFormat == InputFormatNATS) {
+		log.Fatal("-shuffle cannot be used with -curriculum or NATS inputs")
+	} else if *shuffleDocuments && *shuffleMemory <= 0 {
+		log.Fatal("-shuffle_memory must be positive")
+	}
+	if packErr := CheckPacking(*packing, *packingBins); packErr != nil {
+		log.Fatal(packErr)
+	} else if *packing != PackingNone && (*documentIndex || isDocuments) {
+		log.Fatal("-packing cannot be used with -doc_index or " +
+			"-output_format " + *outputFormat)
+	} else if *segmentIds && (*reorderPaths == "shuffle" || isDocuments ||
+		*outputFormat == OutputFormatTFRecord) {
+		log.Fatal("-segment_ids cannot be used with shuffling or " +
+			"-output_format " + *outputFormat + ", tfrecord output takes " +
+			"segment_ids as one of -tfrecord_features")
+	}
+	if *epochs > 0 && (*coordinatorAddress != "" || *workerAddress != "" ||
+		*appendMode || *inputFormat == InputFormatNATS || isDocuments) {
+		log.Fatal("-epochs cannot be used with -coordinator, -worker, " +
+			"-append, NATS inputs or -output_format " + *outputFormat)
+	} else if *epochs > 0 && *reorderPaths != "" && *reorderPaths != "none" {
+		log.Fatal("-epochs shuffles the inputs of each epoch, and cannot " +
+			"be used with -reorder")
+	} else if *curriculum != "" && ((*reorderPaths != "" &&
+		*reorderPaths != "none") || *inputFormat == InputFormatNATS ||
+		isDocuments) {
+		log.Fatal("-curriculum orders the documents itself, and cannot be " +
+			"used with -reorder, NATS inputs or -output_format " +
+			*outputFormat)
+	} else if *routeShards > 0 && (*coordinatorAddress != "" ||
+		*workerAddress != "" || *appendMode || *epochs > 0 ||
+		*inputFormat == InputFormatNATS || isDocuments) {
+		log.Fatal("-route_shards cannot be used with -coordinator, " +
+			"-worker, -append, -epochs, NATS inputs or -output_format " +
+			*outputFormat)
+	} else if *routeShards == 0 && *routeSplits != "" {
+		log.Fatal("-route_splits can only be used with -route_shards")
+	} else if *checkpointInputs < 0 {
+		log.Fatal("-checkpoint_inputs cannot be negative")
+	} else if (*checkpointInputs > 0 || *resume) &&
+		(*coordinatorAddress != "" || *workerAddress != "" || *appendMode ||
+			*epochs > 0 || *routeShards > 0 ||
+			*inputFormat == InputFormatNATS || isDocuments) {
+		log.Fatal("-checkpoint_inputs and -resume cannot be used with " +
+			"-coordinator, -worker, -append, -epochs, -route_shards, NATS " +
+			"inputs or -output_format " + *outputFormat)
+	} else if *epochs == 0 && *tokenBudget != 0 {
+		log.Fatal("-token_budget can only be used with -epochs")
+	} else if *jsonlMetadata != "" && !*documentIndex {
+		log.Fatal("-jsonl_metadata can only be used with -doc_index")
+	} else if (*jsonlTemplate != "" || *jsonlMetadata != "" ||
+		*jsonlField != DefaultJSONLField) &&
+		*inputFormat != InputFormatJSONL {
+		log.Fatal("-jsonl_field, -jsonl_template and -jsonl_metadata can " +
+			"only be used with -input_format jsonl")
+	} else if *lossMask && *inputFormat != InputFormatJSONL {
+		log.Fatal("-loss_mask can only be used with -input_format jsonl")
+	} else if *lossMask && (*packing != PackingNone || isDocuments ||
+		*outputFormat == OutputFormatTFRecord ||
+		*reorderPaths == "shuffle" || *sanitizeBool) {
+		log.Fatal("-loss_mask cannot be used with -packing, shuffling, " +
+			"-sanitize or -output_format " + *outputFormat)
+	} else if !*lossMask && (*jsonlPromptField != DefaultJSONLPromptField ||
+		*jsonlCompletionField != DefaultJSONLCompletionField) {
+		log.Fatal("-jsonl_prompt_field and -jsonl_completion_field can " +
+			"only be used with -loss_mask")
+	}
 	sampling, err := strconv.Atoi(*sampling_str)
 	if err != nil {
 		log.Fatal("Sampling parameter must be an integer")
@@ -693,6 +1706,27 @@ func main() {
 	if sampling > 100 || sampling < 0 {
 		log.Fatal("Sampling parameter out of the 0-100 bounds")
 	}
+	if *documentIndex && (sampling != 100 || *reorderPaths == "shuffle") {
+		log.Fatal("-doc_index cannot be used with sampling or shuffling")
+	}
+
+	outputTemplate, templateErr := NewOutputTemplate(*outputFile,
+		*tokenizerId, time.Now())
+	if templateErr != nil {
+		log.Fatal(templateErr)
+	} else if *appendMode && outputTemplate.HasDate() {
+		log.Fatal("-append cannot be used with an -output of {date}")
+	}
+	*outputFile = outputTemplate.Output()
+	outputPath := SingleOutputPath(*outputFile)
+	manifestPath := OutputManifestPath(*outputFile)
+	// A templated output may expand to that of a run with another tokenizer.
+	if outputTemplate.IsTemplate() && !*forceRetokenization && !*appendMode {
+		if collisionErr := CheckOutputCollision(manifestPath,
+			*tokenizerId); collisionErr != nil {
+			log.Fatal(collisionErr)
+		}
+	}
 
 	log.Printf("Tokenizer definition: %s\n", *tokenizerId)
 	log.Printf("Tokenizer input source: %s\n", *inputDir)
@@ -722,22 +1756,310 @@ func main() {
 	textsTokenizer.BoundaryBegin = *boundaryBegin
 	textsTokenizer.BoundaryOverlap = *boundaryOverlap
 	textsTokenizer.Unitrim = !*unitrimBool
+	textsTokenizer.Packing = *packing
+	textsTokenizer.PackingBins = *packingBins
+	var lossMasks *LossMasks
+	if *lossMask {
+		lossMasks = &LossMasks{}
+	}
+	textsTokenizer.LossMasks = lossMasks
+	if *maxWordLength < 0 {
+		log.Fatalf("-max_word_length must not be negative")
+	}
+	if tokenizer, tokErr := textsTokenizer.InitTokenizer(); tokErr != nil {
+		log.Fatal(tokErr)
+	} else {
+		// Inputs such as scraped pages may hold words of any length, which
+		// are costly to merge whole.
+		tokenizer.MaxWordLength = *maxWordLength
+		if *regexpPreTokenizer {
+			tokenizer.SetPreTokenizer(gpt_bpe.RegexpPreTokenizer)
+		}
+	}
 
-	if !*forceRetokenization {
-		if outStat, outErr := os.Stat(*outputFile); !errors.Is(outErr,
+	textsReader := NewTextsReader()
+	textsReader.Sanitize = *sanitizeBool
+	textsReader.SortSpec = *reorderPaths
+	textsReader.Format = *inputFormat
+	textsReader.WikiStripTemplates = *wikiStripTemplates
+	if *inputFormat == InputFormatJSONL {
+		var metadataFields []string
+		if *jsonlMetadata != "" {
+			metadataFields = strings.Split(*jsonlMetadata, ",")
+		}
+		var jsonlInputErr error
+		if textsReader.JSONL, jsonlInputErr = NewJSONLInput(*jsonlField,
+			*jsonlTemplate, metadataFields); jsonlInputErr != nil {
+			log.Fatal(jsonlInputErr)
+		}
+		if *lossMask {
+			textsReader.JSONL.PromptField = *jsonlPromptField
+			textsReader.JSONL.CompletionField = *jsonlCompletionField
+		}
+	}
+	textsReader.WarcLanguages = nil
+	if *warcLanguages != "" {
+		textsReader.WarcLanguages = strings.Split(*warcLanguages, ",")
+	}
+	textsReader.WarcStatusCodes = nil
+	if *warcStatusCodes != "" {
+		for _, statusCode := range strings.Split(*warcStatusCodes, ",") {
+			if code, codeErr := strconv.Atoi(
+				strings.TrimSpace(statusCode)); codeErr != nil {
+				log.Fatalf("Invalid HTTP status code: %s", statusCode)
+			} else {
+				textsReader.WarcStatusCodes = append(
+					textsReader.WarcStatusCodes, code)
+			}
+		}
+	}
+	if *languageAllow != "" || *languageDeny != "" {
+		var allow, deny []string
+		if *languageAllow != "" {
+			allow = strings.Split(*languageAllow, ",")
+		}
+		if *languageDeny != "" {
+			deny = strings.Split(*languageDeny, ",")
+		}
+		textsReader.Languages = NewLanguageFilter(allow, deny)
+	}
+	if *qualityFilters != "" {
+		filters, filtersErr := ParseDocumentFilters(*qualityFilters)
+		if filtersErr != nil {
+			log.Fatal(filtersErr)
+		}
+		textsReader.Filters = filters
+	}
+	if *dedup != DedupNone {
+		deduplicator, dedupErr := NewDeduplicator(*dedup, *dedupThreshold)
+		if dedupErr != nil {
+			log.Fatal(dedupErr)
+		}
+		if deduplicator.Encoder, dedupErr =
+			textsTokenizer.InitTokenizer(); dedupErr != nil {
+			log.Fatal(dedupErr)
+		}
+		textsReader.Dedup = deduplicator
+		// The report is written when the process exits normally.
+		defer func() {
+			deduplicator.Report.Log()
+			if *dedupReport != "" {
+				if reportErr := deduplicator.Report.Write(
+					*dedupReport); reportErr != nil {
+					log.Fatal(reportErr)
+				}
+			}
+		}()
+	}
+	if *curriculum != "" || *curriculumScores != "" {
+		ordering, curriculumErr := ParseCurriculum(*curriculum,
+			*curriculumScores)
+		if curriculumErr != nil {
+			log.Fatal(curriculumErr)
+		}
+		textsReader.Curriculum = ordering
+	}
+	if *shuffleDocuments {
+		shuffler, shuffleErr := NewDocumentShuffler(int64(*shuffleSeed),
+			*shuffleMemory*1024*1024, *shuffleDir)
+		if shuffleErr != nil {
+			log.Fatal(shuffleErr)
+		}
+		textsReader.Shuffle = shuffler
+	}
+	if *splitRegex != "" || *splitLength > 0 {
+		splitter, splitErr := NewDocumentSplitter(*splitRegex, *splitLength)
+		if splitErr != nil {
+			log.Fatal(splitErr)
+		}
+		textsReader.Splitter = splitter
+	}
+
+	var enc *gpt_bpe.GPTEncoder
+	// *showContexts = true
+	if *showContexts {
+		enc, _ = gpt_bpe.NewEncoder(*tokenizerId)
+	}
+	contextsWriter := NewContextsWriter()
+	contextsWriter.Encoder = enc
+	contextsWriter.Sampling = sampling
+	contextsWriter.Shuffle = *reorderPaths == "shuffle"
+	contextsWriter.Compression = *compression
+	contextsWriter.CompressionFrames = *compressionFrames
+	contextsWriter.CompressionChunkSize = *compressionChunkSize
+	contextsWriter.CompressionLevel = *compressionLevel
+	contextsWriter.CompressionWorkers = *compressionWorkers
+	contextsWriter.Format = *outputFormat
+	contextsWriter.SegmentIds = *segmentIds
+	contextsWriter.LossMasks = lossMasks
+	if *outputFormat == OutputFormatHuggingFace ||
+		*outputFormat == OutputFormatTFRecord || *segmentIds ||
+		(*compression != CompressionNone &&
+			*compressionFrames == CompressionFramesDocument) {
+		if *outputFormat == OutputFormatHuggingFace {
+			contextsWriter.AttentionMask = *hfAttentionMask
+			contextsWriter.Labels = *hfLabels
+		} else if *outputFormat == OutputFormatTFRecord {
+			contextsWriter.TFRecordFeatures = tfrecordFeatureList
+		}
+		padId, eotId, specialErr := textsTokenizer.SpecialTokens()
+		if specialErr != nil {
+			log.Fatal(specialErr)
+		}
+		contextsWriter.PadToken = padId
+		contextsWriter.EndOfText = eotId
+	}
+	if *packingReport != "" {
+		if isDocuments {
+			log.Fatal("-packing_report cannot be used with -output_format " +
+				*outputFormat)
+		}
+		padId, eotId, specialErr := textsTokenizer.SpecialTokens()
+		if specialErr != nil {
+			log.Fatal(specialErr)
+		}
+		contextsWriter.Report = NewPackingReport(*contextSize, padId, eotId)
+		// The report is written when the process exits normally.
+		defer func() {
+			contextsWriter.Report.Log()
+			if reportErr := contextsWriter.Report.Write(
+				*packingReport); reportErr != nil {
+				log.Fatal(reportErr)
+			}
+		}()
+	}
+
+	if *workerAddress != "" {
+		tokenizer, tokErr := textsTokenizer.InitTokenizer()
+		if tokErr != nil {
+			log.Fatal(tokErr)
+		}
+		workErr := RunWorker(*workerAddress, func(
+			task TokenizeTask) TaskResult {
+			result := TaskResult{StartedAt: time.Now().UTC()}
+			if task.Fingerprint != tokenizer.Fingerprint() ||
+				task.ContextSize != *contextSize {
+				result.Error = "tokenizer or context size does not match " +
+					"the coordinator's"
+				return result
+			}
+			inputs, hashErr := HashInputs(task.Inputs)
+			if hashErr != nil {
+				result.Error = hashErr.Error()
+				return result
+			}
+			if textsReader.Languages != nil {
+				textsReader.Languages.Kept = make(map[string]int)
+			}
+			log.Printf("Tokenizing task %d into %s", task.Id, task.Output)
+			total, tokenizeErr := TokenizeAttempt(textsReader,
+				textsTokenizer, contextsWriter, task, *documentIndex)
+			if tokenizeErr != nil {
+				result.Error = tokenizeErr.Error()
+				return result
+			}
+			result.Tokens = total
+			result.Inputs = inputs
+			if textsReader.Languages != nil {
+				result.Languages = textsReader.Languages.Kept
+			}
+			return result
+		})
+		if workErr != nil {
+			log.Fatal(workErr)
+		}
+		log.Printf("Coordinator %s has no more tasks", *workerAddress)
+		return
+	}
+
+	// Streamed documents are written into a new shard whenever enough of them
+	// have arrived, until the stream ends or the process is interrupted.
+	if *inputFormat == InputFormatNATS {
+		tokenizer, tokErr := textsTokenizer.InitTokenizer()
+		if tokErr != nil {
+			log.Fatal(tokErr)
+		}
+		// Messages wait for their acknowledgement until their shard is
+		// closed and synced.
+		ackWait := DefaultNatsAckWait
+		if *streamShardInterval > 0 {
+			ackWait = 2 * *streamShardInterval
+		}
+		source, dialErr := DialNats(*inputDir, ackWait)
+		if dialErr != nil {
+			log.Fatal(dialErr)
+		}
+		defer source.Close()
+		interrupt := make(chan os.Signal, 1)
+		signal.Notify(interrupt, os.Interrupt)
+		go func() {
+			<-interrupt
+			log.Printf("Interrupted, writing the last shard")
+			source.Stop()
+		}()
+		manifest := NewRunManifest()
+		manifest.SetTokenizer(*tokenizerId, tokenizer)
+		manifest.Output = *outputFile
+		manifest.ContextSize = *contextSize
+		streamInputs := []ManifestInput{{Path: *inputDir}}
+		log.Printf("Consuming subject %s from %s", source.Subject, *inputDir)
+		for {
+			nextText := source.NextShard(textsReader,
+				*streamShardSize*1024*1024, *streamShardInterval)
+			if nextText == nil {
+				break
+			}
+			begin := time.Now()
+			shardPath := ShardPath(*outputFile, len(manifest.Shards))
+			total, shardErr := WriteShard(nextText, textsTokenizer,
+				contextsWriter, shardPath, *documentIndex)
+			if shardErr != nil {
+				log.Fatal(shardErr)
+			}
+			if syncErr := syncShard(shardPath); syncErr != nil {
+				log.Fatal(syncErr)
+			}
+			manifest.AddShard(shardPath, total, streamInputs, begin)
+			if manifestErr := manifest.Write(
+				manifestPath); manifestErr != nil {
+				log.Fatal(manifestErr)
+			}
+			if ackErr := source.Ack(); ackErr != nil {
+				log.Fatal(ackErr)
+			}
+			log.Printf("Wrote %d tokens to %s", total, shardPath)
+		}
+		if streamErr := source.Err(); streamErr != nil {
+			log.Print(streamErr)
+		}
+		if textsReader.Languages != nil {
+			manifest.AddLanguages(textsReader.Languages.Kept)
+		}
+		manifest.Inputs = streamInputs
+		manifest.Finish(manifest.TotalTokens)
+		if manifestErr := manifest.Write(manifestPath); manifestErr != nil {
+			log.Fatal(manifestErr)
+		}
+		log.Printf("%d tokens in %d shards, wrote run manifest to %s",
+			manifest.TotalTokens, len(manifest.Shards), manifestPath)
+		return
+	}
+
+	if !*forceRetokenization && !*appendMode && !*resume {
+		if outStat, outErr := os.Stat(outputPath); !errors.Is(outErr,
 			os.ErrNotExist) && outErr != nil {
 			log.Fatal(outErr)
 		} else if errors.Is(outErr, os.ErrNotExist) {
-			log.Printf("Creating %s", *outputFile)
-		} else if newestPath, newestModTime, newestErr := FindNewestText(
-			*inputDir); newestErr != nil {
+			log.Printf("Creating %s", outputPath)
+		} else if newestPath, newestModTime, newestErr := FindNewestInput(
+			*inputDir, *inputFormat); newestErr != nil {
 			log.Fatal(newestErr)
 		} else if newestModTime != nil && newestModTime.Before(
 			outStat.ModTime()) {
 			log.Printf("Newest source `%s` is older than `%s`, "+
 				"not retokenizing. "+
 				"Use -retokenize to force retokenization.", *newestPath,
-				*outputFile)
+				outputPath)
 			os.Exit(0)
 		} else if newestDir, newestDirModTime, newestDirErr := FindNewestDir(
 			*inputDir); newestDirErr != nil {
@@ -746,35 +2068,368 @@ func main() {
 			outStat.ModTime()) {
 			log.Printf("Data source directory `%s` has no changes since `%s"+
 				"was tokenized. Use -retokenize to force retokenization.",
-				*newestDir, *outputFile)
+				*newestDir, outputPath)
 		}
 	}
-	if _, tokErr := textsTokenizer.InitTokenizer(); tokErr != nil {
+	tokenizer, tokErr := textsTokenizer.InitTokenizer()
+	if tokErr != nil {
 		log.Fatal(tokErr)
 	}
+	matches, globErr := GlobInputs(*inputDir, *inputFormat)
+	if globErr != nil {
+		log.Fatal(globErr)
+	}
+	if isDatabase {
+		db, dbErr := NewDocumentsDatabase(*outputFormat)
+		if dbErr != nil {
+			log.Fatal(dbErr)
+		}
+		if dbErr = db.Write(textsReader, tokenizer, matches, outputPath,
+			map[string]string{
+				"tokenizer":   *tokenizerId,
+				"fingerprint": tokenizer.Fingerprint(),
+			}); dbErr != nil {
+			log.Fatal(dbErr)
+		}
+		log.Printf("Wrote %d documents with %d tokens to %s", db.Documents,
+			db.Tokens, outputPath)
+		return
+	}
+	if *outputFormat == OutputFormatJSONL {
+		jsonl := &DocumentsJSONL{Fields: jsonlFieldList}
+		if jsonlErr = jsonl.Write(textsReader, tokenizer, matches,
+			outputPath); jsonlErr != nil {
+			log.Fatal(jsonlErr)
+		}
+		log.Printf("Wrote %d documents with %d tokens to %s",
+			jsonl.Documents, jsonl.Tokens, outputPath)
+		return
+	}
+	if *outputFormat == OutputFormatParquet {
+		documents := &DocumentsParquet{}
+		if parquetErr := documents.Write(textsReader, tokenizer, matches,
+			outputPath, map[string]string{
+				"tokenizer":   *tokenizerId,
+				"fingerprint": tokenizer.Fingerprint(),
+			}); parquetErr != nil {
+			log.Fatal(parquetErr)
+		}
+		log.Printf("Wrote %d documents with %d tokens to %s",
+			documents.Documents, documents.Tokens, outputPath)
+		return
+	}
+	if *outputFormat == OutputFormatMegatron {
+		megatron := &DocumentsMegatron{Dtype: megatronDtypeId}
+		prefix := MegatronPrefix(outputPath)
+		if megatronErr = megatron.Write(textsReader, tokenizer, matches,
+			prefix); megatronErr != nil {
+			log.Fatal(megatronErr)
+		}
+		log.Printf("Wrote %d documents with %d tokens to %s%s and %s%s",
+			megatron.Documents, megatron.Tokens, prefix, MegatronBinSuffix,
+			prefix, MegatronIdxSuffix)
+		return
+	}
+	// A coordinator hands the inputs out to workers, which hash and tokenize
+	// them, and aggregates their results into the manifest.
+	if *coordinatorAddress != "" {
+		manifest := NewRunManifest()
+		manifest.SetTokenizer(*tokenizerId, tokenizer)
+		manifest.Output = *outputFile
+		manifest.ContextSize = *contextSize
+		manifest.InputGlobs = InputGlobs(*inputDir, *inputFormat)
+		coordinator := NewCoordinator(manifest, manifestPath, matches,
+			*taskSize*1024*1024)
+		coordinator.TaskTimeout = *taskTimeout
+		listener, listenErr := net.Listen("tcp", *coordinatorAddress)
+		if listenErr != nil {
+			log.Fatal(listenErr)
+		}
+		log.Printf("Coordinating %d tasks on %s", len(coordinator.tasks),
+			listener.Addr())
+		if serveErr := coordinator.Serve(listener,
+			2*workerPollInterval); serveErr != nil {
+			log.Fatal(serveErr)
+		}
+		log.Printf("%d tokens in %d shards, wrote run manifest to %s",
+			manifest.TotalTokens, len(manifest.Shards), manifestPath)
+		return
+	}
 
-	if nextText, err := ReadTexts(*inputDir, *sanitizeBool,
-		*reorderPaths); err != nil {
-		log.Fatal(err)
-	} else {
-		begin := time.Now()
-		contexts, tokErr := textsTokenizer.TokenizeTexts(
-			nextText)
-		if tokErr != nil {
-			log.Fatal(tokErr)
+	// A multi-epoch run plans the inputs of every epoch up front, and writes
+	// each epoch to its own shard.
+	if *epochs > 0 {
+		plan, planErr := NewEpochPlan(matches, *outputFile, *epochs,
+			int64(*tokenBudget), *bytesPerToken, int64(*epochSeed))
+		if planErr != nil {
+			log.Fatal(planErr)
+		}
+		inputs, hashErr := HashInputs(matches)
+		if hashErr != nil {
+			log.Fatal(hashErr)
+		}
+		hashed := make(map[string]ManifestInput, len(inputs))
+		for _, input := range inputs {
+			hashed[input.Path] = input
+		}
+		planPath := EpochPlanPath(manifestPath)
+		if planErr = plan.Write(planPath); planErr != nil {
+			log.Fatal(planErr)
+		}
+		log.Printf("Planned %d epochs of about %d tokens each, wrote the "+
+			"plan to %s", len(plan.Epochs), plan.Epochs[0].Tokens, planPath)
+		manifest := NewRunManifest()
+		manifest.SetTokenizer(*tokenizerId, tokenizer)
+		manifest.Output = *outputFile
+		manifest.ContextSize = *contextSize
+		manifest.InputGlobs = InputGlobs(*inputDir, *inputFormat)
+		manifest.Inputs = inputs
+		for _, epoch := range plan.Epochs {
+			begin := time.Now()
+			total, epochErr := TokenizeShard(textsReader, textsTokenizer,
+				contextsWriter, epoch.Inputs, epoch.Shard, *documentIndex)
+			if epochErr != nil {
+				log.Fatal(epochErr)
+			}
+			epochInputs := make([]ManifestInput, len(epoch.Inputs))
+			for idx, input := range epoch.Inputs {
+				epochInputs[idx] = hashed[input.Path]
+			}
+			manifest.AddShard(epoch.Shard, total, epochInputs, begin)
+			if manifestErr := manifest.Write(
+				manifestPath); manifestErr != nil {
+				log.Fatal(manifestErr)
+			}
+			log.Printf("Wrote %d tokens of epoch %d to %s", total,
+				epoch.Epoch, epoch.Shard)
+		}
+		if textsReader.Languages != nil {
+			manifest.AddLanguages(textsReader.Languages.Kept)
+		}
+		manifest.Finish(manifest.TotalTokens)
+		if manifestErr := manifest.Write(manifestPath); manifestErr != nil {
+			log.Fatal(manifestErr)
+		}
+		log.Printf("%d tokens in %d epochs, wrote run manifest to %s",
+			manifest.TotalTokens, len(manifest.Shards), manifestPath)
+		return
+	}
+
+	// Routed documents are read once for each route, keeping those that are
+	// routed to it, so that each route's shard is written in turn.
+	if *routeShards > 0 {
+		splits, splitsErr := dataset.ParseRouteSplits(*routeSplits)
+		if splitsErr != nil {
+			log.Fatal(splitsErr)
+		}
+		router, routerErr := dataset.NewRouter(splits, *routeShards)
+		if routerErr != nil {
+			log.Fatal(routerErr)
+		}
+		inputs, hashErr := HashInputs(matches)
+		if hashErr != nil {
+			log.Fatal(hashErr)
+		}
+		manifest := NewRunManifest()
+		manifest.SetTokenizer(*tokenizerId, tokenizer)
+		manifest.Output = *outputFile
+		manifest.ContextSize = *contextSize
+		manifest.InputGlobs = InputGlobs(*inputDir, *inputFormat)
+		manifest.Inputs = inputs
+		manifest.Router = router
+		for _, route := range router.Routes() {
+			begin := time.Now()
+			if textsReader.Languages != nil {
+				// Every pass reads the same documents, so only the last
+				// pass's counts are kept.
+				textsReader.Languages.Kept = make(map[string]int)
+			}
+			nextText, readErr := textsReader.ReadPaths(matches)
+			if readErr != nil {
+				log.Fatal(readErr)
+			}
+			shardPath := RoutePath(*outputFile, route)
+			total, routeErr := WriteShard(RoutedTexts(nextText, router,
+				route), textsTokenizer, contextsWriter, shardPath,
+				*documentIndex)
+			if routeErr != nil {
+				log.Fatal(routeErr)
+			}
+			manifest.AddShard(shardPath, total, inputs, begin)
+			if manifestErr := manifest.Write(
+				manifestPath); manifestErr != nil {
+				log.Fatal(manifestErr)
+			}
+			log.Printf("Wrote %d routed tokens to %s", total, shardPath)
+		}
+		if textsReader.Languages != nil {
+			manifest.AddLanguages(textsReader.Languages.Kept)
+		}
+		manifest.Finish(manifest.TotalTokens)
+		if manifestErr := manifest.Write(manifestPath); manifestErr != nil {
+			log.Fatal(manifestErr)
+		}
+		log.Printf("%d tokens in %d routed shards, wrote run manifest to %s",
+			manifest.TotalTokens, len(manifest.Shards), manifestPath)
+		return
+	}
+
+	// Checkpointed runs write a shard of -checkpoint_inputs inputs at a
+	// time, recording each in the manifest once it is on disk, and resumed
+	// runs continue after the last shard that was recorded.
+	if *checkpointInputs > 0 || *resume {
+		manifest, manifestErr := ReadRunManifest(manifestPath)
+		var pending []ManifestInput
+		if *resume && manifestErr == nil {
+			if !manifest.FinishedAt.IsZero() {
+				log.Printf("The run of %s already finished, nothing to "+
+					"resume.", manifestPath)
+				os.Exit(0)
+			} else if appendErr := manifest.CheckAppendable(tokenizer,
+				*contextSize); appendErr != nil {
+				log.Fatal(appendErr)
+			}
+			if *checkpointInputs > 0 {
+				manifest.CheckpointInputs = *checkpointInputs
+			}
+			inputs, hashErr := HashChangedInputs(matches, manifest.Inputs)
+			if hashErr != nil {
+				log.Fatal(hashErr)
+			}
+			var resumeErr error
+			if pending, resumeErr = manifest.ResumeCheckpoint(
+				inputs); resumeErr != nil {
+				log.Fatal(resumeErr)
+			}
+			log.Printf("Resuming %s after %d shards, %d of %d inputs "+
+				"remain", *outputFile, len(manifest.Shards), len(pending),
+				len(inputs))
+		} else if *resume && !errors.Is(manifestErr, os.ErrNotExist) {
+			log.Fatal(manifestErr)
+		} else if *checkpointInputs == 0 {
+			log.Fatal("-resume of a run without a run manifest requires " +
+				"-checkpoint_inputs")
+		} else {
+			inputs, hashErr := HashInputs(matches)
+			if hashErr != nil {
+				log.Fatal(hashErr)
+			}
+			manifest = NewRunManifest()
+			manifest.SetTokenizer(*tokenizerId, tokenizer)
+			manifest.Output = *outputFile
+			manifest.ContextSize = *contextSize
+			manifest.InputGlobs = InputGlobs(*inputDir, *inputFormat)
+			manifest.Inputs = inputs
+			manifest.CheckpointInputs = *checkpointInputs
+			pending = inputs
+		}
+		if checkpointErr := TokenizeCheckpointed(textsReader,
+			textsTokenizer, contextsWriter, matches, pending, manifest,
+			manifestPath, *documentIndex); checkpointErr != nil {
+			log.Fatal(checkpointErr)
+		}
+		if textsReader.Languages != nil {
+			manifest.AddLanguages(textsReader.Languages.Kept)
 		}
-		var enc *gpt_bpe.GPTEncoder
-		// *showContexts = true
-		if *showContexts {
-			enc, _ = gpt_bpe.NewEncoder(*tokenizerId)
+		manifest.Finish(manifest.TotalTokens)
+		if manifestErr := manifest.Write(manifestPath); manifestErr != nil {
+			log.Fatal(manifestErr)
 		}
-		total, writeErr := WriteContexts(*outputFile, contexts, enc, sampling,
-			*reorderPaths == "shuffle")
-		if writeErr != nil {
-			log.Fatal(writeErr)
+		log.Printf("%d tokens in %d shards, wrote run manifest to %s",
+			manifest.TotalTokens, len(manifest.Shards), manifestPath)
+		return
+	}
+
+	// When appending, only the new and changed inputs are tokenized, into a
+	// new shard next to the existing output.
+	var manifest *RunManifest
+	var shardInputs []ManifestInput
+	shardPath := outputPath
+	if *appendMode {
+		var manifestErr error
+		if manifest, manifestErr = ReadRunManifest(
+			manifestPath); manifestErr != nil {
+			log.Fatal(manifestErr)
+		} else if appendErr := manifest.CheckAppendable(tokenizer,
+			*contextSize); appendErr != nil {
+			log.Fatal(appendErr)
+		}
+		inputs, hashErr := HashChangedInputs(matches, manifest.Inputs)
+		if hashErr != nil {
+			log.Fatal(hashErr)
+		}
+		shardInputs = manifest.PendingInputs(inputs)
+		if len(shardInputs) == 0 {
+			log.Printf("No new or changed inputs since %s was written, "+
+				"nothing to append.", manifestPath)
+			os.Exit(0)
+		}
+		pending := make(map[string]bool, len(shardInputs))
+		for _, input := range shardInputs {
+			pending[input.Path] = true
 		}
+		shardMatches := make([]PathInfo, 0, len(shardInputs))
+		for _, match := range matches {
+			if pending[match.Path] {
+				shardMatches = append(shardMatches, match)
+			}
+		}
+		for _, input := range manifest.Inputs {
+			if pending[input.Path] {
+				log.Printf("%s changed since it was tokenized, its "+
+					"earlier tokens remain in the previous shards", input.Path)
+			}
+		}
+		matches = shardMatches
+		manifest.Inputs = inputs
+		shardPath = manifest.NextShardPath()
+		log.Printf("Appending %d new or changed inputs to %s", len(matches),
+			shardPath)
+	} else if inputs, hashErr := HashInputs(matches); hashErr != nil {
+		log.Fatal(hashErr)
+	} else {
+		manifest = NewRunManifest()
+		manifest.SetTokenizer(*tokenizerId, tokenizer)
+		manifest.Output = *outputFile
+		manifest.ContextSize = *contextSize
+		manifest.InputGlobs = InputGlobs(*inputDir, *inputFormat)
+		manifest.Inputs = inputs
+		shardInputs = inputs
+	}
+
+	begin := time.Now()
+	if total, err := TokenizeShard(textsReader, textsTokenizer,
+		contextsWriter, matches, shardPath, *documentIndex); err != nil {
+		log.Fatal(err)
+	} else {
 		duration := time.Now().Sub(begin).Seconds()
 		log.Printf("%d tokens in %0.2fs, %0.2f tokens/s", total,
 			duration, float64(total)/duration)
+		if languages := textsReader.Languages; languages != nil {
+			for language, count := range languages.Dropped {
+				log.Printf("Dropped %d documents in language %s", count,
+					language)
+			}
+			manifest.AddLanguages(languages.Kept)
+		}
+		if filters := textsReader.Filters; filters != nil {
+			for name, count := range filters.Rejected {
+				log.Printf("Filter %s rejected %d documents", name, count)
+			}
+			log.Printf("Quality filters accepted %d documents",
+				filters.Accepted)
+		}
+		if jsonl := textsReader.JSONL; jsonl != nil && jsonl.Skipped > 0 {
+			log.Printf("Skipped %d jsonl lines without a document",
+				jsonl.Skipped)
+		}
+		manifest.AddShard(shardPath, total, shardInputs, begin)
+		if !*appendMode {
+			manifest.Finish(total)
+		}
+		if manifestErr := manifest.Write(manifestPath); manifestErr != nil {
+			log.Fatal(manifestErr)
+		}
+		log.Printf("Wrote run manifest to %s", manifestPath)
 	}
 }
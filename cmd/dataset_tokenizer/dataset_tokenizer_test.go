@@ -3,15 +3,28 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"compress/gzip"
 	"crypto/sha256"
+	"database/sql"
 	"encoding/binary"
 	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
 	"github.com/stretchr/testify/assert"
 	"github.com/wbrown/gpt_bpe"
+	"github.com/wbrown/gpt_bpe/dataset"
+	"github.com/wbrown/gpt_bpe/zstd"
 	"io"
 	"log"
+	"net"
 	"os"
+	"path"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 )
@@ -54,11 +67,11 @@ func TokensFromBin(bin *[]byte) *gpt_bpe.Tokens {
 	tokens := make(gpt_bpe.Tokens, 0)
 	buf := bytes.NewReader(*bin)
 	for {
-		var token gpt_bpe.Token
+		var token uint16
 		if err := binary.Read(buf, binary.LittleEndian, &token); err != nil {
 			break
 		}
-		tokens = append(tokens, token)
+		tokens = append(tokens, gpt_bpe.Token(token))
 	}
 	return &tokens
 }
@@ -203,7 +216,8 @@ func TestSampling40(t *testing.T) {
 	inputDir := "../../resources"
 	reorderPaths := ""
 	sampling := 100
-	outputFile := "base.chunk"
+	outputDir := t.TempDir()
+	outputFile := path.Join(outputDir, "base.chunk")
 
 	if _, tokErr := textsTokenizer.InitTokenizer(); tokErr != nil {
 		log.Fatal(tokErr)
@@ -245,7 +259,7 @@ func TestSampling40(t *testing.T) {
 	inputDir = "../../resources"
 	reorderPaths = ""
 	sampling = 40
-	outputFile = "samp40.chunk"
+	outputFile = path.Join(outputDir, "samp40.chunk")
 
 	if _, tokErr := textsTokenizer.InitTokenizer(); tokErr != nil {
 		log.Fatal(tokErr)
@@ -298,7 +312,8 @@ func TestShuffle(t *testing.T) {
 	inputDir := "../../resources"
 	reorderPaths := ""
 	sampling := 100
-	outputFile := "noshuffle.chunk"
+	outputDir := t.TempDir()
+	outputFile := path.Join(outputDir, "noshuffle.chunk")
 
 	if _, tokErr := textsTokenizer.InitTokenizer(); tokErr != nil {
 		log.Fatal(tokErr)
@@ -339,7 +354,7 @@ func TestShuffle(t *testing.T) {
 	inputDir = "../../resources"
 	reorderPaths = "shuffle"
 	sampling = 100
-	outputFile = "shuffle.chunk"
+	outputFile = path.Join(outputDir, "shuffle.chunk")
 
 	if _, tokErr := textsTokenizer.InitTokenizer(); tokErr != nil {
 		log.Fatal(tokErr)
@@ -374,13 +389,13 @@ func TestShuffle(t *testing.T) {
 		t.Fail()
 	}
 
-	f, err := os.Open("noshuffle.chunk")
+	f, err := os.Open(path.Join(outputDir, "noshuffle.chunk"))
 	if err != nil {
 		log.Fatal(err)
 	}
 	defer f.Close()
 
-	f2, err2 := os.Open("shuffle.chunk")
+	f2, err2 := os.Open(path.Join(outputDir, "shuffle.chunk"))
 	if err2 != nil {
 		log.Fatal(err2)
 	}
@@ -436,3 +451,2292 @@ func TestShuffle(t *testing.T) {
 
 	fmt.Printf("Using Chunk by chunk hashing, shuffle found to be working as intended!! \n")
 }
+
+func TestRunManifest(t *testing.T) {
+	inputDir := "../../resources"
+	matches, err := GlobTexts(inputDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	inputs, hashErr := HashInputs(matches)
+	if hashErr != nil {
+		t.Fatal(hashErr)
+	}
+	assert.Equal(t, len(matches), len(inputs))
+	for idx := range inputs {
+		assert.Equal(t, matches[idx].Path, inputs[idx].Path)
+		digest, _ := HashFile(matches[idx].Path)
+		assert.Equal(t, digest, inputs[idx].SHA256)
+	}
+
+	manifest := NewRunManifest()
+	manifest.InputGlobs = InputGlobs(inputDir, InputFormatText)
+	manifest.Inputs = inputs
+	manifest.SetTokenizer("gpt2", &gpt_bpe.GPT2Encoder)
+	manifest.Finish(1024)
+	manifestPath := path.Join(t.TempDir(), "manifest.chunk"+ManifestSuffix)
+	if writeErr := manifest.Write(manifestPath); writeErr != nil {
+		t.Fatal(writeErr)
+	}
+	readBack, readErr := ReadRunManifest(manifestPath)
+	if readErr != nil {
+		t.Fatal(readErr)
+	}
+	assert.Equal(t, manifest.Inputs, readBack.Inputs)
+	assert.Equal(t, gpt_bpe.GPT2Encoder.Fingerprint(),
+		readBack.Tokenizer.Fingerprint)
+	assert.Equal(t, 1024, readBack.TotalTokens)
+	assert.NotEmpty(t, readBack.Build.GoVersion)
+}
+
+type SplitterTest struct {
+	Name         string
+	Delimiter    string
+	RecordLength int
+	Input        string
+	Expected     []string
+}
+
+var splitterTests = []SplitterTest{
+	{"Delimiter",
+		"<\\|endoftext\\|>", 0,
+		"foo<|endoftext|>bar<|endoftext|>",
+		[]string{"foo", "bar"}},
+	{"Consecutive delimiters",
+		"\n\n+", 0,
+		"foo\n\n\n\nbar\nbaz\n\nqux",
+		[]string{"foo", "bar\nbaz", "qux"}},
+	{"Line anchored delimiter",
+		"(?m)^-----\n", 0,
+		"foo\n-----\nbar -----\n-----\n",
+		[]string{"foo\n", "bar -----\n"}},
+	{"Record length",
+		"", 4,
+		"foobarbazq",
+		[]string{"foob", "arba", "zq"}},
+	{"Record length aligned to runes",
+		"", 4,
+		"foo…bar",
+		[]string{"foo", "…b", "ar"}},
+}
+
+func TestDocumentSplitter_Split(t *testing.T) {
+	for _, test := range splitterTests {
+		splitter, err := NewDocumentSplitter(test.Delimiter,
+			test.RecordLength)
+		if err != nil {
+			t.Fatal(err)
+		}
+		nextDocument := splitter.Split(strings.NewReader(test.Input))
+		documents := make([]string, 0)
+		for {
+			document, splitErr := nextDocument()
+			assert.Nil(t, splitErr)
+			if document == nil {
+				break
+			}
+			documents = append(documents, *document)
+		}
+		assert.Equal(t, test.Expected, documents, test.Name)
+	}
+
+	_, err := NewDocumentSplitter("x*", 0)
+	assert.Error(t, err)
+	_, err = NewDocumentSplitter("x", 4)
+	assert.Error(t, err)
+}
+
+func TestTextsReader_Splitter(t *testing.T) {
+	inputPath := path.Join(t.TempDir(), "dump.txt")
+	dump := "first document\n\nsecond document\n\nthird document"
+	if err := os.WriteFile(inputPath, []byte(dump), 0644); err != nil {
+		t.Fatal(err)
+	}
+	splitter, _ := NewDocumentSplitter("\n\n", 0)
+	textsReader := NewTextsReader()
+	textsReader.Splitter = splitter
+	nextText, err := textsReader.ReadTexts(inputPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []string{"first document", "second document",
+		"third document"}, readAllTexts(nextText))
+}
+
+// textsIterator returns a TextsIterator over the given documents.
+func textsIterator(documents []string) TextsIterator {
+	documentIdx := 0
+	return func() io.RuneReader {
+		if documentIdx == len(documents) {
+			return nil
+		}
+		documentIdx++
+		return strings.NewReader(documents[documentIdx-1])
+	}
+}
+
+// readAllTexts drains a TextsIterator, returning each document as a string.
+func readAllTexts(nextText TextsIterator) []string {
+	documents := make([]string, 0)
+	for {
+		runeReader := nextText()
+		if runeReader == nil {
+			break
+		}
+		runes := make([]rune, 0)
+		for {
+			r, size, _ := runeReader.ReadRune()
+			if size == 0 {
+				break
+			}
+			runes = append(runes, r)
+		}
+		documents = append(documents, string(runes))
+	}
+	return documents
+}
+
+const wikiDump = `<mediawiki xmlns="http://www.mediawiki.org/xml/export-0.10/">
+  <siteinfo><sitename>Wikipedia</sitename></siteinfo>
+  <page>
+    <title>Anarchism</title>
+    <ns>0</ns>
+    <id>12</id>
+    <revision>
+      <id>1</id>
+      <text xml:space="preserve">{{Short description|Political philosophy}}Anarchism is a {{lang|en|political {{nested}}}} philosophy &amp; movement.</text>
+    </revision>
+  </page>
+  <page>
+    <title>AccessibleComputing</title>
+    <ns>0</ns>
+    <id>10</id>
+    <redirect title="Computer accessibility" />
+    <revision>
+      <text xml:space="preserve">#REDIRECT [[Computer accessibility]]</text>
+    </revision>
+  </page>
+  <page>
+    <title>Talk:Anarchism</title>
+    <ns>1</ns>
+    <id>13</id>
+    <revision>
+      <text xml:space="preserve">Discussion.</text>
+    </revision>
+  </page>
+</mediawiki>`
+
+func TestWikiReader_Next(t *testing.T) {
+	wikiReader := NewWikiReader(strings.NewReader(wikiDump))
+	page, err := wikiReader.Next()
+	assert.Nil(t, err)
+	assert.Equal(t, "Anarchism", page.Title)
+	assert.Equal(t, int64(12), page.Id)
+	assert.Equal(t, "{{Short description|Political philosophy}}Anarchism "+
+		"is a {{lang|en|political {{nested}}}} philosophy & movement.",
+		page.Text)
+	_, err = wikiReader.Next()
+	assert.Equal(t, io.EOF, err)
+
+	wikiReader = NewWikiReader(strings.NewReader(wikiDump))
+	wikiReader.Namespaces = nil
+	wikiReader.SkipRedirects = false
+	titles := make([]string, 0)
+	for {
+		page, err := wikiReader.Next()
+		if err == io.EOF {
+			break
+		}
+		assert.Nil(t, err)
+		titles = append(titles, page.Title)
+	}
+	assert.Equal(t, []string{"Anarchism", "AccessibleComputing",
+		"Talk:Anarchism"}, titles)
+}
+
+func TestStripWikiTemplates(t *testing.T) {
+	assert.Equal(t, "Anarchism is a  philosophy.",
+		StripWikiTemplates("{{a|b}}Anarchism is a {{x|{{y}}}} philosophy."))
+	assert.Equal(t, "no templates", StripWikiTemplates("no templates"))
+	assert.Equal(t, "unterminated ",
+		StripWikiTemplates("unterminated {{template"))
+}
+
+func TestTextsReader_WikiXML(t *testing.T) {
+	inputDir := t.TempDir()
+	inputPath := path.Join(inputDir, "pages-articles.xml")
+	if err := os.WriteFile(inputPath, []byte(wikiDump), 0644); err != nil {
+		t.Fatal(err)
+	}
+	textsReader := NewTextsReader()
+	textsReader.Format = InputFormatWikiXML
+	textsReader.WikiStripTemplates = true
+	nextText, err := textsReader.ReadTexts(inputDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []string{"Anarchism\n\nAnarchism is a  philosophy & " +
+		"movement."}, readAllTexts(nextText))
+}
+
+func TestTextsReader_JSONL(t *testing.T) {
+	inputDir := t.TempDir()
+	lines := `{"id": 1, "title": "One", "text": "The first.", "url": "a"}
+{"id": 2, "title": "Two", "body": "No text field."}
+
+{"id": 3, "title": "Three", "text": "The third.", "url": "c"}
+`
+	assert.Nil(t, os.WriteFile(path.Join(inputDir, "a.jsonl"),
+		[]byte(lines), 0644))
+	textsReader := NewTextsReader()
+	textsReader.Format = InputFormatJSONL
+	nextText, err := textsReader.ReadTexts(inputDir)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"The first.", "The third."},
+		readAllTexts(nextText))
+
+	// Templates read the text from several fields, and lines that lack one
+	// of them are skipped.
+	textsReader.JSONL, err = NewJSONLInput("", `{{.title}}\n{{.body}}`, nil)
+	assert.Nil(t, err)
+	nextText, err = textsReader.ReadTexts(inputDir)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"Two\nNo text field."}, readAllTexts(nextText))
+	assert.Equal(t, 2, textsReader.JSONL.Skipped)
+	_, err = NewJSONLInput("", "{{.title", nil)
+	assert.NotNil(t, err)
+
+	// Metadata is carried through the filters into the document index.
+	textsReader.JSONL, err = NewJSONLInput("text", "", []string{"id", "url"})
+	assert.Nil(t, err)
+	textsReader.Filters = NewDocumentFilters(WordCountFilter{Min: 1,
+		Max: 100})
+	nextText, err = textsReader.ReadTexts(inputDir)
+	assert.Nil(t, err)
+	textsTokenizer := NewTextsTokenizer()
+	textsTokenizer.ContextSize = 16
+	textsTokenizer.TokenizerId = "gpt2"
+	outputFile := path.Join(t.TempDir(), "jsonl.chunk")
+	textsTokenizer.DocumentIndex = NewDocumentIndex(outputFile)
+	contexts, err := textsTokenizer.TokenizeTexts(nextText)
+	assert.Nil(t, err)
+	_, err = NewContextsWriter().WriteContexts(outputFile, contexts)
+	assert.Nil(t, err)
+	spans := textsTokenizer.DocumentIndex.Spans
+	assert.Len(t, spans, 2)
+	assert.Equal(t, map[string]interface{}{"id": 1.0, "url": "a"},
+		spans[0].Metadata)
+	assert.Equal(t, map[string]interface{}{"id": 3.0, "url": "c"},
+		spans[1].Metadata)
+
+	assert.Nil(t, os.WriteFile(path.Join(inputDir, "a.jsonl"),
+		[]byte("{\"text\": \"ok\"}\nnot json\n"), 0644))
+	err = textsReader.readFile(path.Join(inputDir, "a.jsonl"),
+		func(io.RuneReader) {})
+	assert.Contains(t, err.Error(), "line 2")
+}
+
+// warcRecord formats a WARC record with the given headers and block.
+func warcRecord(headers string, block string) string {
+	return fmt.Sprintf("WARC/1.0\r\n%sContent-Length: %d\r\n\r\n%s\r\n\r\n",
+		headers, len(block), block)
+}
+
+func TestWarcReader_Next(t *testing.T) {
+	htmlResponse := "HTTP/1.1 200 OK\r\n" +
+		"Content-Type: text/html; charset=UTF-8\r\n\r\n" +
+		"<html><head><title>Title</title><style>p{}</style></head>" +
+		"<body><h1>Heading</h1><p>Fish &amp; chips.</p>" +
+		"<script>var x = 1;</script><!-- comment --><p>Second</p>" +
+		"</body></html>"
+	notFound := "HTTP/1.1 404 Not Found\r\n" +
+		"Content-Type: text/plain\r\n\r\nmissing"
+	image := "HTTP/1.1 200 OK\r\nContent-Type: image/png\r\n\r\n\x89PNG"
+	dump := warcRecord("WARC-Type: warcinfo\r\n", "software: test") +
+		warcRecord("WARC-Type: conversion\r\n"+
+			"WARC-Identified-Content-Language: eng,fra\r\n",
+			"English text.") +
+		warcRecord("WARC-Type: conversion\r\n"+
+			"WARC-Identified-Content-Language: deu\r\n",
+			"Deutscher Text.") +
+		warcRecord("WARC-Type: response\r\n"+
+			"Content-Type: application/http; msgtype=response\r\n",
+			htmlResponse) +
+		warcRecord("WARC-Type: response\r\n", notFound) +
+		warcRecord("WARC-Type: response\r\n", image)
+
+	readAll := func(warcReader *WarcReader) []string {
+		documents := make([]string, 0)
+		for {
+			document, err := warcReader.Next()
+			if err == io.EOF {
+				return documents
+			}
+			assert.Nil(t, err)
+			documents = append(documents, *document)
+		}
+	}
+
+	warcReader := NewWarcReader(strings.NewReader(dump))
+	assert.Equal(t, []string{"English text.", "Deutscher Text.",
+		"Heading\n\nFish & chips.\n\nSecond", "missing"},
+		readAll(warcReader))
+
+	warcReader = NewWarcReader(strings.NewReader(dump))
+	warcReader.StatusCodes = map[int]bool{200: true}
+	warcReader.Languages = map[string]bool{"eng": true}
+	assert.Equal(t, []string{"English text."}, readAll(warcReader))
+
+	warcReader = NewWarcReader(strings.NewReader("WARC/1.0\r\n" +
+		"Content-Length: nope\r\n\r\n"))
+	_, err := warcReader.Next()
+	assert.NotNil(t, err)
+}
+
+func TestTextsReader_WET(t *testing.T) {
+	inputDir := t.TempDir()
+	inputPath := path.Join(inputDir, "CC-MAIN-00000.warc.wet.gz")
+	var compressed bytes.Buffer
+	// Common Crawl compresses each record as its own gzip member.
+	for _, record := range []string{
+		warcRecord("WARC-Type: warcinfo\r\n", "software: test"),
+		warcRecord("WARC-Type: conversion\r\n"+
+			"WARC-Identified-Content-Language: eng\r\n", "First page."),
+		warcRecord("WARC-Type: conversion\r\n"+
+			"WARC-Identified-Content-Language: fra\r\n", "Deuxième page."),
+	} {
+		gzipWriter := gzip.NewWriter(&compressed)
+		gzipWriter.Write([]byte(record))
+		gzipWriter.Close()
+	}
+	if err := os.WriteFile(inputPath, compressed.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	textsReader := NewTextsReader()
+	textsReader.Format = InputFormatWET
+	nextText, err := textsReader.ReadTexts(inputDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []string{"First page.", "Deuxième page."},
+		readAllTexts(nextText))
+
+	textsReader.WarcLanguages = []string{"fra"}
+	nextText, err = textsReader.ReadTexts(inputDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []string{"Deuxième page."}, readAllTexts(nextText))
+}
+
+func TestContextsWriter_Compression(t *testing.T) {
+	textsTokenizer := NewTextsTokenizer()
+	textsTokenizer.ContextSize = 2048
+	textsTokenizer.TokenizerId = "gpt2"
+	if _, tokErr := textsTokenizer.InitTokenizer(); tokErr != nil {
+		t.Fatal(tokErr)
+	}
+	outputDir := t.TempDir()
+	write := func(contextsWriter ContextsWriter, outputFile string) int64 {
+		nextText, err := ReadTexts("../../resources/frankenstein.txt",
+			false, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		contexts, err := textsTokenizer.TokenizeTexts(nextText)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := contextsWriter.WriteContexts(outputFile,
+			contexts); err != nil {
+			t.Fatal(err)
+		}
+		stat, _ := os.Stat(outputFile)
+		return stat.Size()
+	}
+
+	rawPath := path.Join(outputDir, "raw.chunk")
+	rawSize := write(NewContextsWriter(), rawPath)
+	raw, err := gpt_bpe.ReadTokensFile(rawPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, frames := range []string{CompressionFramesChunk,
+		CompressionFramesContext} {
+		contextsWriter := NewContextsWriter()
+		contextsWriter.Compression = CompressionZstd
+		contextsWriter.CompressionFrames = frames
+		zstdPath := path.Join(outputDir, frames+".chunk.zst")
+		zstdSize := write(contextsWriter, zstdPath)
+		assert.Less(t, zstdSize, rawSize, frames)
+		decompressed, err := gpt_bpe.ReadTokensFile(zstdPath)
+		assert.Nil(t, err, frames)
+		assert.Equal(t, *raw, *decompressed, frames)
+	}
+
+	// Frames compressed in parallel are written as they are serially, and
+	// gzip members are read through as one stream.
+	for _, compression := range []string{CompressionZstd, CompressionGzip} {
+		contextsWriter := NewContextsWriter()
+		contextsWriter.Compression = compression
+		contextsWriter.CompressionChunkSize = 16 * 1024
+		contextsWriter.CompressionLevel = 9
+		serialPath := path.Join(outputDir, "serial.chunk."+compression)
+		write(contextsWriter, serialPath)
+		contextsWriter.CompressionWorkers = 4
+		parallelPath := path.Join(outputDir, "parallel.chunk."+compression)
+		parallelSize := write(contextsWriter, parallelPath)
+		assert.Less(t, parallelSize, rawSize, compression)
+		serial, _ := os.ReadFile(serialPath)
+		parallel, _ := os.ReadFile(parallelPath)
+		assert.Equal(t, serial, parallel, compression)
+		decompressed, err := gpt_bpe.ReadTokensFile(parallelPath)
+		assert.Nil(t, err, compression)
+		assert.Equal(t, *raw, *decompressed, compression)
+	}
+	contextsWriter := NewContextsWriter()
+	contextsWriter.Compression = CompressionGzip
+	contextsWriter.CompressionLevel = 10
+	_, err = contextsWriter.WriteContexts(path.Join(outputDir, "x"), nil)
+	assert.NotNil(t, err)
+
+	contextsWriter = NewContextsWriter()
+	contextsWriter.Compression = CompressionZstd
+	contextsWriter.Shuffle = true
+	_, err = contextsWriter.WriteContexts(path.Join(outputDir, "x"), nil)
+	assert.NotNil(t, err)
+
+	// Document frames end after every end of text token, and keep the
+	// padding of a context with its last document.
+	contexts := []gpt_bpe.Tokens{
+		{10, 11, 50256, 12},
+		{13, 50256, 0, 0},
+		{14, 50256, 15, 16},
+	}
+	contextIdx := 0
+	nextContext := func() *gpt_bpe.Tokens {
+		if contextIdx == len(contexts) {
+			return nil
+		}
+		contextIdx++
+		return &contexts[contextIdx-1]
+	}
+	contextsWriter = NewContextsWriter()
+	contextsWriter.Compression = CompressionZstd
+	contextsWriter.CompressionFrames = CompressionFramesDocument
+	contextsWriter.EndOfText = 50256
+	documentsPath := path.Join(outputDir, "documents.chunk.zst")
+	_, err = contextsWriter.WriteContexts(documentsPath, nextContext)
+	assert.Nil(t, err)
+	expected := make([]byte, 0)
+	for _, document := range []gpt_bpe.Tokens{{10, 11, 50256},
+		{12, 13, 50256, 0, 0}, {14, 50256}, {15, 16}} {
+		bin, err := document.ToBin()
+		assert.Nil(t, err)
+		expected = zstd.Compress(expected, *bin)
+	}
+	written, _ := os.ReadFile(documentsPath)
+	assert.Equal(t, expected, written)
+}
+
+func TestTextsReader_CompressedInputs(t *testing.T) {
+	inputDir := t.TempDir()
+	documents := map[string]string{
+		"plain.txt":     "A plain document.",
+		"zipped.txt.gz": "A gzip document.",
+		"zstd.txt.zst":  "A Zstandard document.",
+	}
+	for name, document := range documents {
+		var contents bytes.Buffer
+		switch path.Ext(name) {
+		case ".gz":
+			gzipWriter := gzip.NewWriter(&contents)
+			gzipWriter.Write([]byte(document))
+			gzipWriter.Close()
+		case ".zst":
+			contents.Write(zstd.Compress(nil, []byte(document)))
+		default:
+			contents.WriteString(document)
+		}
+		if err := os.WriteFile(path.Join(inputDir, name), contents.Bytes(),
+			0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Compressed inputs are found with the uncompressed inputs.
+	assert.Nil(t, os.WriteFile(path.Join(inputDir, "other.gz"), nil, 0644))
+	matches, err := GlobTexts(inputDir)
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.Len(t, matches, 3)
+	nextText, err := NewTextsReader().ReadPaths(matches)
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.ElementsMatch(t, []string{"A plain document.", "A gzip document.",
+		"A Zstandard document."}, readAllTexts(nextText))
+
+	// Inputs that are not of their compression are an error.
+	assert.Nil(t, os.WriteFile(path.Join(inputDir, "bad.txt.gz"),
+		[]byte("not gzip"), 0644))
+	assert.NotNil(t, NewTextsReader().readFile(path.Join(inputDir,
+		"bad.txt.gz"), func(io.RuneReader) {}))
+}
+
+func TestRunManifest_Append(t *testing.T) {
+	inputDir := t.TempDir()
+	writeInput := func(name string, text string) {
+		if err := os.WriteFile(path.Join(inputDir, name), []byte(text),
+			0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeInput("a.txt", "first input")
+	writeInput("b.txt", "second input")
+	matches, _ := GlobTexts(inputDir)
+	inputs, err := HashInputs(matches)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	manifest := NewRunManifest()
+	manifest.Output = path.Join(inputDir, "tokenized.chunk")
+	manifest.ContextSize = 2048
+	manifest.SetTokenizer("gpt2", &gpt_bpe.GPT2Encoder)
+	manifest.Inputs = inputs
+	manifest.AddShard(manifest.Output, 100, inputs, time.Now())
+	manifest.Finish(100)
+	assert.Nil(t, manifest.CheckAppendable(&gpt_bpe.GPT2Encoder, 2048))
+	assert.NotNil(t, manifest.CheckAppendable(&gpt_bpe.GPT2Encoder, 1024))
+	assert.NotNil(t, manifest.CheckAppendable(&gpt_bpe.PileEncoder, 2048))
+
+	// Unchanged files keep their recorded digest without being rehashed.
+	manifest.Inputs[0].SHA256 = "recorded"
+	unchanged, _ := HashChangedInputs(matches, manifest.Inputs)
+	assert.Equal(t, "recorded", unchanged[0].SHA256)
+	assert.Empty(t, manifest.PendingInputs(unchanged))
+
+	writeInput("b.txt", "second input, revised")
+	writeInput("c.txt", "third input")
+	matches, _ = GlobTexts(inputDir)
+	current, _ := HashChangedInputs(matches, manifest.Inputs)
+	pending := manifest.PendingInputs(current)
+	pendingPaths := make([]string, 0)
+	for _, input := range pending {
+		pendingPaths = append(pendingPaths, path.Base(input.Path))
+	}
+	assert.Equal(t, []string{"b.txt", "c.txt"}, pendingPaths)
+
+	assert.Equal(t, manifest.Output+".0001", manifest.NextShardPath())
+	manifest.AddShard(manifest.NextShardPath(), 50, pending, time.Now())
+	assert.Equal(t, 150, manifest.TotalTokens)
+	assert.Equal(t, manifest.Output+".0002", manifest.NextShardPath())
+	assert.Equal(t, []string{pending[0].Path, pending[1].Path},
+		manifest.Shards[1].Inputs)
+}
+
+func TestTokenizeCheckpointed(t *testing.T) {
+	textsTokenizer := NewTextsTokenizer()
+	textsTokenizer.ContextSize = 64
+	if _, tokErr := textsTokenizer.InitTokenizer(); tokErr != nil {
+		t.Fatal(tokErr)
+	}
+	inputDir := t.TempDir()
+	for idx := 0; idx < 5; idx++ {
+		if err := os.WriteFile(path.Join(inputDir, fmt.Sprintf("%d.txt",
+			idx)), []byte(strings.Repeat(fmt.Sprintf("Input %d. ", idx),
+			40)), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	matches, _ := GlobTexts(inputDir)
+	inputs, err := HashInputs(matches)
+	if err != nil {
+		t.Fatal(err)
+	}
+	outputDir := t.TempDir()
+	manifestPath := path.Join(outputDir, "tokenized"+ManifestSuffix)
+	manifest := NewRunManifest()
+	manifest.Output = path.Join(outputDir, "tokenized.chunk")
+	manifest.ContextSize = 64
+	manifest.SetTokenizer("gpt2", &gpt_bpe.GPT2Encoder)
+	manifest.Inputs = inputs
+	manifest.CheckpointInputs = 2
+	checkpoint := func(pending []ManifestInput) {
+		if err := TokenizeCheckpointed(NewTextsReader(), textsTokenizer,
+			NewContextsWriter(), matches, pending, manifest, manifestPath,
+			false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	checkpoint(inputs)
+	if !assert.Len(t, manifest.Shards, 3) {
+		return
+	}
+	shards := make([][]byte, 0)
+	for idx, shard := range manifest.Shards {
+		assert.Equal(t, ShardPath(manifest.Output, idx), shard.Path)
+		contents, _ := os.ReadFile(shard.Path)
+		assert.Equal(t, int64(len(contents)), shard.Bytes)
+		shards = append(shards, contents)
+	}
+	assert.Equal(t, []string{inputs[4].Path}, manifest.Shards[2].Inputs)
+
+	// A run interrupted while writing its second shard resumes after its
+	// first, writing the same shards again.
+	manifest, err = ReadRunManifest(manifestPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest.Shards = manifest.Shards[:1]
+	assert.Nil(t, os.Truncate(ShardPath(manifest.Output, 1), 10))
+	assert.Nil(t, os.Remove(ShardPath(manifest.Output, 2)))
+	pending, err := manifest.ResumeCheckpoint(inputs)
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.Equal(t, inputs[2:], pending)
+	_, err = os.Stat(ShardPath(manifest.Output, 1))
+	assert.True(t, errors.Is(err, os.ErrNotExist))
+	checkpoint(pending)
+	for idx, shard := range manifest.Shards {
+		contents, _ := os.ReadFile(shard.Path)
+		assert.Equal(t, shards[idx], contents, shard.Path)
+	}
+
+	// Completed inputs that changed, and shards that were truncated, cannot
+	// be resumed exactly once.
+	changed := append([]ManifestInput{}, inputs...)
+	changed[0].SHA256 = "changed"
+	_, err = manifest.ResumeCheckpoint(changed)
+	assert.NotNil(t, err)
+	assert.Nil(t, os.Truncate(manifest.Shards[0].Path, 1))
+	_, err = manifest.ResumeCheckpoint(inputs)
+	assert.NotNil(t, err)
+	manifest.CheckpointInputs = 0
+	_, err = manifest.ResumeCheckpoint(inputs)
+	assert.NotNil(t, err)
+}
+
+func TestDocumentIndex(t *testing.T) {
+	textsTokenizer := NewTextsTokenizer()
+	textsTokenizer.ContextSize = 64
+	textsTokenizer.TokenizerId = "gpt2"
+	textsTokenizer.EndOfText = "<|endoftext|>"
+	textsTokenizer.PadToken = "<|endoftext|>"
+	tokenizer, tokErr := textsTokenizer.InitTokenizer()
+	if tokErr != nil {
+		t.Fatal(tokErr)
+	}
+	frankenstein, err := os.ReadFile("../../resources/frankenstein.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	documents := make([]string, 0)
+	for _, paragraph := range strings.Split(string(frankenstein), "\n\n") {
+		if paragraph = strings.TrimSpace(paragraph); paragraph != "" {
+			documents = append(documents, paragraph)
+		}
+		if len(documents) == 40 {
+			break
+		}
+	}
+	documentIdx := 0
+	nextText := func() io.RuneReader {
+		if documentIdx == len(documents) {
+			return nil
+		}
+		documentIdx++
+		return strings.NewReader(documents[documentIdx-1])
+	}
+
+	outputDir := t.TempDir()
+	outputFile := path.Join(outputDir, "indexed.chunk")
+	textsTokenizer.DocumentIndex = NewDocumentIndex(outputFile)
+	contexts, err := textsTokenizer.TokenizeTexts(nextText)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewContextsWriter().WriteContexts(outputFile,
+		contexts); err != nil {
+		t.Fatal(err)
+	}
+	indexPath := outputFile + DocumentIndexSuffix
+	assert.Nil(t, textsTokenizer.DocumentIndex.Write(indexPath))
+	spans, err := ReadDocumentIndex(indexPath)
+	assert.Nil(t, err)
+	assert.Len(t, spans, len(documents))
+
+	tokens, err := gpt_bpe.ReadTokensFile(outputFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	endOfText := *tokenizer.Get("<|endoftext|>")
+	contained := 0
+	for documentIdx, span := range spans {
+		assert.Equal(t, documentIdx, span.Id)
+		assert.Equal(t, outputFile, span.Shard)
+		assert.Greater(t, span.Length, int64(0))
+		spanTokens := (*tokens)[span.Offset : span.Offset+span.Length]
+		document := documents[documentIdx]
+		assert.Equal(t, (*tokenizer.Encode(&document))[0], spanTokens[0])
+		assert.Equal(t, endOfText, spanTokens[len(spanTokens)-1])
+		if documentIdx > 0 {
+			assert.Greater(t, span.Offset, spans[documentIdx-1].Offset)
+		}
+		// Documents within a single context are exactly their tokens.
+		contextSize := int64(textsTokenizer.ContextSize)
+		if span.Offset/contextSize ==
+			(span.Offset+span.Length-1)/contextSize {
+			contained++
+			assert.Equal(t, document+"<|endoftext|>",
+				tokenizer.Decode(&spanTokens))
+		}
+	}
+	assert.Greater(t, contained, 0)
+}
+
+func TestIdentifyLanguage(t *testing.T) {
+	for expected, text := range map[string]string{
+		"eng": "It was on a dreary night of November that I beheld the " +
+			"accomplishment of my toils.",
+		"deu": "Es war in einer trüben Nacht im November, als ich die " +
+			"Vollendung meiner Mühen sah, und ich war nicht froh.",
+		"fra": "Ce fut par une triste nuit de novembre que je vis " +
+			"l'accomplissement de mes travaux, et il ne dormait pas.",
+		"spa": "Fue en una lúgubre noche de noviembre cuando vi el " +
+			"resultado de mis esfuerzos, y la lluvia que caía.",
+		"ita": "Fu in una triste notte di novembre che vidi il compimento " +
+			"delle mie fatiche, e non era più come prima.",
+		"nld": "Het was op een sombere nacht in november dat ik de " +
+			"voltooiing van mijn werk zag, en het regende ook.",
+		"rus": "Это было в ненастную ноябрьскую ночь, когда я увидел, что " +
+			"мои труды завершены, и он не спал.",
+		"jpn": "十一月のわびしい夜、私は自分の苦労が実を結ぶのを見た。",
+		"zho": "在十一月一个阴沉的夜晚，我看到了我辛勤劳动的成果。",
+		"kor": "11월의 어느 음산한 밤, 나는 내 노고의 결실을 보았다.",
+		"ell": "Ήταν μια θλιβερή νύχτα του Νοεμβρίου όταν είδα την " +
+			"ολοκλήρωση των κόπων μου.",
+		"und": "12345 !!! ...",
+	} {
+		assert.Equal(t, expected, IdentifyLanguage(text), text)
+	}
+}
+
+func TestTextsReader_Languages(t *testing.T) {
+	inputPath := path.Join(t.TempDir(), "dump.txt")
+	english := strings.Repeat("This is the story of the creature, "+
+		"and it was not a happy one. ", 200)
+	documents := []string{
+		english,
+		"Dies ist die Geschichte der Kreatur, und sie ist nicht " +
+			"glücklich, aber sie hat ein Ende.",
+		"Ceci est l'histoire de la créature, et elle n'est pas heureuse " +
+			"dans les bois.",
+		"12345",
+	}
+	if err := os.WriteFile(inputPath,
+		[]byte(strings.Join(documents, "\n\n")), 0644); err != nil {
+		t.Fatal(err)
+	}
+	splitter, _ := NewDocumentSplitter("\n\n", 0)
+	read := func(filter *LanguageFilter) []string {
+		textsReader := NewTextsReader()
+		textsReader.Splitter = splitter
+		textsReader.Languages = filter
+		nextText, err := textsReader.ReadTexts(inputPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return readAllTexts(nextText)
+	}
+
+	// Documents longer than the sample are passed through whole.
+	filter := NewLanguageFilter([]string{"eng", "fra"}, nil)
+	assert.Equal(t, []string{english, documents[2]}, read(filter))
+	assert.Equal(t, map[string]int{"eng": 1, "fra": 1}, filter.Kept)
+	assert.Equal(t, map[string]int{"deu": 1, "und": 1}, filter.Dropped)
+
+	filter = NewLanguageFilter(nil, []string{"deu", "und"})
+	assert.Equal(t, []string{english, documents[2]}, read(filter))
+
+	filter = NewLanguageFilter(nil, []string{"eng"})
+	assert.Equal(t, documents[1:], read(filter))
+}
+
+func TestDocumentFilters(t *testing.T) {
+	frankenstein, err := os.ReadFile("../../resources/frankenstein.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	prose := string(frankenstein[20000:26000])
+	documents := map[string]string{
+		"prose":  prose,
+		"short":  "Too short to be a document.",
+		"long":   strings.Repeat("supercalifragilistic ", 100),
+		"hashes": strings.Repeat("#trending #news #today words ", 30),
+		"digits": strings.Repeat("1234 5678 90123 4567 ", 30) + prose[:200],
+		"lines": strings.Repeat("Click here to subscribe to our "+
+			"newsletter today!\n", 30) + prose[:500],
+		"ngrams": strings.Repeat("the quick brown fox jumps over "+
+			"the lazy dog and ", 20),
+	}
+	expected := map[string]string{
+		"prose":  "",
+		"short":  "word_count",
+		"long":   "mean_word_length",
+		"hashes": "symbol_ratio",
+		"digits": "alphabetic_ratio",
+		"lines":  "repetition",
+		"ngrams": "repetition",
+	}
+	filters, err := ParseDocumentFilters("gopher")
+	assert.Nil(t, err)
+	for name, document := range documents {
+		accept, rejectedBy := filters.Filter(document)
+		assert.Equal(t, expected[name] == "", accept, name)
+		assert.Equal(t, expected[name], rejectedBy, name)
+	}
+	assert.Equal(t, 1, filters.Accepted)
+	assert.Equal(t, 2, filters.Rejected["repetition"])
+
+	repetition := NewRepetitionFilter()
+	assert.Less(t, repetition.Score(prose), 1.0)
+	assert.Greater(t, repetition.Score(documents["ngrams"]), 1.0)
+
+	_, err = ParseDocumentFilters("gopher,unknown")
+	assert.NotNil(t, err)
+
+	// Filtering happens as the texts are read.
+	inputPath := path.Join(t.TempDir(), "dump.txt")
+	if err := os.WriteFile(inputPath, []byte(prose+"\f"+
+		documents["short"]+"\f"+documents["ngrams"]), 0644); err != nil {
+		t.Fatal(err)
+	}
+	splitter, _ := NewDocumentSplitter("\f", 0)
+	textsReader := NewTextsReader()
+	textsReader.Splitter = splitter
+	textsReader.Filters, _ = ParseDocumentFilters(
+		"word_count,repetition")
+	nextText, err := textsReader.ReadTexts(inputPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []string{prose}, readAllTexts(nextText))
+}
+
+// pipelineFlagSet defines every flag of a pipeline file with its default.
+func pipelineFlagSet() *flag.FlagSet {
+	flags := flag.NewFlagSet("pipeline", flag.ContinueOnError)
+	defaults := map[string]string{
+		"input_format":           InputFormatText,
+		"jsonl_field":            DefaultJSONLField,
+		"jsonl_prompt_field":     DefaultJSONLPromptField,
+		"jsonl_completion_field": DefaultJSONLCompletionField,
+		"split_length":           "0",
+		"shuffle":                "false",
+		"seed":                   "0",
+		"shuffle_memory":         "1024",
+		"warc_status":            "200",
+		"sanitize":               "false",
+		"wiki_strip_templates":   "false",
+		"tokenizer":              "gpt2",
+		"no_unitrim":             "false",
+		"regexp_pretokenizer":    "false",
+		"max_word_length":        "1024",
+		"context":                "2048",
+		"boundary":               "\n",
+		"boundary_begin":         "false",
+		"boundary_overlap":       "-1",
+		"sampling":               "100",
+		"epochs":                 "0",
+		"token_budget":           "0",
+		"bytes_per_token":        "4",
+		"epoch_seed":             "0",
+		"output":                 "tokenized.chunk",
+		"output_format":          OutputFormatContexts,
+		"megatron_dtype":         "uint16",
+		"tfrecord_features":      ColumnInputIds,
+		"hf_attention_mask":      "false",
+		"hf_labels":              "false",
+		"compress_frames":        CompressionFramesChunk,
+		"compress_chunk_size":    "4194304",
+		"compress_level":         "0",
+		"compress_workers":       "1",
+		"doc_index":              "false",
+		"route_shards":           "0",
+		"append":                 "false",
+		"dedup_threshold":        "0.8",
+		"packing_bins":           "64",
+		"segment_ids":            "false",
+		"loss_mask":              "false",
+		"checkpoint_inputs":      "0",
+		"resume":                 "false",
+		"retokenize":             "false",
+	}
+	for _, setting := range (&PipelineConfig{}).settings() {
+		flags.String(setting.flag, defaults[setting.flag], "")
+	}
+	return flags
+}
+
+func TestPipelineConfig(t *testing.T) {
+	flags := pipelineFlagSet()
+	assert.Nil(t, flags.Parse([]string{"-context", "1024"}))
+	base, err := PipelineConfigFromFlags(flags)
+	assert.Nil(t, err)
+	assert.True(t, base.Tokenizer.Unitrim)
+	assert.Equal(t, []int{200}, base.Inputs.WarcStatus)
+
+	configPath := path.Join(t.TempDir(), "pipeline.yaml")
+	pipeline := `# A pipeline for Common Crawl
+inputs:
+  path: /data/cc
+  format: wet
+  warc_status: [200, 404]
+filters:
+  lang_allow:
+    - eng
+    - deu
+  quality: [gopher]
+tokenizer:
+  id: pile
+  unitrim: false
+packing:
+  context: 4096
+  boundary: "\n"
+`
+	assert.Nil(t, os.WriteFile(configPath, []byte(pipeline), 0644))
+	config, err := LoadPipelineConfig(configPath, base)
+	assert.Nil(t, err)
+	assert.Nil(t, config.Apply(flags, map[string]bool{"context": true}))
+	for name, expected := range map[string]string{
+		"input": "/data/cc", "input_format": InputFormatWET,
+		"warc_status": "200,404", "lang_allow": "eng,deu",
+		"quality_filters": "gopher", "tokenizer": "pile",
+		"no_unitrim": "true", "context": "1024", "boundary": "\n",
+		"output": "tokenized.chunk",
+	} {
+		assert.Equal(t, expected, flags.Lookup(name).Value.String(), name)
+	}
+
+	// The effective config round trips through its pipeline file.
+	effective, err := PipelineConfigFromFlags(flags)
+	assert.Nil(t, err)
+	assert.Nil(t, effective.Validate())
+	var written bytes.Buffer
+	assert.Nil(t, effective.Write(&written))
+	assert.Nil(t, os.WriteFile(configPath, written.Bytes(), 0644))
+	reloaded, err := LoadPipelineConfig(configPath, &PipelineConfig{})
+	assert.Nil(t, err)
+	assert.Equal(t, effective, reloaded)
+
+	assert.Nil(t, os.WriteFile(configPath,
+		[]byte("packing:\n  contxt: 4096\n"), 0644))
+	_, err = LoadPipelineConfig(configPath, base)
+	assert.NotNil(t, err)
+
+	for _, invalidate := range []func(config *PipelineConfig){
+		func(config *PipelineConfig) { config.Inputs.Path = "" },
+		func(config *PipelineConfig) { config.Inputs.Format = "pdf" },
+		func(config *PipelineConfig) { config.Packing.Sampling = 101 },
+		func(config *PipelineConfig) { config.Tokenizer.MaxWordLength = -1 },
+		func(config *PipelineConfig) { config.Output.Compress = "bz2" },
+		func(config *PipelineConfig) {
+			config.Output.Compress = CompressionGzip
+			config.Output.CompressLevel = 10
+		},
+		func(config *PipelineConfig) { config.Output.CompressWorkers = 0 },
+		func(config *PipelineConfig) {
+			config.Filters.Quality = []string{"bogus"}
+		},
+	} {
+		invalid := *effective
+		invalidate(&invalid)
+		assert.NotNil(t, invalid.Validate())
+	}
+}
+
+func TestCoordinator(t *testing.T) {
+	inputDir := t.TempDir()
+	for _, name := range []string{"a.txt", "b.txt", "c.txt"} {
+		if err := os.WriteFile(path.Join(inputDir, name),
+			[]byte("The text of "+name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	matches, _ := GlobTexts(inputDir)
+	outputDir := t.TempDir()
+	manifest := NewRunManifest()
+	manifest.Output = path.Join(outputDir, "tokenized.chunk")
+	manifest.ContextSize = 64
+	manifest.SetTokenizer("gpt2", &gpt_bpe.GPT2Encoder)
+	manifestPath := manifest.Output + ManifestSuffix
+	// Every input is large enough to be a task of its own.
+	coordinator := NewCoordinator(manifest, manifestPath, matches, 1)
+	assert.Len(t, coordinator.tasks, 3)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := make(chan error)
+	go func() {
+		served <- coordinator.Serve(listener, time.Second)
+	}()
+	address := "tcp://" + listener.Addr().String()
+
+	health, err := QueryHealth(address)
+	assert.Nil(t, err)
+	assert.Equal(t, gpt_bpe.Version(), health.Build.GptBpeVersion)
+	assert.Equal(t, gpt_bpe.GPT2_DATA_VERSION, health.Tokenizer.DataVersion)
+	assert.Equal(t, 3, health.Tasks)
+	assert.Equal(t, 3, health.Remaining)
+
+	// Workers built with another release of gpt_bpe refuse to work.
+	coordinator.mutex.Lock()
+	manifest.Build.GptBpeVersion = "0.0.0"
+	coordinator.mutex.Unlock()
+	assert.NotNil(t, RunWorker(address, func(task TokenizeTask) TaskResult {
+		t.Error("unexpected task", task.Id)
+		return TaskResult{}
+	}))
+	coordinator.mutex.Lock()
+	manifest.Build.GptBpeVersion = gpt_bpe.Version()
+	coordinator.mutex.Unlock()
+
+	textsTokenizer := NewTextsTokenizer()
+	textsTokenizer.ContextSize = 64
+	textsTokenizer.EndOfText = "<|endoftext|>"
+	textsTokenizer.PadToken = "<|endoftext|>"
+	failed := false
+	workErr := RunWorker(address, func(task TokenizeTask) TaskResult {
+		result := TaskResult{StartedAt: time.Now()}
+		// The second task fails once, and is handed out again.
+		if task.Id == 1 && !failed {
+			failed = true
+			result.Error = "disk full"
+			return result
+		}
+		assert.Equal(t, manifest.Tokenizer.Fingerprint, task.Fingerprint)
+		result.Inputs, _ = HashInputs(task.Inputs)
+		assert.Equal(t, AttemptPath(task.Shard, task.Attempt), task.Output)
+		result.Tokens, err = TokenizeAttempt(NewTextsReader(),
+			textsTokenizer, NewContextsWriter(), task, true)
+		assert.Nil(t, err)
+		return result
+	})
+	assert.Nil(t, workErr)
+	assert.True(t, failed)
+
+	// Late workers are told that the run is done.
+	assert.Nil(t, RunWorker(address, func(task TokenizeTask) TaskResult {
+		t.Error("unexpected task", task.Id)
+		return TaskResult{}
+	}))
+	assert.Nil(t, <-served)
+
+	written, err := ReadRunManifest(manifestPath)
+	assert.Nil(t, err)
+	assert.Len(t, written.Shards, 3)
+	assert.Len(t, written.Inputs, 3)
+	assert.Equal(t, 3*64, written.TotalTokens)
+	assert.Equal(t, gpt_bpe.Version(), written.Build.GptBpeVersion)
+	for shardIdx, shard := range written.Shards {
+		assert.Equal(t, fmt.Sprintf("%s.%04d", manifest.Output, shardIdx),
+			shard.Path)
+		assert.Equal(t, []string{matches[shardIdx].Path}, shard.Inputs)
+		tokens, err := gpt_bpe.ReadTokensFile(shard.Path)
+		assert.Nil(t, err)
+		assert.Len(t, *tokens, 64)
+		// The document index locates documents in the shard, not in the
+		// attempt that wrote it.
+		index, err := os.ReadFile(shard.Path + DocumentIndexSuffix)
+		assert.Nil(t, err)
+		assert.Contains(t, string(index), `"shard":"`+shard.Path+`"`)
+	}
+	assert.Equal(t, manifest.Output+".0003", written.NextShardPath())
+	// Only the accepted attempts are left, moved into place.
+	attempts, _ := filepath.Glob(manifest.Output + ".*.attempt*")
+	assert.Empty(t, attempts)
+}
+
+func TestCoordinator_StaleWorker(t *testing.T) {
+	outputDir := t.TempDir()
+	manifest := NewRunManifest()
+	manifest.Output = path.Join(outputDir, "tokenized.chunk")
+	manifest.ContextSize = 64
+	manifestPath := manifest.Output + ManifestSuffix
+	coordinator := NewCoordinator(manifest, manifestPath,
+		[]PathInfo{{Path: "a.txt", Size: 1}}, 1)
+	coordinator.MaxAttempts = 2
+	// Leases expire as soon as they are handed out.
+	coordinator.TaskTimeout = 0
+	attempt := func(worker string) TokenizeTask {
+		var task TokenizeTask
+		assert.Nil(t, coordinator.NextTask(&TaskRequest{worker}, &task))
+		assert.Nil(t, os.WriteFile(task.Output, []byte(worker), 0644))
+		return task
+	}
+	report := func(worker string, task TokenizeTask, failure string) {
+		var ok bool
+		assert.Nil(t, coordinator.CompleteTask(&TaskResult{Worker: worker,
+			Id: task.Id, Attempt: task.Attempt, Error: failure}, &ok))
+	}
+
+	// The task times out on the first worker, and is assigned to another.
+	first := attempt("first")
+	coordinator.TaskTimeout = time.Hour
+	second := attempt("second")
+	assert.NotEqual(t, first.Output, second.Output)
+
+	// The first worker's late reports are ignored, as it no longer holds the
+	// task, and neither count as a failed attempt nor orphan the second.
+	report("first", first, "disk full")
+	report("first", first, "")
+	assert.Nil(t, coordinator.err)
+	assert.Equal(t, 1, coordinator.remaining)
+	var waiting TokenizeTask
+	assert.Nil(t, coordinator.NextTask(&TaskRequest{"third"}, &waiting))
+	assert.True(t, waiting.Wait)
+	_, err := os.Stat(first.Output)
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(manifest.Output + ".0000")
+	assert.True(t, os.IsNotExist(err))
+
+	// The second worker's result is accepted, and its shard moved in place.
+	report("second", second, "")
+	assert.Equal(t, 0, coordinator.remaining)
+	shard, err := os.ReadFile(second.Shard)
+	assert.Nil(t, err)
+	assert.Equal(t, "second", string(shard))
+	_, err = os.Stat(second.Output)
+	assert.True(t, os.IsNotExist(err))
+}
+
+// runNatsServer runs a NATS server with JetStream for the test, with a
+// stream of the given subject.
+func runNatsServer(t *testing.T, subject string) *server.Server {
+	natsServer, err := server.NewServer(&server.Options{
+		Host:      "127.0.0.1",
+		Port:      -1,
+		JetStream: true,
+		StoreDir:  t.TempDir(),
+		NoLog:     true,
+		NoSigs:    true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go natsServer.Start()
+	t.Cleanup(natsServer.Shutdown)
+	if !natsServer.ReadyForConnections(10 * time.Second) {
+		t.Fatal("NATS server is not ready")
+	}
+	conn, err := nats.Connect(natsServer.ClientURL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	js, err := conn.JetStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = js.AddStream(&nats.StreamConfig{Name: "documents",
+		Subjects: []string{subject}}); err != nil {
+		t.Fatal(err)
+	}
+	return natsServer
+}
+
+func TestNatsSource(t *testing.T) {
+	natsServer := runNatsServer(t, "scrapes.en")
+	conn, err := nats.Connect(natsServer.ClientURL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	js, err := conn.JetStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	publish := func(documents ...string) {
+		for _, document := range documents {
+			if _, err := js.Publish("scrapes.en",
+				[]byte(document)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	readShard := func(nextText TextsIterator) []string {
+		shard := make([]string, 0)
+		for reader := nextText(); reader != nil; reader = nextText() {
+			var text strings.Builder
+			for {
+				r, _, err := reader.ReadRune()
+				if err != nil {
+					break
+				}
+				text.WriteRune(r)
+			}
+			shard = append(shard, text.String())
+		}
+		return shard
+	}
+	address := natsServer.ClientURL() + "/scrapes.en?queue=tokenizers"
+	documents := []string{"first doc.", "second doc", "third doc."}
+	publish(documents...)
+
+	source, err := DialNats(address, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The first shard is full once it holds 20 bytes of documents.
+	assert.Equal(t, documents[:2], readShard(source.NextShard(
+		NewTextsReader(), 20, time.Minute)))
+	assert.Nil(t, source.Ack())
+	// Documents fetched before the source was stopped are still read, but
+	// the tokenizer stops before their shard is acknowledged.
+	source.Stop()
+	assert.Equal(t, documents[2:], readShard(source.NextShard(
+		NewTextsReader(), 20, time.Minute)))
+	assert.Nil(t, source.NextShard(NewTextsReader(), 20, time.Minute))
+	assert.Nil(t, source.Err())
+	source.Close()
+
+	// The consumer delivers the unacknowledged document again once its
+	// acknowledgement times out, and the acknowledged ones never.
+	source, err = DialNats(address, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publish("fourth doc")
+	assert.ElementsMatch(t, []string{"third doc.", "fourth doc"}, readShard(
+		source.NextShard(NewTextsReader(), 20, 5*time.Second)))
+	assert.Nil(t, source.Ack())
+	source.Close()
+
+	source, err = DialNats(address, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publish("fifth doc.")
+	// The shard closes before the acknowledgement times out.
+	assert.Equal(t, []string{"fifth doc."}, readShard(source.NextShard(
+		NewTextsReader(), 20, 500*time.Millisecond)))
+	assert.Nil(t, source.Ack())
+	source.Close()
+
+	_, err = DialNats(natsServer.ClientURL(), time.Second)
+	assert.NotNil(t, err)
+}
+
+func TestDocumentsDatabase(t *testing.T) {
+	for _, engine := range []string{OutputFormatSQLite, OutputFormatDuckDB} {
+		t.Run(engine, func(t *testing.T) {
+			testDocumentsDatabase(t, engine)
+		})
+	}
+	_, err := NewDocumentsDatabase("postgres")
+	assert.NotNil(t, err)
+}
+
+func testDocumentsDatabase(t *testing.T, engine string) {
+	db, err := NewDocumentsDatabase(engine)
+	if _, ok := databaseDrivers[engine]; !ok {
+		assert.NotNil(t, err)
+		t.Skip(engine + " requires a build with cgo")
+	}
+	assert.Nil(t, err)
+	inputDir := t.TempDir()
+	texts := map[string]string{
+		"a.txt": "It's the first document.\n\nThe second one.",
+		"b.txt": "The third document.",
+	}
+	for name, text := range texts {
+		assert.Nil(t, os.WriteFile(path.Join(inputDir, name), []byte(text),
+			0644))
+	}
+	matches, _ := GlobTexts(inputDir)
+	textsReader := NewTextsReader()
+	textsReader.Splitter, _ = NewDocumentSplitter("\n\n", 0)
+	dbPath := path.Join(t.TempDir(), "documents.db")
+	assert.Nil(t, db.Write(textsReader, &gpt_bpe.GPT2Encoder, matches,
+		dbPath, map[string]string{"tokenizer": "gpt2's"}))
+	assert.Equal(t, 3, db.Documents)
+
+	query := func(query string, values ...interface{}) {
+		conn, err := sql.Open(databaseDrivers[engine], dbPath)
+		if !assert.Nil(t, err) {
+			return
+		}
+		defer conn.Close()
+		assert.Nil(t, conn.QueryRow(query).Scan(values...), query)
+	}
+	var count, tokenCount int
+	query("SELECT count(*), sum(token_count) FROM documents", &count,
+		&tokenCount)
+	assert.Equal(t, 3, count)
+	assert.Equal(t, db.Tokens, tokenCount)
+	var text, source string
+	var tokensBlob []byte
+	query("SELECT text, source, tokens FROM documents WHERE id = 0", &text,
+		&source, &tokensBlob)
+	assert.Equal(t, "It's the first document.", text)
+	assert.True(t, strings.HasSuffix(source, "a.txt"))
+	bin, err := gpt_bpe.GPT2Encoder.Encode(&text).ToBin()
+	assert.Nil(t, err)
+	assert.Equal(t, *bin, tokensBlob)
+	var index string
+	if engine == OutputFormatSQLite {
+		query("SELECT name FROM sqlite_master WHERE type = 'index' "+
+			"AND tbl_name = 'documents' AND name NOT LIKE 'sqlite_%'",
+			&index)
+	} else {
+		query("SELECT index_name FROM duckdb_indexes() "+
+			"WHERE table_name = 'documents'", &index)
+	}
+	assert.Equal(t, "documents_source", index)
+	var tokenizer string
+	query("SELECT value FROM metadata WHERE key = 'tokenizer'", &tokenizer)
+	assert.Equal(t, "gpt2's", tokenizer)
+
+	// Writing again replaces the database.
+	assert.Nil(t, db.Write(textsReader, &gpt_bpe.GPT2Encoder, matches[:1],
+		dbPath, nil))
+	query("SELECT count(*) FROM documents", &count)
+	assert.Equal(t, 2, count)
+}
+
+func TestDocumentsJSONL(t *testing.T) {
+	inputDir := t.TempDir()
+	texts := map[string]string{
+		"a.txt": "It's the first document.\n\nThe \"second\" one.",
+		"b.txt": "The third document.",
+	}
+	for name, text := range texts {
+		assert.Nil(t, os.WriteFile(path.Join(inputDir, name), []byte(text),
+			0644))
+	}
+	matches, _ := GlobTexts(inputDir)
+	textsReader := NewTextsReader()
+	textsReader.Splitter, _ = NewDocumentSplitter("\n\n", 0)
+	jsonlPath := path.Join(t.TempDir(), "documents.jsonl")
+
+	jsonl := &DocumentsJSONL{}
+	assert.Nil(t, jsonl.Write(textsReader, &gpt_bpe.GPT2Encoder, matches,
+		jsonlPath))
+	assert.Equal(t, 3, jsonl.Documents)
+	lines, err := os.ReadFile(jsonlPath)
+	assert.Nil(t, err)
+	first := "It's the first document."
+	var tokens gpt_bpe.Tokens
+	assert.Nil(t, json.Unmarshal(bytes.Split(lines, []byte("\n"))[0],
+		&tokens))
+	assert.Equal(t, *gpt_bpe.GPT2Encoder.Encode(&first), tokens)
+
+	jsonl.Fields, err = ParseJSONLFields("source, id,text,token_count,id")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"source", "id", "text", "token_count"},
+		jsonl.Fields)
+	assert.Nil(t, jsonl.Write(textsReader, &gpt_bpe.GPT2Encoder, matches,
+		jsonlPath))
+	lines, err = os.ReadFile(jsonlPath)
+	assert.Nil(t, err)
+	split := bytes.Split(bytes.TrimSpace(lines), []byte("\n"))
+	assert.Len(t, split, 3)
+	second := string(split[1])
+	assert.True(t, strings.HasPrefix(second, `{"source":"`), second)
+	var document struct {
+		Id         int            `json:"id"`
+		Text       string         `json:"text"`
+		TokenCount int            `json:"token_count"`
+		Tokens     gpt_bpe.Tokens `json:"tokens"`
+	}
+	assert.Nil(t, json.Unmarshal(split[1], &document))
+	assert.Equal(t, 1, document.Id)
+	assert.Equal(t, "The \"second\" one.", document.Text)
+	assert.Equal(t, len(document.Tokens), document.TokenCount)
+	assert.Equal(t, *gpt_bpe.GPT2Encoder.Encode(&document.Text),
+		document.Tokens)
+
+	_, err = ParseJSONLFields("id,label")
+	assert.NotNil(t, err)
+}
+
+// queryParquet runs a query with DuckDB's Parquet reader, formatted with the
+// quoted parquetPath, and returns the values of its rows.
+func queryParquet(t *testing.T, parquetPath string,
+	query string) [][]interface{} {
+	conn, err := sql.Open(databaseDrivers[OutputFormatDuckDB], "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	rows, err := conn.Query(fmt.Sprintf(query, "'"+parquetPath+"'"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	columns, err := rows.Columns()
+	if err != nil {
+		t.Fatal(err)
+	}
+	results := make([][]interface{}, 0)
+	for rows.Next() {
+		values := make([]interface{}, len(columns))
+		pointers := make([]interface{}, len(columns))
+		for idx := range values {
+			pointers[idx] = &values[idx]
+		}
+		if err := rows.Scan(pointers...); err != nil {
+			t.Fatal(err)
+		}
+		results = append(results, values)
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return results
+}
+
+// parquetList returns values as they are read from a Parquet list column.
+func parquetList[T int32 | int64](values ...T) []interface{} {
+	list := make([]interface{}, len(values))
+	for idx, value := range values {
+		list[idx] = value
+	}
+	return list
+}
+
+func TestParquetWriter(t *testing.T) {
+	outPath := path.Join(t.TempDir(), "rows.parquet")
+	file, err := os.Create(outPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pw, err := NewParquetWriter(file, []ParquetColumn{
+		{Name: "id", Type: ParquetInt64},
+		{Name: "values", Type: ParquetInt32, List: true}})
+	assert.Nil(t, err)
+	// Every second row starts a new row group.
+	pw.RowGroupSize = 16
+	pw.Metadata["origin"] = "test"
+	assert.Nil(t, pw.WriteRow([]int64{1}, []int64{1, 2}))
+	assert.Nil(t, pw.WriteRow([]int64{2}, []int64{}))
+	assert.Nil(t, pw.WriteRow([]int64{3}, []int64{-3}))
+	assert.NotNil(t, pw.WriteRow([]int64{4}))
+	assert.NotNil(t, pw.WriteRow([]int64{4, 5}, []int64{}))
+	assert.Nil(t, pw.Close())
+	assert.Nil(t, file.Close())
+
+	assert.Equal(t, [][]interface{}{
+		{int64(1), parquetList[int32](1, 2)},
+		{int64(2), parquetList[int32]()},
+		{int64(3), parquetList[int32](-3)},
+	}, queryParquet(t, outPath, "SELECT * FROM read_parquet(%s)"))
+	assert.Equal(t, [][]interface{}{{int64(2)}}, queryParquet(t, outPath,
+		"SELECT count(DISTINCT row_group_id) FROM parquet_metadata(%s)"))
+	assert.Equal(t, [][]interface{}{{"origin", "test"}}, queryParquet(t,
+		outPath, "SELECT decode(key), decode(value) "+
+			"FROM parquet_kv_metadata(%s)"))
+
+	_, err = NewParquetWriter(io.Discard, []ParquetColumn{
+		{Name: "text", Type: 6}})
+	assert.NotNil(t, err)
+}
+
+func TestContextsWriter_HuggingFace(t *testing.T) {
+	contexts := []gpt_bpe.Tokens{
+		{10, 11, 12, 50256},
+		{13, 50256, 50256, 50256},
+		{14, 15, 16, 17},
+	}
+	contextIdx := 0
+	nextContext := func() *gpt_bpe.Tokens {
+		if contextIdx == len(contexts) {
+			return nil
+		}
+		contextIdx++
+		return &contexts[contextIdx-1]
+	}
+	contextsWriter := NewContextsWriter()
+	contextsWriter.Format = OutputFormatHuggingFace
+	contextsWriter.AttentionMask = true
+	contextsWriter.Labels = true
+	contextsWriter.PadToken = 50256
+	contextsWriter.EndOfText = 50256
+	outPath := path.Join(t.TempDir(), "train.parquet")
+	total, err := contextsWriter.WriteContexts(outPath, nextContext)
+	assert.Nil(t, err)
+	assert.Equal(t, 12, total)
+
+	names := make([]string, 0)
+	for _, row := range queryParquet(t, outPath,
+		"SELECT name FROM parquet_schema(%s)") {
+		names = append(names, row[0].(string))
+	}
+	assert.Equal(t, []string{"schema", "input_ids", "list", "element",
+		"attention_mask", "list", "element", "labels", "list", "element"},
+		names)
+	keyValues := queryParquet(t, outPath, "SELECT decode(key), "+
+		"decode(value) FROM parquet_kv_metadata(%s)")
+	assert.Len(t, keyValues, 1)
+	assert.Equal(t, "huggingface", keyValues[0][0])
+	assert.Contains(t, keyValues[0][1], `"input_ids":{"_type":"Sequence"`)
+
+	assert.Equal(t, [][]interface{}{
+		{parquetList[int32](10, 11, 12, 50256),
+			parquetList[int32](1, 1, 1, 1),
+			parquetList[int32](10, 11, 12, 50256)},
+		{parquetList[int32](13, 50256, 50256, 50256),
+			parquetList[int32](1, 1, 0, 0),
+			parquetList[int32](13, 50256, -100, -100)},
+		{parquetList[int32](14, 15, 16, 17),
+			parquetList[int32](1, 1, 1, 1),
+			parquetList[int32](14, 15, 16, 17)},
+	}, queryParquet(t, outPath, "SELECT input_ids, attention_mask, labels "+
+		"FROM read_parquet(%s)"))
+}
+
+// readTFRecords returns the records of a TFRecord file, checking the CRCs
+// of each.
+func readTFRecords(t *testing.T, data []byte) [][]byte {
+	records := make([][]byte, 0)
+	for len(data) > 0 {
+		length := binary.LittleEndian.Uint64(data)
+		assert.Equal(t, maskedCrc(data[:8]),
+			binary.LittleEndian.Uint32(data[8:]))
+		record := data[12 : 12+length]
+		assert.Equal(t, maskedCrc(record),
+			binary.LittleEndian.Uint32(data[12+length:]))
+		records = append(records, record)
+		data = data[16+length:]
+	}
+	return records
+}
+
+// readProtoBytes returns the length delimited fields of a protocol buffers
+// message, in order.
+func readProtoBytes(message []byte) [][]byte {
+	fields := make([][]byte, 0)
+	for len(message) > 0 {
+		_, n := binary.Uvarint(message)
+		length, m := binary.Uvarint(message[n:])
+		fields = append(fields, message[n+m:n+m+int(length)])
+		message = message[n+m+int(length):]
+	}
+	return fields
+}
+
+func TestContextsWriter_TFRecord(t *testing.T) {
+	features, err := ParseTFRecordFeatures("input_ids=inputs,labels")
+	assert.Nil(t, err)
+	assert.Equal(t, []TFRecordFeature{{ColumnInputIds, "inputs"},
+		{ColumnLabels, ColumnLabels}}, features)
+	for _, invalid := range []string{"labels", "input_ids,tokens",
+		"input_ids,input_ids=x", "input_ids=,labels"} {
+		_, err = ParseTFRecordFeatures(invalid)
+		assert.NotNil(t, err, invalid)
+	}
+
+	contexts := []gpt_bpe.Tokens{{10, 11, 50256, 50256}, {12, 13, 14, 15}}
+	for _, compression := range []string{CompressionNone, CompressionGzip} {
+		contextIdx := 0
+		nextContext := func() *gpt_bpe.Tokens {
+			if contextIdx == len(contexts) {
+				return nil
+			}
+			contextIdx++
+			return &contexts[contextIdx-1]
+		}
+		contextsWriter := NewContextsWriter()
+		contextsWriter.Format = OutputFormatTFRecord
+		contextsWriter.Compression = compression
+		contextsWriter.TFRecordFeatures = features
+		contextsWriter.PadToken = 50256
+		contextsWriter.EndOfText = 50256
+		outPath := path.Join(t.TempDir(), "train.tfrecord")
+		total, err := contextsWriter.WriteContexts(outPath, nextContext)
+		assert.Nil(t, err)
+		assert.Equal(t, 8, total)
+
+		data, err := os.ReadFile(outPath)
+		assert.Nil(t, err)
+		if compression == CompressionGzip {
+			reader, err := gzip.NewReader(bytes.NewReader(data))
+			assert.Nil(t, err)
+			data, err = io.ReadAll(reader)
+			assert.Nil(t, err)
+		}
+		records := readTFRecords(t, data)
+		assert.Len(t, records, 2)
+
+		// Each record is an Example of Features of a map entry for each
+		// feature, of its name and its Int64List.
+		entries := readProtoBytes(readProtoBytes(records[0])[0])
+		assert.Len(t, entries, 2)
+		expected := map[string][]int64{
+			"inputs": {10, 11, 50256, 50256},
+			"labels": {10, 11, 50256, -100},
+		}
+		for _, entry := range entries {
+			fields := readProtoBytes(entry)
+			packed := readProtoBytes(readProtoBytes(fields[1])[0])[0]
+			values := make([]int64, 0)
+			for len(packed) > 0 {
+				value, n := binary.Uvarint(packed)
+				values = append(values, int64(value))
+				packed = packed[n:]
+			}
+			assert.Equal(t, expected[string(fields[0])], values)
+		}
+	}
+}
+func TestOutputTemplate(t *testing.T) {
+	date := time.Date(2024, 3, 9, 23, 0, 0, 0, time.FixedZone("", -3600))
+	template, err := NewOutputTemplate(
+		"out/{tokenizer}-{date}-{shard:05d}.chunk",
+		"EleutherAI/gpt-neox 20b", date)
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.True(t, template.IsTemplate())
+	assert.True(t, template.HasDate())
+	output := template.Output()
+	assert.Equal(t, "out/EleutherAI_gpt-neox_20b-2024-03-10-{shard:05d}.chunk",
+		output)
+	assert.Equal(t, "out/EleutherAI_gpt-neox_20b-2024-03-10-00012.chunk",
+		ShardPath(output, 12))
+	assert.Equal(t, ShardPath(output, 0), SingleOutputPath(output))
+	assert.Equal(t, "out/EleutherAI_gpt-neox_20b-2024-03-10-.chunk"+
+		ManifestSuffix, OutputManifestPath(output))
+	assert.Equal(t, "a-7.chunk", ShardPath("a-{shard}.chunk", 7))
+
+	// Outputs without placeholders keep their fixed names.
+	plain, err := NewOutputTemplate("tokenized.chunk", "gpt2", date)
+	assert.Nil(t, err)
+	assert.False(t, plain.IsTemplate())
+	assert.Equal(t, "tokenized.chunk", SingleOutputPath(plain.Output()))
+	assert.Equal(t, "tokenized.chunk.0003", ShardPath(plain.Output(), 3))
+	assert.Equal(t, "tokenized.chunk"+ManifestSuffix,
+		OutputManifestPath(plain.Output()))
+
+	for _, invalid := range []string{"{shard}-{shard}", "{tokenizer:05d}",
+		"{name}.chunk", "out{"} {
+		_, err = NewOutputTemplate(invalid, "gpt2", date)
+		assert.NotNil(t, err, invalid)
+	}
+
+	// Tokenizer ids that sanitize alike collide on their output.
+	manifestPath := path.Join(t.TempDir(), "gpt2.chunk"+ManifestSuffix)
+	assert.Nil(t, CheckOutputCollision(manifestPath, "a/b"))
+	manifest := NewRunManifest()
+	manifest.Tokenizer.Id = "a/b"
+	assert.Nil(t, manifest.Write(manifestPath))
+	assert.Nil(t, CheckOutputCollision(manifestPath, "a/b"))
+	assert.NotNil(t, CheckOutputCollision(manifestPath, "a_b"))
+}
+
+func TestPackingReport(t *testing.T) {
+	report := NewPackingReport(6, 9, 0)
+	contexts := []gpt_bpe.Tokens{{1, 2, 0, 3, 9, 9}, {4, 5, 6, 7, 8, 1},
+		{0, 9, 9, 9, 9, 9}}
+	contextsWriter := NewContextsWriter()
+	contextsWriter.Report = report
+	nextContext := func() *gpt_bpe.Tokens {
+		if len(contexts) == 0 {
+			return nil
+		}
+		context := contexts[0]
+		contexts = contexts[1:]
+		return &context
+	}
+	outputDir := t.TempDir()
+	total, err := contextsWriter.WriteContexts(
+		path.Join(outputDir, "packed.chunk"), nextContext)
+	assert.Nil(t, err)
+	assert.Equal(t, 18, total)
+
+	assert.Equal(t, int64(3), report.Contexts)
+	assert.Equal(t, int64(9), report.Tokens)
+	assert.Equal(t, int64(2), report.Separators)
+	assert.Equal(t, int64(7), report.Padding)
+	assert.Equal(t, map[int]int64{1: 2, 2: 1}, report.Fragments)
+	assert.Equal(t, 0.5, report.Efficiency())
+
+	reportPath := path.Join(outputDir, "packing.json")
+	assert.Nil(t, report.Write(reportPath))
+	reportJson, err := os.ReadFile(reportPath)
+	assert.Nil(t, err)
+	var written map[string]interface{}
+	assert.Nil(t, json.Unmarshal(reportJson, &written))
+	assert.Equal(t, 0.5, written["efficiency"])
+	assert.Equal(t, float64(7), written["padding"])
+}
+
+func TestDeduplicator(t *testing.T) {
+	corpus, err := gpt_bpe.NewMockCorpus(gpt_bpe.DefaultMockCorpusOptions())
+	if !assert.Nil(t, err) {
+		return
+	}
+	documents := make([]string, 4)
+	for idx := range documents {
+		documents[idx] = corpus.Document()
+	}
+	original := strings.Join(documents, "\n\n")
+	words := strings.Fields(original)
+	// A near duplicate differs from the original by a single word.
+	words[len(words)/2] = "changed"
+	near := strings.Join(words, " ")
+	distinct := corpus.Document()
+
+	for _, mode := range []string{DedupExact, DedupMinHash, DedupSimHash} {
+		dedup, err := NewDeduplicator(mode, 0.8)
+		if !assert.Nil(t, err) {
+			continue
+		}
+		dedup.Encoder = &gpt_bpe.GPT2Encoder
+		assert.True(t, dedup.Keep(original), mode)
+		assert.False(t, dedup.Keep(original), mode)
+		assert.Equal(t, mode == DedupExact, dedup.Keep(near), mode)
+		assert.True(t, dedup.Keep(distinct), mode)
+		report := dedup.Report
+		assert.Equal(t, int64(4), report.Documents, mode)
+		assert.Equal(t, int64(1), report.Exact, mode)
+		if mode == DedupExact {
+			assert.Equal(t, int64(3), report.Kept, mode)
+			assert.Equal(t, int64(0), report.Near, mode)
+			assert.Equal(t, int64(len(original)), report.DroppedBytes, mode)
+		} else {
+			assert.Equal(t, int64(2), report.Kept, mode)
+			assert.Equal(t, int64(1), report.Near, mode)
+			assert.Equal(t, int64(len(original)+len(near)),
+				report.DroppedBytes, mode)
+		}
+		assert.Greater(t, report.DroppedTokens, int64(0), mode)
+	}
+
+	// Duplicates are dropped as documents are read.
+	textsReader := NewTextsReader()
+	textsReader.Dedup, _ = NewDeduplicator(DedupExact, 0)
+	assert.NotNil(t, textsReader.filterDocument(strings.NewReader(distinct)))
+	assert.Nil(t, textsReader.filterDocument(strings.NewReader(distinct)))
+
+	reportPath := path.Join(t.TempDir(), "dedup.json")
+	assert.Nil(t, textsReader.Dedup.Report.Write(reportPath))
+	reportJson, err := os.ReadFile(reportPath)
+	assert.Nil(t, err)
+	var written map[string]interface{}
+	assert.Nil(t, json.Unmarshal(reportJson, &written))
+	assert.Equal(t, float64(1), written["exact_duplicates"])
+
+	_, err = NewDeduplicator("fuzzy", 0.8)
+	assert.NotNil(t, err)
+	_, err = NewDeduplicator(DedupMinHash, 0)
+	assert.NotNil(t, err)
+	_, err = NewDeduplicator(DedupSimHash, 1.5)
+	assert.NotNil(t, err)
+}
+
+func TestContextPacker(t *testing.T) {
+	// Documents of 3, 6 and 2 tokens, each ending with its end of text
+	// token, 0.
+	documents := []gpt_bpe.Tokens{{1, 1, 0}, {2, 2, 2, 2, 2, 0}, {3, 0}}
+	pack := func(bestFit bool, bins int) []gpt_bpe.Tokens {
+		packer := &contextPacker{contextSize: 8, bins: bins,
+			bestFit: bestFit, padToken: 9}
+		for _, document := range documents {
+			packer.add(append(gpt_bpe.Tokens{}, document...))
+		}
+		packer.flush()
+		return packer.closed
+	}
+	// First-fit packs the last document into the first context with room,
+	// while best-fit packs it into the one that it fills.
+	assert.Equal(t, []gpt_bpe.Tokens{{1, 1, 0, 3, 0, 9, 9, 9},
+		{2, 2, 2, 2, 2, 0, 9, 9}}, pack(false, 4))
+	assert.Equal(t, []gpt_bpe.Tokens{{2, 2, 2, 2, 2, 0, 3, 0},
+		{1, 1, 0, 9, 9, 9, 9, 9}}, pack(true, 4))
+	// With a single open context, the first is closed to make room.
+	assert.Equal(t, []gpt_bpe.Tokens{{1, 1, 0, 9, 9, 9, 9, 9},
+		{2, 2, 2, 2, 2, 0, 3, 0}}, pack(false, 1))
+
+	contextsWriter := NewContextsWriter()
+	contextsWriter.PadToken = 9
+	contextsWriter.EndOfText = 0
+	assert.Equal(t, []int64{1, 1, 1, 2, 2, 0, 0, 0},
+		contextsWriter.contextColumn(gpt_bpe.Tokens{1, 1, 0, 3, 0, 9, 9, 9},
+			ColumnSegmentIds))
+	assert.Equal(t, []int64{1, 1, 1, 1, 1, 1, 1, 1},
+		contextsWriter.contextColumn(gpt_bpe.Tokens{2, 2, 2, 2, 2, 2, 2, 2},
+			ColumnSegmentIds))
+
+	assert.Nil(t, CheckPacking(PackingNone, 0))
+	assert.Nil(t, CheckPacking(PackingBestFit, 1))
+	assert.NotNil(t, CheckPacking(PackingFirstFit, 0))
+	assert.NotNil(t, CheckPacking("next_fit", 1))
+}
+
+func TestPackTexts(t *testing.T) {
+	textsTokenizer := NewTextsTokenizer()
+	textsTokenizer.ContextSize = 16
+	textsTokenizer.TokenizerId = "gpt2"
+	textsTokenizer.EndOfText = "<|endoftext|>"
+	textsTokenizer.PadToken = "_"
+	textsTokenizer.Packing = PackingBestFit
+	textsTokenizer.PackingBins = 4
+	tokenizer, err := textsTokenizer.InitTokenizer()
+	if !assert.Nil(t, err) {
+		return
+	}
+	padToken, endOfText, err := textsTokenizer.SpecialTokens()
+	if !assert.Nil(t, err) {
+		return
+	}
+	documents := []string{"A short document.",
+		"The quick brown fox jumps over the lazy dog, again and again, " +
+			"until it is longer than a context.",
+		"Another one.", "Hello world!", "The end of the documents."}
+
+	contexts, err := textsTokenizer.TokenizeTexts(textsIterator(documents))
+	if !assert.Nil(t, err) {
+		return
+	}
+	contextsWriter := NewContextsWriter()
+	contextsWriter.SegmentIds = true
+	contextsWriter.PadToken = padToken
+	contextsWriter.EndOfText = endOfText
+	outPath := path.Join(t.TempDir(), "packed.chunk")
+	total, err := contextsWriter.WriteContexts(outPath, contexts)
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.Equal(t, 0, total%16)
+
+	// Every document is whole within a context, except the long one,
+	// which is split into full contexts of its own.
+	contextsBin, err := os.ReadFile(outPath)
+	assert.Nil(t, err)
+	written := *gpt_bpe.TokensFromBin(&contextsBin)
+	assert.Len(t, written, total)
+	packed := make([]string, 0)
+	pieces := ""
+	for begin := 0; begin < len(written); begin += 16 {
+		context := written[begin : begin+16]
+		text := tokenizer.Decode(&context)
+		if !strings.Contains(text, "<|endoftext|>") {
+			pieces += text
+			continue
+		}
+		for _, segment := range strings.Split(text, "<|endoftext|>") {
+			if segment = strings.TrimRight(segment, "_"); segment != "" {
+				packed = append(packed, segment)
+			}
+		}
+	}
+	assert.NotEmpty(t, pieces)
+	assert.True(t, strings.HasPrefix(documents[1], pieces))
+	assert.ElementsMatch(t, []string{documents[0],
+		strings.TrimPrefix(documents[1], pieces), documents[2],
+		documents[3], documents[4]}, packed)
+
+	// The segment ids are written with the same layout as the contexts.
+	segmentsBin, err := os.ReadFile(outPath + SegmentIdsSuffix)
+	assert.Nil(t, err)
+	assert.Len(t, segmentsBin, len(contextsBin))
+	segments := *gpt_bpe.TokensFromBin(&segmentsBin)
+	for idx, token := range written {
+		if token == padToken {
+			assert.Equal(t, gpt_bpe.Token(0), segments[idx])
+		} else {
+			assert.NotEqual(t, gpt_bpe.Token(0), segments[idx])
+		}
+	}
+
+	// A document index cannot map packed contexts.
+	textsTokenizer.DocumentIndex = NewDocumentIndex(outPath)
+	_, err = textsTokenizer.TokenizeTexts(textsIterator(documents))
+	assert.NotNil(t, err)
+}
+
+func TestLossMask(t *testing.T) {
+	inputDir := t.TempDir()
+	lines := `{"prompt": "Question: what is two and two?\n", "completion": "Four."}
+{"prompt": "Say hello.\n"}
+{"prompt": "Translate: chat\n", "completion": "cat"}
+`
+	assert.Nil(t, os.WriteFile(path.Join(inputDir, "a.jsonl"),
+		[]byte(lines), 0644))
+	textsReader := NewTextsReader()
+	textsReader.Format = InputFormatJSONL
+	textsReader.JSONL = &JSONLInput{PromptField: DefaultJSONLPromptField,
+		CompletionField: DefaultJSONLCompletionField}
+	nextText, err := textsReader.ReadTexts(inputDir)
+	if !assert.Nil(t, err) {
+		return
+	}
+	textsTokenizer := NewTextsTokenizer()
+	textsTokenizer.ContextSize = 8
+	textsTokenizer.TokenizerId = "gpt2"
+	textsTokenizer.EndOfText = "<|endoftext|>"
+	textsTokenizer.PadToken = "_"
+	textsTokenizer.Boundary = ""
+	textsTokenizer.BoundaryOverlap = 8
+	textsTokenizer.LossMasks = &LossMasks{}
+	tokenizer, err := textsTokenizer.InitTokenizer()
+	if !assert.Nil(t, err) {
+		return
+	}
+	padToken, endOfText, err := textsTokenizer.SpecialTokens()
+	if !assert.Nil(t, err) {
+		return
+	}
+	contexts, err := textsTokenizer.TokenizeTexts(nextText)
+	if !assert.Nil(t, err) {
+		return
+	}
+	contextsWriter := NewContextsWriter()
+	contextsWriter.LossMasks = textsTokenizer.LossMasks
+	contextsWriter.PadToken = padToken
+	contextsWriter.EndOfText = endOfText
+	outPath := path.Join(t.TempDir(), "masked.chunk")
+	total, err := contextsWriter.WriteContexts(outPath, contexts)
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.Equal(t, 1, textsReader.JSONL.Skipped)
+
+	// The loss masks are written with the same layout as the contexts, and
+	// only the completions and their end of text tokens are trained on.
+	contextsBin, err := os.ReadFile(outPath)
+	assert.Nil(t, err)
+	written := *gpt_bpe.TokensFromBin(&contextsBin)
+	assert.Len(t, written, total)
+	masksBin, err := os.ReadFile(outPath + LossMaskSuffix)
+	assert.Nil(t, err)
+	assert.Len(t, masksBin, len(contextsBin))
+	masks := *gpt_bpe.TokensFromBin(&masksBin)
+	var prompts, completions gpt_bpe.Tokens
+	for idx, token := range written {
+		if masks[idx] == 1 {
+			completions = append(completions, token)
+		} else if token != padToken {
+			prompts = append(prompts, token)
+		}
+	}
+	assert.Equal(t, "Question: what is two and two?\nTranslate: chat\n",
+		tokenizer.Decode(&prompts))
+	assert.Equal(t, "Four.<|endoftext|>cat<|endoftext|>",
+		tokenizer.Decode(&completions))
+	assert.Empty(t, textsTokenizer.LossMasks.pending)
+}
+
+func TestEpochPlan(t *testing.T) {
+	matches := []PathInfo{
+		{Path: "a.txt", Size: 400},
+		{Path: "b.txt", Size: 200},
+		{Path: "c.txt", Size: 100},
+	}
+	// Without a budget, each epoch traverses every input once, reshuffled.
+	plan, err := NewEpochPlan(matches, "out-{shard}.chunk", 3, 0, 4, 1)
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.Equal(t, int64(175), plan.InputTokens)
+	orders := make(map[string]bool)
+	for idx, epoch := range plan.Epochs {
+		assert.Equal(t, fmt.Sprintf("out-%d.chunk", idx), epoch.Shard)
+		assert.Equal(t, map[string]int{"a.txt": 1, "b.txt": 1, "c.txt": 1},
+			epoch.Traversals)
+		order := ""
+		for _, input := range epoch.Inputs {
+			order += input.Path
+		}
+		orders[order] = true
+	}
+	assert.Greater(t, len(orders), 1)
+
+	// A budget of 900 tokens over 2 epochs traverses every input twice in
+	// each, and then some of them until the share of 450 is met.
+	plan, err = NewEpochPlan(matches, "out.chunk", 2, 900, 4, 1)
+	if !assert.Nil(t, err) {
+		return
+	}
+	for _, epoch := range plan.Epochs {
+		assert.GreaterOrEqual(t, epoch.Tokens, int64(450))
+		assert.Less(t, epoch.Tokens, int64(450+100))
+		for _, path := range []string{"a.txt", "b.txt", "c.txt"} {
+			assert.GreaterOrEqual(t, epoch.Traversals[path], 2)
+		}
+	}
+	assert.Equal(t, "out.chunk.0001", plan.Epochs[1].Shard)
+
+	// Plans are reproducible from their seed.
+	replan, err := NewEpochPlan(matches, "out.chunk", 2, 900, 4, 1)
+	assert.Nil(t, err)
+	assert.Equal(t, plan.Epochs, replan.Epochs)
+
+	_, err = NewEpochPlan(matches, "out.chunk", 0, 0, 4, 1)
+	assert.NotNil(t, err)
+	_, err = NewEpochPlan(nil, "out.chunk", 1, 100, 4, 1)
+	assert.NotNil(t, err)
+	assert.Equal(t, "out.chunk"+EpochPlanSuffix,
+		EpochPlanPath("out.chunk"+ManifestSuffix))
+}
+
+func TestCurriculum(t *testing.T) {
+	inputPath := t.TempDir()
+	for name, text := range map[string]string{
+		"a.txt": "a medium document\fthe longest document of them all\f" +
+			"short",
+		"b.txt": "tiny\fanother medium one",
+	} {
+		if err := os.WriteFile(path.Join(inputPath, name), []byte(text),
+			0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	splitter, _ := NewDocumentSplitter("\f", 0)
+	textsReader := NewTextsReader()
+	textsReader.Splitter = splitter
+	var err error
+	textsReader.Curriculum, err = ParseCurriculum("length", "")
+	if !assert.Nil(t, err) {
+		return
+	}
+	nextText, err := textsReader.ReadTexts(inputPath)
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.Equal(t, []string{"tiny", "short", "a medium document",
+		"another medium one", "the longest document of them all"},
+		readAllTexts(nextText))
+
+	// External scores order the documents by their input, keeping the order
+	// that each input's documents were read in.
+	scoresPath := path.Join(t.TempDir(), "scores.tsv")
+	if err := os.WriteFile(scoresPath, []byte(path.Join(inputPath,
+		"b.txt")+"\t0.5\n"+path.Join(inputPath, "a.txt")+"\t2\n"),
+		0644); err != nil {
+		t.Fatal(err)
+	}
+	textsReader.Curriculum, err = ParseCurriculum(CurriculumScores,
+		scoresPath)
+	if !assert.Nil(t, err) {
+		return
+	}
+	nextText, err = textsReader.ReadTexts(inputPath)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"tiny", "another medium one",
+		"a medium document", "the longest document of them all", "short"},
+		readAllTexts(nextText))
+
+	_, err = ParseCurriculum("difficulty", "")
+	assert.NotNil(t, err)
+	_, err = ParseCurriculum("length", scoresPath)
+	assert.NotNil(t, err)
+	_, err = ParseCurriculum(CurriculumScores, "")
+	assert.NotNil(t, err)
+	curriculum, err := ParseCurriculum("symbol_ratio", "")
+	assert.Nil(t, err)
+	assert.Equal(t, "symbol_ratio", curriculum.Name)
+}
+
+func TestRoutedTexts(t *testing.T) {
+	router, err := dataset.NewRouter([]dataset.RouteSplit{
+		{Name: "train", Weight: 3}, {Name: "validation", Weight: 1}}, 2)
+	if !assert.Nil(t, err) {
+		return
+	}
+	documents := make([]string, 40)
+	for idx := range documents {
+		documents[idx] = fmt.Sprintf("document %d", idx)
+	}
+	// Every document is read from exactly the shard of its route.
+	routed := 0
+	for _, route := range router.Routes() {
+		nextText := RoutedTexts(textsIterator(documents), router, route)
+		for _, document := range readAllTexts(nextText) {
+			assert.Equal(t, route, router.Route([]byte(document)))
+			routed++
+		}
+	}
+	assert.Equal(t, len(documents), routed)
+
+	assert.Equal(t, "tokenized.chunk.validation.0001",
+		RoutePath("tokenized.chunk", dataset.Route{Split: "validation",
+			Shard: 1}))
+	assert.Equal(t, "out-train-00002.chunk", RoutePath(
+		"out-{shard:05d}.chunk", dataset.Route{Split: "train", Shard: 2}))
+	assert.Equal(t, "out-2.chunk", RoutePath("out-{shard}.chunk",
+		dataset.Route{Shard: 2}))
+}
+
+func TestDocumentsParquet(t *testing.T) {
+	inputDir := t.TempDir()
+	assert.Nil(t, os.WriteFile(path.Join(inputDir, "a.txt"),
+		[]byte("The first document.\n\nThe second one.\n\nA third."), 0644))
+	matches, _ := GlobTexts(inputDir)
+	textsReader := NewTextsReader()
+	textsReader.Splitter, _ = NewDocumentSplitter("\n\n", 0)
+	outPath := path.Join(t.TempDir(), "documents.parquet")
+	documents := &DocumentsParquet{}
+	assert.Nil(t, documents.Write(textsReader, &gpt_bpe.GPT2Encoder, matches,
+		outPath, map[string]string{"tokenizer": "gpt2"}))
+	assert.Equal(t, 3, documents.Documents)
+	lengths := make([]int64, 0)
+	for _, text := range []string{"The first document.", "The second one.",
+		"A third."} {
+		lengths = append(lengths, int64(len(*gpt_bpe.GPT2Encoder.Encode(
+			&text))))
+	}
+	assert.Equal(t, int(lengths[0]+lengths[1]+lengths[2]), documents.Tokens)
+
+	names := make([]string, 0)
+	for _, row := range queryParquet(t, outPath,
+		"SELECT name FROM parquet_schema(%s)") {
+		names = append(names, row[0].(string))
+	}
+	assert.Equal(t, []string{"schema", "doc_id", "tokens", "list", "element",
+		"length"}, names)
+	assert.Equal(t, [][]interface{}{{"tokenizer", "gpt2"}}, queryParquet(t,
+		outPath, "SELECT decode(key), decode(value) "+
+			"FROM parquet_kv_metadata(%s)"))
+
+	rows := queryParquet(t, outPath,
+		"SELECT doc_id, tokens, length FROM read_parquet(%s)")
+	assert.Len(t, rows, 3)
+	for idx, text := range []string{"The first document.",
+		"The second one.", "A third."} {
+		tokens := make([]int32, 0)
+		for _, token := range *gpt_bpe.GPT2Encoder.Encode(&text) {
+			tokens = append(tokens, int32(token))
+		}
+		assert.Equal(t, []interface{}{int64(idx), parquetList(tokens...),
+			lengths[idx]}, rows[idx])
+	}
+}
+
+func TestDocumentsMegatron(t *testing.T) {
+	inputDir := t.TempDir()
+	assert.Nil(t, os.WriteFile(path.Join(inputDir, "a.txt"),
+		[]byte("The first document.\n\nThe second one.\n\nA third."), 0644))
+	matches, _ := GlobTexts(inputDir)
+	textsReader := NewTextsReader()
+	textsReader.Splitter, _ = NewDocumentSplitter("\n\n", 0)
+	prefix := MegatronPrefix(path.Join(t.TempDir(), "documents.bin"))
+	expected := gpt_bpe.Tokens{}
+	sizes := make([]int32, 0)
+	for _, text := range []string{"The first document.", "The second one.",
+		"A third."} {
+		tokens := *gpt_bpe.GPT2Encoder.Encode(&text)
+		expected = append(expected, tokens...)
+		sizes = append(sizes, int32(len(tokens)))
+	}
+	for _, dtype := range []string{"uint16", "int32"} {
+		megatronDtype, err := ParseMegatronDtype(dtype)
+		assert.Nil(t, err)
+		megatron := &DocumentsMegatron{Dtype: megatronDtype}
+		assert.Nil(t, megatron.Write(textsReader, &gpt_bpe.GPT2Encoder,
+			matches, prefix))
+		assert.Equal(t, 3, megatron.Documents)
+		assert.Equal(t, len(expected), megatron.Tokens)
+
+		data, err := os.ReadFile(prefix + MegatronBinSuffix)
+		assert.Nil(t, err)
+		tokens, err := gpt_bpe.UnmarshalTokens(data, megatronDtype)
+		assert.Nil(t, err)
+		assert.Equal(t, expected, tokens)
+
+		// The index holds the size and byte offset of each document, and
+		// the boundaries of the documents.
+		index, err := os.Open(prefix + MegatronIdxSuffix)
+		assert.Nil(t, err)
+		var header struct {
+			Magic     [9]byte
+			Version   uint64
+			Code      uint8
+			Sequences uint64
+			Documents uint64
+		}
+		assert.Nil(t, binary.Read(index, binary.LittleEndian, &header))
+		assert.Equal(t, "MMIDIDX\x00\x00", string(header.Magic[:]))
+		assert.Equal(t, uint64(1), header.Version)
+		assert.Equal(t, map[string]uint8{"uint16": 8, "int32": 4}[dtype],
+			header.Code)
+		assert.Equal(t, uint64(3), header.Sequences)
+		assert.Equal(t, uint64(4), header.Documents)
+		indexSizes := make([]int32, 3)
+		pointers := make([]int64, 3)
+		documents := make([]int64, 4)
+		assert.Nil(t, binary.Read(index, binary.LittleEndian, indexSizes))
+		assert.Nil(t, binary.Read(index, binary.LittleEndian, pointers))
+		assert.Nil(t, binary.Read(index, binary.LittleEndian, documents))
+		index.Close()
+		assert.Equal(t, sizes, indexSizes)
+		itemSize := int64(len(data) / len(expected))
+		assert.Equal(t, []int64{0, int64(sizes[0]) * itemSize,
+			int64(sizes[0]+sizes[1]) * itemSize}, pointers)
+		assert.Equal(t, []int64{0, 1, 2, 3}, documents)
+	}
+	_, err := ParseMegatronDtype("float32")
+	assert.NotNil(t, err)
+}
+
+func TestDocumentShuffler(t *testing.T) {
+	documents := make([]string, 100)
+	for idx := range documents {
+		documents[idx] = fmt.Sprintf("document %d", idx)
+	}
+	iterate := func() TextsIterator {
+		idx := 0
+		return func() io.RuneReader {
+			if idx == len(documents) {
+				return nil
+			}
+			idx++
+			return withMetadata(strings.NewReader(documents[idx-1]),
+				map[string]interface{}{"id": documents[idx-1]})
+		}
+	}
+	shuffle := func(shuffler *DocumentShuffler) []string {
+		nextText, err := shuffler.Shuffle(iterate())
+		if !assert.Nil(t, err) {
+			return nil
+		}
+		shuffled := make([]string, 0, len(documents))
+		for reader := nextText(); reader != nil; reader = nextText() {
+			metadata := readerMetadata(reader)
+			document := readDocument(reader)
+			assert.Equal(t, document, metadata["id"])
+			shuffled = append(shuffled, document)
+		}
+		return shuffled
+	}
+
+	// Documents that fit in memory, and those that are spilled to spool
+	// files of a few documents each, are all shuffled reproducibly.
+	dir := t.TempDir()
+	for _, memory := range []int{1024 * 1024, 64} {
+		shuffler, err := NewDocumentShuffler(42, memory, dir)
+		if !assert.Nil(t, err) {
+			continue
+		}
+		shuffled := shuffle(shuffler)
+		assert.ElementsMatch(t, documents, shuffled)
+		assert.NotEqual(t, documents, shuffled)
+		assert.Equal(t, shuffled, shuffle(shuffler))
+		shuffler.Seed = 7
+		assert.NotEqual(t, shuffled, shuffle(shuffler))
+	}
+	// The spool files are removed once the documents are read.
+	spools, err := os.ReadDir(dir)
+	assert.Nil(t, err)
+	assert.Empty(t, spools)
+
+	_, err = NewDocumentShuffler(0, 0, "")
+	assert.NotNil(t, err)
+}
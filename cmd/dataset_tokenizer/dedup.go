@@ -0,0 +1,360 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"log"
+	"math"
+	"math/bits"
+	"os"
+	"strings"
+
+	"github.com/wbrown/gpt_bpe"
+)
+
+// The modes of deduplicating documents. DedupExact drops documents whose
+// text is identical to one that was kept, while the near-duplicate modes
+// also drop documents that are similar enough to one that was kept, by the
+// MinHash estimate of the Jaccard similarity of their word shingles, or by
+// the fraction of the bits of their SimHash fingerprints that agree.
+const (
+	DedupNone    = ""
+	DedupExact   = "exact"
+	DedupMinHash = "minhash"
+	DedupSimHash = "simhash"
+)
+
+const (
+	// DefaultDedupThreshold is the similarity at which documents are near
+	// duplicates by default.
+	DefaultDedupThreshold = 0.8
+	// dedupShingleWords is the number of words of each shingle that
+	// near-duplicate documents are compared by.
+	dedupShingleWords = 5
+	// minHashPermutations is the length of the MinHash signatures.
+	minHashPermutations = 128
+	// minHashPrime is the Mersenne prime 2^61-1 that MinHash permutations
+	// are taken modulo.
+	minHashPrime = (1 << 61) - 1
+)
+
+// DedupReport
+// Tallies the documents that a Deduplicator has seen and dropped, along with
+// the bytes and, if it has an encoder, the tokens of those it dropped.
+type DedupReport struct {
+	Mode           string  `json:"mode"`
+	Threshold      float64 `json:"threshold,omitempty"`
+	Documents      int64   `json:"documents"`
+	Kept           int64   `json:"kept"`
+	Exact          int64   `json:"exact_duplicates"`
+	Near           int64   `json:"near_duplicates"`
+	DroppedBytes   int64   `json:"dropped_bytes"`
+	DroppedTokens  int64   `json:"dropped_tokens,omitempty"`
+	countingTokens bool
+}
+
+// Deduplicator
+// Drops the documents that duplicate one that it kept before, exactly or
+// nearly by its Mode, remembering the documents that it keeps for the rest
+// of the run.
+type Deduplicator struct {
+	Mode      string
+	Threshold float64
+	// Encoder, if set, counts the tokens of the documents that are dropped.
+	Encoder *gpt_bpe.GPTEncoder
+	Report  DedupReport
+	exact   map[[sha256.Size]byte]bool
+	// The MinHash signatures of the kept documents, which are looked up by
+	// the hash of each of their bands of rows.
+	permutations [][2]uint64
+	bands        int
+	rows         int
+	signatures   [][]uint32
+	buckets      []map[uint64][]int
+	// The SimHash fingerprints of the kept documents, which are looked up
+	// by each of their blocks of bits, of which a near duplicate must share
+	// at least one, and the most bits that near duplicates differ by.
+	fingerprints []uint64
+	blocks       []map[uint64][]int
+	blockBits    int
+	maxDistance  int
+}
+
+// NewDeduplicator
+// Creates a Deduplicator of mode, dropping near duplicates whose similarity
+// is at least threshold, between 0 and 1.
+func NewDeduplicator(mode string, threshold float64) (*Deduplicator,
+	error) {
+	dedup := &Deduplicator{
+		Mode:      mode,
+		Threshold: threshold,
+		Report:    DedupReport{Mode: mode},
+		exact:     make(map[[sha256.Size]byte]bool),
+	}
+	switch mode {
+	case DedupExact:
+		return dedup, nil
+	case DedupMinHash, DedupSimHash:
+	default:
+		return nil, errors.New(fmt.Sprintf("invalid dedup mode %s, "+
+			"expected %s, %s or %s", mode, DedupExact, DedupMinHash,
+			DedupSimHash))
+	}
+	if threshold <= 0 || threshold > 1 {
+		return nil, errors.New(fmt.Sprintf("invalid dedup threshold %g, "+
+			"must be above 0 and at most 1", threshold))
+	}
+	dedup.Report.Threshold = threshold
+	if mode == DedupMinHash {
+		dedup.initMinHash()
+	} else {
+		dedup.initSimHash()
+	}
+	return dedup, nil
+}
+
+// initMinHash seeds the MinHash permutations, and picks the bands of rows of
+// the signatures whose collisions approximate the threshold from below, as
+// the documents that collide are compared by their whole signatures.
+func (dedup *Deduplicator) initMinHash() {
+	// A fixed seed keeps the signatures, and so the documents that are
+	// dropped, the same from run to run.
+	state := uint64(0x9e3779b97f4a7c15)
+	next := func() uint64 {
+		state ^= state << 13
+		state ^= state >> 7
+		state ^= state << 17
+		return state
+	}
+	dedup.permutations = make([][2]uint64, minHashPermutations)
+	for idx := range dedup.permutations {
+		dedup.permutations[idx] = [2]uint64{next()%(minHashPrime-1) + 1,
+			next() % minHashPrime}
+	}
+	// Documents of similarity s share a band with probability
+	// 1-(1-s^rows)^bands, which rises most steeply at (1/bands)^(1/rows).
+	best := -1.0
+	for rows := 1; rows <= minHashPermutations; rows++ {
+		if minHashPermutations%rows != 0 {
+			continue
+		}
+		bands := minHashPermutations / rows
+		steepest := math.Pow(1/float64(bands), 1/float64(rows))
+		if steepest <= dedup.Threshold && steepest > best {
+			best = steepest
+			dedup.bands, dedup.rows = bands, rows
+		}
+	}
+	dedup.buckets = make([]map[uint64][]int, dedup.bands)
+	for band := range dedup.buckets {
+		dedup.buckets[band] = make(map[uint64][]int)
+	}
+}
+
+// initSimHash splits the fingerprints into one more block than the most
+// bits that near duplicates differ by.
+func (dedup *Deduplicator) initSimHash() {
+	dedup.maxDistance = int(math.Floor((1 - dedup.Threshold) * 64))
+	blocks := dedup.maxDistance + 1
+	dedup.blockBits = (64 + blocks - 1) / blocks
+	dedup.blocks = make([]map[uint64][]int, (64+dedup.blockBits-1)/
+		dedup.blockBits)
+	for block := range dedup.blocks {
+		dedup.blocks[block] = make(map[uint64][]int)
+	}
+}
+
+// shingleHashes returns the hashes of the distinct shingles of the words of
+// document, or of the whole document if it has fewer words than a shingle.
+func shingleHashes(document string) []uint64 {
+	words := strings.Fields(document)
+	seen := make(map[uint64]bool)
+	hashes := make([]uint64, 0, len(words))
+	for start := 0; start == 0 ||
+		start+dedupShingleWords <= len(words); start++ {
+		end := start + dedupShingleWords
+		if end > len(words) {
+			end = len(words)
+		}
+		hasher := fnv.New64a()
+		hasher.Write([]byte(strings.Join(words[start:end], " ")))
+		hash := hasher.Sum64()
+		if !seen[hash] {
+			seen[hash] = true
+			hashes = append(hashes, hash)
+		}
+	}
+	return hashes
+}
+
+// minHash returns the MinHash signature of the shingles.
+func (dedup *Deduplicator) minHash(shingles []uint64) []uint32 {
+	signature := make([]uint32, minHashPermutations)
+	for idx, permutation := range dedup.permutations {
+		min := uint64(math.MaxUint64)
+		for _, shingle := range shingles {
+			hi, lo := bits.Mul64(permutation[0], shingle%minHashPrime)
+			_, permuted := bits.Div64(hi, lo, minHashPrime)
+			permuted = (permuted + permutation[1]) % minHashPrime
+			if permuted < min {
+				min = permuted
+			}
+		}
+		signature[idx] = uint32(min)
+	}
+	return signature
+}
+
+// simHash returns the SimHash fingerprint of the shingles.
+func simHash(shingles []uint64) uint64 {
+	var weights [64]int
+	for _, shingle := range shingles {
+		for bit := 0; bit < 64; bit++ {
+			if shingle&(1<<bit) != 0 {
+				weights[bit]++
+			} else {
+				weights[bit]--
+			}
+		}
+	}
+	var fingerprint uint64
+	for bit, weight := range weights {
+		if weight > 0 {
+			fingerprint |= 1 << bit
+		}
+	}
+	return fingerprint
+}
+
+// nearMinHash returns whether the document of shingles is a near duplicate
+// of a kept document, and keeps it if it is not.
+func (dedup *Deduplicator) nearMinHash(shingles []uint64) bool {
+	signature := dedup.minHash(shingles)
+	bandHashes := make([]uint64, dedup.bands)
+	checked := make(map[int]bool)
+	for band := 0; band < dedup.bands; band++ {
+		hasher := fnv.New64a()
+		rows := signature[band*dedup.rows : (band+1)*dedup.rows]
+		for _, value := range rows {
+			hasher.Write([]byte{byte(value), byte(value >> 8),
+				byte(value >> 16), byte(value >> 24)})
+		}
+		bandHashes[band] = hasher.Sum64()
+		for _, kept := range dedup.buckets[band][bandHashes[band]] {
+			if checked[kept] {
+				continue
+			}
+			checked[kept] = true
+			agree := 0
+			for idx, value := range dedup.signatures[kept] {
+				if value == signature[idx] {
+					agree++
+				}
+			}
+			if float64(agree)/minHashPermutations >= dedup.Threshold {
+				return true
+			}
+		}
+	}
+	for band, bandHash := range bandHashes {
+		dedup.buckets[band][bandHash] = append(dedup.buckets[band][bandHash],
+			len(dedup.signatures))
+	}
+	dedup.signatures = append(dedup.signatures, signature)
+	return false
+}
+
+// nearSimHash returns whether the document of shingles is a near duplicate
+// of a kept document, and keeps it if it is not.
+func (dedup *Deduplicator) nearSimHash(shingles []uint64) bool {
+	fingerprint := simHash(shingles)
+	mask := uint64(1)<<dedup.blockBits - 1
+	for block := range dedup.blocks {
+		key := fingerprint >> (block * dedup.blockBits) & mask
+		for _, kept := range dedup.blocks[block][key] {
+			if bits.OnesCount64(fingerprint^dedup.fingerprints[kept]) <=
+				dedup.maxDistance {
+				return true
+			}
+		}
+	}
+	for block := range dedup.blocks {
+		key := fingerprint >> (block * dedup.blockBits) & mask
+		dedup.blocks[block][key] = append(dedup.blocks[block][key],
+			len(dedup.fingerprints))
+	}
+	dedup.fingerprints = append(dedup.fingerprints, fingerprint)
+	return false
+}
+
+// Keep
+// Returns whether document is kept, as it does not duplicate a document that
+// was kept before, which it is then remembered as.
+func (dedup *Deduplicator) Keep(document string) bool {
+	dedup.Report.Documents++
+	digest := sha256.Sum256([]byte(document))
+	duplicate := dedup.exact[digest]
+	if duplicate {
+		dedup.Report.Exact++
+	} else {
+		shingles := shingleHashes(document)
+		if dedup.Mode == DedupMinHash {
+			duplicate = dedup.nearMinHash(shingles)
+		} else if dedup.Mode == DedupSimHash {
+			duplicate = dedup.nearSimHash(shingles)
+		}
+		if duplicate {
+			dedup.Report.Near++
+		}
+	}
+	if duplicate {
+		dedup.Report.DroppedBytes += int64(len(document))
+		if dedup.Encoder != nil {
+			dedup.Report.countingTokens = true
+			dedup.Report.DroppedTokens += int64(len(
+				*dedup.Encoder.Encode(&document)))
+		}
+		return false
+	}
+	dedup.exact[digest] = true
+	dedup.Report.Kept++
+	return true
+}
+
+// FilterReader
+// Reads the whole document from reader, and returns a reader over it if it
+// is kept, or nil if it is a duplicate.
+func (dedup *Deduplicator) FilterReader(
+	reader io.RuneReader) io.RuneReader {
+	document := readDocument(reader)
+	if !dedup.Keep(document) {
+		return nil
+	}
+	return strings.NewReader(document)
+}
+
+// Log
+// Logs a summary of the report.
+func (report *DedupReport) Log() {
+	tokens := ""
+	if report.countingTokens {
+		tokens = fmt.Sprintf(", %d tokens", report.DroppedTokens)
+	}
+	log.Printf("Dedup: kept %d of %d documents, dropped %d exact and %d "+
+		"near duplicates of %d bytes%s", report.Kept, report.Documents,
+		report.Exact, report.Near, report.DroppedBytes, tokens)
+}
+
+// Write
+// Writes the report to path as JSON.
+func (report *DedupReport) Write(path string) error {
+	reportJson, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, reportJson, 0644)
+}
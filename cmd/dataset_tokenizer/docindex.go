@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+)
+
+const DocumentIndexSuffix = ".index.jsonl"
+
+// DocumentSpan
+// Locates a single document within the flat token stream of a shard. The
+// span starts at the document's first token and ends after its end of text
+// token, so it includes any padding or overlapping tokens that were inserted
+// where the document crosses a context boundary.
+type DocumentSpan struct {
+	Id     int    `json:"id"`
+	Shard  string `json:"shard"`
+	Offset int64  `json:"offset"`
+	Length int64  `json:"length"`
+	// Metadata are the fields of the document's input that were carried
+	// along with it, such as those of -jsonl_metadata.
+	Metadata map[string]interface{} `json:"metadata,omitempty"`
+}
+
+// indexedDocument is a document whose tokens are still being tokenized or
+// written. An end of -1 means that the document has not ended yet.
+type indexedDocument struct {
+	begin    int64
+	end      int64
+	offset   int64
+	mapped   bool
+	metadata map[string]interface{}
+}
+
+// DocumentIndex
+// Collects the DocumentSpan of every document tokenized into a shard. The
+// tokenizer reports where documents end in its stream of source tokens, and
+// which source tokens each context holds, and the index maps the documents
+// onto the written contexts. The index is only meaningful when every context
+// is written in order, so it cannot be used with sampling or shuffling.
+type DocumentIndex struct {
+	Shard   string
+	Spans   []DocumentSpan
+	pending []indexedDocument
+}
+
+// NewDocumentIndex
+// Creates an empty DocumentIndex for the given shard.
+func NewDocumentIndex(shard string) *DocumentIndex {
+	return &DocumentIndex{
+		Shard:   shard,
+		Spans:   make([]DocumentSpan, 0),
+		pending: []indexedDocument{{begin: 0, end: -1}},
+	}
+}
+
+// endDocument records that the current document, of the given metadata,
+// ends at the given source token position, and that the next document
+// begins there.
+func (index *DocumentIndex) endDocument(end int64,
+	metadata map[string]interface{}) {
+	index.pending[len(index.pending)-1].end = end
+	index.pending[len(index.pending)-1].metadata = metadata
+	index.pending = append(index.pending,
+		indexedDocument{begin: end, end: -1})
+}
+
+// addContext maps the documents in the source tokens [sourceBegin,
+// sourceEnd) onto the contextIdx'th written context, which holds length
+// tokens before padding.
+func (index *DocumentIndex) addContext(contextIdx int, contextSize int,
+	sourceBegin int64, sourceEnd int64, length int) {
+	if length == 0 {
+		return
+	}
+	// Re-encoding at a unicode boundary can change the number of tokens, so
+	// we clamp the positions to the tokens that were written.
+	outputOffset := func(position int64) int64 {
+		offset := position - sourceBegin
+		if offset < 0 {
+			offset = 0
+		} else if offset >= int64(length) {
+			offset = int64(length) - 1
+		}
+		return int64(contextIdx)*int64(contextSize) + offset
+	}
+	for len(index.pending) > 0 {
+		document := &index.pending[0]
+		if !document.mapped {
+			if document.begin >= sourceEnd {
+				break
+			}
+			document.offset = outputOffset(document.begin)
+			document.mapped = true
+		}
+		if document.end == -1 || document.end-1 >= sourceEnd {
+			break
+		}
+		index.Spans = append(index.Spans, DocumentSpan{
+			Id:       len(index.Spans),
+			Shard:    index.Shard,
+			Offset:   document.offset,
+			Length:   outputOffset(document.end-1) + 1 - document.offset,
+			Metadata: document.metadata,
+		})
+		index.pending = index.pending[1:]
+	}
+}
+
+// Write
+// Serializes the index to the given path as JSON lines, one DocumentSpan per
+// line.
+func (index *DocumentIndex) Write(path string) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	writer := bufio.NewWriter(file)
+	encoder := json.NewEncoder(writer)
+	for _, span := range index.Spans {
+		if err := encoder.Encode(span); err != nil {
+			return err
+		}
+	}
+	if err := writer.Flush(); err != nil {
+		return err
+	}
+	return file.Close()
+}
+
+// ReadDocumentIndex
+// Reads the spans of an index previously written by DocumentIndex.Write.
+func ReadDocumentIndex(path string) ([]DocumentSpan, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	spans := make([]DocumentSpan, 0)
+	decoder := json.NewDecoder(bufio.NewReader(file))
+	for decoder.More() {
+		var span DocumentSpan
+		if err := decoder.Decode(&span); err != nil {
+			return nil, err
+		}
+		spans = append(spans, span)
+	}
+	return spans, nil
+}
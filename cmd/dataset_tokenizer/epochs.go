@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"strings"
+)
+
+// EpochPlanSuffix is the suffix of the epoch plan written next to the output
+// of a run with -epochs, in place of the run manifest's ManifestSuffix.
+const EpochPlanSuffix = ".epochs.json"
+
+// DefaultBytesPerToken is the number of input bytes that a token is estimated
+// to take when planning epochs, which is about right for English prose.
+const DefaultBytesPerToken = 4
+
+// PlannedEpoch
+// An epoch of an EpochPlan: the shard that it is written to, the order that
+// its inputs are traversed in, and how many times each input is traversed.
+type PlannedEpoch struct {
+	Epoch      int            `json:"epoch"`
+	Shard      string         `json:"shard"`
+	Tokens     int64          `json:"estimated_tokens"`
+	Traversals map[string]int `json:"traversals"`
+	Inputs     []PathInfo     `json:"-"`
+}
+
+// EpochPlan
+// Plans the shards of a multi-epoch run, with a shard for each epoch. When
+// the run has a token budget, it is split evenly across the epochs, and each
+// epoch traverses every input as many whole times as its share allows, then
+// a prefix of the inputs until its share is met, so that an input may appear
+// more than once within an epoch. Otherwise, each epoch traverses every input
+// once. The inputs are reshuffled for each traversal, from a seed that is
+// derived from the plan's seed and the epoch, so that a plan is reproducible.
+// The tokens of an input are estimated from its size, as the inputs are not
+// tokenized until the plan is carried out.
+type EpochPlan struct {
+	TokenBudget int64 `json:"token_budget"`
+	// BytesPerToken is the number of input bytes estimated for each token.
+	BytesPerToken int   `json:"bytes_per_token"`
+	Seed          int64 `json:"seed"`
+	// InputTokens is the estimated number of tokens in a single traversal of
+	// every input.
+	InputTokens int64          `json:"input_tokens"`
+	Epochs      []PlannedEpoch `json:"epochs"`
+}
+
+// NewEpochPlan
+// Plans epochs shards of output for the inputs in matches. A tokenBudget of
+// 0 traverses every input once in each epoch.
+func NewEpochPlan(matches []PathInfo, output string, epochs int,
+	tokenBudget int64, bytesPerToken int, seed int64) (*EpochPlan, error) {
+	if epochs < 1 {
+		return nil, errors.New(fmt.Sprintf("cannot plan %d epochs", epochs))
+	} else if tokenBudget < 0 {
+		return nil, errors.New(fmt.Sprintf("invalid token budget %d",
+			tokenBudget))
+	} else if bytesPerToken < 1 {
+		return nil, errors.New(fmt.Sprintf("invalid bytes per token %d",
+			bytesPerToken))
+	}
+	plan := &EpochPlan{
+		TokenBudget:   tokenBudget,
+		BytesPerToken: bytesPerToken,
+		Seed:          seed,
+		Epochs:        make([]PlannedEpoch, epochs),
+	}
+	estimates := make(map[string]int64, len(matches))
+	for _, match := range matches {
+		estimate := match.Size / int64(bytesPerToken)
+		if estimate < 1 {
+			estimate = 1
+		}
+		estimates[match.Path] = estimate
+		plan.InputTokens += estimate
+	}
+	if len(matches) == 0 && tokenBudget > 0 {
+		return nil, errors.New("cannot plan a token budget without inputs")
+	}
+
+	for epochIdx := range plan.Epochs {
+		epoch := &plan.Epochs[epochIdx]
+		epoch.Epoch = epochIdx
+		epoch.Shard = ShardPath(output, epochIdx)
+		epoch.Traversals = make(map[string]int, len(matches))
+		epoch.Inputs = make([]PathInfo, 0, len(matches))
+		rng := rand.New(rand.NewSource(seed + int64(epochIdx)))
+		traverse := func(limit int64) {
+			order := append([]PathInfo(nil), matches...)
+			rng.Shuffle(len(order), func(i, j int) {
+				order[i], order[j] = order[j], order[i]
+			})
+			for _, match := range order {
+				if limit >= 0 && epoch.Tokens >= limit {
+					break
+				}
+				epoch.Inputs = append(epoch.Inputs, match)
+				epoch.Traversals[match.Path]++
+				epoch.Tokens += estimates[match.Path]
+			}
+		}
+		if tokenBudget == 0 {
+			traverse(-1)
+			continue
+		}
+		// The budget is split so that the shares of the epochs sum to it.
+		share := tokenBudget*int64(epochIdx+1)/int64(epochs) -
+			tokenBudget*int64(epochIdx)/int64(epochs)
+		for whole := share / plan.InputTokens; whole > 0; whole-- {
+			traverse(-1)
+		}
+		if epoch.Tokens < share {
+			traverse(share)
+		}
+	}
+	return plan, nil
+}
+
+// EpochPlanPath
+// Returns the path of the epoch plan of the run manifest at manifestPath.
+func EpochPlanPath(manifestPath string) string {
+	return strings.TrimSuffix(manifestPath, ManifestSuffix) + EpochPlanSuffix
+}
+
+// Write
+// Writes the plan to path as JSON.
+func (plan *EpochPlan) Write(path string) error {
+	planJson, err := json.MarshalIndent(plan, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, planJson, 0644)
+}
@@ -0,0 +1,340 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// DocumentFilter
+// Scores documents for quality before they are tokenized, and decides
+// whether each score is good enough to keep the document. Filters are
+// combined into a DocumentFilters chain.
+type DocumentFilter interface {
+	// Name identifies the filter in logs and statistics.
+	Name() string
+	// Score measures the document.
+	Score(document string) float64
+	// Accept returns whether a document with the given score is kept.
+	Accept(score float64) bool
+}
+
+// DocumentFilters
+// A chain of DocumentFilter that a document must pass in order. The number
+// of documents rejected by each filter is counted as they are filtered.
+type DocumentFilters struct {
+	Filters  []DocumentFilter
+	Accepted int
+	Rejected map[string]int
+}
+
+// NewDocumentFilters
+// Creates a DocumentFilters chain of the given filters.
+func NewDocumentFilters(filters ...DocumentFilter) *DocumentFilters {
+	return &DocumentFilters{
+		Filters:  filters,
+		Accepted: 0,
+		Rejected: make(map[string]int),
+	}
+}
+
+// Filter
+// Runs the document through the chain, returning whether it is kept, and if
+// not, the name of the filter that rejected it.
+func (filters *DocumentFilters) Filter(document string) (bool, string) {
+	for _, filter := range filters.Filters {
+		if !filter.Accept(filter.Score(document)) {
+			filters.Rejected[filter.Name()]++
+			return false, filter.Name()
+		}
+	}
+	filters.Accepted++
+	return true, ""
+}
+
+// FilterReader
+// Reads the whole document from reader, and returns a reader over it if it
+// is kept by the chain, or nil if it is rejected.
+func (filters *DocumentFilters) FilterReader(
+	reader io.RuneReader) io.RuneReader {
+	document := readDocument(reader)
+	if accept, _ := filters.Filter(document); !accept {
+		return nil
+	}
+	return strings.NewReader(document)
+}
+
+// readDocument reads the whole document from reader.
+func readDocument(reader io.RuneReader) string {
+	var builder strings.Builder
+	for {
+		r, size, err := reader.ReadRune()
+		if size == 0 || err != nil {
+			break
+		}
+		builder.WriteRune(r)
+	}
+	return builder.String()
+}
+
+// WordCountFilter
+// Keeps documents with between Min and Max whitespace separated words.
+type WordCountFilter struct {
+	Min int
+	Max int
+}
+
+func (filter WordCountFilter) Name() string { return "word_count" }
+
+func (filter WordCountFilter) Score(document string) float64 {
+	return float64(len(strings.Fields(document)))
+}
+
+func (filter WordCountFilter) Accept(score float64) bool {
+	return score >= float64(filter.Min) && score <= float64(filter.Max)
+}
+
+// MeanWordLengthFilter
+// Keeps documents whose mean word length, in runes, is between Min and Max.
+type MeanWordLengthFilter struct {
+	Min float64
+	Max float64
+}
+
+func (filter MeanWordLengthFilter) Name() string { return "mean_word_length" }
+
+func (filter MeanWordLengthFilter) Score(document string) float64 {
+	words := strings.Fields(document)
+	if len(words) == 0 {
+		return 0
+	}
+	return float64(utf8.RuneCountInString(strings.Join(words, ""))) /
+		float64(len(words))
+}
+
+func (filter MeanWordLengthFilter) Accept(score float64) bool {
+	return score >= filter.Min && score <= filter.Max
+}
+
+// SymbolRatioFilter
+// Keeps documents with at most Max hash symbols and ellipses per word.
+type SymbolRatioFilter struct {
+	Max float64
+}
+
+func (filter SymbolRatioFilter) Name() string { return "symbol_ratio" }
+
+func (filter SymbolRatioFilter) Score(document string) float64 {
+	words := len(strings.Fields(document))
+	if words == 0 {
+		return 0
+	}
+	symbols := strings.Count(document, "#") +
+		strings.Count(document, "...") + strings.Count(document, "…")
+	return float64(symbols) / float64(words)
+}
+
+func (filter SymbolRatioFilter) Accept(score float64) bool {
+	return score <= filter.Max
+}
+
+// AlphabeticRatioFilter
+// Keeps documents where at least Min of the words contain a letter.
+type AlphabeticRatioFilter struct {
+	Min float64
+}
+
+func (filter AlphabeticRatioFilter) Name() string { return "alphabetic_ratio" }
+
+func (filter AlphabeticRatioFilter) Score(document string) float64 {
+	words := strings.Fields(document)
+	if len(words) == 0 {
+		return 0
+	}
+	alphabetic := 0
+	for _, word := range words {
+		if strings.IndexFunc(word, unicode.IsLetter) != -1 {
+			alphabetic++
+		}
+	}
+	return float64(alphabetic) / float64(len(words))
+}
+
+func (filter AlphabeticRatioFilter) Accept(score float64) bool {
+	return score >= filter.Min
+}
+
+// RepetitionFilter
+// Rejects documents that repeat lines, paragraphs or word n-grams too much.
+// Each measure is a fraction of the document with its own threshold, and the
+// score is the largest measure relative to its threshold, so that documents
+// scoring above 1 are rejected.
+type RepetitionFilter struct {
+	// MaxDuplicateLines and MaxDuplicateParagraphs bound the fraction of
+	// lines and paragraphs that repeat an earlier one.
+	MaxDuplicateLines      float64
+	MaxDuplicateParagraphs float64
+	// MaxDuplicateLineChars and MaxDuplicateParagraphChars bound the
+	// fraction of characters in those repeats.
+	MaxDuplicateLineChars      float64
+	MaxDuplicateParagraphChars float64
+	// MaxTopNGramChars bounds the fraction of word characters in the most
+	// frequent n-gram, for n = 2, 3, 4, ...
+	MaxTopNGramChars []float64
+	// MaxDuplicateNGramChars bounds the fraction of word characters covered
+	// by n-grams that occur more than once, for n = 5, 6, 7, ...
+	MaxDuplicateNGramChars []float64
+}
+
+// NewRepetitionFilter
+// Creates a RepetitionFilter with the thresholds of the Gopher rules.
+func NewRepetitionFilter() RepetitionFilter {
+	return RepetitionFilter{
+		MaxDuplicateLines:          0.30,
+		MaxDuplicateParagraphs:     0.30,
+		MaxDuplicateLineChars:      0.20,
+		MaxDuplicateParagraphChars: 0.20,
+		MaxTopNGramChars:           []float64{0.20, 0.18, 0.16},
+		MaxDuplicateNGramChars: []float64{0.15, 0.14, 0.13, 0.12, 0.11,
+			0.10},
+	}
+}
+
+func (filter RepetitionFilter) Name() string { return "repetition" }
+
+// duplicateFractions returns the fraction of the non-empty parts that repeat
+// an earlier part, and the fraction of characters in the repeats.
+func duplicateFractions(parts []string) (float64, float64) {
+	seen := make(map[string]bool, len(parts))
+	total, duplicates, chars, duplicateChars := 0, 0, 0, 0
+	for _, part := range parts {
+		if part = strings.TrimSpace(part); part == "" {
+			continue
+		}
+		length := utf8.RuneCountInString(part)
+		total++
+		chars += length
+		if seen[part] {
+			duplicates++
+			duplicateChars += length
+		}
+		seen[part] = true
+	}
+	if total == 0 {
+		return 0, 0
+	}
+	return float64(duplicates) / float64(total),
+		float64(duplicateChars) / float64(chars)
+}
+
+func (filter RepetitionFilter) Score(document string) float64 {
+	score := 0.0
+	measure := func(fraction float64, threshold float64) {
+		if threshold > 0 && fraction/threshold > score {
+			score = fraction / threshold
+		}
+	}
+	lines, lineChars := duplicateFractions(strings.Split(document, "\n"))
+	measure(lines, filter.MaxDuplicateLines)
+	measure(lineChars, filter.MaxDuplicateLineChars)
+	paragraphs, paragraphChars := duplicateFractions(
+		strings.Split(document, "\n\n"))
+	measure(paragraphs, filter.MaxDuplicateParagraphs)
+	measure(paragraphChars, filter.MaxDuplicateParagraphChars)
+
+	words := strings.Fields(document)
+	wordLengths := make([]int, len(words))
+	totalChars := 0
+	for wordIdx, word := range words {
+		wordLengths[wordIdx] = utf8.RuneCountInString(word)
+		totalChars += wordLengths[wordIdx]
+	}
+	if totalChars == 0 {
+		return score
+	}
+	countNGrams := func(n int) map[string]int {
+		counts := make(map[string]int)
+		for start := 0; start+n <= len(words); start++ {
+			counts[strings.Join(words[start:start+n], " ")]++
+		}
+		return counts
+	}
+	for ngramIdx, threshold := range filter.MaxTopNGramChars {
+		n := ngramIdx + 2
+		topChars := 0
+		for ngram, count := range countNGrams(n) {
+			if count < 2 {
+				continue
+			}
+			chars := count * (utf8.RuneCountInString(ngram) - (n - 1))
+			if chars > topChars {
+				topChars = chars
+			}
+		}
+		measure(float64(topChars)/float64(totalChars), threshold)
+	}
+	for ngramIdx, threshold := range filter.MaxDuplicateNGramChars {
+		n := ngramIdx + 5
+		counts := countNGrams(n)
+		covered := make([]bool, len(words))
+		for start := 0; start+n <= len(words); start++ {
+			if counts[strings.Join(words[start:start+n], " ")] > 1 {
+				for wordIdx := start; wordIdx < start+n; wordIdx++ {
+					covered[wordIdx] = true
+				}
+			}
+		}
+		coveredChars := 0
+		for wordIdx, isCovered := range covered {
+			if isCovered {
+				coveredChars += wordLengths[wordIdx]
+			}
+		}
+		measure(float64(coveredChars)/float64(totalChars), threshold)
+	}
+	return score
+}
+
+func (filter RepetitionFilter) Accept(score float64) bool {
+	return score <= 1
+}
+
+// GopherFilters
+// Returns the quality heuristics of the Gopher rules (Rae et al., 2021),
+// keyed by the names accepted by ParseDocumentFilters.
+func GopherFilters() map[string]DocumentFilter {
+	return map[string]DocumentFilter{
+		"word_count":       WordCountFilter{Min: 50, Max: 100000},
+		"mean_word_length": MeanWordLengthFilter{Min: 3, Max: 10},
+		"symbol_ratio":     SymbolRatioFilter{Max: 0.1},
+		"alphabetic_ratio": AlphabeticRatioFilter{Min: 0.8},
+		"repetition":       NewRepetitionFilter(),
+	}
+}
+
+// ParseDocumentFilters
+// Creates a DocumentFilters chain from a comma separated list of built-in
+// filter names, where `gopher` stands for all of them.
+func ParseDocumentFilters(spec string) (*DocumentFilters, error) {
+	builtins := GopherFilters()
+	order := []string{"word_count", "mean_word_length", "symbol_ratio",
+		"alphabetic_ratio", "repetition"}
+	filters := make([]DocumentFilter, 0)
+	for _, name := range strings.Split(spec, ",") {
+		name = strings.TrimSpace(name)
+		if name == "gopher" {
+			for _, builtin := range order {
+				filters = append(filters, builtins[builtin])
+			}
+		} else if filter, ok := builtins[name]; ok {
+			filters = append(filters, filter)
+		} else {
+			return nil, errors.New(fmt.Sprintf(
+				"unknown document filter: %s", name))
+		}
+	}
+	return NewDocumentFilters(filters...), nil
+}
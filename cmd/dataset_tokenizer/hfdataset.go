@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+
+	"github.com/wbrown/gpt_bpe"
+)
+
+// IgnoreLabel is the label of padding tokens, which the loss ignores.
+const IgnoreLabel = -100
+
+// hfSequenceFeature is the Hugging Face datasets feature of a column of
+// int32 sequences.
+var hfSequenceFeature = map[string]interface{}{
+	"feature": map[string]string{"dtype": "int32", "_type": "Value"},
+	"_type":   "Sequence",
+}
+
+// paddingStart returns the index of the padding at the end of the context.
+// When the padding token is also the end of text token, the first of the
+// trailing tokens is taken to be the end of the text rather than padding.
+func (cw ContextsWriter) paddingStart(context gpt_bpe.Tokens) int {
+	start := len(context)
+	for start > 0 && context[start-1] == cw.PadToken {
+		start--
+	}
+	if cw.PadToken == cw.EndOfText && start < len(context) {
+		start++
+	}
+	return start
+}
+
+// The columns of the contexts that ContextsWriter can write alongside their
+// tokens, as Hugging Face dataset columns or TFRecord features.
+const (
+	ColumnInputIds      = "input_ids"
+	ColumnAttentionMask = "attention_mask"
+	ColumnLabels        = "labels"
+	ColumnSegmentIds    = "segment_ids"
+	ColumnLossMask      = "loss_mask"
+)
+
+// contextColumn returns the values of a column of the context: its tokens,
+// its attention mask of 1 for each token before its padding, its labels of
+// its tokens with its padding labelled IgnoreLabel, or its segment ids,
+// which number the documents of the context from 1, each up to and
+// including its end of text token, with its padding as 0.
+func (cw ContextsWriter) contextColumn(context gpt_bpe.Tokens,
+	column string) []int64 {
+	values := make([]int64, len(context))
+	paddingStart := cw.paddingStart(context)
+	segment := int64(1)
+	for idx, token := range context {
+		switch column {
+		case ColumnInputIds:
+			values[idx] = int64(token)
+		case ColumnAttentionMask:
+			if idx < paddingStart {
+				values[idx] = 1
+			}
+		case ColumnLabels:
+			values[idx] = int64(token)
+			if idx >= paddingStart {
+				values[idx] = IgnoreLabel
+			}
+		case ColumnSegmentIds:
+			if idx < paddingStart {
+				values[idx] = segment
+				if token == cw.EndOfText {
+					segment++
+				}
+			}
+		}
+	}
+	return values
+}
+
+// writeHuggingFace writes the contexts as a Parquet file of the
+// `input_ids`, and the optional `attention_mask`, `labels`, `segment_ids`
+// and `loss_mask` columns, along with the dataset info that
+// `datasets.load_dataset("parquet")` reads its features from.
+func (cw ContextsWriter) writeHuggingFace(outPath string,
+	nextContext ContextsIterator) (int, error) {
+	if cw.Shuffle || cw.Compression != CompressionNone {
+		return 0, errors.New("shuffling and compression are not " +
+			"supported with Hugging Face dataset output")
+	}
+	columns := []ParquetColumn{{Name: ColumnInputIds, Type: ParquetInt32,
+		List: true}}
+	if cw.AttentionMask {
+		columns = append(columns, ParquetColumn{Name: ColumnAttentionMask,
+			Type: ParquetInt32, List: true})
+	}
+	if cw.Labels {
+		columns = append(columns, ParquetColumn{Name: ColumnLabels,
+			Type: ParquetInt32, List: true})
+	}
+	if cw.SegmentIds {
+		columns = append(columns, ParquetColumn{Name: ColumnSegmentIds,
+			Type: ParquetInt32, List: true})
+	}
+	if cw.LossMasks != nil {
+		columns = append(columns, ParquetColumn{Name: ColumnLossMask,
+			Type: ParquetInt32, List: true})
+	}
+	features := make(map[string]interface{}, len(columns))
+	for _, column := range columns {
+		features[column.Name] = hfSequenceFeature
+	}
+	info, _ := json.Marshal(map[string]interface{}{
+		"info": map[string]interface{}{"features": features},
+	})
+
+	outFile, err := os.Create(outPath)
+	if err != nil {
+		return 0, err
+	}
+	defer outFile.Close()
+	pw, err := NewParquetWriter(outFile, columns)
+	if err != nil {
+		return 0, err
+	}
+	pw.Metadata["huggingface"] = string(info)
+
+	totalTokens := 0
+	samplingIdx := 0
+	for context := nextContext(); context != nil; context = nextContext() {
+		var lossMask []int64
+		if cw.LossMasks != nil {
+			lossMask = cw.LossMasks.next()
+		}
+		// Keep every `sampling` percent context, as with binary contexts.
+		sampled := cw.Sampling == 100 || (samplingIdx%20) < cw.Sampling/5
+		samplingIdx++
+		if !sampled {
+			continue
+		}
+		row := make([][]int64, len(columns))
+		for idx, column := range columns {
+			if column.Name == ColumnLossMask {
+				row[idx] = lossMask
+			} else {
+				row[idx] = cw.contextColumn(*context, column.Name)
+			}
+		}
+		if err := pw.WriteRow(row...); err != nil {
+			return totalTokens, err
+		}
+		totalTokens += len(*context)
+	}
+	if err := pw.Close(); err != nil {
+		return totalTokens, err
+	}
+	return totalTokens, outFile.Close()
+}
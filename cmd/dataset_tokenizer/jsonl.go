@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/wbrown/gpt_bpe"
+)
+
+// The document metadata fields that DocumentsJSONL can write alongside each
+// document's tokens.
+const (
+	JSONLFieldId         = "id"
+	JSONLFieldSource     = "source"
+	JSONLFieldTokenCount = "token_count"
+	JSONLFieldText       = "text"
+)
+
+// DocumentsJSONL
+// Writes the tokens of each document as a line of JSON, for consumers that
+// prefer text interchange to the binary contexts output. Without Fields, each
+// line is an array of token ids. With Fields, each line is an object of the
+// document's metadata fields, in the order given, and its "tokens" array.
+type DocumentsJSONL struct {
+	Fields    []string
+	Documents int
+	Tokens    int
+}
+
+// ParseJSONLFields
+// Parses a comma separated list of document metadata fields, such as
+// "id,source", for DocumentsJSONL.
+func ParseJSONLFields(spec string) ([]string, error) {
+	fields := make([]string, 0)
+	if strings.TrimSpace(spec) == "" {
+		return fields, nil
+	}
+	seen := make(map[string]bool)
+	for _, field := range strings.Split(spec, ",") {
+		field = strings.TrimSpace(field)
+		switch field {
+		case JSONLFieldId, JSONLFieldSource, JSONLFieldTokenCount,
+			JSONLFieldText:
+		default:
+			return nil, errors.New(fmt.Sprintf(
+				"invalid jsonl field %s", field))
+		}
+		if !seen[field] {
+			seen[field] = true
+			fields = append(fields, field)
+		}
+	}
+	return fields, nil
+}
+
+// Write
+// Reads the documents of the given inputs with textsReader, tokenizes them
+// with encoder, and writes them to a new JSONL file at jsonlPath, replacing
+// any existing file.
+func (jw *DocumentsJSONL) Write(textsReader TextsReader,
+	encoder *gpt_bpe.GPTEncoder, matches []PathInfo, jsonlPath string) error {
+	file, err := os.Create(jsonlPath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	writer := bufio.NewWriter(file)
+	if err := jw.writeLines(writer, textsReader, encoder,
+		matches); err != nil {
+		return err
+	}
+	if err := writer.Flush(); err != nil {
+		return err
+	}
+	return file.Close()
+}
+
+// writeLines writes a line of JSON for each document of the inputs.
+func (jw *DocumentsJSONL) writeLines(writer io.Writer,
+	textsReader TextsReader, encoder *gpt_bpe.GPTEncoder,
+	matches []PathInfo) error {
+	jw.Documents, jw.Tokens = 0, 0
+	var line []byte
+	return encodeDocuments(textsReader, encoder, matches,
+		func(source string, document string, tokens gpt_bpe.Tokens) error {
+			var err error
+			if line, err = jw.appendLine(line[:0], source, document,
+				tokens); err != nil {
+				return err
+			} else if _, err = writer.Write(line); err != nil {
+				return err
+			}
+			jw.Documents++
+			jw.Tokens += len(tokens)
+			return nil
+		})
+}
+
+// encodeDocuments reads the documents of the inputs with textsReader,
+// encodes each with encoder, and calls write with the input that it was read
+// from, its text and its tokens, which are only valid until write returns.
+func encodeDocuments(textsReader TextsReader, encoder *gpt_bpe.GPTEncoder,
+	matches []PathInfo, write func(source string, document string,
+		tokens gpt_bpe.Tokens) error) error {
+	var writeErr error
+	// Documents are encoded into one buffer, which is reset after each one.
+	buffer := gpt_bpe.NewTokenBuffer(0)
+	for _, match := range matches {
+		log.Print("Reading ", match.Path)
+		emit := func(reader io.RuneReader) {
+			if reader = textsReader.filterDocument(reader); reader == nil ||
+				writeErr != nil {
+				return
+			}
+			var text strings.Builder
+			for {
+				r, _, err := reader.ReadRune()
+				if err != nil {
+					break
+				}
+				text.WriteRune(r)
+			}
+			document := text.String()
+			writeErr = write(match.Path, document,
+				encoder.EncodeInto(buffer, &document))
+			buffer.Reset()
+		}
+		if err := textsReader.readFile(match.Path, emit); err != nil {
+			return err
+		} else if writeErr != nil {
+			return writeErr
+		}
+	}
+	return nil
+}
+
+// appendLine appends the line of JSON for a document to line.
+func (jw *DocumentsJSONL) appendLine(line []byte, source string,
+	document string, tokens gpt_bpe.Tokens) ([]byte, error) {
+	tokensJson := []byte("[]")
+	if len(tokens) > 0 {
+		var err error
+		if tokensJson, err = json.Marshal(tokens); err != nil {
+			return nil, err
+		}
+	}
+	if len(jw.Fields) == 0 {
+		return append(append(line, tokensJson...), '\n'), nil
+	}
+	line = append(line, '{')
+	for _, field := range jw.Fields {
+		var value []byte
+		var err error
+		switch field {
+		case JSONLFieldId:
+			value = strconv.AppendInt(nil, int64(jw.Documents), 10)
+		case JSONLFieldSource:
+			value, err = json.Marshal(source)
+		case JSONLFieldTokenCount:
+			value = strconv.AppendInt(nil, int64(len(tokens)), 10)
+		case JSONLFieldText:
+			value, err = json.Marshal(document)
+		}
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, '"')
+		line = append(line, field...)
+		line = append(line, `":`...)
+		line = append(line, value...)
+		line = append(line, ',')
+	}
+	line = append(line, `"tokens":`...)
+	line = append(line, tokensJson...)
+	return append(line, '}', '\n'), nil
+}
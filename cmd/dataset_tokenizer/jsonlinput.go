@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"text/template"
+)
+
+// DefaultJSONLField is the field of JSONL inputs that documents are read
+// from by default.
+const DefaultJSONLField = "text"
+
+// DefaultJSONLPromptField and DefaultJSONLCompletionField are the fields of
+// JSONL inputs that the prompts and completions of loss masked documents are
+// read from by default.
+const (
+	DefaultJSONLPromptField     = "prompt"
+	DefaultJSONLCompletionField = "completion"
+)
+
+// JSONLInput
+// How documents are read from the lines of JSONL inputs, each of which is a
+// JSON object: from the string of one of its fields, or from a template of
+// its fields, such as "{{.title}}\n\n{{.text}}". The Metadata fields of each
+// line are carried along with its document into the document index.
+type JSONLInput struct {
+	Field    string
+	Template *template.Template
+	Metadata []string
+	// PromptField and CompletionField, if set, read each document as the
+	// prompt of one field followed by the completion of the other, instead
+	// of Field or Template, for the loss masks of instruction tuning.
+	PromptField     string
+	CompletionField string
+	// Skipped counts the lines without a document, whose field is missing or
+	// is not a string, or that reference a missing field in the template.
+	Skipped int
+}
+
+// NewJSONLInput
+// Creates a JSONLInput of the given field, or of templateSpec if it is not
+// empty, in which `\n` and `\t` are newlines and tabs.
+func NewJSONLInput(field string, templateSpec string,
+	metadata []string) (*JSONLInput, error) {
+	input := &JSONLInput{Field: field, Metadata: metadata}
+	if templateSpec != "" {
+		templateSpec = strings.NewReplacer(`\n`, "\n", `\t`, "\t").Replace(
+			templateSpec)
+		var err error
+		if input.Template, err = template.New("jsonl").Option(
+			"missingkey=error").Parse(templateSpec); err != nil {
+			return nil, errors.New(fmt.Sprintf("invalid jsonl template: %v",
+				err))
+		}
+	} else if field == "" {
+		return nil, errors.New("a jsonl field or template is required")
+	}
+	return input, nil
+}
+
+// Document
+// Returns the document of a line, and its metadata fields, or false if the
+// line has no document.
+func (input *JSONLInput) Document(line []byte) (string,
+	map[string]interface{}, bool, error) {
+	var fields map[string]interface{}
+	if err := json.Unmarshal(line, &fields); err != nil {
+		return "", nil, false, err
+	}
+	var document string
+	prompt := -1
+	if input.PromptField != "" {
+		promptText, isPrompt := fields[input.PromptField].(string)
+		completion, isCompletion := fields[input.CompletionField].(string)
+		if !isPrompt || !isCompletion {
+			return "", nil, false, nil
+		}
+		document = promptText + completion
+		prompt = len(promptText)
+	} else if input.Template != nil {
+		var builder strings.Builder
+		if err := input.Template.Execute(&builder, fields); err != nil {
+			return "", nil, false, nil
+		}
+		document = builder.String()
+	} else if text, ok := fields[input.Field].(string); ok {
+		document = text
+	} else {
+		return "", nil, false, nil
+	}
+	var metadata map[string]interface{}
+	if len(input.Metadata) > 0 || prompt >= 0 {
+		metadata = make(map[string]interface{}, len(input.Metadata)+1)
+		for _, field := range input.Metadata {
+			if value, ok := fields[field]; ok {
+				metadata[field] = value
+			}
+		}
+	}
+	if prompt >= 0 {
+		metadata[promptBytesKey] = prompt
+	}
+	return document, metadata, true, nil
+}
+
+// Read
+// Calls emit with the document of each line of reader, skipping blank
+// lines and lines without a document. Lines that are not JSON objects are
+// an error, reported by their line number.
+func (input *JSONLInput) Read(reader io.Reader,
+	emit func(document string, metadata map[string]interface{})) error {
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024*1024)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := scanner.Bytes()
+		if len(strings.TrimSpace(string(line))) == 0 {
+			continue
+		}
+		document, metadata, ok, err := input.Document(line)
+		if err != nil {
+			return errors.New(fmt.Sprintf("line %d: %v", lineNumber, err))
+		} else if !ok {
+			input.Skipped++
+			continue
+		}
+		emit(document, metadata)
+	}
+	return scanner.Err()
+}
+
+// metadataReader is a document, and the metadata that is carried along with
+// it into the document index.
+type metadataReader struct {
+	io.RuneReader
+	metadata map[string]interface{}
+}
+
+// withMetadata returns reader, along with metadata if it has any.
+func withMetadata(reader io.RuneReader,
+	metadata map[string]interface{}) io.RuneReader {
+	if reader == nil || metadata == nil {
+		return reader
+	}
+	return metadataReader{reader, metadata}
+}
+
+// readerMetadata returns the metadata of a document read by reader, if any.
+func readerMetadata(reader io.RuneReader) map[string]interface{} {
+	if document, ok := reader.(metadataReader); ok {
+		return document.metadata
+	}
+	return nil
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"io"
+	"strings"
+	"unicode"
+)
+
+const (
+	// LanguageUndetermined is the ISO 639-3 code for text whose language
+	// could not be identified.
+	LanguageUndetermined  = "und"
+	DefaultLanguageSample = 2048
+)
+
+// languageStopwords are the most frequent words of each language written in
+// the Latin or Cyrillic scripts, keyed by ISO 639-3 code. Together they form
+// a compact word unigram model that separates languages sharing a script.
+var languageStopwords = map[*unicode.RangeTable]map[string][]string{
+	unicode.Latin: {
+		"eng": strings.Fields("the of and to in is that it was for on " +
+			"with as he be at by this had not are but from his they have " +
+			"you which were her she there their"),
+		"deu": strings.Fields("der die und in den von zu das mit sich des " +
+			"auf für ist im dem nicht ein eine als auch es an werden aus " +
+			"er hat dass sie nach wird bei"),
+		"fra": strings.Fields("de la le et les des en un du une que est " +
+			"pour qui dans par plus pas au sur ne se il sont avec ce elle " +
+			"nous vous"),
+		"spa": strings.Fields("de la que el en y los del se las por un " +
+			"para con una su al lo como más pero sus le ya este fue ha es " +
+			"muy"),
+		"ita": strings.Fields("di e il la che in un per del non una è " +
+			"sono le con si da gli al della come anche più ma nel alla " +
+			"questo"),
+		"por": strings.Fields("de a o que e do da em um para é com não " +
+			"uma os no se na por mais as dos como mas foi ao ele das tem"),
+		"nld": strings.Fields("de en van het een in is dat op te zijn met " +
+			"voor niet aan er die ook als bij door maar om dan nog wordt " +
+			"uit"),
+		"swe": strings.Fields("och i att det som en på är av för med till " +
+			"den har de inte om ett han men var jag sig från vi så"),
+		"dan": strings.Fields("og i at det en den til er som på de med " +
+			"han af for ikke der var mig sig men et har om vi"),
+		"pol": strings.Fields("i w na z się nie do że to jest o jak a co " +
+			"ale po tak od za przez dla być jego czy już"),
+		"ces": strings.Fields("a v se na je že s z o do to ve jako by k " +
+			"pro ale po jsou byl tak které který od jeho"),
+		"tur": strings.Fields("ve bir bu da de için ile çok ne daha gibi " +
+			"o ama kadar olan en var sonra mi her olarak değil"),
+		"fin": strings.Fields("ja on ei se että oli hän ovat tai kun " +
+			"mutta ole myös kuin niin jos sen mitä tämä vain"),
+		"hun": strings.Fields("a az és hogy nem is egy de van meg el már " +
+			"csak mint ez azt volt még ki lesz után"),
+		"ron": strings.Fields("și de în la a cu pe care o nu un este din " +
+			"ce mai pentru se sau fost ca ei"),
+		"ind": strings.Fields("yang dan di itu dengan untuk tidak ini dari " +
+			"dalam akan pada juga saya ke karena adalah bisa ada mereka"),
+		"vie": strings.Fields("của và các có là được trong cho không người " +
+			"những một với đã này để khi đến"),
+	},
+	unicode.Cyrillic: {
+		"rus": strings.Fields("и в не на я что он с как а то все она так " +
+			"его но да ты к у же вы за бы по только ее мне было от"),
+		"ukr": strings.Fields("і в не на що я з та до як це він але його " +
+			"у від за так є ми вони була"),
+		"bul": strings.Fields("и на в се да е за не от че с по са ще като " +
+			"но това си той го което"),
+	},
+}
+
+// scriptLanguages maps scripts that are each used by one major language to
+// that language's ISO 639-3 code.
+var scriptLanguages = []struct {
+	script   *unicode.RangeTable
+	language string
+}{
+	{unicode.Hangul, "kor"},
+	{unicode.Hiragana, "jpn"},
+	{unicode.Katakana, "jpn"},
+	{unicode.Han, "zho"},
+	{unicode.Arabic, "ara"},
+	{unicode.Greek, "ell"},
+	{unicode.Hebrew, "heb"},
+	{unicode.Thai, "tha"},
+	{unicode.Devanagari, "hin"},
+	{unicode.Bengali, "ben"},
+	{unicode.Tamil, "tam"},
+	{unicode.Armenian, "hye"},
+	{unicode.Georgian, "kat"},
+	{unicode.Latin, ""},
+	{unicode.Cyrillic, ""},
+}
+
+// stopwordIndex maps each stopword of a script to the languages it belongs
+// to.
+var stopwordIndex = func() map[*unicode.RangeTable]map[string][]string {
+	index := make(map[*unicode.RangeTable]map[string][]string)
+	for script, languages := range languageStopwords {
+		index[script] = make(map[string][]string)
+		for language, words := range languages {
+			for _, word := range words {
+				index[script][word] = append(index[script][word], language)
+			}
+		}
+	}
+	return index
+}()
+
+// IdentifyLanguage
+// Returns the ISO 639-3 code of the language that text is written in, or
+// LanguageUndetermined. The dominant script decides the language outright
+// where only one major language uses it; Japanese is told apart from
+// Chinese by its kana. Latin and Cyrillic text is scored by how many of its
+// words are frequent words of each language.
+func IdentifyLanguage(text string) string {
+	scriptCounts := make([]int, len(scriptLanguages))
+	for _, r := range text {
+		if !unicode.IsLetter(r) {
+			continue
+		}
+		for scriptIdx, script := range scriptLanguages {
+			if unicode.Is(script.script, r) {
+				scriptCounts[scriptIdx]++
+				break
+			}
+		}
+	}
+	dominant := -1
+	for scriptIdx, count := range scriptCounts {
+		if count > 0 && (dominant == -1 || count > scriptCounts[dominant]) {
+			dominant = scriptIdx
+		}
+	}
+	if dominant == -1 {
+		return LanguageUndetermined
+	}
+	script := scriptLanguages[dominant]
+	if script.script == unicode.Han {
+		kana := 0
+		for scriptIdx, candidate := range scriptLanguages {
+			if candidate.language == "jpn" {
+				kana += scriptCounts[scriptIdx]
+			}
+		}
+		if kana*10 >= scriptCounts[dominant] {
+			return "jpn"
+		}
+	}
+	if script.language != "" {
+		return script.language
+	}
+
+	index := stopwordIndex[script.script]
+	scores := make(map[string]int)
+	words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && r != '\''
+	})
+	for _, word := range words {
+		for _, language := range index[word] {
+			scores[language]++
+		}
+	}
+	best, bestScore := LanguageUndetermined, 0
+	for language, score := range scores {
+		// Ties are broken by code, so that the result is deterministic.
+		if score > bestScore || score == bestScore && language < best {
+			best, bestScore = language, score
+		}
+	}
+	// Too few frequent words to tell the language apart with confidence.
+	if bestScore < 3 && bestScore*10 < len(words) {
+		return LanguageUndetermined
+	}
+	return best
+}
+
+// LanguageFilter
+// Identifies the language of each document from a sample of its first
+// runes, and drops those that are not allowed. When Allow is empty, every
+// language that is not in Deny is allowed. The number of documents kept and
+// dropped of each language is counted as they are filtered.
+type LanguageFilter struct {
+	Allow       map[string]bool
+	Deny        map[string]bool
+	SampleRunes int
+	Kept        map[string]int
+	Dropped     map[string]int
+}
+
+// NewLanguageFilter
+// Creates a LanguageFilter that allows and denies the given ISO 639-3
+// language codes.
+func NewLanguageFilter(allow []string, deny []string) *LanguageFilter {
+	filter := &LanguageFilter{
+		Allow:       make(map[string]bool),
+		Deny:        make(map[string]bool),
+		SampleRunes: DefaultLanguageSample,
+		Kept:        make(map[string]int),
+		Dropped:     make(map[string]int),
+	}
+	for _, language := range allow {
+		filter.Allow[strings.TrimSpace(language)] = true
+	}
+	for _, language := range deny {
+		filter.Deny[strings.TrimSpace(language)] = true
+	}
+	return filter
+}
+
+// Allows
+// Returns whether documents in the given language are kept.
+func (filter *LanguageFilter) Allows(language string) bool {
+	if filter.Deny[language] {
+		return false
+	}
+	return len(filter.Allow) == 0 || filter.Allow[language]
+}
+
+// prefixedRuneReader yields the runes of prefix, and then those of reader.
+type prefixedRuneReader struct {
+	prefix []rune
+	reader io.RuneReader
+}
+
+func (prefixed *prefixedRuneReader) ReadRune() (rune, int, error) {
+	if len(prefixed.prefix) > 0 {
+		r := prefixed.prefix[0]
+		prefixed.prefix = prefixed.prefix[1:]
+		return r, len(string(r)), nil
+	}
+	return prefixed.reader.ReadRune()
+}
+
+// Filter
+// Identifies the language of the document in reader, returning the
+// language, and a reader over the whole document if it is allowed, or nil
+// if it is dropped.
+func (filter *LanguageFilter) Filter(
+	reader io.RuneReader) (io.RuneReader, string) {
+	sample := make([]rune, 0, filter.SampleRunes)
+	var err error
+	for len(sample) < filter.SampleRunes {
+		var r rune
+		if r, _, err = reader.ReadRune(); err != nil {
+			break
+		}
+		sample = append(sample, r)
+	}
+	language := IdentifyLanguage(string(sample))
+	if !filter.Allows(language) {
+		filter.Dropped[language]++
+		return nil, language
+	}
+	filter.Kept[language]++
+	if err != nil {
+		// The whole document fit in the sample.
+		return strings.NewReader(string(sample)), language
+	}
+	return &prefixedRuneReader{sample, reader}, language
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"io"
+)
+
+// LossMaskSuffix is the suffix of the path of the loss masks of binary
+// contexts, which are uncompressed, and are written as tokens are.
+const LossMaskSuffix = ".lossmask"
+
+// promptBytesKey is the metadata key of the length in bytes of the prompt
+// that a prompt and completion document starts with. It is only carried
+// from the reader to the tokenizer, and is not written to the document
+// index.
+const promptBytesKey = "_prompt_bytes"
+
+// LossMasks
+// Passes the loss mask of each context from the TextsTokenizer that
+// tokenizes prompt and completion documents to the ContextsWriter that
+// writes the contexts, in the order of the contexts. A mask is 0 for the
+// tokens of prompts and for padding, and 1 for the tokens of completions,
+// and of other documents, along with their end of text tokens.
+type LossMasks struct {
+	pending [][]int64
+}
+
+// push queues the loss mask of the context that is returned next.
+func (masks *LossMasks) push(mask []int64) {
+	masks.pending = append(masks.pending, mask)
+}
+
+// next returns the loss mask of the context that was returned last, or nil
+// if there is none.
+func (masks *LossMasks) next() []int64 {
+	if len(masks.pending) == 0 {
+		return nil
+	}
+	mask := masks.pending[0]
+	masks.pending = masks.pending[1:]
+	return mask
+}
+
+// promptBytes returns the length in bytes of the prompt of a document from
+// its metadata, which is a float64 once it has been through JSON, as when
+// documents are shuffled.
+func promptBytes(metadata map[string]interface{}) (int, bool) {
+	switch length := metadata[promptBytesKey].(type) {
+	case int:
+		return length, true
+	case float64:
+		return int(length), true
+	}
+	return 0, false
+}
+
+// withoutPromptBytes returns metadata without the length of the prompt, or
+// nil if that leaves it empty.
+func withoutPromptBytes(
+	metadata map[string]interface{}) map[string]interface{} {
+	if _, ok := metadata[promptBytesKey]; !ok {
+		return metadata
+	}
+	stripped := make(map[string]interface{}, len(metadata)-1)
+	for key, value := range metadata {
+		if key != promptBytesKey {
+			stripped[key] = value
+		}
+	}
+	if len(stripped) == 0 {
+		return nil
+	}
+	return stripped
+}
+
+// splitPrompt reads the document of reader, and returns its prompt and
+// completion, or false without reading it if it is not a prompt and
+// completion document.
+func splitPrompt(reader io.RuneReader) (string, string, bool) {
+	length, ok := promptBytes(readerMetadata(reader))
+	if !ok {
+		return "", "", false
+	}
+	document := readDocument(reader)
+	if length > len(document) {
+		length = len(document)
+	}
+	return document[:length], document[length:], true
+}
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"github.com/wbrown/gpt_bpe"
+	"github.com/wbrown/gpt_bpe/dataset"
+)
+
+const ManifestSuffix = ".manifest.json"
+
+// ManifestInput
+// Records an input file that was consumed by a tokenization run.
+type ManifestInput struct {
+	Path    string    `json:"path"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+	SHA256  string    `json:"sha256"`
+}
+
+// ManifestTokenizer
+// Records the tokenizer that was used for a tokenization run.
+type ManifestTokenizer struct {
+	Id          string `json:"id"`
+	Fingerprint string `json:"fingerprint"`
+	DataVersion int    `json:"data_version,omitempty"`
+	ResourceId  uint16 `json:"resource_id,omitempty"`
+}
+
+// ManifestBuild
+// Records the build of the dataset_tokenizer binary that performed the run,
+// and the release of gpt_bpe that it was built with.
+type ManifestBuild struct {
+	GoVersion     string `json:"go_version"`
+	GptBpeVersion string `json:"gpt_bpe_version"`
+	Module        string `json:"module,omitempty"`
+	Version       string `json:"version,omitempty"`
+	VcsRevision   string `json:"vcs_revision,omitempty"`
+	VcsTime       string `json:"vcs_time,omitempty"`
+	VcsModified   bool   `json:"vcs_modified,omitempty"`
+}
+
+// ManifestShard
+// Records an output file written by a tokenization run, and the inputs that
+// were tokenized into it.
+type ManifestShard struct {
+	Path      string    `json:"path"`
+	Tokens    int       `json:"tokens"`
+	Inputs    []string  `json:"inputs"`
+	CreatedAt time.Time `json:"created_at"`
+	Seconds   float64   `json:"seconds"`
+	// Bytes is the size of the shard once it was synced to disk, recorded
+	// by checkpointed runs to verify the shard when they are resumed.
+	Bytes int64 `json:"bytes,omitempty"`
+}
+
+// RunManifest
+// Records the full provenance of a tokenization run: what was read, how it
+// was tokenized, by which build, and how long it took. It is written next to
+// the output so that a dataset can be audited and reproduced later.
+type RunManifest struct {
+	Command    []string          `json:"command"`
+	Flags      map[string]string `json:"flags"`
+	Build      ManifestBuild     `json:"build"`
+	InputGlobs []string          `json:"input_globs"`
+	Inputs     []ManifestInput   `json:"inputs"`
+	Tokenizer  ManifestTokenizer `json:"tokenizer"`
+	Output     string            `json:"output"`
+	Shards     []ManifestShard   `json:"shards,omitempty"`
+	// CheckpointInputs is the number of inputs of each shard of a
+	// checkpointed run, which can be resumed from its last shard.
+	CheckpointInputs int `json:"checkpoint_inputs,omitempty"`
+	// Router routes the documents of a run with -route_shards to its
+	// shards, so that the shard holding a document can be located.
+	Router      *dataset.Router `json:"router,omitempty"`
+	Languages   map[string]int  `json:"languages,omitempty"`
+	ContextSize int             `json:"context_size"`
+	TotalTokens int             `json:"total_tokens"`
+	StartedAt   time.Time       `json:"started_at"`
+	FinishedAt  time.Time       `json:"finished_at"`
+	UpdatedAt   time.Time       `json:"updated_at,omitempty"`
+	Seconds     float64         `json:"seconds"`
+}
+
+// NewRunManifest
+// Creates a RunManifest for the current process, capturing the command line,
+// the effective value of every flag, and the build information.
+func NewRunManifest() *RunManifest {
+	flags := make(map[string]string)
+	flag.VisitAll(func(f *flag.Flag) {
+		flags[f.Name] = f.Value.String()
+	})
+	return &RunManifest{
+		Command:   os.Args,
+		Flags:     flags,
+		Build:     GetManifestBuild(),
+		StartedAt: time.Now().UTC(),
+	}
+}
+
+// GetManifestBuild
+// Returns the Go version, module version and version control information
+// that was stamped into the running binary.
+func GetManifestBuild() ManifestBuild {
+	build := ManifestBuild{GoVersion: runtime.Version(),
+		GptBpeVersion: gpt_bpe.Version()}
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return build
+	}
+	build.Module = info.Main.Path
+	build.Version = info.Main.Version
+	for _, setting := range info.Settings {
+		switch setting.Key {
+		case "vcs.revision":
+			build.VcsRevision = setting.Value
+		case "vcs.time":
+			build.VcsTime = setting.Value
+		case "vcs.modified":
+			build.VcsModified = setting.Value == "true"
+		}
+	}
+	return build
+}
+
+// SetTokenizer
+// Records the tokenizer id, its fingerprint and the version of its data,
+// along with the stable number of embedded tokenizers.
+func (manifest *RunManifest) SetTokenizer(id string,
+	encoder *gpt_bpe.GPTEncoder) {
+	manifest.Tokenizer = ManifestTokenizer{
+		Id:          id,
+		Fingerprint: encoder.Fingerprint(),
+		DataVersion: encoder.DataVersion,
+		ResourceId:  gpt_bpe.EmbeddedResourceIds[id],
+	}
+}
+
+// Finish
+// Records the totals and the timing of the run.
+func (manifest *RunManifest) Finish(totalTokens int) {
+	manifest.TotalTokens = totalTokens
+	manifest.FinishedAt = time.Now().UTC()
+	manifest.Seconds = manifest.FinishedAt.Sub(manifest.StartedAt).Seconds()
+}
+
+// AddLanguages
+// Adds the number of documents tokenized in each identified language.
+func (manifest *RunManifest) AddLanguages(counts map[string]int) {
+	if manifest.Languages == nil {
+		manifest.Languages = make(map[string]int)
+	}
+	for language, count := range counts {
+		manifest.Languages[language] += count
+	}
+}
+
+// AddShard
+// Records an output shard that was written from the given inputs, adding
+// its tokens to the manifest's total.
+func (manifest *RunManifest) AddShard(path string, tokens int,
+	inputs []ManifestInput, startedAt time.Time) {
+	inputPaths := make([]string, len(inputs))
+	for idx := range inputs {
+		inputPaths[idx] = inputs[idx].Path
+	}
+	now := time.Now().UTC()
+	manifest.Shards = append(manifest.Shards, ManifestShard{
+		Path:      path,
+		Tokens:    tokens,
+		Inputs:    inputPaths,
+		CreatedAt: now,
+		Seconds:   now.Sub(startedAt).Seconds(),
+	})
+	manifest.TotalTokens += tokens
+	manifest.UpdatedAt = now
+}
+
+// NextShardPath
+// Returns the path for the next shard appended to the manifest's output,
+// which is the output with the shard's index, as ShardPath gives it.
+func (manifest *RunManifest) NextShardPath() string {
+	shardIdx := len(manifest.Shards)
+	if shardIdx == 0 {
+		// Manifests from before shards were recorded hold a single output.
+		shardIdx = 1
+	}
+	return ShardPath(manifest.Output, shardIdx)
+}
+
+// PendingInputs
+// Returns the inputs in current that are not recorded in the manifest, or
+// whose contents changed since they were recorded.
+func (manifest *RunManifest) PendingInputs(
+	current []ManifestInput) []ManifestInput {
+	recorded := make(map[string]string, len(manifest.Inputs))
+	for _, input := range manifest.Inputs {
+		recorded[input.Path] = input.SHA256
+	}
+	pending := make([]ManifestInput, 0)
+	for _, input := range current {
+		if digest, ok := recorded[input.Path]; !ok || digest != input.SHA256 {
+			pending = append(pending, input)
+		}
+	}
+	return pending
+}
+
+// CheckAppendable
+// Returns an error if tokens produced by the given tokenizer and context
+// size cannot be appended to the manifest's dataset.
+func (manifest *RunManifest) CheckAppendable(encoder *gpt_bpe.GPTEncoder,
+	contextSize int) error {
+	if fingerprint := encoder.Fingerprint(); fingerprint !=
+		manifest.Tokenizer.Fingerprint {
+		return errors.New(fmt.Sprintf(
+			"tokenizer fingerprint %s does not match the manifest's %s",
+			fingerprint, manifest.Tokenizer.Fingerprint))
+	}
+	if contextSize != manifest.ContextSize {
+		return errors.New(fmt.Sprintf(
+			"context size %d does not match the manifest's %d",
+			contextSize, manifest.ContextSize))
+	}
+	return nil
+}
+
+// Write
+// Serializes the manifest as indented JSON to the given path. The manifest
+// is written to a temporary file that replaces path, so that a run that is
+// interrupted never leaves a partially written manifest.
+func (manifest *RunManifest) Write(path string) error {
+	manifestBytes, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	tempPath := path + ".tmp"
+	if err = os.WriteFile(tempPath, append(manifestBytes, '\n'),
+		0644); err != nil {
+		return err
+	}
+	return os.Rename(tempPath, path)
+}
+
+// ReadRunManifest
+// Reads a manifest previously written by RunManifest.Write.
+func ReadRunManifest(path string) (*RunManifest, error) {
+	manifestBytes, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var manifest RunManifest
+	if err := json.Unmarshal(manifestBytes, &manifest); err != nil {
+		return nil, err
+	}
+	return &manifest, nil
+}
+
+// HashFile
+// Returns the hex encoded SHA-256 digest of the file at path.
+func HashFile(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// HashInputs
+// Hashes every input file using a small pool of workers, and returns the
+// manifest entries in the same order as pathInfos.
+func HashInputs(pathInfos []PathInfo) ([]ManifestInput, error) {
+	return HashChangedInputs(pathInfos, nil)
+}
+
+// HashChangedInputs
+// Like HashInputs, but reuses the digest of any previously recorded input
+// whose size and modification time are unchanged, rather than rehashing it.
+func HashChangedInputs(pathInfos []PathInfo,
+	previous []ManifestInput) ([]ManifestInput, error) {
+	recorded := make(map[string]ManifestInput, len(previous))
+	for _, input := range previous {
+		recorded[input.Path] = input
+	}
+	inputs := make([]ManifestInput, len(pathInfos))
+	errs := make([]error, len(pathInfos))
+	indexes := make(chan int)
+	wg := sync.WaitGroup{}
+	for worker := 0; worker < runtime.NumCPU(); worker++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for idx := range indexes {
+				pathInfo := pathInfos[idx]
+				digest := ""
+				var err error
+				if input, ok := recorded[pathInfo.Path]; ok &&
+					input.Size == pathInfo.Size &&
+					input.ModTime.Equal(pathInfo.ModTime) {
+					digest = input.SHA256
+				} else {
+					digest, err = HashFile(pathInfo.Path)
+				}
+				errs[idx] = err
+				inputs[idx] = ManifestInput{
+					Path:    pathInfo.Path,
+					Size:    pathInfo.Size,
+					ModTime: pathInfo.ModTime.UTC(),
+					SHA256:  digest,
+				}
+			}
+		}()
+	}
+	for idx := range pathInfos {
+		indexes <- idx
+	}
+	close(indexes)
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	return inputs, nil
+}
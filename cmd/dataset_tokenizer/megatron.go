@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/wbrown/gpt_bpe"
+)
+
+// The files of a Megatron-LM indexed dataset, of its tokens and of the
+// index of its documents, which are named by the prefix that Megatron-LM's
+// --data-path takes.
+const (
+	MegatronBinSuffix = ".bin"
+	MegatronIdxSuffix = ".idx"
+)
+
+// megatronMagic is the header of the index of a Megatron-LM MMapIndexedDataset,
+// which is followed by its version.
+var megatronMagic = []byte("MMIDIDX\x00\x00")
+
+const megatronVersion = 1
+
+// The dtypes that a DocumentsMegatron can write its tokens as, of which
+// DTYPE_MEGATRON_INT32 is written as uint32, which is the same as Megatron-LM's
+// int32 for every token id.
+const (
+	DTYPE_MEGATRON_UINT16 = gpt_bpe.DTYPE_UINT16
+	DTYPE_MEGATRON_INT32  = gpt_bpe.DTYPE_UINT32
+)
+
+// megatronDtypeCodes are the codes that Megatron-LM's index stores for the
+// dtypes of its tokens.
+var megatronDtypeCodes = map[gpt_bpe.TokensDtype]uint8{
+	DTYPE_MEGATRON_UINT16: 8,
+	DTYPE_MEGATRON_INT32:  4,
+}
+
+// DocumentsMegatron
+// Writes the tokens of each document as a sequence of a Megatron-LM indexed
+// dataset, of a .bin file of their tokens and an .idx file of each
+// sequence's length and offset and of the document boundaries, so that it
+// can be read by Megatron-LM and NeMo pretraining without being repacked.
+// Each document is a sequence of its own, and is not packed into contexts,
+// as Megatron-LM samples its contexts across document boundaries itself.
+type DocumentsMegatron struct {
+	Dtype     gpt_bpe.TokensDtype
+	Documents int
+	Tokens    int
+}
+
+// ParseMegatronDtype
+// Parses the dtype of the tokens of a Megatron-LM indexed dataset, which is
+// uint16, or int32 for Megatron-LM configurations that expect it.
+func ParseMegatronDtype(name string) (gpt_bpe.TokensDtype, error) {
+	switch name {
+	case "uint16":
+		return DTYPE_MEGATRON_UINT16, nil
+	case "int32":
+		return DTYPE_MEGATRON_INT32, nil
+	}
+	return 0, errors.New(fmt.Sprintf("invalid megatron dtype %s, "+
+		"expected uint16 or int32", name))
+}
+
+// MegatronPrefix
+// Returns the prefix of the Megatron-LM indexed dataset written to
+// outputPath, which is outputPath without its .bin or .idx suffix.
+func MegatronPrefix(outputPath string) string {
+	return strings.TrimSuffix(strings.TrimSuffix(outputPath,
+		MegatronBinSuffix), MegatronIdxSuffix)
+}
+
+// Write
+// Reads the documents of the given inputs with textsReader, tokenizes them
+// with encoder, and writes them to a new Megatron-LM indexed dataset of the
+// given prefix, replacing any existing one.
+func (mw *DocumentsMegatron) Write(textsReader TextsReader,
+	encoder *gpt_bpe.GPTEncoder, matches []PathInfo, prefix string) error {
+	code, ok := megatronDtypeCodes[mw.Dtype]
+	if !ok {
+		return errors.New(fmt.Sprintf("invalid megatron dtype %s",
+			mw.Dtype))
+	}
+	binFile, err := os.Create(prefix + MegatronBinSuffix)
+	if err != nil {
+		return err
+	}
+	defer binFile.Close()
+	binWriter := bufio.NewWriter(binFile)
+	mw.Documents, mw.Tokens = 0, 0
+	sizes := make([]int32, 0)
+	if err := encodeDocuments(textsReader, encoder, matches,
+		func(_ string, _ string, tokens gpt_bpe.Tokens) error {
+			data, err := gpt_bpe.MarshalTokens(tokens, mw.Dtype)
+			if err != nil {
+				return err
+			} else if _, err = binWriter.Write(data); err != nil {
+				return err
+			}
+			sizes = append(sizes, int32(len(tokens)))
+			mw.Documents++
+			mw.Tokens += len(tokens)
+			return nil
+		}); err != nil {
+		return err
+	}
+	if err := binWriter.Flush(); err != nil {
+		return err
+	} else if err := binFile.Close(); err != nil {
+		return err
+	}
+	return writeMegatronIndex(prefix+MegatronIdxSuffix, code,
+		mw.Dtype, sizes)
+}
+
+// writeMegatronIndex writes the index of a Megatron-LM indexed dataset of
+// sequences of the given sizes, each of which is a document.
+func writeMegatronIndex(idxPath string, code uint8,
+	dtype gpt_bpe.TokensDtype, sizes []int32) error {
+	itemSize := int64(2)
+	if dtype == DTYPE_MEGATRON_INT32 {
+		itemSize = 4
+	}
+	pointers := make([]int64, len(sizes))
+	offset := int64(0)
+	for idx, size := range sizes {
+		pointers[idx] = offset
+		offset += int64(size) * itemSize
+	}
+	// Every sequence is a document, so the boundaries are every index.
+	documents := make([]int64, len(sizes)+1)
+	for idx := range documents {
+		documents[idx] = int64(idx)
+	}
+	file, err := os.Create(idxPath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	writer := bufio.NewWriter(file)
+	for _, value := range []interface{}{megatronMagic,
+		uint64(megatronVersion), code, uint64(len(sizes)),
+		uint64(len(documents)), sizes, pointers, documents} {
+		if err := binary.Write(writer, binary.LittleEndian,
+			value); err != nil {
+			return err
+		}
+	}
+	if err := writer.Flush(); err != nil {
+		return err
+	}
+	return file.Close()
+}
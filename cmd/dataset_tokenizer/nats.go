@@ -0,0 +1,236 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// DefaultNatsConsumer is the durable consumer of a NATS address that does not
+// name a queue.
+const DefaultNatsConsumer = "dataset_tokenizer"
+
+// DefaultNatsAckWait is how long messages wait for their acknowledgement
+// when shards are not closed after an interval.
+const DefaultNatsAckWait = 24 * time.Hour
+
+// natsFetchBatch is the most messages fetched from the consumer at once, and
+// natsFetchWait how long a fetch waits for them.
+const (
+	natsFetchBatch = 64
+	natsFetchWait  = time.Second
+)
+
+// NatsSource
+// Consumes documents from a subject of a NATS JetStream stream, one document
+// per message, through a durable pull consumer. Tokenizers that share the
+// consumer share the messages of the subject. The messages of a shard's
+// documents are only acknowledged by Ack, once the shard is synced, and
+// messages that are not acknowledged in time are delivered again.
+type NatsSource struct {
+	Subject  string
+	Queue    string
+	conn     *nats.Conn
+	sub      *nats.Subscription
+	messages chan *nats.Msg
+	consumed []*nats.Msg
+	stop     chan struct{}
+	err      error
+	stopped  bool
+	mutex    sync.Mutex
+}
+
+// DialNats
+// Connects to the NATS server and subscribes to the subject given by a URL
+// of the form `nats://[user:pass@]host[:port]/subject[?queue=consumer]`,
+// through the durable consumer named by queue, or DefaultNatsConsumer, which
+// is created if the stream has none by that name. A user without a password
+// is sent as an authentication token. Messages that are not acknowledged
+// within ackWait of their delivery are delivered again.
+func DialNats(address string, ackWait time.Duration) (*NatsSource, error) {
+	natsUrl, err := url.Parse(address)
+	if err != nil {
+		return nil, err
+	} else if natsUrl.Scheme != "nats" {
+		return nil, errors.New(fmt.Sprintf(
+			"NATS address must start with nats://, not %s", address))
+	}
+	subject := strings.Trim(natsUrl.Path, "/")
+	if subject == "" {
+		return nil, errors.New(fmt.Sprintf(
+			"NATS address %s does not name a subject", address))
+	}
+	queue := natsUrl.Query().Get("queue")
+	if queue == "" {
+		queue = DefaultNatsConsumer
+	}
+	server := url.URL{Scheme: natsUrl.Scheme, User: natsUrl.User,
+		Host: natsUrl.Host}
+	conn, err := nats.Connect(server.String(), nats.Name("dataset_tokenizer"))
+	if err != nil {
+		return nil, err
+	}
+	js, err := conn.JetStream()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	sub, err := js.PullSubscribe(subject, queue, nats.AckExplicit(),
+		nats.AckWait(ackWait), nats.MaxAckPending(-1))
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	source := &NatsSource{
+		Subject:  subject,
+		Queue:    queue,
+		conn:     conn,
+		sub:      sub,
+		messages: make(chan *nats.Msg, natsFetchBatch),
+		stop:     make(chan struct{}),
+	}
+	go source.fetchLoop()
+	return source, nil
+}
+
+// fetchLoop fetches messages from the consumer and queues them for the shard
+// iterators, until the source is stopped or a fetch fails.
+func (source *NatsSource) fetchLoop() {
+	defer close(source.messages)
+	for {
+		select {
+		case <-source.stop:
+			return
+		default:
+		}
+		messages, err := source.sub.Fetch(natsFetchBatch,
+			nats.MaxWait(natsFetchWait))
+		if err != nil && !errors.Is(err, nats.ErrTimeout) {
+			source.mutex.Lock()
+			if source.err == nil && !source.stopped {
+				source.err = err
+			}
+			source.mutex.Unlock()
+			return
+		}
+		for idx, message := range messages {
+			select {
+			case source.messages <- message:
+			case <-source.stop:
+				// Messages that no shard will hold are delivered again
+				// without waiting for their acknowledgement.
+				for _, unread := range messages[idx:] {
+					unread.Nak()
+				}
+				return
+			}
+		}
+	}
+}
+
+// Stop
+// Stops fetching messages. Documents that were already fetched are still
+// returned by the shard iterators, and can be acknowledged until the source
+// is closed.
+func (source *NatsSource) Stop() {
+	source.mutex.Lock()
+	defer source.mutex.Unlock()
+	if !source.stopped {
+		source.stopped = true
+		close(source.stop)
+	}
+}
+
+// Close
+// Stops fetching messages and closes the connection. The consumer remains on
+// the server, and its unacknowledged messages are delivered again.
+func (source *NatsSource) Close() {
+	source.Stop()
+	source.conn.Close()
+}
+
+// Err
+// Returns the error that ended the subscription, if any.
+func (source *NatsSource) Err() error {
+	source.mutex.Lock()
+	defer source.mutex.Unlock()
+	return source.err
+}
+
+// Ack
+// Acknowledges the messages of every document that the shard iterators have
+// returned since the last Ack, so that they are not delivered again. Called
+// once the shards holding them are synced.
+func (source *NatsSource) Ack() error {
+	source.mutex.Lock()
+	consumed := source.consumed
+	source.consumed = nil
+	source.mutex.Unlock()
+	for _, message := range consumed {
+		if err := message.Ack(); err != nil {
+			return err
+		}
+	}
+	return source.conn.Flush()
+}
+
+// next waits for the next message, recording it to be acknowledged.
+func (source *NatsSource) next(deadline <-chan time.Time) (*nats.Msg, bool) {
+	select {
+	case message, ok := <-source.messages:
+		if !ok {
+			return nil, false
+		}
+		source.mutex.Lock()
+		source.consumed = append(source.consumed, message)
+		source.mutex.Unlock()
+		return message, true
+	case <-deadline:
+		return nil, false
+	}
+}
+
+// NextShard
+// Waits for the next document, and returns a TextsIterator over the
+// documents of a single shard: those received until their text totals at
+// least maxBytes, or until maxInterval has passed since the first of them.
+// Documents are filtered by the texts reader. Returns nil when the source
+// is stopped and every document has been consumed.
+func (source *NatsSource) NextShard(tr TextsReader, maxBytes int64,
+	maxInterval time.Duration) TextsIterator {
+	first, ok := source.next(nil)
+	if !ok {
+		return nil
+	}
+	var deadline <-chan time.Time
+	if maxInterval > 0 {
+		deadline = time.After(maxInterval)
+	}
+	pending := first
+	var size int64
+	return func() io.RuneReader {
+		for {
+			message := pending
+			pending = nil
+			if message == nil {
+				if size >= maxBytes {
+					return nil
+				} else if message, ok = source.next(deadline); !ok {
+					return nil
+				}
+			}
+			document := string(message.Data)
+			size += int64(len(document))
+			reader := tr.filterDocument(tr.documentReader(document))
+			if reader != nil {
+				return reader
+			}
+		}
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// outputPlaceholder matches a placeholder of an output template, with the
+// zero padded width of a {shard:05d}.
+var outputPlaceholder = regexp.MustCompile(
+	`\{(shard|tokenizer|date)(?::0(\d+)d)?\}`)
+
+// unsafePathChars are the characters of a tokenizer id that are replaced in
+// paths, as they separate directories or are not allowed in file names.
+var unsafePathChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// OutputTemplate
+// An -output path with placeholders: {tokenizer} is the tokenizer id, with
+// the characters that are unsafe in a file name replaced by _, {date} is the
+// UTC date that the run began, as 2006-01-02, and {shard}, or {shard:05d}
+// zero padded to a width, is the index of each shard. An output without
+// {shard} has its shards written to it suffixed with their index.
+type OutputTemplate struct {
+	template  string
+	tokenizer string
+	date      string
+}
+
+// NewOutputTemplate
+// Parses template, failing on braces that are not one of its placeholders,
+// or on a width given to a placeholder other than {shard}.
+func NewOutputTemplate(template string, tokenizerId string,
+	date time.Time) (*OutputTemplate, error) {
+	outputTemplate := &OutputTemplate{
+		template:  template,
+		tokenizer: unsafePathChars.ReplaceAllString(tokenizerId, "_"),
+		date:      date.UTC().Format("2006-01-02"),
+	}
+	shards := 0
+	for _, match := range outputPlaceholder.FindAllStringSubmatch(
+		template, -1) {
+		if match[1] == "shard" {
+			shards++
+		} else if match[2] != "" {
+			return nil, errors.New(fmt.Sprintf(
+				"output template %s: {%s} has no width", template, match[1]))
+		}
+	}
+	if shards > 1 {
+		return nil, errors.New(fmt.Sprintf(
+			"output template %s: more than one {shard}", template))
+	}
+	if rest := outputPlaceholder.ReplaceAllString(template,
+		""); strings.ContainsAny(rest, "{}") {
+		return nil, errors.New(fmt.Sprintf(
+			"output template %s: unknown placeholder, expected {shard}, "+
+				"{shard:05d}, {tokenizer} or {date}", template))
+	}
+	return outputTemplate, nil
+}
+
+// IsTemplate
+// Returns whether the template has any placeholders.
+func (outputTemplate *OutputTemplate) IsTemplate() bool {
+	return outputPlaceholder.MatchString(outputTemplate.template)
+}
+
+// HasDate
+// Returns whether the template has a {date}, which expands differently on
+// each day that it is run.
+func (outputTemplate *OutputTemplate) HasDate() bool {
+	return strings.Contains(outputTemplate.template, "{date}")
+}
+
+// Output
+// Returns the output with {tokenizer} and {date} expanded, keeping its
+// {shard} to be expanded by ShardPath, as runs record it in their manifest.
+func (outputTemplate *OutputTemplate) Output() string {
+	return outputPlaceholder.ReplaceAllStringFunc(outputTemplate.template,
+		func(placeholder string) string {
+			switch {
+			case placeholder == "{tokenizer}":
+				return outputTemplate.tokenizer
+			case placeholder == "{date}":
+				return outputTemplate.date
+			default:
+				return placeholder
+			}
+		})
+}
+
+// ShardPath
+// Returns the path of the shard with index shard of output, which is output
+// with its {shard} expanded, or output suffixed with the index if it has no
+// {shard}.
+func ShardPath(output string, shard int) string {
+	for _, match := range outputPlaceholder.FindAllStringSubmatchIndex(
+		output, -1) {
+		if output[match[2]:match[3]] != "shard" {
+			continue
+		}
+		width := 0
+		if match[4] >= 0 {
+			width, _ = strconv.Atoi(output[match[4]:match[5]])
+		}
+		return output[:match[0]] + fmt.Sprintf("%0*d", width, shard) +
+			output[match[1]:]
+	}
+	return fmt.Sprintf("%s.%04d", output, shard)
+}
+
+// SingleOutputPath
+// Returns the path that a run writing a single shard writes it to, which is
+// output with its {shard} expanded to 0, or output itself.
+func SingleOutputPath(output string) string {
+	if !strings.Contains(output, "{shard") {
+		return output
+	}
+	return ShardPath(output, 0)
+}
+
+// OutputManifestPath
+// Returns the path of the run manifest of output, which is output without its
+// {shard}, suffixed with ManifestSuffix.
+func OutputManifestPath(output string) string {
+	return outputPlaceholder.ReplaceAllStringFunc(output,
+		func(placeholder string) string {
+			if strings.HasPrefix(placeholder, "{shard") {
+				return ""
+			}
+			return placeholder
+		}) + ManifestSuffix
+}
+
+// CheckOutputCollision
+// Fails if the run manifest at manifestPath was written by a run with another
+// tokenizer id, as when two tokenizer ids sanitize to the same {tokenizer},
+// so that one run does not overwrite the output of another.
+func CheckOutputCollision(manifestPath string, tokenizerId string) error {
+	manifest, err := ReadRunManifest(manifestPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if manifest.Tokenizer.Id != tokenizerId {
+		return errors.New(fmt.Sprintf("output collision: %s was written "+
+			"with tokenizer %s, not %s, use -retokenize to overwrite it",
+			manifestPath, manifest.Tokenizer.Id, tokenizerId))
+	}
+	return nil
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"sync"
+
+	"github.com/wbrown/gpt_bpe"
+)
+
+// The modes of packing documents into contexts. PackingNone concatenates the
+// documents into a stream that is cut into contexts, splitting documents
+// across them, while the bin-packing modes place each document whole in a
+// context that has room for it, as the first that does or the one that it
+// fills the most.
+const (
+	PackingNone     = ""
+	PackingFirstFit = "first_fit"
+	PackingBestFit  = "best_fit"
+)
+
+// DefaultPackingBins is the number of contexts that are open to documents at
+// once when bin-packing by default.
+const DefaultPackingBins = 64
+
+// CheckPacking
+// Returns an error if packing is not a valid packing mode, or bins is not a
+// valid number of open contexts for it.
+func CheckPacking(packing string, bins int) error {
+	switch packing {
+	case PackingNone:
+		return nil
+	case PackingFirstFit, PackingBestFit:
+		if bins < 1 {
+			return errors.New(fmt.Sprintf("invalid number of packing bins "+
+				"%d, must be positive", bins))
+		}
+		return nil
+	}
+	return errors.New(fmt.Sprintf("invalid packing %s, expected %s or %s",
+		packing, PackingFirstFit, PackingBestFit))
+}
+
+// contextPacker
+// Bin-packs documents into contexts of contextSize tokens, keeping up to
+// bins contexts open to documents. When a document fits none of them, the
+// oldest context is closed for first-fit packing, and the fullest for
+// best-fit packing, to make room for a new one.
+type contextPacker struct {
+	contextSize int
+	bins        int
+	bestFit     bool
+	padToken    gpt_bpe.Token
+	open        []gpt_bpe.Tokens
+	closed      []gpt_bpe.Tokens
+}
+
+// add packs a document, or a piece of one, of at most contextSize tokens.
+func (packer *contextPacker) add(document gpt_bpe.Tokens) {
+	fit := -1
+	for idx, bin := range packer.open {
+		room := packer.contextSize - len(bin)
+		if room < len(document) {
+			continue
+		}
+		if !packer.bestFit {
+			fit = idx
+			break
+		} else if fit < 0 || len(bin) > len(packer.open[fit]) {
+			fit = idx
+		}
+	}
+	if fit < 0 {
+		if len(packer.open) == packer.bins {
+			evict := 0
+			if packer.bestFit {
+				for idx, bin := range packer.open {
+					if len(bin) > len(packer.open[evict]) {
+						evict = idx
+					}
+				}
+			}
+			packer.close(evict)
+		}
+		packer.open = append(packer.open,
+			make(gpt_bpe.Tokens, 0, packer.contextSize))
+		fit = len(packer.open) - 1
+	}
+	packer.open[fit] = append(packer.open[fit], document...)
+	if len(packer.open[fit]) == packer.contextSize {
+		packer.close(fit)
+	}
+}
+
+// emit pads context out to contextSize tokens, and queues it to be
+// returned.
+func (packer *contextPacker) emit(context gpt_bpe.Tokens) {
+	for len(context) < packer.contextSize {
+		context = append(context, packer.padToken)
+	}
+	packer.closed = append(packer.closed, context)
+}
+
+// close closes the idx'th open context.
+func (packer *contextPacker) close(idx int) {
+	packer.emit(packer.open[idx])
+	packer.open = append(packer.open[:idx], packer.open[idx+1:]...)
+}
+
+// flush closes every open context, in the order that they were opened.
+func (packer *contextPacker) flush() {
+	for len(packer.open) > 0 {
+		packer.close(0)
+	}
+}
+
+// PackTexts
+// Consumes a TextsIterator and produces a ContextsIterator that bin-packs
+// its documents into contexts of `contextSize` tokens, by the Packing mode,
+// each followed by the end of text token, and padded out with the padding
+// token. Documents that are longer than a context are split into as many
+// contexts of their own as they fill, aligned to valid unicode if Unitrim is
+// set, and the remainder is packed. The contexts are returned as they are
+// closed, so documents are reordered within the window of open contexts.
+func (tt TextsTokenizer) PackTexts(
+	nextText TextsIterator) (ContextsIterator, error) {
+	if err := CheckPacking(tt.Packing, tt.PackingBins); err != nil {
+		return nil, err
+	} else if tt.Packing == PackingNone {
+		return nil, errors.New("no packing mode to pack texts by")
+	} else if tt.DocumentIndex != nil {
+		return nil, errors.New("a document index cannot be written for " +
+			"packed contexts")
+	}
+	tokenizer, err := tt.InitTokenizer()
+	if err != nil {
+		return nil, err
+	}
+	padToken, endOfText, err := tt.SpecialTokens()
+	if err != nil {
+		return nil, err
+	}
+	contextSize := tt.ContextSize
+	packer := &contextPacker{
+		contextSize: contextSize,
+		bins:        tt.PackingBins,
+		bestFit:     tt.Packing == PackingBestFit,
+		padToken:    padToken,
+	}
+	done := false
+	return func() *gpt_bpe.Tokens {
+		for len(packer.closed) == 0 {
+			if done {
+				return nil
+			}
+			runeReader := nextText()
+			if runeReader == nil {
+				packer.flush()
+				done = true
+				continue
+			}
+			document := *tokenizer.EncodeReader(runeReader)
+			document = append(document, endOfText)
+			for len(document) > contextSize {
+				piece := document[:contextSize]
+				endAt := contextSize
+				if tt.Unitrim {
+					piece, endAt = tokenizer.AlignAndSizeTokens(&document,
+						contextSize)
+				}
+				if endAt == 0 {
+					// No prefix is valid unicode, so the piece is cut at
+					// the context size.
+					piece, endAt = document[:contextSize], contextSize
+				}
+				packer.emit(append(make(gpt_bpe.Tokens, 0, contextSize),
+					piece...))
+				document = document[endAt:]
+			}
+			packer.add(document)
+		}
+		context := packer.closed[0]
+		packer.closed = packer.closed[1:]
+		return &context
+	}, nil
+}
+
+// PackingReport
+// Tallies how efficiently documents are packed into contexts: how many of
+// their tokens are document tokens, how many are end of text separators, and
+// how many are padding, along with a histogram of the number of document
+// fragments in each context. A fragment is a run of document tokens that
+// ends with an end of text token or at the end of the context. Padding is
+// the run of pad tokens that ends a context, so a pad token that is also the
+// end of text token is counted as padding there.
+type PackingReport struct {
+	ContextSize int           `json:"context_size"`
+	PadToken    gpt_bpe.Token `json:"pad_token"`
+	EndOfText   gpt_bpe.Token `json:"end_of_text"`
+	Contexts    int64         `json:"contexts"`
+	Tokens      int64         `json:"tokens"`
+	Separators  int64         `json:"separators"`
+	Padding     int64         `json:"padding"`
+	// Fragments counts the contexts by their number of document fragments.
+	Fragments map[int]int64 `json:"fragments"`
+	mutex     sync.Mutex
+}
+
+// NewPackingReport
+// Creates an empty PackingReport for contexts of contextSize tokens.
+func NewPackingReport(contextSize int, padToken gpt_bpe.Token,
+	endOfText gpt_bpe.Token) *PackingReport {
+	return &PackingReport{
+		ContextSize: contextSize,
+		PadToken:    padToken,
+		EndOfText:   endOfText,
+		Fragments:   make(map[int]int64),
+	}
+}
+
+// Add
+// Tallies a packed context.
+func (report *PackingReport) Add(context gpt_bpe.Tokens) {
+	end := len(context)
+	for end > 0 && context[end-1] == report.PadToken {
+		end--
+	}
+	separators, fragments := 0, 0
+	for idx, token := range context[:end] {
+		if token == report.EndOfText {
+			separators++
+			fragments++
+		} else if idx == end-1 {
+			fragments++
+		}
+	}
+	report.mutex.Lock()
+	defer report.mutex.Unlock()
+	report.Contexts++
+	report.Tokens += int64(end - separators)
+	report.Separators += int64(separators)
+	report.Padding += int64(len(context) - end)
+	report.Fragments[fragments]++
+}
+
+// Efficiency
+// Returns the fraction of the tallied tokens that are document tokens.
+func (report *PackingReport) Efficiency() float64 {
+	report.mutex.Lock()
+	defer report.mutex.Unlock()
+	total := report.Tokens + report.Separators + report.Padding
+	if total == 0 {
+		return 0
+	}
+	return float64(report.Tokens) / float64(total)
+}
+
+// Log
+// Logs a summary of the report.
+func (report *PackingReport) Log() {
+	efficiency := report.Efficiency()
+	report.mutex.Lock()
+	defer report.mutex.Unlock()
+	total := report.Tokens + report.Separators + report.Padding
+	if total == 0 {
+		log.Printf("Packing: no contexts")
+		return
+	}
+	log.Printf("Packing: %d contexts of %d tokens, %0.2f%% document tokens, "+
+		"%0.2f%% separators, %0.2f%% padding", report.Contexts,
+		report.ContextSize, efficiency*100,
+		float64(report.Separators)*100/float64(total),
+		float64(report.Padding)*100/float64(total))
+	counts := make([]int, 0, len(report.Fragments))
+	for fragments := range report.Fragments {
+		counts = append(counts, fragments)
+	}
+	sort.Ints(counts)
+	for _, fragments := range counts {
+		log.Printf("Packing: %d contexts of %d document fragments",
+			report.Fragments[fragments], fragments)
+	}
+}
+
+// Write
+// Writes the report to path as JSON.
+func (report *PackingReport) Write(path string) error {
+	efficiency := report.Efficiency()
+	report.mutex.Lock()
+	defer report.mutex.Unlock()
+	reportJson, err := json.MarshalIndent(struct {
+		*PackingReport
+		Efficiency float64 `json:"efficiency"`
+	}{report, efficiency}, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, reportJson, 0644)
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/apache/arrow/go/v14/parquet"
+	"github.com/apache/arrow/go/v14/parquet/file"
+	"github.com/apache/arrow/go/v14/parquet/schema"
+)
+
+// Parquet physical types, as numbered by the Parquet format.
+const (
+	ParquetInt32 = 1
+	ParquetInt64 = 2
+
+	DefaultParquetRowGroupSize = 64 * 1024 * 1024
+)
+
+// ParquetColumn
+// Describes a column of integers, or of lists of integers when List is set,
+// of the given physical type. Lists are written with the standard three
+// level list structure, as `name.list.element`.
+type ParquetColumn struct {
+	Name string
+	Type int
+	List bool
+}
+
+// parquetColumnChunk buffers the values of a column within a row group.
+type parquetColumnChunk struct {
+	values      []int64
+	repetitions []int16
+	definitions []int16
+}
+
+// parquetSink keeps the Parquet file writer from closing the writer that it
+// writes to.
+type parquetSink struct {
+	io.Writer
+}
+
+// ParquetWriter
+// Writes rows of integer and integer list columns as an uncompressed Parquet
+// file, with values in PLAIN encoding, and a row group whenever the buffered
+// values reach RowGroupSize bytes. Metadata is written as the file's key
+// and value metadata.
+type ParquetWriter struct {
+	Columns      []ParquetColumn
+	RowGroupSize int
+	Metadata     map[string]string
+	writer       *file.Writer
+	chunks       []parquetColumnChunk
+	buffered     int
+}
+
+// NewParquetWriter
+// Creates a ParquetWriter writing the given columns to writer.
+func NewParquetWriter(writer io.Writer,
+	columns []ParquetColumn) (*ParquetWriter, error) {
+	fields := make(schema.FieldList, len(columns))
+	for idx, column := range columns {
+		var node schema.Node
+		switch column.Type {
+		case ParquetInt32:
+			node = schema.NewInt32Node(column.Name,
+				parquet.Repetitions.Required, -1)
+		case ParquetInt64:
+			node = schema.NewInt64Node(column.Name,
+				parquet.Repetitions.Required, -1)
+		default:
+			return nil, errors.New(fmt.Sprintf(
+				"unsupported type %d for Parquet column %s", column.Type,
+				column.Name))
+		}
+		if column.List {
+			var err error
+			if node, err = schema.ListOf(node, parquet.Repetitions.Required,
+				-1); err != nil {
+				return nil, err
+			}
+		}
+		fields[idx] = node
+	}
+	root, err := schema.NewGroupNode("schema", parquet.Repetitions.Required,
+		fields, -1)
+	if err != nil {
+		return nil, err
+	}
+	props := parquet.NewWriterProperties(
+		parquet.WithDictionaryDefault(false),
+		parquet.WithCreatedBy("gpt_bpe dataset_tokenizer"))
+	return &ParquetWriter{
+		Columns:      columns,
+		RowGroupSize: DefaultParquetRowGroupSize,
+		Metadata:     make(map[string]string),
+		writer: file.NewParquetWriter(parquetSink{writer}, root,
+			file.WithWriterProps(props)),
+		chunks: make([]parquetColumnChunk, len(columns)),
+	}, nil
+}
+
+// WriteRow
+// Buffers a row, with the values of each column in order. Scalar columns
+// take a single value each.
+func (pw *ParquetWriter) WriteRow(row ...[]int64) error {
+	if len(row) != len(pw.Columns) {
+		return errors.New(fmt.Sprintf(
+			"Parquet row has %d columns instead of %d", len(row),
+			len(pw.Columns)))
+	}
+	for columnIdx, column := range pw.Columns {
+		values := row[columnIdx]
+		chunk := &pw.chunks[columnIdx]
+		if !column.List {
+			if len(values) != 1 {
+				return errors.New(fmt.Sprintf(
+					"Parquet column %s takes a single value, not %d",
+					column.Name, len(values)))
+			}
+		} else if len(values) == 0 {
+			// An empty list is recorded by its levels alone.
+			chunk.repetitions = append(chunk.repetitions, 0)
+			chunk.definitions = append(chunk.definitions, 0)
+		}
+		for valueIdx := range values {
+			if column.List {
+				repetition := int16(1)
+				if valueIdx == 0 {
+					repetition = 0
+				}
+				chunk.repetitions = append(chunk.repetitions, repetition)
+				chunk.definitions = append(chunk.definitions, 1)
+			}
+		}
+		chunk.values = append(chunk.values, values...)
+		if column.Type == ParquetInt32 {
+			pw.buffered += 4 * len(values)
+		} else {
+			pw.buffered += 8 * len(values)
+		}
+	}
+	if pw.buffered >= pw.RowGroupSize {
+		return pw.flush()
+	}
+	return nil
+}
+
+// flush writes the buffered rows as a row group.
+func (pw *ParquetWriter) flush() error {
+	if len(pw.Columns) == 0 || (len(pw.chunks[0].values) == 0 &&
+		len(pw.chunks[0].definitions) == 0) {
+		return nil
+	}
+	rowGroup := pw.writer.AppendRowGroup()
+	for columnIdx, column := range pw.Columns {
+		chunk := &pw.chunks[columnIdx]
+		columnWriter, err := rowGroup.NextColumn()
+		if err != nil {
+			return err
+		}
+		var repetitions, definitions []int16
+		if column.List {
+			repetitions, definitions = chunk.repetitions, chunk.definitions
+		}
+		switch columnWriter := columnWriter.(type) {
+		case *file.Int32ColumnChunkWriter:
+			values := make([]int32, len(chunk.values))
+			for idx, value := range chunk.values {
+				values[idx] = int32(value)
+			}
+			_, err = columnWriter.WriteBatch(values, definitions,
+				repetitions)
+		case *file.Int64ColumnChunkWriter:
+			_, err = columnWriter.WriteBatch(chunk.values, definitions,
+				repetitions)
+		}
+		if err != nil {
+			return err
+		} else if err = columnWriter.Close(); err != nil {
+			return err
+		}
+		chunk.values = chunk.values[:0]
+		chunk.repetitions = chunk.repetitions[:0]
+		chunk.definitions = chunk.definitions[:0]
+	}
+	pw.buffered = 0
+	return rowGroup.Close()
+}
+
+// Close
+// Writes the remaining rows and the file's footer. The underlying writer is
+// not closed.
+func (pw *ParquetWriter) Close() error {
+	if err := pw.flush(); err != nil {
+		return err
+	}
+	for _, key := range sortedKeys(pw.Metadata) {
+		if err := pw.writer.AppendKeyValueMetadata(key,
+			pw.Metadata[key]); err != nil {
+			return err
+		}
+	}
+	return pw.writer.Close()
+}
+
+// sortedKeys returns the keys of m in order.
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
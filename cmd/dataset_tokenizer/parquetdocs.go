@@ -0,0 +1,66 @@
+package main
+
+import (
+	"os"
+
+	"github.com/wbrown/gpt_bpe"
+)
+
+// DocumentsParquet
+// Writes the tokens of each document as a row of a Parquet file, of its
+// `doc_id`, its `tokens` and their `length`, so that tokenized corpora can be
+// read directly by Arrow based tools such as Spark or Polars.
+type DocumentsParquet struct {
+	Documents int
+	Tokens    int
+}
+
+// documentsParquetColumns are the columns of a DocumentsParquet file.
+var documentsParquetColumns = []ParquetColumn{
+	{Name: "doc_id", Type: ParquetInt64},
+	{Name: "tokens", Type: ParquetInt32, List: true},
+	{Name: "length", Type: ParquetInt64},
+}
+
+// Write
+// Reads the documents of the given inputs with textsReader, tokenizes them
+// with encoder, and writes them to a new Parquet file at parquetPath,
+// replacing any existing file. Metadata is written as the file's key and
+// value metadata.
+func (pw *DocumentsParquet) Write(textsReader TextsReader,
+	encoder *gpt_bpe.GPTEncoder, matches []PathInfo, parquetPath string,
+	metadata map[string]string) error {
+	file, err := os.Create(parquetPath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	writer, err := NewParquetWriter(file, documentsParquetColumns)
+	if err != nil {
+		return err
+	}
+	for key, value := range metadata {
+		writer.Metadata[key] = value
+	}
+	pw.Documents, pw.Tokens = 0, 0
+	if err := encodeDocuments(textsReader, encoder, matches,
+		func(_ string, _ string, tokens gpt_bpe.Tokens) error {
+			values := make([]int64, len(tokens))
+			for idx, token := range tokens {
+				values[idx] = int64(token)
+			}
+			if err := writer.WriteRow([]int64{int64(pw.Documents)}, values,
+				[]int64{int64(len(tokens))}); err != nil {
+				return err
+			}
+			pw.Documents++
+			pw.Tokens += len(tokens)
+			return nil
+		}); err != nil {
+		return err
+	}
+	if err := writer.Close(); err != nil {
+		return err
+	}
+	return file.Close()
+}
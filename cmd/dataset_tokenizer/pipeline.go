@@ -0,0 +1,446 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// PipelineConfig
+// Describes a tokenization run as a YAML pipeline file, as an alternative to
+// a long list of flags. Every setting stands for the flag named by its `flag`
+// tag, so a pipeline file and the flags can be freely combined, with flags
+// given on the command line taking precedence over the file.
+type PipelineConfig struct {
+	Inputs    PipelineInputs    `yaml:"inputs"`
+	Filters   PipelineFilters   `yaml:"filters"`
+	Cleaners  PipelineCleaners  `yaml:"cleaners"`
+	Tokenizer PipelineTokenizer `yaml:"tokenizer"`
+	Packing   PipelinePacking   `yaml:"packing"`
+	Output    PipelineOutput    `yaml:"output"`
+}
+
+// PipelineInputs
+// Selects the input files, and how they are ordered and split into
+// documents.
+type PipelineInputs struct {
+	Path             string   `yaml:"path" flag:"input"`
+	Format           string   `yaml:"format" flag:"input_format"`
+	Reorder          string   `yaml:"reorder" flag:"reorder"`
+	Curriculum       string   `yaml:"curriculum" flag:"curriculum"`
+	CurriculumScores string   `yaml:"curriculum_scores" flag:"curriculum_scores"`
+	Shuffle          bool     `yaml:"shuffle" flag:"shuffle"`
+	Seed             int      `yaml:"seed" flag:"seed"`
+	ShuffleMemory    int      `yaml:"shuffle_memory" flag:"shuffle_memory"`
+	ShuffleDir       string   `yaml:"shuffle_dir" flag:"shuffle_dir"`
+	SplitRegex       string   `yaml:"split_regex" flag:"split_regex"`
+	SplitLength      int      `yaml:"split_length" flag:"split_length"`
+	WarcLanguages    []string `yaml:"warc_languages" flag:"warc_languages"`
+	WarcStatus       []int    `yaml:"warc_status" flag:"warc_status"`
+	JSONLField       string   `yaml:"jsonl_field" flag:"jsonl_field"`
+	JSONLTemplate    string   `yaml:"jsonl_template" flag:"jsonl_template"`
+	JSONLMetadata    []string `yaml:"jsonl_metadata" flag:"jsonl_metadata"`
+	JSONLPrompt      string   `yaml:"jsonl_prompt_field" flag:"jsonl_prompt_field"`
+	JSONLCompletion  string   `yaml:"jsonl_completion_field" flag:"jsonl_completion_field"`
+}
+
+// PipelineFilters
+// Selects the documents that are tokenized.
+type PipelineFilters struct {
+	LanguageAllow  []string `yaml:"lang_allow" flag:"lang_allow"`
+	LanguageDeny   []string `yaml:"lang_deny" flag:"lang_deny"`
+	Quality        []string `yaml:"quality" flag:"quality_filters"`
+	Dedup          string   `yaml:"dedup" flag:"dedup"`
+	DedupThreshold float64  `yaml:"dedup_threshold" flag:"dedup_threshold"`
+	DedupReport    string   `yaml:"dedup_report" flag:"dedup_report"`
+}
+
+// PipelineCleaners
+// Selects how document text is cleaned up before it is tokenized.
+type PipelineCleaners struct {
+	Sanitize           bool `yaml:"sanitize" flag:"sanitize"`
+	WikiStripTemplates bool `yaml:"wiki_strip_templates" flag:"wiki_strip_templates"`
+}
+
+// PipelineTokenizer
+// Selects the tokenizer and its special tokens.
+type PipelineTokenizer struct {
+	Id                 string `yaml:"id" flag:"tokenizer"`
+	EndOfText          string `yaml:"eot" flag:"eot"`
+	PadToken           string `yaml:"pad" flag:"pad"`
+	Unitrim            bool   `yaml:"unitrim" flag:"no_unitrim,invert"`
+	RegexpPreTokenizer bool   `yaml:"regexp_pretokenizer" flag:"regexp_pretokenizer"`
+	MaxWordLength      int    `yaml:"max_word_length" flag:"max_word_length"`
+}
+
+// PipelinePacking
+// Selects how tokens are packed into contexts.
+type PipelinePacking struct {
+	ContextSize     int    `yaml:"context" flag:"context"`
+	Boundary        string `yaml:"boundary" flag:"boundary"`
+	BoundaryBegin   bool   `yaml:"boundary_begin" flag:"boundary_begin"`
+	BoundaryOverlap int    `yaml:"boundary_overlap" flag:"boundary_overlap"`
+	Sampling        int    `yaml:"sampling" flag:"sampling"`
+	Epochs          int    `yaml:"epochs" flag:"epochs"`
+	TokenBudget     int    `yaml:"token_budget" flag:"token_budget"`
+	BytesPerToken   int    `yaml:"bytes_per_token" flag:"bytes_per_token"`
+	EpochSeed       int    `yaml:"epoch_seed" flag:"epoch_seed"`
+	Mode            string `yaml:"mode" flag:"packing"`
+	Bins            int    `yaml:"bins" flag:"packing_bins"`
+}
+
+// PipelineOutput
+// Selects where and how the contexts are written.
+type PipelineOutput struct {
+	Path              string `yaml:"path" flag:"output"`
+	Format            string `yaml:"format" flag:"output_format"`
+	AttentionMask     bool   `yaml:"attention_mask" flag:"hf_attention_mask"`
+	Labels            bool   `yaml:"labels" flag:"hf_labels"`
+	JSONLFields       string `yaml:"jsonl_fields" flag:"jsonl_fields"`
+	MegatronDtype     string `yaml:"megatron_dtype" flag:"megatron_dtype"`
+	TFRecordFeatures  string `yaml:"tfrecord_features" flag:"tfrecord_features"`
+	Compress          string `yaml:"compress" flag:"compress"`
+	CompressFrames    string `yaml:"compress_frames" flag:"compress_frames"`
+	CompressChunkSize int    `yaml:"compress_chunk_size" flag:"compress_chunk_size"`
+	CompressLevel     int    `yaml:"compress_level" flag:"compress_level"`
+	CompressWorkers   int    `yaml:"compress_workers" flag:"compress_workers"`
+	DocumentIndex     bool   `yaml:"doc_index" flag:"doc_index"`
+	SegmentIds        bool   `yaml:"segment_ids" flag:"segment_ids"`
+	LossMask          bool   `yaml:"loss_mask" flag:"loss_mask"`
+	PackingReport     string `yaml:"packing_report" flag:"packing_report"`
+	RouteShards       int    `yaml:"route_shards" flag:"route_shards"`
+	RouteSplits       string `yaml:"route_splits" flag:"route_splits"`
+	Append            bool   `yaml:"append" flag:"append"`
+	CheckpointInputs  int    `yaml:"checkpoint_inputs" flag:"checkpoint_inputs"`
+	Resume            bool   `yaml:"resume" flag:"resume"`
+	Retokenize        bool   `yaml:"retokenize" flag:"retokenize"`
+}
+
+// pipelineSetting is a single setting of a PipelineConfig, and its flag.
+type pipelineSetting struct {
+	path   string
+	flag   string
+	invert bool
+	value  reflect.Value
+}
+
+// settings returns every setting of the config, in the order of the file.
+func (config *PipelineConfig) settings() []pipelineSetting {
+	settings := make([]pipelineSetting, 0)
+	sections := reflect.ValueOf(config).Elem()
+	for sectionIdx := 0; sectionIdx < sections.NumField(); sectionIdx++ {
+		section := sections.Field(sectionIdx)
+		sectionName := sections.Type().Field(sectionIdx).Tag.Get("yaml")
+		for fieldIdx := 0; fieldIdx < section.NumField(); fieldIdx++ {
+			field := section.Type().Field(fieldIdx)
+			flagTag := strings.Split(field.Tag.Get("flag"), ",")
+			settings = append(settings, pipelineSetting{
+				path:   sectionName + "." + field.Tag.Get("yaml"),
+				flag:   flagTag[0],
+				invert: len(flagTag) > 1 && flagTag[1] == "invert",
+				value:  section.Field(fieldIdx),
+			})
+		}
+	}
+	return settings
+}
+
+// flagValue returns the setting formatted as its flag's value.
+func (setting pipelineSetting) flagValue() string {
+	switch setting.value.Kind() {
+	case reflect.Slice:
+		values := make([]string, setting.value.Len())
+		for valueIdx := range values {
+			values[valueIdx] = fmt.Sprint(
+				setting.value.Index(valueIdx).Interface())
+		}
+		return strings.Join(values, ",")
+	case reflect.Bool:
+		return strconv.FormatBool(setting.value.Bool() != setting.invert)
+	default:
+		return fmt.Sprint(setting.value.Interface())
+	}
+}
+
+// setFlagValue parses the value of the setting's flag into the setting.
+func (setting pipelineSetting) setFlagValue(value string) error {
+	switch setting.value.Kind() {
+	case reflect.String:
+		setting.value.SetString(value)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		setting.value.SetBool(b != setting.invert)
+	case reflect.Int:
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return err
+		}
+		setting.value.SetInt(int64(n))
+	case reflect.Float64:
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return err
+		}
+		setting.value.SetFloat(f)
+	case reflect.Slice:
+		elemType := setting.value.Type().Elem()
+		slice := reflect.MakeSlice(setting.value.Type(), 0, 0)
+		if value != "" {
+			for _, item := range strings.Split(value, ",") {
+				item = strings.TrimSpace(item)
+				if elemType.Kind() == reflect.Int {
+					n, err := strconv.Atoi(item)
+					if err != nil {
+						return err
+					}
+					slice = reflect.Append(slice, reflect.ValueOf(n))
+				} else {
+					slice = reflect.Append(slice, reflect.ValueOf(item))
+				}
+			}
+		}
+		setting.value.Set(slice)
+	}
+	return nil
+}
+
+// PipelineConfigFromFlags
+// Returns the config that corresponds to the current values of the flags.
+func PipelineConfigFromFlags(flags *flag.FlagSet) (*PipelineConfig, error) {
+	config := &PipelineConfig{}
+	for _, setting := range config.settings() {
+		f := flags.Lookup(setting.flag)
+		if f == nil {
+			return nil, errors.New(fmt.Sprintf("flag -%s is not defined",
+				setting.flag))
+		}
+		if err := setting.setFlagValue(f.Value.String()); err != nil {
+			return nil, errors.New(fmt.Sprintf("-%s: %v", setting.flag,
+				err))
+		}
+	}
+	return config, nil
+}
+
+// LoadPipelineConfig
+// Reads a pipeline file from path on top of the base config, so that
+// settings missing from the file keep their base values. Unknown settings
+// and mistyped values are reported as errors.
+func LoadPipelineConfig(path string,
+	base *PipelineConfig) (*PipelineConfig, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	config := *base
+	decoder := yaml.NewDecoder(file)
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&config); err != nil && err != io.EOF {
+		return nil, errors.New(fmt.Sprintf("%s: %v", path, err))
+	}
+	return &config, nil
+}
+
+// Validate
+// Checks that every setting of the config has a valid value.
+func (config *PipelineConfig) Validate() error {
+	validReorder := map[string]bool{"": true, "size_ascending": true,
+		"size_descending": true, "name_ascending": true,
+		"name_descending": true, "random": true, "shuffle": true,
+		"none": true}
+	switch {
+	case config.Inputs.Path == "":
+		return errors.New("inputs.path is required")
+	case InputFormatExtensions[config.Inputs.Format] == nil:
+		return errors.New(fmt.Sprintf("inputs.format: unknown format %s",
+			config.Inputs.Format))
+	case !validReorder[config.Inputs.Reorder]:
+		return errors.New(fmt.Sprintf(
+			"inputs.reorder: invalid specification %s",
+			config.Inputs.Reorder))
+	case config.Inputs.SplitRegex != "" && config.Inputs.SplitLength > 0:
+		return errors.New(
+			"inputs.split_regex and inputs.split_length are exclusive")
+	case config.Inputs.Shuffle && config.Inputs.ShuffleMemory <= 0:
+		return errors.New("inputs.shuffle_memory must be positive")
+	case config.Inputs.Shuffle && (config.Inputs.Curriculum != "" ||
+		config.Inputs.CurriculumScores != ""):
+		return errors.New(
+			"inputs.shuffle cannot be used with inputs.curriculum")
+	case config.Inputs.SplitLength < 0:
+		return errors.New("inputs.split_length must not be negative")
+	case (config.Inputs.JSONLTemplate != "" ||
+		len(config.Inputs.JSONLMetadata) > 0 ||
+		(config.Inputs.JSONLField != "" &&
+			config.Inputs.JSONLField != DefaultJSONLField)) &&
+		config.Inputs.Format != InputFormatJSONL:
+		return errors.New("inputs.jsonl_field, inputs.jsonl_template and " +
+			"inputs.jsonl_metadata can only be used with the jsonl format")
+	case len(config.Inputs.JSONLMetadata) > 0 && !config.Output.DocumentIndex:
+		return errors.New(
+			"inputs.jsonl_metadata can only be used with output.doc_index")
+	case config.Output.LossMask && config.Inputs.Format != InputFormatJSONL:
+		return errors.New(
+			"output.loss_mask can only be used with the jsonl format")
+	case ((config.Inputs.JSONLPrompt != "" &&
+		config.Inputs.JSONLPrompt != DefaultJSONLPromptField) ||
+		(config.Inputs.JSONLCompletion != "" &&
+			config.Inputs.JSONLCompletion != DefaultJSONLCompletionField)) &&
+		!config.Output.LossMask:
+		return errors.New("inputs.jsonl_prompt_field and " +
+			"inputs.jsonl_completion_field can only be used with " +
+			"output.loss_mask")
+	case config.Tokenizer.MaxWordLength < 0:
+		return errors.New("tokenizer.max_word_length must not be negative")
+	case config.Packing.ContextSize <= 0:
+		return errors.New("packing.context must be positive")
+	case config.Packing.Sampling < 0 || config.Packing.Sampling > 100:
+		return errors.New("packing.sampling must be between 0 and 100")
+	case config.Output.Path == "":
+		return errors.New("output.path is required")
+	case config.Output.Format != OutputFormatContexts &&
+		config.Output.Format != OutputFormatHuggingFace &&
+		config.Output.Format != OutputFormatSQLite &&
+		config.Output.Format != OutputFormatDuckDB &&
+		config.Output.Format != OutputFormatJSONL &&
+		config.Output.Format != OutputFormatParquet &&
+		config.Output.Format != OutputFormatMegatron &&
+		config.Output.Format != OutputFormatTFRecord:
+		return errors.New(fmt.Sprintf(
+			"output.format: invalid format %s", config.Output.Format))
+	case config.Output.JSONLFields != "" &&
+		config.Output.Format != OutputFormatJSONL:
+		return errors.New(
+			"output.jsonl_fields can only be used with the jsonl format")
+	case config.Output.MegatronDtype != "" &&
+		config.Output.Format != OutputFormatMegatron &&
+		config.Output.MegatronDtype != "uint16":
+		return errors.New(
+			"output.megatron_dtype can only be used with the megatron format")
+	case config.Output.Compress != CompressionNone &&
+		config.Output.Compress != CompressionZstd &&
+		config.Output.Compress != CompressionGzip:
+		return errors.New(fmt.Sprintf(
+			"output.compress: invalid compression %s",
+			config.Output.Compress))
+	case config.Output.CompressFrames != CompressionFramesChunk &&
+		config.Output.CompressFrames != CompressionFramesContext &&
+		config.Output.CompressFrames != CompressionFramesDocument:
+		return errors.New(fmt.Sprintf(
+			"output.compress_frames: invalid frames %s",
+			config.Output.CompressFrames))
+	case config.Output.CompressChunkSize <= 0:
+		return errors.New("output.compress_chunk_size must be positive")
+	case config.Output.CompressWorkers <= 0:
+		return errors.New("output.compress_workers must be positive")
+	case config.Output.CheckpointInputs < 0:
+		return errors.New("output.checkpoint_inputs cannot be negative")
+	}
+	if config.Output.Compress != CompressionNone {
+		if _, err := newFrameCompressor(config.Output.Compress,
+			config.Output.CompressLevel); err != nil {
+			return errors.New(fmt.Sprintf("output.compress_level: %v", err))
+		}
+	}
+	if err := CheckPacking(config.Packing.Mode,
+		config.Packing.Bins); err != nil {
+		return errors.New(fmt.Sprintf("packing.mode: %v", err))
+	}
+	if config.Filters.Dedup != DedupNone {
+		if _, err := NewDeduplicator(config.Filters.Dedup,
+			config.Filters.DedupThreshold); err != nil {
+			return errors.New(fmt.Sprintf("filters.dedup: %v", err))
+		}
+	}
+	if len(config.Filters.Quality) > 0 {
+		if _, err := ParseDocumentFilters(strings.Join(
+			config.Filters.Quality, ",")); err != nil {
+			return errors.New(fmt.Sprintf("filters.quality: %v", err))
+		}
+	}
+	return nil
+}
+
+// Apply
+// Sets the flags to the config's settings, except for those in explicit,
+// which were given on the command line.
+func (config *PipelineConfig) Apply(flags *flag.FlagSet,
+	explicit map[string]bool) error {
+	for _, setting := range config.settings() {
+		if explicit[setting.flag] {
+			continue
+		}
+		if err := flags.Set(setting.flag, setting.flagValue()); err != nil {
+			return errors.New(fmt.Sprintf("%s: %v", setting.path, err))
+		}
+	}
+	return nil
+}
+
+// Write
+// Serializes the config as a YAML pipeline file. String settings are
+// written double quoted, as yaml.v3 writes a string of only line breaks,
+// such as the "\n" boundary, as a block scalar that reads back empty.
+func (config *PipelineConfig) Write(w io.Writer) error {
+	root := &yaml.Node{Kind: yaml.MappingNode}
+	sections := make(map[string]*yaml.Node)
+	for _, setting := range config.settings() {
+		path := strings.SplitN(setting.path, ".", 2)
+		section, ok := sections[path[0]]
+		if !ok {
+			section = &yaml.Node{Kind: yaml.MappingNode}
+			sections[path[0]] = section
+			root.Content = append(root.Content, &yaml.Node{
+				Kind: yaml.ScalarNode, Value: path[0]}, section)
+		}
+		value, err := settingNode(setting.value)
+		if err != nil {
+			return errors.New(fmt.Sprintf("%s: %v", setting.path, err))
+		}
+		section.Content = append(section.Content, &yaml.Node{
+			Kind: yaml.ScalarNode, Value: path[1]}, value)
+	}
+	encoder := yaml.NewEncoder(w)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(root); err != nil {
+		return err
+	}
+	return encoder.Close()
+}
+
+// settingNode returns the YAML node of a setting's value, with strings, and
+// those of lists, double quoted.
+func settingNode(value reflect.Value) (*yaml.Node, error) {
+	switch value.Kind() {
+	case reflect.String:
+		return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str",
+			Value: value.String(), Style: yaml.DoubleQuotedStyle}, nil
+	case reflect.Slice:
+		node := &yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq"}
+		for idx := 0; idx < value.Len(); idx++ {
+			item, err := settingNode(value.Index(idx))
+			if err != nil {
+				return nil, err
+			}
+			node.Content = append(node.Content, item)
+		}
+		return node, nil
+	default:
+		node := &yaml.Node{}
+		if err := node.Encode(value.Interface()); err != nil {
+			return nil, err
+		}
+		return node, nil
+	}
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"io"
+	"strings"
+
+	"github.com/wbrown/gpt_bpe/dataset"
+)
+
+// RoutedTexts
+// Returns a TextsIterator over the documents of nextText that router routes
+// to route, keyed by their text.
+func RoutedTexts(nextText TextsIterator, router *dataset.Router,
+	route dataset.Route) TextsIterator {
+	return func() io.RuneReader {
+		for reader := nextText(); reader != nil; reader = nextText() {
+			document := readDocument(reader)
+			if router.Route([]byte(document)) == route {
+				return strings.NewReader(document)
+			}
+		}
+		return nil
+	}
+}
+
+// RoutePath
+// Returns the path of the shard of output that route is written to, which
+// is output with the route's split before its {shard}, or suffixed with it
+// if it has no {shard}, and then expanded by ShardPath.
+func RoutePath(output string, route dataset.Route) string {
+	if route.Split != "" {
+		if strings.Contains(output, "{shard") {
+			output = strings.Replace(output, "{shard",
+				route.Split+"-{shard", 1)
+		} else {
+			output += "." + route.Split
+		}
+	}
+	return ShardPath(output, route.Shard)
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"os"
+	"strings"
+)
+
+// DefaultShuffleMemory is the number of megabytes of documents that a
+// DocumentShuffler holds in memory by default.
+const DefaultShuffleMemory = 1024
+
+// DocumentShuffler
+// Shuffles documents by Seed, so that the order of the documents that are
+// tokenized is not correlated with the order of the inputs. Up to Memory
+// bytes of documents are shuffled in memory, and larger inputs are shuffled
+// externally, by spilling shuffled runs of documents to spool files in Dir,
+// or the system's temporary directory if it is empty, that are then merged
+// at random.
+type DocumentShuffler struct {
+	Seed   int64
+	Memory int
+	Dir    string
+}
+
+// NewDocumentShuffler
+// Creates a DocumentShuffler of seed that holds up to memory bytes of
+// documents in memory.
+func NewDocumentShuffler(seed int64, memory int,
+	dir string) (*DocumentShuffler, error) {
+	if memory <= 0 {
+		return nil, errors.New(fmt.Sprintf(
+			"invalid shuffle memory %d, must be positive", memory))
+	}
+	return &DocumentShuffler{Seed: seed, Memory: memory, Dir: dir}, nil
+}
+
+// spooledDocument is a document as it is written to a spool file, along
+// with its metadata, if any.
+type spooledDocument struct {
+	Text     string                 `json:"text"`
+	Metadata map[string]interface{} `json:"metadata,omitempty"`
+}
+
+// shuffleSpool is a spool file of a shuffled run of documents, of which
+// remaining are yet to be read.
+type shuffleSpool struct {
+	file      *os.File
+	decoder   *json.Decoder
+	remaining int
+}
+
+// Shuffle
+// Reads every document of nextText, and returns a TextsIterator over them in
+// a random order, which is the same for the same documents and seed.
+// Documents keep their metadata.
+func (shuffler *DocumentShuffler) Shuffle(
+	nextText TextsIterator) (TextsIterator, error) {
+	rng := rand.New(rand.NewSource(shuffler.Seed))
+	run := make([]spooledDocument, 0)
+	runSize := 0
+	spoolDir := ""
+	spools := make([]*shuffleSpool, 0)
+	cleanup := func() {
+		for _, spool := range spools {
+			spool.file.Close()
+		}
+		if spoolDir != "" {
+			os.RemoveAll(spoolDir)
+		}
+	}
+	// Each run is shuffled before it is spilled, so that merging the runs by
+	// picking each next document from a run in proportion to the documents
+	// that it has left shuffles the documents uniformly.
+	spill := func() error {
+		if spoolDir == "" {
+			var err error
+			if spoolDir, err = os.MkdirTemp(shuffler.Dir,
+				"shuffle-"); err != nil {
+				return err
+			}
+		}
+		rng.Shuffle(len(run), func(i, j int) {
+			run[i], run[j] = run[j], run[i]
+		})
+		file, err := os.CreateTemp(spoolDir, "run-*.jsonl")
+		if err != nil {
+			return err
+		}
+		spools = append(spools, &shuffleSpool{file: file,
+			remaining: len(run)})
+		writer := bufio.NewWriter(file)
+		encoder := json.NewEncoder(writer)
+		for _, document := range run {
+			if err = encoder.Encode(document); err != nil {
+				return err
+			}
+		}
+		if err = writer.Flush(); err != nil {
+			return err
+		}
+		run = run[:0]
+		runSize = 0
+		return nil
+	}
+
+	for reader := nextText(); reader != nil; reader = nextText() {
+		document := spooledDocument{Text: readDocument(reader),
+			Metadata: readerMetadata(reader)}
+		run = append(run, document)
+		runSize += len(document.Text)
+		if runSize >= shuffler.Memory {
+			if err := spill(); err != nil {
+				cleanup()
+				return nil, err
+			}
+		}
+	}
+
+	// Documents that fit in memory are only shuffled in memory.
+	if len(spools) == 0 {
+		rng.Shuffle(len(run), func(i, j int) {
+			run[i], run[j] = run[j], run[i]
+		})
+		return func() io.RuneReader {
+			if len(run) == 0 {
+				return nil
+			}
+			document := run[0]
+			run = run[1:]
+			return withMetadata(strings.NewReader(document.Text),
+				document.Metadata)
+		}, nil
+	}
+	if len(run) > 0 {
+		if err := spill(); err != nil {
+			cleanup()
+			return nil, err
+		}
+	}
+	remaining := 0
+	for _, spool := range spools {
+		if _, err := spool.file.Seek(0, io.SeekStart); err != nil {
+			cleanup()
+			return nil, err
+		}
+		spool.decoder = json.NewDecoder(bufio.NewReader(spool.file))
+		remaining += spool.remaining
+	}
+	log.Printf("Shuffling %d documents from %d spool files in %s",
+		remaining, len(spools), spoolDir)
+	return func() io.RuneReader {
+		if remaining == 0 {
+			cleanup()
+			spoolDir = ""
+			spools = spools[:0]
+			return nil
+		}
+		pick := rng.Intn(remaining)
+		spool := spools[0]
+		for _, spool = range spools {
+			if pick < spool.remaining {
+				break
+			}
+			pick -= spool.remaining
+		}
+		var document spooledDocument
+		if err := spool.decoder.Decode(&document); err != nil {
+			cleanup()
+			log.Fatal(errors.New(fmt.Sprintf(
+				"error reading shuffle spool %s: %v", spool.file.Name(),
+				err)))
+		}
+		spool.remaining--
+		remaining--
+		return withMetadata(strings.NewReader(document.Text),
+			document.Metadata)
+	}, nil
+}
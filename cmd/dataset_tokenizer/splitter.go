@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"unicode/utf8"
+)
+
+const DefaultMaxDocumentSize = 64 * 1024 * 1024
+
+// DocumentSplitter
+// Splits a single input stream, such as a concatenated dump, into multiple
+// documents. Documents are either separated by a delimiter regular
+// expression, which is consumed, or are fixed length records. The input is
+// streamed, so only one document needs to fit in memory at a time.
+type DocumentSplitter struct {
+	Delimiter       *regexp.Regexp
+	RecordLength    int
+	MaxDocumentSize int
+}
+
+// NewDocumentSplitter
+// Creates a DocumentSplitter that splits on the given delimiter regular
+// expression, or if recordLength is greater than zero, into records of
+// recordLength bytes. Exactly one of the two must be given.
+func NewDocumentSplitter(delimiter string,
+	recordLength int) (*DocumentSplitter, error) {
+	if delimiter != "" && recordLength > 0 {
+		return nil, errors.New(
+			"cannot split on both a delimiter and a record length")
+	} else if delimiter == "" && recordLength <= 0 {
+		return nil, errors.New(
+			"must provide a delimiter or a record length to split on")
+	}
+	splitter := &DocumentSplitter{
+		RecordLength:    recordLength,
+		MaxDocumentSize: DefaultMaxDocumentSize,
+	}
+	if delimiter != "" {
+		delimiterRegex, err := regexp.Compile(delimiter)
+		if err != nil {
+			return nil, err
+		}
+		if delimiterRegex.MatchString("") {
+			return nil, errors.New(fmt.Sprintf(
+				"delimiter `%s` must not match the empty string", delimiter))
+		}
+		splitter.Delimiter = delimiterRegex
+	}
+	return splitter, nil
+}
+
+// scanDocuments is a bufio.SplitFunc that returns one document per token.
+func (splitter *DocumentSplitter) scanDocuments(data []byte,
+	atEOF bool) (advance int, token []byte, err error) {
+	if atEOF && len(data) == 0 {
+		return 0, nil, nil
+	}
+	if splitter.RecordLength > 0 {
+		if len(data) > splitter.RecordLength {
+			// Align the record end to the start of a rune, so that we do
+			// not split a multi-byte sequence across documents.
+			end := splitter.RecordLength
+			for backoff := 0; backoff < utf8.UTFMax-1 && end > 1 &&
+				!utf8.RuneStart(data[end]); backoff++ {
+				end--
+			}
+			return end, data[:end], nil
+		}
+	} else if loc := splitter.Delimiter.FindIndex(data); loc != nil {
+		// A match that touches the end of our buffer may grow once we
+		// read more data, so we only accept it when more data follows.
+		if loc[1] < len(data) || atEOF {
+			return loc[1], data[:loc[0]], nil
+		}
+	}
+	if atEOF {
+		return len(data), data, nil
+	}
+	// Request more data.
+	return 0, nil, nil
+}
+
+// Split
+// Returns an iterator function that yields each document in reader, and
+// nil when the reader is exhausted. Empty documents are skipped.
+func (splitter *DocumentSplitter) Split(
+	reader io.Reader) func() (*string, error) {
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 0, 64*1024), splitter.MaxDocumentSize)
+	scanner.Split(splitter.scanDocuments)
+	return func() (*string, error) {
+		for scanner.Scan() {
+			if len(scanner.Bytes()) == 0 {
+				continue
+			}
+			document := scanner.Text()
+			return &document, nil
+		}
+		return nil, scanner.Err()
+	}
+}
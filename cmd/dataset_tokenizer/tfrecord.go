@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"strings"
+)
+
+// CompressionGzip compresses TFRecord output as a whole with gzip, as
+// TensorFlow's `compression_type="GZIP"` reads it.
+const CompressionGzip = "gz"
+
+// TFRecordFeature
+// A feature of the tf.Example of each context, of the values of one of its
+// columns, and the name that it is written as.
+type TFRecordFeature struct {
+	Column string
+	Name   string
+}
+
+// ParseTFRecordFeatures
+// Parses a comma separated list of the columns to write as the features of
+// each context, each optionally renamed, such as
+// "input_ids=inputs,attention_mask". The input_ids column must be written.
+func ParseTFRecordFeatures(spec string) ([]TFRecordFeature, error) {
+	features := make([]TFRecordFeature, 0)
+	columns := make(map[string]bool)
+	names := make(map[string]bool)
+	for _, item := range strings.Split(spec, ",") {
+		parts := strings.SplitN(strings.TrimSpace(item), "=", 2)
+		feature := TFRecordFeature{Column: parts[0], Name: parts[0]}
+		if len(parts) == 2 {
+			feature.Name = parts[1]
+		}
+		switch feature.Column {
+		case ColumnInputIds, ColumnAttentionMask, ColumnLabels,
+			ColumnSegmentIds:
+		default:
+			return nil, errors.New(fmt.Sprintf(
+				"invalid tfrecord column %s", feature.Column))
+		}
+		if feature.Name == "" || names[feature.Name] ||
+			columns[feature.Column] {
+			return nil, errors.New(fmt.Sprintf(
+				"duplicate or empty tfrecord feature %q", item))
+		}
+		columns[feature.Column] = true
+		names[feature.Name] = true
+		features = append(features, feature)
+	}
+	if !columns[ColumnInputIds] {
+		return nil, errors.New("tfrecord features must include input_ids")
+	}
+	return features, nil
+}
+
+// crc32c is the CRC-32C table that TFRecord checksums are computed with.
+var crc32c = crc32.MakeTable(crc32.Castagnoli)
+
+// maskedCrc returns the masked CRC-32C of data that TFRecord stores, which
+// is rotated and offset so that data holding CRCs is checksummed well.
+func maskedCrc(data []byte) uint32 {
+	crc := crc32.Checksum(data, crc32c)
+	return ((crc >> 15) | (crc << 17)) + 0xa282ead8
+}
+
+// writeTFRecord writes data as a record of a TFRecord file, of its length,
+// the masked CRC of its length, data, and the masked CRC of data.
+func writeTFRecord(writer io.Writer, data []byte) error {
+	header := make([]byte, 12)
+	binary.LittleEndian.PutUint64(header, uint64(len(data)))
+	binary.LittleEndian.PutUint32(header[8:], maskedCrc(header[:8]))
+	footer := make([]byte, 4)
+	binary.LittleEndian.PutUint32(footer, maskedCrc(data))
+	for _, part := range [][]byte{header, data, footer} {
+		if _, err := writer.Write(part); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// appendProtoBytes appends a length delimited protocol buffers field.
+func appendProtoBytes(buf []byte, field int, value []byte) []byte {
+	buf = appendUvarint(buf, uint64(field<<3|2))
+	buf = appendUvarint(buf, uint64(len(value)))
+	return append(buf, value...)
+}
+
+// appendUvarint appends value as a protocol buffers varint.
+func appendUvarint(buf []byte, value uint64) []byte {
+	for value >= 0x80 {
+		buf = append(buf, byte(value)|0x80)
+		value >>= 7
+	}
+	return append(buf, byte(value))
+}
+
+// appendTFExample appends the serialized tf.Example of the given features,
+// each of which is an Int64List of its values. Values are packed, and
+// negative values are the ten byte varints of their two's complement, as
+// protocol buffers encodes int64.
+func appendTFExample(buf []byte, names []string,
+	values [][]int64) []byte {
+	var features, entry, feature, list, packed []byte
+	for idx, name := range names {
+		packed = packed[:0]
+		for _, value := range values[idx] {
+			packed = appendUvarint(packed, uint64(value))
+		}
+		// Int64List{value}, Feature{int64_list}, and the map entry of
+		// Features.feature of its name and Feature.
+		list = appendProtoBytes(list[:0], 1, packed)
+		feature = appendProtoBytes(feature[:0], 3, list)
+		entry = appendProtoBytes(entry[:0], 1, []byte(name))
+		entry = appendProtoBytes(entry, 2, feature)
+		features = appendProtoBytes(features, 1, entry)
+	}
+	return appendProtoBytes(buf, 1, features)
+}
+
+// writeTFRecord writes the contexts as a TFRecord file of a tf.Example for
+// each, of the int64 features of its TFRecordFeatures, which can be read by
+// TensorFlow's TFRecordDataset and parsed with `tf.io.parse_example`.
+func (cw ContextsWriter) writeTFRecord(outPath string,
+	nextContext ContextsIterator) (int, error) {
+	if cw.Shuffle {
+		return 0, errors.New("shuffling is not supported with " +
+			"TFRecord output")
+	} else if cw.Compression != CompressionNone &&
+		cw.Compression != CompressionGzip {
+		return 0, errors.New(fmt.Sprintf("invalid TFRecord compression: "+
+			"%s", cw.Compression))
+	}
+	features := cw.TFRecordFeatures
+	if len(features) == 0 {
+		features = []TFRecordFeature{{ColumnInputIds, ColumnInputIds}}
+	}
+	names := make([]string, len(features))
+	for idx, feature := range features {
+		names[idx] = feature.Name
+	}
+
+	outFile, err := os.Create(outPath)
+	if err != nil {
+		return 0, err
+	}
+	defer outFile.Close()
+	buffered := bufio.NewWriter(outFile)
+	var out io.Writer = buffered
+	var gzipWriter *gzip.Writer
+	if cw.Compression == CompressionGzip {
+		level := cw.CompressionLevel
+		if level == 0 {
+			level = gzip.DefaultCompression
+		}
+		if gzipWriter, err = gzip.NewWriterLevel(buffered, level); err != nil {
+			return 0, err
+		}
+		out = gzipWriter
+	}
+
+	totalTokens := 0
+	samplingIdx := 0
+	values := make([][]int64, len(features))
+	var example []byte
+	for context := nextContext(); context != nil; context = nextContext() {
+		// Keep every `sampling` percent context, as with binary contexts.
+		sampled := cw.Sampling == 100 || (samplingIdx%20) < cw.Sampling/5
+		samplingIdx++
+		if !sampled {
+			continue
+		}
+		for idx, feature := range features {
+			values[idx] = cw.contextColumn(*context, feature.Column)
+		}
+		example = appendTFExample(example[:0], names, values)
+		if err := writeTFRecord(out, example); err != nil {
+			return totalTokens, err
+		}
+		totalTokens += len(*context)
+	}
+	if gzipWriter != nil {
+		if err := gzipWriter.Close(); err != nil {
+			return totalTokens, err
+		}
+	}
+	if err := buffered.Flush(); err != nil {
+		return totalTokens, err
+	}
+	return totalTokens, outFile.Close()
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"mime"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"strings"
+)
+
+// WarcRecord
+// A single record from a WARC or WET file: its named headers, and the raw
+// record block.
+type WarcRecord struct {
+	Header  textproto.MIMEHeader
+	Content []byte
+}
+
+// Type
+// Returns the WARC-Type of the record, such as `response` or `conversion`.
+func (record *WarcRecord) Type() string {
+	return record.Header.Get("WARC-Type")
+}
+
+// Language
+// Returns the primary language that Common Crawl identified for the record,
+// as an ISO-639-3 code, or an empty string if there is none. The
+// WARC-Identified-Content-Language header lists languages in order of
+// prevalence, so the first one is the primary language.
+func (record *WarcRecord) Language() string {
+	languages := record.Header.Get("WARC-Identified-Content-Language")
+	if commaIdx := strings.IndexByte(languages, ','); commaIdx >= 0 {
+		languages = languages[:commaIdx]
+	}
+	return strings.TrimSpace(languages)
+}
+
+// WarcReader
+// Streams records and their documents out of a WARC or WET file. Documents
+// are taken from `conversion` records, which hold the extracted plain text
+// in WET files, and from `response` records, whose HTML or plain text HTTP
+// payloads are converted to text. Records can be filtered by their primary
+// identified language, and responses by their HTTP status code.
+type WarcReader struct {
+	Languages     map[string]bool
+	StatusCodes   map[int]bool
+	MaxRecordSize int64
+	reader        *bufio.Reader
+	text          *textproto.Reader
+}
+
+// NewWarcReader
+// Creates a WarcReader over an uncompressed WARC or WET stream. Without any
+// filters set, every language and HTTP status is accepted.
+func NewWarcReader(reader io.Reader) *WarcReader {
+	bufReader := bufio.NewReaderSize(reader, 1024*1024)
+	return &WarcReader{
+		MaxRecordSize: DefaultMaxDocumentSize,
+		reader:        bufReader,
+		text:          textproto.NewReader(bufReader),
+	}
+}
+
+// NextRecord
+// Returns the next record in the stream, or io.EOF when the stream is
+// exhausted. Records larger than MaxRecordSize are returned with their
+// headers, but with their content discarded.
+func (wr *WarcReader) NextRecord() (*WarcRecord, error) {
+	// Records are separated by blank lines, which we skip over.
+	var versionLine string
+	for versionLine == "" {
+		line, err := wr.text.ReadLine()
+		if err == io.EOF && line == "" {
+			return nil, io.EOF
+		} else if err != nil {
+			return nil, err
+		}
+		versionLine = strings.TrimSpace(line)
+	}
+	if !strings.HasPrefix(versionLine, "WARC/") {
+		return nil, errors.New(fmt.Sprintf(
+			"invalid WARC record version line: %q", versionLine))
+	}
+	header, err := wr.text.ReadMIMEHeader()
+	if err != nil {
+		return nil, err
+	}
+	contentLength, err := strconv.ParseInt(
+		header.Get("Content-Length"), 10, 64)
+	if err != nil || contentLength < 0 {
+		return nil, errors.New(fmt.Sprintf(
+			"invalid WARC record Content-Length: %q",
+			header.Get("Content-Length")))
+	}
+	record := &WarcRecord{Header: header}
+	if contentLength > wr.MaxRecordSize {
+		_, err = io.CopyN(io.Discard, wr.reader, contentLength)
+	} else {
+		record.Content = make([]byte, contentLength)
+		_, err = io.ReadFull(wr.reader, record.Content)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return record, nil
+}
+
+// Next
+// Returns the text of the next document that passes the filters, or io.EOF
+// when the stream is exhausted.
+func (wr *WarcReader) Next() (*string, error) {
+	for {
+		record, err := wr.NextRecord()
+		if err != nil {
+			return nil, err
+		}
+		if record.Content == nil {
+			continue
+		}
+		if wr.Languages != nil && !wr.Languages[record.Language()] {
+			continue
+		}
+		var text string
+		switch record.Type() {
+		case "conversion":
+			text = string(record.Content)
+		case "response":
+			var ok bool
+			if text, ok = wr.responseText(record); !ok {
+				continue
+			}
+		default:
+			continue
+		}
+		if text = strings.TrimSpace(text); text != "" {
+			return &text, nil
+		}
+	}
+}
+
+// responseText parses the HTTP response held in a `response` record, and
+// returns its payload as text if it passes the status code filter and is
+// HTML or plain text.
+func (wr *WarcReader) responseText(record *WarcRecord) (string, bool) {
+	response, err := http.ReadResponse(
+		bufio.NewReader(bytes.NewReader(record.Content)), nil)
+	if err != nil {
+		return "", false
+	}
+	defer response.Body.Close()
+	if wr.StatusCodes != nil && !wr.StatusCodes[response.StatusCode] {
+		return "", false
+	}
+	if encoding := response.Header.Get(
+		"Content-Encoding"); encoding != "" && encoding != "identity" {
+		return "", false
+	}
+	mediaType, _, _ := mime.ParseMediaType(
+		response.Header.Get("Content-Type"))
+	body, err := io.ReadAll(response.Body)
+	if err != nil && len(body) == 0 {
+		return "", false
+	}
+	switch mediaType {
+	case "text/html", "application/xhtml+xml":
+		return HTMLToText(string(body)), true
+	case "text/plain":
+		return string(body), true
+	}
+	return "", false
+}
+
+// htmlBlockTags are the elements that start a new line of text.
+var htmlBlockTags = map[string]bool{
+	"address": true, "article": true, "aside": true, "blockquote": true,
+	"br": true, "dd": true, "div": true, "dl": true, "dt": true,
+	"figcaption": true, "footer": true, "form": true, "h1": true, "h2": true,
+	"h3": true, "h4": true, "h5": true, "h6": true, "header": true,
+	"hr": true, "li": true, "main": true, "nav": true, "ol": true, "p": true,
+	"pre": true, "section": true, "table": true, "td": true, "th": true,
+	"tr": true, "ul": true,
+}
+
+// htmlSkipTags are the elements whose content is not text.
+var htmlSkipTags = map[string]bool{
+	"script": true, "style": true, "noscript": true, "template": true,
+	"head": true,
+}
+
+// HTMLToText
+// Performs a lightweight conversion of an HTML document to plain text. Tags
+// are removed, block level elements are separated by newlines, the contents
+// of scripts and styles are dropped, and character references are decoded.
+func HTMLToText(document string) string {
+	var builder strings.Builder
+	builder.Grow(len(document) / 2)
+	skipUntil := ""
+	for len(document) > 0 {
+		tagStart := strings.IndexByte(document, '<')
+		if tagStart < 0 {
+			if skipUntil == "" {
+				builder.WriteString(html.UnescapeString(document))
+			}
+			break
+		}
+		if skipUntil == "" {
+			builder.WriteString(html.UnescapeString(document[:tagStart]))
+		}
+		document = document[tagStart:]
+		if strings.HasPrefix(document, "<!--") {
+			commentEnd := strings.Index(document, "-->")
+			if commentEnd < 0 {
+				break
+			}
+			document = document[commentEnd+3:]
+			continue
+		}
+		tagEnd := strings.IndexByte(document, '>')
+		if tagEnd < 0 {
+			break
+		}
+		tag := document[1:tagEnd]
+		document = document[tagEnd+1:]
+		closing := strings.HasPrefix(tag, "/")
+		name := strings.ToLower(strings.TrimLeft(tag, "/"))
+		if nameEnd := strings.IndexAny(name, " \t\r\n/"); nameEnd >= 0 {
+			name = name[:nameEnd]
+		}
+		if skipUntil != "" {
+			if closing && name == skipUntil {
+				skipUntil = ""
+			}
+			continue
+		}
+		if !closing && htmlSkipTags[name] &&
+			!strings.HasSuffix(tag, "/") {
+			skipUntil = name
+		} else if htmlBlockTags[name] {
+			builder.WriteByte('\n')
+		}
+	}
+	return collapseBlankLines(builder.String())
+}
+
+// collapseBlankLines trims whitespace from each line, and collapses runs of
+// blank lines into a single blank line.
+func collapseBlankLines(text string) string {
+	lines := strings.Split(text, "\n")
+	collapsed := make([]string, 0, len(lines))
+	blank := true
+	for _, line := range lines {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			if !blank {
+				collapsed = append(collapsed, "")
+			}
+			blank = true
+			continue
+		}
+		collapsed = append(collapsed, line)
+		blank = false
+	}
+	return strings.TrimSpace(strings.Join(collapsed, "\n"))
+}
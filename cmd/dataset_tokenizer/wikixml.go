@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/xml"
+	"io"
+	"strings"
+)
+
+// WikiPage
+// A single page from a MediaWiki XML dump, with the text of its latest
+// revision.
+type WikiPage struct {
+	Title     string
+	Namespace int
+	Id        int64
+	Redirect  string
+	Text      string
+}
+
+// Document
+// Returns the page as a document to tokenize: the title, followed by a blank
+// line and the page text.
+func (page *WikiPage) Document() string {
+	return page.Title + "\n\n" + strings.TrimSpace(page.Text)
+}
+
+// wikiPageElement mirrors the `<page>` element of the MediaWiki export schema.
+type wikiPageElement struct {
+	Title     string `xml:"title"`
+	Namespace int    `xml:"ns"`
+	Id        int64  `xml:"id"`
+	Redirect  struct {
+		Title string `xml:"title,attr"`
+	} `xml:"redirect"`
+	Revisions []struct {
+		Text string `xml:"text"`
+	} `xml:"revision"`
+}
+
+// WikiReader
+// Streams pages out of a MediaWiki XML dump, such as `pages-articles.xml`.
+// Only one page is held in memory at a time. By default, only pages in the
+// main article namespace are returned, and redirects are skipped.
+type WikiReader struct {
+	Namespaces     map[int]bool
+	SkipRedirects  bool
+	StripTemplates bool
+	decoder        *xml.Decoder
+}
+
+// NewWikiReader
+// Creates a WikiReader over the given XML dump.
+func NewWikiReader(reader io.Reader) *WikiReader {
+	return &WikiReader{
+		Namespaces:    map[int]bool{0: true},
+		SkipRedirects: true,
+		decoder:       xml.NewDecoder(reader),
+	}
+}
+
+// Next
+// Returns the next page that passes the namespace and redirect filters, or
+// io.EOF when the dump is exhausted.
+func (wr *WikiReader) Next() (*WikiPage, error) {
+	for {
+		token, err := wr.decoder.Token()
+		if err != nil {
+			return nil, err
+		}
+		start, ok := token.(xml.StartElement)
+		if !ok || start.Name.Local != "page" {
+			continue
+		}
+		var element wikiPageElement
+		if err := wr.decoder.DecodeElement(&element, &start); err != nil {
+			return nil, err
+		}
+		if wr.Namespaces != nil && !wr.Namespaces[element.Namespace] {
+			continue
+		}
+		if wr.SkipRedirects && element.Redirect.Title != "" {
+			continue
+		}
+		page := &WikiPage{
+			Title:     element.Title,
+			Namespace: element.Namespace,
+			Id:        element.Id,
+			Redirect:  element.Redirect.Title,
+		}
+		if numRevisions := len(element.Revisions); numRevisions > 0 {
+			page.Text = element.Revisions[numRevisions-1].Text
+		}
+		if wr.StripTemplates {
+			page.Text = StripWikiTemplates(page.Text)
+		}
+		return page, nil
+	}
+}
+
+// StripWikiTemplates
+// Removes `{{...}}` template invocations from wikitext, including nested
+// templates. An unterminated template is removed up to the end of the text.
+func StripWikiTemplates(text string) string {
+	if !strings.Contains(text, "{{") {
+		return text
+	}
+	var builder strings.Builder
+	builder.Grow(len(text))
+	depth := 0
+	for idx := 0; idx < len(text); idx++ {
+		if idx+1 < len(text) && text[idx] == '{' && text[idx+1] == '{' {
+			depth++
+			idx++
+		} else if depth > 0 && idx+1 < len(text) && text[idx] == '}' &&
+			text[idx+1] == '}' {
+			depth--
+			idx++
+		} else if depth == 0 {
+			builder.WriteByte(text[idx])
+		}
+	}
+	return builder.String()
+}
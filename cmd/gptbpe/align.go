@@ -0,0 +1,52 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"io"
+	"log"
+	"os"
+
+	"github.com/wbrown/gpt_bpe"
+)
+
+func runAlign(args []string) error {
+	flags := flag.NewFlagSet("align", flag.ExitOnError)
+	draftId := flags.String("draft", "",
+		"tokenizer of the draft model: an embedded or huggingface id, or a "+
+			"directory")
+	targetId := flags.String("target", "",
+		"tokenizer of the target model: an embedded or huggingface id, or a "+
+			"directory")
+	output := flags.String("output", "",
+		"file to write the alignment to as JSON, instead of standard output")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *draftId == "" || *targetId == "" {
+		flags.Usage()
+		return errors.New("must provide -draft and -target")
+	}
+	draft, err := gpt_bpe.NewEncoder(*draftId)
+	if err != nil {
+		return err
+	}
+	target, err := gpt_bpe.NewEncoder(*targetId)
+	if err != nil {
+		return err
+	}
+	alignment := gpt_bpe.AlignVocabularies(draft, target)
+	log.Printf("Aligned %s to %s: %d exact, %d split, %d unmapped",
+		*draftId, *targetId, alignment.Exact, alignment.Split,
+		len(alignment.Unmapped))
+	var writer io.Writer = os.Stdout
+	if *output != "" {
+		file, err := os.Create(*output)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		writer = file
+	}
+	return alignment.WriteJSON(writer)
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/wbrown/gpt_bpe"
+)
+
+// The formats that mock corpora are written in: text files of documents
+// separated by blank lines, or JSONL files of a {"id", "text"} object for
+// each document.
+const (
+	CorpusFormatText  = "text"
+	CorpusFormatJSONL = "jsonl"
+)
+
+// WriteMockCorpus
+// Writes documents of corpus to dir, spread evenly over the given number of
+// files of format, named corpus_0000.txt or corpus_0000.jsonl onwards, and
+// returns their paths.
+func WriteMockCorpus(dir string, corpus *gpt_bpe.MockCorpus, documents int,
+	files int, format string) ([]string, error) {
+	extension := ".txt"
+	switch format {
+	case CorpusFormatText:
+	case CorpusFormatJSONL:
+		extension = ".jsonl"
+	default:
+		return nil, errors.New(fmt.Sprintf("invalid corpus format %s", format))
+	}
+	if files < 1 || documents < 0 {
+		return nil, errors.New(fmt.Sprintf("invalid count of %d documents "+
+			"in %d files", documents, files))
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	paths := make([]string, 0, files)
+	id := 0
+	for fileIdx := 0; fileIdx < files; fileIdx++ {
+		path := filepath.Join(dir, fmt.Sprintf("corpus_%04d%s", fileIdx,
+			extension))
+		file, err := os.Create(path)
+		if err != nil {
+			return paths, err
+		}
+		writer := bufio.NewWriter(file)
+		// The first documents%files files are one document longer.
+		count := documents / files
+		if fileIdx < documents%files {
+			count++
+		}
+		for idx := 0; idx < count && err == nil; idx++ {
+			document := corpus.Document()
+			if format == CorpusFormatText {
+				if idx > 0 {
+					_, err = writer.WriteString("\n\n")
+				}
+				if err == nil {
+					_, err = writer.WriteString(document)
+				}
+			} else {
+				var line []byte
+				line, err = json.Marshal(map[string]interface{}{
+					"id": id, "text": document})
+				if err == nil {
+					_, err = writer.Write(append(line, '\n'))
+				}
+			}
+			id++
+		}
+		if err == nil {
+			err = writer.Flush()
+		}
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return paths, err
+		}
+		paths = append(paths, path)
+	}
+	return paths, nil
+}
+
+func runCorpus(args []string) error {
+	defaults := gpt_bpe.DefaultMockCorpusOptions()
+	flags := flag.NewFlagSet("corpus", flag.ExitOnError)
+	output := flags.String("output", "corpus",
+		"directory to write the corpus files to")
+	documents := flags.Int("documents", 1000, "number of documents")
+	files := flags.Int("files", 1,
+		"number of files to spread the documents over")
+	format := flags.String("format", CorpusFormatText,
+		"format of the files: text, of documents separated by blank lines, "+
+			"or jsonl")
+	seed := flags.Int64("seed", defaults.Seed,
+		"seed that determines the documents")
+	scripts := flags.String("scripts", "latin:80,cyrillic:10,cjk:10",
+		"comma separated scripts that lines are written in, and their "+
+			"weights, of: arabic, cjk, cyrillic, devanagari, digits, greek, "+
+			"hangul, hebrew, kana, latin, latin_ext")
+	minLines := flags.Int("min_lines", defaults.MinLines,
+		"minimum number of lines of a document")
+	maxLines := flags.Int("max_lines", defaults.MaxLines,
+		"maximum number of lines of a document")
+	minLineLength := flags.Int("min_line_length", defaults.MinLineLength,
+		"minimum length of a line, in runes")
+	maxLineLength := flags.Int("max_line_length", defaults.MaxLineLength,
+		"maximum length of a line, in runes, which its last word may exceed")
+	emojiDensity := flags.Float64("emoji_density", defaults.EmojiDensity,
+		"chance of each word being an emoji")
+	lookalikeDensity := flags.Float64("lookalike_density",
+		defaults.LookalikeDensity,
+		"chance of each line holding a special token lookalike")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	mix, err := gpt_bpe.ParseScriptMix(*scripts)
+	if err != nil {
+		return err
+	}
+	corpus, err := gpt_bpe.NewMockCorpus(gpt_bpe.MockCorpusOptions{
+		Seed:             *seed,
+		Scripts:          mix,
+		MinLines:         *minLines,
+		MaxLines:         *maxLines,
+		MinLineLength:    *minLineLength,
+		MaxLineLength:    *maxLineLength,
+		EmojiDensity:     *emojiDensity,
+		LookalikeDensity: *lookalikeDensity,
+	})
+	if err != nil {
+		return err
+	}
+	paths, err := WriteMockCorpus(*output, corpus, *documents, *files,
+		*format)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Wrote %d documents to %d files in %s\n", *documents,
+		len(paths), *output)
+	return nil
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/wbrown/gpt_bpe"
+	"github.com/wbrown/gpt_bpe/resources"
+)
+
+// The statuses of a Diagnosis.
+const (
+	DiagnosisOk   = "ok"
+	DiagnosisWarn = "warn"
+	DiagnosisFail = "FAIL"
+)
+
+// roundTripProbe is a text that every lossless tokenizer decodes back to
+// itself, and that tokenizers which normalize text, such as CLIP's, do not.
+const roundTripProbe = "Hello, World!"
+
+// Diagnosis
+// The outcome of one check of doctor, and a hint of how to fix it when it
+// did not pass.
+type Diagnosis struct {
+	Check  string
+	Status string
+	Detail string
+	Hint   string
+}
+
+// Diagnose
+// Checks the build, each of the tokenizers, and the directory that remote
+// tokenizers are downloaded to, and returns a Diagnosis of each check.
+func Diagnose(tokenizers []string, downloadDir string) []Diagnosis {
+	diagnoses := []Diagnosis{{
+		Check:  "build",
+		Status: DiagnosisOk,
+		Detail: fmt.Sprintf("gpt_bpe %s, %s %s/%s, Unicode tables %s",
+			gpt_bpe.Version(), runtime.Version(), runtime.GOOS,
+			runtime.GOARCH, gpt_bpe.UNICODE_TABLES_VERSION),
+	}}
+	if unicode.Version != gpt_bpe.UNICODE_TABLES_VERSION {
+		diagnoses[0].Detail += fmt.Sprintf(" (runtime %s)", unicode.Version)
+	}
+	for _, tokenizer := range tokenizers {
+		diagnoses = append(diagnoses, DiagnoseTokenizer(tokenizer)...)
+	}
+	return append(diagnoses, DiagnoseDownloadDir(downloadDir))
+}
+
+// DiagnoseTokenizer
+// Loads the tokenizer with that id, verifies its fingerprint against the
+// embedded tokenizer or the package.json of a packaged one, and checks that
+// it decodes FuzzSeeds back to the texts that they are. Tokenizers that
+// normalize text cannot do so, and are only checked to encode them to tokens
+// of their vocabulary.
+func DiagnoseTokenizer(id string) []Diagnosis {
+	check := "tokenizer " + id
+	encoder, err := gpt_bpe.NewEncoder(id)
+	if err != nil {
+		hint := "check the id, or the path of the tokenizer's directory"
+		if errors.Is(err, gpt_bpe.ErrSignatureInvalid) {
+			hint = "package and sign the tokenizer with `gptbpe package " +
+				"-sign`, or trust its key"
+		} else if errors.Is(err, gpt_bpe.ErrResourceMissing) {
+			hint = "check network access to huggingface.co, and " +
+				"HF_API_TOKEN for gated models"
+		}
+		return []Diagnosis{{check, DiagnosisFail, err.Error(), hint}}
+	}
+	return []Diagnosis{
+		diagnoseFingerprint(check, id, encoder),
+		diagnoseRoundTrips(check, encoder),
+	}
+}
+
+// diagnoseFingerprint checks the fingerprint of the encoder of the
+// tokenizer with that id against the fingerprint that it is expected to
+// have, if any.
+func diagnoseFingerprint(check string, id string,
+	encoder *gpt_bpe.GPTEncoder) Diagnosis {
+	fingerprint := encoder.Fingerprint()
+	diagnosis := Diagnosis{Check: check + " fingerprint",
+		Status: DiagnosisOk, Detail: fingerprint}
+	if dataVersion, ok := gpt_bpe.EmbeddedDataVersions[id]; ok {
+		// The embedded encoders are built when the package is initialized,
+		// and must be built the same by NewEncoder.
+		embedded, err := gpt_bpe.SharedEncoder(id)
+		if err != nil || embedded.Fingerprint() != fingerprint {
+			diagnosis.Status = DiagnosisFail
+			diagnosis.Detail = fmt.Sprintf("%s does not match the embedded "+
+				"tokenizer's", fingerprint)
+			diagnosis.Hint = "rebuild the binary, as its embedded data " +
+				"is inconsistent"
+		} else {
+			diagnosis.Detail += fmt.Sprintf(", embedded data version %d",
+				dataVersion)
+		}
+		return diagnosis
+	}
+	infoJson, err := os.ReadFile(filepath.Join(id,
+		resources.PACKAGE_MANIFEST_FILE))
+	if errors.Is(err, os.ErrNotExist) {
+		return diagnosis
+	}
+	var info PackageInfo
+	if err == nil {
+		err = json.Unmarshal(infoJson, &info)
+	}
+	if err != nil {
+		diagnosis.Status = DiagnosisFail
+		diagnosis.Detail = err.Error()
+		diagnosis.Hint = "repackage the tokenizer with `gptbpe package`"
+	} else if info.Fingerprint != fingerprint {
+		diagnosis.Status = DiagnosisFail
+		diagnosis.Detail = fmt.Sprintf("%s does not match %s of its "+
+			"package, built by gptbpe %s", fingerprint, info.Fingerprint,
+			info.GptBpeVersion)
+		diagnosis.Hint = "the package's files were changed, or this " +
+			"release tokenizes differently; verify it with `gptbpe " +
+			"verify`, or repackage it"
+	} else {
+		diagnosis.Detail += ", matches its package"
+	}
+	return diagnosis
+}
+
+// diagnoseRoundTrips encodes and decodes the valid UTF-8 texts of
+// FuzzSeeds with encoder, failing on the first that does not decode back to
+// itself, or that panics.
+func diagnoseRoundTrips(check string,
+	encoder *gpt_bpe.GPTEncoder) (diagnosis Diagnosis) {
+	diagnosis = Diagnosis{Check: check + " round trips",
+		Status: DiagnosisOk}
+	defer func() {
+		if r := recover(); r != nil {
+			diagnosis.Status = DiagnosisFail
+			diagnosis.Detail = fmt.Sprintf("panic: %v", r)
+			diagnosis.Hint = "report this as a bug, along with this output"
+		}
+	}()
+	probe := roundTripProbe
+	lossless := encoder.Decode(encoder.Encode(&probe)) == probe
+	texts := 0
+	for _, seed := range gpt_bpe.FuzzSeeds {
+		if !utf8.ValidString(seed) {
+			continue
+		}
+		texts++
+		text := seed
+		tokens := encoder.Encode(&text)
+		if err := encoder.CheckTokens(tokens); err != nil {
+			diagnosis.Status = DiagnosisFail
+			diagnosis.Detail = fmt.Sprintf("%q: %v", seed, err)
+			diagnosis.Hint = "report this as a bug, along with this output"
+			return diagnosis
+		}
+		if decoded := encoder.Decode(tokens); lossless && decoded != seed {
+			diagnosis.Status = DiagnosisFail
+			diagnosis.Detail = fmt.Sprintf("%q decoded as %q", seed,
+				decoded)
+			diagnosis.Hint = "report this as a bug, along with this output"
+			return diagnosis
+		}
+	}
+	diagnosis.Detail = fmt.Sprintf("%d texts", texts)
+	if !lossless {
+		diagnosis.Status = DiagnosisWarn
+		diagnosis.Detail += ", not compared as the tokenizer normalizes text"
+	}
+	return diagnosis
+}
+
+// DiagnoseDownloadDir
+// Checks that the directory that remote tokenizers are downloaded to is
+// writable, and warns of the directories of downloads that were interrupted
+// before they could be removed.
+func DiagnoseDownloadDir(dir string) Diagnosis {
+	diagnosis := Diagnosis{Check: "download directory " + dir,
+		Status: DiagnosisOk, Detail: "writable"}
+	probe, err := os.CreateTemp(dir, "gptbpe-doctor")
+	if err != nil {
+		diagnosis.Status = DiagnosisFail
+		diagnosis.Detail = err.Error()
+		diagnosis.Hint = "set TMPDIR to a writable directory"
+		return diagnosis
+	}
+	probe.Close()
+	os.Remove(probe.Name())
+	stale, _ := filepath.Glob(filepath.Join(dir, "resources*"))
+	if len(stale) > 0 {
+		sort.Strings(stale)
+		diagnosis.Status = DiagnosisWarn
+		diagnosis.Detail = fmt.Sprintf("%d interrupted downloads: %s",
+			len(stale), strings.Join(stale, ", "))
+		diagnosis.Hint = "remove them once no tokenizer is being downloaded"
+	}
+	return diagnosis
+}
+
+// WriteDiagnoses
+// Writes a line for each diagnosis, followed by its hint when it has one,
+// and returns the number that failed.
+func WriteDiagnoses(writer io.Writer, diagnoses []Diagnosis) (int, error) {
+	failed := 0
+	for _, diagnosis := range diagnoses {
+		if diagnosis.Status == DiagnosisFail {
+			failed++
+		}
+		if _, err := fmt.Fprintf(writer, "%-4s %s: %s\n", diagnosis.Status,
+			diagnosis.Check, diagnosis.Detail); err != nil {
+			return failed, err
+		}
+		if diagnosis.Hint != "" {
+			if _, err := fmt.Fprintf(writer, "     hint: %s\n",
+				diagnosis.Hint); err != nil {
+				return failed, err
+			}
+		}
+	}
+	return failed, nil
+}
+
+func runDoctor(args []string) error {
+	flags := flag.NewFlagSet("doctor", flag.ExitOnError)
+	tokenizers := flags.String("tokenizers", "",
+		"comma separated tokenizers to check along with the embedded ones: "+
+			"huggingface ids, or the directories of packaged tokenizers")
+	downloadDir := flags.String("download_dir", os.TempDir(),
+		"directory that remote tokenizers are downloaded to")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	ids := make([]string, 0, len(gpt_bpe.EmbeddedDataVersions))
+	for id := range gpt_bpe.EmbeddedDataVersions {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range strings.Split(*tokenizers, ",") {
+		if id = strings.TrimSpace(id); id != "" {
+			ids = append(ids, id)
+		}
+	}
+	failed, err := WriteDiagnoses(os.Stdout, Diagnose(ids, *downloadDir))
+	if err != nil {
+		return err
+	} else if failed > 0 {
+		return errors.New(fmt.Sprintf("%d checks failed", failed))
+	}
+	return nil
+}
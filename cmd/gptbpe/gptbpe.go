@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sort"
+)
+
+// commands are the subcommands of gptbpe, by their name.
+var commands = map[string]struct {
+	run         func(args []string) error
+	description string
+}{
+	"align": {runAlign,
+		"map a draft model's vocabulary to a target model's, as JSON"},
+	"corpus": {runCorpus,
+		"generate a deterministic synthetic corpus, for benchmarks and " +
+			"regression tests"},
+	"doctor": {runDoctor,
+		"check the tokenizers and environment, as a first step of a bug " +
+			"report"},
+	"keygen": {runKeygen,
+		"generate an ed25519 key pair for signing packaged tokenizers"},
+	"merges": {runMerges,
+		"export the merge graph of words or of the whole vocabulary, as " +
+			"DOT or JSON"},
+	"migration": {runMigration,
+		"build the migration of an embedded tokenizer's tokens from an " +
+			"older version of its data, as JSON"},
+	"package": {runPackage,
+		"validate a tokenizer and bundle it into a directory or tarball"},
+	"verify": {runVerify,
+		"verify the signature and files of a packaged tokenizer"},
+	"vocab": {runVocab,
+		"write a table of each token's id, bytes and printable form"},
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s <command> [flags]\n\nCommands:\n",
+		os.Args[0])
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %-10s %s\n", name,
+			commands[name].description)
+	}
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+	command, ok := commands[os.Args[1]]
+	if !ok {
+		usage()
+		log.Fatalf("Unknown command: %s", os.Args[1])
+	}
+	if err := command.run(os.Args[2:]); err != nil {
+		log.Fatal(err)
+	}
+}
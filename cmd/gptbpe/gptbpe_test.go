@@ -0,0 +1,277 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/wbrown/gpt_bpe"
+	"github.com/wbrown/gpt_bpe/resources"
+)
+
+func TestPackage(t *testing.T) {
+	// A tokenizer laid out as huggingface does, as converter output is.
+	hfDir := t.TempDir()
+	for name, body := range map[string]string{
+		"config.json":             `{"model_type": "gpt2"}`,
+		"tokenizer.json":          `{}`,
+		"vocab.json":              `{"a": 0, "b": 1, "ab": 2, "<eos>": 3}`,
+		"merges.txt":              "#version: 0.2\na b\n",
+		"special_tokens_map.json": `{"eos_token": "<eos>"}`,
+	} {
+		if err := os.WriteFile(filepath.Join(hfDir, name), []byte(body),
+			0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, input := range []string{"gpt2-tokenizer", "clip-tokenizer",
+		hfDir} {
+		dir := filepath.Join(t.TempDir(), "packaged")
+		info, err := Package(input, dir, true, 0)
+		if !assert.Nil(t, err, input) {
+			continue
+		}
+		source, _ := gpt_bpe.NewEncoder(input)
+		packaged, err := gpt_bpe.NewEncoder(dir)
+		assert.Nil(t, err)
+		assert.Equal(t, source.Fingerprint(), info.Fingerprint)
+		assert.Equal(t, info.Fingerprint, packaged.Fingerprint())
+		fromDir, err := gpt_bpe.NewEncoderFromDir(dir)
+		if assert.Nil(t, err) {
+			assert.Equal(t, info.Fingerprint, fromDir.Fingerprint())
+		}
+		text := "ab<eos>a<|endoftext|>"
+		assert.Equal(t, *source.Encode(&text), *packaged.Encode(&text))
+
+		var read PackageInfo
+		infoJson, err := os.ReadFile(filepath.Join(dir, "package.json"))
+		assert.Nil(t, err)
+		assert.Nil(t, json.Unmarshal(infoJson, &read))
+		assert.Equal(t, info.Fingerprint, read.Fingerprint)
+		for _, name := range []string{"encoder.json", "vocab.bpe",
+			"specials.txt", "unitrim.json", "config.json"} {
+			assert.Contains(t, read.Files, name)
+		}
+		assert.FileExists(t, filepath.Join(dir, "README.md"))
+	}
+	info, err := Package(hfDir, t.TempDir(), false, 0)
+	if assert.Nil(t, err) {
+		assert.Equal(t, []string{"<eos>"}, info.Specials)
+	}
+
+	dir := t.TempDir()
+	info, err = Package("gpt2-tokenizer", dir, false, 2)
+	if assert.Nil(t, err) {
+		assert.Contains(t, info.Specials, "<|reserved_special_1|>")
+		packaged, err := gpt_bpe.NewEncoder(dir)
+		assert.Nil(t, err)
+		assert.Equal(t, gpt_bpe.Tokens{50259},
+			packaged.Specials()["<|reserved_special_1|>"])
+	}
+}
+
+func TestWriteTarball(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "gpt2")
+	if _, err := Package("gpt2-tokenizer", dir, false, 0); err != nil {
+		t.Fatal(err)
+	}
+	tarPath := filepath.Join(t.TempDir(), "gpt2.tar.gz")
+	assert.Nil(t, WriteTarball(dir, tarPath))
+
+	tarFile, err := os.Open(tarPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tarFile.Close()
+	gzipReader, err := gzip.NewReader(tarFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tarReader := tar.NewReader(gzipReader)
+	names := make([]string, 0)
+	for header, err := tarReader.Next(); err == nil; header,
+		err = tarReader.Next() {
+		names = append(names, header.Name)
+	}
+	sort.Strings(names)
+	assert.Equal(t, []string{"gpt2/README.md", "gpt2/config.json",
+		"gpt2/encoder.json", "gpt2/package.json", "gpt2/specials.txt",
+		"gpt2/unitrim.json", "gpt2/vocab.bpe"}, names)
+}
+
+func TestRunVocab(t *testing.T) {
+	output := filepath.Join(t.TempDir(), "vocab.tsv")
+	assert.Nil(t, runVocab([]string{"-tokenizer", "gpt2-tokenizer",
+		"-output", output}))
+	table, err := os.ReadFile(output)
+	assert.Nil(t, err)
+	assert.True(t, strings.HasPrefix(string(table),
+		gpt_bpe.VOCAB_TABLE_HEADER+"0\t21\t!\t0\n"))
+	assert.NotNil(t, runVocab([]string{}))
+}
+
+func TestRunAlign(t *testing.T) {
+	output := filepath.Join(t.TempDir(), "alignment.json")
+	assert.Nil(t, runAlign([]string{"-draft", "gpt2-tokenizer",
+		"-target", "pile-tokenizer", "-output", output}))
+	data, err := os.ReadFile(output)
+	assert.Nil(t, err)
+	var alignment gpt_bpe.VocabAlignment
+	assert.Nil(t, json.Unmarshal(data, &alignment))
+	assert.Equal(t, len(alignment.Tokens), alignment.Exact+alignment.Split)
+	assert.Greater(t, alignment.Exact, 30000)
+	assert.NotNil(t, runAlign([]string{"-draft", "gpt2-tokenizer"}))
+}
+
+func TestSignPackage(t *testing.T) {
+	keyPath := filepath.Join(t.TempDir(), "key")
+	assert.Nil(t, runKeygen([]string{"-output", keyPath}))
+	dir := filepath.Join(t.TempDir(), "gpt2")
+	assert.Nil(t, runPackage([]string{"-input", "gpt2-tokenizer",
+		"-output", dir, "-sign", keyPath}))
+	assert.FileExists(t, filepath.Join(dir, resources.PACKAGE_SIGNATURE_FILE))
+	assert.Nil(t, runVerify([]string{"-dir", dir, "-keys", keyPath + ".pub"}))
+
+	public, err := ReadPublicKey(keyPath + ".pub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resources.RequireSignedPackages(public)
+	defer resources.RequireSignedPackages()
+	_, err = gpt_bpe.NewEncoder(dir)
+	assert.Nil(t, err)
+	_, err = gpt_bpe.NewEncoder("clip-tokenizer")
+	assert.Nil(t, err)
+
+	// Unsigned tokenizers, and signed ones whose files have changed, are
+	// rejected.
+	unsigned := filepath.Join(t.TempDir(), "unsigned")
+	_, err = Package("gpt2-tokenizer", unsigned, false, 0)
+	assert.ErrorIs(t, err, gpt_bpe.ErrSignatureInvalid)
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "specials.txt"),
+		[]byte("<|endoftext|>\n!\n"), 0644))
+	_, err = gpt_bpe.NewEncoder(dir)
+	assert.ErrorIs(t, err, gpt_bpe.ErrSignatureInvalid)
+	assert.NotNil(t, runVerify([]string{"-dir", dir, "-keys",
+		keyPath + ".pub"}))
+}
+
+func TestDoctor(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "gpt2")
+	_, err := Package("gpt2-tokenizer", dir, false, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	downloadDir := t.TempDir()
+	diagnoses := Diagnose([]string{"clip-tokenizer", dir}, downloadDir)
+	statuses := make(map[string]string)
+	for _, diagnosis := range diagnoses {
+		statuses[diagnosis.Check] = diagnosis.Status
+	}
+	assert.Equal(t, map[string]string{
+		"build":                                DiagnosisOk,
+		"tokenizer clip-tokenizer fingerprint": DiagnosisOk,
+		"tokenizer clip-tokenizer round trips": DiagnosisWarn,
+		"tokenizer " + dir + " fingerprint":    DiagnosisOk,
+		"tokenizer " + dir + " round trips":    DiagnosisOk,
+		"download directory " + downloadDir:    DiagnosisOk,
+	}, statuses)
+
+	// A package whose fingerprint does not match its files, and interrupted
+	// downloads, are reported.
+	infoPath := filepath.Join(dir, resources.PACKAGE_MANIFEST_FILE)
+	infoJson, err := os.ReadFile(infoPath)
+	assert.Nil(t, err)
+	var info map[string]interface{}
+	assert.Nil(t, json.Unmarshal(infoJson, &info))
+	info["fingerprint"] = "0123"
+	infoJson, _ = json.Marshal(info)
+	assert.Nil(t, os.WriteFile(infoPath, infoJson, 0644))
+	assert.Nil(t, os.Mkdir(filepath.Join(downloadDir, "resources123"),
+		0755))
+	diagnoses = append(DiagnoseTokenizer(dir),
+		DiagnoseDownloadDir(downloadDir))
+	var output strings.Builder
+	failed, err := WriteDiagnoses(&output, diagnoses)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, failed)
+	assert.Contains(t, output.String(), "FAIL tokenizer "+dir+
+		" fingerprint: ")
+	assert.Contains(t, output.String(), "does not match 0123 of its package")
+	assert.Contains(t, output.String(), "warn download directory "+
+		downloadDir+": 1 interrupted downloads")
+	assert.Contains(t, output.String(), "     hint: ")
+}
+
+func TestWriteMockCorpus(t *testing.T) {
+	write := func(dir string, format string) []string {
+		corpus, err := gpt_bpe.NewMockCorpus(
+			gpt_bpe.DefaultMockCorpusOptions())
+		if !assert.Nil(t, err) {
+			t.FailNow()
+		}
+		paths, err := WriteMockCorpus(dir, corpus, 5, 2, format)
+		if !assert.Nil(t, err) {
+			t.FailNow()
+		}
+		return paths
+	}
+	dir := t.TempDir()
+	paths := write(dir, CorpusFormatText)
+	assert.Equal(t, []string{filepath.Join(dir, "corpus_0000.txt"),
+		filepath.Join(dir, "corpus_0001.txt")}, paths)
+	first, _ := os.ReadFile(paths[0])
+	second, _ := os.ReadFile(paths[1])
+	assert.Len(t, strings.Split(string(first), "\n\n"), 3)
+	assert.Len(t, strings.Split(string(second), "\n\n"), 2)
+
+	// The same options write the same documents, in either format.
+	paths = write(t.TempDir(), CorpusFormatJSONL)
+	assert.Equal(t, "corpus_0000.jsonl", filepath.Base(paths[0]))
+	lines, _ := os.ReadFile(paths[0])
+	var document struct {
+		Id   int    `json:"id"`
+		Text string `json:"text"`
+	}
+	firstLine := strings.SplitN(string(lines), "\n", 2)[0]
+	assert.Nil(t, json.Unmarshal([]byte(firstLine), &document))
+	assert.Equal(t, 0, document.Id)
+	assert.Equal(t, strings.Split(string(first), "\n\n")[0], document.Text)
+
+	corpus, _ := gpt_bpe.NewMockCorpus(gpt_bpe.DefaultMockCorpusOptions())
+	_, err := WriteMockCorpus(t.TempDir(), corpus, 5, 2, "csv")
+	assert.NotNil(t, err)
+}
+
+func TestWriteMergeGraphs(t *testing.T) {
+	encoder, err := gpt_bpe.NewEncoder("gpt2-tokenizer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var output strings.Builder
+	assert.Nil(t, WriteMergeGraphs(&output, encoder, " hello",
+		MergesFormatJSON))
+	var graphs []gpt_bpe.MergeGraph
+	assert.Nil(t, json.Unmarshal([]byte(output.String()), &graphs))
+	if assert.Len(t, graphs, 1) {
+		assert.Equal(t, " hello", graphs[0].Word)
+		root := graphs[0].Nodes[graphs[0].Roots[0]]
+		assert.Equal(t, "Ġhello", root.Piece)
+		assert.Equal(t, int(*encoder.Get("Ġhello")), root.Token)
+	}
+
+	output.Reset()
+	assert.Nil(t, WriteMergeGraphs(&output, encoder, "", MergesFormatDOT))
+	assert.True(t, strings.HasPrefix(output.String(), "digraph merges {"))
+	assert.NotContains(t, output.String(), "subgraph")
+	assert.Contains(t, output.String(), `[label="Ġt\nrank 0\ntoken 256"];`)
+
+	assert.NotNil(t, WriteMergeGraphs(&output, encoder, "", "svg"))
+}
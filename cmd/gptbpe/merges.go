@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/wbrown/gpt_bpe"
+)
+
+// The formats that merge graphs are exported as.
+const (
+	MergesFormatDOT  = "dot"
+	MergesFormatJSON = "json"
+)
+
+// WriteMergeGraphs
+// Writes the merge graphs of the words of text, or of the whole vocabulary
+// if text is empty, to writer as a Graphviz DOT digraph or as JSON.
+func WriteMergeGraphs(writer io.Writer, encoder *gpt_bpe.GPTEncoder,
+	text string, format string) error {
+	if format != MergesFormatDOT && format != MergesFormatJSON {
+		return errors.New(fmt.Sprintf("invalid merges format %s", format))
+	}
+	var graphs []gpt_bpe.MergeGraph
+	if text != "" {
+		var err error
+		if graphs, err = encoder.ExplainMerges(text); err != nil {
+			return err
+		}
+	} else {
+		graph, err := encoder.VocabMergeGraph()
+		if err != nil {
+			return err
+		}
+		graphs = []gpt_bpe.MergeGraph{*graph}
+	}
+	if format == MergesFormatDOT {
+		return gpt_bpe.WriteMergeGraphsDOT(writer, graphs)
+	}
+	jsonEncoder := json.NewEncoder(writer)
+	jsonEncoder.SetIndent("", "  ")
+	return jsonEncoder.Encode(graphs)
+}
+
+func runMerges(args []string) error {
+	flags := flag.NewFlagSet("merges", flag.ExitOnError)
+	tokenizer := flags.String("tokenizer", "",
+		"tokenizer to explore: an embedded or huggingface id, or a directory")
+	text := flags.String("text", "",
+		"text whose words' merges to export, instead of the whole "+
+			"vocabulary's")
+	format := flags.String("format", MergesFormatDOT,
+		"format to export the merge graph as [dot, json]")
+	output := flags.String("output", "",
+		"file to write the merge graph to, instead of standard output")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *tokenizer == "" {
+		flags.Usage()
+		return errors.New("must provide -tokenizer")
+	}
+	encoder, err := gpt_bpe.NewEncoder(*tokenizer)
+	if err != nil {
+		return err
+	}
+	var writer io.Writer = os.Stdout
+	if *output != "" {
+		file, err := os.Create(*output)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		writer = file
+	}
+	return WriteMergeGraphs(writer, encoder, *text, *format)
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"io"
+	"log"
+	"os"
+
+	"github.com/wbrown/gpt_bpe"
+)
+
+func runMigration(args []string) error {
+	flags := flag.NewFlagSet("migration", flag.ExitOnError)
+	tokenizer := flags.String("tokenizer", "",
+		"embedded tokenizer whose data was updated, whose current data is "+
+			"the newer version unless -newer is given")
+	older := flags.String("older", "",
+		"directory of the older version of the tokenizer's data")
+	newer := flags.String("newer", "",
+		"directory of the newer version of the tokenizer's data, instead "+
+			"of the embedded data")
+	from := flags.Int("from", 0, "data version of -older")
+	to := flags.Int("to", 0,
+		"data version of the newer data, which defaults to the embedded "+
+			"tokenizer's")
+	output := flags.String("output", "",
+		"file to write the migration to as JSON, instead of standard output")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *tokenizer == "" || *older == "" || *from <= 0 {
+		flags.Usage()
+		return errors.New("must provide -tokenizer, -older and -from")
+	}
+	if *to == 0 {
+		*to = gpt_bpe.EmbeddedDataVersions[*tokenizer]
+	}
+	newerId := *tokenizer
+	if *newer != "" {
+		newerId = *newer
+	}
+	olderEncoder, err := gpt_bpe.NewEncoder(*older)
+	if err != nil {
+		return err
+	}
+	newerEncoder, err := gpt_bpe.NewEncoder(newerId)
+	if err != nil {
+		return err
+	}
+	migration, err := gpt_bpe.NewTokenMigration(*tokenizer, *from, *to,
+		olderEncoder, newerEncoder)
+	if err != nil {
+		return err
+	}
+	log.Printf("Migrated %s from data version %d to %d: %d changed, %d "+
+		"unmapped", *tokenizer, *from, *to, len(migration.Changed),
+		len(migration.Unmapped))
+	var writer io.Writer = os.Stdout
+	if *output != "" {
+		file, err := os.Create(*output)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		writer = file
+	}
+	return migration.WriteJSON(writer)
+}
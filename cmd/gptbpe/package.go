@@ -0,0 +1,326 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"text/template"
+	"time"
+
+	"github.com/wbrown/gpt_bpe"
+	"github.com/wbrown/gpt_bpe/resources"
+)
+
+// PackageInfo
+// The provenance of a packaged tokenizer, written as package.json.
+type PackageInfo struct {
+	Source        string            `json:"source"`
+	Fingerprint   string            `json:"fingerprint"`
+	GptBpeVersion string            `json:"gpt_bpe_version"`
+	DataVersion   int               `json:"data_version,omitempty"`
+	Created       string            `json:"created"`
+	Specials      []string          `json:"specials"`
+	Collisions    []string          `json:"collisions,omitempty"`
+	Files         map[string]string `json:"files"`
+}
+
+var readmeTemplate = template.Must(template.New("README.md").Parse(
+	`# {{.Source}}
+
+Tokenizer packaged by gptbpe {{.GptBpeVersion}} on {{.Created}}, in the
+layout of the tokenizers embedded in gpt_bpe. Load it with
+` + "`gpt_bpe.NewEncoderFromDir`" + ` or ` + "`gpt_bpe.NewEncoder`" + ` and
+the path of this directory.
+
+Fingerprint: ` + "`{{.Fingerprint}}`" + `
+{{- if .DataVersion}}
+
+Embedded data version: {{.DataVersion}}
+{{- end}}
+
+## Special tokens
+{{range .Specials}}
+- ` + "`{{printf \"%q\" .}}`" + `
+{{- end}}
+{{- if .Collisions}}
+
+## Special token collisions
+{{range .Collisions}}
+- {{.}}
+{{- end}}
+{{- end}}
+
+## Files
+{{range $name, $digest := .Files}}
+- ` + "`{{$name}}`" + ` sha256 ` + "`{{$digest}}`" + `
+{{- end}}
+`))
+
+// Package
+// Validates the tokenizer at input, and writes it to dir in the layout of
+// the embedded tokenizers, along with its provenance. The packaged tokenizer
+// is loaded back, and must have the same fingerprint as the original. With
+// strict, special tokens that collide with the vocabulary fail validation.
+// With reserve, that many token ids after the vocabulary are reserved as
+// special tokens, named with gpt_bpe.RESERVED_SPECIAL_FORMAT.
+func Package(input string, dir string, strict bool,
+	reserve int) (*PackageInfo, error) {
+	encoder, err := gpt_bpe.NewEncoder(input)
+	if err != nil {
+		return nil, err
+	}
+	collisions := encoder.SpecialCollisions()
+	if strict && len(collisions) > 0 {
+		return nil, fmt.Errorf("%w: %v", gpt_bpe.ErrSpecialCollision,
+			collisions[0])
+	}
+	for _, seed := range gpt_bpe.FuzzSeeds {
+		if err := encoder.CheckTokens(encoder.Encode(&seed)); err != nil {
+			return nil, fmt.Errorf("encoding %q: %w", seed, err)
+		}
+	}
+
+	hf, rsrcs, err := resources.ResolveVocabId(input, "")
+	if err != nil {
+		return nil, err
+	}
+	defer rsrcs.Cleanup()
+	files := make(map[string][]byte)
+	if vocab, ok := (*rsrcs)["vocab.json"]; ok {
+		files["encoder.json"] = *vocab.Data
+	} else if vocab, ok := (*rsrcs)["encoder.json"]; ok {
+		files["encoder.json"] = *vocab.Data
+	}
+	if merges, ok := (*rsrcs)["merges.txt"]; ok {
+		files["vocab.bpe"] = *merges.Data
+	}
+	for _, name := range []string{"vocab.bytes.json",
+		"special_config.json"} {
+		if rsrc, ok := (*rsrcs)[name]; ok {
+			files[name] = *rsrc.Data
+		}
+	}
+	if reserve > 0 {
+		if _, err := encoder.ReserveSpecials(reserve); err != nil {
+			return nil, err
+		}
+		if files["encoder.json"], err = encoder.MarshalVocab(); err != nil {
+			return nil, err
+		}
+		if _, ok := files["vocab.bytes.json"]; ok {
+			if files["vocab.bytes.json"], err =
+				encoder.MarshalVocabBytes(); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	specialsMap := encoder.Specials()
+	specials := make([]string, 0, len(specialsMap))
+	for special := range specialsMap {
+		specials = append(specials, special)
+	}
+	sort.Strings(specials)
+	if files["specials.txt"], err = encoder.MarshalSpecials(); err != nil {
+		return nil, err
+	}
+	if files["unitrim.json"], err = json.Marshal(
+		encoder.Unitrim()); err != nil {
+		return nil, err
+	}
+	config := map[string]interface{}{
+		"bos_token": hf.BosTokenStr,
+		"eos_token": hf.EosTokenStr,
+		"pad_token": hf.PadTokenStr,
+	}
+	if hf.ModelType != nil {
+		config["model_type"] = *hf.ModelType
+	}
+	if hf.TokenizerClass != nil {
+		config["tokenizer_class"] = *hf.TokenizerClass
+	}
+	if hf.Newlinemode != nil {
+		config["newlinemode"] = *hf.Newlinemode
+	}
+	if files["config.json"], err = marshalIndent(config); err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	info := &PackageInfo{
+		Source:        input,
+		Fingerprint:   encoder.Fingerprint(),
+		GptBpeVersion: gpt_bpe.Version(),
+		DataVersion:   encoder.DataVersion,
+		Created:       time.Now().UTC().Format(time.RFC3339),
+		Specials:      specials,
+		Files:         make(map[string]string, len(files)),
+	}
+	for _, collision := range collisions {
+		info.Collisions = append(info.Collisions, collision.String())
+	}
+	for name, data := range files {
+		digest := sha256.Sum256(data)
+		info.Files[name] = hex.EncodeToString(digest[:])
+		if err := os.WriteFile(filepath.Join(dir, name), data,
+			0644); err != nil {
+			return nil, err
+		}
+	}
+
+	packaged, err := gpt_bpe.NewEncoder(dir)
+	if err != nil {
+		return nil, fmt.Errorf("loading the packaged tokenizer: %w", err)
+	}
+	if fingerprint := packaged.Fingerprint(); fingerprint !=
+		info.Fingerprint {
+		return nil, errors.New(fmt.Sprintf(
+			"packaged tokenizer fingerprint %s does not match %s",
+			fingerprint, info.Fingerprint))
+	}
+
+	infoJson, err := marshalIndent(info)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(filepath.Join(dir, "package.json"), infoJson,
+		0644); err != nil {
+		return nil, err
+	}
+	readme, err := os.Create(filepath.Join(dir, "README.md"))
+	if err != nil {
+		return nil, err
+	}
+	defer readme.Close()
+	if err := readmeTemplate.Execute(readme, info); err != nil {
+		return nil, err
+	}
+	return info, readme.Close()
+}
+
+// marshalIndent marshals v as indented JSON, leaving the angle brackets of
+// special tokens unescaped.
+func marshalIndent(v interface{}) ([]byte, error) {
+	var buffer bytes.Buffer
+	encoder := json.NewEncoder(&buffer)
+	encoder.SetEscapeHTML(false)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(v); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+// WriteTarball
+// Writes the files of dir to a gzipped tarball at tarPath, under a
+// directory named after dir.
+func WriteTarball(dir string, tarPath string) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	tarFile, err := os.Create(tarPath)
+	if err != nil {
+		return err
+	}
+	defer tarFile.Close()
+	gzipWriter := gzip.NewWriter(tarFile)
+	tarWriter := tar.NewWriter(gzipWriter)
+	base := filepath.Base(filepath.Clean(dir))
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		header, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		header.Name = base + "/" + entry.Name()
+		if err := tarWriter.WriteHeader(header); err != nil {
+			return err
+		}
+		file, err := os.Open(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(tarWriter, file)
+		file.Close()
+		if err != nil {
+			return err
+		}
+	}
+	if err := tarWriter.Close(); err != nil {
+		return err
+	}
+	if err := gzipWriter.Close(); err != nil {
+		return err
+	}
+	return tarFile.Close()
+}
+
+func runPackage(args []string) error {
+	flags := flag.NewFlagSet("package", flag.ExitOnError)
+	input := flags.String("input", "",
+		"tokenizer to package: an embedded or huggingface id, or the "+
+			"directory of converter output")
+	output := flags.String("output", "",
+		"directory to write the packaged tokenizer to")
+	tarball := flags.String("tar", "",
+		"also write the package to this gzipped tarball")
+	strict := flags.Bool("strict", false,
+		"fail if special tokens collide with the vocabulary")
+	reserve := flags.Int("reserve", 0,
+		"reserve this many token ids after the vocabulary as special tokens")
+	signKey := flags.String("sign", "",
+		"sign the package with the ed25519 private key at this path")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *input == "" || *output == "" {
+		flags.Usage()
+		return errors.New("must provide -input and -output")
+	}
+	info, err := Package(*input, *output, *strict, *reserve)
+	if err != nil {
+		return err
+	}
+	for _, collision := range info.Collisions {
+		log.Printf("WARNING: %s", collision)
+	}
+	log.Printf("Packaged %s to %s, fingerprint %s", *input, *output,
+		info.Fingerprint)
+	if *signKey != "" {
+		key, err := ReadPrivateKey(*signKey)
+		if err != nil {
+			return err
+		}
+		if err := resources.SignPackageDir(*output, key); err != nil {
+			return err
+		}
+		log.Printf("Signed %s", *output)
+	}
+	if *tarball != "" {
+		if err := WriteTarball(*output, *tarball); err != nil {
+			return err
+		}
+		log.Printf("Wrote %s", *tarball)
+	}
+	return nil
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/wbrown/gpt_bpe/resources"
+)
+
+// readKey reads a key written by keygen, of base64 bytes of the given size.
+func readKey(path string, size int) ([]byte, error) {
+	encoded, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	key, err := base64.StdEncoding.DecodeString(
+		strings.TrimSpace(string(encoded)))
+	if err != nil || len(key) != size {
+		return nil, errors.New(fmt.Sprintf("%s is not a base64 key of %d "+
+			"bytes", path, size))
+	}
+	return key, nil
+}
+
+// ReadPrivateKey
+// Reads an ed25519 private key, written by keygen, from path.
+func ReadPrivateKey(path string) (ed25519.PrivateKey, error) {
+	key, err := readKey(path, ed25519.PrivateKeySize)
+	return ed25519.PrivateKey(key), err
+}
+
+// ReadPublicKey
+// Reads an ed25519 public key, written by keygen, from path.
+func ReadPublicKey(path string) (ed25519.PublicKey, error) {
+	key, err := readKey(path, ed25519.PublicKeySize)
+	return ed25519.PublicKey(key), err
+}
+
+func runKeygen(args []string) error {
+	flags := flag.NewFlagSet("keygen", flag.ExitOnError)
+	output := flags.String("output", "",
+		"path to write the private key to, and the public key to with .pub")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *output == "" {
+		flags.Usage()
+		return errors.New("must provide -output")
+	}
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(*output, []byte(
+		base64.StdEncoding.EncodeToString(private)+"\n"), 0600); err != nil {
+		return err
+	}
+	if err := os.WriteFile(*output+".pub", []byte(
+		base64.StdEncoding.EncodeToString(public)+"\n"), 0644); err != nil {
+		return err
+	}
+	log.Printf("Wrote %s and %s.pub", *output, *output)
+	return nil
+}
+
+func runVerify(args []string) error {
+	flags := flag.NewFlagSet("verify", flag.ExitOnError)
+	dir := flags.String("dir", "", "directory of the packaged tokenizer")
+	keyPaths := flags.String("keys", "",
+		"comma separated paths of the trusted public keys")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *dir == "" || *keyPaths == "" {
+		flags.Usage()
+		return errors.New("must provide -dir and -keys")
+	}
+	keys := make([]ed25519.PublicKey, 0)
+	for _, path := range strings.Split(*keyPaths, ",") {
+		key, err := ReadPublicKey(path)
+		if err != nil {
+			return err
+		}
+		keys = append(keys, key)
+	}
+	if err := resources.VerifyPackageDir(*dir, keys...); err != nil {
+		return err
+	}
+	log.Printf("Verified %s", *dir)
+	return nil
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"io"
+	"os"
+
+	"github.com/wbrown/gpt_bpe"
+)
+
+func runVocab(args []string) error {
+	flags := flag.NewFlagSet("vocab", flag.ExitOnError)
+	tokenizer := flags.String("tokenizer", "",
+		"tokenizer to export: an embedded or huggingface id, or a directory")
+	output := flags.String("output", "",
+		"file to write the vocabulary table to, instead of standard output")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *tokenizer == "" {
+		flags.Usage()
+		return errors.New("must provide -tokenizer")
+	}
+	encoder, err := gpt_bpe.NewEncoder(*tokenizer)
+	if err != nil {
+		return err
+	}
+	var writer io.Writer = os.Stdout
+	if *output != "" {
+		file, err := os.Create(*output)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		writer = file
+	}
+	return encoder.WriteVocabTable(writer)
+}
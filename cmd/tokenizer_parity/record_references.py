@@ -0,0 +1,25 @@
+"""Records the reference ids of the challenge set with a tokenizer of Hugging
+Face's tokenizers library, given its model id on the Hugging Face Hub:
+
+    pip install tokenizers
+    go run . -record | python record_references.py gpt2 \
+        > references/gpt2-tokenizer.jsonl
+    go run . -record | python record_references.py EleutherAI/gpt-neox-20b \
+        > references/pile-tokenizer.jsonl
+
+The ids are those of Tokenizer.encode, with the special tokens that the
+tokenizer's post-processor adds, if any.
+"""
+import json
+import sys
+
+from tokenizers import Tokenizer
+
+
+if __name__ == "__main__":
+    tokenizer = Tokenizer.from_pretrained(sys.argv[1])
+    for line in sys.stdin:
+        fixture = json.loads(line)
+        fixture["ids"] = tokenizer.encode(fixture["text"]).ids
+        print(json.dumps(fixture, ensure_ascii=False,
+                         separators=(",", ":")))
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"bufio"
+	"embed"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"sort"
+
+	"github.com/wbrown/gpt_bpe"
+)
+
+// challengesJson is the bundled challenge set, of texts by their category.
+//
+//go:embed challenges.json
+var challengesJson []byte
+
+// referencesFs holds the reference ids recorded for the challenge set with
+// the Hugging Face tokenizers of the embedded tokenizers, by
+// record_references.py, as listed in references/README.md.
+//
+//go:embed references
+var referencesFs embed.FS
+
+// Fixture
+// A text of the challenge set, with the token ids that the reference
+// tokenizer encodes it to when recorded.
+type Fixture struct {
+	Category string `json:"category"`
+	Text     string `json:"text"`
+	Ids      []int  `json:"ids,omitempty"`
+}
+
+// LoadChallenges
+// Returns the bundled challenge set, ordered by category.
+func LoadChallenges() ([]Fixture, error) {
+	var byCategory map[string][]string
+	if err := json.Unmarshal(challengesJson, &byCategory); err != nil {
+		return nil, err
+	}
+	categories := make([]string, 0, len(byCategory))
+	for category := range byCategory {
+		categories = append(categories, category)
+	}
+	sort.Strings(categories)
+	challenges := make([]Fixture, 0)
+	for _, category := range categories {
+		for _, text := range byCategory[category] {
+			challenges = append(challenges, Fixture{category, text, nil})
+		}
+	}
+	return challenges, nil
+}
+
+// LoadReferences
+// Returns the reference ids recorded for the challenge set with the embedded
+// tokenizer of that id. Tokenizers without recorded references fail with
+// fs.ErrNotExist.
+func LoadReferences(tokenizerId string) ([]Fixture, error) {
+	file, err := referencesFs.Open("references/" + tokenizerId + ".jsonl")
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return ReadFixtures(file)
+}
+
+// ReadFixtures
+// Reads fixtures from JSON lines.
+func ReadFixtures(reader io.Reader) ([]Fixture, error) {
+	fixtures := make([]Fixture, 0)
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var fixture Fixture
+		if err := json.Unmarshal(scanner.Bytes(), &fixture); err != nil {
+			return nil, fmt.Errorf("line %d: %v", lineNumber, err)
+		}
+		fixtures = append(fixtures, fixture)
+	}
+	return fixtures, scanner.Err()
+}
+
+// WriteFixtures
+// Writes fixtures as JSON lines.
+func WriteFixtures(writer io.Writer, fixtures []Fixture) error {
+	encoder := json.NewEncoder(writer)
+	for _, fixture := range fixtures {
+		if err := encoder.Encode(fixture); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CategoryParity
+// The number of texts in a category that encode to exactly the reference
+// ids, out of those that have been recorded.
+type CategoryParity struct {
+	Category   string
+	Matched    int
+	Total      int
+	Unrecorded int
+}
+
+// Percent
+// Returns the percentage of recorded texts that matched.
+func (parity CategoryParity) Percent() float64 {
+	if parity.Total == 0 {
+		return 0
+	}
+	return 100 * float64(parity.Matched) / float64(parity.Total)
+}
+
+// Mismatch
+// A text that encoded to different ids than the reference, and the index of
+// the first token that differs.
+type Mismatch struct {
+	Fixture Fixture
+	Tokens  gpt_bpe.Tokens
+	Index   int
+}
+
+// firstDifference returns the index of the first token that differs from
+// ids, or -1 if they are the same.
+func firstDifference(tokens gpt_bpe.Tokens, ids []int) int {
+	for idx := 0; idx < len(tokens) && idx < len(ids); idx++ {
+		if int(tokens[idx]) != ids[idx] {
+			return idx
+		}
+	}
+	if len(tokens) != len(ids) {
+		if len(tokens) < len(ids) {
+			return len(tokens)
+		}
+		return len(ids)
+	}
+	return -1
+}
+
+// Compare
+// Encodes each challenge, and compares its tokens to the ids recorded for
+// the same text in references. Returns the parity of each category, in the
+// order of the challenges, with the overall parity last, along with the
+// mismatches.
+func Compare(encoder gpt_bpe.Encoder, challenges,
+	references []Fixture) ([]CategoryParity, []Mismatch) {
+	recorded := make(map[string][]int, len(references))
+	for _, reference := range references {
+		recorded[reference.Text] = reference.Ids
+	}
+	parities := make([]CategoryParity, 0)
+	overall := CategoryParity{Category: "overall"}
+	mismatches := make([]Mismatch, 0)
+	for _, challenge := range challenges {
+		if len(parities) == 0 ||
+			parities[len(parities)-1].Category != challenge.Category {
+			parities = append(parities,
+				CategoryParity{Category: challenge.Category})
+		}
+		parity := &parities[len(parities)-1]
+		ids, ok := recorded[challenge.Text]
+		if !ok {
+			parity.Unrecorded++
+			overall.Unrecorded++
+			continue
+		}
+		parity.Total++
+		overall.Total++
+		tokens := encoder.Encode(&challenge.Text)
+		if idx := firstDifference(*tokens, ids); idx >= 0 {
+			mismatches = append(mismatches, Mismatch{
+				Fixture{challenge.Category, challenge.Text, ids},
+				*tokens, idx})
+		} else {
+			parity.Matched++
+			overall.Matched++
+		}
+	}
+	return append(parities, overall), mismatches
+}
+
+// The reference ids recorded for an embedded tokenizer are checked by
+// default. References are recorded with the HF tokenizers library from the
+// output of -record, by record_references.py:
+//
+//	go run . -record | python record_references.py gpt2 > gpt2.jsonl
+func main() {
+	tokenizerId := flag.String("tokenizer", "gpt2-tokenizer",
+		"tokenizer to check, embedded or a huggingface model id")
+	referencePath := flag.String("reference", "",
+		"JSON lines of the reference ids recorded for the challenge set, "+
+			"by default those recorded for an embedded tokenizer")
+	record := flag.Bool("record", false,
+		"write the challenge set as JSON lines to record references from")
+	verbose := flag.Bool("verbose", false, "print every mismatch")
+	minParity := flag.Float64("min_parity", 100,
+		"exit with an error if the overall parity is below this percentage")
+	flag.Parse()
+
+	challenges, err := LoadChallenges()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *record {
+		if err := WriteFixtures(os.Stdout, challenges); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	var references []Fixture
+	if *referencePath == "" {
+		*referencePath = "the recorded references of " + *tokenizerId
+		references, err = LoadReferences(*tokenizerId)
+		if errors.Is(err, fs.ErrNotExist) {
+			flag.Usage()
+			log.Fatalf("No references are recorded for %s, must provide "+
+				"-reference or -record", *tokenizerId)
+		}
+	} else {
+		var referenceFile *os.File
+		referenceFile, err = os.Open(*referencePath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		references, err = ReadFixtures(referenceFile)
+		referenceFile.Close()
+	}
+	if err != nil {
+		log.Fatalf("Error reading %s: %v", *referencePath, err)
+	}
+	encoder, err := gpt_bpe.NewEncoder(*tokenizerId)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	parities, mismatches := Compare(encoder, challenges, references)
+	if *verbose {
+		for _, mismatch := range mismatches {
+			fmt.Printf("MISMATCH %s %q at token %d\n  go: %v\n  hf: %v\n",
+				mismatch.Fixture.Category, mismatch.Fixture.Text,
+				mismatch.Index, mismatch.Tokens, mismatch.Fixture.Ids)
+		}
+	}
+	fmt.Printf("%-16s %9s %8s %10s\n", "category", "matched", "parity",
+		"unrecorded")
+	for _, parity := range parities {
+		fmt.Printf("%-16s %4d/%-4d %7.2f%% %10d\n", parity.Category,
+			parity.Matched, parity.Total, parity.Percent(),
+			parity.Unrecorded)
+	}
+	overall := parities[len(parities)-1]
+	if overall.Total == 0 {
+		log.Fatalf("No references recorded for the challenge set in %s",
+			*referencePath)
+	}
+	if overall.Percent() < *minParity {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io/fs"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/wbrown/gpt_bpe"
+)
+
+func TestLoadChallenges(t *testing.T) {
+	challenges, err := LoadChallenges()
+	assert.Nil(t, err)
+	categories := make(map[string]int)
+	for _, challenge := range challenges {
+		assert.NotEmpty(t, challenge.Text)
+		categories[challenge.Category]++
+	}
+	for _, category := range []string{"english", "whitespace", "code",
+		"cjk", "rtl", "emoji", "combining", "specials"} {
+		assert.Greater(t, categories[category], 0, category)
+	}
+}
+
+func TestCompare(t *testing.T) {
+	challenges := []Fixture{
+		{"a", "hello world", nil},
+		{"a", "goodbye", nil},
+		{"b", "unrecorded", nil},
+		{"b", "<|endoftext|>", nil},
+	}
+	references := make([]Fixture, 0)
+	for _, challenge := range challenges[:2] {
+		ids := make([]int, 0)
+		for _, token := range *gpt_bpe.GPT2Encoder.Encode(&challenge.Text) {
+			ids = append(ids, int(token))
+		}
+		references = append(references,
+			Fixture{challenge.Category, challenge.Text, ids})
+	}
+	// A reference that the encoder disagrees with in its second token.
+	references[1].Ids = append(references[1].Ids, 42)
+	references = append(references, Fixture{"b", "<|endoftext|>",
+		[]int{50256}})
+
+	// References survive a round trip through JSON lines.
+	var buffer bytes.Buffer
+	assert.Nil(t, WriteFixtures(&buffer, references))
+	read, err := ReadFixtures(&buffer)
+	assert.Nil(t, err)
+	assert.Equal(t, references, read)
+
+	parities, mismatches := Compare(&gpt_bpe.GPT2Encoder, challenges, read)
+	assert.Equal(t, []CategoryParity{
+		{"a", 1, 2, 0},
+		{"b", 1, 1, 1},
+		{"overall", 2, 3, 1},
+	}, parities)
+	assert.InDelta(t, 66.67, parities[2].Percent(), 0.01)
+	if assert.Len(t, mismatches, 1) {
+		assert.Equal(t, "goodbye", mismatches[0].Fixture.Text)
+		assert.Equal(t, len(mismatches[0].Tokens), mismatches[0].Index)
+	}
+}
+
+func TestRecordedReferences(t *testing.T) {
+	challenges, err := LoadChallenges()
+	assert.Nil(t, err)
+	for _, tokenizerId := range []string{"gpt2-tokenizer",
+		"pile-tokenizer"} {
+		references, err := LoadReferences(tokenizerId)
+		if errors.Is(err, fs.ErrNotExist) {
+			t.Logf("no references recorded for %s", tokenizerId)
+			continue
+		} else if !assert.Nil(t, err, tokenizerId) {
+			continue
+		}
+		encoder, err := gpt_bpe.NewEncoder(tokenizerId)
+		if !assert.Nil(t, err, tokenizerId) {
+			continue
+		}
+		parities, mismatches := Compare(encoder, challenges, references)
+		overall := parities[len(parities)-1]
+		assert.Equal(t, len(challenges), overall.Total, tokenizerId)
+		for _, mismatch := range mismatches {
+			t.Errorf("%s: %q at token %d\n  go: %v\n  hf: %v", tokenizerId,
+				mismatch.Fixture.Text, mismatch.Index, mismatch.Tokens,
+				mismatch.Fixture.Ids)
+		}
+	}
+	_, err = LoadReferences("clip-tokenizer")
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+}
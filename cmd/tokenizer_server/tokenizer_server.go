@@ -0,0 +1,380 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/wbrown/gpt_bpe"
+)
+
+// DefaultMaxRequestBytes is the largest request body in bytes that a
+// TokenizerServer reads by default.
+const DefaultMaxRequestBytes = 1024 * 1024
+
+// DefaultMaxInputBytes is the longest text in bytes that the encoders of a
+// TokenizerServer encode by default.
+const DefaultMaxInputBytes = 256 * 1024
+
+// EncoderLimits
+// The limits of the encoders of a TokenizerServer, where zero disables a
+// limit. Words longer than MaxWordLength are split before they are merged,
+// since the cost of merging a word grows faster than its length, so that a
+// single request of one unbroken word cannot tie up the server.
+type EncoderLimits struct {
+	MaxInputBytes   int
+	MaxOutputTokens int
+	MaxWordLength   int
+}
+
+// DefaultEncoderLimits are the limits of the encoders of a TokenizerServer
+// unless others are given, which encode texts of any number of tokens.
+var DefaultEncoderLimits = EncoderLimits{
+	MaxInputBytes: DefaultMaxInputBytes,
+	MaxWordLength: gpt_bpe.MAXWORD_SZ,
+}
+
+// TokenizerServer
+// Serves the encoders of its tokenizers over HTTP, as JSON endpoints, so
+// that services that are not written in Go can tokenize text exactly as
+// these tokenizers do:
+//
+//	POST /encode      {"tokenizer": id, "text": text} to {"tokens": [...]}
+//	POST /decode      {"tokenizer": id, "tokens": [...]} to {"text": text}
+//	POST /count       {"tokenizer": id, "text": text} to {"count": n}
+//	GET  /tokenizers  the tokenizers that are served, and their fingerprints
+//
+// Requests that omit the tokenizer use Default. Request bodies larger than
+// MaxRequestBytes, and texts that exceed the input or output limits of the
+// encoders, are rejected with 413 Request Entity Too Large.
+type TokenizerServer struct {
+	Default         string
+	MaxRequestBytes int64
+	tokenizers      []string
+	encoders        map[string]*gpt_bpe.GPTEncoder
+}
+
+// NewTokenizerServer
+// Creates a TokenizerServer of the tokenizers, which may be embedded or
+// huggingface ids, the first of which is the default. Each encoder is built
+// when the server is created, with limits.
+func NewTokenizerServer(tokenizers []string,
+	limits EncoderLimits) (*TokenizerServer, error) {
+	if len(tokenizers) == 0 {
+		return nil, errors.New("at least one tokenizer is required")
+	}
+	server := &TokenizerServer{
+		Default:         tokenizers[0],
+		MaxRequestBytes: DefaultMaxRequestBytes,
+		tokenizers:      make([]string, 0, len(tokenizers)),
+		encoders: make(map[string]*gpt_bpe.GPTEncoder,
+			len(tokenizers)),
+	}
+	for _, id := range tokenizers {
+		if _, ok := server.encoders[id]; ok {
+			continue
+		}
+		encoder, err := gpt_bpe.NewEncoderWithOptions(id,
+			gpt_bpe.WithMaxInputBytes(limits.MaxInputBytes),
+			gpt_bpe.WithMaxOutputTokens(limits.MaxOutputTokens),
+			gpt_bpe.WithMaxWordLength(limits.MaxWordLength))
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf(
+				"error loading tokenizer %s: %v", id, err))
+		}
+		server.tokenizers = append(server.tokenizers, id)
+		server.encoders[id] = encoder
+	}
+	return server, nil
+}
+
+// encodeRequest is the body of /encode and /count requests.
+type encodeRequest struct {
+	Tokenizer string `json:"tokenizer"`
+	Text      string `json:"text"`
+}
+
+// decodeRequest is the body of /decode requests.
+type decodeRequest struct {
+	Tokenizer string          `json:"tokenizer"`
+	Tokens    []gpt_bpe.Token `json:"tokens"`
+}
+
+// encodeResponse is the body of /encode responses.
+type encodeResponse struct {
+	Tokenizer string          `json:"tokenizer"`
+	Tokens    []gpt_bpe.Token `json:"tokens"`
+}
+
+// decodeResponse is the body of /decode responses.
+type decodeResponse struct {
+	Tokenizer string `json:"tokenizer"`
+	Text      string `json:"text"`
+}
+
+// countResponse is the body of /count responses.
+type countResponse struct {
+	Tokenizer string `json:"tokenizer"`
+	Count     int    `json:"count"`
+}
+
+// tokenizerInfo describes a tokenizer that is served, in /tokenizers
+// responses.
+type tokenizerInfo struct {
+	Id          string `json:"id"`
+	Fingerprint string `json:"fingerprint"`
+}
+
+// tokenizersResponse is the body of /tokenizers responses.
+type tokenizersResponse struct {
+	Default    string          `json:"default"`
+	Tokenizers []tokenizerInfo `json:"tokenizers"`
+}
+
+// errorResponse is the body of the responses of failed requests.
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+// requestError is the error of a request, along with its HTTP status.
+type requestError struct {
+	status int
+	err    error
+}
+
+func (err *requestError) Error() string {
+	return err.err.Error()
+}
+
+// Handler
+// Returns the handler of the server's endpoints.
+func (server *TokenizerServer) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/encode", server.handleEncode)
+	mux.HandleFunc("/decode", server.handleDecode)
+	mux.HandleFunc("/count", server.handleCount)
+	mux.HandleFunc("/tokenizers", server.handleTokenizers)
+	return mux
+}
+
+// writeJSON writes body as the JSON response of a request, with status.
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		log.Printf("Error writing response: %v", err)
+	}
+}
+
+// writeError writes err as the JSON response of a failed request, with
+// the status of a requestError, or 500 Internal Server Error otherwise.
+func writeError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	var reqErr *requestError
+	if errors.As(err, &reqErr) {
+		status = reqErr.status
+	}
+	writeJSON(w, status, errorResponse{Error: err.Error()})
+}
+
+// readRequest reads the JSON body of a POST request into body, rejecting
+// bodies that are larger than MaxRequestBytes without reading the rest.
+func (server *TokenizerServer) readRequest(r *http.Request,
+	body interface{}) error {
+	if r.Method != http.MethodPost {
+		return &requestError{http.StatusMethodNotAllowed,
+			errors.New(fmt.Sprintf("%s requires POST", r.URL.Path))}
+	}
+	data, err := io.ReadAll(io.LimitReader(r.Body, server.MaxRequestBytes+1))
+	if err != nil {
+		return &requestError{http.StatusBadRequest, err}
+	} else if int64(len(data)) > server.MaxRequestBytes {
+		return &requestError{http.StatusRequestEntityTooLarge,
+			errors.New(fmt.Sprintf("request body exceeds the limit of %d "+
+				"bytes", server.MaxRequestBytes))}
+	}
+	if err = json.Unmarshal(data, body); err != nil {
+		return &requestError{http.StatusBadRequest,
+			errors.New(fmt.Sprintf("invalid request: %v", err))}
+	}
+	return nil
+}
+
+// encoder returns the id and encoder of a requested tokenizer, or of the
+// default tokenizer if id is empty.
+func (server *TokenizerServer) encoder(
+	id string) (string, *gpt_bpe.GPTEncoder, error) {
+	if id == "" {
+		id = server.Default
+	}
+	encoder, ok := server.encoders[id]
+	if !ok {
+		return id, nil, &requestError{http.StatusNotFound,
+			errors.New(fmt.Sprintf("unknown tokenizer %s", id))}
+	}
+	return id, encoder, nil
+}
+
+// encode encodes the text of an /encode or /count request.
+func (server *TokenizerServer) encode(
+	r *http.Request) (string, gpt_bpe.Tokens, error) {
+	var request encodeRequest
+	if err := server.readRequest(r, &request); err != nil {
+		return "", nil, err
+	}
+	id, encoder, err := server.encoder(request.Tokenizer)
+	if err != nil {
+		return id, nil, err
+	}
+	tokens, err := encoder.EncodeLimited(&request.Text)
+	if errors.Is(err, gpt_bpe.ErrInputTooLarge) ||
+		errors.Is(err, gpt_bpe.ErrOutputTooLarge) {
+		return id, nil, &requestError{http.StatusRequestEntityTooLarge, err}
+	} else if err != nil {
+		return id, nil, err
+	}
+	return id, *tokens, nil
+}
+
+func (server *TokenizerServer) handleEncode(w http.ResponseWriter,
+	r *http.Request) {
+	id, tokens, err := server.encode(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, encodeResponse{Tokenizer: id,
+		Tokens: tokens})
+}
+
+func (server *TokenizerServer) handleCount(w http.ResponseWriter,
+	r *http.Request) {
+	id, tokens, err := server.encode(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, countResponse{Tokenizer: id,
+		Count: len(tokens)})
+}
+
+func (server *TokenizerServer) handleDecode(w http.ResponseWriter,
+	r *http.Request) {
+	var request decodeRequest
+	if err := server.readRequest(r, &request); err != nil {
+		writeError(w, err)
+		return
+	}
+	id, encoder, err := server.encoder(request.Tokenizer)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	tokens := gpt_bpe.Tokens(request.Tokens)
+	if err = encoder.CheckTokens(&tokens); err != nil {
+		writeError(w, &requestError{http.StatusBadRequest, err})
+		return
+	}
+	writeJSON(w, http.StatusOK, decodeResponse{Tokenizer: id,
+		Text: encoder.Decode(&tokens)})
+}
+
+func (server *TokenizerServer) handleTokenizers(w http.ResponseWriter,
+	r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, &requestError{http.StatusMethodNotAllowed,
+			errors.New("/tokenizers requires GET")})
+		return
+	}
+	response := tokenizersResponse{Default: server.Default,
+		Tokenizers: make([]tokenizerInfo, 0, len(server.tokenizers))}
+	for _, id := range server.tokenizers {
+		response.Tokenizers = append(response.Tokenizers, tokenizerInfo{
+			Id: id, Fingerprint: server.encoders[id].Fingerprint()})
+	}
+	writeJSON(w, http.StatusOK, response)
+}
+
+func main() {
+	listen := flag.String("listen", "localhost:8080",
+		"address to listen on, which is local by default")
+	tokenizers := flag.String("tokenizers", "gpt2-tokenizer",
+		"comma separated tokenizers to serve, embedded or huggingface ids, "+
+			"the first of which is the default of requests")
+	maxRequestBytes := flag.Int64("max_request_bytes",
+		DefaultMaxRequestBytes, "largest request body in bytes")
+	maxInputBytes := flag.Int("max_input_bytes", DefaultMaxInputBytes,
+		"longest text in bytes that is encoded, or 0 for no limit")
+	maxTokens := flag.Int("max_tokens", 0,
+		"most tokens that a text may encode to, or 0 for no limit")
+	maxWordLength := flag.Int("max_word_length", gpt_bpe.MAXWORD_SZ,
+		"longest word in bytes that is merged whole, where longer words "+
+			"are split, or 0 for no limit, which leaves the server open "+
+			"to texts of one long word")
+	shutdownTimeout := flag.Duration("shutdown_timeout", 10*time.Second,
+		"time to wait for requests in flight to finish on shutdown")
+	flag.Parse()
+
+	if *maxRequestBytes <= 0 {
+		log.Fatal("-max_request_bytes must be positive")
+	} else if *maxInputBytes < 0 {
+		log.Fatal("-max_input_bytes cannot be negative")
+	} else if *maxTokens < 0 {
+		log.Fatal("-max_tokens cannot be negative")
+	} else if *maxWordLength < 0 {
+		log.Fatal("-max_word_length cannot be negative")
+	}
+	ids := make([]string, 0)
+	for _, id := range strings.Split(*tokenizers, ",") {
+		if id = strings.TrimSpace(id); id != "" {
+			ids = append(ids, id)
+		}
+	}
+	server, err := NewTokenizerServer(ids, EncoderLimits{
+		MaxInputBytes:   *maxInputBytes,
+		MaxOutputTokens: *maxTokens,
+		MaxWordLength:   *maxWordLength,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	server.MaxRequestBytes = *maxRequestBytes
+
+	httpServer := &http.Server{
+		Addr:              *listen,
+		Handler:           server.Handler(),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	// On an interrupt or termination, the server stops accepting requests,
+	// and waits for the requests in flight before exiting.
+	done := make(chan struct{})
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+		<-signals
+		log.Printf("Shutting down")
+		ctx, cancel := context.WithTimeout(context.Background(),
+			*shutdownTimeout)
+		defer cancel()
+		if shutdownErr := httpServer.Shutdown(ctx); shutdownErr != nil {
+			log.Printf("Error shutting down: %v", shutdownErr)
+		}
+		close(done)
+	}()
+	log.Printf("Serving %s on %s", strings.Join(server.tokenizers, ", "),
+		*listen)
+	if err = httpServer.ListenAndServe(); err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+	<-done
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/wbrown/gpt_bpe"
+)
+
+// request sends a request to the server's handler, and returns its status
+// and the decoded JSON response.
+func request(server *TokenizerServer, method string, path string,
+	body string) (int, map[string]interface{}) {
+	recorder := httptest.NewRecorder()
+	server.Handler().ServeHTTP(recorder,
+		httptest.NewRequest(method, path, strings.NewReader(body)))
+	var response map[string]interface{}
+	json.Unmarshal(recorder.Body.Bytes(), &response)
+	return recorder.Code, response
+}
+
+func TestTokenizerServer(t *testing.T) {
+	server, err := NewTokenizerServer([]string{"gpt2-tokenizer",
+		"pile-tokenizer", "gpt2-tokenizer"}, DefaultEncoderLimits)
+	if !assert.Nil(t, err) {
+		return
+	}
+	text := "Hello, world! This is a test."
+	expected := make([]interface{}, 0)
+	for _, token := range *gpt_bpe.GPT2Encoder.Encode(&text) {
+		expected = append(expected, float64(token))
+	}
+
+	status, response := request(server, http.MethodPost, "/encode",
+		`{"text": "Hello, world! This is a test."}`)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "gpt2-tokenizer", response["tokenizer"])
+	assert.Equal(t, expected, response["tokens"])
+
+	tokensJson, _ := json.Marshal(response["tokens"])
+	status, response = request(server, http.MethodPost, "/decode",
+		`{"tokenizer": "gpt2-tokenizer", "tokens": `+string(tokensJson)+`}`)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, text, response["text"])
+
+	status, response = request(server, http.MethodPost, "/count",
+		`{"tokenizer": "pile-tokenizer", "text": "Hello, world!"}`)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "pile-tokenizer", response["tokenizer"])
+	assert.Equal(t, float64(4), response["count"])
+
+	status, response = request(server, http.MethodGet, "/tokenizers", "")
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "gpt2-tokenizer", response["default"])
+	assert.Len(t, response["tokenizers"], 2)
+
+	// Failed requests are answered with a JSON error and their status.
+	status, response = request(server, http.MethodPost, "/encode",
+		`{"tokenizer": "missing", "text": "Hello"}`)
+	assert.Equal(t, http.StatusNotFound, status)
+	assert.Contains(t, response["error"], "missing")
+	status, _ = request(server, http.MethodGet, "/encode", "")
+	assert.Equal(t, http.StatusMethodNotAllowed, status)
+	status, _ = request(server, http.MethodPost, "/decode",
+		`{"tokens": [70000]}`)
+	assert.Equal(t, http.StatusBadRequest, status)
+	server.MaxRequestBytes = 16
+	status, _ = request(server, http.MethodPost, "/count",
+		`{"text": "Hello, world!"}`)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, status)
+
+	// Texts that encode to more than the output limit are rejected.
+	limited, err := NewTokenizerServer([]string{"gpt2-tokenizer"},
+		EncoderLimits{MaxOutputTokens: 4})
+	if !assert.Nil(t, err) {
+		return
+	}
+	status, _ = request(limited, http.MethodPost, "/count",
+		`{"text": "Hello, world!"}`)
+	assert.Equal(t, http.StatusOK, status)
+	status, response = request(limited, http.MethodPost, "/encode",
+		`{"text": "Hello, world! This is a test."}`)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, status)
+	assert.Contains(t, response["error"], "too large")
+
+	_, err = NewTokenizerServer(nil, DefaultEncoderLimits)
+	assert.NotNil(t, err)
+}
+
+func TestTokenizerServer_Parallel(t *testing.T) {
+	server, err := NewTokenizerServer([]string{"gpt2-tokenizer"},
+		DefaultEncoderLimits)
+	if !assert.Nil(t, err) {
+		return
+	}
+	httpServer := httptest.NewServer(server.Handler())
+	defer httpServer.Close()
+
+	// Requests are served concurrently, and share the server's encoder.
+	var wg sync.WaitGroup
+	for idx := 0; idx < 32; idx++ {
+		wg.Add(1)
+		go func(idx int) {
+			defer wg.Done()
+			path := "/encode"
+			if idx%2 == 1 {
+				path = "/count"
+			}
+			body := fmt.Sprintf(`{"text": "Request number %d of many."}`,
+				idx)
+			response, postErr := http.Post(httpServer.URL+path,
+				"application/json", strings.NewReader(body))
+			if !assert.Nil(t, postErr) {
+				return
+			}
+			defer response.Body.Close()
+			assert.Equal(t, http.StatusOK, response.StatusCode)
+		}(idx)
+	}
+	wg.Wait()
+}
+
+func TestTokenizerServer_LongWord(t *testing.T) {
+	server, err := NewTokenizerServer([]string{"gpt2-tokenizer"},
+		EncoderLimits{MaxInputBytes: 16 * 1024,
+			MaxWordLength: gpt_bpe.MAXWORD_SZ})
+	if !assert.Nil(t, err) {
+		return
+	}
+	// An unbroken word of random letters, which would take seconds to merge
+	// whole, is split into words of MAXWORD_SZ bytes.
+	random := rand.New(rand.NewSource(0))
+	word := make([]byte, 8*gpt_bpe.MAXWORD_SZ)
+	for idx := range word {
+		word[idx] = byte('a' + random.Intn(26))
+	}
+	expected := make([]interface{}, 0)
+	for begin := 0; begin < len(word); begin += gpt_bpe.MAXWORD_SZ {
+		piece := string(word[begin : begin+gpt_bpe.MAXWORD_SZ])
+		for _, token := range *gpt_bpe.GPT2Encoder.Encode(&piece) {
+			expected = append(expected, float64(token))
+		}
+	}
+	status, response := request(server, http.MethodPost, "/encode",
+		`{"text": "`+string(word)+`"}`)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, expected, response["tokens"])
+
+	// A word longer than the input limit is rejected before it is merged.
+	start := time.Now()
+	status, response = request(server, http.MethodPost, "/count",
+		`{"text": "`+strings.Repeat(string(word), 4)+`"}`)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, status)
+	assert.Contains(t, response["error"], "too large")
+	assert.Less(t, time.Since(start), time.Second)
+}
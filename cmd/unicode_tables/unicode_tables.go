@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"go/format"
+	"log"
+	"os"
+	"unicode"
+)
+
+// TableSet
+// A Unicode property table that the pre-tokenizers classify runes by, and
+// the name of the variable it is bundled as.
+type TableSet struct {
+	Name    string
+	Comment string
+	Table   *unicode.RangeTable
+}
+
+// PreTokenizerTables
+// The tables that the pre-tokenizers use, of the `\p{L}`, `\p{N}` and `\s`
+// classes of their patterns, and the letter categories and marks that the
+// o200k pattern tells cased words apart by, taken from the Go runtime that
+// runs the generator.
+var PreTokenizerTables = []TableSet{
+	{"unicodeLetters", "the runes of the L category, of \\p{L}",
+		unicode.Letter},
+	{"unicodeNumbers", "the runes of the N category, of \\p{N}",
+		unicode.Number},
+	{"unicodeSpaces", "the runes of the White_Space property, of " +
+		"unicode.IsSpace", unicode.White_Space},
+	{"unicodeUppercase", "the runes of the Lu category, of \\p{Lu}",
+		unicode.Lu},
+	{"unicodeTitlecase", "the runes of the Lt category, of \\p{Lt}",
+		unicode.Lt},
+	{"unicodeLowercase", "the runes of the Ll category, of \\p{Ll}",
+		unicode.Ll},
+	{"unicodeModifierLetters", "the runes of the Lm category, of " +
+		"\\p{Lm}", unicode.Lm},
+	{"unicodeOtherLetters", "the runes of the Lo category, of \\p{Lo}",
+		unicode.Lo},
+	{"unicodeMarks", "the runes of the M category, of \\p{M}",
+		unicode.Mark},
+}
+
+// GenerateTables
+// Returns the Go source of package pkg, bundling the given tables along with
+// the version of Unicode that they are of.
+func GenerateTables(pkg string, version string,
+	tables []TableSet) ([]byte, error) {
+	var source bytes.Buffer
+	fmt.Fprintf(&source, "// Code generated by cmd/unicode_tables. "+
+		"DO NOT EDIT.\n\npackage %s\n\nimport \"unicode\"\n\n", pkg)
+	fmt.Fprintf(&source, "// UNICODE_TABLES_VERSION is the version of "+
+		"Unicode of the bundled tables.\nconst UNICODE_TABLES_VERSION = "+
+		"%q\n", version)
+	for _, table := range tables {
+		fmt.Fprintf(&source, "\n// %s are %s.\nvar %s = "+
+			"&unicode.RangeTable{\n", table.Name, table.Comment, table.Name)
+		if len(table.Table.R16) > 0 {
+			source.WriteString("R16: []unicode.Range16{\n")
+			for _, r := range table.Table.R16 {
+				fmt.Fprintf(&source, "{0x%04x, 0x%04x, %d},\n", r.Lo, r.Hi,
+					r.Stride)
+			}
+			source.WriteString("},\n")
+		}
+		if len(table.Table.R32) > 0 {
+			source.WriteString("R32: []unicode.Range32{\n")
+			for _, r := range table.Table.R32 {
+				fmt.Fprintf(&source, "{0x%x, 0x%x, %d},\n", r.Lo, r.Hi,
+					r.Stride)
+			}
+			source.WriteString("},\n")
+		}
+		fmt.Fprintf(&source, "LatinOffset: %d,\n}\n",
+			table.Table.LatinOffset)
+	}
+	return format.Source(source.Bytes())
+}
+
+func main() {
+	output := flag.String("output", "unicodetables_data.go",
+		"Go source file to write the bundled tables to")
+	pkg := flag.String("package", "gpt_bpe", "package of the output")
+	flag.Parse()
+	source, err := GenerateTables(*pkg, unicode.Version, PreTokenizerTables)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err = os.WriteFile(*output, source, 0644); err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("Wrote the tables of Unicode %s to %s", unicode.Version,
+		*output)
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"unicode"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGenerateTables(t *testing.T) {
+	source, err := GenerateTables("tables", "1.0.0", []TableSet{
+		{"digits", "the ASCII digits", &unicode.RangeTable{
+			R16:         []unicode.Range16{{0x30, 0x39, 1}},
+			LatinOffset: 1}},
+		{"linear", "the Linear B syllables", &unicode.RangeTable{
+			R32: []unicode.Range32{{0x10000, 0x1000b, 1}}}},
+	})
+	if !assert.Nil(t, err) {
+		return
+	}
+	generated := string(source)
+	assert.True(t, strings.HasPrefix(generated, "// Code generated"))
+	assert.Contains(t, generated, `const UNICODE_TABLES_VERSION = "1.0.0"`)
+	assert.Contains(t, generated, "{0x0030, 0x0039, 1},")
+	assert.Contains(t, generated, "LatinOffset: 1,")
+	assert.Contains(t, generated, "R32: []unicode.Range32{\n\t\t{0x10000, "+
+		"0x1000b, 1},")
+}
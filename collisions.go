@@ -0,0 +1,209 @@
+package gpt_bpe
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+)
+
+// ErrSpecialCollision
+// A special token collides with the ordinary tokens of the vocabulary, and
+// the CollisionFail policy is in effect.
+var ErrSpecialCollision = errors.New("special token collision")
+
+// CollisionKind
+// How a special token collides with the vocabulary.
+type CollisionKind uint
+
+const (
+	// CollisionUnknown is a special token that is not in the vocabulary,
+	// which encodes to token 0.
+	CollisionUnknown CollisionKind = iota
+	// CollisionDuplicate is a special token whose text is also an ordinary
+	// token with another id, once mapped to the vocabulary's bytes.
+	CollisionDuplicate
+	// CollisionPrefix is a special token whose text begins ordinary tokens,
+	// which the special token is split from instead.
+	CollisionPrefix
+)
+
+func (kind CollisionKind) String() string {
+	switch kind {
+	case CollisionUnknown:
+		return "not in the vocabulary"
+	case CollisionDuplicate:
+		return "duplicates an ordinary token"
+	case CollisionPrefix:
+		return "is a prefix of ordinary tokens"
+	default:
+		return fmt.Sprintf("CollisionKind(%d)", uint(kind))
+	}
+}
+
+// SpecialCollision
+// A special token that collides with the vocabulary, and the ordinary
+// tokens that it collides with.
+type SpecialCollision struct {
+	Special string
+	Kind    CollisionKind
+	Tokens  []string
+}
+
+func (collision SpecialCollision) String() string {
+	if len(collision.Tokens) == 0 {
+		return fmt.Sprintf("special token %q %v", collision.Special,
+			collision.Kind)
+	}
+	shown := collision.Tokens
+	if len(shown) > 4 {
+		shown = shown[:4]
+	}
+	return fmt.Sprintf("special token %q %v: %q (%d in total)",
+		collision.Special, collision.Kind, shown, len(collision.Tokens))
+}
+
+// CollisionPolicy
+// Determines how special tokens that collide with the vocabulary are
+// resolved.
+type CollisionPolicy uint
+
+const (
+	// CollisionPreferSpecial keeps the colliding special tokens, so that
+	// their text always encodes to them.
+	CollisionPreferSpecial CollisionPolicy = iota
+	// CollisionPreferVocab removes the colliding special tokens, so that
+	// their text encodes as ordinary text.
+	CollisionPreferVocab
+	// CollisionFail fails with ErrSpecialCollision on any collision.
+	CollisionFail
+)
+
+// WithCollisionPolicy
+// Sets how special tokens that collide with the vocabulary are resolved, as
+// ResolveCollisions does.
+func WithCollisionPolicy(policy CollisionPolicy) Option {
+	return func(encoder *GPTEncoder) error {
+		return encoder.ResolveCollisions(policy)
+	}
+}
+
+// mapBytes returns text as it is written in the vocabulary, with each of its
+// bytes mapped to their rune.
+func (encoder *GPTEncoder) mapBytes(text string) string {
+	if encoder.bpeLevel == BPECharLevel {
+		return text
+	}
+	var builder strings.Builder
+	for idx := 0; idx < len(text); idx++ {
+		builder.WriteRune(encoder.byteToRune[text[idx]])
+	}
+	return builder.String()
+}
+
+// SpecialCollisions
+// Returns the special tokens that collide with the ordinary tokens of the
+// vocabulary, ordered by their text.
+func (encoder *GPTEncoder) SpecialCollisions() []SpecialCollision {
+	specials := make([]string, 0, len(encoder.specials))
+	specialTokens := make(map[Token]bool, len(encoder.specials))
+	for special, tokens := range encoder.specials {
+		specials = append(specials, special)
+		if token, ok := encoder.encoder[special]; ok && len(tokens) == 1 &&
+			tokens[0] == token {
+			specialTokens[token] = true
+		}
+	}
+	sort.Strings(specials)
+
+	// The forms that special tokens are found in the vocabulary as, and
+	// their lengths, so that the vocabulary is checked for prefixes in one
+	// pass.
+	forms := make(map[string]string, len(specials)*2)
+	formLengths := make([]int, 0)
+	seenLengths := make(map[int]bool)
+	collisions := make([]SpecialCollision, 0)
+	for _, special := range specials {
+		if _, ok := encoder.encoder[special]; !ok {
+			collisions = append(collisions,
+				SpecialCollision{special, CollisionUnknown, nil})
+			continue
+		}
+		specialForms := []string{special}
+		if mapped := encoder.mapBytes(special); mapped != special {
+			specialForms = append(specialForms, mapped)
+			if token, ok := encoder.encoder[mapped]; ok &&
+				!specialTokens[token] {
+				collisions = append(collisions, SpecialCollision{special,
+					CollisionDuplicate, []string{mapped}})
+			}
+		}
+		for _, form := range specialForms {
+			forms[form] = special
+			if !seenLengths[len(form)] {
+				seenLengths[len(form)] = true
+				formLengths = append(formLengths, len(form))
+			}
+		}
+	}
+
+	prefixed := make(map[string][]string)
+	for text, token := range encoder.encoder {
+		if specialTokens[token] {
+			continue
+		}
+		for _, length := range formLengths {
+			if len(text) <= length {
+				continue
+			}
+			if special, ok := forms[text[:length]]; ok {
+				prefixed[special] = append(prefixed[special], text)
+			}
+		}
+	}
+	for _, special := range specials {
+		if texts, ok := prefixed[special]; ok {
+			sort.Strings(texts)
+			collisions = append(collisions,
+				SpecialCollision{special, CollisionPrefix, texts})
+		}
+	}
+	sort.SliceStable(collisions, func(i, j int) bool {
+		return collisions[i].Special < collisions[j].Special
+	})
+	return collisions
+}
+
+// ResolveCollisions
+// Resolves the special tokens that collide with the vocabulary by policy,
+// which with CollisionPreferVocab removes them from the special tokens and
+// changes the encoder's fingerprint.
+func (encoder *GPTEncoder) ResolveCollisions(policy CollisionPolicy) error {
+	switch policy {
+	case CollisionPreferSpecial:
+		return nil
+	case CollisionPreferVocab, CollisionFail:
+	default:
+		return errors.New(fmt.Sprintf("invalid collision policy %d", policy))
+	}
+	collisions := encoder.SpecialCollisions()
+	if len(collisions) == 0 {
+		return nil
+	}
+	if policy == CollisionFail {
+		return fmt.Errorf("%w: %v", ErrSpecialCollision, collisions[0])
+	}
+	for _, collision := range collisions {
+		delete(encoder.specials, collision.Special)
+	}
+	return encoder.updateSpecials()
+}
+
+// warnCollisions logs a warning for each of the special tokens that collide
+// with the vocabulary.
+func (encoder *GPTEncoder) warnCollisions(vocabId string) {
+	for _, collision := range encoder.SpecialCollisions() {
+		log.Printf("WARNING: %s %v", vocabId, collision)
+	}
+}
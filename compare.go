@@ -0,0 +1,208 @@
+package gpt_bpe
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// TokenSpan
+// A token, and the byte range of the text that it encodes. Tokens that each
+// encode only part of a character, and so cannot be decoded alone, share the
+// span of the characters that they encode together.
+type TokenSpan struct {
+	Token Token
+	Start int
+	End   int
+}
+
+// Segmentation
+// The tokens that an encoder encodes a text to, and their spans. Aligned is
+// false when the tokens do not decode back to the text, such as for encoders
+// that normalize or add special tokens, in which case the spans cannot be
+// compared with those of other encoders.
+type Segmentation struct {
+	Spans   []TokenSpan
+	Aligned bool
+}
+
+// SpanDifference
+// A byte range of the text that the aligned encoders segment differently,
+// bounded by token boundaries that they all share. Counts and Reasons hold
+// the number of tokens that each encoder splits the range into, and a
+// description of how, in the order of the encoders, and are zero and empty
+// for the encoders that are not aligned.
+type SpanDifference struct {
+	Start   int
+	End     int
+	Counts  []int
+	Reasons []string
+}
+
+// Comparison
+// How each of a number of encoders segments a text, and where they differ.
+type Comparison struct {
+	Text          string
+	Segmentations []Segmentation
+	Differences   []SpanDifference
+}
+
+// segment encodes text, and finds the span of each token by decoding it,
+// along with as many of the tokens after it as it takes to decode to text.
+func segment(encoder Encoder, text string) Segmentation {
+	tokens := *encoder.Encode(&text)
+	segmentation := Segmentation{make([]TokenSpan, 0, len(tokens)), true}
+	start := 0
+	for idx := 0; idx < len(tokens); {
+		end := idx + 1
+		var decoded string
+		for ; segmentation.Aligned && end <= len(tokens); end++ {
+			group := tokens[idx:end]
+			decoded = encoder.Decode(&group)
+			if (decoded != "" || end == len(tokens)) &&
+				strings.HasPrefix(text[start:], decoded) {
+				break
+			}
+		}
+		if !segmentation.Aligned || end > len(tokens) {
+			// The rest of the tokens do not decode to the rest of the
+			// text, so give them the spans of what they decode to alone.
+			segmentation.Aligned = false
+			end = idx + 1
+			decoded = encoder.Decode(&Tokens{tokens[idx]})
+		}
+		for _, token := range tokens[idx:end] {
+			segmentation.Spans = append(segmentation.Spans,
+				TokenSpan{token, start, start + len(decoded)})
+		}
+		start += len(decoded)
+		idx = end
+	}
+	if start != len(text) {
+		segmentation.Aligned = false
+	}
+	return segmentation
+}
+
+// describeSpans describes how spans split text, for a SpanDifference.
+func describeSpans(text string, spans []TokenSpan,
+	specials map[string]Tokens) string {
+	description := fmt.Sprintf("%d tokens", len(spans))
+	if len(spans) == 1 {
+		description = "1 token"
+	}
+	for idx, span := range spans {
+		if idx > 0 && (span.Start == spans[idx-1].Start ||
+			!utf8.RuneStart(text[span.Start])) {
+			description += ", splitting a character"
+			break
+		}
+	}
+	for _, span := range spans {
+		if tokens, ok := specials[text[span.Start:span.End]]; ok &&
+			len(tokens) == 1 && tokens[0] == span.Token {
+			description += ", including a special token"
+			break
+		}
+	}
+	return description
+}
+
+// CompareEncodings
+// Encodes text with each of the encoders, and aligns their segmentations to
+// find the spans of the text that they tokenize differently, and why.
+func CompareEncodings(text string, encoders ...Encoder) Comparison {
+	comparison := Comparison{
+		Text:          text,
+		Segmentations: make([]Segmentation, len(encoders)),
+		Differences:   make([]SpanDifference, 0),
+	}
+	specials := make([]map[string]Tokens, len(encoders))
+	// The token boundaries that every aligned encoder shares.
+	shared := make(map[int]int)
+	aligned := 0
+	for idx, encoder := range encoders {
+		comparison.Segmentations[idx] = segment(encoder, text)
+		specials[idx] = encoder.Specials()
+		if !comparison.Segmentations[idx].Aligned {
+			continue
+		}
+		aligned++
+		for _, span := range comparison.Segmentations[idx].Spans {
+			shared[span.End]++
+		}
+	}
+	if aligned < 2 {
+		return comparison
+	}
+	boundaries := []int{0}
+	for boundary, count := range shared {
+		if count == aligned && boundary > 0 {
+			boundaries = append(boundaries, boundary)
+		}
+	}
+	sort.Ints(boundaries)
+
+	// The index of the next span of each encoder to be compared.
+	next := make([]int, len(encoders))
+	for idx := 1; idx < len(boundaries); idx++ {
+		start, end := boundaries[idx-1], boundaries[idx]
+		regions := make([][]TokenSpan, len(encoders))
+		for encoderIdx, segmentation := range comparison.Segmentations {
+			if !segmentation.Aligned {
+				continue
+			}
+			first := next[encoderIdx]
+			for next[encoderIdx] < len(segmentation.Spans) &&
+				segmentation.Spans[next[encoderIdx]].End <= end {
+				next[encoderIdx]++
+			}
+			regions[encoderIdx] = segmentation.Spans[first:next[encoderIdx]]
+		}
+		if !differ(regions, comparison.Segmentations) {
+			continue
+		}
+		difference := SpanDifference{
+			Start:   start,
+			End:     end,
+			Counts:  make([]int, len(encoders)),
+			Reasons: make([]string, len(encoders)),
+		}
+		for encoderIdx, region := range regions {
+			if !comparison.Segmentations[encoderIdx].Aligned {
+				continue
+			}
+			difference.Counts[encoderIdx] = len(region)
+			difference.Reasons[encoderIdx] = describeSpans(text, region,
+				specials[encoderIdx])
+		}
+		comparison.Differences = append(comparison.Differences, difference)
+	}
+	return comparison
+}
+
+// differ returns true if the aligned encoders split a region of the text at
+// different boundaries.
+func differ(regions [][]TokenSpan, segmentations []Segmentation) bool {
+	var reference []TokenSpan
+	found := false
+	for idx, region := range regions {
+		if !segmentations[idx].Aligned {
+			continue
+		}
+		if !found {
+			reference, found = region, true
+			continue
+		}
+		if len(region) != len(reference) {
+			return true
+		}
+		for spanIdx := range region {
+			if region[spanIdx].End != reference[spanIdx].End {
+				return true
+			}
+		}
+	}
+	return false
+}
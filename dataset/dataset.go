@@ -0,0 +1,288 @@
+// Package dataset reads back the shards that dataset_tokenizer writes, so
+// that training and evaluation code in Go can consume them natively, and
+// routes documents to shards, so that the shard holding a document can be
+// located.
+package dataset
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/wbrown/gpt_bpe"
+	"github.com/wbrown/gpt_bpe/zstd"
+)
+
+// DocumentIndexSuffix is the suffix of the document index sidecar that
+// dataset_tokenizer writes next to a shard with -doc_index.
+const DocumentIndexSuffix = ".index.jsonl"
+
+// ManifestSuffix is the suffix of the run manifest that dataset_tokenizer
+// writes next to its output.
+const ManifestSuffix = ".manifest.json"
+
+// DocumentSpan
+// Locates a document within the flat token stream of a shard, as a line of
+// its document index sidecar.
+type DocumentSpan struct {
+	Id     int    `json:"id"`
+	Shard  string `json:"shard"`
+	Offset int64  `json:"offset"`
+	Length int64  `json:"length"`
+}
+
+// ShardOptions
+// How the tokens of a shard are laid out. The zero value reads contexts of
+// the size recorded in the shard's run manifest, of little-endian uint16
+// tokens.
+type ShardOptions struct {
+	// ContextSize is the number of tokens in a context, or 0 to read it from
+	// the run manifest written next to the shard.
+	ContextSize int
+	// Dtype is the encoding of each token, gpt_bpe.DTYPE_UINT16 or
+	// gpt_bpe.DTYPE_UINT32, as varints cannot be read at random.
+	Dtype gpt_bpe.TokensDtype
+	// ByteOrder is the byte order of each token, or little-endian if nil.
+	ByteOrder binary.ByteOrder
+}
+
+// Shard
+// A shard of fixed size contexts written by dataset_tokenizer, read at random
+// by context, by document through its document index sidecar, or by token.
+// Uncompressed shards are read from their file as they are accessed, while
+// Zstandard compressed shards are decompressed into memory when opened.
+type Shard struct {
+	Path        string
+	ContextSize int
+	// Documents are the spans of the shard's document index sidecar, or nil
+	// if it has none.
+	Documents  []DocumentSpan
+	reader     io.ReaderAt
+	closer     io.Closer
+	size       int64
+	tokenBytes int
+	dtype      gpt_bpe.TokensDtype
+	byteOrder  binary.ByteOrder
+}
+
+// OpenShard
+// Opens the shard at path with the default ShardOptions.
+func OpenShard(path string) (*Shard, error) {
+	return OpenShardWithOptions(path, ShardOptions{})
+}
+
+// OpenShardWithOptions
+// Opens the shard at path, with its document index sidecar if it has one.
+// A shard that is not a whole number of tokens fails with
+// gpt_bpe.ErrTokensInvalid.
+func OpenShardWithOptions(path string, options ShardOptions) (*Shard,
+	error) {
+	shard := &Shard{
+		Path:        path,
+		ContextSize: options.ContextSize,
+		dtype:       options.Dtype,
+		byteOrder:   options.ByteOrder,
+	}
+	switch options.Dtype {
+	case gpt_bpe.DTYPE_UINT16:
+		shard.tokenBytes = 2
+	case gpt_bpe.DTYPE_UINT32:
+		shard.tokenBytes = 4
+	default:
+		return nil, fmt.Errorf("%w: %s tokens cannot be read at random",
+			gpt_bpe.ErrTokensInvalid, options.Dtype)
+	}
+	if shard.byteOrder == nil {
+		shard.byteOrder = binary.LittleEndian
+	}
+	if shard.ContextSize <= 0 {
+		contextSize, err := readManifestContextSize(path + ManifestSuffix)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("%s: context size is not "+
+				"set, and it cannot be read from its manifest: %v", path,
+				err))
+		}
+		shard.ContextSize = contextSize
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	stat, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	magic := make([]byte, 4)
+	if _, err := file.ReadAt(magic, 0); err == nil && zstd.IsFrame(magic) {
+		data, err := io.ReadAll(zstd.NewReader(bufio.NewReader(file)))
+		file.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		shard.reader, shard.size = bytes.NewReader(data), int64(len(data))
+	} else {
+		shard.reader, shard.closer, shard.size = file, file, stat.Size()
+	}
+	if shard.size%int64(shard.tokenBytes) != 0 {
+		shard.Close()
+		return nil, fmt.Errorf("%w: %s is %d bytes, not a whole number of "+
+			"%s tokens", gpt_bpe.ErrTokensInvalid, path, shard.size,
+			shard.dtype)
+	}
+
+	if shard.Documents, err = readDocumentIndex(
+		path + DocumentIndexSuffix); err != nil &&
+		!errors.Is(err, os.ErrNotExist) {
+		shard.Close()
+		return nil, err
+	}
+	return shard, nil
+}
+
+// readManifestContextSize returns the context size recorded in the run
+// manifest at path.
+func readManifestContextSize(path string) (int, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	var manifest struct {
+		ContextSize int `json:"context_size"`
+	}
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return 0, err
+	}
+	if manifest.ContextSize <= 0 {
+		return 0, errors.New("no context size recorded")
+	}
+	return manifest.ContextSize, nil
+}
+
+// readDocumentIndex reads the spans of the document index sidecar at path.
+func readDocumentIndex(path string) ([]DocumentSpan, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	spans := make([]DocumentSpan, 0)
+	decoder := json.NewDecoder(bufio.NewReader(file))
+	for decoder.More() {
+		var span DocumentSpan
+		if err := decoder.Decode(&span); err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		spans = append(spans, span)
+	}
+	return spans, nil
+}
+
+// Close
+// Closes the shard's file.
+func (shard *Shard) Close() error {
+	if shard.closer == nil {
+		return nil
+	}
+	closer := shard.closer
+	shard.closer = nil
+	return closer.Close()
+}
+
+// NumTokens
+// Returns the number of tokens in the shard.
+func (shard *Shard) NumTokens() int64 {
+	return shard.size / int64(shard.tokenBytes)
+}
+
+// NumContexts
+// Returns the number of whole contexts in the shard.
+func (shard *Shard) NumContexts() int {
+	return int(shard.NumTokens() / int64(shard.ContextSize))
+}
+
+// Tokens
+// Returns length tokens of the shard's flat token stream from offset.
+// Ranges past the end of the shard fail with io.ErrUnexpectedEOF.
+func (shard *Shard) Tokens(offset int64, length int64) (gpt_bpe.Tokens,
+	error) {
+	if offset < 0 || length < 0 || offset+length > shard.NumTokens() {
+		return nil, fmt.Errorf("%w: tokens [%d, %d) of %d",
+			io.ErrUnexpectedEOF, offset, offset+length, shard.NumTokens())
+	}
+	data := make([]byte, length*int64(shard.tokenBytes))
+	if _, err := shard.reader.ReadAt(data,
+		offset*int64(shard.tokenBytes)); err != nil {
+		return nil, err
+	}
+	tokens := make(gpt_bpe.Tokens, length)
+	for idx := range tokens {
+		if shard.tokenBytes == 2 {
+			tokens[idx] = gpt_bpe.Token(shard.byteOrder.Uint16(data[idx*2:]))
+			continue
+		}
+		tokens[idx] = gpt_bpe.Token(shard.byteOrder.Uint32(data[idx*4:]))
+	}
+	return tokens, nil
+}
+
+// Context
+// Returns the context at index idx.
+func (shard *Shard) Context(idx int) (gpt_bpe.Tokens, error) {
+	if idx < 0 || idx >= shard.NumContexts() {
+		return nil, errors.New(fmt.Sprintf("context %d out of %d", idx,
+			shard.NumContexts()))
+	}
+	return shard.Tokens(int64(idx)*int64(shard.ContextSize),
+		int64(shard.ContextSize))
+}
+
+// Document
+// Returns the tokens of the document at index idx of the shard's document
+// index, including any padding or overlapping tokens that were inserted
+// where it crosses a context boundary.
+func (shard *Shard) Document(idx int) (gpt_bpe.Tokens, error) {
+	if shard.Documents == nil {
+		return nil, errors.New(fmt.Sprintf("%s has no document index",
+			shard.Path))
+	} else if idx < 0 || idx >= len(shard.Documents) {
+		return nil, errors.New(fmt.Sprintf("document %d out of %d", idx,
+			len(shard.Documents)))
+	}
+	span := shard.Documents[idx]
+	return shard.Tokens(span.Offset, span.Length)
+}
+
+// NextContext
+// Returns an iterator over the shard's contexts, in order, which returns
+// io.EOF after the last.
+func (shard *Shard) NextContext() func() (gpt_bpe.Tokens, error) {
+	idx := 0
+	return func() (gpt_bpe.Tokens, error) {
+		if idx >= shard.NumContexts() {
+			return nil, io.EOF
+		}
+		idx++
+		return shard.Context(idx - 1)
+	}
+}
+
+// NextDocument
+// Returns an iterator over the documents of the shard's document index, in
+// order, which returns io.EOF after the last.
+func (shard *Shard) NextDocument() func() (gpt_bpe.Tokens, error) {
+	idx := 0
+	return func() (gpt_bpe.Tokens, error) {
+		if idx >= len(shard.Documents) {
+			return nil, io.EOF
+		}
+		idx++
+		return shard.Document(idx - 1)
+	}
+}
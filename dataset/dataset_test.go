@@ -0,0 +1,169 @@
+package dataset
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/wbrown/gpt_bpe"
+	"github.com/wbrown/gpt_bpe/zstd"
+)
+
+// shardTokens are three contexts of four tokens, holding two documents that
+// end with token 0 and are padded with token 9.
+var shardTokens = gpt_bpe.Tokens{1, 2, 3, 4, 5, 0, 6, 7, 8, 0, 9, 9}
+
+func writeFile(t *testing.T, path string, data []byte) {
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestOpenShard(t *testing.T) {
+	dir := t.TempDir()
+	shardPath := path.Join(dir, "tokenized.chunk")
+	bin, err := shardTokens.ToBin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, shardPath, *bin)
+	writeFile(t, shardPath+ManifestSuffix, []byte(`{"context_size": 4}`))
+	writeFile(t, shardPath+DocumentIndexSuffix, []byte(
+		`{"id":0,"shard":"tokenized.chunk","offset":0,"length":6}`+"\n"+
+			`{"id":1,"shard":"tokenized.chunk","offset":6,"length":4}`+"\n"))
+
+	shard, err := OpenShard(shardPath)
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer shard.Close()
+	assert.Equal(t, 4, shard.ContextSize)
+	assert.Equal(t, int64(12), shard.NumTokens())
+	assert.Equal(t, 3, shard.NumContexts())
+	context, err := shard.Context(2)
+	assert.Nil(t, err)
+	assert.Equal(t, gpt_bpe.Tokens{8, 0, 9, 9}, context)
+	_, err = shard.Context(3)
+	assert.NotNil(t, err)
+
+	// Documents are read through the index sidecar, across contexts.
+	document, err := shard.Document(1)
+	assert.Nil(t, err)
+	assert.Equal(t, gpt_bpe.Tokens{6, 7, 8, 0}, document)
+	nextDocument := shard.NextDocument()
+	documents := 0
+	for {
+		if _, err := nextDocument(); err == io.EOF {
+			break
+		} else {
+			assert.Nil(t, err)
+		}
+		documents++
+	}
+	assert.Equal(t, 2, documents)
+	_, err = shard.Tokens(10, 4)
+	assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+
+	// Compressed shards read the same, given their context size.
+	var compressed bytes.Buffer
+	writer := zstd.NewWriter(&compressed, 8)
+	writer.Write(*bin)
+	assert.Nil(t, writer.Close())
+	compressedPath := path.Join(dir, "compressed.chunk")
+	writeFile(t, compressedPath, compressed.Bytes())
+	_, err = OpenShard(compressedPath)
+	assert.NotNil(t, err)
+	compressedShard, err := OpenShardWithOptions(compressedPath,
+		ShardOptions{ContextSize: 4})
+	if !assert.Nil(t, err) {
+		return
+	}
+	nextContext := compressedShard.NextContext()
+	read := make(gpt_bpe.Tokens, 0, len(shardTokens))
+	for {
+		context, err := nextContext()
+		if err == io.EOF {
+			break
+		}
+		assert.Nil(t, err)
+		read = append(read, context...)
+	}
+	assert.Equal(t, shardTokens, read)
+	_, err = compressedShard.Document(0)
+	assert.NotNil(t, err)
+
+	// Big-endian uint32 tokens.
+	wide := make([]byte, len(shardTokens)*4)
+	for idx, token := range shardTokens {
+		binary.BigEndian.PutUint32(wide[idx*4:], uint32(token))
+	}
+	widePath := path.Join(dir, "wide.chunk")
+	writeFile(t, widePath, wide)
+	wideShard, err := OpenShardWithOptions(widePath, ShardOptions{
+		ContextSize: 6, Dtype: gpt_bpe.DTYPE_UINT32,
+		ByteOrder: binary.BigEndian})
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer wideShard.Close()
+	context, err = wideShard.Context(1)
+	assert.Nil(t, err)
+	assert.Equal(t, shardTokens[6:], context)
+
+	writeFile(t, widePath, wide[:5])
+	_, err = OpenShardWithOptions(widePath, ShardOptions{ContextSize: 6,
+		Dtype: gpt_bpe.DTYPE_UINT32})
+	assert.ErrorIs(t, err, gpt_bpe.ErrTokensInvalid)
+	_, err = OpenShardWithOptions(widePath, ShardOptions{ContextSize: 6,
+		Dtype: gpt_bpe.DTYPE_VARINT})
+	assert.ErrorIs(t, err, gpt_bpe.ErrTokensInvalid)
+}
+
+func TestRouter(t *testing.T) {
+	splits, err := ParseRouteSplits("train:98, validation:2")
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.Equal(t, []RouteSplit{{"train", 98}, {"validation", 2}}, splits)
+	router, err := NewRouter(splits, 4)
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.Equal(t, 8, len(router.Routes()))
+
+	// Routes are stable, and spread documents over every shard and split.
+	counts := make(map[Route]int)
+	for idx := 0; idx < 2000; idx++ {
+		key := []byte(fmt.Sprintf("document %d", idx))
+		route := router.Route(key)
+		assert.Equal(t, route, router.Route(key))
+		counts[route]++
+	}
+	assert.Equal(t, 8, len(counts))
+	validation := 0
+	for route, count := range counts {
+		if route.Split == "validation" {
+			validation += count
+		}
+	}
+	assert.Greater(t, validation, 10)
+	assert.Less(t, validation, 100)
+
+	// A router without splits routes to shards alone.
+	unsplit, err := NewRouter(nil, 3)
+	assert.Nil(t, err)
+	assert.Equal(t, "", unsplit.Route([]byte("document")).Split)
+	assert.Equal(t, []Route{{"", 0}, {"", 1}, {"", 2}}, unsplit.Routes())
+
+	_, err = NewRouter(nil, 0)
+	assert.NotNil(t, err)
+	_, err = NewRouter([]RouteSplit{{"train", 1}, {"train", 1}}, 1)
+	assert.NotNil(t, err)
+	_, err = ParseRouteSplits("train")
+	assert.NotNil(t, err)
+}
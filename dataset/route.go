@@ -0,0 +1,133 @@
+package dataset
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// RouteSplit
+// A split of a Router, such as train or validation, that receives a share of
+// the documents in proportion to its weight.
+type RouteSplit struct {
+	Name   string `json:"name"`
+	Weight int    `json:"weight"`
+}
+
+// Route
+// Where a Router sends a document: the name of its split, or "" if the router
+// has no splits, and the index of its shard within the split.
+type Route struct {
+	Split string `json:"split,omitempty"`
+	Shard int    `json:"shard"`
+}
+
+// Router
+// Routes documents to splits and shards by a stable hash of their key, which
+// is their id, or their text as it was tokenized when they have none. The
+// route of a key depends only on the key and the router's splits and shards,
+// so that the shard holding a document can be located later, such as to
+// delete it, without reading the dataset.
+type Router struct {
+	Splits []RouteSplit `json:"splits,omitempty"`
+	Shards int          `json:"shards"`
+}
+
+// NewRouter
+// Creates a Router of the given splits, each of shards shards.
+func NewRouter(splits []RouteSplit, shards int) (*Router, error) {
+	if shards < 1 {
+		return nil, errors.New(fmt.Sprintf("cannot route to %d shards",
+			shards))
+	}
+	names := make(map[string]bool, len(splits))
+	for _, split := range splits {
+		if split.Name == "" || split.Weight < 1 {
+			return nil, errors.New(fmt.Sprintf("invalid split %q of "+
+				"weight %d", split.Name, split.Weight))
+		} else if names[split.Name] {
+			return nil, errors.New(fmt.Sprintf("duplicate split %s",
+				split.Name))
+		}
+		names[split.Name] = true
+	}
+	return &Router{Splits: splits, Shards: shards}, nil
+}
+
+// ParseRouteSplits
+// Parses a comma separated list of splits and their weights, such as
+// `train:98,validation:2`.
+func ParseRouteSplits(spec string) ([]RouteSplit, error) {
+	splits := make([]RouteSplit, 0)
+	if strings.TrimSpace(spec) == "" {
+		return splits, nil
+	}
+	for _, item := range strings.Split(spec, ",") {
+		parts := strings.Split(strings.TrimSpace(item), ":")
+		if len(parts) != 2 {
+			return nil, errors.New(fmt.Sprintf("split %q: expected "+
+				"name:weight", item))
+		}
+		weight, err := strconv.Atoi(parts[1])
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("split %q: %v", item, err))
+		}
+		splits = append(splits, RouteSplit{Name: parts[0], Weight: weight})
+	}
+	return splits, nil
+}
+
+// HashDocument
+// Returns the stable hash that documents are routed by, of the first 16
+// bytes of the SHA-256 digest of key.
+func HashDocument(key []byte) (uint64, uint64) {
+	digest := sha256.Sum256(key)
+	return binary.BigEndian.Uint64(digest[:8]),
+		binary.BigEndian.Uint64(digest[8:16])
+}
+
+// Route
+// Returns the route of the document with the given key. The split and the
+// shard are chosen from independent halves of the key's hash.
+func (router *Router) Route(key []byte) Route {
+	splitHash, shardHash := HashDocument(key)
+	route := Route{Shard: int(shardHash % uint64(router.Shards))}
+	total := 0
+	for _, split := range router.Splits {
+		total += split.Weight
+	}
+	if total == 0 {
+		return route
+	}
+	point := int(splitHash % uint64(total))
+	for _, split := range router.Splits {
+		if point < split.Weight {
+			route.Split = split.Name
+			break
+		}
+		point -= split.Weight
+	}
+	return route
+}
+
+// Routes
+// Returns every route of the router, by split and then by shard.
+func (router *Router) Routes() []Route {
+	splits := []string{""}
+	if len(router.Splits) > 0 {
+		splits = make([]string, len(router.Splits))
+		for idx, split := range router.Splits {
+			splits[idx] = split.Name
+		}
+	}
+	routes := make([]Route, 0, len(splits)*router.Shards)
+	for _, split := range splits {
+		for shard := 0; shard < router.Shards; shard++ {
+			routes = append(routes, Route{Split: split, Shard: shard})
+		}
+	}
+	return routes
+}
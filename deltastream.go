@@ -0,0 +1,104 @@
+package gpt_bpe
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// DeltaWriter
+// Writes a stream of tokens as DTYPE_DELTA_VARINT, a lighter alternative to
+// zstd for datasets of nearby ids that are read at random. Each record that is written
+// after Reset is deltaed from zero, so it can be read from its Offset alone,
+// without the records before it.
+type DeltaWriter struct {
+	writer   io.Writer
+	previous Token
+	offset   int64
+	buffer   []byte
+}
+
+// NewDeltaWriter
+// Creates a DeltaWriter that writes to writer.
+func NewDeltaWriter(writer io.Writer) *DeltaWriter {
+	return &DeltaWriter{writer: writer}
+}
+
+// Write
+// Writes tokens, each as its difference from the token before it.
+func (writer *DeltaWriter) Write(tokens Tokens) error {
+	writer.buffer, writer.previous = appendDeltaVarints(writer.buffer[:0],
+		writer.previous, tokens)
+	written, err := writer.writer.Write(writer.buffer)
+	writer.offset += int64(written)
+	return err
+}
+
+// Reset
+// Starts a new record, whose first token is written as its difference from
+// zero, and returns the offset that it starts at.
+func (writer *DeltaWriter) Reset() int64 {
+	writer.previous = 0
+	return writer.offset
+}
+
+// Offset
+// Returns the number of bytes written.
+func (writer *DeltaWriter) Offset() int64 {
+	return writer.offset
+}
+
+// DeltaReader
+// Reads a stream of tokens written by a DeltaWriter. A record that starts at
+// an offset that a DeltaWriter's Reset returned is read by a DeltaReader over
+// the stream from that offset.
+type DeltaReader struct {
+	reader   io.ByteReader
+	previous int64
+	read     int
+}
+
+// NewDeltaReader
+// Creates a DeltaReader that reads from reader.
+func NewDeltaReader(reader io.Reader) *DeltaReader {
+	byteReader, ok := reader.(io.ByteReader)
+	if !ok {
+		byteReader = bufio.NewReader(reader)
+	}
+	return &DeltaReader{reader: byteReader}
+}
+
+// Read
+// Reads up to len(tokens) tokens into tokens, and returns how many were read.
+// At the end of the stream it returns io.EOF, and a stream that ends within
+// a varint fails with ErrTokensInvalid.
+func (reader *DeltaReader) Read(tokens Tokens) (int, error) {
+	for idx := range tokens {
+		delta, err := binary.ReadVarint(reader.reader)
+		if errors.Is(err, io.EOF) && idx > 0 {
+			return idx, nil
+		} else if errors.Is(err, io.EOF) {
+			return 0, io.EOF
+		} else if err != nil {
+			return idx, fmt.Errorf("%w: token %d: %s", ErrTokensInvalid,
+				reader.read, err)
+		}
+		token, err := undeltaToken(reader.previous, delta, reader.read)
+		if err != nil {
+			return idx, err
+		}
+		tokens[idx] = token
+		reader.previous = int64(token)
+		reader.read++
+	}
+	return len(tokens), nil
+}
+
+// Reset
+// Starts a new record, as a DeltaWriter's Reset does, so that the next token
+// read is deltaed from zero.
+func (reader *DeltaReader) Reset() {
+	reader.previous = 0
+}
@@ -0,0 +1,82 @@
+package gpt_bpe
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// DuplicatePolicy
+// Which of the ids that a vocabulary maps to the same string Encode
+// produces. Each of the ids decodes to the string, whatever the policy.
+type DuplicatePolicy uint8
+
+const (
+	// DuplicatesHighest encodes the string as its highest id, which is the
+	// last of its entries in a vocabulary ordered by id, and the default.
+	DuplicatesHighest DuplicatePolicy = iota
+	// DuplicatesLowest encodes the string as its lowest id, which is the
+	// first that the vocabulary was trained or converted with.
+	DuplicatesLowest
+)
+
+// Duplicates
+// Returns the strings that the vocabulary has more than one id for, with
+// their ids in ascending order. Such vocabularies are written as
+// vocab.bytes.json, as the keys of vocab.json cannot repeat.
+func (encoder *GPTEncoder) Duplicates() map[string]Tokens {
+	byText := make(map[string]Tokens)
+	for token, text := range encoder.decoder {
+		byText[string(text)] = append(byText[string(text)], token)
+	}
+	duplicates := make(map[string]Tokens)
+	for text, tokens := range byText {
+		if len(tokens) > 1 {
+			sort.Slice(tokens, func(i, j int) bool {
+				return tokens[i] < tokens[j]
+			})
+			duplicates[text] = tokens
+		}
+	}
+	return duplicates
+}
+
+// SetDuplicatePolicy
+// Sets which of the ids of a string that the vocabulary has more than one
+// id for is encoded, along with the special tokens and the BOS, EOS and
+// padding tokens of such strings.
+func (encoder *GPTEncoder) SetDuplicatePolicy(policy DuplicatePolicy) error {
+	if policy > DuplicatesLowest {
+		return errors.New(fmt.Sprintf("invalid duplicate policy %d", policy))
+	}
+	for text, tokens := range encoder.Duplicates() {
+		chosen := tokens[len(tokens)-1]
+		if policy == DuplicatesLowest {
+			chosen = tokens[0]
+		}
+		encoder.encoder[text] = chosen
+		for _, token := range []*Token{&encoder.BosToken, &encoder.EosToken,
+			&encoder.PadToken} {
+			if string(encoder.decoder[*token]) == text {
+				*token = chosen
+			}
+		}
+		for special, specialTokens := range encoder.specials {
+			if len(specialTokens) == 1 &&
+				string(encoder.decoder[specialTokens[0]]) == text {
+				encoder.specials[special] = Tokens{chosen}
+			}
+		}
+	}
+	encoder.cache.Purge()
+	return nil
+}
+
+// WithDuplicatePolicy
+// Sets which id of a duplicated string is encoded, as SetDuplicatePolicy
+// does.
+func WithDuplicatePolicy(policy DuplicatePolicy) Option {
+	return func(encoder *GPTEncoder) error {
+		return encoder.SetDuplicatePolicy(policy)
+	}
+}
@@ -0,0 +1,130 @@
+package gpt_bpe
+
+import (
+	"fmt"
+	"os"
+	"path"
+
+	"github.com/wbrown/gpt_bpe/resources"
+)
+
+// Encoder
+// The operations common to every family of tokenizer, so that applications
+// can switch between them without code changes.
+type Encoder interface {
+	// Encode encodes text into tokens.
+	Encode(text *string) *Tokens
+	// Decode decodes tokens back into text.
+	Decode(encoded *Tokens) string
+	// Count returns the number of tokens that text encodes to.
+	Count(text *string) int
+	// Specials returns the special tokens, by their text.
+	Specials() map[string]Tokens
+	// Fingerprint returns a digest that is the same for any two encoders
+	// that tokenize text identically.
+	Fingerprint() string
+}
+
+var (
+	_ Encoder = (*GPTEncoder)(nil)
+	_ Encoder = (*MockEncoder)(nil)
+)
+
+// Count
+// Returns the number of tokens that text encodes to.
+func (encoder *GPTEncoder) Count(text *string) int {
+	return len(*encoder.Encode(text))
+}
+
+// Specials
+// Returns a copy of the encoder's special tokens, by their text.
+func (encoder *GPTEncoder) Specials() map[string]Tokens {
+	specials := make(map[string]Tokens, len(encoder.specials))
+	for special, tokens := range encoder.specials {
+		specials[special] = append(Tokens{}, tokens...)
+	}
+	return specials
+}
+
+// NewEncoderFromDir
+// Returns an Encoder for the tokenizer in dir, detecting the layout of its
+// files with resources.DetectLayout, so that callers need not know which
+// format a tokenizer was saved in. Nothing is downloaded. Tiktoken ranks
+// files are loaded when they are named for one of TiktokenEncodings, and a
+// tokenizer.json is loaded with its normalizer, pre-tokenizer and
+// post-processor. SentencePiece models, and tokenizer.json files with a
+// Unigram model, are loaded as a SentencePieceEncoder. BERT-family vocab.txt
+// files, and tokenizer.json files with a WordPiece model, are loaded as a
+// WordPieceEncoder, and RWKV vocabularies as a TrieEncoder. Layouts that
+// cannot be loaded fail with ErrUnsupportedLayout.
+func NewEncoderFromDir(dir string) (Encoder, error) {
+	layout, _ := resources.DetectLayout(dir)
+	switch layout {
+	case resources.LAYOUT_TIKTOKEN:
+		encoder, err := newTiktokenEncoderFromDir(dir)
+		if err != nil {
+			return nil, err
+		}
+		return encoder, nil
+	case resources.LAYOUT_SENTENCEPIECE:
+		encoder, err := newSentencePieceEncoderFromDir(dir)
+		if err != nil {
+			return nil, err
+		}
+		return encoder, nil
+	case resources.LAYOUT_TOKENIZER_JSON:
+		data, err := os.ReadFile(path.Join(dir, "tokenizer.json"))
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s", ErrResourceMissing, err)
+		}
+		if tokenizerJsonModelType(data) == "Unigram" {
+			if err := resources.CheckUnsignedAllowed(dir); err != nil {
+				return nil, err
+			}
+			encoder, err := newSentencePieceEncoderFromTokenizerJson(data)
+			if err != nil {
+				return nil, err
+			}
+			return encoder, nil
+		} else if tokenizerJsonModelType(data) == "WordPiece" {
+			if err := resources.CheckUnsignedAllowed(dir); err != nil {
+				return nil, err
+			}
+			encoder, err := newWordPieceEncoderFromTokenizerJson(data)
+			if err != nil {
+				return nil, err
+			}
+			return encoder, nil
+		}
+	case resources.LAYOUT_WORDPIECE:
+		encoder, err := newWordPieceEncoderFromDir(dir)
+		if err != nil {
+			return nil, err
+		}
+		return encoder, nil
+	case resources.LAYOUT_RWKV:
+		encoder, err := newRWKVEncoderFromDir(dir)
+		if err != nil {
+			return nil, err
+		}
+		return encoder, nil
+	}
+	hfConfig, rsrcs, err := resources.ResolveLocalDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	encoder, err := newEncoderFromResources(dir, hfConfig, *rsrcs)
+	if err != nil {
+		return nil, err
+	}
+	if layout == resources.LAYOUT_TOKENIZER_JSON {
+		data, err := os.ReadFile(path.Join(dir, "tokenizer.json"))
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s", ErrResourceMissing, err)
+		}
+		if err := encoder.applyTokenizerJson(data); err != nil {
+			return nil, err
+		}
+	}
+	return encoder, nil
+}
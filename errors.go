@@ -0,0 +1,55 @@
+package gpt_bpe
+
+import (
+	"errors"
+
+	"github.com/wbrown/gpt_bpe/resources"
+)
+
+// The errors that the encoder wraps its failures in, so that callers can
+// tell them apart with errors.Is.
+var (
+	// ErrVocabMissing
+	// The vocabulary or merges of a tokenizer could not be found.
+	ErrVocabMissing = errors.New("vocabulary missing")
+	// ErrVocabInvalid
+	// The vocabulary of a tokenizer could not be parsed.
+	ErrVocabInvalid = errors.New("vocabulary invalid")
+	// ErrMergeInvalid
+	// A line of the merges of a tokenizer is not a pair of tokens.
+	ErrMergeInvalid = errors.New("merge invalid")
+	// ErrTokenOutOfRange
+	// A token id does not fit in a Token, or is not in the vocabulary.
+	ErrTokenOutOfRange = errors.New("token out of range")
+	// ErrTokensInvalid
+	// Serialized tokens could not be parsed in their dtype.
+	ErrTokensInvalid = errors.New("tokens invalid")
+	// ErrInputTooLarge
+	// A text is longer than the encoder's MaxInputBytes.
+	ErrInputTooLarge = errors.New("input too large")
+	// ErrOutputTooLarge
+	// A text encodes to more tokens than the encoder's MaxOutputTokens.
+	ErrOutputTooLarge = errors.New("output too large")
+	// ErrMigrationMissing
+	// No published migration translates tokens between two versions of a
+	// tokenizer's data.
+	ErrMigrationMissing = errors.New("migration missing")
+
+	// ErrResourceMissing
+	// A resource that a tokenizer requires could not be found.
+	ErrResourceMissing = resources.ErrResourceMissing
+	// ErrResourceInvalid
+	// A resource of a tokenizer, such as its configuration, could not be
+	// parsed.
+	ErrResourceInvalid = resources.ErrResourceInvalid
+	// ErrDownloadFailed
+	// A resource of a tokenizer could not be downloaded.
+	ErrDownloadFailed = resources.ErrDownloadFailed
+	// ErrUnsupportedLayout
+	// A directory holds a tokenizer in a layout that cannot be loaded.
+	ErrUnsupportedLayout = resources.ErrUnsupportedLayout
+	// ErrSignatureInvalid
+	// A packaged tokenizer is not signed by a trusted key, or a tokenizer
+	// that cannot be signed was loaded while signed packages are required.
+	ErrSignatureInvalid = resources.ErrSignatureInvalid
+)
@@ -0,0 +1,142 @@
+package gpt_bpe
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"hash"
+	"sort"
+)
+
+// Fingerprint
+// Returns a hex encoded SHA-256 digest over everything that determines how
+// the encoder tokenizes text: the vocabulary, the merge ranks, the special
+// tokens and the pre-tokenization settings. Two encoders with the same
+// fingerprint produce identical tokenizations, regardless of where their
+// resources were loaded from.
+func (encoder *GPTEncoder) Fingerprint() string {
+	h := sha256.New()
+
+	// Vocabulary, ordered by token id, then by bytes for duplicate ids.
+	type vocabEntry struct {
+		token Token
+		text  string
+	}
+	vocab := make([]vocabEntry, 0, len(encoder.encoder))
+	for text, token := range encoder.encoder {
+		vocab = append(vocab, vocabEntry{token, text})
+	}
+	sort.Slice(vocab, func(i, j int) bool {
+		if vocab[i].token != vocab[j].token {
+			return vocab[i].token < vocab[j].token
+		}
+		return vocab[i].text < vocab[j].text
+	})
+	writeFingerprintUint(h, uint64(len(vocab)))
+	for _, entry := range vocab {
+		writeFingerprintUint(h, uint64(entry.token))
+		writeFingerprintString(h, entry.text)
+	}
+
+	// Merges, ordered by their rank.
+	merges := make(BGERanks, 0, len(encoder.bpe_ranks))
+	for pair, rank := range encoder.bpe_ranks {
+		merges = append(merges, BGERank{rank, pair})
+	}
+	sort.Slice(merges, func(i, j int) bool {
+		if merges[i].rank != merges[j].rank {
+			return merges[i].rank < merges[j].rank
+		}
+		if merges[i].bigram.left != merges[j].bigram.left {
+			return merges[i].bigram.left < merges[j].bigram.left
+		}
+		return merges[i].bigram.right < merges[j].bigram.right
+	})
+	writeFingerprintUint(h, uint64(len(merges)))
+	for _, merge := range merges {
+		writeFingerprintString(h, merge.bigram.left)
+		writeFingerprintString(h, merge.bigram.right)
+	}
+
+	// Special tokens, ordered by their text.
+	specials := make([]string, 0, len(encoder.specials))
+	for special := range encoder.specials {
+		specials = append(specials, special)
+	}
+	sort.Strings(specials)
+	writeFingerprintUint(h, uint64(len(specials)))
+	for _, special := range specials {
+		writeFingerprintString(h, special)
+		for _, token := range encoder.specials[special] {
+			writeFingerprintUint(h, uint64(token))
+		}
+	}
+
+	// Settings that change the pre-tokenization or framing of the output.
+	replacements := make([]string, 0, len(encoder.replacements))
+	for replaced := range encoder.replacements {
+		replacements = append(replacements, replaced)
+	}
+	sort.Strings(replacements)
+	for _, replaced := range replacements {
+		writeFingerprintString(h, replaced)
+		writeFingerprintString(h, encoder.replacements[replaced])
+	}
+	writeFingerprintString(h, encoder.pattern.String())
+	writeFingerprintString(h, encoder.endOfWord)
+	writeFingerprintString(h, string(encoder.PuncRunes))
+	for _, flag := range []bool{encoder.encloseEosBos, encoder.prefixSpace,
+		encoder.lowerCase} {
+		if flag {
+			writeFingerprintUint(h, 1)
+		} else {
+			writeFingerprintUint(h, 0)
+		}
+	}
+	for _, token := range []Token{encoder.BosToken, encoder.EosToken,
+		encoder.PadToken} {
+		writeFingerprintUint(h, uint64(token))
+	}
+	writeFingerprintUint(h, uint64(encoder.MaxWordLength))
+	// Only a policy other than the default is written, which keeps the
+	// fingerprints from before the policy existed.
+	if encoder.specialsPolicy != SpecialsAllow {
+		writeFingerprintUint(h, uint64(encoder.specialsPolicy))
+	}
+	bos, eos := encoder.BosEosPolicy()
+	if defaultPolicy := encoder.resolvePolicy(AddDefault,
+		AddDefault); bos != defaultPolicy || eos != defaultPolicy {
+		writeFingerprintUint(h, uint64(bos))
+		writeFingerprintUint(h, uint64(eos))
+	}
+	if encoder.mergeMode != MergeBPE {
+		writeFingerprintUint(h, uint64(encoder.mergeMode))
+	}
+	if encoder.caseFolding != CaseFoldNone {
+		writeFingerprintUint(h, uint64(encoder.caseFolding))
+	}
+	if encoder.bpeLevel != BPEByteLevel {
+		writeFingerprintUint(h, uint64(encoder.bpeLevel))
+	}
+	if unk := encoder.unk; unk != nil {
+		writeFingerprintUint(h, uint64(unk.token))
+		if unk.fuse {
+			writeFingerprintUint(h, 1)
+		}
+	}
+
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func writeFingerprintUint(h hash.Hash, v uint64) {
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], v)
+	h.Write(buf[:])
+}
+
+// writeFingerprintString writes a length prefixed string, so that adjacent
+// strings cannot be confused with each other.
+func writeFingerprintString(h hash.Hash, s string) {
+	writeFingerprintUint(h, uint64(len(s)))
+	h.Write([]byte(s))
+}
@@ -0,0 +1,118 @@
+package gpt_bpe
+
+import (
+	"strconv"
+	"unsafe"
+)
+
+// The sizes in bytes of the headers of Go's strings and slices, and of
+// pointers, on the platform.
+const (
+	pointerBytes      = strconv.IntSize / 8
+	stringHeaderBytes = 2 * pointerBytes
+	sliceHeaderBytes  = 3 * pointerBytes
+)
+
+// mapEntryBytes returns the bytes that a map entry with keys and values of
+// that combined size takes, including its share of the map's buckets, at
+// their average load of 6.5 of 8 entries.
+func mapEntryBytes(keyValueBytes int) int {
+	return (keyValueBytes + 1) * 8 * 2 / 13
+}
+
+// MemoryFootprint
+// An estimate of the bytes that the tables of an encoder take in memory,
+// from MemoryFootprint, broken down by table. The estimate counts the
+// contents of the tables, with the overhead of Go's maps, strings and slices,
+// but not the allocator's rounding, so it is a lower bound that is close for
+// large vocabularies.
+type MemoryFootprint struct {
+	// VocabBytes is the vocabulary, in both directions, and the byte
+	// mapping.
+	VocabBytes int
+	// MergeBytes is the ranks of the BPE merges.
+	MergeBytes int
+	// CacheBytes is the words currently in the word cache, and their tokens.
+	CacheBytes int
+	// UnitrimBytes is the table of incomplete UTF-8 per token.
+	UnitrimBytes int
+	// SpecialsBytes is the special tokens, and the tree that matches them.
+	SpecialsBytes int
+	// TotalBytes is the sum of the tables.
+	TotalBytes int
+}
+
+// MemoryFootprint
+// Returns an estimate of the memory that the encoder's tables take, for
+// capacity planning of servers that hold several tokenizers, and for
+// validating work that reduces their memory.
+func (encoder *GPTEncoder) MemoryFootprint() MemoryFootprint {
+	var footprint MemoryFootprint
+	tokenBytes := int(unsafe.Sizeof(Token(0)))
+
+	for word := range encoder.encoder {
+		footprint.VocabBytes += len(word) +
+			mapEntryBytes(stringHeaderBytes+tokenBytes)
+	}
+	for _, word := range encoder.decoder {
+		footprint.VocabBytes += len(word) +
+			mapEntryBytes(tokenBytes+sliceHeaderBytes)
+	}
+	footprint.VocabBytes += len(encoder.byteToRune)*4 +
+		len(encoder.runeToByte)*mapEntryBytes(4+1)
+
+	for pair := range encoder.bpe_ranks {
+		footprint.MergeBytes += len(pair.left) + len(pair.right) +
+			mapEntryBytes(2*stringHeaderBytes+8)
+	}
+
+	if encoder.cache != nil {
+		// Each cached word is in a map, and a list element of three
+		// pointers and its key and value, which are interfaces.
+		entryBytes := mapEntryBytes(2*pointerBytes+pointerBytes) +
+			3*pointerBytes + 4*pointerBytes
+		for _, key := range encoder.cache.Keys() {
+			footprint.CacheBytes += entryBytes
+			if word, ok := key.(string); ok {
+				footprint.CacheBytes += stringHeaderBytes + len(word)
+			}
+			if value, ok := encoder.cache.Peek(key); ok {
+				if tokens, ok := value.(Tokens); ok {
+					footprint.CacheBytes += sliceHeaderBytes +
+						len(tokens)*tokenBytes
+				}
+			}
+		}
+	}
+
+	footprint.UnitrimBytes = sliceHeaderBytes +
+		cap(encoder.unitrim)*pointerBytes
+
+	for special, tokens := range encoder.specials {
+		footprint.SpecialsBytes += len(special) + len(tokens)*tokenBytes +
+			mapEntryBytes(stringHeaderBytes+sliceHeaderBytes)
+	}
+	footprint.SpecialsBytes += runeTreeBytes(encoder.specialsTree)
+
+	footprint.TotalBytes = footprint.VocabBytes + footprint.MergeBytes +
+		footprint.CacheBytes + footprint.UnitrimBytes +
+		footprint.SpecialsBytes
+	return footprint
+}
+
+// runeTreeBytes returns the bytes that the nodes of the tree under node
+// take.
+func runeTreeBytes(node *RuneNode) int {
+	if node == nil {
+		return 0
+	}
+	// The rune, size and terminal fields, the runes and childsArr slices,
+	// and the childs map.
+	size := 4 + pointerBytes + 1 + 2*sliceHeaderBytes + pointerBytes +
+		len(node.runes)*4 + cap(node.childsArr)*pointerBytes +
+		len(node.childs)*mapEntryBytes(4+pointerBytes)
+	for _, child := range node.childs {
+		size += runeTreeBytes(child)
+	}
+	return size
+}
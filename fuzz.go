@@ -0,0 +1,94 @@
+package gpt_bpe
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"unicode/utf8"
+)
+
+// FuzzSeeds
+// Inputs that exercise the edge cases of pre-tokenization, special token
+// splitting and byte-level encoding, to seed a fuzzer's corpus with.
+var FuzzSeeds = []string{
+	"",
+	" ",
+	"\n",
+	"\r\n\r\n",
+	"  \t\v\f \u00a0\u2028\u3000 ",
+	"we'll go jump<|endoftext|> in a lake.",
+	"<|endoftext|><|endoftext|>",
+	"<|endof<|endoftext|>",
+	"<|end\noftext|>",
+	"'s't're've'm'll'd'S'T'RE",
+	"12345678901234567890",
+	"e\u0301\u0301\u0301 a\u0308\u0308",
+	"\U0001F469\u200d\U0001F469\u200d\U0001F467\u200d\U0001F466",
+	"\U0001F1FA\U0001F1F8\U0001F3F3\ufe0f\u200d\U0001F308",
+	"\u202eevil\u202c \u0627\u0644\u0639\u0631\u0628\u064a\u0629",
+	"\ufeffbom \u200b\u200c\u200d zero width",
+	"\u65e5\u672c\u8a9e\u3001\ud55c\uad6d\uc5b4",
+	"\x00\x01\x1f\x7f",
+	"\xff\xfe\xfd",
+	"\xc0\xaf overlong",
+	"\xed\xa0\x80 surrogate",
+	"\xe2\x82 truncated",
+	"\U0010ffff\ufffd\ufffe",
+}
+
+// FuzzEncode
+// A go-fuzz entry point that encodes data as text with encoder, and decodes
+// the tokens, so that the fuzzer catches any panic on adversarial input. It
+// returns 1 when data is valid UTF-8, to prioritize such inputs, and 0
+// otherwise.
+func FuzzEncode(encoder *GPTEncoder, data []byte) int {
+	text := string(data)
+	encoder.Decode(encoder.Encode(&text))
+	if utf8.Valid(data) {
+		return 1
+	}
+	return 0
+}
+
+// FuzzEncodeDecode
+// A go-fuzz entry point for byte-level encoders such as GPT2Encoder and
+// PileEncoder, which also panics when valid UTF-8 text does not decode back
+// to itself.
+func FuzzEncodeDecode(encoder *GPTEncoder, data []byte) int {
+	text := string(data)
+	decoded := encoder.Decode(encoder.Encode(&text))
+	if !utf8.Valid(data) {
+		return 0
+	}
+	if decoded != text {
+		panic(fmt.Sprintf("gpt_bpe: %q decoded as %q", text, decoded))
+	}
+	return 1
+}
+
+// FuzzDecode
+// A go-fuzz entry point that decodes data as binary tokens, including ones
+// that are not in the vocabulary, so that the fuzzer catches any panic.
+func FuzzDecode(encoder *GPTEncoder, data []byte) int {
+	encoder.DecodeBuffer(&data)
+	return 0
+}
+
+// WriteFuzzCorpus
+// Writes FuzzSeeds to dir, as a go-fuzz corpus directory of files named by
+// the SHA-1 of their contents.
+func WriteFuzzCorpus(dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	for _, seed := range FuzzSeeds {
+		hash := sha1.Sum([]byte(seed))
+		path := filepath.Join(dir, hex.EncodeToString(hash[:]))
+		if err := os.WriteFile(path, []byte(seed), 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -3,7 +3,6 @@ package gpt_bpe
 import (
 	"bufio"
 	"bytes"
-	"encoding/binary"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -13,7 +12,9 @@ import (
 	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"unicode"
+	"unicode/utf8"
 
 	lru "github.com/hashicorp/golang-lru"
 	"github.com/wbrown/gpt_bpe/resources"
@@ -23,7 +24,11 @@ const BPE_LRU_SZ = 65536
 const RUNEBUF_SZ = 16384
 const WORDCHAN_SZ = 4096
 
-type Token uint16
+// MAXWORD_SZ is a MaxWordLength suited to encoders of untrusted input, such
+// as servers. Encoders do not cap words unless it is set.
+const MAXWORD_SZ = 1024
+
+type Token uint32
 type Tokens []Token
 
 type GPTEncoder struct {
@@ -31,7 +36,7 @@ type GPTEncoder struct {
 	decoder         map[Token][]byte
 	bpe_ranks       map[GPTPair]float64
 	unitrim         []int
-	pattern         *regexp.Regexp
+	pattern         PreTokenizer
 	puncPat         *regexp.Regexp
 	specialsPat     *regexp.Regexp
 	byteToRune      [256]rune
@@ -51,11 +56,40 @@ type GPTEncoder struct {
 	replacements    map[string]string
 	runeBufSz       int
 	wordChanSz      int
-	LruHits         int
-	LruMisses       int
+	// LruHits and LruMisses count the word cache's hits and misses, and are
+	// updated atomically, as an encoder may encode on many goroutines.
+	LruHits         int64
+	LruMisses       int64
 	LruEvictions    int
 	LruSize         int
 	SplitterThreads int
+	// MaxWordLength caps the length in bytes of the words that are ranked
+	// and merged, as the cost of merging grows quadratically with a word's
+	// length. Longer words are split into pieces, which changes the tokens
+	// that they encode to. Zero, the default, disables the cap, other than
+	// in EncodeLimited, which merges words in pieces of MAXWORD_SZ.
+	MaxWordLength int
+	// MaxInputBytes and MaxOutputTokens cap the texts that EncodeLimited
+	// accepts, in bytes and in the tokens that they encode to. Zero
+	// disables either limit.
+	MaxInputBytes   int
+	MaxOutputTokens int
+	// DataVersion is the version of the tokenizer's data when it is
+	// embedded, from EmbeddedDataVersions, and zero otherwise.
+	DataVersion    int
+	specialsPolicy SpecialsPolicy
+	pairTemplate   *PairTemplate
+	bosPolicy      AddPolicy
+	eosPolicy      AddPolicy
+	mergeMode      MergeMode
+	// longestToken is the length in bytes of the longest token, which
+	// bounds the prefixes that MergeGreedy looks up.
+	longestToken int
+	mergeIndex   *mergeIndex
+	hooks        *Hooks
+	caseFolding  CaseFolding
+	bpeLevel     BPELevel
+	unk          *unknownToken
 }
 
 type GPTPair struct {
@@ -82,6 +116,8 @@ func (bs BGERanks) Less(i, j int) bool {
 	return bs[i].rank < bs[j].rank
 }
 
+// SPLIT_REGEX approximates the GPT-2 pre-tokenization expression, which
+// GPT2PreTokenizer implements exactly.
 const SPLIT_REGEX = "'s|'t|'re|'ve|'m|'ll|'d| ?\\p{L" +
 	"}+| ?\\p{N}+| ?[^\\s\\p{L" +
 	"}\\p{N}]+|\\s+(\\S){0}|\\s+"
@@ -104,8 +140,10 @@ func NewCLIPEncoder() GPTEncoder {
 }
 
 type RuneNode struct {
-	rune      rune
-	runes     []rune
+	rune  rune
+	runes []rune
+	// size is the length of runes in bytes.
+	size      int
 	terminal  bool
 	childs    map[rune]*RuneNode
 	childsArr []*RuneNode
@@ -137,6 +175,7 @@ func (encoder *GPTEncoder) createRuneTree() *RuneNode {
 				node.childs[r] = &RuneNode{
 					rune:      r,
 					runes:     keyRunes[:i+1],
+					size:      len(string(keyRunes[:i+1])),
 					terminal:  i == keyLen-1,
 					childs:    make(map[rune]*RuneNode, 0),
 					childsArr: make([]*RuneNode, 0),
@@ -169,15 +208,25 @@ func (root *RuneNode) evaluate(node *RuneNode, r rune) (*RuneNode, bool) {
 
 // NewEncoder
 // Returns a GPTEncoder with the tokenizer data loaded for that vocabulary
-// id.
+// id, which may also name one of TiktokenEncodings.
 func NewEncoder(vocabId string) (*GPTEncoder, error) {
+	if encoding, ok := TiktokenEncodings[vocabId]; ok {
+		return newTiktokenEncoderFromURL(encoding)
+	}
 	hfConfig, resourcesPtr, vocabErr := resources.ResolveVocabId(vocabId,
 		"")
 	if vocabErr != nil {
 		return nil, vocabErr
 	}
-	rsrcs := *resourcesPtr
+	return newEncoderFromResources(vocabId, hfConfig, *resourcesPtr)
+}
 
+// newEncoderFromResources returns a GPTEncoder for the resolved resources
+// of the tokenizer with that vocabulary id.
+func newEncoderFromResources(vocabId string, hfConfig *resources.HFConfig,
+	rsrcs resources.Resources) (*GPTEncoder, error) {
+	// Embedded tokenizers are resolved before any other by their id.
+	dataVersion := EmbeddedDataVersions[vocabId]
 	if hfConfig != nil && hfConfig.ModelId != nil {
 		vocabId = *hfConfig.ModelId
 	}
@@ -192,8 +241,10 @@ func NewEncoder(vocabId string) (*GPTEncoder, error) {
 	}
 	if special, ok := (rsrcs)["special_config.json"]; ok {
 		if special.Data != nil {
-			if json.Unmarshal(*special.Data, &specialConfig) != nil {
-				log.Fatal("Error unmarshalling special_config.json")
+			if err := json.Unmarshal(*special.Data,
+				&specialConfig); err != nil {
+				return nil, fmt.Errorf("%w: error unmarshalling "+
+					"special_config.json: %v", ErrResourceInvalid, err)
 			}
 		}
 	}
@@ -212,18 +263,89 @@ func NewEncoder(vocabId string) (*GPTEncoder, error) {
 		normalizer = strings.NewReplacer(norms...)
 	}
 
-	// Unmarshal the encoder mappings from json to (int: string) map.
-	encoderMappings := make(map[string]int)
-	// check if the encoder.json file is present
-	if _, ok := rsrcs["encoder.json"]; !ok {
-		return nil, fmt.Errorf("encoder.json not found for vocabId: %s", vocabId)
-	}
-	if json.Unmarshal(*rsrcs["encoder.json"].Data, &encoderMappings) != nil {
-		log.Fatal("Error unmarshalling `encoder.json`")
+	// check if the vocabulary and merges files are present
+	_, hasVocabBytes := rsrcs[VOCAB_BYTES_FILE]
+	// Without merges, the vocabulary is encoded greedily.
+	_, hasMerges := rsrcs["merges.txt"]
+	for _, name := range []string{"encoder.json", "vocab.json"} {
+		if name == "vocab.json" && hasVocabBytes {
+			continue
+		}
+		if _, ok := rsrcs[name]; !ok {
+			return nil, fmt.Errorf("%w: %s not found for vocabId: %s",
+				ErrVocabMissing, name, vocabId)
+		}
 	}
 
-	// Build the unitrim array dynamically.
-	unitrimArr := makeUnitrimArr(encoderMappings)
+	// The vocabulary and merges are the bulk of the cold start, and are
+	// parsed concurrently.
+	var encoderMappings map[string]int
+	var unitrimArr []int
+	var encoderTokens map[string]Token
+	var tokensEncoder map[Token][]byte
+	var bpeRanks map[GPTPair]float64
+	var encoderErr, vocabJsonErr, mergesErr error
+	var parsing sync.WaitGroup
+	parsing.Add(3)
+	go func() {
+		defer parsing.Done()
+		// Unmarshal the encoder mappings from json to (int: string) map.
+		encoderMappings = make(map[string]int)
+		if err := json.Unmarshal(*rsrcs["encoder.json"].Data,
+			&encoderMappings); err != nil {
+			encoderErr = fmt.Errorf("%w: error unmarshalling "+
+				"`encoder.json`: %v", ErrVocabInvalid, err)
+			return
+		}
+		// Build the unitrim array dynamically.
+		unitrimArr = makeUnitrimArr(encoderMappings)
+	}()
+	go func() {
+		defer parsing.Done()
+		// The lossless vocabulary is preferred when present.
+		if hasVocabBytes {
+			encoderTokens, tokensEncoder, vocabJsonErr = ParseVocabBytes(
+				*rsrcs[VOCAB_BYTES_FILE].Data)
+			return
+		}
+		// Read encoder mappings and also generate reverse mappings.
+		encoderTokens = make(map[string]Token)
+		if err := json.Unmarshal(*rsrcs["vocab.json"].Data,
+			&encoderTokens); err != nil {
+			vocabJsonErr = vocabUnmarshalError("vocab.json", err)
+			return
+		}
+		tokensEncoder = make(map[Token][]byte)
+		for text, token := range encoderTokens {
+			tokensEncoder[token] = []byte(text)
+		}
+	}()
+	go func() {
+		defer parsing.Done()
+		// Read vocabulary into bpe_ranks
+		bpeRanks = make(map[GPTPair]float64)
+		if !hasMerges {
+			return
+		}
+		scanner := bufio.NewScanner(bytes.NewBuffer(*rsrcs["merges.txt"].Data))
+		idx := 0
+		for lineNumber := 1; scanner.Scan(); lineNumber++ {
+			// Merges may begin with a version header, and the merges of
+			// others, such as GPT-NeoX's, begin with their first merge.
+			if lineNumber == 1 && strings.HasPrefix(scanner.Text(),
+				"#version") {
+				continue
+			}
+			left_right := strings.SplitN(scanner.Text(), " ", 2)
+			if len(left_right) != 2 {
+				mergesErr = fmt.Errorf("%w: line %d of `merges.txt`: %q",
+					ErrMergeInvalid, lineNumber, scanner.Text())
+				return
+			}
+			bpeRanks[GPTPair{left_right[0], left_right[1]}] = float64(idx)
+			idx += 1
+		}
+	}()
 
 	// Build the bytes to unicode tables.
 	bytesUnicodeMap := make(map[byte]rune)
@@ -251,29 +373,11 @@ func NewEncoder(vocabId string) (*GPTEncoder, error) {
 		bytesUnicode[b] = bytesUnicodeMap[uint8(b)]
 	}
 
-	// Read encoder mappings and also generate reverse mappings.
-	encoderTokens := make(map[string]Token)
-	if json.Unmarshal(*rsrcs["vocab.json"].Data, &encoderTokens) != nil {
-		log.Fatal("Error unmarshalling `vocab.json`")
-	}
-	tokensEncoder := make(map[Token][]byte)
-	for text, token := range encoderTokens {
-		tokensEncoder[token] = []byte(text)
-	}
-
-	// Read vocabulary into bpe_ranks
-	bpeRanks := make(map[GPTPair]float64)
-	scanner := bufio.NewScanner(bytes.NewBuffer(*rsrcs["merges.txt"].Data))
-	idx := uint16(0)
-	firstLine := true
-	for scanner.Scan() {
-		if firstLine == true {
-			firstLine = false
-			continue
+	parsing.Wait()
+	for _, err := range []error{encoderErr, vocabJsonErr, mergesErr} {
+		if err != nil {
+			return nil, err
 		}
-		left_right := strings.SplitN(scanner.Text(), " ", 2)
-		bpeRanks[GPTPair{left_right[0], left_right[1]}] = float64(idx)
-		idx += 1
 	}
 
 	// Handle special tokens. Special tokens are removed from the input before
@@ -297,7 +401,8 @@ func NewEncoder(vocabId string) (*GPTEncoder, error) {
 		seenSpecials := make(map[string]bool, 0)
 		if specialErr := json.Unmarshal(*specialsJson.Data,
 			&specialsData); specialErr != nil {
-			return nil, specialErr
+			return nil, fmt.Errorf("%w: error unmarshalling specials.json: %v",
+				ErrResourceInvalid, specialErr)
 		}
 		for _, v := range specialsData {
 			if _, seen := seenSpecials[v]; !seen {
@@ -315,10 +420,7 @@ func NewEncoder(vocabId string) (*GPTEncoder, error) {
 	if err != nil {
 		log.Fatalf(REGEX_ERROR, err)
 	}
-	pat, err := regexp.Compile(SPLIT_REGEX)
-	if err != nil {
-		log.Fatalf(REGEX_ERROR, err)
-	}
+	var pat PreTokenizer = GPT2PreTokenizer
 	puncPat, err := regexp.Compile(PUNC_REGEX)
 	if err != nil {
 		log.Fatalf(REGEX_ERROR, err)
@@ -362,11 +464,46 @@ func NewEncoder(vocabId string) (*GPTEncoder, error) {
 		0,
 		BPE_LRU_SZ,
 		4,
+		0,
+		0,
+		0,
+		dataVersion,
+		SpecialsAllow,
+		nil,
+		AddDefault,
+		AddDefault,
+		MergeBPE,
+		0,
+		&mergeIndex{},
+		nil,
+		CaseFoldNone,
+		BPEByteLevel,
+		nil,
 	}
 	encoder.specialsTree = encoder.createRuneTree()
+	if !hasMerges {
+		encoder.SetMergeMode(MergeGreedy)
+	}
+	if specialConfig.CharLevel {
+		encoder.SetBPELevel(BPECharLevel)
+	}
+	if specialConfig.UnkToken != "" {
+		if err := encoder.SetUnkToken(specialConfig.UnkToken,
+			specialConfig.FuseUnk); err != nil {
+			return nil, err
+		}
+	}
+	encoder.warnCollisions(vocabId)
 	return encoder, nil
 }
 
+// Unitrim
+// Returns a copy of the encoder's unicode trimming table, which is written as
+// unitrim.json by the embedded tokenizers.
+func (encoder *GPTEncoder) Unitrim() []int {
+	return append([]int{}, encoder.unitrim...)
+}
+
 // makeUnitrimArr creates a lookup table for unicode trimming
 // it replaces the method of generating it in advanced (unitrim.json)
 func makeUnitrimArr(encoderMap map[string]int) []int {
@@ -433,8 +570,15 @@ func makeUnitrimArr(encoderMap map[string]int) []int {
 		DecodeMap[key] = value
 	}
 
-	// create the ordered array of encodings
-	orderedArrayEncodings := make([]string, len(reverseEncoderMap))
+	// create the ordered array of encodings, sized by the highest id, as
+	// ids may be sparse, such as with reserved ranges
+	maxId := -1
+	for k := range reverseEncoderMap {
+		if k > maxId {
+			maxId = k
+		}
+	}
+	orderedArrayEncodings := make([]string, maxId+1)
 	for k, v := range reverseEncoderMap {
 		orderedArrayEncodings[k] = v
 	}
@@ -641,19 +785,28 @@ func findAllStringsIndexes(text string, strings []string) [][]int {
 // Given pre-split text, perform bigram ranking and merges, and returns Tokens
 func (encoder *GPTEncoder) toBPE(text string) Tokens {
 	if lookup, ok := encoder.cache.Get(text); ok {
-		encoder.LruHits++
+		atomic.AddInt64(&encoder.LruHits, 1)
 		return lookup.(Tokens)
 	} else {
-		encoder.LruMisses++
+		atomic.AddInt64(&encoder.LruMisses, 1)
+		if encoder.hooks != nil && encoder.hooks.OnCacheMiss != nil {
+			encoder.hooks.OnCacheMiss(text)
+		}
 	}
 	word := strings.Split(text, "")
 	word[len(word)-1] = word[len(word)-1] + encoder.endOfWord
+	if encoder.mergeMode == MergeGreedy {
+		tokens := encoder.toGreedy(word)
+		encoder.cache.Add(text, tokens)
+		return tokens
+	}
 	rankedPairs := encoder.getRankedPairs(word)
 	if len(rankedPairs) == 0 {
-		tokens := Tokens{encoder.encoder[word[0]]}
+		tokens, _ := encoder.appendPiece(make(Tokens, 0, 1), word[0], false)
 		encoder.cache.Add(text, tokens)
 		return tokens
 	}
+	merges := 0
 	for {
 		bigram := rankedPairs[0].bigram
 		if _, ok := encoder.bpe_ranks[bigram]; !ok {
@@ -672,6 +825,7 @@ func (encoder *GPTEncoder) toBPE(text string) Tokens {
 			i = j
 			if word[i] == first && i < len(word)-1 && word[i+1] == second {
 				newWord = append(newWord, first+second)
+				merges++
 				i += 2
 			} else {
 				newWord = append(newWord, word[i])
@@ -689,9 +843,13 @@ func (encoder *GPTEncoder) toBPE(text string) Tokens {
 		idx := len(word) - 1
 		word[idx] = word[idx]
 	}
-	tokens := make(Tokens, len(word))
-	for idx, token := range word {
-		tokens[idx] = encoder.encoder[token]
+	if encoder.hooks != nil && encoder.hooks.OnMergeApplied != nil {
+		encoder.hooks.OnMergeApplied(text, merges)
+	}
+	tokens := make(Tokens, 0, len(word))
+	unknown := false
+	for _, piece := range word {
+		tokens, unknown = encoder.appendPiece(tokens, piece, unknown)
 	}
 	encoder.cache.Add(text, tokens)
 	return tokens
@@ -711,12 +869,62 @@ func (encoder *GPTEncoder) getSpecials() map[int][][]rune {
 	return lenMap
 }
 
+// splitLongWord
+// Splits word into pieces of at most maxLength bytes, without splitting
+// any rune.
+func splitLongWord(word string, maxLength int) []string {
+	pieces := make([]string, 0, len(word)/maxLength+1)
+	for len(word) > maxLength {
+		end := maxLength
+		for end > 0 && !utf8.RuneStart(word[end]) {
+			end--
+		}
+		if end == 0 {
+			// A single rune is longer than maxLength.
+			_, end = utf8.DecodeRuneInString(word)
+		}
+		pieces = append(pieces, word[:end])
+		word = word[end:]
+	}
+	if len(word) > 0 {
+		pieces = append(pieces, word)
+	}
+	return pieces
+}
+
 type NextRuneFunc func() (rune, int, error)
 type WordCallback func(*string)
 
-func (encoder *GPTEncoder) splitOntoChan(text string, ch chan *string,
-	specialToken bool, specialsNode *RuneNode, wg *sync.WaitGroup) {
+// splitOntoChan
+// Splits a line of text into words, sending them onto ch. The special tokens
+// in the line are given by the begin and end offsets in specialIdxes, and
+// are sent as words of their own, while the text between them is split. The
+// lookahead is the text that follows the line, if any.
+func (encoder *GPTEncoder) splitOntoChan(text string, specialIdxes []int,
+	lookahead string, ch chan *string, wg *sync.WaitGroup) {
 	defer close(ch)
+	begin := 0
+	for idx := 0; idx < len(specialIdxes); idx += 2 {
+		encoder.splitSegment(text[begin:specialIdxes[idx]], "", ch)
+		special := text[specialIdxes[idx]:specialIdxes[idx+1]]
+		ch <- &special
+		begin = specialIdxes[idx+1]
+	}
+	encoder.splitSegment(text[begin:], lookahead, ch)
+	wg.Done()
+}
+
+// splitSegment
+// Splits text that holds no special tokens into words, sending them onto ch.
+// The words are slices of text, unless they are rewritten. Text is split
+// along with its lookahead, the text that follows it, so that the whitespace
+// at its end is split as it is before that text, but only the words of text
+// are sent.
+func (encoder *GPTEncoder) splitSegment(text string, lookahead string,
+	ch chan *string) {
+	if len(text) == 0 {
+		return
+	}
 	// Some things such as KoboldAI have a 'replacement' rule, where
 	// they replace tokens such as `\n` with `</s>` for Fairseq
 	// handling.
@@ -725,10 +933,18 @@ func (encoder *GPTEncoder) splitOntoChan(text string, ch chan *string,
 	}
 
 	text = encoder.Normalizer.Replace(text)
+	text = CaseFold(text, encoder.caseFolding)
 
-	idxes := encoder.pattern.FindAllStringIndex(text, -1)
+	idxes := encoder.pattern.FindAllStringIndex(text+lookahead, -1)
 	for idx := range idxes {
-		word := text[idxes[idx][0]:idxes[idx][1]]
+		if idxes[idx][0] >= len(text) {
+			break
+		}
+		end := idxes[idx][1]
+		if end > len(text) {
+			end = len(text)
+		}
+		word := text[idxes[idx][0]:end]
 		if encoder.lowerCase {
 			word = strings.ToLower(word)
 		}
@@ -737,24 +953,21 @@ func (encoder *GPTEncoder) splitOntoChan(text string, ch chan *string,
 			word = strings.TrimSpace(word)
 		}
 
-		if len(word) > 0 {
+		if encoder.MaxWordLength > 0 && len(word) > encoder.MaxWordLength {
+			for _, piece := range splitLongWord(word, encoder.MaxWordLength) {
+				piece := piece
+				ch <- &piece
+			}
+		} else if len(word) > 0 {
 			ch <- &word
 		}
 	}
-
-	// Finally, if we have a special token, we cap it off.
-	if specialToken {
-		runeString := string(specialsNode.runes)
-		ch <- &runeString
-	}
-	wg.Done()
 }
 
-func (encoder *GPTEncoder) synchronousSplitterThread(
-	line string, specialToken bool, specialsNode *RuneNode,
-	wg *sync.WaitGroup) chan *string {
+func (encoder *GPTEncoder) synchronousSplitterThread(line string,
+	specialIdxes []int, lookahead string, wg *sync.WaitGroup) chan *string {
 	retCh := make(chan *string, 16)
-	go encoder.splitOntoChan(line, retCh, specialToken, specialsNode, wg)
+	go encoder.splitOntoChan(line, specialIdxes, lookahead, retCh, wg)
 	return retCh
 }
 
@@ -787,53 +1000,81 @@ func (encoder *GPTEncoder) makeWordSplitter(
 
 	return func() {
 		specialsRuneRoot := encoder.specialsTree
-		runeAccumulator := make([]rune, 0, encoder.runeBufSz)
-		specialToken := false
+		lineBuffer := make([]byte, 0, encoder.runeBufSz)
+		var runeBytes [utf8.UTFMax]byte
 		specialsNode := specialsRuneRoot
+		// The rune read after the end of a line, which begins the next.
+		var pending rune
+		var pendingSize int
 		for {
 			// Let's collect runes until we reach the end of our IO stream, or
-			// hit a newline.
+			// the end of a line. Special tokens are found as we go, and
+			// recorded as the begin and end offsets of their bytes in the
+			// line.
+			var specialIdxes []int
+			afterNewline := false
 			for {
-				r, size, err := nextRuneFunc()
+				var r rune
+				var size int
+				var err error
+				if pendingSize > 0 {
+					r, size, pendingSize = pending, pendingSize, 0
+				} else {
+					r, size, err = nextRuneFunc()
+				}
 				if size == 0 || err != nil {
 					break
 				}
+				// A line ends at a newline that no word continues past,
+				// which is one followed by a rune other than whitespace, or
+				// the slash that o200k keeps with the newlines before it,
+				// outside of special tokens, so that the words of each line
+				// are those of the whole text.
+				if afterNewline && specialsNode == specialsRuneRoot &&
+					!isSpace(r) && r != '/' &&
+					specialsRuneRoot.childs[r] == nil {
+					pending, pendingSize = r, size
+					break
+				}
 
-				runeAccumulator = append(runeAccumulator, r)
+				if r < utf8.RuneSelf {
+					lineBuffer = append(lineBuffer, byte(r))
+				} else {
+					runeSize := utf8.EncodeRune(runeBytes[:], r)
+					lineBuffer = append(lineBuffer, runeBytes[:runeSize]...)
+				}
+				var specialToken bool
 				specialsNode, specialToken = specialsRuneRoot.evaluate(
 					specialsNode, r)
-				if specialToken || r == '\n' {
-					break
+				if specialToken {
+					specialIdxes = append(specialIdxes,
+						len(lineBuffer)-specialsNode.size, len(lineBuffer))
+					specialsNode = specialsRuneRoot
 				}
+				afterNewline = r == '\n'
 			}
 
 			// If we have no runes, then we've hit an error, or reached the end
 			// of our IO stream.
-			if len(runeAccumulator) == 0 {
+			if len(lineBuffer) == 0 {
 				wordCallback(nil)
 				break
 			}
 
-			// If we've discovered a special token, then we need to split the
-			// runeAccumulator before the special token.
-			var line string
-			if specialToken {
-				line = string(runeAccumulator[:len(runeAccumulator)-len(
-					specialsNode.runes)])
-			} else {
-				line = string(runeAccumulator)
-			}
-			runeAccumulator = runeAccumulator[:0]
-
-			// We split all words before the special token in question, and
+			// We split all words of the line around its special tokens, and
 			// accumulate them.
+			line := string(lineBuffer)
+			lineBuffer = lineBuffer[:0]
+			lookahead := ""
+			if pendingSize > 0 {
+				lookahead = string(pending)
+			}
 			wg.Add(1)
-			workQueue <- encoder.synchronousSplitterThread(line, specialToken,
-				specialsNode, &wg)
+			workQueue <- encoder.synchronousSplitterThread(line, specialIdxes,
+				lookahead, &wg)
 
 			// Reset our special tokens state.
 			specialsNode = specialsRuneRoot
-			specialToken = false
 		}
 		close(workQueue)
 		wg.Wait()
@@ -886,6 +1127,10 @@ func (encoder *GPTEncoder) SplitWords(text *string) *[]string {
 }
 
 func (encoder *GPTEncoder) toUnicode(text *string) string {
+	// Character level vocabularies are written as the text itself.
+	if encoder.bpeLevel == BPECharLevel {
+		return *text
+	}
 	textBytes := []byte(*text)
 	outArr := make([]rune, len(*text))
 	for idx := range textBytes {
@@ -905,12 +1150,35 @@ func (encoder *GPTEncoder) encodeTokens(tokens *[]string) (encoded Tokens) {
 // StreamingEncode is a streaming encoder. It takes an io.RuneReader and
 // returns an iterator function that will return Tokens on each call.
 func (encoder *GPTEncoder) StreamingEncode(reader io.RuneReader) func(int) *Tokens {
+	bos, eos := encoder.BosEosPolicy()
+	return encoder.streamingEncode(reader, bos, eos)
+}
+
+// StreamingEncodeReader
+// Returns an iterator function over the tokens of the text read from reader,
+// as StreamingEncode does, for encoding files too large to hold in memory.
+// Readers that are not io.RuneReaders are buffered, and characters and words
+// that straddle reads are decoded whole, so the tokens are those that Encode
+// returns for the whole text. The text is split into words a line at a time,
+// where lines end at the newlines that no word spans, so memory is bounded by
+// the longest such line of the text.
+func (encoder *GPTEncoder) StreamingEncodeReader(
+	reader io.Reader) func(int) *Tokens {
+	runeReader, ok := reader.(io.RuneReader)
+	if !ok {
+		runeReader = bufio.NewReaderSize(reader, encoder.runeBufSz)
+	}
+	return encoder.StreamingEncode(runeReader)
+}
+
+// streamingEncode is StreamingEncode, adding BOS and EOS tokens by the given
+// resolved policies.
+func (encoder *GPTEncoder) streamingEncode(reader io.RuneReader,
+	bos AddPolicy, eos AddPolicy) func(int) *Tokens {
 	nextWord := encoder.WordSplitter(reader)
 	accumulator := make(Tokens, 0, 16384)
-	eosReturned := false
-	if encoder.encloseEosBos {
-		accumulator = append(accumulator, encoder.BosToken)
-	}
+	framer := encoder.newBosEosFramer(bos, eos)
+	ended := false
 	return func(desiredTokens int) *Tokens {
 		for {
 			// If we have enough tokens, then we return them, and reset the
@@ -924,9 +1192,9 @@ func (encoder *GPTEncoder) StreamingEncode(reader io.RuneReader) func(int) *Toke
 			word := nextWord()
 			// If we have no word, then we're done.
 			if word == nil {
-				if encoder.encloseEosBos && !eosReturned {
-					accumulator = append(accumulator, encoder.EosToken)
-					eosReturned = true
+				if !ended {
+					accumulator = append(accumulator, framer.end()...)
+					ended = true
 				}
 				// If we have any tokens left, then we return them.
 				if len(accumulator) > 0 {
@@ -937,22 +1205,28 @@ func (encoder *GPTEncoder) StreamingEncode(reader io.RuneReader) func(int) *Toke
 					return nil
 				}
 			}
-			// Otherwise, we add the word to the accumulator. We have to handle
-			// the special tokens here, since they're not in the vocab.
-			var encodedTokens Tokens
-			specialToken, isSpecial := encoder.specials[*word]
-			if isSpecial {
-				decodedSpecial := string(encoder.decoder[specialToken[0]])
-				encodedTokens = Tokens{encoder.encoder[decodedSpecial]}
-			} else {
-				fragment := encoder.toUnicode(word)
-				encodedTokens = encoder.toBPE(fragment)
-			}
-			accumulator = append(accumulator, encodedTokens...)
+			// Otherwise, we add the word to the accumulator.
+			accumulator = append(accumulator,
+				framer.next(encoder.encodeWord(word))...)
 		}
 	}
 }
 
+// encodeWord
+// Encodes a word from the WordSplitter. We have to handle the special tokens
+// here, since they're not in the vocab.
+func (encoder *GPTEncoder) encodeWord(word *string) Tokens {
+	if encoder.hooks != nil && encoder.hooks.OnPretokenize != nil {
+		encoder.hooks.OnPretokenize(*word)
+	}
+	if specialToken, isSpecial := encoder.specials[*word]; isSpecial &&
+		encoder.specialsPolicy == SpecialsAllow {
+		decodedSpecial := string(encoder.decoder[specialToken[0]])
+		return Tokens{encoder.encoder[decodedSpecial]}
+	}
+	return encoder.toBPE(encoder.toUnicode(word))
+}
+
 func (encoder *GPTEncoder) EncodeReader(reader io.RuneReader) *Tokens {
 	encoded := make(Tokens, 0, 4096)
 	nextTokens := encoder.StreamingEncode(reader)
@@ -967,8 +1241,9 @@ func (encoder *GPTEncoder) EncodeReader(reader io.RuneReader) *Tokens {
 }
 
 // EncodeBuffer takes a byte array and encodes it into Tokens in another
-// byte array.
-func (encoder *GPTEncoder) EncodeBuffer(buffer *[]byte) *[]byte {
+// byte array, of TokenSize bytes a token as ToBin writes. It fails with
+// ErrTokenOutOfRange if the encoder yields a token that does not fit.
+func (encoder *GPTEncoder) EncodeBuffer(buffer *[]byte) (*[]byte, error) {
 	runeReader := bytes.NewReader(*buffer)
 	nextTokens := encoder.StreamingEncode(runeReader)
 	buf := bytes.NewBuffer(make([]byte, 0, 4096))
@@ -977,10 +1252,14 @@ func (encoder *GPTEncoder) EncodeBuffer(buffer *[]byte) *[]byte {
 		if tokens == nil {
 			break
 		}
-		binary.Write(buf, binary.LittleEndian, tokens)
+		bin, err := tokens.ToBin()
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(*bin)
 	}
 	bufBytes := buf.Bytes()
-	return &bufBytes
+	return &bufBytes, nil
 }
 
 // Encode encodes a string into a sequence of tokens.
@@ -1020,13 +1299,18 @@ func (encoder *GPTEncoder) Decode(encoded *Tokens) (text string) {
 					bs = append(bs, v...)
 				}
 			}
-			// Convert our bytearray to string, interpreting as UTF-8 and then
-			// to 32-bit runes.
-			runes := []rune(string(bs))
-			decoded := make([]byte, len(runes))
-			// Convert our runes into 8-bit bytes using a 256-slot lookup table.
-			for runeIdx := range runes {
-				decoded[runeIdx] = encoder.runeToByte[runes[runeIdx]]
+			// Character level tokens are their own text.
+			decoded := bs
+			if encoder.bpeLevel == BPEByteLevel {
+				// Convert our bytearray to string, interpreting as UTF-8 and
+				// then to 32-bit runes.
+				runes := []rune(string(bs))
+				decoded = make([]byte, len(runes))
+				// Convert our runes into 8-bit bytes using a 256-slot lookup
+				// table.
+				for runeIdx := range runes {
+					decoded[runeIdx] = encoder.runeToByte[runes[runeIdx]]
+				}
 			}
 			// Decode our final token representation into a Unicode string.
 			fragment := string(decoded)
@@ -1045,9 +1329,10 @@ func (encoder *GPTEncoder) Decode(encoded *Tokens) (text string) {
 					unicode.IsNumber(fragmentAsRunes[0]) {
 					fragmentAsRunes = append(fragmentAsRunes, ' ')
 				}
-				if len(runesAcc) > 1 && runeIsIn(fragmentAsRunes[0],
-					encoder.PuncRunes) && unicode.IsSpace(runesAcc[len(
-					runesAcc)-1]) {
+				// Tokens that are not in the vocabulary decode as nothing.
+				if len(runesAcc) > 1 && len(fragmentAsRunes) > 0 &&
+					runeIsIn(fragmentAsRunes[0], encoder.PuncRunes) &&
+					unicode.IsSpace(runesAcc[len(runesAcc)-1]) {
 					runesAcc = runesAcc[:len(runesAcc)-1]
 				}
 			}
@@ -1059,6 +1344,19 @@ func (encoder *GPTEncoder) Decode(encoded *Tokens) (text string) {
 	return string(runesAcc)
 }
 
+// CheckTokens
+// Returns an ErrTokenOutOfRange error for the first of tokens that is not in
+// the vocabulary, which Decode would skip over.
+func (encoder *GPTEncoder) CheckTokens(tokens *Tokens) error {
+	for idx, token := range *tokens {
+		if _, ok := encoder.decoder[token]; !ok {
+			return fmt.Errorf("%w: token %d at index %d",
+				ErrTokenOutOfRange, token, idx)
+		}
+	}
+	return nil
+}
+
 // DecodeBuffer
 // Decode Tokens from a byte array into a string.
 func (encoder *GPTEncoder) DecodeBuffer(encoded *[]byte) (text string) {
@@ -1116,9 +1414,21 @@ func (encoder *GPTEncoder) TrimTokens(tokens *Tokens) (trimmed *Tokens) {
 	}
 }
 
-var GPT2Encoder = NewGPT2Encoder()
-var PileEncoder = NewPileEncoder()
-var CLIPEncoder = NewCLIPEncoder()
+var GPT2Encoder, PileEncoder, CLIPEncoder = newEmbeddedEncoders()
+
+// newEmbeddedEncoders
+// Builds the encoders of the embedded vocabularies concurrently, as each is
+// parsed independently of the others.
+func newEmbeddedEncoders() (gpt2, pile, clip GPTEncoder) {
+	var wg sync.WaitGroup
+	wg.Add(3)
+	go func() { defer wg.Done(); gpt2 = NewGPT2Encoder() }()
+	go func() { defer wg.Done(); pile = NewPileEncoder() }()
+	go func() { defer wg.Done(); clip = NewCLIPEncoder() }()
+	wg.Wait()
+	return gpt2, pile, clip
+}
+
 var blankString = ""
 var _ = GPT2Encoder.Encode(&blankString)
 var _ = PileEncoder.Encode(&blankString)
@@ -2,19 +2,32 @@ package gpt_bpe
 
 import (
 	"bufio"
+	"bytes"
 	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"log"
+	"math"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"runtime/debug"
 	"strings"
+	"sync"
 	"testing"
+	"testing/iotest"
 	"time"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/wbrown/gpt_bpe/resources"
+	"github.com/wbrown/gpt_bpe/zstd"
 )
 
 var clipEncoder GPTEncoder
@@ -110,7 +123,7 @@ const hindiSentence = "व्याकरण शास्त्रीय पर
 var TrimSentencesTests = []TrimTest{
 	{sent1, TrimTop, 10,
 		" This is test sentence 3."},
-	{sent1, TrimTop, 20,
+	{sent1, TrimTop, 19,
 		" This is test sentence 2.  This is test sentence 3."},
 	{sent1, TrimTop, 30,
 		sent1},
@@ -122,7 +135,7 @@ var TrimSentencesTests = []TrimTest{
 		sent2},
 	{sent1, TrimBottom, 10,
 		"This is test sentence 1."},
-	{sent1, TrimBottom, 20,
+	{sent1, TrimBottom, 19,
 		"This is test sentence 1.  This is test sentence 2."},
 	{sent1, TrimBottom, 30,
 		sent1},
@@ -230,7 +243,7 @@ var SplitTests = []SplitTest{
 		[]string{"we", "'ll", " go", " jump", " in", " a", " lake",
 			"."}},
 	{"multiple  encoded spaces.",
-		[]string{"multiple", "  ", "encoded", " spaces", "."}},
+		[]string{"multiple", " ", " encoded", " spaces", "."}},
 	{"Capitalized Words Are Cool",
 		[]string{"Capitalized", " Words", " Are", " Cool"}},
 	{"we'LL test irregular cApitalizatioN.",
@@ -247,6 +260,17 @@ var SplitTests = []SplitTest{
 	{"we'll go jump<|end\noftext|> in a lake.",
 		[]string{"we", "'ll", " go", " jump", "<|", "end", "\n",
 			"oftext", "|>", " in", " a", " lake", "."}},
+	{"<|endoftext|><|endoftext|>café<|endoftext|> naïve\n<|endoftext|>",
+		[]string{"<|endoftext|>", "<|endoftext|>", "café",
+			"<|endoftext|>", " naïve", "\n", "<|endoftext|>"}},
+	{"<|endof<|endoftext|>",
+		[]string{"<|", "endof", "<|endoftext|>"}},
+	{"three\n\n\nnewlines and windows\r\nnewlines",
+		[]string{"three", "\n\n", "\n", "newlines", " and", " windows", "\r",
+			"\n", "newlines"}},
+	{"paragraph.\n\n<|endoftext|>\n\n  indented",
+		[]string{"paragraph", ".", "\n\n", "<|endoftext|>", "\n\n ",
+			" indented"}},
 }
 
 func TestGPTEncoder_Split(t *testing.T) {
@@ -256,6 +280,1210 @@ func TestGPTEncoder_Split(t *testing.T) {
 	}
 }
 
+// PreTokenizerTests holds reference splits by the standard expressions.
+var PreTokenizerTests = []struct {
+	PreTokenizer PreTokenizer
+	Input        string
+	Expected     []string
+}{
+	{GPT2PreTokenizer, "multiple  encoded spaces.\n",
+		[]string{"multiple", " ", " encoded", " spaces", ".", "\n"}},
+	{GPT2PreTokenizer, "Tabs\t\tand\u3000ideographic\u00a0spaces  ",
+		[]string{"Tabs", "\t", "\t", "and", "\u3000", "ideographic",
+			"\u00a0", "spaces", "  "}},
+	{GPT2PreTokenizer, "we'LL say it's 1,234.5\r\n\r\nok",
+		[]string{"we", "'", "LL", " say", " it", "'s", " 1", ",", "234", ".",
+			"5", "\r\n\r", "\n", "ok"}},
+	{Llama3PreTokenizer, "multiple  encoded spaces.\n",
+		[]string{"multiple", " ", " encoded", " spaces", ".\n"}},
+	{Llama3PreTokenizer, "WE'LL say it'S 1234567!!\n\n  Hello\n",
+		[]string{"WE", "'LL", " say", " it", "'S", " ", "123", "456", "7",
+			"!!\n\n", " ", " Hello", "\n"}},
+	{Llama3PreTokenizer, "\"quoted\"\t\ttabs 中文 ²³ 😀😀\r\n",
+		[]string{"\"quoted", "\"", "\t", "\ttabs", " 中文", " ", "²³",
+			" 😀😀\r\n"}},
+	{O200kPreTokenizer, "HelloWorld camelCase XMLHttpRequest iPhone",
+		[]string{"Hello", "World", " camel", "Case", " XMLHttp", "Request",
+			" i", "Phone"}},
+	{O200kPreTokenizer, "WE'LL say it'S 1234567!!\n\n  Hello\n",
+		[]string{"WE'LL", " say", " it'S", " ", "123", "456", "7", "!!\n\n",
+			" ", " Hello", "\n"}},
+	{O200kPreTokenizer, "path/to //x.\n//y\n\nño Ǆemal ǅx 中文 ʰa",
+		[]string{"path", "/to", " //", "x", ".\n//", "y", "\n\n", "ño",
+			" Ǆemal", " ǅx", " 中文", " ʰa"}},
+}
+
+func TestScannerPreTokenizer(t *testing.T) {
+	for _, test := range PreTokenizerTests {
+		words := make([]string, 0)
+		for _, idx := range test.PreTokenizer.FindAllStringIndex(test.Input,
+			-1) {
+			words = append(words, test.Input[idx[0]:idx[1]])
+		}
+		assert.Equal(t, test.Expected, words, test.Input)
+	}
+	assert.Len(t, GPT2PreTokenizer.FindAllStringIndex("a b c", 2), 2)
+}
+
+func TestGPTEncoder_SplitWordsAcrossLines(t *testing.T) {
+	// Text is split a line at a time, into the words of the whole text,
+	// which may span newlines.
+	text := "Ends with punctuation!\n\nThen\r\n\r\nwindows\n  \n" +
+		"indented\n\t// comment\n//\n/path\n\n\n'tis 12345\nend\n"
+	for _, preTokenizer := range []PreTokenizer{GPT2PreTokenizer,
+		Llama3PreTokenizer, O200kPreTokenizer} {
+		expected := make([]string, 0)
+		for _, idx := range preTokenizer.FindAllStringIndex(text, -1) {
+			expected = append(expected, text[idx[0]:idx[1]])
+		}
+		encoder := NewGPT2Encoder()
+		encoder.SetPreTokenizer(preTokenizer)
+		assert.Equal(t, expected, *encoder.SplitWords(&text),
+			preTokenizer.String())
+	}
+}
+
+func benchmarkPreTokenizer(b *testing.B, preTokenizer PreTokenizer) {
+	b.SetBytes(int64(len(corpus)))
+	for i := 0; i < b.N; i++ {
+		preTokenizer.FindAllStringIndex(corpus, -1)
+	}
+}
+
+func BenchmarkGPT2PreTokenizer(b *testing.B) {
+	benchmarkPreTokenizer(b, GPT2PreTokenizer)
+}
+
+func BenchmarkRegexpPreTokenizer(b *testing.B) {
+	benchmarkPreTokenizer(b, RegexpPreTokenizer)
+}
+
+func TestGPTEncoder_SetPreTokenizer(t *testing.T) {
+	encoder := NewGPT2Encoder()
+	fingerprint := encoder.Fingerprint()
+	text := "multiple  encoded spaces."
+	encoder.SetPreTokenizer(RegexpPreTokenizer)
+	assert.Equal(t, []string{"multiple", "  ", "encoded", " spaces", "."},
+		*encoder.SplitWords(&text))
+	assert.NotEqual(t, fingerprint, encoder.Fingerprint())
+	encoder.SetPreTokenizer(GPT2PreTokenizer)
+	assert.Equal(t, fingerprint, encoder.Fingerprint())
+}
+
+func TestGPTEncoder_MaxWordLength(t *testing.T) {
+	encoder := NewGPT2Encoder()
+	// Words are not capped unless it is asked for.
+	assert.Equal(t, 0, encoder.MaxWordLength)
+	encoder.MaxWordLength = 16
+	long := strings.Repeat("a", 40) + " " + strings.Repeat("é", 10)
+	assert.Equal(t, []string{strings.Repeat("a", 16),
+		strings.Repeat("a", 16), strings.Repeat("a", 8),
+		" " + strings.Repeat("é", 7), strings.Repeat("é", 3)},
+		*encoder.SplitWords(&long))
+	assert.Equal(t, long, encoder.Decode(encoder.Encode(&long)))
+
+	// Unbroken input far longer than the cap still encodes.
+	encoder.MaxWordLength = MAXWORD_SZ
+	adversarial := strings.Repeat("xq", 64*1024)
+	assert.Equal(t, adversarial,
+		encoder.Decode(encoder.Encode(&adversarial)))
+
+	encoder.MaxWordLength = 0
+	assert.Equal(t, []string{strings.Repeat("a", 40),
+		" " + strings.Repeat("é", 10)}, *encoder.SplitWords(&long))
+}
+
+func TestNewEncoderWithOptions(t *testing.T) {
+	encoder, err := NewEncoderWithOptions("gpt2-tokenizer",
+		WithCacheSize(16), WithMaxWordLength(8),
+		WithPreTokenizer(RegexpPreTokenizer),
+		WithNormalizer(strings.NewReplacer("colour", "color")))
+	assert.Nil(t, err)
+	assert.Equal(t, 16, encoder.LruSize)
+	assert.Equal(t, 8, encoder.MaxWordLength)
+	text := "a colour"
+	assert.Equal(t, "a color", encoder.Decode(encoder.Encode(&text)))
+
+	_, err = NewEncoderWithOptions("gpt2-tokenizer", WithCacheSize(0))
+	assert.NotNil(t, err)
+	_, err = NewEncoderWithOptions("gpt2-tokenizer", WithMaxWordLength(-1))
+	assert.NotNil(t, err)
+	_, err = NewEncoderWithOptions("gpt2-tokenizer",
+		WithSpecialsPolicy(SpecialsPolicy(99)))
+	assert.NotNil(t, err)
+}
+
+func TestGPTEncoder_SetSpecialsPolicy(t *testing.T) {
+	encoder, err := NewEncoderWithOptions("gpt2-tokenizer",
+		WithSpecialsPolicy(SpecialsAsText))
+	assert.Nil(t, err)
+	text := "hello<|endoftext|>"
+	asText := encoder.Encode(&text)
+	assert.NotContains(t, *asText, encoder.EosToken)
+	assert.Equal(t, text, encoder.Decode(asText))
+	assert.NotEqual(t, gpt2Encoder.Fingerprint(), encoder.Fingerprint())
+
+	assert.Nil(t, encoder.SetSpecialsPolicy(SpecialsAllow))
+	assert.Equal(t, *gpt2Encoder.Encode(&text), *encoder.Encode(&text))
+	assert.Equal(t, gpt2Encoder.Fingerprint(), encoder.Fingerprint())
+}
+
+func TestMockEncoder(t *testing.T) {
+	encoder := NewMockEncoder("hello", " world")
+	text := "hello world  hello\tthere \n"
+	assert.Equal(t, []string{"hello", " world", "  hello", "\tthere", " \n"},
+		*encoder.SplitWords(&text))
+	tokens := encoder.Encode(&text)
+	assert.Equal(t, Tokens{2, 3, 4, 5, 6}, *tokens)
+	assert.Equal(t, text, encoder.Decode(tokens))
+	assert.Equal(t, *tokens,
+		*encoder.EncodeReader(strings.NewReader(text)))
+	assert.Equal(t, Token(3), *encoder.Get(" world"))
+	assert.Nil(t, encoder.Get("unseen"))
+	assert.NoError(t, encoder.CheckTokens(tokens))
+	assert.ErrorIs(t, encoder.CheckTokens(&Tokens{7}), ErrTokenOutOfRange)
+
+	// Ids are stable for the same inputs.
+	assert.Equal(t, *tokens, *NewMockEncoder("hello", " world").Encode(&text))
+
+	encoder.maxTokens = 7
+	more := " more words"
+	assert.Equal(t, Tokens{MOCK_UNK_TOKEN, MOCK_UNK_TOKEN},
+		*encoder.Encode(&more))
+}
+
+func TestEncoder(t *testing.T) {
+	text := "hello world<|endoftext|>"
+	for _, encoder := range []Encoder{&gpt2Encoder, NewMockEncoder()} {
+		tokens := encoder.Encode(&text)
+		assert.Equal(t, len(*tokens), encoder.Count(&text))
+		assert.Equal(t, text, encoder.Decode(tokens))
+		assert.Contains(t, encoder.Specials(), "<|endoftext|>")
+		assert.Len(t, encoder.Fingerprint(), 64)
+	}
+	assert.Equal(t, Tokens{gpt2Encoder.EosToken},
+		gpt2Encoder.Specials()["<|endoftext|>"])
+	assert.Equal(t, NewMockEncoder("a").Fingerprint(),
+		NewMockEncoder("a").Fingerprint())
+	assert.NotEqual(t, NewMockEncoder("a").Fingerprint(),
+		NewMockEncoder("b").Fingerprint())
+}
+
+func TestGPTEncoder_ReserveSpecials(t *testing.T) {
+	encoder := NewGPT2Encoder()
+	tokens, err := encoder.ReserveSpecials(3)
+	assert.Nil(t, err)
+	assert.Equal(t, Tokens{50258, 50259, 50260}, tokens)
+	text := "hello<|reserved_special_1|>world"
+	encoded := encoder.Encode(&text)
+	assert.Equal(t, Tokens{31373, 50259, 6894}, *encoded)
+	assert.Equal(t, text, encoder.Decode(encoded))
+	assert.Nil(t, encoder.CheckTokens(encoded))
+
+	assert.Nil(t, encoder.RenameSpecial("<|reserved_special_1|>",
+		"<|tool_call|>"))
+	_, ok := encoder.Specials()["<|reserved_special_1|>"]
+	assert.False(t, ok)
+	text = "hello<|tool_call|>world"
+	assert.Equal(t, Tokens{31373, 50259, 6894}, *encoder.Encode(&text))
+	// The lowest free names are given first.
+	tokens, err = encoder.ReserveSpecialRange(60000, 2,
+		RESERVED_SPECIAL_FORMAT)
+	assert.Nil(t, err)
+	assert.Equal(t, Tokens{60000, 60001}, tokens)
+	assert.Equal(t, Tokens{60000},
+		encoder.Specials()["<|reserved_special_1|>"])
+	assert.Equal(t, Tokens{60001},
+		encoder.Specials()["<|reserved_special_3|>"])
+
+	_, err = encoder.ReserveSpecialRange(60001, 1, RESERVED_SPECIAL_FORMAT)
+	assert.NotNil(t, err)
+	_, err = encoder.ReserveSpecialRange(^Token(0), 2,
+		RESERVED_SPECIAL_FORMAT)
+	assert.NotNil(t, err)
+	_, err = encoder.ReserveSpecials(0)
+	assert.NotNil(t, err)
+	assert.NotNil(t, encoder.RenameSpecial("<|tool_call|>", "hello"))
+	assert.NotNil(t, encoder.RenameSpecial("<|tool_call|>", "<|a b|>"))
+	assert.NotNil(t, encoder.RenameSpecial("hello", "<|hello|>"))
+
+	// The updated artifacts load as the same tokenizer.
+	dir := t.TempDir()
+	vocab, err := encoder.MarshalVocab()
+	assert.Nil(t, err)
+	specials, err := encoder.MarshalSpecials()
+	assert.Nil(t, err)
+	for name, data := range map[string][]byte{
+		"encoder.json": vocab,
+		"specials.txt": specials,
+		"vocab.bpe": *resources.GetEmbeddedResource(
+			"gpt2-tokenizer/vocab.bpe").Data,
+	} {
+		if err := os.WriteFile(dir+"/"+name, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	reloaded, err := NewEncoder(dir)
+	if assert.Nil(t, err) {
+		assert.Equal(t, encoder.Specials(), reloaded.Specials())
+		assert.Equal(t, *encoder.Encode(&text), *reloaded.Encode(&text))
+		assert.Equal(t, encoder.Fingerprint(), reloaded.Fingerprint())
+	}
+}
+
+func TestCompareEncodings(t *testing.T) {
+	text := "hello tokenizations 🐹<|endoftext|>"
+	comparison := CompareEncodings(text, &gpt2Encoder, NewMockEncoder(),
+		&clipEncoder)
+	assert.Equal(t, text, comparison.Text)
+	gpt2, mock := comparison.Segmentations[0], comparison.Segmentations[1]
+	assert.True(t, gpt2.Aligned)
+	assert.True(t, mock.Aligned)
+	// CLIP lowercases and marks word ends, so cannot be aligned.
+	assert.False(t, comparison.Segmentations[2].Aligned)
+	for _, segmentation := range comparison.Segmentations[:2] {
+		assert.Equal(t, 0, segmentation.Spans[0].Start)
+		assert.Equal(t, len(text),
+			segmentation.Spans[len(segmentation.Spans)-1].End)
+	}
+
+	if !assert.Len(t, comparison.Differences, 2) {
+		return
+	}
+	word, emoji := comparison.Differences[0], comparison.Differences[1]
+	assert.Equal(t, " tokenizations", text[word.Start:word.End])
+	assert.Equal(t, 1, word.Counts[1])
+	assert.Greater(t, word.Counts[0], 1)
+	assert.Equal(t, 0, word.Counts[2])
+	assert.Empty(t, word.Reasons[2])
+	// The mock encoder does not split special tokens from words.
+	assert.Equal(t, " 🐹<|endoftext|>", text[emoji.Start:emoji.End])
+	assert.Equal(t, "4 tokens, splitting a character, including a "+
+		"special token", emoji.Reasons[0])
+	assert.Equal(t, "1 token", emoji.Reasons[1])
+
+	// Identical encoders do not differ.
+	assert.Empty(t, CompareEncodings(text, &gpt2Encoder,
+		&gpt2Encoder).Differences)
+	assert.Empty(t, CompareEncodings(text, &gpt2Encoder).Differences)
+}
+
+func TestGPTEncoder_EncodeInputs(t *testing.T) {
+	text, pair := "hello world", "one two three four"
+	first, second := *gpt2Encoder.Encode(&text), *gpt2Encoder.Encode(&pair)
+	assert.Len(t, first, 2)
+	assert.Len(t, second, 4)
+
+	inputs, err := gpt2Encoder.EncodeInputs(&text, nil, InputsOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, ModelInputs{first, []int{1, 1}, nil}, *inputs)
+
+	inputs, err = gpt2Encoder.EncodeInputs(&text, &pair, InputsOptions{
+		MaxLength:          8,
+		PadToMaxLength:     true,
+		ReturnTokenTypeIds: true,
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, append(append(Tokens{}, first...), append(second,
+		gpt2Encoder.PadToken, gpt2Encoder.PadToken)...), inputs.InputIds)
+	assert.Equal(t, []int{1, 1, 1, 1, 1, 1, 0, 0}, inputs.AttentionMask)
+	assert.Equal(t, []int{0, 0, 1, 1, 1, 1, 0, 0}, inputs.TokenTypeIds)
+
+	truncations := []struct {
+		truncation    Truncation
+		first, second int
+	}{
+		{TruncateLongestFirst, 2, 2},
+		{TruncateOnlyFirst, -1, -1},
+		{TruncateOnlySecond, 2, 2},
+	}
+	for _, test := range truncations {
+		inputs, err = gpt2Encoder.EncodeInputs(&text, &pair, InputsOptions{
+			MaxLength:          4,
+			Truncation:         test.truncation,
+			ReturnTokenTypeIds: true,
+		})
+		if test.first < 0 {
+			assert.NotNil(t, err)
+			continue
+		}
+		assert.Nil(t, err)
+		expected := append(append(Tokens{}, first[:test.first]...),
+			second[:test.second]...)
+		assert.Equal(t, expected, inputs.InputIds)
+	}
+	inputs, err = gpt2Encoder.EncodeInputs(&pair, &text, InputsOptions{
+		MaxLength: 3, Truncation: TruncateLongestFirst})
+	assert.Nil(t, err)
+	assert.Equal(t, append(second[:2:2], first[:1]...), inputs.InputIds)
+	_, err = gpt2Encoder.EncodeInputs(&text, nil, InputsOptions{
+		MaxLength: 1, Truncation: TruncateOnlySecond})
+	assert.NotNil(t, err)
+	inputs, err = gpt2Encoder.EncodeInputs(&text, nil, InputsOptions{
+		MaxLength: 1})
+	assert.Nil(t, err)
+	assert.Equal(t, first, inputs.InputIds)
+
+	// Special tokens that texts are enclosed in are kept when truncating.
+	encoder := NewGPT2Encoder()
+	encoder.encloseEosBos = true
+	inputs, err = encoder.EncodeInputs(&text, &pair, InputsOptions{
+		MaxLength:          6,
+		Truncation:         TruncateLongestFirst,
+		ReturnTokenTypeIds: true,
+	})
+	assert.Nil(t, err)
+	bos, eos := encoder.BosToken, encoder.EosToken
+	assert.Equal(t, Tokens{bos, first[0], eos, bos, second[0], eos},
+		inputs.InputIds)
+	assert.Equal(t, []int{0, 0, 0, 1, 1, 1}, inputs.TokenTypeIds)
+}
+
+func TestGPTEncoder_EncodePair(t *testing.T) {
+	query, passage := "hello", "world"
+	hello, world := *gpt2Encoder.Encode(&query), *gpt2Encoder.Encode(&passage)
+	assert.Equal(t, PairTemplate{}, gpt2Encoder.PairTemplate())
+	assert.Equal(t, append(append(Tokens{}, hello...), world...),
+		*gpt2Encoder.EncodePair(&query, &passage))
+
+	bos, eos := clipEncoder.BosToken, clipEncoder.EosToken
+	clipHello := *clipEncoder.Encode(&query)
+	clipWorld := *clipEncoder.Encode(&passage)
+	assert.Equal(t, append(append(Tokens{}, clipHello...), clipWorld...),
+		*clipEncoder.EncodePair(&query, &passage))
+	assert.Equal(t, bos, clipHello[0])
+	assert.Equal(t, eos, clipWorld[len(clipWorld)-1])
+
+	// A tokenizer with BERT's special tokens takes BERT's template.
+	encoder := NewGPT2Encoder()
+	tokens, err := encoder.ReserveSpecials(2)
+	assert.Nil(t, err)
+	assert.Nil(t, encoder.RenameSpecial("<|reserved_special_0|>", "[CLS]"))
+	assert.Nil(t, encoder.RenameSpecial("<|reserved_special_1|>", "[SEP]"))
+	cls, sep := tokens[0], tokens[1]
+	assert.Equal(t, Tokens{cls, hello[0], sep, world[0], sep},
+		*encoder.EncodePair(&query, &passage))
+	inputs, err := encoder.EncodeInputs(&query, &passage, InputsOptions{
+		ReturnTokenTypeIds: true})
+	assert.Nil(t, err)
+	assert.Equal(t, []int{0, 0, 0, 1, 1}, inputs.TokenTypeIds)
+	inputs, err = encoder.EncodeInputs(&query, nil, InputsOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, Tokens{cls, hello[0], sep}, inputs.InputIds)
+
+	template := PairTemplate{Tokens{1}, Tokens{2}, Tokens{2}, Tokens{2}}
+	custom, err := NewEncoderWithOptions("gpt2-tokenizer",
+		WithPairTemplate(template))
+	assert.Nil(t, err)
+	assert.Equal(t, template, custom.PairTemplate())
+	assert.Equal(t, Tokens{1, hello[0], 2, 2, world[0], 2},
+		*custom.EncodePair(&query, &passage))
+}
+
+func TestMarshalTokens(t *testing.T) {
+	tokens := Tokens{0, 1, 127, 128, 50256, 65535}
+	for _, dtype := range []TokensDtype{DTYPE_UINT16, DTYPE_UINT32,
+		DTYPE_VARINT, DTYPE_DELTA_VARINT} {
+		data, err := MarshalTokens(tokens, dtype)
+		assert.Nil(t, err)
+		unmarshalled, err := UnmarshalTokens(data, dtype)
+		assert.Nil(t, err)
+		assert.Equal(t, tokens, unmarshalled, dtype.String())
+
+		formatted, err := FormatTokens(tokens, dtype)
+		assert.Nil(t, err)
+		assert.True(t, strings.HasPrefix(formatted, dtype.String()+":"))
+		parsed, err := ParseTokens(formatted)
+		assert.Nil(t, err)
+		assert.Equal(t, tokens, parsed, formatted)
+	}
+	data, _ := MarshalTokens(tokens, DTYPE_UINT16)
+	bin, err := tokens.ToBin()
+	assert.Nil(t, err)
+	assert.Equal(t, *bin, data)
+	formatted, _ := FormatTokens(Tokens{100, 256}, DTYPE_UINT16)
+	assert.Equal(t, "uint16:ZAAAAQ==", formatted)
+	data, _ = MarshalTokens(Tokens{1, 300}, DTYPE_VARINT)
+	assert.Equal(t, []byte{1, 0xac, 2}, data)
+	data, _ = MarshalTokens(Tokens{300, 299, 301}, DTYPE_DELTA_VARINT)
+	assert.Equal(t, []byte{0xd8, 4, 1, 4}, data)
+
+	_, err = UnmarshalTokens([]byte{1, 2, 3}, DTYPE_UINT16)
+	assert.ErrorIs(t, err, ErrTokensInvalid)
+	parsed, err := UnmarshalTokens([]byte{0, 0, 1, 0}, DTYPE_UINT32)
+	assert.Nil(t, err)
+	assert.Equal(t, Tokens{65536}, parsed)
+	_, err = MarshalTokens(parsed, DTYPE_UINT16)
+	assert.ErrorIs(t, err, ErrTokenOutOfRange)
+	_, err = (&Tokens{0, 65536}).ToBin()
+	assert.ErrorIs(t, err, ErrTokenOutOfRange)
+	_, err = UnmarshalTokens([]byte{0x80, 0x80, 0x80, 0x80, 0x10},
+		DTYPE_VARINT)
+	assert.ErrorIs(t, err, ErrTokenOutOfRange)
+	_, err = UnmarshalTokens([]byte{0x80}, DTYPE_VARINT)
+	assert.ErrorIs(t, err, ErrTokensInvalid)
+	_, err = UnmarshalTokens([]byte{1}, DTYPE_DELTA_VARINT)
+	assert.ErrorIs(t, err, ErrTokenOutOfRange)
+	_, err = MarshalTokens(tokens, TokensDtype(9))
+	assert.ErrorIs(t, err, ErrTokensInvalid)
+	for _, formatted := range []string{"ZAAAAQ==", "int8:ZAAAAQ==",
+		"uint16:!!"} {
+		_, err = ParseTokens(formatted)
+		assert.ErrorIs(t, err, ErrTokensInvalid)
+	}
+}
+
+func TestDeltaWriter(t *testing.T) {
+	var buffer bytes.Buffer
+	writer := NewDeltaWriter(&buffer)
+	records := []Tokens{*gpt2Encoder.Encode(&corpus), {65535, 0}, {7, 8, 6}}
+	offsets := make([]int64, 0, len(records))
+	for _, record := range records {
+		offsets = append(offsets, writer.Reset())
+		assert.Nil(t, writer.Write(record))
+	}
+	assert.Equal(t, int64(buffer.Len()), writer.Offset())
+	// Nearby ids delta to a byte each.
+	assert.Equal(t, []byte{14, 2, 3}, buffer.Bytes()[offsets[2]:])
+
+	// Each record is read from its offset alone.
+	data := buffer.Bytes()
+	for idx := len(records) - 1; idx >= 0; idx-- {
+		reader := NewDeltaReader(bytes.NewReader(data[offsets[idx]:]))
+		read := make(Tokens, len(records[idx]))
+		n, err := reader.Read(read)
+		assert.Nil(t, err)
+		assert.Equal(t, records[idx], read[:n])
+	}
+	// Records are read in sequence by resetting between them.
+	reader := NewDeltaReader(bytes.NewReader(data))
+	for _, record := range records {
+		reader.Reset()
+		read := make(Tokens, len(record))
+		n, err := reader.Read(read)
+		assert.Nil(t, err)
+		assert.Equal(t, record, read[:n])
+	}
+	chunk := make(Tokens, 8)
+	n, err := reader.Read(chunk)
+	assert.Equal(t, 0, n)
+	assert.ErrorIs(t, err, io.EOF)
+
+	_, err = NewDeltaReader(bytes.NewReader([]byte{0x80})).Read(chunk)
+	assert.ErrorIs(t, err, ErrTokensInvalid)
+}
+
+func TestTokenStreamWriter(t *testing.T) {
+	streamPath := t.TempDir() + "/stream.tokens"
+	writer, err := OpenTokenStream(streamPath, TokenStreamOptions{
+		SyncDocuments: 2})
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.Nil(t, writer.WriteDocument(Tokens{1, 2, 3}))
+	assert.Nil(t, writer.WriteDocument(Tokens{4, 5}))
+	// The third document is ended but not synced, and the fourth is cut off
+	// by a crash, so that neither is durable.
+	assert.Nil(t, writer.WriteDocument(Tokens{6}))
+	assert.Nil(t, writer.Write(Tokens{7, 8}))
+	assert.Nil(t, writer.Flush())
+	assert.Equal(t, int64(16), writer.Offset())
+	assert.Equal(t, int64(12), writer.Committed())
+
+	committed, err := RecoverTokenStream(streamPath)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(10), committed)
+	tokens, err := ReadTokensFile(streamPath)
+	assert.Nil(t, err)
+	assert.Equal(t, Tokens{1, 2, 3, 4, 5}, *tokens)
+
+	// Reopening appends after the last durable document, and closing
+	// discards a document that was not ended.
+	writer, err = OpenTokenStream(streamPath, TokenStreamOptions{
+		Dtype: DTYPE_UINT16})
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.Nil(t, writer.WriteDocument(Tokens{9}))
+	assert.Nil(t, writer.Write(Tokens{10}))
+	assert.Nil(t, writer.Close())
+	assert.ErrorIs(t, writer.Write(Tokens{11}), os.ErrClosed)
+	tokens, err = ReadTokensFile(streamPath)
+	assert.Nil(t, err)
+	assert.Equal(t, Tokens{1, 2, 3, 4, 5, 9}, *tokens)
+
+	_, err = OpenTokenStream(streamPath, TokenStreamOptions{
+		Dtype: DTYPE_DELTA_VARINT})
+	assert.ErrorIs(t, err, ErrTokensInvalid)
+}
+
+func TestUnicodeTables(t *testing.T) {
+	// The pre-tokenizers classify runes by the bundled tables, which agree
+	// with the Go runtime's when they are of the same version of Unicode.
+	assert.True(t, isLetter('é'))
+	assert.True(t, isNumber('٣'))
+	assert.True(t, isSpace('\u3000'))
+	assert.True(t, isOther('…'))
+	if unicode.Version != UNICODE_TABLES_VERSION {
+		t.Skipf("the bundled tables are of Unicode %s, not %s",
+			UNICODE_TABLES_VERSION, unicode.Version)
+	}
+	for r := rune(0); r <= unicode.MaxRune; r++ {
+		if isLetter(r) != unicode.IsLetter(r) ||
+			isNumber(r) != unicode.IsNumber(r) ||
+			isSpace(r) != unicode.IsSpace(r) {
+			t.Fatalf("the bundled tables differ from unicode's at %U", r)
+		}
+	}
+}
+
+func TestGPTEncoder_RankOfPair(t *testing.T) {
+	space, ok := gpt2Encoder.encoder["Ġ"]
+	assert.True(t, ok)
+	letterT := gpt2Encoder.encoder["t"]
+	rank, ok := gpt2Encoder.RankOfPair(space, letterT)
+	assert.True(t, ok)
+	assert.Equal(t, 0, rank)
+	rank, ok = gpt2Encoder.RankOfPair(gpt2Encoder.encoder["h"],
+		gpt2Encoder.encoder["e"])
+	assert.True(t, ok)
+	assert.Equal(t, 2, rank)
+	_, ok = gpt2Encoder.RankOfPair(letterT, space)
+	assert.False(t, ok)
+
+	// Tokens are ranked by the merge that produces them, and the tokens of
+	// single bytes and special tokens by none.
+	assert.Equal(t, 0, gpt2Encoder.RankOfToken(gpt2Encoder.encoder["Ġt"]))
+	assert.Equal(t, -1, gpt2Encoder.RankOfToken(letterT))
+	assert.Equal(t, -1, gpt2Encoder.RankOfToken(gpt2Encoder.EosToken))
+	the := *gpt2Encoder.Get("Ġthe")
+	assert.Greater(t, gpt2Encoder.RankOfToken(the), 0)
+}
+
+func TestGPTEncoder_ExplainMerges(t *testing.T) {
+	text := "Hello world, it's <|endoftext|> unbelievable"
+	graphs, err := gpt2Encoder.ExplainMerges(text)
+	if !assert.Nil(t, err) {
+		return
+	}
+	// The roots of the words are the tokens that they encode to.
+	roots := make(Tokens, 0)
+	for _, graph := range graphs {
+		for _, root := range graph.Roots {
+			roots = append(roots, Token(graph.Nodes[root].Token))
+		}
+		for _, step := range graph.Steps {
+			assert.Equal(t, step.MergeCandidate, step.Candidates[0])
+		}
+	}
+	assert.Equal(t, *gpt2Encoder.Encode(&text), roots)
+
+	hello := graphs[0]
+	assert.Equal(t, "Hello", hello.Word)
+	assert.Equal(t, "H", hello.Nodes[0].Piece)
+	assert.Equal(t, -1, hello.Nodes[0].Rank)
+	root := hello.Nodes[hello.Roots[0]]
+	assert.Equal(t, "Hello", root.Piece)
+	assert.Equal(t, gpt2Encoder.RankOfToken(Token(root.Token)), root.Rank)
+	assert.Equal(t, "H", hello.Nodes[root.Left].Piece)
+	assert.Equal(t, "ello", hello.Nodes[root.Right].Piece)
+
+	vocab, err := gpt2Encoder.VocabMergeGraph()
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.Empty(t, vocab.Invalid)
+	for _, node := range vocab.Nodes {
+		if node.Rank >= 0 {
+			assert.Equal(t, gpt2Encoder.RankOfToken(Token(node.Token)),
+				node.Rank, node.Piece)
+			assert.Equal(t, node.Piece, vocab.Nodes[node.Left].Piece+
+				vocab.Nodes[node.Right].Piece)
+		}
+	}
+	var dot strings.Builder
+	assert.Nil(t, WriteMergeGraphsDOT(&dot, graphs[:1]))
+	assert.Contains(t, dot.String(), "digraph merges {")
+	assert.Contains(t, dot.String(), "subgraph cluster_0 {\n\t\tlabel=\"Hello\";")
+	assert.Contains(t, dot.String(), "[label=\"Hello\\nrank ")
+
+	greedy, _ := NewEncoder("gpt2-tokenizer")
+	assert.Nil(t, greedy.SetMergeMode(MergeGreedy))
+	_, err = greedy.ExplainMerges(text)
+	assert.NotNil(t, err)
+}
+
+func TestGPTEncoder_ScanSpecials(t *testing.T) {
+	text := "a <|endoftext|> b ＜|endoftext|＞ c"
+	matches := gpt2Encoder.ScanSpecials(text)
+	if assert.Len(t, matches, 2) {
+		assert.Equal(t, SpecialMatch{2, 15, "<|endoftext|>", SpecialExact},
+			matches[0])
+		assert.Equal(t, SpecialNormalized, matches[1].Kind)
+		assert.Equal(t, "＜|endoftext|＞",
+			text[matches[1].Start:matches[1].End])
+	}
+	assert.Empty(t, gpt2Encoder.ScanSpecials("a <|endof text|> b"))
+
+	neutralized := gpt2Encoder.NeutralizeSpecials(text)
+	assert.Empty(t, gpt2Encoder.ScanSpecials(neutralized))
+	assert.NotContains(t, *gpt2Encoder.Encode(&neutralized),
+		gpt2Encoder.EosToken)
+	assert.Equal(t, "plain", gpt2Encoder.NeutralizeSpecials("plain"))
+
+	// A newline that the encoder replaces with a special token.
+	encoder := NewGPT2Encoder()
+	if _, err := encoder.ReserveSpecials(1); err != nil {
+		t.Fatal(err)
+	}
+	assert.Nil(t, encoder.RenameSpecial("<|reserved_special_0|>", "</s>"))
+	encoder.replacements["\n"] = "</s>"
+	matches = encoder.ScanSpecials("one\ntwo")
+	assert.Equal(t, []SpecialMatch{{3, 4, "</s>", SpecialNormalized}},
+		matches)
+	assert.Equal(t, "one\uFFFDtwo", encoder.NeutralizeSpecials("one\ntwo"))
+}
+
+func TestGPTEncoder_WriteVocabTable(t *testing.T) {
+	assert.Equal(t, []byte(" the"), gpt2Encoder.TokenBytes(262))
+	assert.Nil(t, gpt2Encoder.TokenBytes(65000))
+
+	var table strings.Builder
+	assert.Nil(t, gpt2Encoder.WriteVocabTable(&table))
+	rows := strings.Split(strings.TrimSuffix(table.String(), "\n"), "\n")
+	assert.Equal(t, VOCAB_TABLE_HEADER, rows[0]+"\n")
+	assert.Len(t, rows, len(gpt2Encoder.decoder)+1)
+	assert.Equal(t, "0\t21\t!\t0", rows[1])
+	assert.Equal(t, "198\t0a\tĊ\t0", rows[199])
+	assert.Equal(t, "262\t20746865\tĠthe\t0", rows[263])
+	assert.Equal(t, "50256\t"+hex.EncodeToString([]byte("<|endoftext|>"))+
+		"\t<|endoftext|>\t1", rows[50257])
+}
+
+func TestGPTEncoder_BosEosPolicy(t *testing.T) {
+	text := "hello world"
+	plain := *gpt2Encoder.Encode(&text)
+	bos, eos := gpt2Encoder.BosToken, gpt2Encoder.EosToken
+	policy, _ := gpt2Encoder.BosEosPolicy()
+	assert.Equal(t, AddNever, policy)
+	policy, _ = clipEncoder.BosEosPolicy()
+	assert.Equal(t, AddAlways, policy)
+
+	withEos := "hello world<|endoftext|>"
+	tests := []struct {
+		bos, eos AddPolicy
+		text     string
+		expected Tokens
+	}{
+		{AddDefault, AddDefault, text, plain},
+		{AddAlways, AddNever, text, append(Tokens{bos}, plain...)},
+		{AddNever, AddAlways, text, append(append(Tokens{}, plain...), eos)},
+		{AddNever, AddIfMissing, text, append(append(Tokens{}, plain...),
+			eos)},
+		{AddNever, AddIfMissing, withEos, append(append(Tokens{}, plain...),
+			eos)},
+		{AddNever, AddAlways, withEos, append(append(Tokens{}, plain...),
+			eos, eos)},
+		{AddIfMissing, AddNever, "", Tokens{bos}},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.expected, *gpt2Encoder.EncodeWithPolicy(
+			&test.text, test.bos, test.eos),
+			fmt.Sprintf("%s %s %q", test.bos, test.eos, test.text))
+	}
+
+	encoder, err := NewEncoderWithOptions("gpt2-tokenizer",
+		WithBosEosPolicy(AddNever, AddIfMissing))
+	assert.Nil(t, err)
+	expected := append(append(Tokens{}, plain...), eos)
+	assert.Equal(t, expected, *encoder.Encode(&text))
+	assert.Equal(t, expected, *encoder.Encode(&withEos))
+	assert.Equal(t, expected, encoder.EncodeInto(NewTokenBuffer(0), &text))
+	assert.Equal(t, plain, *encoder.EncodeWithPolicy(&text, AddDefault,
+		AddNever))
+	assert.NotEqual(t, gpt2Encoder.Fingerprint(), encoder.Fingerprint())
+	assert.Equal(t, PairTemplate{End: Tokens{eos}, PairEnd: Tokens{eos}},
+		encoder.PairTemplate())
+
+	// Setting the tokenizer's own policy keeps its fingerprint.
+	clip := NewCLIPEncoder()
+	assert.Nil(t, clip.SetBosEosPolicy(AddAlways, AddAlways))
+	assert.Equal(t, clipEncoder.Fingerprint(), clip.Fingerprint())
+	assert.Nil(t, clip.SetBosEosPolicy(AddNever, AddNever))
+	clipText := "hello"
+	assert.Equal(t, (*clipEncoder.Encode(&clipText))[1:2],
+		*clip.Encode(&clipText))
+	assert.NotNil(t, clip.SetBosEosPolicy(AddPolicy(9), AddNever))
+
+	for _, name := range []string{"default", "never", "always", "if-missing"} {
+		policy, err := ParseAddPolicy(name)
+		assert.Nil(t, err)
+		assert.Equal(t, name, policy.String())
+	}
+	_, err = ParseAddPolicy("sometimes")
+	assert.NotNil(t, err)
+}
+
+func TestGPTEncoder_WarmCache(t *testing.T) {
+	encoder, err := NewEncoderWithOptions("gpt2-tokenizer",
+		WithCacheSize(3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sample := "the cat and the dog and the bird<|endoftext|> fish"
+	assert.Equal(t, 3, encoder.WarmCache(strings.NewReader(sample)))
+	assert.Equal(t, 3, encoder.cache.Len())
+	assert.Equal(t, int64(0), encoder.LruHits)
+	assert.Equal(t, int64(0), encoder.LruMisses)
+
+	// The most frequent words are " the", " and", and then " bird" of the
+	// words that occur once, in order.
+	text := " the and bird"
+	assert.Equal(t, *gpt2Encoder.Encode(&text), *encoder.Encode(&text))
+	assert.Equal(t, int64(3), encoder.LruHits)
+	assert.Equal(t, int64(0), encoder.LruMisses)
+}
+
+func TestGPTEncoder_Hooks(t *testing.T) {
+	words := make([]string, 0)
+	misses := make([]string, 0)
+	merges := make(map[string]int)
+	encoder, err := NewEncoderWithOptions("gpt2-tokenizer",
+		WithHooks(&Hooks{
+			OnPretokenize: func(word string) {
+				words = append(words, word)
+			},
+			OnCacheMiss: func(word string) {
+				misses = append(misses, word)
+			},
+			OnMergeApplied: func(word string, count int) {
+				merges[word] += count
+			},
+		}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	text := "hello hello world<|endoftext|>"
+	tokens := encoder.Encode(&text)
+	assert.Equal(t, *gpt2Encoder.Encode(&text), *tokens)
+	assert.Equal(t, []string{"hello", " hello", " world", "<|endoftext|>"},
+		words)
+	// Words are passed to the cache and merge hooks in the printable form of
+	// the vocabulary, and the repeated word is a cache hit.
+	assert.Equal(t, []string{"hello", "Ġhello", "Ġworld"}, misses)
+	assert.Equal(t, map[string]int{"hello": 4, "Ġhello": 5, "Ġworld": 5},
+		merges)
+
+	// Warming the cache does not call the hooks, and hooks are removed.
+	encoder.WarmCache(strings.NewReader(" the cat"))
+	assert.Len(t, words, 4)
+	encoder.SetHooks(nil)
+	assert.Nil(t, encoder.Hooks())
+	text = " the cat sat"
+	encoder.Encode(&text)
+	assert.Len(t, misses, 3)
+}
+
+func TestGPTEncoder_EncodeLimited(t *testing.T) {
+	encoder, err := NewEncoderWithOptions("gpt2-tokenizer",
+		WithMaxInputBytes(64), WithMaxOutputTokens(8))
+	if err != nil {
+		t.Fatal(err)
+	}
+	text := "The quick brown fox."
+	tokens, err := encoder.EncodeLimited(&text)
+	assert.Nil(t, err)
+	assert.Equal(t, *gpt2Encoder.Encode(&text), *tokens)
+
+	// Text that is too long is rejected before it is encoded, or as it is
+	// read.
+	long := strings.Repeat("a", 65)
+	_, err = encoder.EncodeLimited(&long)
+	assert.ErrorIs(t, err, ErrInputTooLarge)
+	var limitErr *LimitError
+	if assert.True(t, errors.As(err, &limitErr)) {
+		assert.Equal(t, 64, limitErr.Limit)
+		assert.Equal(t, 65, limitErr.Size)
+	}
+	encoder.MaxOutputTokens = 0
+	_, err = encoder.EncodeReaderLimited(strings.NewReader(long))
+	assert.ErrorIs(t, err, ErrInputTooLarge)
+	encoder.MaxOutputTokens = 8
+
+	// Text that encodes to too many tokens is rejected as soon as it does.
+	many := "one two three four five six seven eight nine ten"
+	_, err = encoder.EncodeLimited(&many)
+	assert.ErrorIs(t, err, ErrOutputTooLarge)
+	if assert.True(t, errors.As(err, &limitErr)) {
+		assert.Equal(t, 8, limitErr.Limit)
+		assert.Equal(t, 9, limitErr.Size)
+	}
+	assert.Contains(t, err.Error(), "9 tokens exceeds the limit of 8")
+
+	// A single long word is merged in pieces, and rejected after the first
+	// piece that exceeds the limit, rather than after merging it whole.
+	random := rand.New(rand.NewSource(0))
+	word := make([]byte, 64*MAXWORD_SZ)
+	for idx := range word {
+		word[idx] = byte('a' + random.Intn(26))
+	}
+	longWord := string(word)
+	encoder.MaxInputBytes = 0
+	start := time.Now()
+	_, err = encoder.EncodeLimited(&longWord)
+	assert.ErrorIs(t, err, ErrOutputTooLarge)
+	assert.Less(t, time.Since(start), time.Second)
+	if assert.True(t, errors.As(err, &limitErr)) {
+		assert.LessOrEqual(t, limitErr.Size, 8+MAXWORD_SZ)
+	}
+	encoder.MaxOutputTokens = 0
+	longWord = longWord[:3*MAXWORD_SZ]
+	tokens, err = encoder.EncodeLimited(&longWord)
+	assert.Nil(t, err)
+	capped := NewGPT2Encoder()
+	capped.MaxWordLength = MAXWORD_SZ
+	assert.Equal(t, *capped.Encode(&longWord), *tokens)
+	encoder.MaxInputBytes, encoder.MaxOutputTokens = 64, 8
+
+	// Without limits, any text is encoded.
+	unlimited, err := NewEncoderWithOptions("gpt2-tokenizer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tokens, err = unlimited.EncodeLimited(&many)
+	assert.Nil(t, err)
+	assert.Len(t, *tokens, 10)
+	_, err = NewEncoderWithOptions("gpt2-tokenizer", WithMaxInputBytes(-1))
+	assert.NotNil(t, err)
+	_, err = NewEncoderWithOptions("gpt2-tokenizer", WithMaxOutputTokens(-1))
+	assert.NotNil(t, err)
+}
+
+func TestGPTEncoder_StreamingEncodeReader(t *testing.T) {
+	text := strings.Repeat("The quick brown 🦊 jumps over<|endoftext|>"+
+		" the lazy 🐕.\n\n", 64)
+	for _, encoder := range []*GPTEncoder{&gpt2Encoder, &clipEncoder} {
+		// Reading a byte at a time splits every character and word
+		// across reads.
+		nextTokens := encoder.StreamingEncodeReader(
+			iotest.OneByteReader(strings.NewReader(text)))
+		streamed := make(Tokens, 0)
+		for tokens := nextTokens(7); tokens != nil; tokens = nextTokens(7) {
+			streamed = append(streamed, *tokens...)
+		}
+		assert.Equal(t, *encoder.Encode(&text), streamed)
+	}
+}
+
+func TestGPTEncoder_EncodeBatch(t *testing.T) {
+	texts := make([]string, 100)
+	for idx := range texts {
+		texts[idx] = fmt.Sprintf("Text number %d of the batch.", idx)
+	}
+	for _, workers := range []int{0, 1, 8, 1000} {
+		encoded := gpt2Encoder.EncodeBatch(texts, workers)
+		assert.Equal(t, len(texts), len(encoded))
+		for idx := range texts {
+			assert.Equal(t, *gpt2Encoder.Encode(&texts[idx]), encoded[idx])
+		}
+	}
+	assert.Equal(t, 0, len(gpt2Encoder.EncodeBatch(nil, 4)))
+
+	// Every word of the batch is counted as a hit or a miss of the cache.
+	encoder := NewGPT2Encoder()
+	words := 0
+	for idx := range texts {
+		words += len(*encoder.SplitWords(&texts[idx]))
+	}
+	encoder.EncodeBatch(texts, 8)
+	assert.Equal(t, int64(words), encoder.LruHits+encoder.LruMisses)
+}
+
+func TestStreamDecoder(t *testing.T) {
+	text := "Hello 🐹 and 🦊!"
+	decoder := gpt2Encoder.NewStreamDecoder()
+	var decoded []byte
+	for _, token := range *gpt2Encoder.Encode(&text) {
+		chunk := decoder.Feed(token)
+		assert.True(t, utf8.Valid(chunk))
+		decoded = append(decoded, chunk...)
+	}
+	assert.False(t, decoder.Pending())
+	assert.Equal(t, text, string(decoded))
+
+	// The hamster is split over three tokens, and held until the last.
+	hamster := " 🐹"
+	tokens := *gpt2Encoder.Encode(&hamster)
+	assert.Equal(t, 3, len(tokens))
+	assert.Equal(t, []byte(" "), decoder.Feed(tokens[0]))
+	assert.True(t, decoder.Pending())
+	assert.Equal(t, []byte{}, decoder.Feed(tokens[1]))
+	assert.Equal(t, []byte("🐹"[:3]), decoder.Flush())
+	assert.False(t, decoder.Pending())
+	assert.Equal(t, []byte("a"), decoder.Feed(gpt2Encoder.encoder["a"]))
+}
+
+func TestGPTEncoder_EncodeWithOffsets(t *testing.T) {
+	text := "Hello  World 🐹<|endoftext|>\nx"
+	tokens, spans := gpt2Encoder.EncodeWithOffsets(text)
+	assert.Equal(t, *gpt2Encoder.Encode(&text), tokens)
+	// The hamster is split into byte tokens, which have the spans of their
+	// bytes.
+	assert.Equal(t, []Span{{0, 5}, {5, 6}, {6, 12}, {12, 15}, {15, 16},
+		{16, 17}, {17, 30}, {30, 31}, {31, 32}}, spans)
+
+	// CLIP lower cases words, drops the spaces between them, and encloses
+	// the text in BOS and EOS tokens, which have empty spans.
+	tokens, spans = clipEncoder.EncodeWithOffsets(text)
+	assert.Equal(t, *clipEncoder.Encode(&text), tokens)
+	assert.Equal(t, []Span{{0, 0}, {0, 5}, {7, 12}, {13, 16}, {16, 17},
+		{17, 30}, {31, 32}, {32, 32}}, spans)
+}
+
+func TestGPTEncoder_MemoryFootprint(t *testing.T) {
+	encoder, err := NewEncoder("gpt2-tokenizer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	footprint := encoder.MemoryFootprint()
+	assert.Equal(t, 0, footprint.CacheBytes)
+	assert.Equal(t, footprint.VocabBytes+footprint.MergeBytes+
+		footprint.UnitrimBytes+footprint.SpecialsBytes, footprint.TotalBytes)
+	// Each of the 50257 tokens is in the vocabulary in both directions, with
+	// at least its bytes, and the 50000 merges each hold two strings.
+	assert.Greater(t, footprint.VocabBytes, 2*50257*(stringHeaderBytes+2))
+	assert.Greater(t, footprint.MergeBytes, 50000*2*stringHeaderBytes)
+	assert.Greater(t, footprint.UnitrimBytes, 50257)
+	assert.Greater(t, footprint.SpecialsBytes, len("<|endoftext|>"))
+
+	text := "the quick brown fox"
+	encoder.Encode(&text)
+	cached := encoder.MemoryFootprint()
+	assert.Greater(t, cached.CacheBytes, len(text))
+	assert.Equal(t, footprint.TotalBytes+cached.CacheBytes,
+		cached.TotalBytes)
+}
+
+func TestSharedEncoder(t *testing.T) {
+	encoder, err := SharedEncoder("gpt2-tokenizer")
+	assert.Nil(t, err)
+	assert.True(t, encoder == &GPT2Encoder)
+
+	files := make(map[string]string)
+	for _, name := range []string{"encoder.json", "vocab.bpe",
+		"specials.txt"} {
+		files[name] = string(*resources.GetEmbeddedResource(
+			"gpt2-tokenizer/" + name).Data)
+	}
+	dir := writeTokenizerDir(t, files)
+	encoders := make([]*GPTEncoder, 4)
+	var wg sync.WaitGroup
+	for idx := range encoders {
+		wg.Add(1)
+		go func(idx int) {
+			defer wg.Done()
+			encoders[idx], _ = SharedEncoder(dir)
+		}(idx)
+	}
+	wg.Wait()
+	assert.NotNil(t, encoders[0])
+	for _, shared := range encoders[1:] {
+		assert.True(t, shared == encoders[0])
+	}
+	assert.Equal(t, gpt2Encoder.Fingerprint(), encoders[0].Fingerprint())
+}
+
+func TestCachingResolver(t *testing.T) {
+	var buildsMtx sync.Mutex
+	builds := make(map[string]int)
+	resolver := NewCachingResolver(func(vocabId string) (*GPTEncoder,
+		error) {
+		buildsMtx.Lock()
+		builds[vocabId]++
+		buildsMtx.Unlock()
+		if vocabId == "alias" {
+			vocabId = "gpt2-tokenizer"
+		}
+		return NewEncoder(vocabId)
+	}, 0)
+
+	encoder, err := resolver.Resolve("gpt2-tokenizer")
+	assert.Nil(t, err)
+	cached, err := resolver.Resolve("gpt2-tokenizer")
+	assert.Nil(t, err)
+	assert.True(t, encoder == cached)
+	assert.Equal(t, 1, builds["gpt2-tokenizer"])
+
+	// Ids that resolve to identical tokenizers share an encoder.
+	alias, err := resolver.Resolve("alias")
+	assert.Nil(t, err)
+	assert.True(t, encoder == alias)
+	assert.Equal(t, 1, builds["alias"])
+
+	// Concurrent resolutions wait on the one build.
+	encoders := make([]*GPTEncoder, 4)
+	var wg sync.WaitGroup
+	for idx := range encoders {
+		wg.Add(1)
+		go func(idx int) {
+			defer wg.Done()
+			encoders[idx], _ = resolver.Resolve("pile-tokenizer")
+		}(idx)
+	}
+	wg.Wait()
+	assert.NotNil(t, encoders[0])
+	for _, shared := range encoders[1:] {
+		assert.True(t, shared == encoders[0])
+	}
+	assert.Equal(t, 1, builds["pile-tokenizer"])
+
+	// Failed builds are retried.
+	missing := t.TempDir() + "/missing"
+	_, err = resolver.Resolve(missing)
+	assert.NotNil(t, err)
+	_, err = resolver.Resolve(missing)
+	assert.NotNil(t, err)
+	assert.Equal(t, 2, builds[missing])
+
+	// Encoders are built anew once their TTL has passed, or once purged.
+	resolver.TTL = time.Hour
+	_, err = resolver.Resolve("gpt2-tokenizer")
+	assert.Nil(t, err)
+	assert.Equal(t, 1, builds["gpt2-tokenizer"])
+	resolver.TTL = time.Millisecond
+	time.Sleep(2 * time.Millisecond)
+	_, err = resolver.Resolve("gpt2-tokenizer")
+	assert.Nil(t, err)
+	assert.Equal(t, 2, builds["gpt2-tokenizer"])
+	resolver.TTL = 0
+	resolver.Purge()
+	assert.Empty(t, resolver.encoders)
+	_, err = resolver.Resolve("pile-tokenizer")
+	assert.Nil(t, err)
+	assert.Equal(t, 2, builds["pile-tokenizer"])
+}
+
+func TestAnalyzeCompression(t *testing.T) {
+	stats, err := AnalyzeCompression(NewMockEncoder(),
+		strings.NewReader("a a a a"))
+	assert.Nil(t, err)
+	assert.Equal(t, 7, stats.Bytes)
+	assert.Equal(t, 4, stats.Tokens)
+	assert.Equal(t, 2, stats.Distinct)
+	assert.InDelta(t, 0.8113, stats.EntropyBits, 0.0001)
+	assert.InDelta(t, 0.8113*4/7, stats.BitsPerByte, 0.0001)
+
+	stats, err = AnalyzeCompression(&gpt2Encoder, strings.NewReader(corpus))
+	assert.Nil(t, err)
+	assert.Equal(t, len(corpus), stats.Bytes)
+	assert.Equal(t, len(*gpt2Encoder.Encode(&corpus)), stats.Tokens)
+	assert.Greater(t, stats.BitsPerByte, 0.0)
+	assert.Less(t, stats.BitsPerByte, stats.RankBitsPerByte)
+	assert.Less(t, stats.RankBitsPerByte, 8.0)
+
+	stats, err = AnalyzeCompression(&gpt2Encoder, strings.NewReader(""))
+	assert.Nil(t, err)
+	assert.Equal(t, CompressionStats{}, *stats)
+}
+
+func TestGPTEncoder_SpecialCollisions(t *testing.T) {
+	assert.Empty(t, gpt2Encoder.SpecialCollisions())
+	_, err := NewEncoderWithOptions("gpt2-tokenizer",
+		WithCollisionPolicy(CollisionFail))
+	assert.Nil(t, err)
+
+	encoder := NewGPT2Encoder()
+	encoder.specials["<|unknown|>"] = Tokens{0}
+	// A special token for " the", which is the ordinary token "Ġthe".
+	encoder.encoder[" the"] = 60000
+	encoder.decoder[60000] = []byte(" the")
+	encoder.specials[" the"] = Tokens{60000}
+	encoder.specialsTree = encoder.createRuneTree()
+	collisions := encoder.SpecialCollisions()
+	if assert.Len(t, collisions, 3) {
+		assert.Equal(t, SpecialCollision{" the", CollisionDuplicate,
+			[]string{"Ġthe"}}, collisions[0])
+		assert.Equal(t, CollisionPrefix, collisions[1].Kind)
+		assert.Contains(t, collisions[1].Tokens, "Ġtheir")
+		assert.Equal(t, SpecialCollision{"<|unknown|>", CollisionUnknown,
+			nil}, collisions[2])
+	}
+	text := "in the end"
+	assert.Contains(t, *encoder.Encode(&text), Token(60000))
+
+	assert.ErrorIs(t, encoder.ResolveCollisions(CollisionFail),
+		ErrSpecialCollision)
+	assert.Nil(t, encoder.ResolveCollisions(CollisionPreferVocab))
+	assert.Empty(t, encoder.SpecialCollisions())
+	assert.Equal(t, *gpt2Encoder.Encode(&text), *encoder.Encode(&text))
+}
+
+func TestTokenBuffer(t *testing.T) {
+	buffer := NewTokenBuffer(4)
+	first := buffer.Append(Tokens{1, 2, 3})
+	// The second view doesn't fit in the first block, nor in a block of
+	// blockSize tokens.
+	buffer.Append(Tokens{4, 5, 6, 7, 8})
+	third := buffer.Append(Tokens{})
+	assert.Equal(t, 3, buffer.Len())
+	assert.Equal(t, 8, buffer.Size())
+	assert.Equal(t, []Tokens{{1, 2, 3}, {4, 5, 6, 7, 8}, {}}, buffer.Views())
+	assert.Equal(t, Tokens{4, 5, 6, 7, 8}, buffer.View(1))
+	assert.Empty(t, third)
+
+	// Appending to a view doesn't overwrite the views after it.
+	grown := append(first, 9)
+	assert.Equal(t, Tokens{1, 2, 3, 9}, grown)
+	assert.Equal(t, Tokens{1, 2, 3}, buffer.View(0))
+	assert.Equal(t, Tokens{1, 2, 3, 4, 5, 6, 7, 8}, *buffer.Flatten())
+
+	copied := buffer.Copy(1)
+	buffer.Reset()
+	assert.Equal(t, 0, buffer.Len())
+	buffer.Append(Tokens{10, 11, 12, 13, 14})
+	assert.Equal(t, Tokens{4, 5, 6, 7, 8}, *copied)
+}
+
+func TestGPTEncoder_EncodeInto(t *testing.T) {
+	texts := strings.SplitAfter(corpus, "\n")[:64]
+	for _, encoder := range []*GPTEncoder{&gpt2Encoder, &clipEncoder} {
+		buffer := NewTokenBuffer(256)
+		for idx := range texts {
+			encoder.EncodeInto(buffer, &texts[idx])
+		}
+		assert.Equal(t, len(texts), buffer.Len())
+		for idx := range texts {
+			assert.Equal(t, *encoder.Encode(&texts[idx]), buffer.View(idx))
+		}
+	}
+}
+
+func BenchmarkGPTEncoder_EncodeInto(b *testing.B) {
+	texts := strings.SplitAfter(corpus, "\n")
+	buffer := NewTokenBuffer(0)
+	b.ReportAllocs()
+	b.SetBytes(int64(len(corpus)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		buffer.Reset()
+		for idx := range texts {
+			gpt2Encoder.EncodeInto(buffer, &texts[idx])
+		}
+	}
+}
+
+func BenchmarkGPTEncoder_EncodeTexts(b *testing.B) {
+	texts := strings.SplitAfter(corpus, "\n")
+	b.ReportAllocs()
+	b.SetBytes(int64(len(corpus)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for idx := range texts {
+			gpt2Encoder.Encode(&texts[idx])
+		}
+	}
+}
+
 func BenchmarkGPTEncoder_WordSplitterChan(b *testing.B) {
 	b.StopTimer()
 	corpusHandle, err := os.Open(largeCorpusPath)
@@ -398,15 +1626,38 @@ func BenchmarkGPTEncoder_Encode(b *testing.B) {
 		len(corpus), tokenCt, duration))
 }
 
+func TestGPTEncoder_EncodeBuffer(t *testing.T) {
+	text := corpus[:4096]
+	textBytes := []byte(text)
+	encoded, err := gpt2Encoder.EncodeBuffer(&textBytes)
+	assert.Nil(t, err)
+	bin, err := gpt2Encoder.Encode(&text).ToBin()
+	assert.Nil(t, err)
+	assert.Equal(t, *bin, *encoded)
+	assert.Equal(t, text, gpt2Encoder.DecodeBuffer(encoded))
+}
+
 func BenchmarkGPTEncoder_EncodeBuffer(b *testing.B) {
 	corpusBytes := []byte(corpus)
 	start := time.Now()
-	tokenCt := len(*gpt2Encoder.EncodeBuffer(&corpusBytes)) / 2
+	encoded, _ := gpt2Encoder.EncodeBuffer(&corpusBytes)
+	tokenCt := len(*encoded) / 2
 	duration := time.Since(start)
 	b.Log(fmt.Sprintf("%v bytes into %v tokens over %v",
 		len(corpus), tokenCt, duration))
 }
 
+func BenchmarkGPTEncoder_EncodeSpecials(b *testing.B) {
+	prompt := strings.Repeat("<|endoftext|>Hello world.<|endoftext|>"+
+		"<|endoftext|>\n", 4096)
+	b.ReportAllocs()
+	b.SetBytes(int64(len(prompt)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		gpt2Encoder.Encode(&prompt)
+	}
+}
+
 func TestGPTEncoder_Encode(t *testing.T) {
 	start := time.Now()
 	tokenCt := len(*gpt2Encoder.Encode(&corpus))
@@ -464,6 +1715,32 @@ func TestPileEncoder_Encode(t *testing.T) {
 	}
 }
 
+func TestPileEncoder_MergeSpaces(t *testing.T) {
+	// GPT-NeoX's merges have no version header, and begin with "Ġ Ġ".
+	for text, expected := range map[string]Tokens{
+		"  ":            {245},
+		"   ":           {341},
+		"    ":          {252},
+		"a\n    return": {66, 477, 1091},
+	} {
+		assert.Equal(t, expected, *pileEncoder.Encode(&text), "%q", text)
+	}
+
+	// Only a first line that is a version header is skipped.
+	for _, merges := range []string{"#version: 0.2\na b\n", "a b\n"} {
+		encoder, err := NewEncoder(serveTokenizer(t, map[string]string{
+			"config.json":    `{"model_type": "gpt2"}`,
+			"tokenizer.json": `{}`,
+			"vocab.json":     `{"a": 0, "b": 1, "ab": 2}`,
+			"merges.txt":     merges,
+		}))
+		if assert.Nil(t, err, merges) {
+			text := "ab"
+			assert.Equal(t, Tokens{2}, *encoder.Encode(&text), merges)
+		}
+	}
+}
+
 func TestGPTEncoder_Decode2(t *testing.T) {
 	gpt2EncodedCorpus := "NrGIEOQBRzFfAQEBCAE5GeADPCFGAQhdBgFhBkcHXwEBATM5HgGilUYBpAdDEaUheR8iAQEBmgSnbyQpRgHIjaYBiSQYLfoHYwHogg0A0AHsGFUmpgEGAcd0qApjAzwa7hscAeHAYwEGAbYRB3UiAax0PQPjAgoXpgEGAZgE6G2gAWMExy5GAb5szQdGAXUBAR2gAVQBRgG8CdYBYbCgAe4QAxg/NA0AdyoiAZMGOXL8AWlmAQGgFXknNlIGAdADLiciAT4B6lk="
 	decodedCorpus := "frying whatever they touched with a sizzled smell that fills the air along with a shower of sparks that land harmlessly elsewhere and a few stray drops that drip from fingers burned black as charcoal.The shock waves from the blasts cause many nearby trees to topple as the earth shakes and trembles underfoot from the power unleashed by each blast that destroys anything that was struck by it that wasn't shielded by heavy metal plates."
@@ -872,3 +2149,1038 @@ func TestModelDownloadPythiaSharded(t *testing.T) {
 	fmt.Println("All Exists - Looks good.")
 
 }
+
+func TestGPTEncoder_Fingerprint(t *testing.T) {
+	reloaded, err := NewEncoder("gpt2-tokenizer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	gpt2Fingerprint := gpt2Encoder.Fingerprint()
+	assert.Len(t, gpt2Fingerprint, 64)
+	assert.Equal(t, gpt2Fingerprint, reloaded.Fingerprint())
+	assert.NotEqual(t, gpt2Fingerprint, pileEncoder.Fingerprint())
+	assert.NotEqual(t, gpt2Fingerprint, clipEncoder.Fingerprint())
+}
+
+func TestNewEmbeddedEncoders(t *testing.T) {
+	gpt2, pile, clip := newEmbeddedEncoders()
+	assert.Equal(t, gpt2Encoder.Fingerprint(), gpt2.Fingerprint())
+	assert.Equal(t, pileEncoder.Fingerprint(), pile.Fingerprint())
+	assert.Equal(t, clipEncoder.Fingerprint(), clip.Fingerprint())
+	assert.Equal(t, gpt2Encoder.unitrim, gpt2.unitrim)
+}
+
+func TestFuzzSeeds(t *testing.T) {
+	for _, seed := range FuzzSeeds {
+		data := []byte(seed)
+		assert.NotPanics(t, func() {
+			FuzzEncodeDecode(&gpt2Encoder, data)
+			FuzzEncodeDecode(&pileEncoder, data)
+			FuzzEncode(&clipEncoder, data)
+			FuzzDecode(&gpt2Encoder, data)
+			FuzzDecode(&clipEncoder, data)
+		}, fmt.Sprintf("%q", seed))
+	}
+
+	dir := t.TempDir()
+	if err := WriteFuzzCorpus(dir); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Len(t, entries, len(FuzzSeeds))
+}
+
+// serveTokenizer serves the given files as a remote tokenizer, which
+// answers 404 for any other file.
+func serveTokenizer(t *testing.T, files map[string]string) string {
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if body, ok := files[strings.TrimPrefix(r.URL.Path, "/")]; ok {
+				w.Write([]byte(body))
+			} else {
+				http.NotFound(w, r)
+			}
+		}))
+	t.Cleanup(server.Close)
+	return server.URL
+}
+
+func TestNewEncoder_Errors(t *testing.T) {
+	valid := map[string]string{
+		"config.json":    `{"model_type": "gpt2"}`,
+		"tokenizer.json": `{}`,
+		"vocab.json":     `{"a": 0, "b": 1, "ab": 2}`,
+		"merges.txt":     "#version: 0.2\na b\n",
+	}
+	withFile := func(name, body string) map[string]string {
+		files := make(map[string]string, len(valid))
+		for k, v := range valid {
+			files[k] = v
+		}
+		if body == "" {
+			delete(files, name)
+		} else {
+			files[name] = body
+		}
+		return files
+	}
+	tests := []struct {
+		files map[string]string
+		err   error
+	}{
+		{withFile("tokenizer.json", ""), ErrResourceMissing},
+		{withFile("config.json", "{"), ErrResourceInvalid},
+		{withFile("vocab.json", `["a"]`), ErrVocabInvalid},
+		{withFile("vocab.json", `{"a": 4294967296}`), ErrTokenOutOfRange},
+		{withFile("merges.txt", "#version: 0.2\na b\nab\n"),
+			ErrMergeInvalid},
+		{withFile(VOCAB_BYTES_FILE, `[{"id": 0, "bytes": [256]}]`),
+			ErrVocabInvalid},
+		{withFile(VOCAB_BYTES_FILE, `[{"id": 4294967296, "bytes": "YQ=="}]`),
+			ErrTokenOutOfRange},
+	}
+	for _, test := range tests {
+		_, err := NewEncoder(serveTokenizer(t, test.files))
+		assert.ErrorIs(t, err, test.err)
+	}
+
+	_, err := resources.FetchHTTP(serveTokenizer(t, valid), "missing", "")
+	assert.ErrorIs(t, err, ErrDownloadFailed)
+	var statusErr *resources.HTTPStatusError
+	if assert.True(t, errors.As(err, &statusErr)) {
+		assert.Equal(t, http.StatusNotFound, statusErr.StatusCode)
+	}
+}
+
+func TestVocabBytes(t *testing.T) {
+	files := map[string]string{
+		"config.json":    `{"model_type": "gpt2"}`,
+		"tokenizer.json": `{}`,
+		"merges.txt":     "#version: 0.2\na b\n",
+		VOCAB_BYTES_FILE: `[{"id": 0, "bytes": "YQ=="}, ` +
+			`{"id": 1, "bytes": [98]}, {"id": 2, "bytes": "YWI="}, ` +
+			`{"id": 3, "bytes": [255, 254]}]`,
+	}
+	encoder, err := NewEncoder(serveTokenizer(t, files))
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.Equal(t, Token(2), *encoder.Get("ab"))
+	assert.Equal(t, []byte{0xff, 0xfe}, encoder.decoder[3])
+	assert.Equal(t, Token(3), *encoder.Get(string([]byte{0xff, 0xfe})))
+
+	// The embedded vocabularies survive a round trip.
+	data, err := gpt2Encoder.MarshalVocabBytes()
+	assert.Nil(t, err)
+	encoderTokens, tokensEncoder, err := ParseVocabBytes(data)
+	assert.Nil(t, err)
+	assert.Equal(t, gpt2Encoder.encoder, encoderTokens)
+	assert.Equal(t, gpt2Encoder.decoder, tokensEncoder)
+}
+
+func TestGPTEncoder_DuplicatePolicy(t *testing.T) {
+	// "ab" has the ids 2 and 3, which are listed out of order.
+	dir := writeTokenizerDir(t, map[string]string{
+		"merges.txt": "#version: 0.2\na b\n",
+		VOCAB_BYTES_FILE: `[{"id": 0, "bytes": "YQ=="}, ` +
+			`{"id": 1, "bytes": "Yg=="}, {"id": 3, "bytes": "YWI="}, ` +
+			`{"id": 2, "bytes": "YWI="}]`,
+	})
+	loaded, err := NewEncoderFromDir(dir)
+	if !assert.Nil(t, err) {
+		return
+	}
+	encoder := loaded.(*GPTEncoder)
+	assert.Equal(t, map[string]Tokens{"ab": {2, 3}}, encoder.Duplicates())
+	text := "abab"
+	assert.Equal(t, Tokens{3, 3}, *encoder.Encode(&text))
+	assert.Equal(t, "abab", encoder.Decode(&Tokens{2, 3}))
+
+	fingerprint := encoder.Fingerprint()
+	assert.Nil(t, encoder.SetDuplicatePolicy(DuplicatesLowest))
+	assert.Equal(t, Tokens{2, 2}, *encoder.Encode(&text))
+	assert.NotEqual(t, fingerprint, encoder.Fingerprint())
+	assert.Nil(t, encoder.SetDuplicatePolicy(DuplicatesHighest))
+	assert.Equal(t, fingerprint, encoder.Fingerprint())
+	assert.NotNil(t, encoder.SetDuplicatePolicy(DuplicatePolicy(2)))
+	assert.Equal(t, 0, len(gpt2Encoder.Duplicates()))
+}
+
+// writeTokenizerDir writes files to a new directory, and returns its path.
+func writeTokenizerDir(t *testing.T, files map[string]string) string {
+	dir := t.TempDir()
+	for name, body := range files {
+		if err := os.WriteFile(dir+"/"+name, []byte(body),
+			0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestNewTiktokenEncoder(t *testing.T) {
+	// The ranks of r50k_base are the ids of GPT-2's vocabulary, without its
+	// special token.
+	var ranks strings.Builder
+	for token := Token(0); token < 50256; token++ {
+		ranks.WriteString(base64.StdEncoding.EncodeToString(
+			gpt2Encoder.TokenBytes(token)))
+		ranks.WriteString(fmt.Sprintf(" %d\n", token))
+	}
+	encoder, err := NewTiktokenEncoder(TiktokenEncodings["r50k_base"],
+		strings.NewReader(ranks.String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	corpus, err := os.ReadFile("resources/frankenstein.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	text := string(corpus[:65536]) + "<|endoftext|> 🐹 ​ x"
+	assert.Equal(t, *gpt2Encoder.Encode(&text), *encoder.Encode(&text))
+	assert.Equal(t, text, encoder.Decode(encoder.Encode(&text)))
+	assert.Equal(t, Token(50256), encoder.EosToken)
+
+	_, err = NewTiktokenEncoder(TiktokenEncodings["r50k_base"],
+		strings.NewReader("YQ== 0\nYQ== 0\n"))
+	assert.ErrorIs(t, err, ErrResourceInvalid)
+
+	// The ids of cl100k_base and o200k_base do not fit in 16 bits.
+	// "dizz" is the 4-letter word of rank 18508+3*26*26*26+8*26*26+25*26+25.
+	text = "<|endofprompt|> dizz"
+	for _, name := range []string{"cl100k_base", "o200k_base"} {
+		encoding := TiktokenEncodings[name]
+		encoder, err = NewTiktokenEncoder(encoding, strings.NewReader(
+			syntheticTiktokenRanks(encoding.Specials["<|endoftext|>"])))
+		if !assert.Nil(t, err, name) {
+			continue
+		}
+		assert.Equal(t, Tokens{Token(encoding.Specials["<|endofprompt|>"]),
+			' ', 77319}, *encoder.Encode(&text), name)
+		assert.Equal(t, text, encoder.Decode(encoder.Encode(&text)), name)
+	}
+
+	// LLaMA 3's 128000 ranks are followed by 256 special tokens.
+	llama3 := TiktokenEncodings["llama3-tokenizer"]
+	assert.Equal(t, 256, len(llama3.Specials))
+	assert.Equal(t, 128009, llama3.Specials["<|eot_id|>"])
+	assert.Equal(t, 128255,
+		llama3.Specials["<|reserved_special_token_250|>"])
+	encoder, err = NewTiktokenEncoder(llama3,
+		strings.NewReader(syntheticTiktokenRanks(128000)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	text = "<|begin_of_text|> fizz<|reserved_special_token_250|><|eot_id|>"
+	assert.Equal(t, Tokens{128000, ' ', 112471, 128255, 128009},
+		*encoder.Encode(&text))
+	assert.Equal(t, text, encoder.Decode(encoder.Encode(&text)))
+	assert.Equal(t, Token(128000), encoder.BosToken)
+	assert.Equal(t, Token(128001), encoder.EosToken)
+
+	// Its ids do not fit in the two bytes a token of ToBin and EncodeBuffer.
+	textBytes := []byte(text)
+	_, err = encoder.EncodeBuffer(&textBytes)
+	assert.ErrorIs(t, err, ErrTokenOutOfRange)
+	_, err = encoder.Encode(&text).ToBin()
+	assert.ErrorIs(t, err, ErrTokenOutOfRange)
+}
+
+// TiktokenTests holds the tokens that tiktoken encodes texts to, which
+// differ between the encodings in how they split words by case and
+// contraction, and merge runs of spaces.
+var TiktokenTests = []struct {
+	Encoding string
+	Input    string
+	Expected Tokens
+}{
+	{"cl100k_base", "'RE", Tokens{95253}},
+	{"cl100k_base", "hello world", Tokens{15339, 1917}},
+	{"cl100k_base", "hello  world", Tokens{15339, 220, 1917}},
+	{"cl100k_base", "hello   world", Tokens{15339, 256, 1917}},
+	{"cl100k_base", "supercalifragilistic",
+		Tokens{13066, 3035, 278, 333, 4193, 321, 4633}},
+	{"cl100k_base", "We know what we are, but know not what we may be.",
+		Tokens{1687, 1440, 1148, 584, 527, 11, 719, 1440, 539, 1148, 584, 1253,
+			387, 13}},
+	{"o200k_base", "'RE", Tokens{6, 1099}},
+	{"o200k_base", "hello world", Tokens{24912, 2375}},
+	{"o200k_base", "hello  world", Tokens{24912, 220, 2375}},
+	{"o200k_base", "hello   world", Tokens{24912, 256, 2375}},
+	{"o200k_base", "supercalifragilistic",
+		Tokens{17789, 5842, 366, 17764, 311, 6207}},
+	{"o200k_base", "We know what we are, but know not what we may be.",
+		Tokens{2167, 1761, 1412, 581, 553, 11, 889, 1761, 625, 1412, 581, 1340,
+			413, 13}},
+	// These are recorded with tiktoken-go, a port of tiktoken, from the same
+	// ranks, and are split differently by the GPT-2 expression.
+	{"o200k_base", "HelloWorld isn'T 1234567",
+		Tokens{13225, 13046, 11092, 51532, 220, 7633, 19354, 22}},
+	{"o200k_base", "end.\n\n//path/to\nNext",
+		Tokens{419, 69935, 4189, 72231, 198, 7695}},
+}
+
+func TestTiktokenEncodings(t *testing.T) {
+	encoders := make(map[string]*GPTEncoder)
+	for _, test := range TiktokenTests {
+		encoder, ok := encoders[test.Encoding]
+		if !ok {
+			var err error
+			encoder, err = NewEncoder(test.Encoding)
+			if errors.Is(err, ErrDownloadFailed) {
+				t.Skipf("ranks of %s unavailable: %v", test.Encoding, err)
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			encoders[test.Encoding] = encoder
+		}
+		assert.Equal(t, test.Expected, *encoder.Encode(&test.Input),
+			test.Encoding+" "+test.Input)
+		assert.Equal(t, test.Input, encoder.Decode(&test.Expected))
+	}
+}
+
+// syntheticTiktokenRanks returns a tiktoken ranks file of count ranks, of
+// the 256 bytes and then the lowercase words of two letters and more, in
+// alphabetical order by length. Every word is made of words of lower ranks,
+// so that words in the file are encoded to a single token.
+func syntheticTiktokenRanks(count int) string {
+	var ranks strings.Builder
+	for rank := 0; rank < 256 && rank < count; rank++ {
+		ranks.WriteString(base64.StdEncoding.EncodeToString(
+			[]byte{byte(rank)}))
+		ranks.WriteString(fmt.Sprintf(" %d\n", rank))
+	}
+	words := []string{""}
+	for rank := 256; rank < count; {
+		longer := make([]string, 0, len(words)*26)
+		for _, word := range words {
+			for letter := 'a'; letter <= 'z' && rank < count; letter++ {
+				longer = append(longer, word+string(letter))
+				if len(word) == 0 {
+					continue
+				}
+				ranks.WriteString(base64.StdEncoding.EncodeToString(
+					[]byte(word + string(letter))))
+				ranks.WriteString(fmt.Sprintf(" %d\n", rank))
+				rank++
+			}
+		}
+		words = longer
+	}
+	return ranks.String()
+}
+
+func TestNewEncoderFromDir(t *testing.T) {
+	embedded := make(map[string]string)
+	for _, name := range []string{"encoder.json", "vocab.bpe",
+		"specials.txt"} {
+		embedded[name] = string(*resources.GetEmbeddedResource(
+			"gpt2-tokenizer/" + name).Data)
+	}
+	vocab := `{"a": 0, "b": 1, "ab": 2, "<eos>": 3}`
+	tests := []struct {
+		files  map[string]string
+		layout resources.DirLayout
+		err    error
+	}{
+		{embedded, resources.LAYOUT_EMBEDDED, nil},
+		{map[string]string{
+			"vocab.json":              vocab,
+			"merges.txt":              "#version: 0.2\na b\n",
+			"special_tokens_map.json": `{"eos_token": "<eos>"}`,
+		}, resources.LAYOUT_GPT2, nil},
+		{map[string]string{
+			"tokenizer.json": `{"model": {"type": "BPE", "vocab": ` +
+				vocab + `, "merges": [["a", "b"]]}}`,
+			"special_tokens_map.json": `{"eos_token": "<eos>"}`,
+		}, resources.LAYOUT_TOKENIZER_JSON, nil},
+		{map[string]string{
+			"tokenizer.json": `{"model": {"type": "Unigram"}}`,
+		}, resources.LAYOUT_TOKENIZER_JSON, ErrResourceInvalid},
+		{map[string]string{
+			"tokenizer.json": `{"model": {"type": "WordLevel"}}`,
+		}, resources.LAYOUT_TOKENIZER_JSON, ErrUnsupportedLayout},
+		{map[string]string{"tokenizer.model": ""},
+			resources.LAYOUT_SENTENCEPIECE, ErrResourceInvalid},
+		{map[string]string{"cl100k_base.tiktoken": "YQ== 0\nYQ== 0\n"},
+			resources.LAYOUT_TIKTOKEN, ErrResourceInvalid},
+		{map[string]string{"custom.tiktoken": ""},
+			resources.LAYOUT_TIKTOKEN, ErrUnsupportedLayout},
+		{map[string]string{}, resources.LAYOUT_UNKNOWN,
+			ErrUnsupportedLayout},
+	}
+	for idx, test := range tests {
+		dir := writeTokenizerDir(t, test.files)
+		layout, err := resources.DetectLayout(dir)
+		assert.Nil(t, err)
+		assert.Equal(t, test.layout, layout, fmt.Sprintf("test %d", idx))
+		encoder, err := NewEncoderFromDir(dir)
+		if test.err != nil {
+			assert.ErrorIs(t, err, test.err)
+			assert.Nil(t, encoder)
+			continue
+		}
+		if !assert.Nil(t, err, fmt.Sprintf("test %d", idx)) {
+			continue
+		}
+		if test.layout == resources.LAYOUT_EMBEDDED {
+			assert.Equal(t, gpt2Encoder.Fingerprint(),
+				encoder.Fingerprint())
+			continue
+		}
+		text := "ab<eos>"
+		assert.Equal(t, Tokens{2, 3}, *encoder.Encode(&text))
+		assert.Equal(t, text, encoder.Decode(encoder.Encode(&text)))
+	}
+
+	_, err := NewEncoderFromDir(t.TempDir() + "/missing")
+	assert.ErrorIs(t, err, ErrResourceMissing)
+}
+
+func TestGPTEncoder_CheckTokens(t *testing.T) {
+	assert.NoError(t, gpt2Encoder.CheckTokens(&Tokens{0, 50256}))
+	assert.ErrorIs(t, gpt2Encoder.CheckTokens(&Tokens{0, 65535}),
+		ErrTokenOutOfRange)
+}
+
+func TestVersion(t *testing.T) {
+	// Test binaries record no version of the module that they test.
+	assert.Equal(t, VERSION, Version())
+	version = "0.2.0"
+	assert.Equal(t, "0.2.0", Version())
+	version = ""
+	for expected, info := range map[string]debug.BuildInfo{
+		"0.1.1": {Main: debug.Module{Path: modulePath,
+			Version: "v0.1.1"}},
+		"0.1.2": {Main: debug.Module{Path: "example.com/tool"},
+			Deps: []*debug.Module{{Path: modulePath,
+				Version: "v0.1.2"}}},
+		"0.1.3": {Main: debug.Module{Path: "example.com/tool"},
+			Deps: []*debug.Module{{Path: modulePath, Version: "v0.1.0",
+				Replace: &debug.Module{Path: "example.com/fork",
+					Version: "v0.1.3"}}}},
+		// Local copies of the module have no version.
+		"": {Main: debug.Module{Path: "example.com/tool"},
+			Deps: []*debug.Module{{Path: modulePath, Version: "v0.1.0",
+				Replace: &debug.Module{Path: "../gpt_bpe"}}}},
+	} {
+		assert.Equal(t, expected, buildInfoVersion(&info))
+	}
+	assert.Equal(t, "", buildInfoVersion(&debug.BuildInfo{
+		Main: debug.Module{Path: modulePath, Version: "(devel)"}}))
+	assert.Equal(t, GPT2_DATA_VERSION, gpt2Encoder.DataVersion)
+	assert.Equal(t, PILE_DATA_VERSION, pileEncoder.DataVersion)
+	assert.Equal(t, CLIP_DATA_VERSION, clipEncoder.DataVersion)
+}
+
+func TestReadTokensFile(t *testing.T) {
+	tokens := Tokens{50256, 464, 2068, 7586, 21831, 50256}
+	dir := t.TempDir()
+	rawPath := dir + "/tokens.chunk"
+	zstdPath := dir + "/tokens.chunk.zst"
+	bin, err := tokens.ToBin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(rawPath, *bin, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(zstdPath, zstd.Compress(nil, *bin),
+		0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{rawPath, zstdPath} {
+		read, err := ReadTokensFile(path)
+		assert.Nil(t, err)
+		assert.Equal(t, tokens, *read)
+	}
+}
+
+func TestNewEncoderFromTokenizerJson(t *testing.T) {
+	model := `"model": {"type": "BPE", "vocab": {"a": 0, "b": 1, ` +
+		`"ab": 2, "Ġ": 3, "Ġab": 4}, "merges": ["a b", "Ġ ab"]}`
+	tokenizerJson := `{"added_tokens": [` +
+		`{"id": 5, "content": "<s>"}, {"id": 6, "content": "</s>"}], ` +
+		`"normalizer": {"type": "Sequence", "normalizers": [` +
+		`{"type": "Replace", "pattern": {"String": "c"}, "content": "a"}, ` +
+		`{"type": "Lowercase"}]}, ` +
+		`"pre_tokenizer": {"type": "ByteLevel", "add_prefix_space": false, ` +
+		`"use_regex": true}, ` +
+		`"post_processor": {"type": "TemplateProcessing", ` +
+		`"single": [{"SpecialToken": {"id": "<s>"}}, ` +
+		`{"Sequence": {"id": "A"}}, {"SpecialToken": {"id": "</s>"}}], ` +
+		`"pair": [{"SpecialToken": {"id": "<s>"}}, ` +
+		`{"Sequence": {"id": "A"}}, {"SpecialToken": {"id": "</s>"}}, ` +
+		`{"SpecialToken": {"id": "</s>"}}, {"Sequence": {"id": "B"}}, ` +
+		`{"SpecialToken": {"id": "</s>"}}], ` +
+		`"special_tokens": {"<s>": {"ids": [5]}, "</s>": {"ids": [6]}}}, ` +
+		`"decoder": {"type": "ByteLevel"}, ` + model + `}`
+	encoder, err := NewEncoderFromTokenizerJson([]byte(tokenizerJson))
+	if !assert.Nil(t, err) {
+		return
+	}
+	text := "AB cb"
+	assert.Equal(t, Tokens{5, 2, 4, 6}, *encoder.Encode(&text))
+	assert.Equal(t, "<s>ab ab</s>", encoder.Decode(encoder.Encode(&text)))
+	assert.Equal(t, PairTemplate{Start: Tokens{5}, End: Tokens{6},
+		PairStart: Tokens{6}, PairEnd: Tokens{6}}, encoder.PairTemplate())
+	special := "ab</s>"
+	assert.Equal(t, Tokens{5, 2, 6, 6}, *encoder.Encode(&special))
+
+	roberta := `{"post_processor": {"type": "RobertaProcessing", ` +
+		`"sep": ["ab", 2], "cls": ["a", 0]}, ` + model + `}`
+	encoder, err = NewEncoderFromTokenizerJson([]byte(roberta))
+	if assert.Nil(t, err) {
+		assert.Equal(t, PairTemplate{Start: Tokens{0}, End: Tokens{2},
+			PairStart: Tokens{2}, PairEnd: Tokens{2}},
+			encoder.PairTemplate())
+	}
+
+	for _, unsupported := range []string{
+		`"normalizer": {"type": "NFKC"}`,
+		`"pre_tokenizer": {"type": "Metaspace"}`,
+		`"pre_tokenizer": {"type": "Split", "pattern": {"Regex": "\\d"}, ` +
+			`"behavior": "Isolated"}`,
+		`"decoder": {"type": "WordPiece"}`,
+	} {
+		_, err := NewEncoderFromTokenizerJson([]byte(
+			`{` + unsupported + `, ` + model + `}`))
+		assert.ErrorIs(t, err, ErrUnsupportedLayout, unsupported)
+	}
+	_, err = NewEncoderFromTokenizerJson([]byte(`{"added_tokens": [` +
+		`{"id": 4294967296, "content": "<x>"}], ` + model + `}`))
+	assert.ErrorIs(t, err, ErrTokenOutOfRange)
+}
+
+func TestGPTEncoder_MergeMode(t *testing.T) {
+	encoder, err := NewEncoderWithOptions("gpt2-tokenizer",
+		WithMergeMode(MergeGreedy))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, MergeGreedy, encoder.MergeMode())
+	assert.NotEqual(t, gpt2Encoder.Fingerprint(), encoder.Fingerprint())
+	text := "hello world 🐹"
+	assert.Equal(t, text, encoder.Decode(encoder.Encode(&text)))
+	assert.Equal(t, corpus, encoder.Decode(encoder.Encode(&corpus)))
+	assert.Nil(t, encoder.SetMergeMode(MergeBPE))
+	assert.Equal(t, gpt2Encoder.Fingerprint(), encoder.Fingerprint())
+	assert.Equal(t, *gpt2Encoder.Encode(&corpus), *encoder.Encode(&corpus))
+	assert.NotNil(t, encoder.SetMergeMode(MergeMode(2)))
+
+	// A vocabulary without merges is encoded greedily.
+	dir := writeTokenizerDir(t, map[string]string{
+		"vocab.json": `{"a": 0, "b": 1, "ab": 2, "abb": 3, ` +
+			`"<eos>": 4}`,
+		"special_tokens_map.json": `{"eos_token": "<eos>"}`,
+	})
+	layout, _ := resources.DetectLayout(dir)
+	assert.Equal(t, resources.LAYOUT_GPT2, layout)
+	loaded, err := NewEncoderFromDir(dir)
+	if !assert.Nil(t, err) {
+		return
+	}
+	vocabOnly := loaded.(*GPTEncoder)
+	assert.Equal(t, MergeGreedy, vocabOnly.MergeMode())
+	text = "abbaba<eos>"
+	assert.Equal(t, Tokens{3, 2, 0, 4}, *vocabOnly.Encode(&text))
+	assert.Equal(t, text, vocabOnly.Decode(vocabOnly.Encode(&text)))
+}
+
+// appendUvarint appends v to data as a protobuf varint.
+func appendUvarint(data []byte, v uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	return append(data, buf[:binary.PutUvarint(buf[:], v)]...)
+}
+
+// appendUint32 appends v to data as four little endian bytes.
+func appendUint32(data []byte, v uint32) []byte {
+	var buf [4]byte
+	binary.LittleEndian.PutUint32(buf[:], v)
+	return append(data, buf[:]...)
+}
+
+// protoField returns a protobuf field of the number, with a varint value,
+// or with payload as its bytes when payload is not nil.
+func protoField(number int, varint uint64, payload []byte) []byte {
+	if payload == nil {
+		return appendUvarint(appendUvarint(nil, uint64(number<<3)), varint)
+	}
+	field := appendUvarint(nil, uint64(number<<3|2))
+	field = appendUvarint(field, uint64(len(payload)))
+	return append(field, payload...)
+}
+
+// protoPiece returns a SentencePiece model's piece, as a protobuf field.
+func protoPiece(text string, score float32, pieceType int) []byte {
+	piece := protoField(1, 0, []byte(text))
+	piece = appendUvarint(piece, 2<<3|5)
+	piece = appendUint32(piece, math.Float32bits(score))
+	piece = append(piece, protoField(3, uint64(pieceType), nil)...)
+	return protoField(1, 0, piece)
+}
+
+func TestSentencePieceEncoder(t *testing.T) {
+	// A Unigram model segments "▁aba" by the scores of its pieces, rather
+	// than into its longest pieces.
+	tokenizerJson := `{"added_tokens": [` +
+		`{"id": 0, "content": "<unk>", "special": true}, ` +
+		`{"id": 2, "content": "</s>", "special": true}], ` +
+		`"normalizer": {"type": "Sequence", "normalizers": [` +
+		`{"type": "Strip", "strip_left": false, "strip_right": true}, ` +
+		`{"type": "Replace", "pattern": {"Regex": " {2,}"}, ` +
+		`"content": " "}]}, ` +
+		`"pre_tokenizer": {"type": "Metaspace", "replacement": "▁", ` +
+		`"prepend_scheme": "always"}, ` +
+		`"model": {"type": "Unigram", "unk_id": 0, "vocab": [` +
+		`["<unk>", 0], ["<s>", 0], ["</s>", 0], ["▁", -2], ["a", -3], ` +
+		`["b", -3], ["▁ab", -2], ["▁a", -1.5], ["ba", -1], ["c", -4]]}}`
+	dir := writeTokenizerDir(t, map[string]string{
+		"tokenizer.json": tokenizerJson,
+	})
+	loaded, err := NewEncoderFromDir(dir)
+	if !assert.Nil(t, err) {
+		return
+	}
+	unigram := loaded.(*SentencePieceEncoder)
+	assert.Equal(t, SentencePieceUnigram, unigram.Model())
+	text := "aba  c</s>"
+	assert.Equal(t, Tokens{7, 8, 3, 9, 2}, *unigram.Encode(&text))
+	assert.Equal(t, "aba c</s>", unigram.Decode(unigram.Encode(&text)))
+	unknown := "xy a"
+	assert.Equal(t, Tokens{3, 0, 7}, *unigram.Encode(&unknown))
+	// The unknown piece is not found in text, as SentencePiece does not.
+	assert.Equal(t, map[string]Tokens{"</s>": {2}}, unigram.Specials())
+	_, err = NewEncoderFromTokenizerJson([]byte(tokenizerJson))
+	assert.ErrorIs(t, err, ErrUnsupportedLayout)
+
+	// A BPE model merges the pair of the highest score, and encodes the
+	// characters that it has no piece for as their bytes.
+	model := append(protoPiece("<unk>", 0, 2), protoPiece("<s>", 0, 3)...)
+	for _, piece := range []struct {
+		text  string
+		score float32
+	}{{"</s>", 0}, {"<0xC3>", 0}, {"<0xA9>", 0}, {"▁", -1}, {"a", -2},
+		{"b", -2}, {"▁a", -3}, {"ab", -1.5}, {"▁ab", -1}} {
+		pieceType := 1
+		if strings.HasPrefix(piece.text, "<") {
+			pieceType = 3
+			if strings.HasPrefix(piece.text, "<0x") {
+				pieceType = 6
+			}
+		}
+		model = append(model, protoPiece(piece.text, piece.score,
+			pieceType)...)
+	}
+	trainerSpec := append(protoField(3, 2, nil), protoField(35, 1, nil)...)
+	trainerSpec = append(trainerSpec, protoField(43, ^uint64(0), nil)...)
+	model = append(model, protoField(2, 0, trainerSpec)...)
+	model = append(model, protoField(3, 0,
+		protoField(1, 0, []byte("identity")))...)
+	dir = writeTokenizerDir(t, map[string]string{
+		"tokenizer.model": string(model),
+	})
+	loaded, err = NewEncoderFromDir(dir)
+	if !assert.Nil(t, err) {
+		return
+	}
+	bpe := loaded.(*SentencePieceEncoder)
+	assert.Equal(t, SentencePieceBPE, bpe.Model())
+	assert.Equal(t, Token(2), bpe.EosToken)
+	text = "ab é"
+	assert.Equal(t, Tokens{10, 5, 3, 4}, *bpe.Encode(&text))
+	assert.Equal(t, text, bpe.Decode(bpe.Encode(&text)))
+	assert.NotEqual(t, unigram.Fingerprint(), bpe.Fingerprint())
+
+	// A charsmap whose double-array trie maps "Ａ" to "A".
+	trie := make([]uint32, 1024)
+	trie[0] = 1 << 10
+	trie[238] = 0xef | 256<<10
+	trie[338] = 0xbc | 512<<10
+	trie[1011] = 0xa1 | 1<<8 | 1<<10
+	trie[1010] = 1 << 31
+	charsMapData := appendUint32(nil, 4*1024)
+	for _, unit := range trie {
+		charsMapData = appendUint32(charsMapData, unit)
+	}
+	charsMapData = append(charsMapData, "A\x00"...)
+	charsMap, err := newSentencePieceCharsMap(charsMapData)
+	if assert.Nil(t, err) {
+		assert.Equal(t, "AｂA", charsMap.normalize("ＡｂＡ"))
+	}
+}
+
+func TestWordPieceEncoder(t *testing.T) {
+	vocab := "[PAD]\n[UNK]\n[CLS]\n[SEP]\n[MASK]\nun\n##aff\n##able\n" +
+		"hello\n,\n!\ncafe\n世\n##s\n"
+	uncased, err := NewWordPieceEncoder([]byte(vocab), true, true)
+	if !assert.Nil(t, err) {
+		return
+	}
+	// Words are split at punctuation and CJK characters, lowercased and
+	// stripped of their accents, then split into their longest pieces.
+	text := "UnAffable, Café!  [SEP]hellos 世界"
+	encoded := uncased.Encode(&text)
+	assert.Equal(t, Tokens{5, 6, 7, 9, 11, 10, 3, 8, 13, 12, 1}, *encoded)
+	assert.Equal(t, "unaffable , cafe ! [SEP] hellos 世 [UNK]",
+		uncased.Decode(encoded))
+	assert.Equal(t, 11, uncased.Count(&text))
+	assert.Equal(t, Token(2), uncased.ClsToken)
+	assert.Equal(t, Token(3), uncased.SepToken)
+	assert.Equal(t, 5, len(uncased.Specials()))
+
+	// A cased vocabulary has no piece for "Un".
+	dir := writeTokenizerDir(t, map[string]string{
+		"vocab.txt":             vocab,
+		"tokenizer_config.json": `{"do_lower_case": false}`,
+	})
+	layout, err := resources.DetectLayout(dir)
+	assert.Nil(t, err)
+	assert.Equal(t, resources.LAYOUT_WORDPIECE, layout)
+	loaded, err := NewEncoderFromDir(dir)
+	if !assert.Nil(t, err) {
+		return
+	}
+	cased := loaded.(*WordPieceEncoder)
+	word := "UnAffable unaffable"
+	assert.Equal(t, Tokens{1, 5, 6, 7}, *cased.Encode(&word))
+	assert.NotEqual(t, uncased.Fingerprint(), cased.Fingerprint())
+
+	// A tokenizer.json with a WordPiece model loads the same vocabulary.
+	dir = writeTokenizerDir(t, map[string]string{
+		"tokenizer.json": `{"added_tokens": [` +
+			`{"id": 0, "content": "[PAD]", "special": true}, ` +
+			`{"id": 1, "content": "[UNK]", "special": true}, ` +
+			`{"id": 3, "content": "[SEP]", "special": true}], ` +
+			`"normalizer": {"type": "BertNormalizer", "lowercase": true, ` +
+			`"strip_accents": null}, ` +
+			`"pre_tokenizer": {"type": "BertPreTokenizer"}, ` +
+			`"model": {"type": "WordPiece", "unk_token": "[UNK]", ` +
+			`"continuing_subword_prefix": "##", ` +
+			`"max_input_chars_per_word": 8, "vocab": {"[PAD]": 0, ` +
+			`"[UNK]": 1, "[SEP]": 3, "un": 5, "##aff": 6, "##able": 7}}}`,
+	})
+	loaded, err = NewEncoderFromDir(dir)
+	if !assert.Nil(t, err) {
+		return
+	}
+	fromJson := loaded.(*WordPieceEncoder)
+	// Words longer than max_input_chars_per_word are unknown.
+	word = "UnAff[SEP]unaffable"
+	assert.Equal(t, Tokens{5, 6, 3, 1}, *fromJson.Encode(&word))
+	assert.Equal(t, 3, len(fromJson.Specials()))
+}
+
+func TestRWKVEncoder(t *testing.T) {
+	vocab := "1 'a' 1\n2 'b' 1\n3 ' ' 1\n4 'ab' 2\n5 'abc' 3\n6 ' a' 2\n" +
+		"7 b'\\xe4\\xbd' 2\n8 '你' 3\n9 '\\n' 1\n10 \"it's\" 4\n" +
+		"11 '\\u00e9' 2\n"
+	dir := writeTokenizerDir(t, map[string]string{
+		"rwkv_vocab_v20230424.txt": vocab,
+	})
+	loaded, err := NewEncoderFromDir(dir)
+	if !assert.Nil(t, err) {
+		return
+	}
+	encoder := loaded.(*TrieEncoder)
+	// Text is matched greedily across spaces, and the bytes that no token
+	// starts with are skipped.
+	text := "abab ab\nab 你it'sé"
+	encoded := encoder.Encode(&text)
+	assert.Equal(t, Tokens{4, 4, 6, 2, 9, 4, 3, 8, 10, 11}, *encoded)
+	assert.Equal(t, text, encoder.Decode(encoded))
+	text = "abcac"
+	assert.Equal(t, Tokens{5, 1}, *encoder.Encode(&text))
+	assert.Equal(t, "\xe4\xbd", encoder.Decode(&Tokens{0, 7}))
+	assert.Empty(t, encoder.Specials())
+
+	for _, invalid := range []string{"1 'ab' 3\n", "1 'a\n", "1 b'é' 2\n",
+		"1 '\\q' 2\n"} {
+		_, err = ParseRWKVVocab(strings.NewReader(invalid))
+		assert.ErrorIs(t, err, ErrVocabInvalid, invalid)
+	}
+	_, err = ParseRWKVVocab(strings.NewReader("4294967296 'a' 1\n"))
+	assert.ErrorIs(t, err, ErrTokenOutOfRange)
+}
+
+func TestAlignVocabularies(t *testing.T) {
+	alignment := AlignVocabularies(&gpt2Encoder, &gpt2Encoder)
+	assert.Equal(t, len(gpt2Encoder.decoder), alignment.Exact)
+	assert.Equal(t, 0, alignment.Split)
+	assert.Equal(t, 0, len(alignment.Unmapped))
+
+	alignment = AlignVocabularies(&gpt2Encoder, &pileEncoder)
+	assert.Equal(t, len(gpt2Encoder.decoder),
+		alignment.Exact+alignment.Split+len(alignment.Unmapped))
+	assert.Greater(t, alignment.Exact, 30000)
+	the := gpt2Encoder.encoder["Ġthe"]
+	assert.Equal(t, Tokens{pileEncoder.encoder["Ġthe"]},
+		alignment.DraftToTarget()[the])
+	for _, tokenAlignment := range alignment.Tokens {
+		draft := string(gpt2Encoder.TokenBytes(tokenAlignment.Draft))
+		var target string
+		for _, token := range tokenAlignment.Target {
+			target += string(pileEncoder.TokenBytes(token))
+		}
+		if _, isSpecial := specialsByToken(&gpt2Encoder)[tokenAlignment.
+			Draft]; !isSpecial {
+			assert.Equal(t, draft, target)
+		}
+	}
+
+	dir := writeTokenizerDir(t, map[string]string{
+		"vocab.json":              `{"a": 0, "b": 1, "<eos>": 2}`,
+		"special_tokens_map.json": `{"eos_token": "<eos>"}`,
+	})
+	target, err := NewEncoderFromDir(dir)
+	if !assert.Nil(t, err) {
+		return
+	}
+	dir = writeTokenizerDir(t, map[string]string{
+		"vocab.json":              `{"a": 0, "b": 1, "ab": 2, "c": 3, "<s>": 4}`,
+		"merges.txt":              "#version: 0.2\na b\n",
+		"special_tokens_map.json": `{"bos_token": "<s>"}`,
+	})
+	draft, err := NewEncoderFromDir(dir)
+	if !assert.Nil(t, err) {
+		return
+	}
+	alignment = AlignVocabularies(draft.(*GPTEncoder), target.(*GPTEncoder))
+	assert.Equal(t, []TokenAlignment{{0, Tokens{0}, true},
+		{1, Tokens{1}, true}, {2, Tokens{0, 1}, false}}, alignment.Tokens)
+	assert.Equal(t, Tokens{3, 4}, alignment.Unmapped)
+	var written bytes.Buffer
+	assert.Nil(t, alignment.WriteJSON(&written))
+	assert.Contains(t, written.String(),
+		`{"draft":2,"target":[0,1],"exact":false}`)
+}
+
+func TestTokenMigration(t *testing.T) {
+	// Every embedded tokenizer has a stable number, and the migrations of
+	// its data from the first version to the current one are published.
+	numbers := make(map[uint16]string)
+	for id, version := range EmbeddedDataVersions {
+		number, ok := EmbeddedResourceIds[id]
+		assert.True(t, ok, id)
+		assert.Equal(t, "", numbers[number], id)
+		numbers[number] = id
+		_, err := MigrateTokens(id, 1, version, &Tokens{})
+		assert.Nil(t, err, id)
+	}
+
+	dir := writeTokenizerDir(t, map[string]string{
+		"vocab.json":              `{"a": 0, "b": 1, "ab": 2, "c": 3, "<s>": 4}`,
+		"merges.txt":              "#version: 0.2\na b\n",
+		"special_tokens_map.json": `{"bos_token": "<s>"}`,
+	})
+	older, err := NewEncoderFromDir(dir)
+	if !assert.Nil(t, err) {
+		return
+	}
+	dir = writeTokenizerDir(t, map[string]string{
+		"vocab.json":              `{"b": 0, "a": 1, "c": 2, "<eos>": 3}`,
+		"special_tokens_map.json": `{"eos_token": "<eos>"}`,
+	})
+	newer, err := NewEncoderFromDir(dir)
+	if !assert.Nil(t, err) {
+		return
+	}
+	migration, err := NewTokenMigration("test-tokenizer", 1, 2,
+		older.(*GPTEncoder), newer.(*GPTEncoder))
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.Equal(t, map[Token]Tokens{0: {1}, 1: {0}, 2: {1, 0}, 3: {2}},
+		migration.Changed)
+	assert.Equal(t, Tokens{4}, migration.Unmapped)
+	migrated, err := migration.Apply(&Tokens{2, 3, 0})
+	assert.Nil(t, err)
+	assert.Equal(t, Tokens{1, 0, 2, 1}, *migrated)
+	_, err = migration.Apply(&Tokens{4, 0})
+	assert.ErrorIs(t, err, ErrTokenOutOfRange)
+	_, err = NewTokenMigration("test-tokenizer", 2, 2,
+		older.(*GPTEncoder), newer.(*GPTEncoder))
+	assert.ErrorIs(t, err, ErrMigrationMissing)
+
+	// Published migrations round trip through JSON, and are chained.
+	var written bytes.Buffer
+	assert.Nil(t, migration.WriteJSON(&written))
+	published, err := ReadTokenMigration(&written)
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.Equal(t, migration, published)
+	embedded := EmbeddedMigrations
+	defer func() { EmbeddedMigrations = embedded }()
+	EmbeddedMigrations = []TokenMigration{*published, {
+		Tokenizer: "test-tokenizer", From: 2, To: 3,
+		Changed: map[Token]Tokens{2: {3}},
+	}}
+	migrated, err = MigrateTokens("test-tokenizer", 1, 3, &Tokens{3, 1})
+	assert.Nil(t, err)
+	assert.Equal(t, Tokens{3, 0}, *migrated)
+	migrated, err = MigrateTokens("test-tokenizer", 2, 2, &Tokens{3, 1})
+	assert.Nil(t, err)
+	assert.Equal(t, Tokens{3, 1}, *migrated)
+	_, err = MigrateTokens("test-tokenizer", 1, 4, &Tokens{})
+	assert.ErrorIs(t, err, ErrMigrationMissing)
+	_, err = MigrateTokens("test-tokenizer", 3, 1, &Tokens{})
+	assert.ErrorIs(t, err, ErrMigrationMissing)
+	_, err = ReadTokenMigration(strings.NewReader("{"))
+	assert.ErrorIs(t, err, ErrResourceInvalid)
+}
+
+func TestMockCorpus(t *testing.T) {
+	options := DefaultMockCorpusOptions()
+	options.Scripts = map[string]int{"latin": 1, "cjk": 1, "arabic": 1}
+	options.EmojiDensity = 0.1
+	options.LookalikeDensity = 0.5
+	generate := func(options MockCorpusOptions) []string {
+		corpus, err := NewMockCorpus(options)
+		if !assert.Nil(t, err) {
+			t.FailNow()
+		}
+		documents := make([]string, 50)
+		for idx := range documents {
+			documents[idx] = corpus.Document()
+		}
+		return documents
+	}
+	documents := generate(options)
+	assert.Equal(t, documents, generate(options))
+	reseeded := options
+	reseeded.Seed++
+	assert.NotEqual(t, documents, generate(reseeded))
+
+	corpus := strings.Join(documents, "\n\n")
+	for _, property := range []struct {
+		name  string
+		found func(r rune) bool
+	}{
+		{"latin", func(r rune) bool { return r >= 'a' && r <= 'z' }},
+		{"cjk", func(r rune) bool { return r >= 0x4e00 && r <= 0x9fff }},
+		{"arabic", func(r rune) bool { return r >= 0x0628 && r <= 0x064a }},
+		{"cyrillic", func(r rune) bool { return r >= 0x0430 && r <= 0x044f }},
+	} {
+		assert.Equal(t, property.name != "cyrillic",
+			strings.IndexFunc(corpus, property.found) >= 0, property.name)
+	}
+	assert.Contains(t, corpus, "\u200d")
+	lookalikes := 0
+	for _, lookalike := range MockSpecialLookalikes {
+		lookalikes += strings.Count(corpus, lookalike)
+	}
+	assert.Greater(t, lookalikes, 0)
+	assert.NotContains(t, corpus, "<|endoftext|>")
+	for _, document := range documents {
+		lines := strings.Split(document, "\n")
+		assert.GreaterOrEqual(t, len(lines), options.MinLines)
+		assert.LessOrEqual(t, len(lines), options.MaxLines)
+		for _, line := range lines {
+			assert.GreaterOrEqual(t, utf8.RuneCountInString(line),
+				options.MinLineLength)
+		}
+	}
+
+	// Lookalikes are encoded as text, and the corpus round trips.
+	tokens := gpt2Encoder.Encode(&corpus)
+	assert.NotContains(t, *tokens, gpt2Encoder.EosToken)
+	assert.Equal(t, corpus, gpt2Encoder.Decode(tokens))
+
+	mix, err := ParseScriptMix("latin:3, kana")
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]int{"latin": 3, "kana": 1}, mix)
+	_, err = ParseScriptMix("latin:x")
+	assert.NotNil(t, err)
+	options.Scripts = map[string]int{"klingon": 1}
+	_, err = NewMockCorpus(options)
+	assert.NotNil(t, err)
+	options.Scripts = map[string]int{"latin": 1}
+	options.MaxLines = 0
+	_, err = NewMockCorpus(options)
+	assert.NotNil(t, err)
+}
+
+func TestCaseFold(t *testing.T) {
+	assert.Equal(t, "Straße İstanbul", CaseFold("Straße İstanbul",
+		CaseFoldNone))
+	assert.Equal(t, "strasse i̇stanbul fi", CaseFold("Straße İstanbul ﬁ",
+		CaseFoldFull))
+	// Characters with more than one lower case fold to the same one.
+	assert.Equal(t, "σοφοσ", CaseFold("ΣΟΦΟΣ", CaseFoldFull))
+	assert.Equal(t, "σοφοσ", CaseFold("σοφος", CaseFoldFull))
+	assert.Equal(t, "ꭰᏸ", CaseFold("ꭰᏸ", CaseFoldNone))
+	assert.Equal(t, "ᎠᏰ", CaseFold("ꭰᏸ", CaseFoldFull))
+	assert.Equal(t, "ı", CaseFold("ı", CaseFoldFull))
+	assert.Equal(t, "ıstanbul istanbul", CaseFold("ISTANBUL İstanbul",
+		CaseFoldTurkic))
+
+	encoder, err := NewEncoderWithOptions("gpt2-tokenizer",
+		WithCaseFolding(CaseFoldFull))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, CaseFoldFull, encoder.CaseFolding())
+	text, folded := "Hello WORLD, Straße", "hello world, strasse"
+	assert.Equal(t, *gpt2Encoder.Encode(&folded), *encoder.Encode(&text))
+	assert.NotEqual(t, gpt2Encoder.Fingerprint(), encoder.Fingerprint())
+	_, spans := encoder.EncodeWithOffsets(text)
+	assert.Equal(t, len(text), spans[len(spans)-1].End)
+	assert.NotNil(t, encoder.SetCaseFolding(CaseFoldTurkic+1))
+}
+
+func TestGPTEncoder_CharLevel(t *testing.T) {
+	vocab := `{"[UNK]": 0, "h": 1, "e": 2, "l": 3, "o</w>": 4, "he": 5, ` +
+		`"ll": 6, "hell": 7, "hello</w>": 8, "é": 9, "hé": 10}`
+	merges := `["h e", "l l", "he ll", "hell o</w>", "h é"]`
+	tokenizerJson := `{"pre_tokenizer": {"type": "Whitespace"}, ` +
+		`"decoder": {"type": "BPEDecoder", "suffix": "</w>"}, ` +
+		`"model": {"type": "BPE", "unk_token": "[UNK]", ` +
+		`"end_of_word_suffix": "</w>", "vocab": ` + vocab + `, ` +
+		`"merges": ` + merges + `}}`
+	encoder, err := NewEncoderFromTokenizerJson([]byte(tokenizerJson))
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.Equal(t, BPECharLevel, encoder.BPELevel())
+	unk, ok := encoder.UnkToken()
+	assert.True(t, ok)
+	assert.Equal(t, Token(0), unk)
+	// Characters are merged as they are, rather than as their bytes, and
+	// those that are not in the vocabulary are unknown.
+	text := "hello héllo hxxo"
+	tokens := encoder.Encode(&text)
+	assert.Equal(t, Tokens{8, 10, 6, 4, 1, 0, 0, 4}, *tokens)
+	assert.Equal(t, "hello héllo h[UNK][UNK]o ", encoder.Decode(tokens))
+	assert.Equal(t, []byte("é"), encoder.TokenBytes(9))
+	assert.Equal(t, make([]int, len(encoder.Unitrim())), encoder.Unitrim())
+
+	// Runs of unknown characters are fused into one token when asked to.
+	fingerprint := encoder.Fingerprint()
+	assert.Nil(t, encoder.SetUnkToken("[UNK]", true))
+	assert.Equal(t, Tokens{8, 10, 6, 4, 1, 0, 4}, *encoder.Encode(&text))
+	assert.NotEqual(t, fingerprint, encoder.Fingerprint())
+	assert.ErrorIs(t, encoder.SetUnkToken("<unk>", false), ErrVocabInvalid)
+	assert.NotNil(t, encoder.SetBPELevel(BPECharLevel+1))
+
+	// A character level vocabulary is also selected by the encoder config.
+	dir := writeTokenizerDir(t, map[string]string{
+		"vocab.json": vocab,
+		"merges.txt": "#version: 0.2\nh e\nl l\nhe ll\nhell o</w>\nh é\n",
+		"special_config.json": `{"char_level": true, ` +
+			`"unk_token": "[UNK]", "end_of_word": "</w>"}`,
+	})
+	loaded, err := NewEncoderFromDir(dir)
+	if !assert.Nil(t, err) {
+		return
+	}
+	fromConfig := loaded.(*GPTEncoder)
+	fromConfig.SetPreTokenizer(WhitespacePreTokenizer)
+	assert.Equal(t, BPECharLevel, fromConfig.BPELevel())
+	assert.Equal(t, Tokens{8, 10, 6, 4, 1, 0, 0, 4},
+		*fromConfig.Encode(&text))
+}
@@ -0,0 +1,85 @@
+package gpt_bpe
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// MergeMode
+// How the words that text is split into are encoded as tokens.
+type MergeMode uint8
+
+const (
+	// MergeBPE merges the characters of each word by the ranks of the
+	// merges, as the tokenizer was trained to, and is the default.
+	MergeBPE MergeMode = iota
+	// MergeGreedy encodes each word as the longest token of the vocabulary
+	// that it starts with, then the longest that the rest starts with, and
+	// so on, without the merges. Tokenizers that are loaded without merges
+	// are encoded greedily.
+	MergeGreedy
+)
+
+// MergeMode
+// Returns how the words that text is split into are encoded as tokens.
+func (encoder *GPTEncoder) MergeMode() MergeMode {
+	return encoder.mergeMode
+}
+
+// SetMergeMode
+// Sets how the words that text is split into are encoded as tokens, which
+// changes the encoder's fingerprint. With MergeBPE, a tokenizer that was
+// loaded without merges encodes each character as its own token.
+func (encoder *GPTEncoder) SetMergeMode(mode MergeMode) error {
+	if mode > MergeGreedy {
+		return errors.New(fmt.Sprintf("invalid merge mode %d", mode))
+	}
+	encoder.mergeMode = mode
+	if mode == MergeGreedy {
+		encoder.longestToken = 0
+		for text := range encoder.encoder {
+			if len(text) > encoder.longestToken {
+				encoder.longestToken = len(text)
+			}
+		}
+	}
+	encoder.cache.Purge()
+	return nil
+}
+
+// WithMergeMode
+// Sets how words are encoded as tokens, as SetMergeMode does.
+func WithMergeMode(mode MergeMode) Option {
+	return func(encoder *GPTEncoder) error {
+		return encoder.SetMergeMode(mode)
+	}
+}
+
+// toGreedy encodes the characters of word, which end with the end of word
+// marker, as the longest tokens of the vocabulary that each position starts
+// with. A character that no token starts with is encoded as toBPE encodes an
+// unknown character.
+func (encoder *GPTEncoder) toGreedy(word []string) Tokens {
+	tokens := make(Tokens, 0, len(word))
+	var prefix strings.Builder
+	unknown := false
+	for begin := 0; begin < len(word); {
+		// Prefixes are only looked up to the length of the longest token.
+		longest := begin + 1
+		prefix.Reset()
+		for end := begin + 1; end <= len(word); end++ {
+			prefix.WriteString(word[end-1])
+			if prefix.Len() > encoder.longestToken {
+				break
+			}
+			if _, ok := encoder.encoder[prefix.String()]; ok {
+				longest = end
+			}
+		}
+		tokens, unknown = encoder.appendPiece(tokens,
+			strings.Join(word[begin:longest], ""), unknown)
+		begin = longest
+	}
+	return tokens
+}
@@ -0,0 +1,41 @@
+package gpt_bpe
+
+// Hooks
+// Callbacks that an encoder calls as it encodes, for debugging its
+// performance in production. Any of them may be nil, and an encoder without
+// hooks only pays for a nil check per word. The hooks are called on the
+// goroutine that encodes, so hooks of an encoder that is used concurrently
+// must be safe to call concurrently.
+type Hooks struct {
+	// OnPretokenize is called with each word that text is split into,
+	// before it is encoded.
+	OnPretokenize func(word string)
+	// OnCacheMiss is called with each word that is not in the cache, and
+	// is merged into tokens.
+	OnCacheMiss func(word string)
+	// OnMergeApplied is called with each word that is merged, after its
+	// merges, with the number of pairs of pieces that were merged.
+	OnMergeApplied func(word string, merges int)
+}
+
+// SetHooks
+// Sets the hooks that the encoder calls as it encodes, or removes them if
+// hooks is nil.
+func (encoder *GPTEncoder) SetHooks(hooks *Hooks) {
+	encoder.hooks = hooks
+}
+
+// Hooks
+// Returns the hooks that the encoder calls as it encodes, or nil.
+func (encoder *GPTEncoder) Hooks() *Hooks {
+	return encoder.hooks
+}
+
+// WithHooks
+// Sets the hooks that the encoder calls as it encodes, as SetHooks does.
+func WithHooks(hooks *Hooks) Option {
+	return func(encoder *GPTEncoder) error {
+		encoder.SetHooks(hooks)
+		return nil
+	}
+}
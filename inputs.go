@@ -0,0 +1,165 @@
+package gpt_bpe
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Truncation
+// How EncodeInputs truncates texts to InputsOptions.MaxLength, after the
+// truncation strategies of huggingface tokenizers.
+type Truncation uint
+
+const (
+	// TruncateNone never truncates.
+	TruncateNone Truncation = iota
+	// TruncateLongestFirst removes a token at a time from the end of the
+	// longer of the texts, the second when they are as long.
+	TruncateLongestFirst
+	// TruncateOnlyFirst truncates only the first text.
+	TruncateOnlyFirst
+	// TruncateOnlySecond truncates only the second text of a pair.
+	TruncateOnlySecond
+)
+
+// InputsOptions
+// The options for EncodeInputs. A MaxLength of zero neither truncates nor
+// pads. The length includes the special tokens of the encoder's
+// PairTemplate.
+type InputsOptions struct {
+	MaxLength          int
+	Truncation         Truncation
+	PadToMaxLength     bool
+	ReturnTokenTypeIds bool
+}
+
+// ModelInputs
+// The inputs of a model for a text or a pair of texts, as huggingface
+// tokenizers return them when called. TokenTypeIds are 0 for the tokens of
+// the first text, and 1 for those of the second.
+type ModelInputs struct {
+	InputIds      Tokens `json:"input_ids"`
+	AttentionMask []int  `json:"attention_mask"`
+	TokenTypeIds  []int  `json:"token_type_ids,omitempty"`
+}
+
+// encodeContent encodes text without the BOS and EOS tokens that Encode
+// adds, as the PairTemplate places its own.
+func (encoder *GPTEncoder) encodeContent(text *string) Tokens {
+	return *encoder.EncodeWithPolicy(text, AddNever, AddNever)
+}
+
+// concatTokens returns a new slice of the tokens of each of parts in turn.
+func concatTokens(parts ...Tokens) Tokens {
+	length := 0
+	for _, part := range parts {
+		length += len(part)
+	}
+	tokens := make(Tokens, 0, length)
+	for _, part := range parts {
+		tokens = append(tokens, part...)
+	}
+	return tokens
+}
+
+// truncateInputs truncates first and second, which is nil for a single
+// text, by excess tokens with the truncation strategy.
+func truncateInputs(first Tokens, second Tokens, excess int,
+	truncation Truncation) (Tokens, Tokens, error) {
+	switch truncation {
+	case TruncateLongestFirst:
+		if excess > len(first)+len(second) {
+			break
+		}
+		for ; excess > 0; excess-- {
+			if len(first) > len(second) {
+				first = first[:len(first)-1]
+			} else {
+				second = second[:len(second)-1]
+			}
+		}
+		return first, second, nil
+	case TruncateOnlyFirst:
+		// As with huggingface, a text is not truncated to nothing.
+		if excess >= len(first) {
+			break
+		}
+		return first[:len(first)-excess], second, nil
+	case TruncateOnlySecond:
+		if second == nil {
+			return nil, nil, errors.New(
+				"cannot truncate only the second text of a single text")
+		}
+		if excess >= len(second) {
+			break
+		}
+		return first, second[:len(second)-excess], nil
+	case TruncateNone:
+		return first, second, nil
+	default:
+		return nil, nil, errors.New(fmt.Sprintf(
+			"invalid truncation strategy %d", truncation))
+	}
+	return nil, nil, errors.New(fmt.Sprintf(
+		"cannot truncate %d tokens with truncation strategy %d", excess,
+		truncation))
+}
+
+// EncodeInputs
+// Encodes text, and the second text of a pair when pair is not nil, into the
+// input ids, attention mask and, optionally, token type ids of a model, as
+// calling a huggingface tokenizer does. The texts are placed in the special
+// tokens of the encoder's PairTemplate, and the texts are truncated, and the
+// inputs padded with the PadToken, to the options' MaxLength.
+func (encoder *GPTEncoder) EncodeInputs(text *string, pair *string,
+	options InputsOptions) (*ModelInputs, error) {
+	first := encoder.encodeContent(text)
+	var second Tokens
+	if pair != nil {
+		second = encoder.encodeContent(pair)
+	}
+	template := encoder.PairTemplate()
+	specials := len(template.Start) + len(template.End)
+	if pair != nil {
+		specials += len(template.PairStart) + len(template.PairEnd)
+	}
+	if options.MaxLength > 0 {
+		excess := specials + len(first) + len(second) - options.MaxLength
+		if excess > 0 {
+			var err error
+			if first, second, err = truncateInputs(first, second, excess,
+				options.Truncation); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	inputs := &ModelInputs{
+		InputIds:      concatTokens(template.Start, first, template.End),
+		AttentionMask: make([]int, 0, options.MaxLength),
+	}
+	firstLength := len(inputs.InputIds)
+	if pair != nil {
+		inputs.InputIds = append(inputs.InputIds, concatTokens(
+			template.PairStart, second, template.PairEnd)...)
+	}
+	for range inputs.InputIds {
+		inputs.AttentionMask = append(inputs.AttentionMask, 1)
+	}
+	if options.ReturnTokenTypeIds {
+		inputs.TokenTypeIds = make([]int, len(inputs.InputIds))
+		for idx := firstLength; idx < len(inputs.TokenTypeIds); idx++ {
+			inputs.TokenTypeIds[idx] = 1
+		}
+	}
+	if options.PadToMaxLength {
+		for len(inputs.InputIds) < options.MaxLength {
+			inputs.InputIds = append(inputs.InputIds, encoder.PadToken)
+			inputs.AttentionMask = append(inputs.AttentionMask, 0)
+			if options.ReturnTokenTypeIds {
+				inputs.TokenTypeIds = append(inputs.TokenTypeIds, 0)
+			}
+		}
+	}
+	return inputs, nil
+}
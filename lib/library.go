@@ -21,10 +21,12 @@ func init() {
 //export initTokenizer
 // initTokenizer accepts a vocabulary id as a C string, and if it does not
 // exist in the global tokenizers map, initializes a tokenizer for that
-// vocabulary.
+// vocabulary. Its words are capped at MAXWORD_SZ bytes, as callers may pass
+// untrusted text.
 func initTokenizer(vocab_id *C.char) bool {
 	vocab_id_str := C.GoString(vocab_id)
-	if encoder, err := gpt_bpe.NewEncoder(vocab_id_str); err != nil {
+	if encoder, err := gpt_bpe.NewEncoderWithOptions(vocab_id_str,
+		gpt_bpe.WithMaxWordLength(gpt_bpe.MAXWORD_SZ)); err != nil {
 		panic(err)
 	} else {
 		tokenizers[vocab_id_str] = encoder
@@ -51,7 +53,13 @@ func tokenizeBuffer(vocabIdStr *C.char, buf *C.char, sz C.size_t) C.Tokens {
 		encoder = tokenizers[tokenizerId]
 	}
 	goBuf := createBuffer(unsafe.Pointer(buf), int(sz))
-	encoded := *encoder.EncodeBuffer(goBuf)
+	// Tokens are returned as uint16_t, so tokenizers with larger ids panic
+	// here rather than returning truncated tokens.
+	encodedPtr, err := encoder.EncodeBuffer(goBuf)
+	if err != nil {
+		panic(err)
+	}
+	encoded := *encodedPtr
 	tokensArr := C.CBytes(encoded)
 	tokens := C.Tokens{
 		tokens: (*C.uint16_t)(tokensArr),
@@ -75,7 +83,11 @@ func tokenize(vocabIdStr *C.char, str *C.char) C.Tokens {
 	fmt.Printf("input: %s\n", s)
 	encoded := *encoder.Encode(&s)
 	fmt.Printf("Tokens: %v\n", encoded)
-	tokensArr := C.CBytes(*encoded.ToBin())
+	bin, err := encoded.ToBin()
+	if err != nil {
+		panic(err)
+	}
+	tokensArr := C.CBytes(*bin)
 	tokens := C.Tokens{
 		tokens: (*C.uint16_t)(tokensArr),
 		len:    C.size_t(len(encoded)),
@@ -105,6 +117,13 @@ func decode(vocabIdStr *C.char, tokens C.Tokens) *C.char {
 	return C.CString(decoded)
 }
 
+//export version
+// version returns a malloc'ed C.char* containing the release of gpt_bpe that
+// the library was built with.
+func version() *C.char {
+	return C.CString(gpt_bpe.Version())
+}
+
 //export freeTokens
 func freeTokens(tokens C.Tokens) {
 	C.free(unsafe.Pointer(tokens.tokens))
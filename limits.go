@@ -0,0 +1,146 @@
+package gpt_bpe
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync/atomic"
+)
+
+// LimitError
+// The error of a text that exceeds a limit of the encoder, which wraps
+// ErrInputTooLarge or ErrOutputTooLarge. Size is the number of bytes or
+// tokens that were reached when the text was rejected, which exceeds Limit,
+// but may be less than the whole text's.
+type LimitError struct {
+	Err   error
+	Limit int
+	Size  int
+}
+
+func (err *LimitError) Error() string {
+	unit := "bytes"
+	if err.Err == ErrOutputTooLarge {
+		unit = "tokens"
+	}
+	return fmt.Sprintf("%v: %d %s exceeds the limit of %d", err.Err,
+		err.Size, unit, err.Limit)
+}
+
+func (err *LimitError) Unwrap() error {
+	return err.Err
+}
+
+// WithMaxInputBytes
+// Sets the longest text in bytes that EncodeLimited and EncodeReaderLimited
+// encode, where zero disables the limit.
+func WithMaxInputBytes(limit int) Option {
+	return func(encoder *GPTEncoder) error {
+		if limit < 0 {
+			return errors.New(fmt.Sprintf("invalid max input bytes %d",
+				limit))
+		}
+		encoder.MaxInputBytes = limit
+		return nil
+	}
+}
+
+// WithMaxOutputTokens
+// Sets the most tokens that EncodeLimited and EncodeReaderLimited return,
+// where zero disables the limit.
+func WithMaxOutputTokens(limit int) Option {
+	return func(encoder *GPTEncoder) error {
+		if limit < 0 {
+			return errors.New(fmt.Sprintf("invalid max output tokens %d",
+				limit))
+		}
+		encoder.MaxOutputTokens = limit
+		return nil
+	}
+}
+
+// limitedRuneReader
+// Reads runes from reader until more than limit bytes are read, or it is
+// stopped, after which it reads as if at the end of the text.
+type limitedRuneReader struct {
+	reader   io.RuneReader
+	limit    int
+	read     int
+	exceeded bool
+	stopped  int32
+}
+
+func (limited *limitedRuneReader) ReadRune() (rune, int, error) {
+	if atomic.LoadInt32(&limited.stopped) != 0 || limited.exceeded {
+		return 0, 0, io.EOF
+	}
+	r, size, err := limited.reader.ReadRune()
+	limited.read += size
+	if limited.limit > 0 && limited.read > limited.limit {
+		limited.exceeded = true
+		return 0, 0, io.EOF
+	}
+	return r, size, err
+}
+
+// EncodeReaderLimited
+// Encodes the text read from reader, as EncodeReader does, unless it is
+// longer than MaxInputBytes, or encodes to more than MaxOutputTokens
+// tokens, when it returns a LimitError instead. Encoding stops as soon as
+// either limit is exceeded, so that services can reject abusive requests
+// cheaply. Words are merged in pieces of at most MaxWordLength bytes, or
+// MAXWORD_SZ if it is unset, so that no single word is costly to merge
+// before the limits are checked again.
+func (encoder *GPTEncoder) EncodeReaderLimited(
+	reader io.RuneReader) (*Tokens, error) {
+	limited := &limitedRuneReader{reader: reader,
+		limit: encoder.MaxInputBytes}
+	framer := encoder.newBosEosFramer(encoder.BosEosPolicy())
+	nextWord := encoder.WordSplitter(limited)
+	tokens := make(Tokens, 0)
+	maxTokens := encoder.MaxOutputTokens
+	maxWordLength := encoder.MaxWordLength
+	if maxWordLength == 0 {
+		maxWordLength = MAXWORD_SZ
+	}
+	for word := nextWord(); word != nil; word = nextWord() {
+		pieces := []string{*word}
+		if len(*word) > maxWordLength {
+			pieces = splitLongWord(*word, maxWordLength)
+		}
+		for idx := range pieces {
+			tokens = append(tokens,
+				framer.next(encoder.encodeWord(&pieces[idx]))...)
+			if maxTokens > 0 && len(tokens) > maxTokens {
+				// The words that were already split are drained without
+				// being encoded, so that the splitter finishes.
+				atomic.StoreInt32(&limited.stopped, 1)
+				for word = nextWord(); word != nil; word = nextWord() {
+				}
+				return nil, &LimitError{ErrOutputTooLarge, maxTokens,
+					len(tokens)}
+			}
+		}
+	}
+	if limited.exceeded {
+		return nil, &LimitError{ErrInputTooLarge, limited.limit,
+			limited.read}
+	}
+	tokens = append(tokens, framer.end()...)
+	if maxTokens > 0 && len(tokens) > maxTokens {
+		return nil, &LimitError{ErrOutputTooLarge, maxTokens, len(tokens)}
+	}
+	return &tokens, nil
+}
+
+// EncodeLimited
+// Encodes text, as Encode does, unless it is longer than MaxInputBytes, or
+// encodes to more than MaxOutputTokens tokens, when it returns a LimitError
+// instead. Text that is too long is rejected before it is encoded.
+func (encoder *GPTEncoder) EncodeLimited(text *string) (*Tokens, error) {
+	if limit := encoder.MaxInputBytes; limit > 0 && len(*text) > limit {
+		return nil, &LimitError{ErrInputTooLarge, limit, len(*text)}
+	}
+	return encoder.EncodeReaderLimited(strings.NewReader(*text))
+}
@@ -0,0 +1,259 @@
+package gpt_bpe
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// MergeNode
+// A node of a MergeGraph: a piece of a word, or a token of the vocabulary,
+// in the printable form of the vocabulary, where spaces are Ġ. Pieces that
+// are merged have the Rank of their merge and the Left and Right nodes that
+// it joined, while the characters that words start from have a Rank, Left
+// and Right of -1. Token is -1 for pieces that are not in the vocabulary.
+type MergeNode struct {
+	Id    int    `json:"id"`
+	Piece string `json:"piece"`
+	Token int    `json:"token"`
+	Rank  int    `json:"rank"`
+	Left  int    `json:"left"`
+	Right int    `json:"right"`
+}
+
+// MergeCandidate
+// A pair of adjacent pieces that could be merged, and the rank of their
+// merge, or -1 if there is no merge of them.
+type MergeCandidate struct {
+	Left  string `json:"left"`
+	Right string `json:"right"`
+	Rank  int    `json:"rank"`
+}
+
+// MergeStep
+// A merge that was applied to a word, as the candidate of the lowest rank
+// among the pairs of adjacent pieces of the word at that step, all of which
+// are its Candidates, in order of their rank.
+type MergeStep struct {
+	MergeCandidate
+	Candidates []MergeCandidate `json:"candidates"`
+}
+
+// MergeGraph
+// The directed acyclic graph of the merges that built a word's tokens, or
+// every token of a vocabulary, from their characters. The Roots of a word
+// are the nodes of its tokens, in order, and its Steps the merges in the
+// order that they were applied. The graph of a vocabulary has a node for
+// each token that merges produce or join, joined by the first merge to
+// produce it, and lists the merges that can never apply, as a part or their
+// result is not in the vocabulary, as Invalid.
+type MergeGraph struct {
+	Word    string           `json:"word,omitempty"`
+	Nodes   []MergeNode      `json:"nodes"`
+	Roots   []int            `json:"roots,omitempty"`
+	Steps   []MergeStep      `json:"steps,omitempty"`
+	Invalid []MergeCandidate `json:"invalid,omitempty"`
+}
+
+// addNode adds a node of piece to the graph, returning its id.
+func (graph *MergeGraph) addNode(encoder *GPTEncoder, piece string,
+	rank int, left int, right int) int {
+	token := -1
+	if id, ok := encoder.encoder[piece]; ok {
+		token = int(id)
+	}
+	graph.Nodes = append(graph.Nodes, MergeNode{Id: len(graph.Nodes),
+		Piece: piece, Token: token, Rank: rank, Left: left, Right: right})
+	return len(graph.Nodes) - 1
+}
+
+// mergeRank returns the rank of the merge of left and right, or -1.
+func (encoder *GPTEncoder) mergeRank(left string, right string) int {
+	if rank, ok := encoder.bpe_ranks[GPTPair{left, right}]; ok {
+		return int(rank)
+	}
+	return -1
+}
+
+// checkMerges returns an error if the encoder does not encode by merges.
+func (encoder *GPTEncoder) checkMerges() error {
+	if len(encoder.bpe_ranks) == 0 || encoder.mergeMode != MergeBPE {
+		return errors.New("the encoder does not encode by merges")
+	}
+	return nil
+}
+
+// ExplainMerges
+// Splits text into words as Encode does, and returns the MergeGraph of each
+// word, tracing the merges that build its tokens and the candidates that
+// each merge won over.
+func (encoder *GPTEncoder) ExplainMerges(text string) ([]MergeGraph,
+	error) {
+	if err := encoder.checkMerges(); err != nil {
+		return nil, err
+	}
+	graphs := make([]MergeGraph, 0)
+	for _, word := range *encoder.SplitWords(&text) {
+		graphs = append(graphs, encoder.explainWord(word))
+	}
+	return graphs, nil
+}
+
+// explainWord returns the MergeGraph of word, merging its pieces as toBPE
+// does: all the occurrences of the pair of the lowest rank at each step.
+func (encoder *GPTEncoder) explainWord(word string) MergeGraph {
+	graph := MergeGraph{Word: word}
+	if specialToken, isSpecial := encoder.specials[word]; isSpecial &&
+		encoder.specialsPolicy == SpecialsAllow {
+		piece := string(encoder.decoder[specialToken[0]])
+		graph.Roots = []int{graph.addNode(encoder, piece, -1, -1, -1)}
+		return graph
+	}
+	pieces := strings.Split(encoder.toUnicode(&word), "")
+	pieces[len(pieces)-1] += encoder.endOfWord
+	ids := make([]int, len(pieces))
+	for idx, piece := range pieces {
+		ids[idx] = graph.addNode(encoder, piece, -1, -1, -1)
+	}
+	for len(pieces) > 1 {
+		candidates := make([]MergeCandidate, 0, len(pieces)-1)
+		seen := make(map[GPTPair]bool)
+		for idx := 1; idx < len(pieces); idx++ {
+			pair := GPTPair{pieces[idx-1], pieces[idx]}
+			if !seen[pair] {
+				seen[pair] = true
+				candidates = append(candidates, MergeCandidate{pair.left,
+					pair.right, encoder.mergeRank(pair.left, pair.right)})
+			}
+		}
+		// Pairs without a merge are ordered last.
+		sort.SliceStable(candidates, func(i, j int) bool {
+			return uint(candidates[i].Rank) < uint(candidates[j].Rank)
+		})
+		merge := candidates[0]
+		if merge.Rank < 0 {
+			break
+		}
+		graph.Steps = append(graph.Steps, MergeStep{merge, candidates})
+		mergedPieces := make([]string, 0, len(pieces))
+		mergedIds := make([]int, 0, len(pieces))
+		for idx := 0; idx < len(pieces); {
+			if idx < len(pieces)-1 && pieces[idx] == merge.Left &&
+				pieces[idx+1] == merge.Right {
+				mergedPieces = append(mergedPieces, merge.Left+merge.Right)
+				mergedIds = append(mergedIds, graph.addNode(encoder,
+					merge.Left+merge.Right, merge.Rank, ids[idx], ids[idx+1]))
+				idx += 2
+			} else {
+				mergedPieces = append(mergedPieces, pieces[idx])
+				mergedIds = append(mergedIds, ids[idx])
+				idx++
+			}
+		}
+		pieces, ids = mergedPieces, mergedIds
+	}
+	graph.Roots = ids
+	return graph
+}
+
+// VocabMergeGraph
+// Returns the MergeGraph of every merge of the encoder, for debugging merge
+// tables, such as those of converted tokenizers.
+func (encoder *GPTEncoder) VocabMergeGraph() (*MergeGraph, error) {
+	if err := encoder.checkMerges(); err != nil {
+		return nil, err
+	}
+	merges := make([]MergeCandidate, 0, len(encoder.bpe_ranks))
+	for pair, rank := range encoder.bpe_ranks {
+		merges = append(merges, MergeCandidate{pair.left, pair.right,
+			int(rank)})
+	}
+	sort.Slice(merges, func(i, j int) bool {
+		if merges[i].Rank != merges[j].Rank {
+			return merges[i].Rank < merges[j].Rank
+		}
+		return merges[i].Left+merges[i].Right <
+			merges[j].Left+merges[j].Right
+	})
+	graph := &MergeGraph{}
+	nodes := make(map[string]int)
+	node := func(piece string) int {
+		if id, ok := nodes[piece]; ok {
+			return id
+		}
+		nodes[piece] = graph.addNode(encoder, piece, -1, -1, -1)
+		return nodes[piece]
+	}
+	for _, merge := range merges {
+		_, leftOk := encoder.encoder[merge.Left]
+		_, rightOk := encoder.encoder[merge.Right]
+		_, mergedOk := encoder.encoder[merge.Left+merge.Right]
+		if !leftOk || !rightOk || !mergedOk {
+			graph.Invalid = append(graph.Invalid, merge)
+			continue
+		}
+		left, right := node(merge.Left), node(merge.Right)
+		merged := node(merge.Left + merge.Right)
+		// Merges are visited in order of rank, so the first merge to
+		// produce a token is the one that is kept.
+		if graph.Nodes[merged].Rank < 0 && merged != left &&
+			merged != right {
+			graph.Nodes[merged].Rank = merge.Rank
+			graph.Nodes[merged].Left = left
+			graph.Nodes[merged].Right = right
+		}
+	}
+	return graph, nil
+}
+
+// WriteMergeGraphsDOT
+// Writes graphs to writer as a Graphviz DOT digraph, with the characters at
+// the bottom and the edges of each merge pointing up from its parts to the
+// piece that it produces. Each word's graph is a cluster of its own, and its
+// tokens are drawn as boxes.
+func WriteMergeGraphsDOT(writer io.Writer, graphs []MergeGraph) error {
+	bufWriter := bufio.NewWriter(writer)
+	bufWriter.WriteString("digraph merges {\n\trankdir=BT;\n" +
+		"\tnode [shape=ellipse, fontname=\"monospace\"];\n")
+	for graphIdx, graph := range graphs {
+		indent := "\t"
+		if graph.Word != "" {
+			fmt.Fprintf(bufWriter, "\tsubgraph cluster_%d {\n\t\tlabel=%s;\n",
+				graphIdx, strconv.Quote(graph.Word))
+			indent = "\t\t"
+		}
+		roots := make(map[int]bool, len(graph.Roots))
+		for _, root := range graph.Roots {
+			roots[root] = true
+		}
+		for _, node := range graph.Nodes {
+			label := node.Piece
+			if node.Rank >= 0 {
+				label += fmt.Sprintf("\nrank %d", node.Rank)
+			}
+			if node.Token >= 0 {
+				label += fmt.Sprintf("\ntoken %d", node.Token)
+			}
+			shape := ""
+			if roots[node.Id] {
+				shape = ", shape=box"
+			}
+			fmt.Fprintf(bufWriter, "%sg%d_n%d [label=%s%s];\n", indent,
+				graphIdx, node.Id, strconv.Quote(label), shape)
+			if node.Left >= 0 {
+				fmt.Fprintf(bufWriter, "%sg%d_n%d -> g%d_n%d;\n%sg%d_n%d -> "+
+					"g%d_n%d;\n", indent, graphIdx, node.Left, graphIdx,
+					node.Id, indent, graphIdx, node.Right, graphIdx, node.Id)
+			}
+		}
+		if graph.Word != "" {
+			bufWriter.WriteString("\t}\n")
+		}
+	}
+	bufWriter.WriteString("}\n")
+	return bufWriter.Flush()
+}
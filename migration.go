@@ -0,0 +1,143 @@
+package gpt_bpe
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// TokenMigration
+// The tokens of one version of a tokenizer's data that are changed in a
+// later version, so that token streams that were encoded with the older
+// data can be read with the newer. Changed maps each token whose id moved,
+// or that was split, to the tokens of the newer version that decode to the
+// same bytes, and tokens that are not in Changed keep their ids. Unmapped
+// lists the tokens that the newer version cannot spell, such as special
+// tokens that were removed.
+type TokenMigration struct {
+	Tokenizer       string           `json:"tokenizer"`
+	From            int              `json:"from"`
+	To              int              `json:"to"`
+	FromFingerprint string           `json:"from_fingerprint"`
+	ToFingerprint   string           `json:"to_fingerprint"`
+	Changed         map[Token]Tokens `json:"changed"`
+	Unmapped        Tokens           `json:"unmapped"`
+}
+
+// EmbeddedMigrations
+// The published migrations of the embedded tokenizers, from each version of
+// their data to the next. Whenever a version in EmbeddedDataVersions is
+// raised, the migration from the previous version, as NewTokenMigration
+// builds it, is added here, so that datasets that were tokenized with older
+// data remain interpretable. Every embedded tokenizer is still at its first
+// version.
+var EmbeddedMigrations = []TokenMigration{}
+
+// NewTokenMigration
+// Builds the migration of the tokenizer from version from of its data, as
+// the older encoder has it, to version to, as the newer encoder has it, by
+// aligning the older vocabulary to the newer as AlignVocabularies does.
+func NewTokenMigration(tokenizer string, from int, to int, older *GPTEncoder,
+	newer *GPTEncoder) (*TokenMigration, error) {
+	if to <= from {
+		return nil, fmt.Errorf("%w: %s data version %d does not follow %d",
+			ErrMigrationMissing, tokenizer, to, from)
+	}
+	alignment := AlignVocabularies(older, newer)
+	migration := &TokenMigration{
+		Tokenizer:       tokenizer,
+		From:            from,
+		To:              to,
+		FromFingerprint: alignment.DraftFingerprint,
+		ToFingerprint:   alignment.TargetFingerprint,
+		Changed:         make(map[Token]Tokens),
+		Unmapped:        alignment.Unmapped,
+	}
+	for _, aligned := range alignment.Tokens {
+		if !aligned.Exact || aligned.Target[0] != aligned.Draft {
+			migration.Changed[aligned.Draft] = aligned.Target
+		}
+	}
+	return migration, nil
+}
+
+// ReadTokenMigration
+// Reads a migration that was published as JSON, as WriteJSON writes it.
+func ReadTokenMigration(reader io.Reader) (*TokenMigration, error) {
+	migration := &TokenMigration{}
+	if err := json.NewDecoder(reader).Decode(migration); err != nil {
+		return nil, fmt.Errorf("%w: error reading token migration: %v",
+			ErrResourceInvalid, err)
+	}
+	return migration, nil
+}
+
+// WriteJSON
+// Writes the migration as indented JSON, for publishing along with the
+// newer version of the tokenizer's data.
+func (migration *TokenMigration) WriteJSON(writer io.Writer) error {
+	encoder := json.NewEncoder(writer)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(migration)
+}
+
+// Apply
+// Translates tokens from the older version of the data to the newer, and
+// fails with ErrTokenOutOfRange if one of them cannot be spelled by the
+// newer version.
+func (migration *TokenMigration) Apply(tokens *Tokens) (*Tokens, error) {
+	unmapped := make(map[Token]bool, len(migration.Unmapped))
+	for _, token := range migration.Unmapped {
+		unmapped[token] = true
+	}
+	migrated := make(Tokens, 0, len(*tokens))
+	for _, token := range *tokens {
+		if unmapped[token] {
+			return nil, fmt.Errorf("%w: token %d of %s data version %d "+
+				"is not in version %d", ErrTokenOutOfRange, token,
+				migration.Tokenizer, migration.From, migration.To)
+		} else if changed, ok := migration.Changed[token]; ok {
+			migrated = append(migrated, changed...)
+		} else {
+			migrated = append(migrated, token)
+		}
+	}
+	return &migrated, nil
+}
+
+// MigrateTokens
+// Translates tokens that were encoded with version from of the embedded
+// tokenizer's data to version to, by applying each of EmbeddedMigrations
+// between them in turn. Tokens are only migrated forward, and fail with
+// ErrMigrationMissing when a migration between the versions is not
+// published.
+func MigrateTokens(tokenizer string, from int, to int,
+	tokens *Tokens) (*Tokens, error) {
+	if to < from {
+		return nil, fmt.Errorf("%w: %s cannot be migrated back from data "+
+			"version %d to %d", ErrMigrationMissing, tokenizer, from, to)
+	}
+	migrated := append(Tokens{}, *tokens...)
+	for version := from; version < to; {
+		var step *TokenMigration
+		for idx := range EmbeddedMigrations {
+			migration := &EmbeddedMigrations[idx]
+			if migration.Tokenizer == tokenizer &&
+				migration.From == version {
+				step = migration
+				break
+			}
+		}
+		if step == nil || step.To > to {
+			return nil, fmt.Errorf("%w: %s from data version %d",
+				ErrMigrationMissing, tokenizer, version)
+		}
+		next, err := step.Apply(&migrated)
+		if err != nil {
+			return nil, err
+		}
+		migrated = *next
+		version = step.To
+	}
+	return &migrated, nil
+}
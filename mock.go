@@ -0,0 +1,189 @@
+package gpt_bpe
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+const (
+	// MOCK_EOS_TOKEN is the end of text token of a MockEncoder.
+	MOCK_EOS_TOKEN Token = 0
+	// MOCK_UNK_TOKEN is the token of the words that a MockEncoder has no
+	// room left in its vocabulary for.
+	MOCK_UNK_TOKEN Token = 1
+)
+
+// MockEncoder
+// A small deterministic encoder for unit tests of code that counts or budgets
+// tokens, which needs no vocabulary files. Text is split into words on
+// whitespace, each word keeping the whitespace before it so that decoding
+// returns the text exactly, and each word is its own token. Words are given
+// ids in the order that they are first seen, after the words the encoder was
+// created with, so the same inputs always encode to the same tokens.
+type MockEncoder struct {
+	EosToken  Token
+	mutex     sync.RWMutex
+	words     map[string]Token
+	decoder   []string
+	maxTokens int
+	// seeded is the number of words given ids when the encoder was created.
+	seeded int
+}
+
+// NewMockEncoder
+// Creates a MockEncoder, with words given the ids following the special
+// tokens in the order that they are passed.
+func NewMockEncoder(words ...string) *MockEncoder {
+	encoder := &MockEncoder{
+		EosToken:  MOCK_EOS_TOKEN,
+		words:     make(map[string]Token, len(words)+2),
+		decoder:   make([]string, 0, len(words)+2),
+		maxTokens: 1 << 16,
+	}
+	encoder.add("<|endoftext|>")
+	encoder.add("<|unk|>")
+	for _, word := range words {
+		encoder.add(word)
+	}
+	encoder.seeded = len(encoder.decoder)
+	return encoder
+}
+
+// add returns the token of word, giving it the next id if it has none.
+// The caller must hold the write lock.
+func (encoder *MockEncoder) add(word string) Token {
+	if token, ok := encoder.words[word]; ok {
+		return token
+	}
+	if len(encoder.decoder) >= encoder.maxTokens {
+		return MOCK_UNK_TOKEN
+	}
+	token := Token(len(encoder.decoder))
+	encoder.words[word] = token
+	encoder.decoder = append(encoder.decoder, word)
+	return token
+}
+
+// SplitWords
+// Splits text into words, each with the whitespace that precedes it. Any
+// trailing whitespace is a word of its own.
+func (encoder *MockEncoder) SplitWords(text *string) *[]string {
+	words := make([]string, 0)
+	begin := 0
+	inWord := false
+	for idx, r := range *text {
+		isSpace := unicode.IsSpace(r)
+		if isSpace && inWord {
+			words = append(words, (*text)[begin:idx])
+			begin = idx
+		}
+		inWord = !isSpace
+	}
+	if begin < len(*text) {
+		words = append(words, (*text)[begin:])
+	}
+	return &words
+}
+
+// Encode
+// Encodes text into tokens, one for each word.
+func (encoder *MockEncoder) Encode(text *string) *Tokens {
+	words := encoder.SplitWords(text)
+	tokens := make(Tokens, 0, len(*words))
+	encoder.mutex.Lock()
+	defer encoder.mutex.Unlock()
+	for _, word := range *words {
+		tokens = append(tokens, encoder.add(word))
+	}
+	return &tokens
+}
+
+// EncodeReader
+// Encodes the text read from reader into tokens, as Encode does.
+func (encoder *MockEncoder) EncodeReader(reader io.RuneReader) *Tokens {
+	var builder strings.Builder
+	for {
+		r, _, err := reader.ReadRune()
+		if err != nil {
+			break
+		}
+		builder.WriteRune(r)
+	}
+	text := builder.String()
+	return encoder.Encode(&text)
+}
+
+// Get
+// Returns the token of a word that has been seen, or nil.
+func (encoder *MockEncoder) Get(text string) *Token {
+	encoder.mutex.RLock()
+	defer encoder.mutex.RUnlock()
+	if token, ok := encoder.words[text]; ok {
+		return &token
+	}
+	return nil
+}
+
+// Decode
+// Decodes tokens back into the text that they were encoded from.
+func (encoder *MockEncoder) Decode(encoded *Tokens) string {
+	var builder strings.Builder
+	encoder.mutex.RLock()
+	defer encoder.mutex.RUnlock()
+	for _, token := range *encoded {
+		if int(token) < len(encoder.decoder) {
+			builder.WriteString(encoder.decoder[token])
+		}
+	}
+	return builder.String()
+}
+
+// CheckTokens
+// Returns an ErrTokenOutOfRange error for the first of tokens that the
+// encoder has not given to a word.
+func (encoder *MockEncoder) CheckTokens(tokens *Tokens) error {
+	encoder.mutex.RLock()
+	defer encoder.mutex.RUnlock()
+	for idx, token := range *tokens {
+		if int(token) >= len(encoder.decoder) {
+			return fmt.Errorf("%w: token %d at index %d",
+				ErrTokenOutOfRange, token, idx)
+		}
+	}
+	return nil
+}
+
+// Count
+// Returns the number of tokens that text encodes to, without giving ids to
+// the words that have not been seen.
+func (encoder *MockEncoder) Count(text *string) int {
+	return len(*encoder.SplitWords(text))
+}
+
+// Specials
+// Returns the encoder's special tokens, by their text.
+func (encoder *MockEncoder) Specials() map[string]Tokens {
+	return map[string]Tokens{
+		"<|endoftext|>": {MOCK_EOS_TOKEN},
+		"<|unk|>":       {MOCK_UNK_TOKEN},
+	}
+}
+
+// Fingerprint
+// Returns a hex encoded SHA-256 digest of the words that the encoder was
+// created with, which along with the order that words are seen in determine
+// its tokens.
+func (encoder *MockEncoder) Fingerprint() string {
+	h := sha256.New()
+	writeFingerprintString(h, "mock")
+	writeFingerprintUint(h, uint64(encoder.seeded))
+	for _, word := range encoder.decoder[:encoder.seeded] {
+		writeFingerprintString(h, word)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
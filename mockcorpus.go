@@ -0,0 +1,253 @@
+package gpt_bpe
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// mockScript is a script that mock corpora draw words from: the ranges of
+// its runes, whether its words are separated by spaces, and the punctuation
+// that ends its lines.
+type mockScript struct {
+	ranges      [][2]rune
+	spaced      bool
+	punctuation []string
+}
+
+// MockScripts are the names of the scripts that a MockCorpus can mix.
+var MockScripts = []string{"arabic", "cjk", "cyrillic", "devanagari",
+	"digits", "greek", "hangul", "hebrew", "kana", "latin", "latin_ext"}
+
+// mockScripts are the scripts of MockScripts, by their name.
+var mockScripts = map[string]mockScript{
+	"arabic":     {[][2]rune{{0x0628, 0x064a}}, true, []string{".", "؟", "،"}},
+	"cjk":        {[][2]rune{{0x4e00, 0x9fff}}, false, []string{"。", "，", "！"}},
+	"cyrillic":   {[][2]rune{{0x0430, 0x044f}}, true, []string{".", ",", "!"}},
+	"devanagari": {[][2]rune{{0x0915, 0x0939}}, true, []string{"।", ","}},
+	"digits":     {[][2]rune{{'0', '9'}}, true, []string{".", ",", "%"}},
+	"greek":      {[][2]rune{{0x03b1, 0x03c9}}, true, []string{".", ";", ","}},
+	"hangul":     {[][2]rune{{0xac00, 0xd7a3}}, true, []string{".", "?", ","}},
+	"hebrew":     {[][2]rune{{0x05d0, 0x05ea}}, true, []string{".", ","}},
+	"kana":       {[][2]rune{{0x3041, 0x3096}}, false, []string{"。", "、"}},
+	"latin":      {[][2]rune{{'a', 'z'}}, true, []string{".", ",", "?", "!"}},
+	"latin_ext": {[][2]rune{{'a', 'z'}, {0x00e0, 0x00f6}, {0x00f8, 0x00ff}},
+		true, []string{".", ",", "?", "!"}},
+}
+
+// MockEmoji are the emoji that mock corpora mix into their text, from single
+// runes to modified, flag and ZWJ sequences of several.
+var MockEmoji = []string{"😀", "🎉", "🤖", "❤️", "👍🏽", "🇯🇵", "🏳️‍🌈",
+	"👩‍👩‍👧‍👦"}
+
+// MockSpecialLookalikes are texts that resemble special tokens without being
+// any, which must be encoded as ordinary text.
+var MockSpecialLookalikes = []string{"<|endoftext|", "|endoftext|>",
+	"< |endoftext|>", "<|endoftext |>", "<|ENDOFTEXT|>", "<|endoftxet|>",
+	"<｜endoftext｜>", "<|endof<|text|>", "[CLS ]", "</ s>"}
+
+// MockCorpusOptions
+// The properties of the documents of a MockCorpus. Scripts weighs the
+// scripts of MockScripts that each line is written in, line lengths are
+// counted in runes, EmojiDensity is the chance of each word being an emoji,
+// and LookalikeDensity the chance of each line holding one of
+// MockSpecialLookalikes.
+type MockCorpusOptions struct {
+	Seed             int64
+	Scripts          map[string]int
+	MinLines         int
+	MaxLines         int
+	MinLineLength    int
+	MaxLineLength    int
+	EmojiDensity     float64
+	LookalikeDensity float64
+}
+
+// DefaultMockCorpusOptions
+// Returns the options of a mostly Latin corpus of paragraphs, with a little
+// of other scripts, emoji and special token lookalikes.
+func DefaultMockCorpusOptions() MockCorpusOptions {
+	return MockCorpusOptions{
+		Seed:             1,
+		Scripts:          map[string]int{"latin": 80, "cyrillic": 10, "cjk": 10},
+		MinLines:         1,
+		MaxLines:         8,
+		MinLineLength:    20,
+		MaxLineLength:    120,
+		EmojiDensity:     0.01,
+		LookalikeDensity: 0.01,
+	}
+}
+
+// ParseScriptMix
+// Parses a comma separated list of scripts and their weights, such as
+// "latin:80,cjk:20". Scripts without a weight weigh 1.
+func ParseScriptMix(spec string) (map[string]int, error) {
+	mix := make(map[string]int)
+	for _, item := range strings.Split(spec, ",") {
+		parts := strings.SplitN(strings.TrimSpace(item), ":", 2)
+		weight := 1
+		if len(parts) == 2 {
+			var err error
+			if weight, err = strconv.Atoi(parts[1]); err != nil {
+				return nil, errors.New(fmt.Sprintf("invalid weight of "+
+					"script %s: %s", parts[0], parts[1]))
+			}
+		}
+		mix[parts[0]] = weight
+	}
+	return mix, nil
+}
+
+// MockCorpus
+// A generator of synthetic documents of controlled properties, for
+// benchmarking and regression testing of encoders and dataset pipelines.
+// The documents are determined by the options, and their Seed, alone.
+type MockCorpus struct {
+	options MockCorpusOptions
+	rng     *rand.Rand
+	scripts []string
+	weights []int
+	total   int
+}
+
+// NewMockCorpus
+// Creates a MockCorpus of options, returning an error if they are invalid.
+func NewMockCorpus(options MockCorpusOptions) (*MockCorpus, error) {
+	corpus := &MockCorpus{options: options,
+		rng: rand.New(rand.NewSource(options.Seed))}
+	// Scripts are weighed in order of their names, as the iteration order of
+	// maps is random.
+	for _, name := range MockScripts {
+		weight, ok := options.Scripts[name]
+		if !ok || weight == 0 {
+			continue
+		} else if weight < 0 {
+			return nil, errors.New(fmt.Sprintf("negative weight of script "+
+				"%s", name))
+		}
+		corpus.scripts = append(corpus.scripts, name)
+		corpus.weights = append(corpus.weights, weight)
+		corpus.total += weight
+	}
+	for name := range options.Scripts {
+		if _, ok := mockScripts[name]; !ok {
+			return nil, errors.New(fmt.Sprintf("unknown script %s, expected "+
+				"one of %s", name, strings.Join(MockScripts, ", ")))
+		}
+	}
+	switch {
+	case corpus.total == 0:
+		return nil, errors.New("a script with a positive weight is required")
+	case options.MinLines < 1 || options.MaxLines < options.MinLines:
+		return nil, errors.New(fmt.Sprintf("invalid lines range %d-%d",
+			options.MinLines, options.MaxLines))
+	case options.MinLineLength < 1 ||
+		options.MaxLineLength < options.MinLineLength:
+		return nil, errors.New(fmt.Sprintf("invalid line length range "+
+			"%d-%d", options.MinLineLength, options.MaxLineLength))
+	case options.EmojiDensity < 0 || options.EmojiDensity > 1:
+		return nil, errors.New(fmt.Sprintf("invalid emoji density %v",
+			options.EmojiDensity))
+	case options.LookalikeDensity < 0 || options.LookalikeDensity > 1:
+		return nil, errors.New(fmt.Sprintf("invalid lookalike density %v",
+			options.LookalikeDensity))
+	}
+	return corpus, nil
+}
+
+// between returns a random int from min to max, inclusive.
+func (corpus *MockCorpus) between(min int, max int) int {
+	return min + corpus.rng.Intn(max-min+1)
+}
+
+// script returns a script of the corpus, by the weights of its scripts.
+func (corpus *MockCorpus) script() mockScript {
+	pick := corpus.rng.Intn(corpus.total)
+	for idx, weight := range corpus.weights {
+		if pick < weight {
+			return mockScripts[corpus.scripts[idx]]
+		}
+		pick -= weight
+	}
+	return mockScripts[corpus.scripts[len(corpus.scripts)-1]]
+}
+
+// word returns a word of script, of one to eight runes of its ranges, or
+// of up to four for scripts without spaces between their words.
+func (corpus *MockCorpus) word(script mockScript) string {
+	length := corpus.between(1, 8)
+	if !script.spaced {
+		length = corpus.between(1, 4)
+	}
+	var builder strings.Builder
+	for idx := 0; idx < length; idx++ {
+		r := script.ranges[corpus.rng.Intn(len(script.ranges))]
+		builder.WriteRune(r[0] + rune(corpus.rng.Intn(int(r[1]-r[0]+1))))
+	}
+	return builder.String()
+}
+
+// line returns a line of one script, of words until it reaches a random
+// length of the line lengths of the corpus, ending with the script's
+// punctuation.
+func (corpus *MockCorpus) line() string {
+	script := corpus.script()
+	length := corpus.between(corpus.options.MinLineLength,
+		corpus.options.MaxLineLength)
+	words := make([]string, 0)
+	runes := 0
+	for runes < length {
+		var word string
+		if corpus.rng.Float64() < corpus.options.EmojiDensity {
+			word = MockEmoji[corpus.rng.Intn(len(MockEmoji))]
+		} else {
+			word = corpus.word(script)
+		}
+		words = append(words, word)
+		runes += utf8.RuneCountInString(word) + 1
+	}
+	if corpus.rng.Float64() < corpus.options.LookalikeDensity {
+		lookalike := MockSpecialLookalikes[corpus.rng.Intn(
+			len(MockSpecialLookalikes))]
+		words[corpus.rng.Intn(len(words))] = lookalike
+	}
+	separator := ""
+	if script.spaced {
+		separator = " "
+	}
+	return strings.Join(words, separator) +
+		script.punctuation[corpus.rng.Intn(len(script.punctuation))]
+}
+
+// Document
+// Returns the next document of the corpus, of lines separated by newlines.
+// Documents have no blank lines, so that they can be joined by them.
+func (corpus *MockCorpus) Document() string {
+	lines := make([]string, corpus.between(corpus.options.MinLines,
+		corpus.options.MaxLines))
+	for idx := range lines {
+		lines[idx] = corpus.line()
+	}
+	return strings.Join(lines, "\n")
+}
+
+// WriteDocuments
+// Writes the next count documents of the corpus to writer, each followed by
+// separator, and returns the number of bytes written.
+func (corpus *MockCorpus) WriteDocuments(writer io.Writer, count int,
+	separator string) (int, error) {
+	written := 0
+	for idx := 0; idx < count; idx++ {
+		n, err := io.WriteString(writer, corpus.Document()+separator)
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
@@ -0,0 +1,101 @@
+package gpt_bpe
+
+import (
+	"bytes"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Span
+// A byte range of the original text that a token was encoded from, from
+// EncodeWithOffsets. Start is inclusive and End exclusive.
+type Span struct {
+	Start int
+	End   int
+}
+
+// normalizeForEncoding returns how the encoder normalizes r before splitting
+// text into words, by its replacements, normalizer, case folding and lower
+// casing.
+func (encoder *GPTEncoder) normalizeForEncoding(r rune) string {
+	normalized := string(r)
+	if replacement, ok := encoder.replacements[normalized]; ok {
+		normalized = replacement
+	}
+	if encoder.Normalizer != nil {
+		normalized = encoder.Normalizer.Replace(normalized)
+	}
+	normalized = CaseFold(normalized, encoder.caseFolding)
+	if encoder.lowerCase {
+		normalized = strings.ToLower(normalized)
+	}
+	return normalized
+}
+
+// EncodeWithOffsets
+// Encodes text as Encode does, and returns with the tokens the span of the
+// original text that each was encoded from, for aligning tokens with
+// annotations of the text such as named entities. Tokens that encode part
+// of a character, such as the byte fallback tokens of rare characters, have
+// the span of their bytes, special tokens have the span of their text, and
+// the BOS and EOS tokens that the encoder adds have empty spans where they
+// are added. The spans are found by matching the bytes of each token against
+// the text as the encoder normalizes it, one character at a time, so a token
+// whose bytes are not in the text, such as one from a normalizer that
+// rewrites a sequence of characters, has an empty span at the end of the
+// span before it.
+func (encoder *GPTEncoder) EncodeWithOffsets(text string) (Tokens, []Span) {
+	tokens := *encoder.Encode(&text)
+	spans := make([]Span, len(tokens))
+
+	// The normalized text, with the range in text of each of its bytes.
+	var normalizedBuilder strings.Builder
+	starts := make([]int, 0, len(text)+1)
+	ends := make([]int, 0, len(text)+1)
+	for offset, r := range text {
+		piece := encoder.normalizeForEncoding(r)
+		normalizedBuilder.WriteString(piece)
+		_, size := utf8.DecodeRuneInString(text[offset:])
+		for idx := 0; idx < len(piece); idx++ {
+			if piece == text[offset:offset+size] {
+				// Unchanged characters map byte for byte.
+				starts = append(starts, offset+idx)
+				ends = append(ends, offset+idx+1)
+			} else {
+				starts = append(starts, offset)
+				ends = append(ends, offset+size)
+			}
+		}
+	}
+	normalized := normalizedBuilder.String()
+	starts = append(starts, len(text))
+
+	cursor := 0
+	for idx, token := range tokens {
+		tokenBytes := encoder.TokenBytes(token)
+		if encoder.endOfWord != "" {
+			tokenBytes = bytes.TrimSuffix(tokenBytes, []byte(encoder.endOfWord))
+		}
+		start := cursor
+		// Whitespace that the encoder drops from words is skipped.
+		for start < len(normalized) && len(tokenBytes) > 0 &&
+			!strings.HasPrefix(normalized[start:], string(tokenBytes)) {
+			r, size := utf8.DecodeRuneInString(normalized[start:])
+			if !unicode.IsSpace(r) {
+				break
+			}
+			start += size
+		}
+		if len(tokenBytes) == 0 ||
+			!strings.HasPrefix(normalized[start:], string(tokenBytes)) {
+			// Added BOS and EOS tokens, and tokens that are not in the
+			// text as normalized, are given an empty span.
+			spans[idx] = Span{starts[cursor], starts[cursor]}
+			continue
+		}
+		cursor = start + len(tokenBytes)
+		spans[idx] = Span{starts[start], ends[cursor-1]}
+	}
+	return tokens, spans
+}
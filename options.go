@@ -0,0 +1,123 @@
+package gpt_bpe
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	lru "github.com/hashicorp/golang-lru"
+)
+
+// SpecialsPolicy
+// Determines how special tokens that appear in the text are encoded.
+type SpecialsPolicy uint
+
+const (
+	// SpecialsAllow encodes special tokens in the text as their token.
+	SpecialsAllow SpecialsPolicy = iota
+	// SpecialsAsText encodes special tokens in the text as ordinary text,
+	// so that untrusted input cannot inject them.
+	SpecialsAsText SpecialsPolicy = iota
+)
+
+// Option
+// Configures an encoder created by NewEncoderWithOptions.
+type Option func(encoder *GPTEncoder) error
+
+// NewEncoderWithOptions
+// Returns a GPTEncoder with the tokenizer data loaded for that vocabulary id,
+// as NewEncoder does, configured by each of the options in turn.
+func NewEncoderWithOptions(vocabId string, opts ...Option) (*GPTEncoder,
+	error) {
+	encoder, err := NewEncoder(vocabId)
+	if err != nil {
+		return nil, err
+	}
+	for _, opt := range opts {
+		if err := opt(encoder); err != nil {
+			return nil, err
+		}
+	}
+	return encoder, nil
+}
+
+// WithCacheSize
+// Sets the number of words whose BPE merges are cached, which defaults to
+// BPE_LRU_SZ.
+func WithCacheSize(size int) Option {
+	return func(encoder *GPTEncoder) error {
+		cache, err := lru.NewARC(size)
+		if err != nil {
+			return errors.New(fmt.Sprintf("invalid cache size %d: %v",
+				size, err))
+		}
+		encoder.cache = cache
+		encoder.LruSize = size
+		return nil
+	}
+}
+
+// WithPreTokenizer
+// Sets the pre-tokenizer that splits text into words, as SetPreTokenizer
+// does.
+func WithPreTokenizer(preTokenizer PreTokenizer) Option {
+	return func(encoder *GPTEncoder) error {
+		encoder.SetPreTokenizer(preTokenizer)
+		return nil
+	}
+}
+
+// WithSpecialsPolicy
+// Sets how special tokens that appear in the text are encoded, as
+// SetSpecialsPolicy does.
+func WithSpecialsPolicy(policy SpecialsPolicy) Option {
+	return func(encoder *GPTEncoder) error {
+		return encoder.SetSpecialsPolicy(policy)
+	}
+}
+
+// WithNormalizer
+// Sets the replacements that are applied to text before it is split into
+// words, in place of the tokenizer's own.
+func WithNormalizer(normalizer *strings.Replacer) Option {
+	return func(encoder *GPTEncoder) error {
+		encoder.Normalizer = normalizer
+		return nil
+	}
+}
+
+// WithMaxWordLength
+// Sets the longest word in bytes that is merged whole, where longer words
+// are split. Zero, the default, disables the cap, and MAXWORD_SZ suits
+// encoders of untrusted input.
+func WithMaxWordLength(length int) Option {
+	return func(encoder *GPTEncoder) error {
+		if length < 0 {
+			return errors.New(fmt.Sprintf("invalid max word length %d",
+				length))
+		}
+		encoder.MaxWordLength = length
+		return nil
+	}
+}
+
+// SetSpecialsPolicy
+// Sets how special tokens that appear in the text are encoded, which
+// changes the encoder's fingerprint.
+func (encoder *GPTEncoder) SetSpecialsPolicy(policy SpecialsPolicy) error {
+	switch policy {
+	case SpecialsAllow:
+		encoder.specialsPolicy = policy
+		encoder.specialsTree = encoder.createRuneTree()
+	case SpecialsAsText:
+		encoder.specialsPolicy = policy
+		// No special tokens are found in the text.
+		encoder.specialsTree = &RuneNode{
+			runes:  []rune{},
+			childs: make(map[rune]*RuneNode, 0),
+		}
+	default:
+		return errors.New(fmt.Sprintf("invalid specials policy %d", policy))
+	}
+	return nil
+}
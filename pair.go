@@ -0,0 +1,61 @@
+package gpt_bpe
+
+// PairTemplate
+// The special tokens that a tokenizer family places around a text, or a pair
+// of texts, for models such as rerankers and cross-encoders. A single text is
+// encoded as Start, the text, then End, and the second text of a pair
+// follows as PairStart, the text, then PairEnd.
+type PairTemplate struct {
+	Start     Tokens
+	End       Tokens
+	PairStart Tokens
+	PairEnd   Tokens
+}
+
+// WithPairTemplate
+// Sets the template that EncodePair and EncodeInputs place texts in, in
+// place of the template detected from the tokenizer.
+func WithPairTemplate(template PairTemplate) Option {
+	return func(encoder *GPTEncoder) error {
+		encoder.pairTemplate = &template
+		return nil
+	}
+}
+
+// PairTemplate
+// Returns the template that texts are placed in by EncodePair and
+// EncodeInputs. Unless one is set with WithPairTemplate, it is detected from
+// the tokenizer: tokenizers with [CLS] and [SEP] special tokens are given the
+// BERT template of "[CLS] a [SEP] b [SEP]", and others enclose each of the
+// pair in the BOS and EOS tokens that their BosEosPolicy adds, so that those
+// that add neither, such as GPT-2, join the texts without special tokens.
+func (encoder *GPTEncoder) PairTemplate() PairTemplate {
+	if encoder.pairTemplate != nil {
+		return *encoder.pairTemplate
+	}
+	cls, hasCls := encoder.specials["[CLS]"]
+	sep, hasSep := encoder.specials["[SEP]"]
+	if hasCls && hasSep {
+		return PairTemplate{Start: cls, End: sep, PairEnd: sep}
+	}
+	var template PairTemplate
+	bos, eos := encoder.BosEosPolicy()
+	if bos != AddNever {
+		template.Start = Tokens{encoder.BosToken}
+		template.PairStart = template.Start
+	}
+	if eos != AddNever {
+		template.End = Tokens{encoder.EosToken}
+		template.PairEnd = template.End
+	}
+	return template
+}
+
+// EncodePair
+// Encodes a pair of texts, placed in the encoder's PairTemplate, as the
+// cross-encoders that score pairs of texts take them.
+func (encoder *GPTEncoder) EncodePair(first *string, second *string) *Tokens {
+	// Without truncation, EncodeInputs cannot fail.
+	inputs, _ := encoder.EncodeInputs(first, second, InputsOptions{})
+	return &inputs.InputIds
+}
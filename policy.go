@@ -0,0 +1,166 @@
+package gpt_bpe
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// AddPolicy
+// When BOS and EOS tokens are added around encoded text.
+type AddPolicy uint8
+
+const (
+	// AddDefault follows the tokenizer, which adds both tokens when its
+	// special_config.json has enclose_eos_bos set, and neither otherwise.
+	AddDefault AddPolicy = iota
+	// AddNever never adds the token.
+	AddNever
+	// AddAlways always adds the token.
+	AddAlways
+	// AddIfMissing adds the token unless the text already begins with the
+	// BOS token, or ends with the EOS token.
+	AddIfMissing
+)
+
+func (policy AddPolicy) String() string {
+	switch policy {
+	case AddDefault:
+		return "default"
+	case AddNever:
+		return "never"
+	case AddAlways:
+		return "always"
+	case AddIfMissing:
+		return "if-missing"
+	default:
+		return "unknown"
+	}
+}
+
+// ParseAddPolicy
+// Returns the AddPolicy named name, one of "default", "never", "always" or
+// "if-missing".
+func ParseAddPolicy(name string) (AddPolicy, error) {
+	for policy := AddDefault; policy <= AddIfMissing; policy++ {
+		if strings.EqualFold(name, policy.String()) {
+			return policy, nil
+		}
+	}
+	return AddDefault, errors.New(fmt.Sprintf("invalid add policy %s", name))
+}
+
+// resolvePolicy returns the policy that AddDefault stands for, given how the
+// encoder's BOS and EOS policies were set.
+func (encoder *GPTEncoder) resolvePolicy(policy AddPolicy,
+	set AddPolicy) AddPolicy {
+	if policy == AddDefault {
+		policy = set
+	}
+	if policy == AddDefault {
+		if encoder.encloseEosBos {
+			return AddAlways
+		}
+		return AddNever
+	}
+	return policy
+}
+
+// BosEosPolicy
+// Returns when Encode adds BOS and EOS tokens, with AddDefault resolved to
+// the tokenizer's behavior.
+func (encoder *GPTEncoder) BosEosPolicy() (bos AddPolicy, eos AddPolicy) {
+	return encoder.resolvePolicy(encoder.bosPolicy, AddDefault),
+		encoder.resolvePolicy(encoder.eosPolicy, AddDefault)
+}
+
+// SetBosEosPolicy
+// Sets when Encode, and the other encoding methods, add BOS and EOS tokens,
+// in place of the tokenizer's default.
+func (encoder *GPTEncoder) SetBosEosPolicy(bos AddPolicy,
+	eos AddPolicy) error {
+	for _, policy := range []AddPolicy{bos, eos} {
+		if policy > AddIfMissing {
+			return errors.New(fmt.Sprintf("invalid add policy %d", policy))
+		}
+	}
+	encoder.bosPolicy, encoder.eosPolicy = bos, eos
+	return nil
+}
+
+// WithBosEosPolicy
+// Sets when BOS and EOS tokens are added, as SetBosEosPolicy does.
+func WithBosEosPolicy(bos AddPolicy, eos AddPolicy) Option {
+	return func(encoder *GPTEncoder) error {
+		return encoder.SetBosEosPolicy(bos, eos)
+	}
+}
+
+// EncodeWithPolicy
+// Encodes text as Encode does, adding BOS and EOS tokens by the given
+// policies for this call, where AddDefault keeps the encoder's policy.
+func (encoder *GPTEncoder) EncodeWithPolicy(text *string, bos AddPolicy,
+	eos AddPolicy) *Tokens {
+	encoded := make(Tokens, 0, 4096)
+	nextTokens := encoder.streamingEncode(strings.NewReader(*text),
+		encoder.resolvePolicy(bos, encoder.bosPolicy),
+		encoder.resolvePolicy(eos, encoder.eosPolicy))
+	for tokens := nextTokens(4096); tokens != nil; tokens = nextTokens(4096) {
+		encoded = append(encoded, *tokens...)
+	}
+	return &encoded
+}
+
+// bosEosFramer adds BOS and EOS tokens around the tokens of the words of a
+// text, by its policies, as they are encoded.
+type bosEosFramer struct {
+	encoder    *GPTEncoder
+	bos        AddPolicy
+	eos        AddPolicy
+	bosPending bool
+	last       Token
+	any        bool
+}
+
+// newBosEosFramer returns a framer for the resolved policies.
+func (encoder *GPTEncoder) newBosEosFramer(bos AddPolicy,
+	eos AddPolicy) *bosEosFramer {
+	return &bosEosFramer{
+		encoder:    encoder,
+		bos:        bos,
+		eos:        eos,
+		bosPending: bos == AddAlways || bos == AddIfMissing,
+	}
+}
+
+// next returns the tokens of a word, preceded by the BOS token if it is
+// the first word, and one is to be added.
+func (framer *bosEosFramer) next(tokens Tokens) Tokens {
+	if len(tokens) == 0 {
+		return tokens
+	}
+	if framer.bosPending {
+		framer.bosPending = false
+		if framer.bos == AddAlways || tokens[0] != framer.encoder.BosToken {
+			tokens = append(Tokens{framer.encoder.BosToken}, tokens...)
+		}
+	}
+	framer.last, framer.any = tokens[len(tokens)-1], true
+	return tokens
+}
+
+// end returns the tokens that end the text, the BOS token of an empty text,
+// and the EOS token if one is to be added.
+func (framer *bosEosFramer) end() Tokens {
+	tokens := make(Tokens, 0, 2)
+	if framer.bosPending {
+		framer.bosPending = false
+		tokens = append(tokens, framer.encoder.BosToken)
+		framer.last, framer.any = framer.encoder.BosToken, true
+	}
+	if framer.eos == AddAlways || (framer.eos == AddIfMissing &&
+		(!framer.any || framer.last != framer.encoder.EosToken)) {
+		tokens = append(tokens, framer.encoder.EosToken)
+	}
+	return tokens
+}
@@ -0,0 +1,395 @@
+package gpt_bpe
+
+import (
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// PreTokenizer
+// Splits text into the words that are ranked and merged by BPE, returning
+// the byte offsets of at most n words, or of all words when n is negative,
+// in the manner of regexp.Regexp.FindAllStringIndex. String returns the
+// expression that the text is split by.
+type PreTokenizer interface {
+	FindAllStringIndex(text string, n int) [][]int
+	String() string
+}
+
+// ScannerPreTokenizer
+// Splits text exactly as one of the standard pre-tokenization regular
+// expressions does, by scanning it by hand with the Unicode property
+// tables. Go's regexp package has no lookahead, and its `\s` only matches
+// ASCII whitespace, so it can only approximate these expressions.
+type ScannerPreTokenizer struct {
+	expression string
+	// match returns the end of the word starting at begin.
+	match func(text string, begin int) int
+}
+
+// GPT2PreTokenizer
+// Splits text as the GPT-2 expression does.
+var GPT2PreTokenizer = ScannerPreTokenizer{
+	"'s|'t|'re|'ve|'m|'ll|'d| ?\\p{L}+| ?\\p{N}+| ?[^\\s\\p{L}\\p{N}]+|" +
+		"\\s+(?!\\S)|\\s+",
+	matchGPT2,
+}
+
+// Llama3PreTokenizer
+// Splits text as the Llama 3 expression, shared with cl100k, does.
+var Llama3PreTokenizer = ScannerPreTokenizer{
+	"(?i:'s|'t|'re|'ve|'m|'ll|'d)|[^\\r\\n\\p{L}\\p{N}]?\\p{L}+|" +
+		"\\p{N}{1,3}| ?[^\\s\\p{L}\\p{N}]+[\\r\\n]*|\\s*[\\r\\n]+|" +
+		"\\s+(?!\\S)|\\s+",
+	matchLlama3,
+}
+
+// O200kPreTokenizer
+// Splits text as the o200k expression does, which splits words where their
+// case changes from lower to upper, and keeps contractions with their word.
+var O200kPreTokenizer = ScannerPreTokenizer{
+	"[^\\r\\n\\p{L}\\p{N}]?[\\p{Lu}\\p{Lt}\\p{Lm}\\p{Lo}\\p{M}]*" +
+		"[\\p{Ll}\\p{Lm}\\p{Lo}\\p{M}]+(?i:'s|'t|'re|'ve|'m|'ll|'d)?|" +
+		"[^\\r\\n\\p{L}\\p{N}]?[\\p{Lu}\\p{Lt}\\p{Lm}\\p{Lo}\\p{M}]+" +
+		"[\\p{Ll}\\p{Lm}\\p{Lo}\\p{M}]*(?i:'s|'t|'re|'ve|'m|'ll|'d)?|" +
+		"\\p{N}{1,3}| ?[^\\s\\p{L}\\p{N}]+[\\r\\n/]*|\\s*[\\r\\n]+|" +
+		"\\s+(?!\\S)|\\s+",
+	matchO200k,
+}
+
+// RegexpPreTokenizer
+// Splits text by SPLIT_REGEX, the approximation of the GPT-2 expression that
+// Go's regexp package supports, to verify GPT2PreTokenizer against.
+var RegexpPreTokenizer PreTokenizer = regexp.MustCompile(SPLIT_REGEX)
+
+// WhitespacePreTokenizer
+// Splits text into runs of word characters, and runs of the other
+// characters that are not whitespace, as the Whitespace pre-tokenizer of
+// huggingface tokenizers does, dropping the whitespace between them.
+var WhitespacePreTokenizer PreTokenizer = regexp.MustCompile(
+	`[\p{L}\p{M}\p{Nd}\p{Pc}]+|[^\p{L}\p{M}\p{Nd}\p{Pc}\s\p{Z}]+`)
+
+// WhitespaceSplitPreTokenizer
+// Splits text on whitespace, as the WhitespaceSplit pre-tokenizer of
+// huggingface tokenizers does.
+var WhitespaceSplitPreTokenizer PreTokenizer = regexp.MustCompile(
+	`[^\s\p{Z}]+`)
+
+// SetPreTokenizer
+// Replaces the pre-tokenizer that splits text into words, which changes the
+// encoder's fingerprint.
+func (encoder *GPTEncoder) SetPreTokenizer(preTokenizer PreTokenizer) {
+	encoder.pattern = preTokenizer
+	encoder.cache.Purge()
+}
+
+// String
+// Returns the expression that the scanner implements.
+func (scanner ScannerPreTokenizer) String() string {
+	return scanner.expression
+}
+
+// FindAllStringIndex
+// Returns the byte offsets of at most n words of text, or of all words when
+// n is negative.
+func (scanner ScannerPreTokenizer) FindAllStringIndex(text string,
+	n int) [][]int {
+	indexes := make([][]int, 0, len(text)/4+1)
+	// The offsets of all words share a backing array, which is reallocated
+	// as it fills up.
+	offsets := make([]int, 0, 2*cap(indexes))
+	for begin := 0; begin < len(text) && (n < 0 || len(indexes) < n); {
+		end := scanner.match(text, begin)
+		if len(offsets) == cap(offsets) {
+			offsets = make([]int, 0, cap(offsets))
+		}
+		offsets = append(offsets, begin, end)
+		indexes = append(indexes, offsets[len(offsets)-2:len(offsets):len(
+			offsets)])
+		begin = end
+	}
+	return indexes
+}
+
+var contractions = []string{"'s", "'t", "'re", "'ve", "'m", "'ll", "'d"}
+
+// runeAt returns the rune at offset in text and its size, or a size of zero
+// at the end of text.
+func runeAt(text string, offset int) (rune, int) {
+	if offset >= len(text) {
+		return 0, 0
+	} else if text[offset] < utf8.RuneSelf {
+		return rune(text[offset]), 1
+	}
+	return utf8.DecodeRuneInString(text[offset:])
+}
+
+// Runes are classified by the Unicode tables bundled in unicodetables_data.go
+// rather than by the Go runtime's, so that pre-tokenization does not change
+// when the toolchain's version of Unicode does. The tables are refreshed with
+// `make unicode_tables`, which changes the output of the pre-tokenizers for
+// the runes that it reclassifies.
+
+// Classes of ASCII runes, which are looked up rather than searched for in
+// the Unicode tables.
+const (
+	classOther = iota
+	classLetter
+	classNumber
+	classSpace
+)
+
+var asciiClasses = func() (classes [utf8.RuneSelf]byte) {
+	for r := range classes {
+		switch {
+		case unicode.Is(unicodeLetters, rune(r)):
+			classes[r] = classLetter
+		case unicode.Is(unicodeNumbers, rune(r)):
+			classes[r] = classNumber
+		case unicode.Is(unicodeSpaces, rune(r)):
+			classes[r] = classSpace
+		}
+	}
+	return classes
+}()
+
+func isLetter(r rune) bool {
+	if r < utf8.RuneSelf {
+		return asciiClasses[r] == classLetter
+	}
+	return unicode.Is(unicodeLetters, r)
+}
+
+func isNumber(r rune) bool {
+	if r < utf8.RuneSelf {
+		return asciiClasses[r] == classNumber
+	}
+	return unicode.Is(unicodeNumbers, r)
+}
+
+func isSpace(r rune) bool {
+	if r < utf8.RuneSelf {
+		return asciiClasses[r] == classSpace
+	}
+	return unicode.Is(unicodeSpaces, r)
+}
+
+// isOther matches [^\s\p{L}\p{N}].
+func isOther(r rune) bool {
+	if r < utf8.RuneSelf {
+		return asciiClasses[r] == classOther
+	}
+	return !unicode.Is(unicodeSpaces, r) && !unicode.Is(unicodeLetters, r) &&
+		!unicode.Is(unicodeNumbers, r)
+}
+
+func isNewline(r rune) bool {
+	return r == '\r' || r == '\n'
+}
+
+// skip returns the offset after the run of runes matching class at offset,
+// stopping after max runes when max is positive.
+func skip(text string, offset int, class func(rune) bool, max int) int {
+	for count := 0; max <= 0 || count < max; count++ {
+		r, size := runeAt(text, offset)
+		if size == 0 || !class(r) {
+			break
+		}
+		offset += size
+	}
+	return offset
+}
+
+// matchContraction returns the end of the contraction at begin, or -1.
+// Contractions are matched in order, with case folding if requested.
+func matchContraction(text string, begin int, foldCase bool) int {
+	if text[begin] != '\'' {
+		return -1
+	}
+	for _, contraction := range contractions {
+		end := begin + 1
+		for _, expected := range contraction[1:] {
+			r, size := runeAt(text, end)
+			if size == 0 || (r != expected && !(foldCase &&
+				strings.EqualFold(string(r), string(expected)))) {
+				end = -1
+				break
+			}
+			end += size
+		}
+		if end != -1 {
+			return end
+		}
+	}
+	return -1
+}
+
+// matchSpaces matches \s+(?!\S)|\s+ at begin, which holds whitespace. The
+// lookahead leaves the last whitespace before a word for the word itself.
+func matchSpaces(text string, begin int) int {
+	end := skip(text, begin, isSpace, 0)
+	if end == len(text) {
+		return end
+	}
+	_, lastSize := utf8.DecodeLastRuneInString(text[:end])
+	if end-lastSize > begin {
+		return end - lastSize
+	}
+	return end
+}
+
+func matchGPT2(text string, begin int) int {
+	if end := matchContraction(text, begin, false); end != -1 {
+		return end
+	}
+	offset := begin
+	if text[offset] == ' ' {
+		offset++
+	}
+	r, size := runeAt(text, offset)
+	switch {
+	case size == 0:
+	case isLetter(r):
+		return skip(text, offset, isLetter, 0)
+	case isNumber(r):
+		return skip(text, offset, isNumber, 0)
+	case isOther(r):
+		return skip(text, offset, isOther, 0)
+	}
+	// Every other rune is whitespace.
+	return matchSpaces(text, begin)
+}
+
+func matchLlama3(text string, begin int) int {
+	if end := matchContraction(text, begin, true); end != -1 {
+		return end
+	}
+	r, size := runeAt(text, begin)
+	// [^\r\n\p{L}\p{N}]?\p{L}+
+	if !isNewline(r) && !isNumber(r) {
+		offset := begin
+		if !isLetter(r) {
+			offset += size
+		}
+		if next, _ := runeAt(text, offset); isLetter(next) {
+			return skip(text, offset, isLetter, 0)
+		}
+	}
+	return matchNumbersOrOther(text, begin, isNewline)
+}
+
+// matchNumbersOrOther matches the alternatives that the Llama 3 and o200k
+// expressions end with, \p{N}{1,3}| ?[^\s\p{L}\p{N}]+T*|\s*[\r\n]+|
+// \s+(?!\S)|\s+, at begin, where trailing matches T.
+func matchNumbersOrOther(text string, begin int,
+	trailing func(rune) bool) int {
+	r, _ := runeAt(text, begin)
+	// \p{N}{1,3}
+	if isNumber(r) {
+		return skip(text, begin, isNumber, 3)
+	}
+	// ' ?[^\s\p{L}\p{N}]+T*'
+	offset := begin
+	if r == ' ' {
+		offset++
+	}
+	if next, nextSize := runeAt(text, offset); nextSize > 0 &&
+		isOther(next) {
+		offset = skip(text, offset, isOther, 0)
+		return skip(text, offset, trailing, 0)
+	}
+	// Every other rune is whitespace, for which \s*[\r\n]+ ends after the
+	// last newline of the whitespace.
+	end := skip(text, begin, isSpace, 0)
+	if newline := strings.LastIndexAny(text[begin:end],
+		"\r\n"); newline != -1 {
+		return begin + newline + 1
+	}
+	return matchSpaces(text, begin)
+}
+
+func isNewlineOrSlash(r rune) bool {
+	return r == '\r' || r == '\n' || r == '/'
+}
+
+// isCaseless matches the letters and marks that have no case, of Lm, Lo and
+// M, which the o200k expression allows in both the upper and lower case runs
+// of a word.
+func isCaseless(r rune) bool {
+	if r < utf8.RuneSelf {
+		return false
+	}
+	return unicode.Is(unicodeModifierLetters, r) ||
+		unicode.Is(unicodeOtherLetters, r) || unicode.Is(unicodeMarks, r)
+}
+
+// isUpperRun matches [\p{Lu}\p{Lt}\p{Lm}\p{Lo}\p{M}].
+func isUpperRun(r rune) bool {
+	if r < utf8.RuneSelf {
+		return r >= 'A' && r <= 'Z'
+	}
+	return unicode.Is(unicodeUppercase, r) ||
+		unicode.Is(unicodeTitlecase, r) || isCaseless(r)
+}
+
+// isLowerRun matches [\p{Ll}\p{Lm}\p{Lo}\p{M}].
+func isLowerRun(r rune) bool {
+	if r < utf8.RuneSelf {
+		return r >= 'a' && r <= 'z'
+	}
+	return unicode.Is(unicodeLowercase, r) || isCaseless(r)
+}
+
+// matchCasedWord matches U*L+ at offset, or U+L* if upperFirst is set, where
+// U and L are the runs of isUpperRun and isLowerRun, returning -1 if there is
+// no match. The caseless runes of both runs are given back by U* to L+ as a
+// backtracking expression would.
+func matchCasedWord(text string, offset int, upperFirst bool) int {
+	upperEnd := skip(text, offset, isUpperRun, 0)
+	if upperFirst {
+		if upperEnd == offset {
+			return -1
+		}
+		return skip(text, upperEnd, isLowerRun, 0)
+	}
+	if r, size := runeAt(text, upperEnd); size > 0 && isLowerRun(r) {
+		return skip(text, upperEnd, isLowerRun, 0)
+	}
+	// L+ can only match the last caseless rune of the upper case run, and
+	// the rest of the run ends the word, since it is not of L.
+	for end := upperEnd; end > offset; {
+		r, size := utf8.DecodeLastRuneInString(text[offset:end])
+		if isCaseless(r) {
+			return end
+		}
+		end -= size
+	}
+	return -1
+}
+
+func matchO200k(text string, begin int) int {
+	// [^\r\n\p{L}\p{N}]?U*L+C?|[^\r\n\p{L}\p{N}]?U+L*C?, where C are the
+	// contractions, with case folding. A rune that may be the optional
+	// prefix is tried as both the prefix and the start of the word.
+	r, size := runeAt(text, begin)
+	for _, upperFirst := range []bool{false, true} {
+		end := -1
+		if !isNewline(r) && !isLetter(r) && !isNumber(r) {
+			end = matchCasedWord(text, begin+size, upperFirst)
+		}
+		if end == -1 {
+			end = matchCasedWord(text, begin, upperFirst)
+		}
+		if end == -1 {
+			continue
+		} else if end < len(text) {
+			if contraction := matchContraction(text, end,
+				true); contraction != -1 {
+				return contraction
+			}
+		}
+		return end
+	}
+	return matchNumbersOrOther(text, begin, isNewlineOrSlash)
+}
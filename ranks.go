@@ -0,0 +1,67 @@
+package gpt_bpe
+
+import (
+	"sync"
+)
+
+// tokenPair is a pair of adjacent tokens that a merge joins.
+type tokenPair struct {
+	left  Token
+	right Token
+}
+
+// mergeIndex indexes the encoder's merges by the tokens that they join, and
+// by the token that they produce, for RankOfPair and RankOfToken. It is
+// built on first use, as most encoders are never queried for their ranks.
+type mergeIndex struct {
+	once   sync.Once
+	pairs  map[tokenPair]int
+	tokens map[Token]int
+}
+
+// merges returns the encoder's merge index, building it if needed.
+func (encoder *GPTEncoder) merges() *mergeIndex {
+	index := encoder.mergeIndex
+	index.once.Do(func() {
+		index.pairs = make(map[tokenPair]int, len(encoder.bpe_ranks))
+		index.tokens = make(map[Token]int, len(encoder.bpe_ranks))
+		for pair, bpeRank := range encoder.bpe_ranks {
+			left, leftOk := encoder.encoder[pair.left]
+			right, rightOk := encoder.encoder[pair.right]
+			if !leftOk || !rightOk {
+				continue
+			}
+			rank := int(bpeRank)
+			index.pairs[tokenPair{left, right}] = rank
+			// The same token can be produced by several merges, of which
+			// the lowest rank is the one that produces it first.
+			if merged, ok := encoder.encoder[pair.left+pair.right]; ok {
+				if existing, seen := index.tokens[merged]; !seen ||
+					rank < existing {
+					index.tokens[merged] = rank
+				}
+			}
+		}
+	})
+	return index
+}
+
+// RankOfPair
+// Returns the rank of the merge that joins the adjacent tokens left and
+// right, where lower ranks are merged first, and whether there is such a
+// merge.
+func (encoder *GPTEncoder) RankOfPair(left, right Token) (int, bool) {
+	rank, ok := encoder.merges().pairs[tokenPair{left, right}]
+	return rank, ok
+}
+
+// RankOfToken
+// Returns the rank of the first merge that produces token, so that tokens of
+// low rank are the common fragments that are merged first, or -1 if no merge
+// produces it, as for the tokens of single bytes and special tokens.
+func (encoder *GPTEncoder) RankOfToken(token Token) int {
+	if rank, ok := encoder.merges().tokens[token]; ok {
+		return rank
+	}
+	return -1
+}
@@ -0,0 +1,58 @@
+package gpt_bpe
+
+import "sync"
+
+// sharedEncoder is an encoder of the registry, built once by its first user.
+type sharedEncoder struct {
+	once    sync.Once
+	encoder *GPTEncoder
+	err     error
+}
+
+var (
+	sharedEncodersMtx sync.Mutex
+	sharedEncoders    = map[string]*sharedEncoder{
+		"gpt2-tokenizer": {encoder: &GPT2Encoder},
+		"pile-tokenizer": {encoder: &PileEncoder},
+		"clip-tokenizer": {encoder: &CLIPEncoder},
+	}
+)
+
+func init() {
+	// The embedded encoders are built at package initialization.
+	for _, shared := range sharedEncoders {
+		shared.once.Do(func() {})
+	}
+}
+
+// SharedEncoder
+// Returns the process-wide encoder for that vocabulary id, which is built by
+// NewEncoder on the first call for the id and returned by every later call,
+// so that the parts of a large application share a single copy of a
+// vocabulary. Concurrent first calls wait on the one build. The encoder is
+// shared, and must be treated as read-only: callers that reconfigure an
+// encoder, with SetSpecialsPolicy or SetBosEosPolicy for example, should
+// build their own with NewEncoder. A failed build is not kept, so a later
+// call retries it.
+func SharedEncoder(vocabId string) (*GPTEncoder, error) {
+	sharedEncodersMtx.Lock()
+	shared, ok := sharedEncoders[vocabId]
+	if !ok {
+		shared = &sharedEncoder{}
+		sharedEncoders[vocabId] = shared
+	}
+	sharedEncodersMtx.Unlock()
+
+	shared.once.Do(func() {
+		shared.encoder, shared.err = NewEncoder(vocabId)
+	})
+	if shared.err != nil {
+		sharedEncodersMtx.Lock()
+		if sharedEncoders[vocabId] == shared {
+			delete(sharedEncoders, vocabId)
+		}
+		sharedEncodersMtx.Unlock()
+		return nil, shared.err
+	}
+	return shared.encoder, nil
+}
@@ -0,0 +1,168 @@
+package gpt_bpe
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// RESERVED_SPECIAL_FORMAT is the name that ReserveSpecials gives the Nth
+// reserved token, after the reserved blocks that Llama 3 ships.
+const RESERVED_SPECIAL_FORMAT = "<|reserved_special_%d|>"
+
+// updateSpecials recompiles the pattern and tree that special tokens are
+// found in text with, after encoder.specials changes.
+func (encoder *GPTEncoder) updateSpecials() error {
+	quotedSpecials := make([]string, 0, len(encoder.specials))
+	for special := range encoder.specials {
+		quotedSpecials = append(quotedSpecials, regexp.QuoteMeta(special))
+	}
+	sort.Strings(quotedSpecials)
+	encoder.specialsPat = regexp.MustCompile(strings.Join(quotedSpecials,
+		"|"))
+	// Words that are now special tokens may have been cached as text.
+	encoder.cache.Purge()
+	return encoder.SetSpecialsPolicy(encoder.specialsPolicy)
+}
+
+// checkSpecialName returns an error if name cannot be added to the
+// vocabulary as a special token.
+func (encoder *GPTEncoder) checkSpecialName(name string) error {
+	if name == "" {
+		return errors.New("special token name is empty")
+	}
+	// Special tokens are listed by their text in specials.txt, and looked up
+	// in the vocabulary by it, so must be the same in its byte mapping.
+	if encoder.mapBytes(name) != name {
+		return errors.New(fmt.Sprintf(
+			"special token name %q must be printable ASCII", name))
+	}
+	if _, ok := encoder.encoder[name]; ok {
+		return errors.New(fmt.Sprintf(
+			"special token name %q is already in the vocabulary", name))
+	}
+	if _, ok := encoder.specials[name]; ok {
+		return errors.New(fmt.Sprintf(
+			"special token name %q is already a special token", name))
+	}
+	return nil
+}
+
+// addSpecial adds name to the vocabulary as the special token for token.
+func (encoder *GPTEncoder) addSpecial(name string, token Token) {
+	encoder.encoder[name] = token
+	encoder.decoder[token] = []byte(name)
+	encoder.specials[name] = Tokens{token}
+	for len(encoder.unitrim) <= int(token) {
+		encoder.unitrim = append(encoder.unitrim, 0)
+	}
+}
+
+// ReserveSpecials
+// Reserves count token ids after the highest in the vocabulary, as special
+// tokens named with RESERVED_SPECIAL_FORMAT, so that they can be claimed with
+// RenameSpecial later without renumbering the vocabulary.
+func (encoder *GPTEncoder) ReserveSpecials(count int) (Tokens, error) {
+	start := int64(0)
+	for token := range encoder.decoder {
+		if int64(token) >= start {
+			start = int64(token) + 1
+		}
+	}
+	if start > int64(^Token(0)) {
+		return nil, errors.New("no token ids are left to reserve")
+	}
+	return encoder.ReserveSpecialRange(Token(start), count,
+		RESERVED_SPECIAL_FORMAT)
+}
+
+// ReserveSpecialRange
+// Reserves the count unused token ids from start as special tokens, named by
+// format with the lowest numbers that are not yet in the vocabulary. The
+// artifacts of the updated vocabulary are written by MarshalVocab,
+// MarshalVocabBytes, MarshalSpecials and Unitrim.
+func (encoder *GPTEncoder) ReserveSpecialRange(start Token, count int,
+	format string) (Tokens, error) {
+	if count <= 0 {
+		return nil, errors.New(fmt.Sprintf(
+			"cannot reserve %d token ids", count))
+	}
+	if int64(start)+int64(count)-1 > int64(^Token(0)) {
+		return nil, errors.New(fmt.Sprintf(
+			"cannot reserve %d token ids from %d, beyond the largest "+
+				"token id %d", count, start, ^Token(0)))
+	}
+	tokens := make(Tokens, 0, count)
+	names := make([]string, 0, count)
+	seen := make(map[string]bool, count)
+	number := 0
+	for idx := 0; idx < count; idx++ {
+		token := Token(int(start) + idx)
+		if _, ok := encoder.decoder[token]; ok {
+			return nil, errors.New(fmt.Sprintf(
+				"token id %d is already in use", token))
+		}
+		var name string
+		for ; ; number++ {
+			name = fmt.Sprintf(format, number)
+			if _, ok := encoder.encoder[name]; !ok && !seen[name] {
+				break
+			}
+		}
+		if err := encoder.checkSpecialName(name); err != nil {
+			return nil, err
+		}
+		seen[name] = true
+		tokens = append(tokens, token)
+		names = append(names, name)
+	}
+	for idx, token := range tokens {
+		encoder.addSpecial(names[idx], token)
+	}
+	return tokens, encoder.updateSpecials()
+}
+
+// RenameSpecial
+// Renames the special token special to name, keeping its token id, so that
+// fine-tuners can claim reserved tokens.
+func (encoder *GPTEncoder) RenameSpecial(special string, name string) error {
+	tokens, ok := encoder.specials[special]
+	if !ok || len(tokens) != 1 {
+		return errors.New(fmt.Sprintf(
+			"%q is not a single special token", special))
+	}
+	if err := encoder.checkSpecialName(name); err != nil {
+		return err
+	}
+	if token, ok := encoder.encoder[special]; ok && token == tokens[0] {
+		delete(encoder.encoder, special)
+	}
+	delete(encoder.specials, special)
+	encoder.addSpecial(name, tokens[0])
+	return encoder.updateSpecials()
+}
+
+// MarshalVocab
+// Returns the vocabulary as encoder.json, mapping each token's text to its
+// id.
+func (encoder *GPTEncoder) MarshalVocab() ([]byte, error) {
+	return json.Marshal(encoder.encoder)
+}
+
+// MarshalSpecials
+// Returns the special tokens as specials.txt, one to a line, in order.
+func (encoder *GPTEncoder) MarshalSpecials() ([]byte, error) {
+	specials := make([]string, 0, len(encoder.specials))
+	for special := range encoder.specials {
+		if strings.ContainsAny(special, "\r\n") {
+			return nil, errors.New(fmt.Sprintf(
+				"cannot write special token %q with a newline", special))
+		}
+		specials = append(specials, special)
+	}
+	sort.Strings(specials)
+	return []byte(strings.Join(specials, "\n") + "\n"), nil
+}
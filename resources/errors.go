@@ -0,0 +1,39 @@
+package resources
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrResourceMissing
+// A resource that a vocabulary requires could not be found, locally or
+// remotely.
+var ErrResourceMissing = errors.New("resource missing")
+
+// ErrDownloadFailed
+// A resource could not be fetched, or written to the resource directory.
+var ErrDownloadFailed = errors.New("download failed")
+
+// ErrResourceInvalid
+// A resource was found, but could not be parsed.
+var ErrResourceInvalid = errors.New("resource invalid")
+
+// ErrUnsupportedLayout
+// A directory holds a tokenizer in a layout that cannot be loaded.
+var ErrUnsupportedLayout = errors.New("unsupported tokenizer layout")
+
+// HTTPStatusError
+// A request for a remote resource was answered with a status other than
+// 200 OK. It matches ErrDownloadFailed with errors.Is.
+type HTTPStatusError struct {
+	URL        string
+	StatusCode int
+}
+
+func (e *HTTPStatusError) Error() string {
+	return fmt.Sprintf("HTTP status code %d", e.StatusCode)
+}
+
+func (e *HTTPStatusError) Is(target error) bool {
+	return target == ErrDownloadFailed
+}
@@ -0,0 +1,221 @@
+package resources
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+)
+
+// DirLayout
+// The layout of the tokenizer files in a directory.
+type DirLayout uint8
+
+// The layouts of tokenizer files that a directory is detected as.
+const (
+	LAYOUT_UNKNOWN DirLayout = iota
+	// LAYOUT_EMBEDDED has encoder.json and vocab.bpe, as the embedded
+	// tokenizers and packaged tokenizers do.
+	LAYOUT_EMBEDDED
+	// LAYOUT_GPT2 has vocab.json, or vocab.bytes.json, and merges.txt. A
+	// vocabulary without merges is also of this layout, and is encoded
+	// greedily.
+	LAYOUT_GPT2
+	// LAYOUT_TOKENIZER_JSON has only a huggingface tokenizer.json.
+	LAYOUT_TOKENIZER_JSON
+	// LAYOUT_SENTENCEPIECE has a SentencePiece .model file.
+	LAYOUT_SENTENCEPIECE
+	// LAYOUT_TIKTOKEN has a tiktoken .tiktoken ranks file.
+	LAYOUT_TIKTOKEN
+	// LAYOUT_WORDPIECE has a BERT-family WordPiece vocab.txt.
+	LAYOUT_WORDPIECE
+	// LAYOUT_RWKV has an RWKV rwkv_vocab*.txt vocabulary.
+	LAYOUT_RWKV
+)
+
+func (layout DirLayout) String() string {
+	switch layout {
+	case LAYOUT_EMBEDDED:
+		return "embedded"
+	case LAYOUT_GPT2:
+		return "gpt2"
+	case LAYOUT_TOKENIZER_JSON:
+		return "tokenizer.json"
+	case LAYOUT_SENTENCEPIECE:
+		return "sentencepiece"
+	case LAYOUT_TIKTOKEN:
+		return "tiktoken"
+	case LAYOUT_WORDPIECE:
+		return "wordpiece"
+	case LAYOUT_RWKV:
+		return "rwkv"
+	default:
+		return "unknown"
+	}
+}
+
+// DetectLayout
+// Returns the layout of the tokenizer files in dir. When a directory holds
+// more than one layout, the first in the order of the DirLayout constants is
+// returned.
+func DetectLayout(dir string) (DirLayout, error) {
+	if stat, err := os.Stat(dir); err != nil {
+		return LAYOUT_UNKNOWN, fmt.Errorf("%w: %s", ErrResourceMissing, err)
+	} else if !stat.IsDir() {
+		return LAYOUT_UNKNOWN, fmt.Errorf("%w: %s is not a directory",
+			ErrResourceMissing, dir)
+	}
+	has := func(name string) bool {
+		return CheckFileExist(path.Join(dir, name))
+	}
+	matches := func(pattern string) bool {
+		found, _ := filepath.Glob(filepath.Join(dir, pattern))
+		return len(found) > 0
+	}
+	switch {
+	case IsPackageDir(dir):
+		return LAYOUT_EMBEDDED, nil
+	case (has("vocab.json") || has("vocab.bytes.json")) &&
+		has("merges.txt"):
+		return LAYOUT_GPT2, nil
+	case has("tokenizer.json"):
+		return LAYOUT_TOKENIZER_JSON, nil
+	case matches("*.model"):
+		return LAYOUT_SENTENCEPIECE, nil
+	case matches("*.tiktoken"):
+		return LAYOUT_TIKTOKEN, nil
+	case has("vocab.txt"):
+		return LAYOUT_WORDPIECE, nil
+	case matches("rwkv_vocab*.txt"):
+		return LAYOUT_RWKV, nil
+	case has("vocab.json") || has("vocab.bytes.json"):
+		return LAYOUT_GPT2, nil
+	default:
+		return LAYOUT_UNKNOWN, nil
+	}
+}
+
+// ResolveLocalDir
+// Resolves the resources of the tokenizer in dir, whatever its layout, and
+// without downloading anything. The vocabulary and merges of a directory with
+// only a tokenizer.json are extracted from it. Layouts that gpt_bpe cannot
+// load fail with ErrUnsupportedLayout.
+func ResolveLocalDir(dir string) (*HFConfig, *Resources, error) {
+	layout, err := DetectLayout(dir)
+	if err != nil {
+		return nil, nil, err
+	}
+	switch layout {
+	case LAYOUT_EMBEDDED:
+		return ResolvePackageDir(dir)
+	case LAYOUT_GPT2, LAYOUT_TOKENIZER_JSON:
+		if err := CheckUnsignedAllowed(dir); err != nil {
+			return nil, nil, err
+		}
+	default:
+		return nil, nil, fmt.Errorf("%w: %s layout in %s",
+			ErrUnsupportedLayout, layout, dir)
+	}
+
+	tempDir, err := ioutil.TempDir("", "resources")
+	if err != nil {
+		return nil, nil, err
+	}
+	defer os.RemoveAll(tempDir)
+	resources := make(Resources, 0)
+	for _, name := range []string{"config.json", "vocab.json",
+		"vocab.bytes.json", "merges.txt", "special_tokens_map.json",
+		"special_config.json", "specials.txt"} {
+		data, err := os.ReadFile(path.Join(dir, name))
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, nil, fmt.Errorf("%w: %s/%s: %s",
+				ErrResourceMissing, dir, name, err)
+		}
+		resources[name] = ResourceEntry{nil, &data}
+	}
+
+	if layout == LAYOUT_TOKENIZER_JSON {
+		if err := extractTokenizerJson(dir, tempDir,
+			&resources); err != nil {
+			return nil, nil, err
+		}
+	}
+	if vocab, ok := resources["vocab.json"]; ok {
+		resources["encoder.json"] = vocab
+	} else {
+		resources["encoder.json"] = *GetEmbeddedResource(
+			"gpt2-tokenizer/encoder.json")
+	}
+
+	var hfConfig HFConfig
+	if config, ok := resources["config.json"]; ok {
+		if err := json.Unmarshal(*config.Data, &hfConfig); err != nil {
+			return nil, nil, fmt.Errorf(
+				"%w: error unmarshalling config.json: %s",
+				ErrResourceInvalid, err)
+		}
+	}
+	modelId := filepath.Base(filepath.Clean(dir))
+	hfConfig.ModelId = &modelId
+	specialTokens, err := resources.ResolveSpecialTokens(tempDir)
+	if err != nil {
+		resources.Cleanup()
+		return nil, nil, err
+	}
+	applySpecialTokens(&hfConfig, specialTokens)
+	return &hfConfig, &resources, nil
+}
+
+// extractTokenizerJson extracts the vocabulary and merges of the BPE model
+// in the tokenizer.json of dir into resources, using tempDir.
+func extractTokenizerJson(dir string, tempDir string,
+	resources *Resources) error {
+	tokenizerJson, err := os.ReadFile(path.Join(dir, "tokenizer.json"))
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrResourceMissing, err)
+	}
+	if err := os.WriteFile(path.Join(tempDir, "tokenizer.json"),
+		tokenizerJson, 0644); err != nil {
+		return err
+	}
+	model, err := ExtractModelFromTokenizer(&tempDir)
+	if err != nil {
+		return fmt.Errorf("%w: could not extract model from "+
+			"tokenizer.json: %s", ErrResourceInvalid, err)
+	}
+	if modelType, _ := model["type"].(string); modelType != "BPE" {
+		return fmt.Errorf("%w: tokenizer.json model of type %q in %s",
+			ErrUnsupportedLayout, modelType, dir)
+	}
+	// Newer tokenizers write each merge as a pair rather than a string.
+	if merges, ok := model["merges"].([]interface{}); ok {
+		for idx, merge := range merges {
+			if pair, ok := merge.([]interface{}); ok && len(pair) == 2 {
+				merges[idx] = fmt.Sprintf("%v %v", pair[0], pair[1])
+			}
+		}
+	}
+	if err := ExtractVocabFromTokenizer(model, &tempDir); err != nil {
+		return fmt.Errorf("%w: could not extract vocab from "+
+			"tokenizer.json: %s", ErrResourceInvalid, err)
+	}
+	if err := ExtractMergesFromTokenizer(model, &tempDir); err != nil {
+		return fmt.Errorf("%w: could not extract merges from "+
+			"tokenizer.json: %s", ErrResourceInvalid, err)
+	}
+	vocab, err := os.ReadFile(path.Join(tempDir, "vocab.json"))
+	if err != nil {
+		return err
+	}
+	merges, err := os.ReadFile(path.Join(tempDir, "merges.txt"))
+	if err != nil {
+		return err
+	}
+	(*resources)["vocab.json"] = ResourceEntry{nil, &vocab}
+	(*resources)["merges.txt"] = ResourceEntry{nil, &merges}
+	return nil
+}
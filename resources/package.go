@@ -0,0 +1,111 @@
+package resources
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+)
+
+// resolveEmbeddedLayout
+// Resolves the resources of a tokenizer laid out as the embedded tokenizers
+// are, with getResource returning each of its files, or nil if the file does
+// not exist.
+func resolveEmbeddedLayout(
+	getResource func(name string) *ResourceEntry,
+) *Resources {
+	resources := make(Resources, 0)
+	if config := getResource("encoder.json"); config != nil {
+		resources["vocab.json"] = *config
+		resources["encoder.json"] = *config
+	}
+	if vocab := getResource("vocab.bpe"); vocab != nil {
+		resources["merges.txt"] = *vocab
+	}
+	for _, name := range []string{"vocab.bytes.json", "specials.txt",
+		"special_tokens_map.json", "special_config.json"} {
+		if rsrc := getResource(name); rsrc != nil {
+			resources[name] = *rsrc
+		}
+	}
+	return &resources
+}
+
+// IsPackageDir
+// Returns true if dir is a directory holding a tokenizer in the layout of
+// the embedded tokenizers, with at least encoder.json and vocab.bpe.
+func IsPackageDir(dir string) bool {
+	return CheckFileExist(path.Join(dir, "encoder.json")) &&
+		CheckFileExist(path.Join(dir, "vocab.bpe"))
+}
+
+// ResolvePackageDir
+// Resolves the resources of a tokenizer in dir, laid out as the embedded
+// tokenizers are. The special token strings are read from config.json when
+// present, and otherwise default to those of the embedded tokenizers. When
+// RequireSignedPackages requires signed packages, the package must be signed
+// by a trusted key, and each file that is read must match its digest.
+func ResolvePackageDir(dir string) (*HFConfig, *Resources, error) {
+	// When signed packages are required, every file that is read must be
+	// covered by the signature.
+	var digests map[string]string
+	if keys := signaturesRequired(); len(keys) > 0 {
+		var err error
+		if digests, err = verifyManifest(dir, keys); err != nil {
+			return nil, nil, err
+		}
+	}
+	var hf HFConfig
+	if configBytes, err := os.ReadFile(path.Join(dir,
+		"config.json")); err == nil {
+		if digests != nil {
+			if err := checkDigest(dir, "config.json", configBytes,
+				digests); err != nil {
+				return nil, nil, err
+			}
+		}
+		if configErr := json.Unmarshal(configBytes, &hf); configErr != nil {
+			return nil, nil, fmt.Errorf(
+				"%w: error unmarshalling %s/config.json: %s",
+				ErrResourceInvalid, dir, configErr)
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, nil, fmt.Errorf("%w: %s/config.json: %s",
+			ErrResourceMissing, dir, err)
+	}
+	modelId := filepath.Base(filepath.Clean(dir))
+	hf.ModelId = &modelId
+	if hf.BosTokenStr == nil {
+		bosText := "<|startoftext|>"
+		hf.BosTokenStr = &bosText
+	}
+	endOfText := "<|endoftext|>"
+	if hf.EosTokenStr == nil {
+		hf.EosTokenStr = &endOfText
+	}
+	if hf.PadTokenStr == nil {
+		hf.PadTokenStr = &endOfText
+	}
+
+	var readErr error
+	resources := resolveEmbeddedLayout(func(name string) *ResourceEntry {
+		data, err := os.ReadFile(path.Join(dir, name))
+		if err != nil {
+			_, signed := digests[name]
+			if (!os.IsNotExist(err) || signed) && readErr == nil {
+				readErr = fmt.Errorf("%w: %s/%s: %s", ErrResourceMissing,
+					dir, name, err)
+			}
+			return nil
+		}
+		if digests != nil && readErr == nil {
+			readErr = checkDigest(dir, name, data, digests)
+		}
+		return &ResourceEntry{nil, &data}
+	})
+	if readErr != nil {
+		return nil, nil, readErr
+	}
+	return &hf, resources, nil
+}
@@ -88,6 +88,7 @@ func GetResourceEntries(typ ResourceType) ResourceEntryDefs {
 		return ResourceEntryDefs{
 			"config.json":                  RESOURCE_REQUIRED,
 			"vocab.json":                   RESOURCE_OPTIONAL,
+			"vocab.bytes.json":             RESOURCE_OPTIONAL,
 			"merges.txt":                   RESOURCE_OPTIONAL,
 			"special_tokens_map.json":      RESOURCE_OPTIONAL,
 			"encoder.json":                 RESOURCE_OPTIONAL,
@@ -211,9 +212,8 @@ func (rsrcs *Resources) ResolveSpecialTokens(dir string) (
 	if _, ok := (*rsrcs)["specials.json"]; ok {
 		if specErr := json.Unmarshal(*(*rsrcs)["specials.json"].Data,
 			&realizedSpecials); specErr != nil {
-			return nil, errors.New(
-				fmt.Sprintf("cannot unmarshal specials.json: %s",
-					specErr))
+			return nil, fmt.Errorf("%w: cannot unmarshal specials.json: %s",
+				ErrResourceInvalid, specErr)
 		}
 		return realizedSpecials, nil
 	}
@@ -241,12 +241,12 @@ func (rsrcs *Resources) ResolveSpecialTokens(dir string) (
 			case string:
 				specialToken = mvt
 			default:
-				log.Fatal(fmt.Sprintf("unknown format for `special_tokens_map."+
-					"json`: %v", t))
+				return nil, fmt.Errorf("%w: unknown format for "+
+					"`special_tokens_map.json`: %v", ErrResourceInvalid, t)
 			}
 		default:
-			log.Fatal(fmt.Sprintf("unknown format for `special_tokens_map."+
-				"json`: %v", t))
+			return nil, fmt.Errorf("%w: unknown format for "+
+				"`special_tokens_map.json`: %v", ErrResourceInvalid, t)
 		}
 		realizedSpecials[k] = specialToken
 	}
@@ -314,10 +314,9 @@ func ResolveResources(
 				if flag&RESOURCE_REQUIRED != 0 {
 					log.Printf("%s/%s not found, required!",
 						uri, file)
-					return &foundResources, errors.New(
-						fmt.Sprintf(
-							"cannot retrieve required `%s from %s`: %s",
-							uri, file, rsrcSizeErr))
+					return &foundResources, fmt.Errorf(
+						"%w: cannot retrieve required `%s from %s`: %s",
+						ErrResourceMissing, uri, file, rsrcSizeErr)
 				} else {
 					// Otherwise, we can skip it.
 					continue
@@ -341,10 +340,9 @@ func ResolveResources(
 					rsrcFile = *openFile
 				}
 			} else if rsrcReader, rsrcErr := Fetch(uri, file, token); rsrcErr != nil {
-				return &foundResources, errors.New(
-					fmt.Sprintf(
-						"cannot retrieve `%s from %s`: %s",
-						uri, file, rsrcErr))
+				return &foundResources, fmt.Errorf(
+					"%w: cannot retrieve `%s from %s`: %s",
+					ErrDownloadFailed, uri, file, rsrcErr)
 			} else {
 				if dirErr := os.MkdirAll(
 					path.Dir(path.Join(*dir, file)), 0755); dirErr != nil {
@@ -370,9 +368,9 @@ func ResolveResources(
 					io.TeeReader(rsrcReader, counter))
 				rsrcReader.Close()
 				if ioErr != nil {
-					return &foundResources, errors.New(
-						fmt.Sprintf("error downloading '%s': %s",
-							file, ioErr))
+					return &foundResources, fmt.Errorf(
+						"%w: error downloading '%s': %s",
+						ErrDownloadFailed, file, ioErr)
 				} else {
 					log.Println(fmt.Sprintf("Downloaded %s/%s... "+
 						"%s completed.", uri, file,
@@ -388,22 +386,23 @@ func ResolveResources(
 		}
 	}
 
-	flagVocabExist := CheckFileExist(path.Join(*dir, "vocab.json"))
+	flagVocabExist := CheckFileExist(path.Join(*dir, "vocab.json")) ||
+		CheckFileExist(path.Join(*dir, "vocab.bytes.json"))
 
 	// if vocab does not exist, extract it from tokenizer
 	if !flagVocabExist {
 		model, err := ExtractModelFromTokenizer(dir)
 		if err != nil {
-			return &foundResources, errors.New(
-				fmt.Sprintf("Could not extract model from tokenizer %s",
-					err))
+			return &foundResources, fmt.Errorf(
+				"%w: Could not extract model from tokenizer %s",
+				ErrResourceInvalid, err)
 		}
 
 		err = ExtractVocabFromTokenizer(model, dir)
 		if err != nil {
-			return &foundResources, errors.New(
-				fmt.Sprintf("Could not extract vocab from tokenizer %s",
-					err))
+			return &foundResources, fmt.Errorf(
+				"%w: Could not extract vocab from tokenizer %s",
+				ErrResourceInvalid, err)
 		}
 	}
 
@@ -413,16 +412,16 @@ func ResolveResources(
 	if !flagMergesExists {
 		model, err := ExtractModelFromTokenizer(dir)
 		if err != nil {
-			return &foundResources, errors.New(
-				fmt.Sprintf("Could not extract model from tokenizer %s",
-					err))
+			return &foundResources, fmt.Errorf(
+				"%w: Could not extract model from tokenizer %s",
+				ErrResourceInvalid, err)
 		}
 
 		err = ExtractMergesFromTokenizer(model, dir)
 		if err != nil {
-			return &foundResources, errors.New(
-				fmt.Sprintf("Could not extract merges from tokenizer %s",
-					err))
+			return &foundResources, fmt.Errorf(
+				"%w: Could not extract merges from tokenizer %s",
+				ErrResourceInvalid, err)
 		}
 	}
 
@@ -459,7 +458,8 @@ func ResolveResources(
 				rsrcSize, rsrcSizeErr := Size(uri, shardPath, token)
 				if rsrcSizeErr != nil {
 					fmt.Printf("Could not get size of shard %s: %s\n", shardPath, rsrcSizeErr)
-					return &foundResources, errors.New("could not get size of shard")
+					return &foundResources, fmt.Errorf(
+						"%w: could not get size of shard", ErrDownloadFailed)
 				}
 				//print size of shard
 				log.Printf("Remote Size of shard %s is %s\n", shardPath, humanize.Bytes(uint64(rsrcSize)))
@@ -483,9 +483,9 @@ func ResolveResources(
 				var rsrcReader io.ReadCloser
 				rsrcReader, err = Fetch(uri, shardPath, token)
 				if err != nil {
-					return &foundResources, errors.New(
-						fmt.Sprintf("error trying to fetch file: %s",
-							err))
+					return &foundResources, fmt.Errorf(
+						"%w: error trying to fetch file: %s",
+						ErrDownloadFailed, err)
 				}
 
 				//create shard file
@@ -514,9 +514,9 @@ func ResolveResources(
 							err))
 				}
 				if ioErr != nil {
-					return &foundResources, errors.New(
-						fmt.Sprintf("error downloading '%s': %s",
-							shardPath, ioErr))
+					return &foundResources, fmt.Errorf(
+						"%w: error downloading '%s': %s",
+						ErrDownloadFailed, shardPath, ioErr)
 				} else {
 					log.Println(fmt.Sprintf("Downloaded %s/%s... "+
 						"%s completed.", uri, shardPath,
@@ -539,7 +539,9 @@ func ResolveResources(
 					return &foundResources, errors.New("could not get size of local shard")
 				}
 				if (rsrcSize > 0) && (rsrcSize != uint(localShardInfo.Size())) {
-					return &foundResources, errors.New("shard was not downloaded correctly")
+					return &foundResources, fmt.Errorf(
+						"%w: shard was not downloaded correctly",
+						ErrDownloadFailed)
 				}
 				log.Printf("Shard %s downloaded correctly, size is %s\n", shardPath, humanize.Bytes(uint64(localShardInfo.Size())))
 
@@ -566,13 +568,13 @@ func CheckFileExist(path string) bool {
 type HFConfig struct {
 	ModelId        *string `json:"omitempty"`
 	ModelType      *string `json:"model_type,omitempty"`
-	EosTokenId     *uint16 `json:"eos_token_id,omitempty"`
-	BosTokenId     *uint16 `json:"bos_token_id,omitempty"`
-	PadTokenId     *uint16 `json:"pad_token_id,omitempty"`
+	EosTokenId     *uint32 `json:"eos_token_id,omitempty"`
+	BosTokenId     *uint32 `json:"bos_token_id,omitempty"`
+	PadTokenId     *uint32 `json:"pad_token_id,omitempty"`
 	BosTokenStr    *string `json:"bos_token,omitempty"`
 	EosTokenStr    *string `json:"eos_token,omitempty"`
 	PadTokenStr    *string `json:"pad_token,omitempty"`
-	VocabSize      *uint16 `json:"vocab_size,omitempty"`
+	VocabSize      *uint32 `json:"vocab_size,omitempty"`
 	Newlinemode    *string `json:"newlinemode,omitempty"`
 	TokenizerClass *string `json:"tokenizer_class"`
 }
@@ -585,6 +587,12 @@ type SpecialConfig struct {
 	PrefixSpace   bool               `json:"prefix_space"`
 	LowerCase     bool               `json:"lower_case"`
 	EndOfWord     string             `json:"end_of_word"`
+	// CharLevel selects a character level BPE vocabulary, whose characters
+	// that are not in it are encoded as UnkToken, fusing runs of them if
+	// FuseUnk is set.
+	CharLevel bool   `json:"char_level"`
+	UnkToken  string `json:"unk_token"`
+	FuseUnk   bool   `json:"fuse_unk"`
 }
 
 // ResolveConfig
@@ -613,8 +621,8 @@ func ResolveConfig(vocabId string, token string) (config *HFConfig,
 	if configErr := json.Unmarshal(*((*resources)["config.json"]).Data,
 		&hfConfig); configErr != nil {
 		resources.Cleanup()
-		return nil, nil, errors.New(fmt.Sprintf(
-			"error unmarshalling config.json: %s", configErr))
+		return nil, nil, fmt.Errorf("%w: error unmarshalling config.json: %s",
+			ErrResourceInvalid, configErr)
 	}
 
 	specialTokens, specialsErr := resources.ResolveSpecialTokens(dir)
@@ -622,6 +630,15 @@ func ResolveConfig(vocabId string, token string) (config *HFConfig,
 		resources.Cleanup()
 		return nil, nil, specialsErr
 	}
+	applySpecialTokens(&hfConfig, specialTokens)
+
+	return &hfConfig, resources, nil
+}
+
+// applySpecialTokens
+// Sets the special token strings of hfConfig from specialTokens, defaulting
+// to "<|endoftext|>" for those that are not given.
+func applySpecialTokens(hfConfig *HFConfig, specialTokens Specials) {
 	defaultTkn := "<|endoftext|>"
 	eosToken, ok := specialTokens["eos_token"]
 	if !ok {
@@ -648,8 +665,6 @@ func ResolveConfig(vocabId string, token string) (config *HFConfig,
 	if hfConfig.BosTokenStr == nil {
 		hfConfig.BosTokenStr = &defaultTkn
 	}
-
-	return &hfConfig, resources, nil
 }
 
 // ResolveVocabId
@@ -666,28 +681,16 @@ func ResolveVocabId(vocabId string, token string) (*HFConfig, *Resources, error)
 			EosTokenStr: &endOfText,
 			PadTokenStr: &endOfText,
 		}
-		resources := make(Resources, 0)
-
-		if config := GetEmbeddedResource(vocabId + "/encoder." +
-			"json"); config != nil {
-			resources["vocab.json"] = *config
-			resources["encoder.json"] = *config
-		}
-		if vocab := GetEmbeddedResource(vocabId + "/vocab.bpe"); vocab != nil {
-			resources["merges.txt"] = *vocab
-		}
-		if specials_t := GetEmbeddedResource(vocabId + "/specials.txt"); specials_t != nil {
-			resources["specials.txt"] = *specials_t
-		}
-		if specials := GetEmbeddedResource(vocabId + "/special_tokens_map." +
-			"json"); specials != nil {
-			resources["special_tokens_map.json"] = *specials
-		}
-		special_config := GetEmbeddedResource(vocabId + "/special_config.json")
-		if special_config != nil {
-			resources["special_config.json"] = *special_config
-		}
-		return hf, &resources, nil
+		resources := resolveEmbeddedLayout(func(name string) *ResourceEntry {
+			return GetEmbeddedResource(vocabId + "/" + name)
+		})
+		return hf, resources, nil
+	}
+	if IsPackageDir(vocabId) {
+		return ResolvePackageDir(vocabId)
+	}
+	if err := CheckUnsignedAllowed(vocabId); err != nil {
+		return nil, nil, err
 	}
 	if isValidUrl(vocabId) {
 		u, _ := url.Parse(vocabId)
@@ -4,8 +4,6 @@ package resources
 
 import (
 	"embed"
-	"errors"
-	"fmt"
 	"io"
 	"net/http"
 	"strconv"
@@ -67,8 +65,8 @@ func FetchHTTP(uri string, rsrc string, auth string) (io.ReadCloser, error) {
 		return nil, remoteErr
 	}
 	if resp.StatusCode != 200 {
-		return nil, errors.New(fmt.Sprintf("HTTP status code %d",
-			resp.StatusCode))
+		resp.Body.Close()
+		return nil, &HTTPStatusError{uri + "/" + rsrc, resp.StatusCode}
 	}
 	return resp.Body, nil
 }
@@ -87,8 +85,7 @@ func SizeHTTP(uri string, rsrc string, auth string) (uint, error) {
 	if remoteErr != nil {
 		return 0, remoteErr
 	} else if resp.StatusCode != 200 {
-		return 0, errors.New(fmt.Sprintf("HTTP status code %d",
-			resp.StatusCode))
+		return 0, &HTTPStatusError{uri + "/" + rsrc, resp.StatusCode}
 	} else {
 		size, _ := strconv.Atoi(resp.Header.Get("Content-Length"))
 		return uint(size), nil
@@ -0,0 +1,162 @@
+package resources
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"sync"
+)
+
+// PACKAGE_MANIFEST_FILE is the file of a packaged tokenizer that lists the
+// sha256 digest of each of its files, and is what its signature signs.
+const PACKAGE_MANIFEST_FILE = "package.json"
+
+// PACKAGE_SIGNATURE_FILE is the detached ed25519 signature of the manifest
+// of a packaged tokenizer, written as base64.
+const PACKAGE_SIGNATURE_FILE = "package.sig"
+
+// ErrSignatureInvalid
+// A packaged tokenizer is unsigned, is not signed by a trusted key, or its
+// files do not match the digests that its signature covers.
+var ErrSignatureInvalid = errors.New("signature invalid")
+
+var (
+	trustedKeysMtx sync.RWMutex
+	trustedKeys    []ed25519.PublicKey
+)
+
+// RequireSignedPackages
+// Requires every tokenizer that is resolved from outside the binary to be a
+// packaged tokenizer signed by one of keys, so that only approved
+// vocabularies are used. Tokenizers that are not packaged, or that are
+// unsigned or fail verification, fail to resolve with ErrSignatureInvalid.
+// The embedded tokenizers are always allowed. Calling it with no keys lifts
+// the requirement.
+func RequireSignedPackages(keys ...ed25519.PublicKey) {
+	trustedKeysMtx.Lock()
+	defer trustedKeysMtx.Unlock()
+	trustedKeys = append([]ed25519.PublicKey(nil), keys...)
+}
+
+// signaturesRequired returns the trusted keys, or nil if signatures are not
+// required.
+func signaturesRequired() []ed25519.PublicKey {
+	trustedKeysMtx.RLock()
+	defer trustedKeysMtx.RUnlock()
+	return trustedKeys
+}
+
+// CheckUnsignedAllowed
+// Fails with ErrSignatureInvalid if RequireSignedPackages requires signed
+// packages, for loaders of tokenizers that are not packaged, and so cannot be
+// signed, such as those of other layouts.
+func CheckUnsignedAllowed(source string) error {
+	if len(signaturesRequired()) > 0 {
+		return fmt.Errorf("%w: %s is not a signed package, and signed "+
+			"packages are required", ErrSignatureInvalid, source)
+	}
+	return nil
+}
+
+// SignPackageDir
+// Signs the manifest of the packaged tokenizer in dir with key, writing the
+// signature to PACKAGE_SIGNATURE_FILE.
+func SignPackageDir(dir string, key ed25519.PrivateKey) error {
+	manifest, err := os.ReadFile(path.Join(dir, PACKAGE_MANIFEST_FILE))
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrResourceMissing, err)
+	}
+	signature := base64.StdEncoding.EncodeToString(
+		ed25519.Sign(key, manifest))
+	return os.WriteFile(path.Join(dir, PACKAGE_SIGNATURE_FILE),
+		[]byte(signature+"\n"), 0644)
+}
+
+// VerifyPackageDir
+// Verifies that the manifest of the packaged tokenizer in dir is signed by
+// one of keys, and that each file that it lists has the digest that it
+// lists, failing with ErrSignatureInvalid otherwise.
+func VerifyPackageDir(dir string, keys ...ed25519.PublicKey) error {
+	digests, err := verifyManifest(dir, keys)
+	if err != nil {
+		return err
+	}
+	for name := range digests {
+		data, err := os.ReadFile(path.Join(dir, name))
+		if err != nil {
+			return fmt.Errorf("%w: %s/%s: %s", ErrSignatureInvalid, dir,
+				name, err)
+		}
+		if err := checkDigest(dir, name, data, digests); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// verifyManifest verifies that the manifest of the packaged tokenizer in dir
+// is signed by one of keys, and returns the digests that it lists, by the
+// name of their file.
+func verifyManifest(dir string,
+	keys []ed25519.PublicKey) (map[string]string, error) {
+	manifest, err := os.ReadFile(path.Join(dir, PACKAGE_MANIFEST_FILE))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s has no %s", ErrSignatureInvalid,
+			dir, PACKAGE_MANIFEST_FILE)
+	}
+	encoded, err := os.ReadFile(path.Join(dir, PACKAGE_SIGNATURE_FILE))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s has no %s", ErrSignatureInvalid,
+			dir, PACKAGE_SIGNATURE_FILE)
+	}
+	signature, err := base64.StdEncoding.DecodeString(
+		strings.TrimSpace(string(encoded)))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s/%s: %s", ErrSignatureInvalid, dir,
+			PACKAGE_SIGNATURE_FILE, err)
+	}
+	trusted := false
+	for _, key := range keys {
+		if ed25519.Verify(key, manifest, signature) {
+			trusted = true
+			break
+		}
+	}
+	if !trusted {
+		return nil, fmt.Errorf("%w: %s is not signed by a trusted key",
+			ErrSignatureInvalid, dir)
+	}
+
+	var info struct {
+		Files map[string]string `json:"files"`
+	}
+	if err := json.Unmarshal(manifest, &info); err != nil {
+		return nil, fmt.Errorf("%w: error unmarshalling %s/%s: %s",
+			ErrSignatureInvalid, dir, PACKAGE_MANIFEST_FILE, err)
+	}
+	return info.Files, nil
+}
+
+// checkDigest fails with ErrSignatureInvalid unless data, read from the file
+// name of dir, has the digest that the manifest lists for it.
+func checkDigest(dir string, name string, data []byte,
+	digests map[string]string) error {
+	expected, ok := digests[name]
+	if !ok {
+		return fmt.Errorf("%w: %s/%s is not in the signed manifest",
+			ErrSignatureInvalid, dir, name)
+	}
+	digest := sha256.Sum256(data)
+	if hex.EncodeToString(digest[:]) != expected {
+		return fmt.Errorf("%w: %s/%s does not match its digest",
+			ErrSignatureInvalid, dir, name)
+	}
+	return nil
+}
@@ -0,0 +1,173 @@
+package resources
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// tiktokenByteRunes returns the runes that GPT-2 style vocabularies write
+// each byte as, where printable bytes are themselves and the others are
+// mapped past the end of Latin-1, in order.
+func tiktokenByteRunes() (byteRunes [256]rune) {
+	unprintable := 0
+	for b := 0; b < 256; b++ {
+		if (b >= '!' && b <= '~') || (b >= 0xa1 && b <= 0xac) ||
+			(b >= 0xae && b <= 0xff) {
+			byteRunes[b] = rune(b)
+		} else {
+			byteRunes[b] = rune(256 + unprintable)
+			unprintable++
+		}
+	}
+	return byteRunes
+}
+
+// ParseTiktokenRanks
+// Parses a tiktoken ranks file, of a line of the base64 bytes of each token
+// followed by its rank, into the bytes of the tokens indexed by rank. Ranks
+// that the file skips, such as those of special tokens, are nil.
+func ParseTiktokenRanks(data []byte) ([][]byte, error) {
+	tokens := make([][]byte, 0, bytes.Count(data, []byte("\n"))+1)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := scanner.Text()
+		if line == "" {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%w: line %d of tiktoken ranks: %q",
+				ErrResourceInvalid, lineNumber, line)
+		}
+		token, err := base64.StdEncoding.DecodeString(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("%w: line %d of tiktoken ranks: %s",
+				ErrResourceInvalid, lineNumber, err)
+		}
+		rank, err := strconv.Atoi(fields[1])
+		if err != nil || rank < 0 {
+			return nil, fmt.Errorf("%w: line %d of tiktoken ranks: "+
+				"invalid rank %q", ErrResourceInvalid, lineNumber, fields[1])
+		}
+		for len(tokens) <= rank {
+			tokens = append(tokens, nil)
+		}
+		if tokens[rank] != nil {
+			return nil, fmt.Errorf("%w: line %d of tiktoken ranks: "+
+				"duplicate rank %d", ErrResourceInvalid, lineNumber, rank)
+		}
+		tokens[rank] = token
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrResourceInvalid, err)
+	}
+	return tokens, nil
+}
+
+// TiktokenResources
+// Converts the tokens of a tiktoken ranks file, from ParseTiktokenRanks, and
+// the ids of its special tokens into the encoder.json, vocab.json,
+// merges.txt and specials.txt of a BPE tokenizer, with <|endoftext|> as its
+// BOS, EOS and padding token, or for LLaMA 3, <|begin_of_text|> as its BOS
+// and <|end_of_text|> as its EOS and padding token. As tiktoken merges the
+// pair of parts that makes the token of the lowest rank, each way of
+// splitting a token into two others is a merge, ranked by the token, and
+// then by its parts.
+func TiktokenResources(modelId string, tokens [][]byte,
+	specials map[string]int) (*HFConfig, *Resources, error) {
+	beginOfText, endOfText := "<|endoftext|>", "<|endoftext|>"
+	if _, ok := specials["<|end_of_text|>"]; ok {
+		beginOfText, endOfText = "<|begin_of_text|>", "<|end_of_text|>"
+	}
+	for _, special := range []string{beginOfText, endOfText} {
+		if _, ok := specials[special]; !ok {
+			return nil, nil, fmt.Errorf("%w: tiktoken encoding %s has "+
+				"no %s", ErrResourceInvalid, modelId, special)
+		}
+	}
+
+	byteRunes := tiktokenByteRunes()
+	mapped := make([]string, len(tokens))
+	ranks := make(map[string]int, len(tokens))
+	for rank, token := range tokens {
+		if token == nil {
+			continue
+		}
+		var builder strings.Builder
+		for _, b := range token {
+			builder.WriteRune(byteRunes[b])
+		}
+		mapped[rank] = builder.String()
+		ranks[string(token)] = rank
+	}
+
+	vocab := make(map[string]int, len(tokens)+len(specials))
+	for rank, text := range mapped {
+		if tokens[rank] != nil {
+			vocab[text] = rank
+		}
+	}
+	specialNames := make([]string, 0, len(specials))
+	for special, id := range specials {
+		vocab[special] = id
+		specialNames = append(specialNames, special)
+	}
+	sort.Strings(specialNames)
+	vocabJson, err := json.Marshal(vocab)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	type merge struct {
+		rank, left, right int
+	}
+	merges := make([]merge, 0, 2*len(tokens))
+	for rank, token := range tokens {
+		for split := 1; split < len(token); split++ {
+			left, hasLeft := ranks[string(token[:split])]
+			right, hasRight := ranks[string(token[split:])]
+			if hasLeft && hasRight {
+				merges = append(merges, merge{rank, left, right})
+			}
+		}
+	}
+	sort.Slice(merges, func(i, j int) bool {
+		if merges[i].rank != merges[j].rank {
+			return merges[i].rank < merges[j].rank
+		}
+		if merges[i].left != merges[j].left {
+			return merges[i].left < merges[j].left
+		}
+		return merges[i].right < merges[j].right
+	})
+	var mergesTxt bytes.Buffer
+	mergesTxt.WriteString("#version: 0.2\n")
+	for _, m := range merges {
+		mergesTxt.WriteString(mapped[m.left])
+		mergesTxt.WriteByte(' ')
+		mergesTxt.WriteString(mapped[m.right])
+		mergesTxt.WriteByte('\n')
+	}
+	mergesData := mergesTxt.Bytes()
+	specialsData := []byte(strings.Join(specialNames, "\n") + "\n")
+
+	resources := Resources{
+		"encoder.json": ResourceEntry{nil, &vocabJson},
+		"vocab.json":   ResourceEntry{nil, &vocabJson},
+		"merges.txt":   ResourceEntry{nil, &mergesData},
+		"specials.txt": ResourceEntry{nil, &specialsData},
+	}
+	hfConfig := &HFConfig{
+		ModelId:     &modelId,
+		BosTokenStr: &beginOfText,
+		EosTokenStr: &endOfText,
+		PadTokenStr: &endOfText,
+	}
+	return hfConfig, &resources, nil
+}
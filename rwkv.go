@@ -0,0 +1,167 @@
+package gpt_bpe
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/wbrown/gpt_bpe/resources"
+)
+
+// RWKV_WORLD_VOCAB_URL is where the vocabulary of RWKV's World models,
+// RWKV_WORLD_VOCAB, is downloaded from.
+const RWKV_WORLD_VOCAB_URL = "https://raw.githubusercontent.com/BlinkDL/" +
+	"ChatRWKV/main/tokenizer"
+
+// RWKV_WORLD_VOCAB is the file name of the vocabulary of RWKV's World
+// models, of 65529 tokens.
+const RWKV_WORLD_VOCAB = "rwkv_vocab_v20230424.txt"
+
+// ParseRWKVVocab
+// Parses an RWKV vocabulary, of a token on each line as its id, its text as a
+// Python str or bytes literal, and the length of its bytes. Lines that are
+// not of that form, or whose bytes are not of their length, fail with
+// ErrVocabInvalid.
+func ParseRWKVVocab(reader io.Reader) (map[Token][]byte, error) {
+	vocab := make(map[Token][]byte)
+	scanner := bufio.NewScanner(reader)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if line == "" {
+			continue
+		}
+		first, last := strings.IndexByte(line, ' '),
+			strings.LastIndexByte(line, ' ')
+		if first < 0 || first == last {
+			return nil, fmt.Errorf("%w: line %d: %q", ErrVocabInvalid,
+				lineNum, line)
+		}
+		id, err := strconv.ParseUint(line[:first], 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("%w: line %d: id: %s",
+				ErrTokenOutOfRange, lineNum, err)
+		}
+		length, err := strconv.Atoi(line[last+1:])
+		if err != nil {
+			return nil, fmt.Errorf("%w: line %d: length: %s",
+				ErrVocabInvalid, lineNum, err)
+		}
+		tokenBytes, err := parsePythonLiteral(line[first+1 : last])
+		if err != nil {
+			return nil, fmt.Errorf("%w: line %d: %s", ErrVocabInvalid,
+				lineNum, err)
+		}
+		if len(tokenBytes) != length {
+			return nil, fmt.Errorf("%w: line %d: %d bytes, not %d",
+				ErrVocabInvalid, lineNum, len(tokenBytes), length)
+		}
+		vocab[Token(id)] = tokenBytes
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return vocab, nil
+}
+
+// parsePythonLiteral returns the bytes of a Python str literal, encoded as
+// UTF-8, or of a bytes literal, with the escapes that repr writes.
+func parsePythonLiteral(literal string) ([]byte, error) {
+	isBytes := strings.HasPrefix(literal, "b")
+	if isBytes {
+		literal = literal[1:]
+	}
+	if len(literal) < 2 || (literal[0] != '\'' && literal[0] != '"') ||
+		literal[len(literal)-1] != literal[0] {
+		return nil, fmt.Errorf("not a literal: %s", literal)
+	}
+	literal = literal[1 : len(literal)-1]
+	var parsed bytes.Buffer
+	for idx := 0; idx < len(literal); {
+		if literal[idx] != '\\' {
+			r, size := utf8.DecodeRuneInString(literal[idx:])
+			if isBytes && r >= utf8.RuneSelf {
+				return nil, fmt.Errorf("non-ASCII bytes literal: %s",
+					literal)
+			}
+			parsed.WriteString(literal[idx : idx+size])
+			idx += size
+			continue
+		}
+		if idx+1 >= len(literal) {
+			return nil, fmt.Errorf("trailing backslash: %s", literal)
+		}
+		escape := literal[idx+1]
+		idx += 2
+		if simple := strings.IndexByte(`\'"nrtabfv0`, escape); simple >= 0 {
+			parsed.WriteByte("\\'\"\n\r\t\a\b\f\v\x00"[simple])
+			continue
+		}
+		digits := map[byte]int{'x': 2, 'u': 4, 'U': 8}[escape]
+		if digits == 0 || (isBytes && escape != 'x') ||
+			idx+digits > len(literal) {
+			return nil, fmt.Errorf("invalid escape \\%c: %s", escape,
+				literal)
+		}
+		value, err := strconv.ParseUint(literal[idx:idx+digits], 16, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid escape \\%c: %s", escape,
+				literal)
+		}
+		idx += digits
+		if isBytes {
+			parsed.WriteByte(byte(value))
+		} else {
+			parsed.WriteRune(rune(value))
+		}
+	}
+	return parsed.Bytes(), nil
+}
+
+// NewRWKVEncoder
+// Returns a TrieEncoder for the RWKV vocabulary read from reader, as
+// ParseRWKVVocab parses it.
+func NewRWKVEncoder(name string, reader io.Reader) (*TrieEncoder, error) {
+	vocab, err := ParseRWKVVocab(reader)
+	if err != nil {
+		return nil, err
+	}
+	return NewTrieEncoder(name, vocab)
+}
+
+// NewRWKVWorldEncoder
+// Returns a TrieEncoder for the vocabulary of RWKV's World models,
+// downloading RWKV_WORLD_VOCAB from RWKV_WORLD_VOCAB_URL.
+func NewRWKVWorldEncoder() (*TrieEncoder, error) {
+	body, err := resources.FetchHTTP(RWKV_WORLD_VOCAB_URL, RWKV_WORLD_VOCAB,
+		"")
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s: %v", ErrDownloadFailed,
+			RWKV_WORLD_VOCAB, err)
+	}
+	defer body.Close()
+	return NewRWKVEncoder(RWKV_WORLD_VOCAB, body)
+}
+
+// newRWKVEncoderFromDir returns a TrieEncoder for the RWKV vocabulary in dir.
+func newRWKVEncoderFromDir(dir string) (*TrieEncoder, error) {
+	if err := resources.CheckUnsignedAllowed(dir); err != nil {
+		return nil, err
+	}
+	paths, _ := filepath.Glob(filepath.Join(dir, "rwkv_vocab*.txt"))
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("%w: no RWKV vocabulary in %s",
+			ErrResourceMissing, dir)
+	}
+	file, err := os.Open(paths[0])
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrResourceMissing, err)
+	}
+	defer file.Close()
+	return NewRWKVEncoder(filepath.Base(paths[0]), file)
+}
@@ -0,0 +1,169 @@
+package gpt_bpe
+
+import (
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// SpecialMatchKind
+// How a span of text matches a special token.
+type SpecialMatchKind uint8
+
+const (
+	// SpecialExact spans are the text of a special token.
+	SpecialExact SpecialMatchKind = iota
+	// SpecialNormalized spans become the text of a special token once
+	// normalized, by the encoder's normalizer, replacements or lower casing,
+	// or by the folding of fullwidth forms that NFKC normalization does.
+	SpecialNormalized
+)
+
+func (kind SpecialMatchKind) String() string {
+	switch kind {
+	case SpecialExact:
+		return "exact"
+	case SpecialNormalized:
+		return "normalized"
+	default:
+		return "unknown"
+	}
+}
+
+// SpecialMatch
+// A span of text that would encode to a special token, from ScanSpecials.
+type SpecialMatch struct {
+	Start   int
+	End     int
+	Special string
+	Kind    SpecialMatchKind
+}
+
+// neutralizer is inserted into special tokens to break them up.
+const neutralizer = "\u200b"
+
+// normalizeRune returns how r is normalized when scanning for specials.
+func (encoder *GPTEncoder) normalizeRune(r rune) string {
+	// Fullwidth forms of ASCII, and the ideographic space.
+	if r >= 0xff01 && r <= 0xff5e {
+		r -= 0xff01 - 0x21
+	} else if r == 0x3000 {
+		r = ' '
+	}
+	return encoder.normalizeForEncoding(r)
+}
+
+// findSpecials returns the spans of text that are the text of a special
+// token, preferring the earliest and then the longest of overlapping spans.
+func (encoder *GPTEncoder) findSpecials(text string,
+	kind SpecialMatchKind) []SpecialMatch {
+	found := make([]SpecialMatch, 0)
+	for special := range encoder.specials {
+		if special == "" {
+			continue
+		}
+		for offset := 0; offset < len(text); {
+			idx := strings.Index(text[offset:], special)
+			if idx < 0 {
+				break
+			}
+			start := offset + idx
+			found = append(found, SpecialMatch{start, start + len(special),
+				special, kind})
+			_, size := utf8.DecodeRuneInString(text[start:])
+			offset = start + size
+		}
+	}
+	sort.Slice(found, func(i, j int) bool {
+		if found[i].Start != found[j].Start {
+			return found[i].Start < found[j].Start
+		}
+		return found[i].End > found[j].End
+	})
+	matches := make([]SpecialMatch, 0, len(found))
+	for _, match := range found {
+		if len(matches) == 0 || match.Start >= matches[len(matches)-1].End {
+			matches = append(matches, match)
+		}
+	}
+	return matches
+}
+
+// ScanSpecials
+// Returns the spans of text that would encode to the encoder's special
+// tokens, either exactly, or once normalized, so that servers can reject or
+// neutralize untrusted input that would inject control tokens into prompts.
+// Normalized matches that overlap exact ones are not returned.
+func (encoder *GPTEncoder) ScanSpecials(text string) []SpecialMatch {
+	matches := encoder.findSpecials(text, SpecialExact)
+
+	// The normalized text, with the offset in text of each of its bytes.
+	var normalized strings.Builder
+	starts := make([]int, 0, len(text))
+	ends := make([]int, 0, len(text))
+	for offset, r := range text {
+		piece := encoder.normalizeRune(r)
+		normalized.WriteString(piece)
+		_, size := utf8.DecodeRuneInString(text[offset:])
+		for idx := 0; idx < len(piece); idx++ {
+			starts = append(starts, offset)
+			ends = append(ends, offset+size)
+		}
+	}
+	if normalized.String() == text {
+		return matches
+	}
+
+	for _, match := range encoder.findSpecials(normalized.String(),
+		SpecialNormalized) {
+		start, end := starts[match.Start], ends[match.End-1]
+		overlaps := false
+		for _, exact := range matches {
+			if exact.Kind == SpecialExact && start < exact.End &&
+				exact.Start < end {
+				overlaps = true
+				break
+			}
+		}
+		if !overlaps {
+			matches = append(matches, SpecialMatch{start, end, match.Special,
+				SpecialNormalized})
+		}
+	}
+	sort.SliceStable(matches, func(i, j int) bool {
+		return matches[i].Start < matches[j].Start
+	})
+	return matches
+}
+
+// NeutralizeSpecials
+// Returns text with the spans that ScanSpecials finds broken up, so that
+// none of them encodes to a special token. A zero width space is inserted
+// after the first character of each span, and spans of a single character,
+// such as a newline that is replaced with a special token, are replaced
+// with the Unicode replacement character.
+func (encoder *GPTEncoder) NeutralizeSpecials(text string) string {
+	matches := encoder.ScanSpecials(text)
+	if len(matches) == 0 {
+		return text
+	}
+	var neutralized strings.Builder
+	offset := 0
+	for _, match := range matches {
+		if match.Start < offset {
+			continue
+		}
+		neutralized.WriteString(text[offset:match.Start])
+		_, size := utf8.DecodeRuneInString(text[match.Start:])
+		if match.Start+size == match.End {
+			neutralized.WriteRune(utf8.RuneError)
+		} else {
+			neutralized.WriteString(text[match.Start : match.Start+size])
+			neutralized.WriteString(neutralizer)
+			neutralized.WriteString(text[match.Start+size : match.End])
+		}
+		offset = match.End
+	}
+	neutralized.WriteString(text[offset:])
+	return neutralized.String()
+}
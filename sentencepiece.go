@@ -0,0 +1,745 @@
+package gpt_bpe
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/wbrown/gpt_bpe/resources"
+)
+
+// SentencePieceModel
+// The algorithm that a SentencePieceEncoder segments text with.
+type SentencePieceModel uint8
+
+const (
+	// SentencePieceUnigram segments text into the pieces whose scores sum
+	// highest, as T5 and other Unigram tokenizers do.
+	SentencePieceUnigram SentencePieceModel = iota
+	// SentencePieceBPE merges the adjacent pieces that make the piece of the
+	// highest score, as LLaMA does.
+	SentencePieceBPE
+)
+
+// DummyPrefix
+// Where a SentencePieceEncoder prepends the whitespace marker to text, so
+// that the first word of text is encoded as the words that follow spaces
+// are.
+type DummyPrefix uint8
+
+const (
+	// DummyPrefixNever never prepends the marker.
+	DummyPrefixNever DummyPrefix = iota
+	// DummyPrefixFirst prepends the marker to the start of the text, as
+	// SentencePiece does.
+	DummyPrefixFirst
+	// DummyPrefixAlways prepends the marker to each run of text between
+	// special tokens, as huggingface's Metaspace does by default.
+	DummyPrefixAlways
+)
+
+// SENTENCEPIECE_SPACE is the marker that SentencePiece escapes spaces as.
+const SENTENCEPIECE_SPACE = "▁"
+
+// The types of the pieces of a SentencePiece model.
+const (
+	sentencePieceNormal      = 1
+	sentencePieceUnknown     = 2
+	sentencePieceControl     = 3
+	sentencePieceUserDefined = 4
+	sentencePieceUnused      = 5
+	sentencePieceByte        = 6
+)
+
+// sentencePieceUnkPenalty is how much lower than the lowest piece score an
+// unknown character scores, as SentencePiece penalizes them.
+const sentencePieceUnkPenalty = 10.0
+
+type sentencePiece struct {
+	text      string
+	score     float32
+	pieceType int
+}
+
+// SentencePieceEncoder
+// Encodes text with a SentencePiece model natively, segmenting it by the
+// scores of its pieces rather than approximating it with BPE merges, so that
+// LLaMA and T5 style tokenizers encode exactly. It is loaded from a
+// SentencePiece .model file, or from a huggingface tokenizer.json with a
+// Unigram model.
+type SentencePieceEncoder struct {
+	BosToken Token
+	EosToken Token
+	PadToken Token
+	UnkToken Token
+	model    SentencePieceModel
+	pieces   []sentencePiece
+	// byText maps the text of each piece that text is segmented into to
+	// its token.
+	byText       map[string]Token
+	bytePieces   [256]Token
+	byteTokens   map[Token]byte
+	byteFallback bool
+	specials     map[string]Tokens
+	specialsPat  *regexp.Regexp
+	minScore     float32
+	longestPiece int
+	// splitWords is whether no piece spans the start of a word, so that
+	// words are segmented apart from each other.
+	splitWords             bool
+	charsMap               *sentencePieceCharsMap
+	addDummyPrefix         DummyPrefix
+	removeExtraWhitespaces bool
+	escapeWhitespaces      bool
+}
+
+var _ Encoder = (*SentencePieceEncoder)(nil)
+
+// newSentencePieceEncoder returns a SentencePieceEncoder for pieces, whose
+// unknown piece is unkId. Control and user defined pieces are special
+// tokens.
+func newSentencePieceEncoder(model SentencePieceModel,
+	pieces []sentencePiece, unkId int) (*SentencePieceEncoder, error) {
+	if len(pieces) == 0 {
+		return nil, fmt.Errorf("%w: sentencepiece model has no pieces",
+			ErrResourceInvalid)
+	}
+	if int64(len(pieces)) > int64(^Token(0))+1 {
+		return nil, fmt.Errorf("%w: sentencepiece model has %d pieces, "+
+			"more than a Token holds", ErrTokenOutOfRange, len(pieces))
+	}
+	if unkId < 0 || unkId >= len(pieces) {
+		return nil, fmt.Errorf("%w: sentencepiece unknown piece %d is not "+
+			"in the model", ErrResourceInvalid, unkId)
+	}
+	encoder := &SentencePieceEncoder{
+		UnkToken:          Token(unkId),
+		model:             model,
+		pieces:            pieces,
+		byText:            make(map[string]Token, len(pieces)),
+		byteTokens:        make(map[Token]byte),
+		specials:          make(map[string]Tokens),
+		minScore:          float32(math.Inf(1)),
+		splitWords:        true,
+		addDummyPrefix:    DummyPrefixFirst,
+		escapeWhitespaces: true,
+	}
+	pieces[unkId].pieceType = sentencePieceUnknown
+	for id, piece := range pieces {
+		token := Token(id)
+		switch piece.pieceType {
+		case sentencePieceControl, sentencePieceUserDefined:
+			if piece.text != "" {
+				encoder.specials[piece.text] = Tokens{token}
+			}
+		case sentencePieceByte:
+			var b byte
+			if _, err := fmt.Sscanf(piece.text, "<0x%02X>",
+				&b); err != nil {
+				return nil, fmt.Errorf("%w: sentencepiece byte piece %q",
+					ErrResourceInvalid, piece.text)
+			}
+			encoder.bytePieces[b] = token
+			encoder.byteTokens[token] = b
+		case sentencePieceNormal:
+			encoder.byText[piece.text] = token
+			if piece.score < encoder.minScore {
+				encoder.minScore = piece.score
+			}
+			if len(piece.text) > encoder.longestPiece {
+				encoder.longestPiece = len(piece.text)
+			}
+			// A piece with the marker after its start would join words.
+			if idx := strings.Index(strings.TrimLeft(piece.text,
+				SENTENCEPIECE_SPACE), SENTENCEPIECE_SPACE); idx >= 0 {
+				encoder.splitWords = false
+			}
+		}
+	}
+	encoder.updateSpecials()
+	return encoder, nil
+}
+
+// updateSpecials recompiles the pattern that special tokens are found in
+// text with.
+func (encoder *SentencePieceEncoder) updateSpecials() {
+	quoted := make([]string, 0, len(encoder.specials))
+	for special := range encoder.specials {
+		quoted = append(quoted, regexp.QuoteMeta(special))
+	}
+	// Longer specials are matched before those that they start with.
+	sort.Slice(quoted, func(i, j int) bool {
+		if len(quoted[i]) != len(quoted[j]) {
+			return len(quoted[i]) > len(quoted[j])
+		}
+		return quoted[i] < quoted[j]
+	})
+	encoder.specialsPat = nil
+	if len(quoted) > 0 {
+		encoder.specialsPat = regexp.MustCompile(strings.Join(quoted, "|"))
+	}
+}
+
+// setSpecialToken sets token to the id of the piece, when the model has it.
+func (encoder *SentencePieceEncoder) setSpecialToken(token *Token, id int) {
+	if id >= 0 && id < len(encoder.pieces) {
+		*token = Token(id)
+	}
+}
+
+// Model
+// Returns the algorithm that the encoder segments text with.
+func (encoder *SentencePieceEncoder) Model() SentencePieceModel {
+	return encoder.model
+}
+
+// Encode
+// Encodes text into tokens. Special tokens in the text are encoded as their
+// token, and the rest is normalized and segmented by the model. Characters
+// that no piece covers are encoded as their bytes when the model has byte
+// pieces, and as the unknown token otherwise.
+func (encoder *SentencePieceEncoder) Encode(text *string) *Tokens {
+	tokens := make(Tokens, 0, len(*text)/3+1)
+	segment := func(begin int, end int) {
+		normalized := encoder.normalize((*text)[begin:end],
+			encoder.addDummyPrefix == DummyPrefixAlways ||
+				(encoder.addDummyPrefix == DummyPrefixFirst && begin == 0))
+		for _, word := range encoder.words(normalized) {
+			tokens = append(tokens, encoder.encodeWord(word)...)
+		}
+	}
+	begin := 0
+	if encoder.specialsPat != nil {
+		for _, match := range encoder.specialsPat.FindAllStringIndex(*text,
+			-1) {
+			if match[0] > begin {
+				segment(begin, match[0])
+			}
+			tokens = append(tokens,
+				encoder.specials[(*text)[match[0]:match[1]]]...)
+			begin = match[1]
+		}
+	}
+	if begin < len(*text) {
+		segment(begin, len(*text))
+	}
+	return &tokens
+}
+
+// normalize normalizes text as the model's normalizer does, escaping its
+// whitespace with SENTENCEPIECE_SPACE.
+func (encoder *SentencePieceEncoder) normalize(text string,
+	dummyPrefix bool) string {
+	if encoder.charsMap != nil {
+		text = encoder.charsMap.normalize(text)
+	}
+	if encoder.removeExtraWhitespaces {
+		text = strings.Join(strings.FieldsFunc(text, func(r rune) bool {
+			return r == ' '
+		}), " ")
+	}
+	if dummyPrefix && text != "" {
+		text = " " + text
+	}
+	if encoder.escapeWhitespaces {
+		text = strings.ReplaceAll(text, " ", SENTENCEPIECE_SPACE)
+	}
+	return text
+}
+
+// words splits normalized text before each run of whitespace markers, when
+// no piece spans the start of a word, so that words are segmented apart.
+func (encoder *SentencePieceEncoder) words(normalized string) []string {
+	if !encoder.splitWords || !encoder.escapeWhitespaces {
+		return []string{normalized}
+	}
+	words := make([]string, 0, len(normalized)/4+1)
+	begin := 0
+	inMarkers := true
+	for idx, r := range normalized {
+		isMarker := string(r) == SENTENCEPIECE_SPACE
+		if isMarker && !inMarkers {
+			words = append(words, normalized[begin:idx])
+			begin = idx
+		}
+		inMarkers = isMarker
+	}
+	if begin < len(normalized) {
+		words = append(words, normalized[begin:])
+	}
+	return words
+}
+
+// encodeWord segments a word of normalized text into tokens.
+func (encoder *SentencePieceEncoder) encodeWord(word string) Tokens {
+	var pieces []string
+	if encoder.model == SentencePieceBPE {
+		pieces = encoder.mergeWord(word)
+	} else {
+		pieces = encoder.viterbi(word)
+	}
+	tokens := make(Tokens, 0, len(pieces))
+	for _, piece := range pieces {
+		if token, ok := encoder.byText[piece]; ok {
+			tokens = append(tokens, token)
+		} else if encoder.byteFallback {
+			for idx := 0; idx < len(piece); idx++ {
+				tokens = append(tokens, encoder.bytePieces[piece[idx]])
+			}
+		} else if len(tokens) == 0 ||
+			tokens[len(tokens)-1] != encoder.UnkToken {
+			// Consecutive unknown characters are one unknown token, as
+			// SentencePiece encodes them.
+			tokens = append(tokens, encoder.UnkToken)
+		}
+	}
+	return tokens
+}
+
+// viterbi returns the pieces of word whose scores sum highest, where each
+// character that no piece starts with is a piece of its own.
+func (encoder *SentencePieceEncoder) viterbi(word string) []string {
+	type node struct {
+		score float64
+		begin int
+		found bool
+	}
+	best := make([]node, len(word)+1)
+	best[0].found = true
+	unkScore := float64(encoder.minScore) - sentencePieceUnkPenalty
+	for begin := 0; begin < len(word); {
+		_, charLen := utf8.DecodeRuneInString(word[begin:])
+		if best[begin].found {
+			covered := false
+			for end := begin + charLen; end <= len(word) &&
+				end-begin <= encoder.longestPiece; {
+				if token, ok := encoder.byText[word[begin:end]]; ok {
+					score := best[begin].score +
+						float64(encoder.pieces[token].score)
+					if !best[end].found || score > best[end].score {
+						best[end] = node{score, begin, true}
+					}
+					if end == begin+charLen {
+						covered = true
+					}
+				}
+				_, size := utf8.DecodeRuneInString(word[end:])
+				if size == 0 {
+					break
+				}
+				end += size
+			}
+			if end := begin + charLen; !covered {
+				score := best[begin].score + unkScore
+				if !best[end].found || score > best[end].score {
+					best[end] = node{score, begin, true}
+				}
+			}
+		}
+		begin += charLen
+	}
+	pieces := make([]string, 0, len(word)/2+1)
+	for end := len(word); end > 0; end = best[end].begin {
+		pieces = append(pieces, word[best[end].begin:end])
+	}
+	for i, j := 0, len(pieces)-1; i < j; i, j = i+1, j-1 {
+		pieces[i], pieces[j] = pieces[j], pieces[i]
+	}
+	return pieces
+}
+
+// mergeWord splits word into characters, and merges the adjacent pair that
+// makes the piece of the highest score, the leftmost of equal scores, until
+// no pair makes a piece.
+func (encoder *SentencePieceEncoder) mergeWord(word string) []string {
+	symbols := make([]string, 0, len(word))
+	for idx, r := range word {
+		symbols = append(symbols, word[idx:idx+utf8.RuneLen(r)])
+	}
+	for len(symbols) > 1 {
+		bestIdx := -1
+		var bestScore float32
+		for idx := 0; idx < len(symbols)-1; idx++ {
+			token, ok := encoder.byText[symbols[idx]+symbols[idx+1]]
+			if !ok {
+				continue
+			}
+			if score := encoder.pieces[token].score; bestIdx < 0 ||
+				score > bestScore {
+				bestIdx, bestScore = idx, score
+			}
+		}
+		if bestIdx < 0 {
+			break
+		}
+		symbols[bestIdx] += symbols[bestIdx+1]
+		symbols = append(symbols[:bestIdx+1], symbols[bestIdx+2:]...)
+	}
+	return symbols
+}
+
+// Decode
+// Decodes tokens back into text, unescaping the whitespace markers, and
+// removing the dummy prefix from the start of the text. Special tokens are
+// decoded as their text.
+func (encoder *SentencePieceEncoder) Decode(encoded *Tokens) string {
+	var builder strings.Builder
+	for idx, token := range *encoded {
+		if int(token) >= len(encoder.pieces) {
+			continue
+		}
+		piece := encoder.pieces[token]
+		switch piece.pieceType {
+		case sentencePieceByte:
+			builder.WriteByte(encoder.byteTokens[token])
+		case sentencePieceNormal:
+			text := strings.ReplaceAll(piece.text, SENTENCEPIECE_SPACE, " ")
+			if idx == 0 && encoder.addDummyPrefix != DummyPrefixNever {
+				text = strings.TrimPrefix(text, " ")
+			}
+			builder.WriteString(text)
+		default:
+			builder.WriteString(piece.text)
+		}
+	}
+	return builder.String()
+}
+
+// Count
+// Returns the number of tokens that text encodes to.
+func (encoder *SentencePieceEncoder) Count(text *string) int {
+	return len(*encoder.Encode(text))
+}
+
+// Specials
+// Returns a copy of the encoder's special tokens, by their text.
+func (encoder *SentencePieceEncoder) Specials() map[string]Tokens {
+	specials := make(map[string]Tokens, len(encoder.specials))
+	for special, tokens := range encoder.specials {
+		specials[special] = append(Tokens{}, tokens...)
+	}
+	return specials
+}
+
+// Fingerprint
+// Returns a hex encoded SHA-256 digest over everything that determines how
+// the encoder tokenizes text: its model, pieces and normalization.
+func (encoder *SentencePieceEncoder) Fingerprint() string {
+	h := sha256.New()
+	writeFingerprintString(h, "sentencepiece")
+	writeFingerprintUint(h, uint64(encoder.model))
+	writeFingerprintUint(h, uint64(len(encoder.pieces)))
+	for _, piece := range encoder.pieces {
+		writeFingerprintString(h, piece.text)
+		writeFingerprintUint(h, uint64(math.Float32bits(piece.score)))
+		writeFingerprintUint(h, uint64(piece.pieceType))
+	}
+	specials := make([]string, 0, len(encoder.specials))
+	for special := range encoder.specials {
+		specials = append(specials, special)
+	}
+	sort.Strings(specials)
+	for _, special := range specials {
+		writeFingerprintString(h, special)
+		writeFingerprintUint(h, uint64(encoder.specials[special][0]))
+	}
+	for _, flag := range []bool{encoder.byteFallback,
+		encoder.removeExtraWhitespaces, encoder.escapeWhitespaces} {
+		if flag {
+			writeFingerprintUint(h, 1)
+		} else {
+			writeFingerprintUint(h, 0)
+		}
+	}
+	writeFingerprintUint(h, uint64(encoder.addDummyPrefix))
+	if encoder.charsMap != nil {
+		writeFingerprintUint(h, uint64(len(encoder.charsMap.trie)))
+		for _, unit := range encoder.charsMap.trie {
+			writeFingerprintUint(h, uint64(unit))
+		}
+		writeFingerprintString(h, string(encoder.charsMap.normalized))
+	}
+	for _, token := range []Token{encoder.BosToken, encoder.EosToken,
+		encoder.PadToken, encoder.UnkToken} {
+		writeFingerprintUint(h, uint64(token))
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// sentencePieceCharsMap
+// The precompiled normalization rules of a SentencePiece model, a
+// double-array trie of the texts that are replaced, whose values are the
+// offsets of their replacements in normalized.
+type sentencePieceCharsMap struct {
+	trie       []uint32
+	normalized []byte
+}
+
+// newSentencePieceCharsMap parses a precompiled charsmap, of the size in
+// bytes of its trie, the trie, and then its null terminated replacements.
+func newSentencePieceCharsMap(data []byte) (*sentencePieceCharsMap, error) {
+	if len(data) == 0 {
+		return nil, nil
+	}
+	if len(data) < 4 {
+		return nil, fmt.Errorf("%w: sentencepiece charsmap is truncated",
+			ErrResourceInvalid)
+	}
+	trieSize := int(binary.LittleEndian.Uint32(data))
+	if trieSize%4 != 0 || 4+trieSize > len(data) {
+		return nil, fmt.Errorf("%w: sentencepiece charsmap trie of %d "+
+			"bytes", ErrResourceInvalid, trieSize)
+	}
+	charsMap := &sentencePieceCharsMap{
+		trie:       make([]uint32, trieSize/4),
+		normalized: data[4+trieSize:],
+	}
+	for idx := range charsMap.trie {
+		charsMap.trie[idx] = binary.LittleEndian.Uint32(data[4+4*idx:])
+	}
+	return charsMap, nil
+}
+
+// longestPrefix returns the value of the longest key of the trie that text
+// starts with, and its length, or a length of zero if none.
+func (charsMap *sentencePieceCharsMap) longestPrefix(text string) (int,
+	int) {
+	trie := charsMap.trie
+	if len(trie) == 0 {
+		return 0, 0
+	}
+	offset := func(unit uint32) uint32 {
+		return (unit >> 10) << ((unit & (1 << 9)) >> 6)
+	}
+	value, length := 0, 0
+	id := offset(trie[0])
+	for idx := 0; idx < len(text); idx++ {
+		id ^= uint32(text[idx])
+		if int(id) >= len(trie) {
+			break
+		}
+		unit := trie[id]
+		if unit&((1<<31)|0xff) != uint32(text[idx]) {
+			break
+		}
+		id ^= offset(unit)
+		if (unit>>8)&1 == 1 && int(id) < len(trie) {
+			value, length = int(trie[id]&((1<<31)-1)), idx+1
+		}
+	}
+	return value, length
+}
+
+// normalize replaces the longest key of the trie at each position of text
+// with its replacement.
+func (charsMap *sentencePieceCharsMap) normalize(text string) string {
+	var builder strings.Builder
+	builder.Grow(len(text))
+	for idx := 0; idx < len(text); {
+		value, length := charsMap.longestPrefix(text[idx:])
+		if length > 0 && value < len(charsMap.normalized) {
+			replacement := charsMap.normalized[value:]
+			if end := strings.IndexByte(string(replacement), 0); end >= 0 {
+				replacement = replacement[:end]
+			}
+			builder.Write(replacement)
+			idx += length
+			continue
+		}
+		r, size := utf8.DecodeRuneInString(text[idx:])
+		if r == utf8.RuneError && size <= 1 {
+			builder.WriteRune(utf8.RuneError)
+			idx++
+			continue
+		}
+		builder.WriteString(text[idx : idx+size])
+		idx += size
+	}
+	return builder.String()
+}
+
+// readProtoFields calls field with the number, and the value, of each field
+// of the protobuf message in data. Varints and fixed width values are
+// passed as varint, and length delimited values as bytes.
+func readProtoFields(data []byte, field func(number int, varint uint64,
+	bytes []byte) error) error {
+	for len(data) > 0 {
+		key, size := binary.Uvarint(data)
+		if size <= 0 {
+			return errors.New("invalid protobuf field key")
+		}
+		data = data[size:]
+		number, wireType := int(key>>3), key&7
+		var varint uint64
+		var bytes []byte
+		switch wireType {
+		case 0:
+			if varint, size = binary.Uvarint(data); size <= 0 {
+				return errors.New("invalid protobuf varint")
+			}
+			data = data[size:]
+		case 1:
+			if len(data) < 8 {
+				return errors.New("truncated protobuf fixed64")
+			}
+			varint, data = binary.LittleEndian.Uint64(data), data[8:]
+		case 2:
+			length, size := binary.Uvarint(data)
+			if size <= 0 || uint64(len(data)-size) < length {
+				return errors.New("truncated protobuf bytes")
+			}
+			bytes = data[size : size+int(length)]
+			data = data[size+int(length):]
+		case 5:
+			if len(data) < 4 {
+				return errors.New("truncated protobuf fixed32")
+			}
+			varint = uint64(binary.LittleEndian.Uint32(data))
+			data = data[4:]
+		default:
+			return errors.New(fmt.Sprintf("unsupported protobuf wire "+
+				"type %d", wireType))
+		}
+		if err := field(number, varint, bytes); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// NewSentencePieceEncoder
+// Returns a SentencePieceEncoder for the SentencePiece model in data, the
+// contents of a .model file, with its normalization rules. Unigram and BPE
+// models are supported.
+func NewSentencePieceEncoder(data []byte) (*SentencePieceEncoder, error) {
+	pieces := make([]sentencePiece, 0)
+	modelType := 1
+	byteFallback := false
+	unkId, bosId, eosId, padId := 0, 1, 2, -1
+	var charsMapData []byte
+	normalizerName := ""
+	addDummyPrefix, removeExtraWhitespaces, escapeWhitespaces := true,
+		true, true
+	err := readProtoFields(data, func(number int, varint uint64,
+		bytes []byte) error {
+		switch number {
+		case 1:
+			piece := sentencePiece{pieceType: sentencePieceNormal}
+			if err := readProtoFields(bytes, func(number int,
+				varint uint64, bytes []byte) error {
+				switch number {
+				case 1:
+					piece.text = string(bytes)
+				case 2:
+					piece.score = math.Float32frombits(uint32(varint))
+				case 3:
+					piece.pieceType = int(varint)
+				}
+				return nil
+			}); err != nil {
+				return err
+			}
+			pieces = append(pieces, piece)
+		case 2:
+			return readProtoFields(bytes, func(number int, varint uint64,
+				bytes []byte) error {
+				switch number {
+				case 3:
+					modelType = int(varint)
+				case 35:
+					byteFallback = varint != 0
+				case 40:
+					unkId = int(int32(varint))
+				case 41:
+					bosId = int(int32(varint))
+				case 42:
+					eosId = int(int32(varint))
+				case 43:
+					padId = int(int32(varint))
+				}
+				return nil
+			})
+		case 3:
+			return readProtoFields(bytes, func(number int, varint uint64,
+				bytes []byte) error {
+				switch number {
+				case 1:
+					normalizerName = string(bytes)
+				case 2:
+					charsMapData = bytes
+				case 3:
+					addDummyPrefix = varint != 0
+				case 4:
+					removeExtraWhitespaces = varint != 0
+				case 5:
+					escapeWhitespaces = varint != 0
+				}
+				return nil
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("%w: sentencepiece model: %s",
+			ErrResourceInvalid, err)
+	}
+	var model SentencePieceModel
+	switch modelType {
+	case 1:
+		model = SentencePieceUnigram
+	case 2:
+		model = SentencePieceBPE
+	default:
+		return nil, fmt.Errorf("%w: sentencepiece model of type %d",
+			ErrUnsupportedLayout, modelType)
+	}
+	encoder, err := newSentencePieceEncoder(model, pieces, unkId)
+	if err != nil {
+		return nil, err
+	}
+	if normalizerName != "identity" {
+		if encoder.charsMap, err = newSentencePieceCharsMap(
+			charsMapData); err != nil {
+			return nil, err
+		}
+	}
+	encoder.byteFallback = byteFallback
+	encoder.removeExtraWhitespaces = removeExtraWhitespaces
+	encoder.escapeWhitespaces = escapeWhitespaces
+	if !addDummyPrefix {
+		encoder.addDummyPrefix = DummyPrefixNever
+	}
+	encoder.setSpecialToken(&encoder.BosToken, bosId)
+	encoder.setSpecialToken(&encoder.EosToken, eosId)
+	encoder.setSpecialToken(&encoder.PadToken, padId)
+	return encoder, nil
+}
+
+// newSentencePieceEncoderFromDir returns a SentencePieceEncoder for the
+// .model file in dir.
+func newSentencePieceEncoderFromDir(dir string) (*SentencePieceEncoder,
+	error) {
+	if err := resources.CheckUnsignedAllowed(dir); err != nil {
+		return nil, err
+	}
+	paths, _ := filepath.Glob(filepath.Join(dir, "*.model"))
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("%w: no sentencepiece model in %s",
+			ErrResourceMissing, dir)
+	}
+	sort.Strings(paths)
+	data, err := os.ReadFile(paths[0])
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrResourceMissing, err)
+	}
+	return NewSentencePieceEncoder(data)
+}
@@ -0,0 +1,215 @@
+package gpt_bpe
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"strings"
+)
+
+// TokensDtype
+// The encoding of serialized tokens, tagged by its name in the base64 form
+// of FormatTokens so that services exchanging tokens agree on it.
+type TokensDtype uint8
+
+const (
+	// DTYPE_UINT16 is two little-endian bytes a token, as ToBin writes. It
+	// does not hold the ids above 65535 of large vocabularies.
+	DTYPE_UINT16 TokensDtype = iota
+	// DTYPE_UINT32 is four little-endian bytes a token, as numpy's uint32.
+	DTYPE_UINT32
+	// DTYPE_VARINT is an unsigned varint a token, as protocol buffers do.
+	DTYPE_VARINT
+	// DTYPE_DELTA_VARINT is a signed varint a token, of its difference from
+	// the token before it. It is a byte a token for runs of nearby ids, such
+	// as byte tokens or sorted ids, but the ids of prose are not near one
+	// another, and take more bytes than as DTYPE_VARINT.
+	DTYPE_DELTA_VARINT
+)
+
+var dtypeNames = map[TokensDtype]string{
+	DTYPE_UINT16:       "uint16",
+	DTYPE_UINT32:       "uint32",
+	DTYPE_VARINT:       "varint",
+	DTYPE_DELTA_VARINT: "delta_varint",
+}
+
+func (dtype TokensDtype) String() string {
+	if name, ok := dtypeNames[dtype]; ok {
+		return name
+	}
+	return fmt.Sprintf("TokensDtype(%d)", uint8(dtype))
+}
+
+// ParseTokensDtype
+// Returns the TokensDtype named name, such as "uint16".
+func ParseTokensDtype(name string) (TokensDtype, error) {
+	for dtype, dtypeName := range dtypeNames {
+		if dtypeName == name {
+			return dtype, nil
+		}
+	}
+	return 0, fmt.Errorf("%w: unknown dtype %q", ErrTokensInvalid, name)
+}
+
+// MarshalTokens
+// Serializes tokens to bytes in dtype. Token ids that do not fit in dtype
+// fail with ErrTokenOutOfRange.
+func MarshalTokens(tokens Tokens, dtype TokensDtype) ([]byte, error) {
+	switch dtype {
+	case DTYPE_UINT16:
+		data := make([]byte, len(tokens)*2)
+		for idx, token := range tokens {
+			if token > math.MaxUint16 {
+				return nil, fmt.Errorf("%w: token %d at index %d",
+					ErrTokenOutOfRange, token, idx)
+			}
+			binary.LittleEndian.PutUint16(data[idx*2:], uint16(token))
+		}
+		return data, nil
+	case DTYPE_UINT32:
+		data := make([]byte, len(tokens)*4)
+		for idx, token := range tokens {
+			binary.LittleEndian.PutUint32(data[idx*4:], uint32(token))
+		}
+		return data, nil
+	case DTYPE_VARINT:
+		data := make([]byte, 0, len(tokens)*2)
+		varint := make([]byte, binary.MaxVarintLen32)
+		for _, token := range tokens {
+			length := binary.PutUvarint(varint, uint64(token))
+			data = append(data, varint[:length]...)
+		}
+		return data, nil
+	case DTYPE_DELTA_VARINT:
+		data, _ := appendDeltaVarints(make([]byte, 0, len(tokens)*2), 0,
+			tokens)
+		return data, nil
+	default:
+		return nil, fmt.Errorf("%w: unknown dtype %d", ErrTokensInvalid,
+			dtype)
+	}
+}
+
+// UnmarshalTokens
+// Deserializes tokens from bytes in dtype. Data that is not a whole number
+// of tokens fails with ErrTokensInvalid, and token ids that do not fit in a
+// Token with ErrTokenOutOfRange.
+func UnmarshalTokens(data []byte, dtype TokensDtype) (Tokens, error) {
+	switch dtype {
+	case DTYPE_UINT16:
+		if len(data)%2 != 0 {
+			return nil, fmt.Errorf("%w: %d bytes is not a whole number "+
+				"of uint16 tokens", ErrTokensInvalid, len(data))
+		}
+		tokens := make(Tokens, len(data)/2)
+		for idx := range tokens {
+			tokens[idx] = Token(binary.LittleEndian.Uint16(data[idx*2:]))
+		}
+		return tokens, nil
+	case DTYPE_UINT32:
+		if len(data)%4 != 0 {
+			return nil, fmt.Errorf("%w: %d bytes is not a whole number "+
+				"of uint32 tokens", ErrTokensInvalid, len(data))
+		}
+		tokens := make(Tokens, len(data)/4)
+		for idx := range tokens {
+			tokens[idx] = Token(binary.LittleEndian.Uint32(data[idx*4:]))
+		}
+		return tokens, nil
+	case DTYPE_VARINT:
+		tokens := make(Tokens, 0, len(data))
+		for offset := 0; offset < len(data); {
+			token, length := binary.Uvarint(data[offset:])
+			if length <= 0 {
+				return nil, fmt.Errorf("%w: invalid varint at byte %d",
+					ErrTokensInvalid, offset)
+			}
+			if token > math.MaxUint32 {
+				return nil, fmt.Errorf("%w: token %d at index %d",
+					ErrTokenOutOfRange, token, len(tokens))
+			}
+			tokens = append(tokens, Token(token))
+			offset += length
+		}
+		return tokens, nil
+	case DTYPE_DELTA_VARINT:
+		tokens := make(Tokens, 0, len(data))
+		previous := int64(0)
+		for offset := 0; offset < len(data); {
+			delta, length := binary.Varint(data[offset:])
+			if length <= 0 {
+				return nil, fmt.Errorf("%w: invalid varint at byte %d",
+					ErrTokensInvalid, offset)
+			}
+			token, err := undeltaToken(previous, delta, len(tokens))
+			if err != nil {
+				return nil, err
+			}
+			tokens = append(tokens, token)
+			previous = int64(token)
+			offset += length
+		}
+		return tokens, nil
+	default:
+		return nil, fmt.Errorf("%w: unknown dtype %d", ErrTokensInvalid,
+			dtype)
+	}
+}
+
+// FormatTokens
+// Serializes tokens to a string of their dtype's name, a colon, and their
+// bytes in dtype as standard base64, such as "uint16:ZAAAAQ==".
+func FormatTokens(tokens Tokens, dtype TokensDtype) (string, error) {
+	data, err := MarshalTokens(tokens, dtype)
+	if err != nil {
+		return "", err
+	}
+	return dtype.String() + ":" + base64.StdEncoding.EncodeToString(data),
+		nil
+}
+
+// ParseTokens
+// Deserializes tokens from a string written by FormatTokens, in the dtype
+// that it is tagged with.
+func ParseTokens(formatted string) (Tokens, error) {
+	separator := strings.IndexByte(formatted, ':')
+	if separator < 0 {
+		return nil, fmt.Errorf("%w: no dtype tag", ErrTokensInvalid)
+	}
+	dtype, err := ParseTokensDtype(formatted[:separator])
+	if err != nil {
+		return nil, err
+	}
+	data, err := base64.StdEncoding.DecodeString(formatted[separator+1:])
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrTokensInvalid, err)
+	}
+	return UnmarshalTokens(data, dtype)
+}
+
+// appendDeltaVarints appends tokens to data as the signed varints of their
+// differences from the token before them, the first from previous, and
+// returns data and the last token.
+func appendDeltaVarints(data []byte, previous Token,
+	tokens Tokens) ([]byte, Token) {
+	varint := make([]byte, binary.MaxVarintLen32)
+	for _, token := range tokens {
+		length := binary.PutVarint(varint, int64(token)-int64(previous))
+		data = append(data, varint[:length]...)
+		previous = token
+	}
+	return data, previous
+}
+
+// undeltaToken returns the token that is delta from previous, failing with
+// ErrTokenOutOfRange for the token at idx if it does not fit in a Token.
+func undeltaToken(previous int64, delta int64, idx int) (Token, error) {
+	token := previous + delta
+	if token < 0 || token > math.MaxUint32 {
+		return 0, fmt.Errorf("%w: token %d at index %d",
+			ErrTokenOutOfRange, token, idx)
+	}
+	return Token(token), nil
+}
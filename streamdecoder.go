@@ -0,0 +1,71 @@
+package gpt_bpe
+
+import (
+	"bytes"
+	"unicode/utf8"
+)
+
+// StreamDecoder
+// Decodes tokens one at a time, as they are generated, into the bytes of
+// the characters that they complete. Tokens that encode only part of a
+// character are held until the tokens after them complete it, so that the
+// bytes returned are always whole UTF-8 characters.
+type StreamDecoder struct {
+	encoder *GPTEncoder
+	pending []byte
+}
+
+// NewStreamDecoder
+// Returns a StreamDecoder for the tokens of the encoder.
+func (encoder *GPTEncoder) NewStreamDecoder() *StreamDecoder {
+	return &StreamDecoder{encoder: encoder, pending: make([]byte, 0, 8)}
+}
+
+// Feed
+// Decodes token, and returns the bytes of the characters that it completes,
+// which are empty when it ends with part of a character. Tokens that are
+// not in the vocabulary decode as nothing, as in Decode, and the end of word
+// markers of tokenizers such as CLIP's decode as a space.
+func (decoder *StreamDecoder) Feed(token Token) []byte {
+	tokenBytes := decoder.encoder.TokenBytes(token)
+	endOfWord := decoder.encoder.endOfWord
+	if endOfWord != "" && bytes.HasSuffix(tokenBytes, []byte(endOfWord)) {
+		tokenBytes = append(tokenBytes[:len(tokenBytes)-len(endOfWord)], ' ')
+	}
+	decoder.pending = append(decoder.pending, tokenBytes...)
+
+	// Find the start of the last character, and hold it back if it is
+	// incomplete. Bytes that cannot start or continue a character are
+	// returned, as no later token can complete them.
+	complete := len(decoder.pending)
+	for idx := len(decoder.pending) - 1; idx >= 0 &&
+		idx >= len(decoder.pending)-utf8.UTFMax; idx-- {
+		if utf8.RuneStart(decoder.pending[idx]) {
+			if !utf8.FullRune(decoder.pending[idx:]) {
+				complete = idx
+			}
+			break
+		}
+	}
+	decoded := make([]byte, complete)
+	copy(decoded, decoder.pending[:complete])
+	decoder.pending = append(decoder.pending[:0],
+		decoder.pending[complete:]...)
+	return decoded
+}
+
+// Flush
+// Returns the bytes of the incomplete character that the decoder is holding,
+// if any, such as at the end of generation, and resets the decoder.
+func (decoder *StreamDecoder) Flush() []byte {
+	flushed := make([]byte, len(decoder.pending))
+	copy(flushed, decoder.pending)
+	decoder.pending = decoder.pending[:0]
+	return flushed
+}
+
+// Pending
+// Returns whether the decoder is holding part of a character.
+func (decoder *StreamDecoder) Pending() bool {
+	return len(decoder.pending) > 0
+}
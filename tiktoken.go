@@ -0,0 +1,145 @@
+package gpt_bpe
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/wbrown/gpt_bpe/resources"
+)
+
+// TIKTOKEN_BASE_URL is where the ranks files of OpenAI's tiktoken encodings
+// are downloaded from.
+const TIKTOKEN_BASE_URL = "https://openaipublic.blob.core.windows.net/encodings"
+
+// LLAMA3_RANKS_URL is where the ranks file of LLaMA 3, the tokenizer.model of
+// Meta's gated repository, is downloaded from with HF_API_TOKEN.
+const LLAMA3_RANKS_URL = "https://huggingface.co/meta-llama/" +
+	"Meta-Llama-3-8B/resolve/main/original"
+
+// TiktokenEncoding
+// An encoding of OpenAI's tiktoken library, which is loaded from its ranks
+// file, NAME.tiktoken, with its special tokens and pre-tokenizer.
+type TiktokenEncoding struct {
+	Name         string
+	VocabSize    int
+	Specials     map[string]int
+	PreTokenizer PreTokenizer
+}
+
+// TiktokenEncodings are the tiktoken encodings that NewEncoder loads by
+// name, along with llama3-tokenizer, whose ranks file is of the same format.
+var TiktokenEncodings = map[string]TiktokenEncoding{
+	"r50k_base": {"r50k_base", 50257,
+		map[string]int{"<|endoftext|>": 50256}, GPT2PreTokenizer},
+	"p50k_base": {"p50k_base", 50281,
+		map[string]int{"<|endoftext|>": 50256}, GPT2PreTokenizer},
+	"p50k_edit": {"p50k_base", 50284,
+		map[string]int{"<|endoftext|>": 50256, "<|fim_prefix|>": 50281,
+			"<|fim_middle|>": 50282, "<|fim_suffix|>": 50283},
+		GPT2PreTokenizer},
+	"cl100k_base": {"cl100k_base", 100277,
+		map[string]int{"<|endoftext|>": 100257, "<|fim_prefix|>": 100258,
+			"<|fim_middle|>": 100259, "<|fim_suffix|>": 100260,
+			"<|endofprompt|>": 100276},
+		Llama3PreTokenizer},
+	"o200k_base": {"o200k_base", 200019,
+		map[string]int{"<|endoftext|>": 199999, "<|endofprompt|>": 200018},
+		O200kPreTokenizer},
+	"llama3-tokenizer": {"llama3-tokenizer", 128256, llama3Specials(),
+		Llama3PreTokenizer},
+}
+
+// llama3Specials returns the special tokens of LLaMA 3, which follow its
+// 128000 ranks, with those that are not used reserved as
+// <|reserved_special_token_N|>.
+func llama3Specials() map[string]int {
+	specials := map[string]int{"<|begin_of_text|>": 128000,
+		"<|end_of_text|>": 128001, "<|start_header_id|>": 128006,
+		"<|end_header_id|>": 128007, "<|eot_id|>": 128009}
+	reserved := 0
+	for id := 128002; id < 128256; id++ {
+		if id >= 128006 && id <= 128009 && id != 128008 {
+			continue
+		}
+		specials[fmt.Sprintf("<|reserved_special_token_%d|>",
+			reserved)] = id
+		reserved++
+	}
+	return specials
+}
+
+// NewTiktokenEncoder
+// Returns a GPTEncoder for the tiktoken encoding, from its ranks file read
+// from reader. Tiktoken merges the parts of a word that make the token of
+// the lowest rank, which is the BPE of a vocabulary whose merges are ranked
+// by the tokens that they make, so the encoder gives the tokens that tiktoken
+// does.
+func NewTiktokenEncoder(encoding TiktokenEncoding,
+	reader io.Reader) (*GPTEncoder, error) {
+	if err := resources.CheckUnsignedAllowed(encoding.Name); err != nil {
+		return nil, err
+	}
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+	tokens, err := resources.ParseTiktokenRanks(data)
+	if err != nil {
+		return nil, err
+	}
+	hfConfig, rsrcs, err := resources.TiktokenResources(encoding.Name,
+		tokens, encoding.Specials)
+	if err != nil {
+		return nil, err
+	}
+	encoder, err := newEncoderFromResources(encoding.Name, hfConfig, *rsrcs)
+	if err != nil {
+		return nil, err
+	}
+	if encoding.PreTokenizer != nil {
+		encoder.SetPreTokenizer(encoding.PreTokenizer)
+	}
+	return encoder, nil
+}
+
+// newTiktokenEncoderFromURL returns a GPTEncoder for the tiktoken encoding,
+// downloading its ranks file from TIKTOKEN_BASE_URL, or LLAMA3_RANKS_URL for
+// llama3-tokenizer.
+func newTiktokenEncoderFromURL(encoding TiktokenEncoding) (*GPTEncoder,
+	error) {
+	baseURL, file, auth := TIKTOKEN_BASE_URL, encoding.Name+".tiktoken", ""
+	if encoding.Name == "llama3-tokenizer" {
+		baseURL, file = LLAMA3_RANKS_URL, "tokenizer.model"
+		auth = os.Getenv("HF_API_TOKEN")
+	}
+	body, err := resources.FetchHTTP(baseURL, file, auth)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s: %v", ErrDownloadFailed, file, err)
+	}
+	defer body.Close()
+	return NewTiktokenEncoder(encoding, body)
+}
+
+// newTiktokenEncoderFromDir returns a GPTEncoder for the ranks file in dir,
+// which is named for one of TiktokenEncodings.
+func newTiktokenEncoderFromDir(dir string) (*GPTEncoder, error) {
+	paths, _ := filepath.Glob(filepath.Join(dir, "*.tiktoken"))
+	for _, path := range paths {
+		name := strings.TrimSuffix(filepath.Base(path), ".tiktoken")
+		encoding, ok := TiktokenEncodings[name]
+		if !ok {
+			continue
+		}
+		file, err := os.Open(path)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s", ErrResourceMissing, err)
+		}
+		defer file.Close()
+		return NewTiktokenEncoder(encoding, file)
+	}
+	return nil, fmt.Errorf("%w: no ranks file of a known tiktoken encoding "+
+		"in %s", ErrUnsupportedLayout, dir)
+}
@@ -0,0 +1,148 @@
+package gpt_bpe
+
+import (
+	"io"
+	"strings"
+)
+
+const TOKENBUFFER_SZ = 1 << 20
+
+// TokenBuffer
+// An arena of tokens for batch operations, such as tokenizing the documents
+// of a dataset. Each sequence of tokens appended to the buffer is returned as
+// a view into one of a few large blocks, rather than as a Tokens allocation
+// of its own. Views are capped at their length, so appending to a view copies
+// it instead of overwriting its neighbours, and they remain valid until the
+// buffer is Reset.
+type TokenBuffer struct {
+	blockSize int
+	block     Tokens
+	// begin is the offset in block of the view being appended to.
+	begin int
+	views []Tokens
+}
+
+// NewTokenBuffer
+// Creates a TokenBuffer that allocates blocks of blockSize tokens, or of
+// TOKENBUFFER_SZ tokens if blockSize is not positive.
+func NewTokenBuffer(blockSize int) *TokenBuffer {
+	if blockSize <= 0 {
+		blockSize = TOKENBUFFER_SZ
+	}
+	return &TokenBuffer{
+		blockSize: blockSize,
+		block:     make(Tokens, 0, blockSize),
+	}
+}
+
+// push appends tokens to the view being built. When the block is full, the
+// view is moved to a new block, leaving the views before it in place.
+func (buffer *TokenBuffer) push(tokens ...Token) {
+	if len(buffer.block)+len(tokens) > cap(buffer.block) {
+		pending := buffer.block[buffer.begin:]
+		size := buffer.blockSize
+		if len(pending)+len(tokens) > size {
+			size = len(pending) + len(tokens)
+		}
+		block := make(Tokens, len(pending), size)
+		copy(block, pending)
+		buffer.block = block
+		buffer.begin = 0
+	}
+	buffer.block = append(buffer.block, tokens...)
+}
+
+// seal ends the view being built, and returns it.
+func (buffer *TokenBuffer) seal() Tokens {
+	end := len(buffer.block)
+	view := buffer.block[buffer.begin:end:end]
+	buffer.begin = end
+	buffer.views = append(buffer.views, view)
+	return view
+}
+
+// Append
+// Copies tokens into the buffer, and returns the view of them.
+func (buffer *TokenBuffer) Append(tokens Tokens) Tokens {
+	buffer.push(tokens...)
+	return buffer.seal()
+}
+
+// Len
+// Returns the number of views in the buffer.
+func (buffer *TokenBuffer) Len() int {
+	return len(buffer.views)
+}
+
+// Size
+// Returns the total number of tokens in the buffer's views.
+func (buffer *TokenBuffer) Size() (size int) {
+	for _, view := range buffer.views {
+		size += len(view)
+	}
+	return size
+}
+
+// View
+// Returns the view at idx, in the order that they were appended.
+func (buffer *TokenBuffer) View(idx int) Tokens {
+	return buffer.views[idx]
+}
+
+// Views
+// Returns every view in the buffer, in the order that they were appended.
+// The returned slice is only valid until the next append or Reset.
+func (buffer *TokenBuffer) Views() []Tokens {
+	return buffer.views
+}
+
+// Copy
+// Returns a copy of the view at idx, which does not share the buffer's
+// memory and remains valid after the buffer is Reset.
+func (buffer *TokenBuffer) Copy(idx int) *Tokens {
+	tokens := make(Tokens, len(buffer.views[idx]))
+	copy(tokens, buffer.views[idx])
+	return &tokens
+}
+
+// Flatten
+// Returns every view in the buffer concatenated into one Tokens, which does
+// not share the buffer's memory.
+func (buffer *TokenBuffer) Flatten() *Tokens {
+	tokens := make(Tokens, 0, buffer.Size())
+	for _, view := range buffer.views {
+		tokens = append(tokens, view...)
+	}
+	return &tokens
+}
+
+// Reset
+// Empties the buffer, reusing its current block for the views appended
+// after. Views returned before the Reset must no longer be used.
+func (buffer *TokenBuffer) Reset() {
+	buffer.block = buffer.block[:0]
+	buffer.begin = 0
+	buffer.views = buffer.views[:0]
+}
+
+// EncodeReaderInto
+// Encodes the text read from reader into buffer, as EncodeReader does, and
+// returns the view of its tokens.
+func (encoder *GPTEncoder) EncodeReaderInto(buffer *TokenBuffer,
+	reader io.RuneReader) Tokens {
+	framer := encoder.newBosEosFramer(encoder.BosEosPolicy())
+	nextWord := encoder.WordSplitter(reader)
+	for word := nextWord(); word != nil; word = nextWord() {
+		buffer.push(framer.next(encoder.encodeWord(word))...)
+	}
+	buffer.push(framer.end()...)
+	return buffer.seal()
+}
+
+// EncodeInto
+// Encodes text into buffer, as Encode does, and returns the view of its
+// tokens.
+func (encoder *GPTEncoder) EncodeInto(buffer *TokenBuffer,
+	text *string) Tokens {
+	return encoder.EncodeReaderInto(buffer, strings.NewReader(*text))
+}
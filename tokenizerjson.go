@@ -0,0 +1,717 @@
+package gpt_bpe
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+)
+
+// tokenizerJson is the part of a huggingface tokenizer.json that is read
+// past the vocabulary and merges of its model, which ResolveLocalDir
+// extracts.
+type tokenizerJson struct {
+	AddedTokens   []tokenizerJsonAddedToken `json:"added_tokens"`
+	Normalizer    *tokenizerJsonComponent   `json:"normalizer"`
+	PreTokenizer  *tokenizerJsonComponent   `json:"pre_tokenizer"`
+	Model         tokenizerJsonModel        `json:"model"`
+	PostProcessor *tokenizerJsonComponent   `json:"post_processor"`
+	Decoder       *tokenizerJsonComponent   `json:"decoder"`
+}
+
+type tokenizerJsonAddedToken struct {
+	Id      int    `json:"id"`
+	Content string `json:"content"`
+	Special bool   `json:"special"`
+}
+
+type tokenizerJsonModel struct {
+	Type string `json:"type"`
+	// Vocab is an object of BPE tokens by id, or an array of Unigram pieces
+	// and their scores.
+	Vocab                   json.RawMessage `json:"vocab"`
+	UnkId                   *int            `json:"unk_id"`
+	ByteFallback            bool            `json:"byte_fallback"`
+	IgnoreMerges            bool            `json:"ignore_merges"`
+	ContinuingSubwordPrefix *string         `json:"continuing_subword_prefix"`
+	EndOfWordSuffix         *string         `json:"end_of_word_suffix"`
+	FuseUnk                 bool            `json:"fuse_unk"`
+	// BPE and WordPiece
+	UnkToken             *string `json:"unk_token"`
+	MaxInputCharsPerWord *int    `json:"max_input_chars_per_word"`
+}
+
+// tokenizerJsonComponent is a normalizer, pre-tokenizer, post-processor or
+// decoder, with the fields of each of the types that are supported.
+type tokenizerJsonComponent struct {
+	Type string `json:"type"`
+	// Sequence
+	Normalizers   []tokenizerJsonComponent `json:"normalizers"`
+	PreTokenizers []tokenizerJsonComponent `json:"pretokenizers"`
+	Processors    []tokenizerJsonComponent `json:"processors"`
+	Decoders      []tokenizerJsonComponent `json:"decoders"`
+	// Replace and Split
+	Pattern struct {
+		String *string `json:"String"`
+		Regex  *string `json:"Regex"`
+	} `json:"pattern"`
+	Content  string `json:"content"`
+	Behavior string `json:"behavior"`
+	Invert   bool   `json:"invert"`
+	// Precompiled, as base64.
+	PrecompiledCharsmap *string `json:"precompiled_charsmap"`
+	// Prepend
+	Prepend string `json:"prepend"`
+	// ByteLevel and Metaspace
+	AddPrefixSpace bool  `json:"add_prefix_space"`
+	UseRegex       *bool `json:"use_regex"`
+	// Metaspace
+	Replacement   string `json:"replacement"`
+	PrependScheme string `json:"prepend_scheme"`
+	// BPEDecoder
+	Suffix string `json:"suffix"`
+	// BertNormalizer
+	Lowercase    *bool `json:"lowercase"`
+	StripAccents *bool `json:"strip_accents"`
+	// TemplateProcessing
+	Single        []tokenizerJsonPiece `json:"single"`
+	Pair          []tokenizerJsonPiece `json:"pair"`
+	SpecialTokens map[string]struct {
+		Ids []int `json:"ids"`
+	} `json:"special_tokens"`
+	// BertProcessing and RobertaProcessing, as [content, id].
+	Sep []interface{} `json:"sep"`
+	Cls []interface{} `json:"cls"`
+}
+
+// tokenizerJsonPiece is a piece of a TemplateProcessing template, either a
+// special token or one of the sequences, A or B.
+type tokenizerJsonPiece struct {
+	SpecialToken *struct {
+		Id string `json:"id"`
+	} `json:"SpecialToken"`
+	Sequence *struct {
+		Id string `json:"id"`
+	} `json:"Sequence"`
+}
+
+// NewEncoderFromTokenizerJson
+// Returns a GPTEncoder for a huggingface fast tokenizer, from the contents of
+// its tokenizer.json, as NewEncoderFromDir loads a directory holding only
+// it.
+func NewEncoderFromTokenizerJson(data []byte) (*GPTEncoder, error) {
+	dir, err := ioutil.TempDir("", "tokenizer")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	if err := os.WriteFile(path.Join(dir, "tokenizer.json"), data,
+		0644); err != nil {
+		return nil, err
+	}
+	encoder, err := NewEncoderFromDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	gptEncoder, ok := encoder.(*GPTEncoder)
+	if !ok {
+		return nil, fmt.Errorf("%w: tokenizer.json is not a BPE tokenizer, "+
+			"load it with NewEncoderFromDir", ErrUnsupportedLayout)
+	}
+	return gptEncoder, nil
+}
+
+// tokenizerJsonModelType returns the type of the model of a tokenizer.json,
+// or an empty string if it cannot be read.
+func tokenizerJsonModelType(data []byte) string {
+	var tokenizer struct {
+		Model struct {
+			Type string `json:"type"`
+		} `json:"model"`
+	}
+	if err := json.Unmarshal(data, &tokenizer); err != nil {
+		return ""
+	}
+	return tokenizer.Model.Type
+}
+
+// newSentencePieceEncoderFromTokenizerJson
+// Returns a SentencePieceEncoder for a tokenizer.json with a Unigram model,
+// as huggingface converts SentencePiece models to. Its added tokens are
+// special tokens, and its normalizer and pre-tokenizer set the normalization
+// of the encoder. Its post-processor is not applied, so that text encodes as
+// SentencePiece encodes it.
+func newSentencePieceEncoderFromTokenizerJson(
+	data []byte) (*SentencePieceEncoder, error) {
+	var tokenizer tokenizerJson
+	if err := json.Unmarshal(data, &tokenizer); err != nil {
+		return nil, fmt.Errorf("%w: error unmarshalling tokenizer.json: %s",
+			ErrResourceInvalid, err)
+	}
+	var vocab [][]interface{}
+	if err := json.Unmarshal(tokenizer.Model.Vocab, &vocab); err != nil {
+		return nil, fmt.Errorf("%w: tokenizer.json Unigram vocab: %s",
+			ErrResourceInvalid, err)
+	}
+	pieces := make([]sentencePiece, 0, len(vocab))
+	for idx, entry := range vocab {
+		text, isText := entry[0].(string)
+		score, isScore := entry[len(entry)-1].(float64)
+		if len(entry) != 2 || !isText || !isScore {
+			return nil, fmt.Errorf("%w: tokenizer.json Unigram piece %d: %v",
+				ErrResourceInvalid, idx, entry)
+		}
+		piece := sentencePiece{text, float32(score), sentencePieceNormal}
+		if tokenizer.Model.ByteFallback && len(text) == 6 &&
+			strings.HasPrefix(text, "<0x") && strings.HasSuffix(text, ">") {
+			piece.pieceType = sentencePieceByte
+		}
+		pieces = append(pieces, piece)
+	}
+	for _, added := range tokenizer.AddedTokens {
+		if added.Id < 0 || int64(added.Id) > int64(^Token(0)) {
+			return nil, fmt.Errorf("%w: added token %q has id %d",
+				ErrTokenOutOfRange, added.Content, added.Id)
+		}
+		for len(pieces) <= added.Id {
+			pieces = append(pieces, sentencePiece{
+				pieceType: sentencePieceUnused})
+		}
+		pieces[added.Id].text = added.Content
+		pieces[added.Id].pieceType = sentencePieceUserDefined
+		if added.Special {
+			pieces[added.Id].pieceType = sentencePieceControl
+		}
+	}
+	unkId := 0
+	if tokenizer.Model.UnkId != nil {
+		unkId = *tokenizer.Model.UnkId
+	}
+	encoder, err := newSentencePieceEncoder(SentencePieceUnigram, pieces,
+		unkId)
+	if err != nil {
+		return nil, err
+	}
+	encoder.byteFallback = tokenizer.Model.ByteFallback
+	// Without a normalizer or pre-tokenizer, text is segmented as it is.
+	encoder.addDummyPrefix = DummyPrefixNever
+	encoder.escapeWhitespaces = false
+	if tokenizer.Normalizer != nil {
+		if err := encoder.applyTokenizerJsonNormalizer(
+			*tokenizer.Normalizer); err != nil {
+			return nil, err
+		}
+	}
+	if tokenizer.PreTokenizer != nil {
+		if err := encoder.applyTokenizerJsonPreTokenizer(
+			*tokenizer.PreTokenizer); err != nil {
+			return nil, err
+		}
+	}
+	return encoder, nil
+}
+
+// applyTokenizerJsonNormalizer sets the normalization of encoder from the
+// normalizer of a tokenizer.json. The Strip and whitespace collapsing
+// Replace normalizers that converters emulate SentencePiece's removal of
+// extra whitespace with are read as that removal.
+func (encoder *SentencePieceEncoder) applyTokenizerJsonNormalizer(
+	normalizer tokenizerJsonComponent) error {
+	switch normalizer.Type {
+	case "Sequence":
+		for _, inner := range normalizer.Normalizers {
+			if err := encoder.applyTokenizerJsonNormalizer(
+				inner); err != nil {
+				return err
+			}
+		}
+	case "Precompiled":
+		if normalizer.PrecompiledCharsmap == nil {
+			return nil
+		}
+		data, err := base64.StdEncoding.DecodeString(
+			*normalizer.PrecompiledCharsmap)
+		if err != nil {
+			return fmt.Errorf("%w: tokenizer.json precompiled charsmap: %s",
+				ErrResourceInvalid, err)
+		}
+		if encoder.charsMap, err = newSentencePieceCharsMap(
+			data); err != nil {
+			return err
+		}
+	case "Strip":
+		encoder.removeExtraWhitespaces = true
+	case "Prepend":
+		if normalizer.Prepend != SENTENCEPIECE_SPACE {
+			return fmt.Errorf("%w: tokenizer.json Prepend normalizer of %q",
+				ErrUnsupportedLayout, normalizer.Prepend)
+		}
+		encoder.addDummyPrefix = DummyPrefixAlways
+	case "Replace":
+		switch {
+		case normalizer.Pattern.Regex != nil &&
+			*normalizer.Pattern.Regex == " {2,}":
+			encoder.removeExtraWhitespaces = true
+		case normalizer.Pattern.String != nil &&
+			*normalizer.Pattern.String == " " &&
+			normalizer.Content == SENTENCEPIECE_SPACE:
+			encoder.escapeWhitespaces = true
+		default:
+			return fmt.Errorf("%w: tokenizer.json Replace normalizer for a "+
+				"SentencePiece model", ErrUnsupportedLayout)
+		}
+	default:
+		return fmt.Errorf("%w: tokenizer.json %s normalizer",
+			ErrUnsupportedLayout, normalizer.Type)
+	}
+	return nil
+}
+
+// applyTokenizerJsonPreTokenizer sets the normalization of encoder from the
+// pre-tokenizer of a tokenizer.json, which escapes whitespace with
+// Metaspace, and may split words on whitespace beforehand.
+func (encoder *SentencePieceEncoder) applyTokenizerJsonPreTokenizer(
+	preTokenizer tokenizerJsonComponent) error {
+	switch preTokenizer.Type {
+	case "Sequence":
+		for _, inner := range preTokenizer.PreTokenizers {
+			if err := encoder.applyTokenizerJsonPreTokenizer(
+				inner); err != nil {
+				return err
+			}
+		}
+	case "WhitespaceSplit":
+		encoder.removeExtraWhitespaces = true
+	case "Metaspace":
+		if preTokenizer.Replacement != SENTENCEPIECE_SPACE {
+			return fmt.Errorf("%w: tokenizer.json Metaspace replacement %q",
+				ErrUnsupportedLayout, preTokenizer.Replacement)
+		}
+		encoder.escapeWhitespaces = true
+		switch preTokenizer.PrependScheme {
+		case "always":
+			encoder.addDummyPrefix = DummyPrefixAlways
+		case "first":
+			encoder.addDummyPrefix = DummyPrefixFirst
+		case "never":
+			encoder.addDummyPrefix = DummyPrefixNever
+		case "":
+			if preTokenizer.AddPrefixSpace {
+				encoder.addDummyPrefix = DummyPrefixAlways
+			}
+		default:
+			return fmt.Errorf("%w: tokenizer.json Metaspace prepend scheme "+
+				"%q", ErrUnsupportedLayout, preTokenizer.PrependScheme)
+		}
+	default:
+		return fmt.Errorf("%w: tokenizer.json %s pre-tokenizer for a "+
+			"SentencePiece model", ErrUnsupportedLayout, preTokenizer.Type)
+	}
+	return nil
+}
+
+// applyTokenizerJson
+// Configures encoder, loaded from the vocabulary and merges of a
+// tokenizer.json, by its other sections: its added tokens, its normalizer,
+// pre-tokenizer and post-processor, and its decoder. The byte-level BPE
+// pipelines of GPT-2 style tokenizers are supported, as are character level
+// ones, which are detected by a pre-tokenizer or decoder without a ByteLevel
+// component, and whose unk_token and end_of_word_suffix are read. Others,
+// such as SentencePiece's Metaspace and Unicode normalization, fail with
+// ErrUnsupportedLayout rather than encoding differently. The flags of added
+// tokens, such as lstrip, are not read. Sections that are missing keep the
+// encoder's defaults.
+func (encoder *GPTEncoder) applyTokenizerJson(data []byte) error {
+	var tokenizer tokenizerJson
+	if err := json.Unmarshal(data, &tokenizer); err != nil {
+		return fmt.Errorf("%w: error unmarshalling tokenizer.json: %s",
+			ErrResourceInvalid, err)
+	}
+	model := tokenizer.Model
+	charLevel := (tokenizer.PreTokenizer != nil ||
+		tokenizer.Decoder != nil) && !tokenizer.usesByteLevel()
+	switch {
+	case model.ByteFallback:
+		return fmt.Errorf("%w: tokenizer.json BPE with byte_fallback",
+			ErrUnsupportedLayout)
+	case model.IgnoreMerges:
+		return fmt.Errorf("%w: tokenizer.json BPE with ignore_merges",
+			ErrUnsupportedLayout)
+	case model.ContinuingSubwordPrefix != nil &&
+		*model.ContinuingSubwordPrefix != "":
+		return fmt.Errorf("%w: tokenizer.json BPE with "+
+			"continuing_subword_prefix", ErrUnsupportedLayout)
+	case model.EndOfWordSuffix != nil && *model.EndOfWordSuffix != "" &&
+		!charLevel:
+		return fmt.Errorf("%w: tokenizer.json BPE with end_of_word_suffix",
+			ErrUnsupportedLayout)
+	}
+
+	// The vocabulary of a character level model is written as its text,
+	// which its added tokens are added to the vocabulary as.
+	if charLevel {
+		if err := encoder.SetBPELevel(BPECharLevel); err != nil {
+			return err
+		}
+		if model.EndOfWordSuffix != nil {
+			encoder.endOfWord = *model.EndOfWordSuffix
+		}
+	}
+	if err := encoder.applyAddedTokens(tokenizer.AddedTokens); err != nil {
+		return err
+	}
+	if tokenizer.Normalizer != nil {
+		pairs, err := tokenizerJsonNormalizer(*tokenizer.Normalizer,
+			encoder)
+		if err != nil {
+			return err
+		}
+		if len(pairs) > 0 {
+			encoder.Normalizer = strings.NewReplacer(pairs...)
+		}
+	}
+	if tokenizer.PreTokenizer != nil {
+		preTokenizer, err := tokenizerJsonPreTokenizer(
+			*tokenizer.PreTokenizer)
+		if err != nil {
+			return err
+		}
+		if preTokenizer == nil {
+			return fmt.Errorf("%w: tokenizer.json pre-tokenizer does not "+
+				"split words", ErrUnsupportedLayout)
+		}
+		encoder.SetPreTokenizer(preTokenizer)
+	}
+	if charLevel && model.UnkToken != nil {
+		if err := encoder.SetUnkToken(*model.UnkToken,
+			model.FuseUnk); err != nil {
+			return err
+		}
+	}
+	if tokenizer.Decoder != nil {
+		if err := checkTokenizerJsonDecoder(*tokenizer.Decoder,
+			encoder.endOfWord); err != nil {
+			return err
+		}
+	}
+	if tokenizer.PostProcessor != nil {
+		if err := encoder.applyPostProcessor(
+			*tokenizer.PostProcessor); err != nil {
+			return err
+		}
+	}
+	encoder.cache.Purge()
+	return nil
+}
+
+// usesByteLevel returns whether any of the pre-tokenizer, post-processor or
+// decoder of a tokenizer.json is, or is a sequence holding, a ByteLevel
+// component.
+func (tokenizer *tokenizerJson) usesByteLevel() bool {
+	var isByteLevel func(component tokenizerJsonComponent) bool
+	isByteLevel = func(component tokenizerJsonComponent) bool {
+		if component.Type == "ByteLevel" {
+			return true
+		}
+		for _, inners := range [][]tokenizerJsonComponent{
+			component.PreTokenizers, component.Processors,
+			component.Decoders} {
+			for _, inner := range inners {
+				if isByteLevel(inner) {
+					return true
+				}
+			}
+		}
+		return false
+	}
+	for _, component := range []*tokenizerJsonComponent{
+		tokenizer.PreTokenizer, tokenizer.PostProcessor, tokenizer.Decoder} {
+		if component != nil && isByteLevel(*component) {
+			return true
+		}
+	}
+	return false
+}
+
+// applyAddedTokens makes each added token of a tokenizer.json a special
+// token, which is found in text before it is split into words. Added tokens
+// that are not in the vocabulary are added to it.
+func (encoder *GPTEncoder) applyAddedTokens(
+	addedTokens []tokenizerJsonAddedToken) error {
+	if len(addedTokens) == 0 {
+		return nil
+	}
+	for _, added := range addedTokens {
+		if added.Id < 0 || int64(added.Id) > int64(^Token(0)) {
+			return fmt.Errorf("%w: added token %q has id %d",
+				ErrTokenOutOfRange, added.Content, added.Id)
+		}
+		if added.Content == "" {
+			continue
+		}
+		token := Token(added.Id)
+		if _, ok := encoder.decoder[token]; !ok {
+			// Added tokens are kept in the byte mapping of the vocabulary,
+			// so that those that are not printable decode to their text.
+			mapped := encoder.mapBytes(added.Content)
+			encoder.encoder[mapped] = token
+			encoder.decoder[token] = []byte(mapped)
+			for len(encoder.unitrim) <= int(token) {
+				encoder.unitrim = append(encoder.unitrim, 0)
+			}
+		}
+		encoder.specials[added.Content] = Tokens{token}
+	}
+	return encoder.updateSpecials()
+}
+
+// tokenizerJsonNormalizer returns the replacements of a tokenizer.json
+// normalizer, as pairs for strings.NewReplacer, and sets encoder to
+// lowercase text for a Lowercase normalizer. The replacements of a Sequence
+// are made at once, rather than one after the other.
+func tokenizerJsonNormalizer(normalizer tokenizerJsonComponent,
+	encoder *GPTEncoder) ([]string, error) {
+	switch normalizer.Type {
+	case "Sequence":
+		pairs := make([]string, 0)
+		for _, inner := range normalizer.Normalizers {
+			innerPairs, err := tokenizerJsonNormalizer(inner, encoder)
+			if err != nil {
+				return nil, err
+			}
+			pairs = append(pairs, innerPairs...)
+		}
+		return pairs, nil
+	case "Lowercase":
+		encoder.lowerCase = true
+		return nil, nil
+	case "Replace":
+		if normalizer.Pattern.String == nil {
+			return nil, fmt.Errorf("%w: tokenizer.json Replace normalizer "+
+				"with a regex", ErrUnsupportedLayout)
+		}
+		return []string{*normalizer.Pattern.String, normalizer.Content}, nil
+	default:
+		return nil, fmt.Errorf("%w: tokenizer.json %s normalizer",
+			ErrUnsupportedLayout, normalizer.Type)
+	}
+}
+
+// tokenizerJsonPreTokenizer returns the PreTokenizer that splits words as a
+// tokenizer.json pre-tokenizer does, or nil if it does not split words.
+// Split expressions are matched against those of the known pre-tokenizers.
+func tokenizerJsonPreTokenizer(
+	preTokenizer tokenizerJsonComponent) (PreTokenizer, error) {
+	switch preTokenizer.Type {
+	case "Sequence":
+		var found PreTokenizer
+		for _, inner := range preTokenizer.PreTokenizers {
+			innerFound, err := tokenizerJsonPreTokenizer(inner)
+			if err != nil {
+				return nil, err
+			}
+			if innerFound == nil {
+				continue
+			} else if found != nil {
+				return nil, fmt.Errorf("%w: tokenizer.json pre-tokenizer "+
+					"splits words more than once", ErrUnsupportedLayout)
+			}
+			found = innerFound
+		}
+		return found, nil
+	case "ByteLevel":
+		if preTokenizer.AddPrefixSpace {
+			return nil, fmt.Errorf("%w: tokenizer.json ByteLevel "+
+				"pre-tokenizer with add_prefix_space", ErrUnsupportedLayout)
+		}
+		if preTokenizer.UseRegex != nil && !*preTokenizer.UseRegex {
+			return nil, nil
+		}
+		return GPT2PreTokenizer, nil
+	case "Whitespace":
+		return WhitespacePreTokenizer, nil
+	case "WhitespaceSplit":
+		return WhitespaceSplitPreTokenizer, nil
+	case "Split":
+		if preTokenizer.Pattern.Regex == nil || preTokenizer.Invert ||
+			preTokenizer.Behavior != "Isolated" {
+			return nil, fmt.Errorf("%w: tokenizer.json Split pre-tokenizer "+
+				"that does not isolate matches of a regex",
+				ErrUnsupportedLayout)
+		}
+		for _, known := range []PreTokenizer{GPT2PreTokenizer,
+			Llama3PreTokenizer} {
+			if known.String() == *preTokenizer.Pattern.Regex {
+				return known, nil
+			}
+		}
+		return nil, fmt.Errorf("%w: tokenizer.json Split pre-tokenizer "+
+			"regex %q", ErrUnsupportedLayout, *preTokenizer.Pattern.Regex)
+	default:
+		return nil, fmt.Errorf("%w: tokenizer.json %s pre-tokenizer",
+			ErrUnsupportedLayout, preTokenizer.Type)
+	}
+}
+
+// checkTokenizerJsonDecoder fails unless a tokenizer.json decoder decodes
+// tokens as their bytes, as Decode does, or as words that end with the
+// encoder's endOfWord suffix, which Decode replaces with a space.
+func checkTokenizerJsonDecoder(decoder tokenizerJsonComponent,
+	endOfWord string) error {
+	switch decoder.Type {
+	case "ByteLevel":
+		return nil
+	case "BPEDecoder":
+		if decoder.Suffix != endOfWord {
+			return fmt.Errorf("%w: tokenizer.json BPEDecoder suffix %q "+
+				"is not the model's end_of_word_suffix",
+				ErrUnsupportedLayout, decoder.Suffix)
+		}
+		return nil
+	case "Sequence":
+		for _, inner := range decoder.Decoders {
+			if err := checkTokenizerJsonDecoder(inner,
+				endOfWord); err != nil {
+				return err
+			}
+		}
+		return nil
+	default:
+		return fmt.Errorf("%w: tokenizer.json %s decoder",
+			ErrUnsupportedLayout, decoder.Type)
+	}
+}
+
+// applyPostProcessor sets the BOS and EOS tokens, and the pair template, of
+// encoder from a tokenizer.json post-processor.
+func (encoder *GPTEncoder) applyPostProcessor(
+	processor tokenizerJsonComponent) error {
+	var template PairTemplate
+	switch processor.Type {
+	case "ByteLevel":
+		return nil
+	case "Sequence":
+		for _, inner := range processor.Processors {
+			if err := encoder.applyPostProcessor(inner); err != nil {
+				return err
+			}
+		}
+		return nil
+	case "BertProcessing", "RobertaProcessing":
+		cls, err := tokenizerJsonTokenId(processor.Cls)
+		if err != nil {
+			return err
+		}
+		sep, err := tokenizerJsonTokenId(processor.Sep)
+		if err != nil {
+			return err
+		}
+		template = PairTemplate{Start: Tokens{cls}, End: Tokens{sep},
+			PairEnd: Tokens{sep}}
+		if processor.Type == "RobertaProcessing" {
+			template.PairStart = Tokens{sep}
+		}
+	case "TemplateProcessing":
+		single, err := processor.templateParts(processor.Single)
+		if err != nil {
+			return err
+		}
+		pair, err := processor.templateParts(processor.Pair)
+		if err != nil {
+			return err
+		}
+		template = PairTemplate{Start: single[0], End: single[1]}
+		if len(pair) == 3 {
+			// The tokens between the texts of a pair are the End of the
+			// first, then the PairStart of the second.
+			between := pair[1]
+			if len(between) < len(template.End) {
+				return fmt.Errorf("%w: tokenizer.json pair template does "+
+					"not follow its single template", ErrUnsupportedLayout)
+			}
+			for idx, token := range template.End {
+				if between[idx] != token {
+					return fmt.Errorf("%w: tokenizer.json pair template "+
+						"does not follow its single template",
+						ErrUnsupportedLayout)
+				}
+			}
+			template.PairStart = between[len(template.End):]
+			template.PairEnd = pair[2]
+		}
+	default:
+		return fmt.Errorf("%w: tokenizer.json %s post-processor",
+			ErrUnsupportedLayout, processor.Type)
+	}
+
+	bos, eos := AddNever, AddNever
+	if len(template.Start) == 1 {
+		encoder.BosToken = template.Start[0]
+		bos = AddAlways
+	}
+	if len(template.End) == 1 {
+		encoder.EosToken = template.End[0]
+		eos = AddAlways
+	}
+	encoder.pairTemplate = &template
+	return encoder.SetBosEosPolicy(bos, eos)
+}
+
+// templateParts splits a TemplateProcessing template into the special
+// tokens before, between and after its sequences, so that a template of one
+// sequence has two parts, and one of two sequences has three.
+func (processor tokenizerJsonComponent) templateParts(
+	pieces []tokenizerJsonPiece) ([]Tokens, error) {
+	parts := []Tokens{{}}
+	for _, piece := range pieces {
+		switch {
+		case piece.Sequence != nil:
+			parts = append(parts, Tokens{})
+		case piece.SpecialToken != nil:
+			special, ok := processor.SpecialTokens[piece.SpecialToken.Id]
+			if !ok {
+				return nil, fmt.Errorf("%w: tokenizer.json template special "+
+					"token %q is not defined", ErrResourceInvalid,
+					piece.SpecialToken.Id)
+			}
+			for _, id := range special.Ids {
+				if id < 0 || int64(id) > int64(^Token(0)) {
+					return nil, fmt.Errorf("%w: template special token %q "+
+						"has id %d", ErrTokenOutOfRange,
+						piece.SpecialToken.Id, id)
+				}
+				parts[len(parts)-1] = append(parts[len(parts)-1], Token(id))
+			}
+		}
+	}
+	if len(parts) < 2 && len(pieces) > 0 {
+		return nil, fmt.Errorf("%w: tokenizer.json template has no sequence",
+			ErrResourceInvalid)
+	}
+	for len(parts) < 2 {
+		parts = append(parts, Tokens{})
+	}
+	return parts, nil
+}
+
+// tokenizerJsonTokenId returns the id of a [content, id] token of a
+// tokenizer.json post-processor.
+func tokenizerJsonTokenId(token []interface{}) (Token, error) {
+	if len(token) != 2 {
+		return 0, fmt.Errorf("%w: tokenizer.json post-processor token %v",
+			ErrResourceInvalid, token)
+	}
+	id, ok := token[1].(float64)
+	if !ok {
+		return 0, fmt.Errorf("%w: tokenizer.json post-processor token %v",
+			ErrResourceInvalid, token)
+	}
+	if id < 0 || id > float64(^Token(0)) {
+		return 0, fmt.Errorf("%w: post-processor token %v",
+			ErrTokenOutOfRange, token)
+	}
+	return Token(id), nil
+}
@@ -0,0 +1,247 @@
+package gpt_bpe
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"time"
+)
+
+// TOKENSTREAM_COMMIT_SUFFIX is the suffix of the commit log that a
+// TokenStreamWriter keeps next to its stream.
+const TOKENSTREAM_COMMIT_SUFFIX = ".commit"
+
+// TOKENSTREAM_BUFFER_SZ is the default number of bytes that a
+// TokenStreamWriter buffers before writing them to its stream.
+const TOKENSTREAM_BUFFER_SZ = 1024 * 1024
+
+// TokenStreamOptions
+// How a TokenStreamWriter serializes its tokens, and how often it makes
+// them durable. The zero value writes uint16 tokens, buffers
+// TOKENSTREAM_BUFFER_SZ bytes, and only syncs when it is closed.
+type TokenStreamOptions struct {
+	// Dtype is the serialization of the tokens, which cannot be
+	// DTYPE_DELTA_VARINT, as its documents would not be read independently.
+	Dtype TokensDtype
+	// BufferSize is the number of bytes buffered before they are written, or
+	// TOKENSTREAM_BUFFER_SZ if it is not positive.
+	BufferSize int
+	// SyncDocuments syncs the stream after every SyncDocuments documents, or
+	// never if it is not positive.
+	SyncDocuments int
+	// SyncInterval syncs the stream at the end of the first document that
+	// ends SyncInterval after the last sync, or never if it is not positive.
+	SyncInterval time.Duration
+}
+
+// TokenStreamWriter
+// Appends documents of tokens to a file, and makes them durable according to
+// its TokenStreamOptions. Each sync fsyncs the stream, and then records the
+// length of its complete documents in a commit log next to it, so that a
+// stream that was being written when the process or machine crashed can be
+// truncated to its last durable document by RecoverTokenStream. Opening a
+// stream recovers it, so that appending continues after its last durable
+// document.
+type TokenStreamWriter struct {
+	Path      string
+	options   TokenStreamOptions
+	file      *os.File
+	commits   *os.File
+	buffered  *bufio.Writer
+	offset    int64
+	committed int64
+	unsynced  int
+	lastSync  time.Time
+	open      bool
+}
+
+// OpenTokenStream
+// Opens the stream at path for appending with options, creating it if it
+// does not exist, and recovering it with RecoverTokenStream if it does.
+func OpenTokenStream(path string, options TokenStreamOptions) (
+	*TokenStreamWriter, error) {
+	if options.Dtype == DTYPE_DELTA_VARINT {
+		return nil, fmt.Errorf("%w: token streams cannot be %s, use a "+
+			"DeltaWriter", ErrTokensInvalid, options.Dtype)
+	} else if _, err := MarshalTokens(nil, options.Dtype); err != nil {
+		return nil, err
+	}
+	if options.BufferSize <= 0 {
+		options.BufferSize = TOKENSTREAM_BUFFER_SZ
+	}
+	offset, err := RecoverTokenStream(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND,
+		0644)
+	if err != nil {
+		return nil, err
+	}
+	commits, err := os.OpenFile(path+TOKENSTREAM_COMMIT_SUFFIX,
+		os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &TokenStreamWriter{
+		Path:      path,
+		options:   options,
+		file:      file,
+		commits:   commits,
+		buffered:  bufio.NewWriterSize(file, options.BufferSize),
+		offset:    offset,
+		committed: offset,
+		lastSync:  time.Now(),
+		open:      true,
+	}, nil
+}
+
+// RecoverTokenStream
+// Truncates the stream at path to the length recorded by the last complete
+// entry of its commit log, discarding any partial document that was being
+// written when its writer stopped, and returns that length. A stream without
+// a commit log is taken to be complete.
+func RecoverTokenStream(path string) (int64, error) {
+	stat, err := os.Stat(path)
+	if err != nil {
+		return 0, err
+	}
+	log, err := os.ReadFile(path + TOKENSTREAM_COMMIT_SUFFIX)
+	if errors.Is(err, os.ErrNotExist) {
+		return stat.Size(), nil
+	} else if err != nil {
+		return 0, err
+	}
+	// The last entry may have been torn by the crash, so only entries that
+	// end with a newline are complete.
+	committed := int64(0)
+	if end := bytes.LastIndexByte(log, '\n'); end >= 0 {
+		entries := bytes.Split(log[:end], []byte("\n"))
+		entry := string(entries[len(entries)-1])
+		if committed, err = strconv.ParseInt(entry, 10, 64); err != nil {
+			return 0, fmt.Errorf("%w: %s%s: %v", ErrTokensInvalid, path,
+				TOKENSTREAM_COMMIT_SUFFIX, err)
+		}
+	}
+	if committed > stat.Size() {
+		return 0, fmt.Errorf("%w: %s is %d bytes, but %d were committed",
+			ErrTokensInvalid, path, stat.Size(), committed)
+	} else if committed < stat.Size() {
+		if err := os.Truncate(path, committed); err != nil {
+			return 0, err
+		}
+	}
+	return committed, nil
+}
+
+// Write
+// Appends tokens to the document being written, which is not durable until
+// it is ended by EndDocument and then synced.
+func (writer *TokenStreamWriter) Write(tokens Tokens) error {
+	if !writer.open {
+		return os.ErrClosed
+	}
+	data, err := MarshalTokens(tokens, writer.options.Dtype)
+	if err != nil {
+		return err
+	}
+	written, err := writer.buffered.Write(data)
+	writer.offset += int64(written)
+	return err
+}
+
+// EndDocument
+// Ends the document being written, and syncs the stream if its options
+// call for it.
+func (writer *TokenStreamWriter) EndDocument() error {
+	if !writer.open {
+		return os.ErrClosed
+	}
+	writer.committed = writer.offset
+	writer.unsynced++
+	options := writer.options
+	if (options.SyncDocuments > 0 &&
+		writer.unsynced >= options.SyncDocuments) ||
+		(options.SyncInterval > 0 &&
+			time.Since(writer.lastSync) >= options.SyncInterval) {
+		return writer.Sync()
+	}
+	return nil
+}
+
+// WriteDocument
+// Appends tokens as a whole document.
+func (writer *TokenStreamWriter) WriteDocument(tokens Tokens) error {
+	if err := writer.Write(tokens); err != nil {
+		return err
+	}
+	return writer.EndDocument()
+}
+
+// Flush
+// Writes the buffered tokens to the stream, without syncing it.
+func (writer *TokenStreamWriter) Flush() error {
+	if !writer.open {
+		return os.ErrClosed
+	}
+	return writer.buffered.Flush()
+}
+
+// Sync
+// Makes every ended document durable, by flushing and fsyncing the stream,
+// and then recording its length in the commit log and fsyncing that.
+func (writer *TokenStreamWriter) Sync() error {
+	if err := writer.Flush(); err != nil {
+		return err
+	} else if err := writer.file.Sync(); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(writer.commits,
+		strconv.FormatInt(writer.committed, 10)+"\n"); err != nil {
+		return err
+	} else if err := writer.commits.Sync(); err != nil {
+		return err
+	}
+	writer.unsynced = 0
+	writer.lastSync = time.Now()
+	return nil
+}
+
+// Offset
+// Returns the number of bytes in the stream, including the document being
+// written.
+func (writer *TokenStreamWriter) Offset() int64 {
+	return writer.offset
+}
+
+// Committed
+// Returns the number of bytes of the stream's ended documents.
+func (writer *TokenStreamWriter) Committed() int64 {
+	return writer.committed
+}
+
+// Close
+// Syncs the stream's ended documents and closes it, discarding the document
+// being written if it was not ended.
+func (writer *TokenStreamWriter) Close() error {
+	if !writer.open {
+		return nil
+	}
+	err := writer.Sync()
+	writer.open = false
+	if err == nil && writer.offset > writer.committed {
+		err = writer.file.Truncate(writer.committed)
+	}
+	if closeErr := writer.file.Close(); err == nil {
+		err = closeErr
+	}
+	if closeErr := writer.commits.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
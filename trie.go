@@ -0,0 +1,142 @@
+package gpt_bpe
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+)
+
+// TrieEncoder
+// Encodes text as the longest token of its vocabulary that the text starts
+// with, then the longest that the rest starts with, and so on, over the bytes
+// of the text and without splitting it into words first, as the tokenizers of
+// RWKV's World models do. Its vocabulary is held in a trie of the bytes of
+// its tokens.
+type TrieEncoder struct {
+	name    string
+	nodes   []trieNode
+	decoder map[Token][]byte
+}
+
+var _ Encoder = (*TrieEncoder)(nil)
+
+// trieNode is a node of a TrieEncoder's trie, which ends a token when token
+// is not negative.
+type trieNode struct {
+	children map[byte]int32
+	token    int32
+}
+
+// NewTrieEncoder
+// Returns a TrieEncoder for the vocabulary of tokens and their bytes. The
+// name is written to its fingerprint.
+func NewTrieEncoder(name string,
+	vocab map[Token][]byte) (*TrieEncoder, error) {
+	encoder := &TrieEncoder{
+		name:    name,
+		nodes:   []trieNode{{token: -1}},
+		decoder: make(map[Token][]byte, len(vocab)),
+	}
+	tokens := make(Tokens, 0, len(vocab))
+	for token := range vocab {
+		tokens = append(tokens, token)
+	}
+	sort.Slice(tokens, func(i, j int) bool { return tokens[i] < tokens[j] })
+	for _, token := range tokens {
+		tokenBytes := vocab[token]
+		if len(tokenBytes) == 0 {
+			return nil, fmt.Errorf("%w: token %d is empty", ErrVocabInvalid,
+				token)
+		}
+		node := 0
+		for _, b := range tokenBytes {
+			child, ok := encoder.nodes[node].children[b]
+			if !ok {
+				if encoder.nodes[node].children == nil {
+					encoder.nodes[node].children = make(map[byte]int32)
+				}
+				child = int32(len(encoder.nodes))
+				encoder.nodes[node].children[b] = child
+				encoder.nodes = append(encoder.nodes, trieNode{token: -1})
+			}
+			node = int(child)
+		}
+		// Of the ids of a duplicated string, the lowest is encoded.
+		if encoder.nodes[node].token < 0 {
+			encoder.nodes[node].token = int32(token)
+		}
+		encoder.decoder[token] = append([]byte{}, tokenBytes...)
+	}
+	return encoder, nil
+}
+
+// Encode
+// Encodes text into the longest tokens that each position starts with. The
+// bytes that no token starts with are skipped, which a vocabulary with a
+// token for each byte, as RWKV's World vocabulary has, never does.
+func (encoder *TrieEncoder) Encode(text *string) *Tokens {
+	tokens := make(Tokens, 0, len(*text)/3+1)
+	for begin := 0; begin < len(*text); {
+		end, token := begin+1, int32(-1)
+		node := 0
+		for idx := begin; idx < len(*text); idx++ {
+			child, ok := encoder.nodes[node].children[(*text)[idx]]
+			if !ok {
+				break
+			}
+			node = int(child)
+			if encoder.nodes[node].token >= 0 {
+				end, token = idx+1, encoder.nodes[node].token
+			}
+		}
+		if token >= 0 {
+			tokens = append(tokens, Token(token))
+		}
+		begin = end
+	}
+	return &tokens
+}
+
+// Decode
+// Decodes tokens into the text of their bytes. Tokens that are not in the
+// vocabulary, such as RWKV's end of text token 0, are skipped.
+func (encoder *TrieEncoder) Decode(encoded *Tokens) string {
+	text := make([]byte, 0, len(*encoded)*3)
+	for _, token := range *encoded {
+		text = append(text, encoder.decoder[token]...)
+	}
+	return string(text)
+}
+
+// Count
+// Returns the number of tokens that text encodes to.
+func (encoder *TrieEncoder) Count(text *string) int {
+	return len(*encoder.Encode(text))
+}
+
+// Specials
+// Returns no special tokens, as a TrieEncoder finds none in text.
+func (encoder *TrieEncoder) Specials() map[string]Tokens {
+	return map[string]Tokens{}
+}
+
+// Fingerprint
+// Returns a hex encoded SHA-256 digest over the encoder's name and its
+// vocabulary, which determine how it tokenizes text.
+func (encoder *TrieEncoder) Fingerprint() string {
+	h := sha256.New()
+	writeFingerprintString(h, "trie")
+	writeFingerprintString(h, encoder.name)
+	tokens := make(Tokens, 0, len(encoder.decoder))
+	for token := range encoder.decoder {
+		tokens = append(tokens, token)
+	}
+	sort.Slice(tokens, func(i, j int) bool { return tokens[i] < tokens[j] })
+	writeFingerprintUint(h, uint64(len(tokens)))
+	for _, token := range tokens {
+		writeFingerprintUint(h, uint64(token))
+		writeFingerprintString(h, string(encoder.decoder[token]))
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
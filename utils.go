@@ -1,9 +1,17 @@
 package gpt_bpe
 
 import (
+	"bufio"
 	"bytes"
+	"compress/gzip"
 	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"os"
 	"strings"
+
+	"github.com/wbrown/gpt_bpe/zstd"
 )
 
 type TrimDirection uint
@@ -18,29 +26,80 @@ const (
 	TokenSize = 2
 )
 
-func (tokens *Tokens) ToBin() *[]byte {
-	buf := bytes.NewBuffer(make([]byte, 0, len(*tokens)*TokenSize))
-	for idx := range *tokens {
-		bs := (*tokens)[idx]
-		binary.Write(buf, binary.LittleEndian, bs)
+// ToBin
+// Returns tokens as TokenSize little-endian bytes each, the binary format of
+// token files, or an ErrTokenOutOfRange error for the first token that does
+// not fit in TokenSize bytes, as ids above 65535 of larger vocabularies do
+// not. Write those with MarshalTokens and DTYPE_UINT32.
+func (tokens *Tokens) ToBin() (*[]byte, error) {
+	byt := make([]byte, len(*tokens)*TokenSize)
+	for idx, token := range *tokens {
+		if token > math.MaxUint16 {
+			return nil, fmt.Errorf("%w: token %d at index %d does not fit "+
+				"in %d bytes", ErrTokenOutOfRange, token, idx, TokenSize)
+		}
+		binary.LittleEndian.PutUint16(byt[idx*TokenSize:], uint16(token))
 	}
-	byt := buf.Bytes()
-	return &byt
+	return &byt, nil
 }
 
 func TokensFromBin(bin *[]byte) *Tokens {
 	tokens := make(Tokens, 0)
 	buf := bytes.NewReader(*bin)
 	for {
-		var token Token
+		var token uint16
 		if err := binary.Read(buf, binary.LittleEndian, &token); err != nil {
 			break
 		}
-		tokens = append(tokens, token)
+		tokens = append(tokens, Token(token))
 	}
 	return &tokens
 }
 
+// NewTokensReader
+// Returns a reader over the binary tokens in reader, transparently
+// decompressing Zstandard and gzip compressed token files. A gzip reader
+// that fails to read its header is returned as an error of the reader.
+func NewTokensReader(reader io.Reader) io.Reader {
+	buffered := bufio.NewReader(reader)
+	magic, err := buffered.Peek(4)
+	if err == nil && zstd.IsFrame(magic) {
+		return zstd.NewReader(buffered)
+	} else if len(magic) >= 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+		gzipReader, err := gzip.NewReader(buffered)
+		if err != nil {
+			return &errReader{err}
+		}
+		return gzipReader
+	}
+	return buffered
+}
+
+// errReader is a reader that fails with err.
+type errReader struct {
+	err error
+}
+
+func (reader *errReader) Read([]byte) (int, error) {
+	return 0, reader.err
+}
+
+// ReadTokensFile
+// Reads all the tokens from a binary token file, which may be Zstandard or
+// gzip compressed.
+func ReadTokensFile(path string) (*Tokens, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	bin, err := io.ReadAll(NewTokensReader(file))
+	if err != nil {
+		return nil, err
+	}
+	return TokensFromBin(&bin), nil
+}
+
 func (encoder GPTEncoder) TrimNewlines(tokens *Tokens, direction TrimDirection,
 	limit uint) (*Tokens, error) {
 	var err error
@@ -0,0 +1,88 @@
+package gpt_bpe
+
+import (
+	"runtime/debug"
+	"strings"
+)
+
+// VERSION
+// The release of the gpt_bpe module that Version falls back to when neither
+// the build nor its build info records one.
+const VERSION = "0.1.0"
+
+// version is the release of the gpt_bpe module set by the build, with
+// `-ldflags "-X github.com/wbrown/gpt_bpe.version=0.2.0"`.
+var version string
+
+// modulePath is the path of the gpt_bpe module in build info.
+const modulePath = "github.com/wbrown/gpt_bpe"
+
+// Versions of the data of the embedded tokenizers, raised whenever the
+// vocabulary, merges, special tokens or configuration of that tokenizer
+// changes.
+const (
+	GPT2_DATA_VERSION = 1
+	PILE_DATA_VERSION = 1
+	CLIP_DATA_VERSION = 1
+)
+
+// EmbeddedDataVersions
+// Maps the ids of the embedded tokenizers to the versions of their data.
+var EmbeddedDataVersions = map[string]int{
+	"gpt2-tokenizer": GPT2_DATA_VERSION,
+	"pile-tokenizer": PILE_DATA_VERSION,
+	"clip-tokenizer": CLIP_DATA_VERSION,
+}
+
+// EmbeddedResourceIds
+// Maps the ids of the embedded tokenizers to stable numbers, for formats
+// that record the tokenizer of their tokens compactly. A number is never
+// changed or reused, and the tokenizer's data version tells the versions of
+// its data apart.
+var EmbeddedResourceIds = map[string]uint16{
+	"gpt2-tokenizer": 1,
+	"pile-tokenizer": 2,
+	"clip-tokenizer": 3,
+}
+
+// Version
+// Returns the release of the gpt_bpe module that the binary was built with:
+// the version set by the build, or else the version of the module in the
+// binary's build info, or else VERSION, such as when it is built from a
+// local copy of the module.
+func Version() string {
+	if version != "" {
+		return version
+	}
+	if info, ok := debug.ReadBuildInfo(); ok {
+		if moduleVersion := buildInfoVersion(info); moduleVersion != "" {
+			return moduleVersion
+		}
+	}
+	return VERSION
+}
+
+// buildInfoVersion returns the version of the gpt_bpe module in info,
+// without its v prefix, or "" when info has no version for it.
+func buildInfoVersion(info *debug.BuildInfo) string {
+	module := &info.Main
+	if module.Path != modulePath {
+		module = nil
+		for _, dep := range info.Deps {
+			if dep.Path == modulePath {
+				module = dep
+				break
+			}
+		}
+		if module == nil {
+			return ""
+		}
+	}
+	if module.Replace != nil {
+		module = module.Replace
+	}
+	if module.Version == "" || module.Version == "(devel)" {
+		return ""
+	}
+	return strings.TrimPrefix(module.Version, "v")
+}
@@ -0,0 +1,106 @@
+package gpt_bpe
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// VOCAB_BYTES_FILE
+// The name of the lossless vocabulary resource, which is used in place of
+// vocab.json when present.
+const VOCAB_BYTES_FILE = "vocab.bytes.json"
+
+// VocabBytes
+// The bytes of a token in a lossless vocabulary. They are written as base64,
+// and read from either base64 or a list of integers, so that tokens which are
+// not valid UTF-8 survive without any escaping.
+type VocabBytes []byte
+
+func (vocabBytes *VocabBytes) UnmarshalJSON(data []byte) error {
+	if len(data) > 0 && data[0] == '[' {
+		var ints []int
+		if err := json.Unmarshal(data, &ints); err != nil {
+			return err
+		}
+		decoded := make(VocabBytes, len(ints))
+		for idx, b := range ints {
+			if b < 0 || b > 255 {
+				return errors.New(fmt.Sprintf("byte %d out of range", b))
+			}
+			decoded[idx] = byte(b)
+		}
+		*vocabBytes = decoded
+		return nil
+	}
+	var encoded string
+	if err := json.Unmarshal(data, &encoded); err != nil {
+		return err
+	}
+	decoded, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return err
+	}
+	*vocabBytes = decoded
+	return nil
+}
+
+// VocabBytesEntry
+// A token and its bytes in a lossless vocabulary, which is a JSON array of
+// entries ordered by token.
+type VocabBytesEntry struct {
+	Token Token      `json:"id"`
+	Bytes VocabBytes `json:"bytes"`
+}
+
+// ParseVocabBytes
+// Parses a lossless vocabulary into the mappings of text to tokens and of
+// tokens to bytes that vocab.json is parsed into.
+func ParseVocabBytes(data []byte) (map[string]Token, map[Token][]byte,
+	error) {
+	var entries []VocabBytesEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, nil, vocabUnmarshalError(VOCAB_BYTES_FILE, err)
+	}
+	encoderTokens := make(map[string]Token, len(entries))
+	tokensEncoder := make(map[Token][]byte, len(entries))
+	for _, entry := range entries {
+		// Of the ids of a duplicated string, the highest is encoded,
+		// whatever the order of the entries, as DuplicatesHighest.
+		if token, ok := encoderTokens[string(entry.Bytes)]; !ok ||
+			entry.Token > token {
+			encoderTokens[string(entry.Bytes)] = entry.Token
+		}
+		tokensEncoder[entry.Token] = entry.Bytes
+	}
+	return encoderTokens, tokensEncoder, nil
+}
+
+// vocabUnmarshalError wraps an error unmarshalling a vocabulary, as
+// ErrTokenOutOfRange when a token id does not fit in a Token.
+func vocabUnmarshalError(name string, err error) error {
+	kind := ErrVocabInvalid
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &typeErr) && strings.HasPrefix(typeErr.Value,
+		"number") {
+		kind = ErrTokenOutOfRange
+	}
+	return fmt.Errorf("%w: error unmarshalling `%s`: %v", kind, name, err)
+}
+
+// MarshalVocabBytes
+// Returns the encoder's vocabulary as a lossless vocabulary, to be written
+// as VOCAB_BYTES_FILE.
+func (encoder *GPTEncoder) MarshalVocabBytes() ([]byte, error) {
+	entries := make([]VocabBytesEntry, 0, len(encoder.decoder))
+	for token, text := range encoder.decoder {
+		entries = append(entries, VocabBytesEntry{token, text})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Token < entries[j].Token
+	})
+	return json.Marshal(entries)
+}
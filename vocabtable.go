@@ -0,0 +1,83 @@
+package gpt_bpe
+
+import (
+	"bufio"
+	"encoding/hex"
+	"io"
+	"sort"
+	"strconv"
+)
+
+// VOCAB_TABLE_HEADER is the header line of the table that WriteVocabTable
+// writes, naming its tab separated columns.
+const VOCAB_TABLE_HEADER = "id\tbytes\tprintable\tspecial\n"
+
+// TokenBytes
+// Returns the UTF-8 bytes that token decodes to on its own, which may be
+// part of a character, or nil if the token is not in the vocabulary.
+func (encoder *GPTEncoder) TokenBytes(token Token) []byte {
+	mapped, ok := encoder.decoder[token]
+	if !ok {
+		return nil
+	}
+	if encoder.bpeLevel == BPECharLevel {
+		return append([]byte{}, mapped...)
+	}
+	tokenBytes := make([]byte, 0, len(mapped))
+	for _, r := range string(mapped) {
+		if b, ok := encoder.runeToByte[r]; ok {
+			tokenBytes = append(tokenBytes, b)
+		} else {
+			// Runes outside the byte mapping, as in some added tokens, are
+			// their own UTF-8.
+			tokenBytes = append(tokenBytes, string(r)...)
+		}
+	}
+	return tokenBytes
+}
+
+// WriteVocabTable
+// Writes a tab separated table of the vocabulary to writer, with a row for
+// each token id in order, for initializing or analyzing embedding matrices
+// by token. The columns, as named by VOCAB_TABLE_HEADER, are the token id,
+// its bytes in hex, its printable form in the byte mapping that GPT-2 style
+// vocabularies are written in, where spaces are Ġ and newlines Ċ, and 1 for
+// special tokens or 0 otherwise.
+func (encoder *GPTEncoder) WriteVocabTable(writer io.Writer) error {
+	tokens := make(Tokens, 0, len(encoder.decoder))
+	for token := range encoder.decoder {
+		tokens = append(tokens, token)
+	}
+	sort.Slice(tokens, func(i, j int) bool {
+		return tokens[i] < tokens[j]
+	})
+	specials := make(map[Token]bool, len(encoder.specials))
+	for _, specialTokens := range encoder.specials {
+		if len(specialTokens) == 1 {
+			specials[specialTokens[0]] = true
+		}
+	}
+
+	bufWriter := bufio.NewWriter(writer)
+	if _, err := bufWriter.WriteString(VOCAB_TABLE_HEADER); err != nil {
+		return err
+	}
+	row := make([]byte, 0, 128)
+	for _, token := range tokens {
+		tokenBytes := encoder.TokenBytes(token)
+		row = strconv.AppendUint(row[:0], uint64(token), 10)
+		row = append(row, '\t')
+		row = append(row, hex.EncodeToString(tokenBytes)...)
+		row = append(row, '\t')
+		row = append(row, encoder.mapBytes(string(tokenBytes))...)
+		if specials[token] {
+			row = append(row, "\t1\n"...)
+		} else {
+			row = append(row, "\t0\n"...)
+		}
+		if _, err := bufWriter.Write(row); err != nil {
+			return err
+		}
+	}
+	return bufWriter.Flush()
+}
@@ -0,0 +1,49 @@
+package gpt_bpe
+
+import (
+	"io"
+	"sort"
+	"sync/atomic"
+)
+
+// WarmCache
+// Pre-populates the word cache with the most frequent words of sample, as
+// many as the cache holds, so that a freshly started encoder does not pay
+// for merging common words on its first requests. The words are encoded from
+// the least to the most frequent, leaving the most frequent the most recently
+// used. The cache statistics are not changed, and the hooks are not called.
+// Returns the number of words that were encoded.
+func (encoder *GPTEncoder) WarmCache(sample io.RuneReader) int {
+	counts := make(map[string]int)
+	nextWord := encoder.WordSplitter(sample)
+	for word := nextWord(); word != nil; word = nextWord() {
+		if _, isSpecial := encoder.specials[*word]; !isSpecial {
+			counts[*word]++
+		}
+	}
+	words := make([]string, 0, len(counts))
+	for word := range counts {
+		words = append(words, word)
+	}
+	sort.Slice(words, func(i, j int) bool {
+		if counts[words[i]] != counts[words[j]] {
+			return counts[words[i]] > counts[words[j]]
+		}
+		return words[i] < words[j]
+	})
+	if encoder.LruSize > 0 && len(words) > encoder.LruSize {
+		words = words[:encoder.LruSize]
+	}
+
+	hits, misses := atomic.LoadInt64(&encoder.LruHits),
+		atomic.LoadInt64(&encoder.LruMisses)
+	hooks := encoder.hooks
+	encoder.hooks = nil
+	for idx := len(words) - 1; idx >= 0; idx-- {
+		encoder.encodeWord(&words[idx])
+	}
+	atomic.StoreInt64(&encoder.LruHits, hits)
+	atomic.StoreInt64(&encoder.LruMisses, misses)
+	encoder.hooks = hooks
+	return len(words)
+}
@@ -0,0 +1,465 @@
+package gpt_bpe
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/wbrown/gpt_bpe/resources"
+)
+
+// WORDPIECE_MAX_WORD_CHARS is the longest word, in characters, that a
+// WordPieceEncoder splits into pieces, as BERT does. Longer words are
+// encoded as the unknown token.
+const WORDPIECE_MAX_WORD_CHARS = 100
+
+// WordPieceSpecials are the special tokens of BERT-family vocabularies,
+// which are found in text before it is split into words.
+var WordPieceSpecials = []string{"[PAD]", "[UNK]", "[CLS]", "[SEP]",
+	"[MASK]"}
+
+// WordPieceEncoder
+// Encodes text as BERT, DistilBERT and ELECTRA do. BERT's basic tokenizer
+// cleans the text, optionally lowercases it and strips its accents, and
+// splits it into words on whitespace, punctuation and CJK characters. Each
+// word is then encoded as the longest piece of the vocabulary that it starts
+// with, followed by the longest continuation pieces, prefixed with ##, that
+// the rest starts with. Words that cannot be encoded so are encoded as the
+// unknown token.
+type WordPieceEncoder struct {
+	ClsToken Token
+	SepToken Token
+	PadToken Token
+	UnkToken Token
+	// ContinuingPrefix marks the pieces that continue a word.
+	ContinuingPrefix string
+	// MaxWordChars is the longest word, in characters, that is split into
+	// pieces.
+	MaxWordChars int
+	lowerCase    bool
+	stripAccents bool
+	encoder      map[string]Token
+	decoder      map[Token]string
+	specials     map[string]Tokens
+	specialsPat  *regexp.Regexp
+}
+
+var _ Encoder = (*WordPieceEncoder)(nil)
+
+// NewWordPieceEncoder
+// Returns a WordPieceEncoder for a BERT-family vocab.txt, of a piece on each
+// line in the order of their ids. With lowerCase, text is lowercased, and
+// with stripAccents, the accents of Latin letters and combining marks are
+// removed, as uncased BERT vocabularies are trained with.
+func NewWordPieceEncoder(vocab []byte, lowerCase bool,
+	stripAccents bool) (*WordPieceEncoder, error) {
+	pieces := make([]string, 0, len(vocab)/8)
+	scanner := bufio.NewScanner(bytes.NewReader(vocab))
+	for scanner.Scan() {
+		pieces = append(pieces, strings.TrimRight(scanner.Text(), "\r"))
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("%w: vocab.txt: %s", ErrVocabInvalid, err)
+	}
+	encoder, err := newWordPieceEncoder(pieces, lowerCase, stripAccents)
+	if err != nil {
+		return nil, err
+	}
+	return encoder, encoder.setSpecials(WordPieceSpecials, "[UNK]")
+}
+
+// newWordPieceEncoder returns a WordPieceEncoder for pieces, in the order of
+// their ids, without special tokens. Empty pieces are ids that are not used.
+func newWordPieceEncoder(pieces []string, lowerCase bool,
+	stripAccents bool) (*WordPieceEncoder, error) {
+	if int64(len(pieces)) > int64(^Token(0))+1 {
+		return nil, fmt.Errorf("%w: %d pieces is more than a Token holds",
+			ErrTokenOutOfRange, len(pieces))
+	}
+	encoder := &WordPieceEncoder{
+		ContinuingPrefix: "##",
+		MaxWordChars:     WORDPIECE_MAX_WORD_CHARS,
+		lowerCase:        lowerCase,
+		stripAccents:     stripAccents,
+		encoder:          make(map[string]Token, len(pieces)),
+		decoder:          make(map[Token]string, len(pieces)),
+		specials:         make(map[string]Tokens),
+	}
+	for id, piece := range pieces {
+		if piece == "" {
+			continue
+		}
+		if _, ok := encoder.encoder[piece]; !ok {
+			encoder.encoder[piece] = Token(id)
+		}
+		encoder.decoder[Token(id)] = piece
+	}
+	return encoder, nil
+}
+
+// setSpecials makes those of specials that are in the vocabulary the
+// encoder's special tokens, with unk as its unknown token.
+func (encoder *WordPieceEncoder) setSpecials(specials []string,
+	unk string) error {
+	unkToken, ok := encoder.encoder[unk]
+	if !ok {
+		return fmt.Errorf("%w: unknown token %s is not in the vocabulary",
+			ErrVocabInvalid, unk)
+	}
+	encoder.UnkToken = unkToken
+	encoder.specials = make(map[string]Tokens, len(specials))
+	quoted := make([]string, 0, len(specials))
+	for _, special := range specials {
+		if token, ok := encoder.encoder[special]; ok {
+			encoder.specials[special] = Tokens{token}
+			quoted = append(quoted, regexp.QuoteMeta(special))
+		}
+	}
+	sort.Strings(quoted)
+	encoder.specialsPat = regexp.MustCompile(strings.Join(quoted, "|"))
+	for special, token := range map[string]*Token{"[CLS]": &encoder.ClsToken,
+		"[SEP]": &encoder.SepToken, "[PAD]": &encoder.PadToken} {
+		if tokens, ok := encoder.specials[special]; ok {
+			*token = tokens[0]
+		}
+	}
+	return nil
+}
+
+// Encode
+// Encodes text into tokens, without the [CLS] and [SEP] tokens that BERT
+// models take their input between.
+func (encoder *WordPieceEncoder) Encode(text *string) *Tokens {
+	tokens := make(Tokens, 0, len(*text)/4+1)
+	begin := 0
+	for _, match := range encoder.specialsPat.FindAllStringIndex(*text, -1) {
+		if match[0] == match[1] {
+			continue
+		}
+		for _, word := range encoder.SplitWords((*text)[begin:match[0]]) {
+			tokens = append(tokens, encoder.encodeWord(word)...)
+		}
+		tokens = append(tokens, encoder.specials[(*text)[match[0]:match[1]]]...)
+		begin = match[1]
+	}
+	for _, word := range encoder.SplitWords((*text)[begin:]) {
+		tokens = append(tokens, encoder.encodeWord(word)...)
+	}
+	return &tokens
+}
+
+// SplitWords
+// Splits text into words as BERT's basic tokenizer does: control characters
+// are removed, the text is lowercased and its accents stripped as the encoder
+// is configured to, and it is split on whitespace, with each punctuation
+// character and CJK character a word of its own.
+func (encoder *WordPieceEncoder) SplitWords(text string) []string {
+	words := make([]string, 0, len(text)/4+1)
+	var word strings.Builder
+	endWord := func() {
+		if word.Len() > 0 {
+			words = append(words, word.String())
+			word.Reset()
+		}
+	}
+	for _, r := range text {
+		switch {
+		case r == 0 || r == utf8.RuneError ||
+			(r != '\t' && r != '\n' && r != '\r' && unicode.IsControl(r)) ||
+			unicode.In(r, unicode.Cf):
+			continue
+		case unicode.IsSpace(r):
+			endWord()
+			continue
+		}
+		if encoder.lowerCase {
+			r = unicode.ToLower(r)
+		}
+		if encoder.stripAccents {
+			if unicode.Is(unicode.Mn, r) {
+				continue
+			}
+			if stripped, ok := accentsStripped[r]; ok {
+				r = stripped
+			}
+		}
+		if isBertPunctuation(r) || isCJK(r) {
+			endWord()
+			words = append(words, string(r))
+			continue
+		}
+		word.WriteRune(r)
+	}
+	endWord()
+	return words
+}
+
+// encodeWord encodes a word as the longest pieces that each of its positions
+// start with, or as the unknown token if no pieces cover it.
+func (encoder *WordPieceEncoder) encodeWord(word string) Tokens {
+	if utf8.RuneCountInString(word) > encoder.MaxWordChars {
+		return Tokens{encoder.UnkToken}
+	}
+	tokens := make(Tokens, 0, 2)
+	for begin := 0; begin < len(word); {
+		found := false
+		for end := len(word); end > begin; {
+			piece := word[begin:end]
+			if begin > 0 {
+				piece = encoder.ContinuingPrefix + piece
+			}
+			if token, ok := encoder.encoder[piece]; ok {
+				tokens = append(tokens, token)
+				begin, found = end, true
+				break
+			}
+			_, size := utf8.DecodeLastRuneInString(word[begin:end])
+			end -= size
+		}
+		if !found {
+			return Tokens{encoder.UnkToken}
+		}
+	}
+	return tokens
+}
+
+// Decode
+// Decodes tokens into text, joining continuation pieces to the piece before
+// them and separating words with spaces. As the basic tokenizer discards
+// whitespace and case, the text is not always that which was encoded.
+func (encoder *WordPieceEncoder) Decode(encoded *Tokens) string {
+	var builder strings.Builder
+	for idx, token := range *encoded {
+		piece, ok := encoder.decoder[token]
+		if !ok {
+			continue
+		}
+		if continued := strings.TrimPrefix(piece,
+			encoder.ContinuingPrefix); continued != piece {
+			builder.WriteString(continued)
+			continue
+		}
+		if idx > 0 {
+			builder.WriteByte(' ')
+		}
+		builder.WriteString(piece)
+	}
+	return builder.String()
+}
+
+// Count
+// Returns the number of tokens that text encodes to.
+func (encoder *WordPieceEncoder) Count(text *string) int {
+	return len(*encoder.Encode(text))
+}
+
+// Specials
+// Returns a copy of the encoder's special tokens, by their text.
+func (encoder *WordPieceEncoder) Specials() map[string]Tokens {
+	specials := make(map[string]Tokens, len(encoder.specials))
+	for special, tokens := range encoder.specials {
+		specials[special] = append(Tokens{}, tokens...)
+	}
+	return specials
+}
+
+// Fingerprint
+// Returns a hex encoded SHA-256 digest over everything that determines how
+// the encoder tokenizes text: its vocabulary, special tokens and basic
+// tokenizer options.
+func (encoder *WordPieceEncoder) Fingerprint() string {
+	h := sha256.New()
+	writeFingerprintString(h, "wordpiece")
+	tokens := make(Tokens, 0, len(encoder.decoder))
+	for token := range encoder.decoder {
+		tokens = append(tokens, token)
+	}
+	sort.Slice(tokens, func(i, j int) bool {
+		return tokens[i] < tokens[j]
+	})
+	writeFingerprintUint(h, uint64(len(tokens)))
+	for _, token := range tokens {
+		writeFingerprintUint(h, uint64(token))
+		writeFingerprintString(h, encoder.decoder[token])
+	}
+	specials := make([]string, 0, len(encoder.specials))
+	for special := range encoder.specials {
+		specials = append(specials, special)
+	}
+	sort.Strings(specials)
+	for _, special := range specials {
+		writeFingerprintString(h, special)
+	}
+	for _, flag := range []bool{encoder.lowerCase, encoder.stripAccents} {
+		if flag {
+			writeFingerprintUint(h, 1)
+		} else {
+			writeFingerprintUint(h, 0)
+		}
+	}
+	writeFingerprintString(h, encoder.ContinuingPrefix)
+	writeFingerprintUint(h, uint64(encoder.MaxWordChars))
+	writeFingerprintUint(h, uint64(encoder.UnkToken))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// isBertPunctuation returns whether BERT splits words at r, which is all
+// ASCII symbols as well as Unicode punctuation.
+func isBertPunctuation(r rune) bool {
+	if (r >= 33 && r <= 47) || (r >= 58 && r <= 64) ||
+		(r >= 91 && r <= 96) || (r >= 123 && r <= 126) {
+		return true
+	}
+	return unicode.IsPunct(r)
+}
+
+// isCJK returns whether r is in the CJK Unified Ideographs blocks, which
+// BERT splits into words of their own.
+func isCJK(r rune) bool {
+	return (r >= 0x4E00 && r <= 0x9FFF) || (r >= 0x3400 && r <= 0x4DBF) ||
+		(r >= 0x20000 && r <= 0x2A6DF) || (r >= 0x2A700 && r <= 0x2B73F) ||
+		(r >= 0x2B740 && r <= 0x2B81F) || (r >= 0x2B820 && r <= 0x2CEAF) ||
+		(r >= 0xF900 && r <= 0xFAFF) || (r >= 0x2F800 && r <= 0x2FA1F)
+}
+
+// accentsStripped maps the precomposed Latin letters with accents to the
+// letters that their canonical decomposition starts with, as stripping the
+// combining marks of their NFD form leaves them.
+var accentsStripped = func() map[rune]rune {
+	stripped := make(map[rune]rune)
+	for base, accented := range map[rune]string{
+		'A': "ÀÁÂÃÄÅĀĂĄ", 'a': "àáâãäåāăą", 'C': "ÇĆĈĊČ", 'c': "çćĉċč",
+		'D': "Ď", 'd': "ď", 'E': "ÈÉÊËĒĔĖĘĚ", 'e': "èéêëēĕėęě",
+		'G': "ĜĞĠĢ", 'g': "ĝğġģ", 'H': "Ĥ", 'h': "ĥ", 'I': "ÌÍÎÏĨĪĬĮİ",
+		'i': "ìíîïĩīĭį", 'J': "Ĵ", 'j': "ĵ", 'K': "Ķ", 'k': "ķ",
+		'L': "ĹĻĽ", 'l': "ĺļľ", 'N': "ÑŃŅŇ", 'n': "ñńņň",
+		'O': "ÒÓÔÕÖŌŎŐ", 'o': "òóôõöōŏő", 'R': "ŔŖŘ", 'r': "ŕŗř",
+		'S': "ŚŜŞŠ", 's': "śŝşš", 'T': "ŢŤ", 't': "ţť",
+		'U': "ÙÚÛÜŨŪŬŮŰŲ", 'u': "ùúûüũūŭůűų", 'W': "Ŵ", 'w': "ŵ",
+		'Y': "ÝŶŸ", 'y': "ýÿŷ", 'Z': "ŹŻŽ", 'z': "źżž",
+	} {
+		for _, r := range accented {
+			stripped[r] = base
+		}
+	}
+	return stripped
+}()
+
+// newWordPieceEncoderFromDir returns a WordPieceEncoder for the vocab.txt in
+// dir, lowercasing as its tokenizer_config.json says, which BERT's tokenizer
+// defaults to.
+func newWordPieceEncoderFromDir(dir string) (*WordPieceEncoder, error) {
+	if err := resources.CheckUnsignedAllowed(dir); err != nil {
+		return nil, err
+	}
+	vocab, err := os.ReadFile(path.Join(dir, "vocab.txt"))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrResourceMissing, err)
+	}
+	config := struct {
+		DoLowerCase  *bool `json:"do_lower_case"`
+		StripAccents *bool `json:"strip_accents"`
+	}{}
+	if data, err := os.ReadFile(path.Join(dir,
+		"tokenizer_config.json")); err == nil {
+		if err := json.Unmarshal(data, &config); err != nil {
+			return nil, fmt.Errorf("%w: error unmarshalling "+
+				"tokenizer_config.json: %s", ErrResourceInvalid, err)
+		}
+	}
+	lowerCase := config.DoLowerCase == nil || *config.DoLowerCase
+	// Accents are stripped along with case unless configured otherwise.
+	stripAccents := lowerCase
+	if config.StripAccents != nil {
+		stripAccents = *config.StripAccents
+	}
+	return NewWordPieceEncoder(vocab, lowerCase, stripAccents)
+}
+
+// newWordPieceEncoderFromTokenizerJson
+// Returns a WordPieceEncoder for a tokenizer.json with a WordPiece model, as
+// huggingface saves BERT-family tokenizers. Its added tokens are special
+// tokens, and its BertNormalizer sets whether text is lowercased and its
+// accents stripped.
+func newWordPieceEncoderFromTokenizerJson(
+	data []byte) (*WordPieceEncoder, error) {
+	var tokenizer tokenizerJson
+	if err := json.Unmarshal(data, &tokenizer); err != nil {
+		return nil, fmt.Errorf("%w: error unmarshalling tokenizer.json: %s",
+			ErrResourceInvalid, err)
+	}
+	var vocab map[string]int
+	if err := json.Unmarshal(tokenizer.Model.Vocab, &vocab); err != nil {
+		return nil, fmt.Errorf("%w: tokenizer.json WordPiece vocab: %s",
+			ErrResourceInvalid, err)
+	}
+	pieces := make([]string, 0, len(vocab))
+	setPiece := func(piece string, id int) error {
+		if id < 0 || int64(id) > int64(^Token(0)) {
+			return fmt.Errorf("%w: piece %q has id %d",
+				ErrTokenOutOfRange, piece, id)
+		}
+		for len(pieces) <= id {
+			pieces = append(pieces, "")
+		}
+		pieces[id] = piece
+		return nil
+	}
+	for piece, id := range vocab {
+		if err := setPiece(piece, id); err != nil {
+			return nil, err
+		}
+	}
+	specials := make([]string, 0, len(tokenizer.AddedTokens))
+	for _, added := range tokenizer.AddedTokens {
+		if err := setPiece(added.Content, added.Id); err != nil {
+			return nil, err
+		}
+		specials = append(specials, added.Content)
+	}
+
+	// Without a normalizer, text is neither lowercased nor stripped.
+	lowerCase, stripAccents := false, false
+	if normalizer := tokenizer.Normalizer; normalizer != nil {
+		if normalizer.Type != "BertNormalizer" {
+			return nil, fmt.Errorf("%w: tokenizer.json %s normalizer of a "+
+				"WordPiece model", ErrUnsupportedLayout, normalizer.Type)
+		}
+		lowerCase = normalizer.Lowercase == nil || *normalizer.Lowercase
+		stripAccents = lowerCase
+		if normalizer.StripAccents != nil {
+			stripAccents = *normalizer.StripAccents
+		}
+	}
+	if preTokenizer := tokenizer.PreTokenizer; preTokenizer != nil &&
+		preTokenizer.Type != "BertPreTokenizer" {
+		return nil, fmt.Errorf("%w: tokenizer.json %s pre-tokenizer of a "+
+			"WordPiece model", ErrUnsupportedLayout, preTokenizer.Type)
+	}
+
+	encoder, err := newWordPieceEncoder(pieces, lowerCase, stripAccents)
+	if err != nil {
+		return nil, err
+	}
+	if prefix := tokenizer.Model.ContinuingSubwordPrefix; prefix != nil {
+		encoder.ContinuingPrefix = *prefix
+	}
+	if maxChars := tokenizer.Model.MaxInputCharsPerWord; maxChars != nil {
+		encoder.MaxWordChars = *maxChars
+	}
+	unk := "[UNK]"
+	if tokenizer.Model.UnkToken != nil {
+		unk = *tokenizer.Model.UnkToken
+	}
+	return encoder, encoder.setSpecials(specials, unk)
+}
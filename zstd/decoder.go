@@ -0,0 +1,59 @@
+package zstd
+
+import (
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// decoderOptions are the options of every decoder, which decode on the
+// goroutine that reads, and refuse windows larger than MaxWindowSize.
+var decoderOptions = []zstd.DOption{
+	zstd.WithDecoderConcurrency(1),
+	zstd.WithDecoderMaxWindow(MaxWindowSize),
+	zstd.WithDecoderLowmem(true),
+}
+
+// allDecoder decompresses whole buffers for Decompress, and is safe for
+// concurrent use.
+var allDecoder, _ = zstd.NewReader(nil, decoderOptions...)
+
+// Reader
+// Decompresses a stream of concatenated Zstandard frames, skipping any
+// skippable frames. Only a window of recently decoded data is kept in memory,
+// so arbitrarily large frames can be streamed.
+type Reader struct {
+	decoder *zstd.Decoder
+	err     error
+}
+
+// NewReader
+// Creates a Reader that decompresses the frames read from in.
+func NewReader(in io.Reader) *Reader {
+	decoder, err := zstd.NewReader(in, decoderOptions...)
+	return &Reader{decoder: decoder, err: err}
+}
+
+// Decompress
+// Appends the decompressed contents of all the frames in src to dst.
+func Decompress(dst, src []byte) ([]byte, error) {
+	return allDecoder.DecodeAll(src, dst)
+}
+
+// Read
+// Implements io.Reader over the decompressed stream.
+func (r *Reader) Read(p []byte) (int, error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+	return r.decoder.Read(p)
+}
+
+// Close
+// Releases the Reader's resources. It does not close the underlying reader.
+func (r *Reader) Close() error {
+	if r.decoder != nil {
+		r.decoder.Close()
+	}
+	return nil
+}
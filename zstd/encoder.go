@@ -0,0 +1,123 @@
+package zstd
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// The compression levels of an Encoder, which are those of the reference
+// zstd. They select the closest of klauspost/compress's speeds: levels 1 and
+// 2 are its fastest, 3 to 5 its default, 6 to 9 its better, and 10 and above
+// its best compression.
+const (
+	MinLevel     = 1
+	DefaultLevel = 3
+	MaxLevel     = 22
+)
+
+// Encoder
+// Compresses data into Zstandard frames. It is safe for concurrent use.
+type Encoder struct {
+	encoder *zstd.Encoder
+}
+
+// defaultEncoder is the Encoder of Compress.
+var defaultEncoder = NewEncoder()
+
+// NewEncoder
+// Creates an Encoder of DefaultLevel.
+func NewEncoder() *Encoder {
+	encoder, _ := NewEncoderLevel(DefaultLevel)
+	return encoder
+}
+
+// NewEncoderLevel
+// Creates an Encoder of a level from MinLevel to MaxLevel, where a level of
+// zero is DefaultLevel.
+func NewEncoderLevel(level int) (*Encoder, error) {
+	if level == 0 {
+		level = DefaultLevel
+	}
+	if level < MinLevel || level > MaxLevel {
+		return nil, fmt.Errorf("%w: %d, expected %d to %d", ErrLevel,
+			level, MinLevel, MaxLevel)
+	}
+	encoder, err := zstd.NewWriter(nil,
+		zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(level)),
+		zstd.WithEncoderConcurrency(1),
+		zstd.WithEncoderCRC(true),
+		zstd.WithZeroFrames(true))
+	if err != nil {
+		return nil, err
+	}
+	return &Encoder{encoder: encoder}, nil
+}
+
+// Compress
+// Appends src, compressed as a single frame, to dst.
+func Compress(dst, src []byte) []byte {
+	return defaultEncoder.EncodeAll(dst, src)
+}
+
+// EncodeAll
+// Appends src, compressed as a single frame, to dst. The frame records the
+// content size and a checksum of the content.
+func (enc *Encoder) EncodeAll(dst, src []byte) []byte {
+	return enc.encoder.EncodeAll(src, dst)
+}
+
+// Writer
+// Compresses the data written to it into a series of independent frames.
+// Data is buffered until at least FrameSize bytes are pending at the end of
+// a Write, or until Flush is called, so a FrameSize of one produces a frame
+// per Write.
+type Writer struct {
+	FrameSize int
+	w         io.Writer
+	enc       *Encoder
+	buf       []byte
+	out       []byte
+}
+
+// NewWriter
+// Creates a Writer that writes frames of at least frameSize bytes of
+// content to w.
+func NewWriter(w io.Writer, frameSize int) *Writer {
+	return &Writer{
+		FrameSize: frameSize,
+		w:         w,
+		enc:       defaultEncoder,
+	}
+}
+
+// Write
+// Buffers p, and writes a frame once FrameSize bytes are pending.
+func (zw *Writer) Write(p []byte) (int, error) {
+	zw.buf = append(zw.buf, p...)
+	if len(zw.buf) >= zw.FrameSize {
+		if err := zw.Flush(); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// Flush
+// Writes any pending data as a frame.
+func (zw *Writer) Flush() error {
+	if len(zw.buf) == 0 {
+		return nil
+	}
+	zw.out = zw.enc.EncodeAll(zw.out[:0], zw.buf)
+	zw.buf = zw.buf[:0]
+	_, err := zw.w.Write(zw.out)
+	return err
+}
+
+// Close
+// Flushes any pending data. It does not close the underlying writer.
+func (zw *Writer) Close() error {
+	return zw.Flush()
+}
@@ -0,0 +1,36 @@
+// Package zstd compresses and decompresses Zstandard (RFC 8878) frames for
+// tokenized datasets, using github.com/klauspost/compress/zstd.
+//
+// Data is compressed into independent frames that record their content size
+// and a checksum, so that frames may be written in parallel and concatenated,
+// and streams of concatenated frames are decompressed as one.
+package zstd
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+const (
+	frameMagic         = 0xFD2FB528
+	skippableMagicMask = 0xFFFFFFF0
+	skippableMagic     = 0x184D2A50
+
+	// MaxWindowSize is the largest window that the decoder will allocate.
+	MaxWindowSize = 1 << 27
+)
+
+// ErrLevel is returned for compression levels out of MinLevel to MaxLevel.
+var ErrLevel = errors.New("zstd: invalid compression level")
+
+// IsFrame
+// Returns true if data starts with a Zstandard or skippable frame magic
+// number.
+func IsFrame(data []byte) bool {
+	if len(data) < 4 {
+		return false
+	}
+	magic := binary.LittleEndian.Uint32(data)
+	return magic == frameMagic ||
+		magic&skippableMagicMask == skippableMagic
+}
@@ -0,0 +1,39 @@
+//go:build go1.18
+
+package zstd
+
+import (
+	"bytes"
+	"testing"
+)
+
+func FuzzCompress(f *testing.F) {
+	for _, seed := range [][]byte{{}, []byte("hello, world"), fixtureText(),
+		alphabetData(1268, 32), tokenLikeData(4096)} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		for _, level := range []int{MinLevel, DefaultLevel, 9, MaxLevel} {
+			encoder, err := NewEncoderLevel(level)
+			if err != nil {
+				t.Fatal(err)
+			}
+			compressed := encoder.EncodeAll(nil, data)
+			decompressed, err := Decompress(nil, compressed)
+			if err != nil {
+				t.Fatalf("level %d: %v", level, err)
+			} else if !bytes.Equal(data, decompressed) {
+				t.Fatalf("level %d: round trip mismatch", level)
+			}
+		}
+	})
+}
+
+func FuzzDecompress(f *testing.F) {
+	f.Add(Compress(nil, fixtureText()))
+	f.Add([]byte("not zstd"))
+	// Arbitrary input must be rejected, not crash the decoder.
+	f.Fuzz(func(t *testing.T, data []byte) {
+		Decompress(nil, data)
+	})
+}
@@ -0,0 +1,244 @@
+package zstd
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// referenceFrame is fixtureText compressed with the reference `zstd -19`,
+// which uses Huffman literals, FSE compressed sequence tables and repeat
+// offsets.
+const referenceFrame = "28b52ffd64dc07d5050092881a1860770e0f253d94f40805f51" +
+	"4452d11116493925a1404a1251befdc93ddfb072bcf1de5df21af3bc38efbe5a0e59e" +
+	"63fcc2feee8bcc874efee78edf078ee53bcbd83f5460759a84633d8a40866adbd0e84" +
+	"c2a9de605291539d6a2ab1974e8834113a14ca15892ce440844a821c4afff77503997" +
+	"0312f8bf41005a117c300a26ce731a47300deab82b408b4b6aab1c5a5a654d6ea4ae1" +
+	"fbb7355b795b84c405584b735bcadd693e8bcfbda2059b471c9e6af1670036415b620" +
+	"84af"
+
+func fixtureText() []byte {
+	var builder strings.Builder
+	for i := 0; i < 40; i++ {
+		builder.WriteString(fmt.Sprintf(
+			"The quick brown fox %d jumps over the lazy dog number %d. ",
+			i*7%13, i*i%31))
+	}
+	return []byte(builder.String())
+}
+
+func TestDecompress_Reference(t *testing.T) {
+	frame, _ := hex.DecodeString(referenceFrame)
+	decompressed, err := Decompress(nil, frame)
+	assert.Nil(t, err)
+	assert.Equal(t, fixtureText(), decompressed)
+
+	decompressed, err = io.ReadAll(NewReader(bytes.NewReader(frame)))
+	assert.Nil(t, err)
+	assert.Equal(t, fixtureText(), decompressed)
+
+	// Corrupting the checksum must be detected.
+	frame[len(frame)-1] ^= 0xff
+	_, err = Decompress(nil, frame)
+	assert.NotNil(t, err)
+
+	_, err = Decompress(nil, []byte("not zstd"))
+	assert.NotNil(t, err)
+}
+
+// tokenLikeData returns little endian uint16 values with a skewed
+// distribution and repeated runs, resembling tokenized text.
+func tokenLikeData(n int) []byte {
+	rng := rand.New(rand.NewSource(0))
+	data := make([]byte, 0, n*2)
+	phrases := make([][]uint16, 64)
+	for i := range phrases {
+		phrases[i] = make([]uint16, 2+rng.Intn(12))
+		for j := range phrases[i] {
+			phrases[i][j] = uint16(rng.ExpFloat64() * 2000)
+		}
+	}
+	for len(data) < n*2 {
+		var token [2]byte
+		if rng.Intn(3) == 0 {
+			for _, t := range phrases[rng.Intn(len(phrases))] {
+				binary.LittleEndian.PutUint16(token[:], t)
+				data = append(data, token[:]...)
+			}
+		} else {
+			binary.LittleEndian.PutUint16(token[:],
+				uint16(rng.ExpFloat64()*5000))
+			data = append(data, token[:]...)
+		}
+	}
+	return data[:n*2]
+}
+
+// alphabetData returns n random bytes of an alphabet of size symbols.
+func alphabetData(n int, size int) []byte {
+	rng := rand.New(rand.NewSource(int64(n)))
+	data := make([]byte, n)
+	for i := range data {
+		data[i] = byte('A' + rng.Intn(size))
+	}
+	return data
+}
+
+func TestCompress_RoundTrip(t *testing.T) {
+	random := make([]byte, 300000)
+	rand.New(rand.NewSource(1)).Read(random)
+	frankenstein, _ := os.ReadFile("../resources/frankenstein.txt")
+	inputs := map[string][]byte{
+		"empty":        {},
+		"byte":         {42},
+		"short":        []byte("hello, world"),
+		"rle":          bytes.Repeat([]byte{0xff}, 300000),
+		"repeat":       bytes.Repeat([]byte("abcdefgh"), 50000),
+		"random":       random,
+		"tokens":       tokenLikeData(400000),
+		"fixture":      fixtureText(),
+		"alphabet":     alphabetData(1268, 32),
+		"frankenstein": frankenstein,
+	}
+	for name, input := range inputs {
+		compressed := Compress(nil, input)
+		assert.True(t, IsFrame(compressed), name)
+		decompressed, err := Decompress(nil, compressed)
+		assert.Nil(t, err, name)
+		assert.True(t, bytes.Equal(input, decompressed), name)
+		if name == "tokens" || name == "repeat" || name == "frankenstein" {
+			assert.Less(t, len(compressed), len(input)*2/3, name)
+		}
+	}
+}
+
+func TestEncoderLevel(t *testing.T) {
+	frankenstein, _ := os.ReadFile("../resources/frankenstein.txt")
+	input := append(frankenstein, tokenLikeData(400000)...)
+	sizes := make(map[int]int)
+	for _, level := range []int{MinLevel, DefaultLevel, 9, MaxLevel} {
+		encoder, err := NewEncoderLevel(level)
+		if !assert.Nil(t, err, level) {
+			continue
+		}
+		compressed := encoder.EncodeAll(nil, input)
+		decompressed, err := Decompress(nil, compressed)
+		assert.Nil(t, err, level)
+		assert.True(t, bytes.Equal(input, decompressed), level)
+		sizes[level] = len(compressed)
+	}
+	assert.LessOrEqual(t, sizes[MaxLevel], sizes[DefaultLevel])
+	assert.LessOrEqual(t, sizes[DefaultLevel], sizes[MinLevel])
+	// The default level compresses as Compress does.
+	assert.Equal(t, len(Compress(nil, input)), sizes[DefaultLevel])
+
+	// A level of zero is the default level.
+	encoder, err := NewEncoderLevel(0)
+	assert.Nil(t, err)
+	assert.Equal(t, len(Compress(nil, input)),
+		len(encoder.EncodeAll(nil, input)))
+
+	_, err = NewEncoderLevel(MaxLevel + 1)
+	assert.ErrorIs(t, err, ErrLevel)
+	_, err = NewEncoderLevel(-1)
+	assert.ErrorIs(t, err, ErrLevel)
+}
+
+func TestWriter_Frames(t *testing.T) {
+	contextSize := 4096
+	data := tokenLikeData(contextSize * 25)
+	for _, frameSize := range []int{1, 64 * 1024, 1 << 30} {
+		var compressed bytes.Buffer
+		writer := NewWriter(&compressed, frameSize)
+		for start := 0; start < len(data); start += contextSize {
+			end := start + contextSize
+			if end > len(data) {
+				end = len(data)
+			}
+			_, err := writer.Write(data[start:end])
+			assert.Nil(t, err)
+		}
+		assert.Nil(t, writer.Close())
+
+		decompressed, err := io.ReadAll(NewReader(&compressed))
+		assert.Nil(t, err)
+		assert.True(t, bytes.Equal(data, decompressed))
+	}
+
+	// With a frame size of one, each Write is an independent frame.
+	var compressed bytes.Buffer
+	writer := NewWriter(&compressed, 1)
+	expected := make([]byte, 0)
+	for start := 0; start < len(data); start += contextSize {
+		_, err := writer.Write(data[start : start+contextSize])
+		assert.Nil(t, err)
+		expected = Compress(expected, data[start:start+contextSize])
+	}
+	assert.Nil(t, writer.Close())
+	assert.Equal(t, expected, compressed.Bytes())
+}
+
+// referenceZstd runs the reference zstd command with args on input, and
+// returns its output, skipping the test if zstd is not installed.
+func referenceZstd(t *testing.T, input []byte, args ...string) []byte {
+	path, err := exec.LookPath("zstd")
+	if err != nil {
+		t.Skip("the reference zstd command is not installed")
+	}
+	cmd := exec.Command(path, append(args, "-c", "-q")...)
+	cmd.Stdin = bytes.NewReader(input)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	if err != nil {
+		t.Fatalf("zstd %s: %v: %s", strings.Join(args, " "), err,
+			stderr.String())
+	}
+	return output
+}
+
+func TestCompress_ReferenceInterop(t *testing.T) {
+	frankenstein, _ := os.ReadFile("../resources/frankenstein.txt")
+	inputs := map[string][]byte{
+		"empty":        {},
+		"short":        []byte("hello, world"),
+		"alphabet":     alphabetData(1268, 32),
+		"tokens":       tokenLikeData(400000),
+		"frankenstein": frankenstein,
+	}
+	for name, input := range inputs {
+		// Frames of every level are decompressed by the reference zstd.
+		for _, level := range []int{MinLevel, DefaultLevel, 9, MaxLevel} {
+			encoder, err := NewEncoderLevel(level)
+			if !assert.Nil(t, err, level) {
+				continue
+			}
+			compressed := encoder.EncodeAll(nil, input)
+			assert.Equal(t, input, append([]byte{},
+				referenceZstd(t, compressed, "-d")...), name, level)
+		}
+		// And the reference zstd's frames are decompressed, concatenated.
+		for _, args := range [][]string{{"-1"}, {"-19"},
+			{"--long=27", "--ultra", "-22"}} {
+			compressed := referenceZstd(t, input, args...)
+			compressed = append(compressed, compressed...)
+			decompressed, err := Decompress(nil, compressed)
+			assert.Nil(t, err, name, args)
+			assert.Equal(t, append(append([]byte{}, input...), input...),
+				append([]byte{}, decompressed...), name, args)
+		}
+	}
+
+	// Compress is about as good as the reference zstd at the same level.
+	reference := referenceZstd(t, frankenstein, "-3")
+	assert.Less(t, len(Compress(nil, frankenstein)), len(reference)*11/10)
+}